@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -28,8 +29,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/version"
+	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/mattn/go-isatty"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/urfave/cli/v2"
 )
 
@@ -61,12 +70,70 @@ type benchmark struct {
 	big, small *benchCase
 	threads    int
 	tmpdir     string
+	jfs        *fs.FileSystem // run against it instead of the local path if not nil
+}
+
+// jfsFile adapts a file in JuiceFS to io.ReadWriteCloser.
+type jfsFile struct {
+	*fs.File
+}
+
+func (f jfsFile) Read(b []byte) (int, error) {
+	return f.File.Read(meta.Background, b)
+}
+
+func (f jfsFile) Write(b []byte) (int, error) {
+	n, e := f.File.Write(meta.Background, b)
+	if e != 0 {
+		return n, e
+	}
+	return n, nil
+}
+
+func (f jfsFile) Close() error {
+	if e := f.File.Close(meta.Background); e != 0 {
+		return e
+	}
+	return nil
+}
+
+func (bm *benchmark) create(fname string) (io.WriteCloser, error) {
+	if bm.jfs == nil {
+		return os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	}
+	f, e := bm.jfs.Create(meta.Background, fname, 0644)
+	if e != 0 {
+		return nil, e
+	}
+	return jfsFile{f}, nil
+}
+
+func (bm *benchmark) open(fname string) (io.ReadCloser, error) {
+	if bm.jfs == nil {
+		return os.Open(fname)
+	}
+	f, e := bm.jfs.Open(meta.Background, fname, vfs.MODE_MASK_R)
+	if e != 0 {
+		return nil, e
+	}
+	return jfsFile{f}, nil
+}
+
+func (bm *benchmark) stat(fname string) error {
+	if bm.jfs == nil {
+		_, err := os.Stat(fname)
+		return err
+	}
+	if _, e := bm.jfs.Stat(meta.Background, fname); e != 0 {
+		return e
+	}
+	return nil
 }
 
 func (bc *benchCase) writeFiles(index int) {
 	for i := 0; i < bc.fcount; i++ {
 		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
-		fp, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		fp, err := bc.bm.create(fname)
 		if err != nil {
 			logger.Fatalf("Failed to open file %s: %s", fname, err)
 		}
@@ -85,13 +152,13 @@ func (bc *benchCase) writeFiles(index int) {
 func (bc *benchCase) readFiles(index int) {
 	for i := 0; i < bc.fcount; i++ {
 		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
-		fp, err := os.Open(fname)
+		fp, err := bc.bm.open(fname)
 		if err != nil {
 			logger.Fatalf("Failed to open file %s: %s", fname, err)
 		}
 		buf := make([]byte, bc.bsize)
 		for j := 0; j < bc.bcount; j++ {
-			if n, err := fp.Read(buf); err != nil || n != bc.bsize {
+			if n, err := io.ReadFull(fp, buf); err != nil || n != bc.bsize {
 				logger.Fatalf("Failed to read file %s: %d %s", fname, n, err)
 			}
 			bc.rbar.Increment()
@@ -103,7 +170,7 @@ func (bc *benchCase) readFiles(index int) {
 func (bc *benchCase) statFiles(index int) {
 	for i := 0; i < bc.fcount; i++ {
 		fname := fmt.Sprintf("%s/%s.%d.%d", bc.bm.tmpdir, bc.name, index, i)
-		if _, err := os.Stat(fname); err != nil {
+		if err := bc.bm.stat(fname); err != nil {
 			logger.Fatalf("Failed to stat file %s: %s", fname, err)
 		}
 		bc.sbar.Increment()
@@ -246,6 +313,89 @@ func (bm *benchmark) printResult(result [][3]string) {
 	fmt.Println(divider)
 }
 
+// newSimulatedFS creates an in-memory volume on an object storage with the performance in perf.
+func newSimulatedFS(perf *object.SimulatedPerf) *fs.FileSystem {
+	m := meta.NewClient("memkv://", &meta.Config{Retries: 10, Strict: true, AtimeMode: meta.NoAtime})
+	format := &meta.Format{
+		Name:        "bench",
+		UUID:        uuid.New().String(),
+		Storage:     "mem",
+		BlockSize:   4096,
+		Compression: "none",
+	}
+	if err := m.Init(*format, true); err != nil {
+		logger.Fatalf("Init simulated volume: %s", err)
+	}
+	meta.InitMetrics()
+	blob, err := object.CreateStorage("mem", "", "", "")
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	blob = object.Simulate(blob, *perf)
+	chunkConf := chunk.Config{
+		BlockSize: format.BlockSize * 1024,
+		Compress:  format.Compression,
+
+		GetTimeout:  time.Second * 60,
+		PutTimeout:  time.Second * 60,
+		UploadRetry: time.Minute * 5,
+		MaxUpload:   20,
+		BufferSize:  300 << 20,
+		CacheDir:    "memory", // no cache, so every read goes to the object storage
+	}
+	store := chunk.NewCachedStore(blob, chunkConf)
+	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
+		chunkid := args[0].(uint64)
+		length := args[1].(uint32)
+		return store.Remove(chunkid, int(length))
+	})
+	if err = m.NewSession(); err != nil {
+		logger.Fatalf("new session: %s", err)
+	}
+	conf := &vfs.Config{
+		Meta:            &meta.Config{Retries: 10},
+		Format:          format,
+		Version:         version.Version(),
+		AttrTimeout:     time.Second,
+		EntryTimeout:    time.Second,
+		DirEntryTimeout: time.Second,
+		Chunk:           &chunkConf,
+	}
+	jfs, err := fs.NewFileSystem(conf, m, store)
+	if err != nil {
+		logger.Fatalf("initialize: %s", err)
+	}
+	return jfs
+}
+
+// gatherStats collects the metrics of current process in the same format as .stats.
+func gatherStats() map[string]float64 {
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		logger.Warnf("gather metrics: %s", err)
+		return nil
+	}
+	stats := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			name := "juicefs_" + mf.GetName()
+			for _, l := range m.Label {
+				name += "_" + l.GetValue()
+			}
+			switch {
+			case m.Counter != nil:
+				stats[name] = m.Counter.GetValue()
+			case m.Gauge != nil:
+				stats[name] = m.Gauge.GetValue()
+			case m.Histogram != nil:
+				stats[name+"_total"] = float64(m.Histogram.GetSampleCount())
+				stats[name+"_sum"] = m.Histogram.GetSampleSum()
+			}
+		}
+	}
+	return stats
+}
+
 func bench(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
 
@@ -253,12 +403,22 @@ func bench(ctx *cli.Context) error {
 	if ctx.Uint("block-size") == 0 || ctx.Uint("threads") == 0 {
 		return os.ErrInvalid
 	}
-	if ctx.NArg() < 1 {
-		logger.Fatalln("PATH must be provided")
-	}
-	tmpdir, err := filepath.Abs(ctx.Args().First())
-	if err != nil {
-		logger.Fatalf("Failed to get absolute path of %s: %s", ctx.Args().First(), err)
+	var perf *object.SimulatedPerf
+	var tmpdir string
+	var err error
+	if ctx.IsSet("simulate") {
+		if perf, err = object.ParseSimulatedPerf(ctx.String("simulate")); err != nil {
+			logger.Fatalf("Invalid performance of object storage: %s", err)
+		}
+		tmpdir = "/"
+	} else {
+		if ctx.NArg() < 1 {
+			logger.Fatalln("PATH must be provided")
+		}
+		tmpdir, err = filepath.Abs(ctx.Args().First())
+		if err != nil {
+			logger.Fatalf("Failed to get absolute path of %s: %s", ctx.Args().First(), err)
+		}
 	}
 	tmpdir = filepath.Join(tmpdir, fmt.Sprintf("__juicefs_benchmark_%d__", time.Now().UnixNano()))
 	bm := newBenchmark(tmpdir, int(ctx.Uint("block-size")), int(ctx.Uint("big-file-size")),
@@ -266,43 +426,54 @@ func bench(ctx *cli.Context) error {
 	if bm.big == nil && bm.small == nil {
 		return os.ErrInvalid
 	}
-	var purgeArgs []string
-	if os.Getuid() != 0 {
-		purgeArgs = append(purgeArgs, "sudo")
-	}
-	switch runtime.GOOS {
-	case "darwin":
-		purgeArgs = append(purgeArgs, "purge")
-	case "linux":
-		purgeArgs = append(purgeArgs, "/bin/sh", "-c", "echo 3 > /proc/sys/vm/drop_caches")
-	default:
-		logger.Fatal("Currently only support Linux/macOS")
-	}
 
 	/* --- Prepare --- */
-	if _, err := os.Stat(bm.tmpdir); os.IsNotExist(err) {
-		if err = os.MkdirAll(bm.tmpdir, 0755); err != nil {
-			logger.Fatalf("Failed to create %s: %s", bm.tmpdir, err)
+	var readBenchStats func() map[string]float64
+	dropCaches := func() {}
+	if perf != nil {
+		bm.jfs = newSimulatedFS(perf)
+		if e := bm.jfs.Mkdir(meta.Background, bm.tmpdir, 0755); e != 0 {
+			logger.Fatalf("Failed to create %s: %s", bm.tmpdir, e)
 		}
-	}
-	var statsPath string
-	for mp := filepath.Dir(bm.tmpdir); mp != "/"; mp = filepath.Dir(mp) {
-		if _, err := os.Stat(filepath.Join(mp, ".stats")); err == nil {
-			statsPath = filepath.Join(mp, ".stats")
-			break
+		readBenchStats = gatherStats
+	} else {
+		var purgeArgs []string
+		if os.Getuid() != 0 {
+			purgeArgs = append(purgeArgs, "sudo")
 		}
-	}
-	dropCaches := func() {
-		if os.Getenv("SKIP_DROP_CACHES") != "true" {
-			if err := exec.Command(purgeArgs[0], purgeArgs[1:]...).Run(); err != nil {
-				logger.Warnf("Failed to clean kernel caches: %s", err)
+		switch runtime.GOOS {
+		case "darwin":
+			purgeArgs = append(purgeArgs, "purge")
+		case "linux":
+			purgeArgs = append(purgeArgs, "/bin/sh", "-c", "echo 3 > /proc/sys/vm/drop_caches")
+		default:
+			logger.Fatal("Currently only support Linux/macOS")
+		}
+
+		if _, err := os.Stat(bm.tmpdir); os.IsNotExist(err) {
+			if err = os.MkdirAll(bm.tmpdir, 0755); err != nil {
+				logger.Fatalf("Failed to create %s: %s", bm.tmpdir, err)
 			}
-		} else {
-			logger.Warnf("Clear cache operation has been skipped")
 		}
-	}
-	if os.Getuid() != 0 {
-		fmt.Println("Cleaning kernel cache, may ask for root privilege...")
+		for mp := filepath.Dir(bm.tmpdir); mp != "/"; mp = filepath.Dir(mp) {
+			if _, err := os.Stat(filepath.Join(mp, ".stats")); err == nil {
+				statsPath := filepath.Join(mp, ".stats")
+				readBenchStats = func() map[string]float64 { return readStats(statsPath) }
+				break
+			}
+		}
+		dropCaches = func() {
+			if os.Getenv("SKIP_DROP_CACHES") != "true" {
+				if err := exec.Command(purgeArgs[0], purgeArgs[1:]...).Run(); err != nil {
+					logger.Warnf("Failed to clean kernel caches: %s", err)
+				}
+			} else {
+				logger.Warnf("Clear cache operation has been skipped")
+			}
+		}
+		if os.Getuid() != 0 {
+			fmt.Println("Cleaning kernel cache, may ask for root privilege...")
+		}
 	}
 	dropCaches()
 	bm.tty = isatty.IsTerminal(os.Stdout.Fd())
@@ -321,8 +492,8 @@ func bench(ctx *cli.Context) error {
 
 	/* --- Run Benchmark --- */
 	var stats map[string]float64
-	if statsPath != "" {
-		stats = readStats(statsPath)
+	if readBenchStats != nil {
+		stats = readBenchStats()
 	}
 	var result [][3]string
 	if b := bm.big; b != nil {
@@ -368,7 +539,11 @@ func bench(ctx *cli.Context) error {
 	progress.Done()
 
 	/* --- Clean-up --- */
-	if err := exec.Command("rm", "-rf", bm.tmpdir).Run(); err != nil {
+	if bm.jfs != nil {
+		if e := bm.jfs.Rmr(meta.Background, bm.tmpdir); e != 0 {
+			logger.Warnf("Failed to cleanup %s: %s", bm.tmpdir, e)
+		}
+	} else if err := exec.Command("rm", "-rf", bm.tmpdir).Run(); err != nil {
 		logger.Warnf("Failed to cleanup %s: %s", bm.tmpdir, err)
 	}
 
@@ -376,8 +551,11 @@ func bench(ctx *cli.Context) error {
 	fmt.Println("Benchmark finished!")
 	fmt.Printf("BlockSize: %d MiB, BigFileSize: %d MiB, SmallFileSize: %d KiB, SmallFileCount: %d, NumThreads: %d\n",
 		ctx.Uint("block-size"), ctx.Uint("big-file-size"), ctx.Uint("small-file-size"), ctx.Uint("small-file-count"), ctx.Uint("threads"))
+	if perf != nil {
+		fmt.Printf("Simulated object storage: %s\n", perf)
+	}
 	if stats != nil {
-		stats2 := readStats(statsPath)
+		stats2 := readBenchStats()
 		diff := func(item string) float64 {
 			return stats2["juicefs_"+item] - stats["juicefs_"+item]
 		}
@@ -393,22 +571,26 @@ func bench(ctx *cli.Context) error {
 			line[2] += " ms/op"
 			result = append(result, line)
 		}
-		show("FUSE operation", "fuse", "fuse_ops_durations_histogram_seconds")
+		if bm.jfs == nil {
+			show("FUSE operation", "fuse", "fuse_ops_durations_histogram_seconds")
+		}
 		show("Update meta", "meta", "transaction_durations_histogram_seconds")
 		show("Put object", "put", "object_request_durations_histogram_seconds_PUT")
 		show("Get object", "get", "object_request_durations_histogram_seconds_GET")
 		show("Delete object", "delete", "object_request_durations_histogram_seconds_DELETE")
-		show("Write into cache", "cachewr", "blockcache_write_hist_seconds")
-		show("Read from cache", "cacherd", "blockcache_read_hist_seconds")
-		var fmtString string
-		if bm.tty {
-			greenSeq := fmt.Sprintf("%s%dm", COLOR_SEQ, GREEN)
-			fmtString = fmt.Sprintf("Time used: %s%%.1f%s s, CPU: %s%%.1f%s%%%%, Memory: %s%%.1f%s MiB\n",
-				greenSeq, RESET_SEQ, greenSeq, RESET_SEQ, greenSeq, RESET_SEQ)
-		} else {
-			fmtString = "Time used: %.1f s, CPU: %.1f%%, Memory: %.1f MiB\n"
+		if bm.jfs == nil { // there is no cache or process metrics for the simulated volume
+			show("Write into cache", "cachewr", "blockcache_write_hist_seconds")
+			show("Read from cache", "cacherd", "blockcache_read_hist_seconds")
+			var fmtString string
+			if bm.tty {
+				greenSeq := fmt.Sprintf("%s%dm", COLOR_SEQ, GREEN)
+				fmtString = fmt.Sprintf("Time used: %s%%.1f%s s, CPU: %s%%.1f%s%%%%, Memory: %s%%.1f%s MiB\n",
+					greenSeq, RESET_SEQ, greenSeq, RESET_SEQ, greenSeq, RESET_SEQ)
+			} else {
+				fmtString = "Time used: %.1f s, CPU: %.1f%%, Memory: %.1f MiB\n"
+			}
+			fmt.Printf(fmtString, diff("uptime"), diff("cpu_usage")*100/diff("uptime"), stats2["juicefs_memory"]/1024/1024)
 		}
-		fmt.Printf(fmtString, diff("uptime"), diff("cpu_usage")*100/diff("uptime"), stats2["juicefs_memory"]/1024/1024)
 	}
 	bm.printResult(result)
 	return nil
@@ -421,6 +603,10 @@ func benchFlags() *cli.Command {
 		Action:    bench,
 		ArgsUsage: "PATH",
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "simulate",
+				Usage: "run against an in-memory volume on a simulated object storage instead of PATH, e.g. \"latency=50ms,bandwidth=1000,error-rate=0.001\" (bandwidth in Mbps)",
+			},
 			&cli.UintFlag{
 				Name:  "block-size",
 				Value: 1,
@@ -0,0 +1,65 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func brokerFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "meta-broker",
+		Usage:     "share Redis connections among the clients on this host",
+		ArgsUsage: "META-URL SOCKET",
+		Action:    metaBroker,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "connections",
+				Value: 16,
+				Usage: "max number of connections to Redis",
+			},
+		},
+	}
+}
+
+func metaBroker(c *cli.Context) error {
+	setLoggerLevel(c)
+	if c.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and SOCKET are needed")
+	}
+	addr := c.Args().Get(0)
+	b, err := meta.NewRedisBroker(addr, c.Int("connections"))
+	if err != nil {
+		logger.Fatalf("broker: %s", err)
+	}
+	sock := c.Args().Get(1)
+	_ = os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		logger.Fatalf("listen on %s: %s", sock, err)
+	}
+	if err = os.Chmod(sock, 0600); err != nil {
+		logger.Warnf("chmod %s: %s", sock, err)
+	}
+	logger.Infof("Broker is listening on %s with at most %d connections", sock, c.Int("connections"))
+	return b.Serve(l)
+}
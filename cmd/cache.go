@@ -0,0 +1,524 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+// names of the entries in the tarball of exported cache, in the order of writing
+const (
+	cacheVolumeEntry   = "volume"   // UUID of the volume
+	cacheManifestEntry = "manifest" // keys of the cached blocks, the same as the manifest of warmup
+	cacheBlockPrefix   = "blocks/"  // data of the blocks, followed by their keys
+)
+
+// number of blocks extracted into the temporary directory before loading them into cache
+const loadBatch = 256
+
+func cacheFlags() *cli.Command {
+	return &cli.Command{
+		Name:  "cache",
+		Usage: "export, import or hand off the cache of a mount point, so new clients can start warm",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "export",
+				Usage:     "export the keys (and data) of cached blocks into a tarball",
+				ArgsUsage: "MOUNTPOINT FILE",
+				Action:    cacheExport,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "blocks",
+						Usage: "export the data of blocks cached on disk too, otherwise they are downloaded from object storage when imported",
+					},
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "build cache from a tarball exported by another client of the same volume",
+				ArgsUsage: "MOUNTPOINT FILE",
+				Action:    cacheImport,
+				Flags: []cli.Flag{
+					&cli.UintFlag{
+						Name:    "threads",
+						Aliases: []string{"p"},
+						Value:   50,
+						Usage:   "number of concurrent workers",
+					},
+					&cli.StringFlag{
+						Name:  "temp-dir",
+						Value: os.TempDir(),
+						Usage: "directory to extract the blocks into before loading them into cache",
+					},
+				},
+			},
+			{
+				Name:      "handoff",
+				Usage:     "take over the hottest cached blocks of a client being drained, by copying them from it",
+				ArgsUsage: "MOUNTPOINT ADDR",
+				Action:    cacheHandoff,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "number of the hottest blocks to take over, 0 means all",
+					},
+					&cli.UintFlag{
+						Name:    "threads",
+						Aliases: []string{"p"},
+						Value:   50,
+						Usage:   "number of concurrent workers",
+					},
+					&cli.StringFlag{
+						Name:  "temp-dir",
+						Value: os.TempDir(),
+						Usage: "directory to download the blocks into before loading them into cache",
+					},
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Value: time.Minute,
+						Usage: "timeout of each request to the client",
+					},
+				},
+			},
+		},
+	}
+}
+
+// readReply reads the reply of a message from the controller, which is an errno if it has only one byte.
+func readReply(cf *os.File, what string) []byte {
+	data := make([]byte, 4)
+	n, err := io.ReadFull(cf, data)
+	if n == 1 {
+		if eno := syscall.Errno(data[0]); eno == syscall.EINVAL {
+			logger.Fatalf("%s is not supported, please upgrade and mount again", what)
+		} else {
+			logger.Fatalf("%s: %s", what, eno)
+		}
+	}
+	if err != nil {
+		logger.Fatalf("read size: %d %s", n, err)
+	}
+	data = make([]byte, utils.ReadBuffer(data).Get32())
+	if _, err = io.ReadFull(cf, data); err != nil {
+		logger.Fatalf("read reply: %s", err)
+	}
+	return data
+}
+
+func addTarFile(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+func cacheExport(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("MOUNTPOINT and FILE are needed")
+	}
+	mp := findMountpoint(ctx.Args().Get(0))
+	cf := openController(mp)
+	if cf == nil {
+		logger.Fatalf("Failed to open control file under %s", mp)
+	}
+	defer cf.Close()
+	wb := utils.NewBuffer(8)
+	wb.Put32(meta.ListCache)
+	wb.Put32(0)
+	if _, err := cf.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(readReply(cf, "list cache")), "\n"), "\n")
+	uuid, lines := lines[0], lines[1:]
+
+	fname := ctx.Args().Get(1)
+	var out io.WriteCloser = os.Stdout
+	if fname != "-" {
+		f, err := os.Create(fname)
+		if err != nil {
+			logger.Fatalf("create %s: %s", fname, err)
+		}
+		out = f
+	}
+	tw := tar.NewWriter(out)
+	if err := addTarFile(tw, cacheVolumeEntry, int64(len(uuid)), strings.NewReader(uuid)); err != nil {
+		logger.Fatalf("write %s: %s", cacheVolumeEntry, err)
+	}
+	keys := make([]string, len(lines))
+	for i, l := range lines {
+		keys[i] = strings.SplitN(l, "\t", 2)[0]
+	}
+	manifest := strings.Join(keys, "\n") + "\n"
+	if err := addTarFile(tw, cacheManifestEntry, int64(len(manifest)), strings.NewReader(manifest)); err != nil {
+		logger.Fatalf("write %s: %s", cacheManifestEntry, err)
+	}
+
+	var exported, size int64
+	if ctx.Bool("blocks") {
+		progress := utils.NewProgress(fname == "-", true)
+		bar := progress.AddCountBar("Exported blocks", int64(len(lines)))
+		for _, l := range lines {
+			bar.Increment()
+			kp := strings.SplitN(l, "\t", 2)
+			if len(kp) < 2 || kp[1] == "" { // in memory
+				continue
+			}
+			f, err := os.Open(kp[1])
+			if err != nil { // evicted
+				logger.Debugf("open %s: %s", kp[1], err)
+				continue
+			}
+			fi, err := f.Stat()
+			if err == nil {
+				err = addTarFile(tw, cacheBlockPrefix+kp[0], fi.Size(), f)
+			}
+			_ = f.Close()
+			if err != nil {
+				logger.Fatalf("export block %s: %s", kp[0], err)
+			}
+			exported++
+			size += fi.Size()
+		}
+		progress.Done()
+	}
+	if err := tw.Close(); err != nil {
+		logger.Fatalf("close tarball: %s", err)
+	}
+	if err := out.Close(); err != nil {
+		logger.Fatalf("close %s: %s", fname, err)
+	}
+	logger.Infof("Exported %d cached blocks of volume %s, with the data of %d blocks (%d bytes)", len(keys), uuid, exported, size)
+	return nil
+}
+
+// loadCache asks the mount to build cache for blocks from the local files, items are keys and paths separated by tab.
+func loadCache(cf *os.File, uuid string, items []string, threads uint) {
+	data := strings.Join(items, "\n")
+	wb := utils.NewBuffer(8 + 4 + uint32(len(uuid)) + 4 + uint32(len(data)) + 2)
+	wb.Put32(meta.LoadCache)
+	wb.Put32(4 + uint32(len(uuid)) + 4 + uint32(len(data)) + 2)
+	wb.Put32(uint32(len(uuid)))
+	wb.Put([]byte(uuid))
+	wb.Put32(uint32(len(data)))
+	wb.Put([]byte(data))
+	wb.Put16(uint16(threads))
+	if _, err := cf.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	var errs = make([]byte, 1)
+	if n, err := cf.Read(errs); err != nil || n != 1 {
+		logger.Fatalf("read message: %d %s", n, err)
+	}
+	switch eno := syscall.Errno(errs[0]); eno {
+	case 0:
+	case syscall.EINVAL:
+		logger.Fatalf("import cache is not supported, please upgrade and mount again")
+	case syscall.EXDEV:
+		logger.Fatalf("the cache is exported from another volume %s", uuid)
+	default:
+		logger.Fatalf("load cache: %s", eno)
+	}
+}
+
+func cacheImport(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("MOUNTPOINT and FILE are needed")
+	}
+	mp := findMountpoint(ctx.Args().Get(0))
+	cf := openController(mp)
+	if cf == nil {
+		logger.Fatalf("Failed to open control file under %s", mp)
+	}
+	defer cf.Close()
+	fname := ctx.Args().Get(1)
+	var in io.ReadCloser = os.Stdin
+	if fname != "-" {
+		f, err := os.Open(fname)
+		if err != nil {
+			logger.Fatalf("open %s: %s", fname, err)
+		}
+		in = f
+	}
+	defer in.Close()
+
+	threads := ctx.Uint("threads")
+	var uuid, tmp string
+	var keys []string
+	var items []string
+	loaded := make(map[string]bool)
+	flush := func() {
+		loadCache(cf, uuid, items, threads)
+		for _, it := range items {
+			_ = os.Remove(strings.SplitN(it, "\t", 2)[1])
+		}
+		items = items[:0]
+	}
+	tr := tar.NewReader(in)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Fatalf("read tarball: %s", err)
+		}
+		switch {
+		case h.Name == cacheVolumeEntry:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				logger.Fatalf("read %s: %s", h.Name, err)
+			}
+			uuid = string(data)
+			loadCache(cf, uuid, nil, threads) // check the volume before anything else
+		case h.Name == cacheManifestEntry:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				logger.Fatalf("read %s: %s", h.Name, err)
+			}
+			keys = strings.Fields(string(data))
+		case strings.HasPrefix(h.Name, cacheBlockPrefix):
+			if uuid == "" {
+				logger.Fatalf("invalid tarball: %s is missing", cacheVolumeEntry)
+			}
+			if tmp == "" { // created after the volume is checked
+				if tmp, err = os.MkdirTemp(ctx.String("temp-dir"), "juicefs-cache-"); err != nil {
+					logger.Fatalf("create temporary directory: %s", err)
+				}
+				defer os.RemoveAll(tmp)
+			}
+			key := h.Name[len(cacheBlockPrefix):]
+			p := filepath.Join(tmp, strings.ReplaceAll(key, "/", "_"))
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				logger.Fatalf("create %s: %s", p, err)
+			}
+			_, err = io.Copy(f, tr)
+			if e := f.Close(); err == nil {
+				err = e
+			}
+			if err != nil {
+				logger.Fatalf("extract block %s: %s", key, err)
+			}
+			items = append(items, key+"\t"+p)
+			loaded[key] = true
+			if len(items) >= loadBatch {
+				flush()
+			}
+		default:
+			logger.Warnf("Unknown entry in tarball: %s", h.Name)
+		}
+	}
+	if uuid == "" {
+		logger.Fatalf("invalid tarball: %s is missing", cacheVolumeEntry)
+	}
+	if len(items) > 0 {
+		flush()
+	}
+
+	// download the blocks without data in the tarball from object storage
+	batch := make([]string, 0, batchMax)
+	for _, key := range keys {
+		if !loaded[key] {
+			batch = append(batch, key)
+		}
+		if len(batch) >= batchMax {
+			sendCommand(cf, meta.FillBlocks, batch, len(batch), threads, false)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		sendCommand(cf, meta.FillBlocks, batch, len(batch), threads, false)
+	}
+	logger.Infof("Imported %d cached blocks of volume %s, %d of them are loaded from the tarball", len(keys), uuid, len(loaded))
+	return nil
+}
+
+// hotBlocks is the reply of /cache/hot, the keys of cached blocks are the most recently used first.
+type hotBlocks struct {
+	UUID   string
+	Blocks []string
+}
+
+// cacheHandler serves the hottest cached blocks of this client, so they can be taken over by another client
+// with `juicefs cache handoff`.
+func cacheHandler(v *vfs.VFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cache/hot":
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(&hotBlocks{v.Conf.Format.UUID, v.Store.HotBlocks(limit)})
+		case "/cache/block":
+			data, err := v.Store.CachedBlock(r.URL.Query().Get("key"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write(data)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// downloadBlock saves a cached block of the client at addr into a file under dir.
+func downloadBlock(client *http.Client, addr, key, dir string) (string, error) {
+	u := url.URL{Scheme: "http", Host: addr, Path: "/cache/block", RawQuery: url.Values{"key": {key}}.Encode()}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", u.String(), resp.Status)
+	}
+	p := filepath.Join(dir, strings.ReplaceAll(key, "/", "_"))
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(p)
+		return "", err
+	}
+	return p, nil
+}
+
+func cacheHandoff(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("MOUNTPOINT and ADDR are needed")
+	}
+	mp := findMountpoint(ctx.Args().Get(0))
+	cf := openController(mp)
+	if cf == nil {
+		logger.Fatalf("Failed to open control file under %s", mp)
+	}
+	defer cf.Close()
+	addr := ctx.Args().Get(1)
+	client := &http.Client{Timeout: ctx.Duration("timeout")}
+	u := url.URL{Scheme: "http", Host: addr, Path: "/cache/hot", RawQuery: url.Values{"limit": {strconv.Itoa(ctx.Int("limit"))}}.Encode()}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		logger.Fatalf("list hot blocks from %s: %s", addr, err)
+	}
+	var hot hotBlocks
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("GET %s: %s", u.String(), resp.Status)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&hot)
+	}
+	_ = resp.Body.Close()
+	if err != nil {
+		logger.Fatalf("list hot blocks from %s: %s", addr, err)
+	}
+	threads := ctx.Uint("threads")
+	loadCache(cf, hot.UUID, nil, threads) // check the volume before anything else
+
+	tmp, err := os.MkdirTemp(ctx.String("temp-dir"), "juicefs-cache-")
+	if err != nil {
+		logger.Fatalf("create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	progress := utils.NewProgress(false, true)
+	bar := progress.AddCountBar("Copied blocks", int64(len(hot.Blocks)))
+	var missed []string // evicted or in memory only
+	var copied int
+	// the hottest blocks are copied first, batch by batch
+	for start := 0; start < len(hot.Blocks); start += loadBatch {
+		end := start + loadBatch
+		if end > len(hot.Blocks) {
+			end = len(hot.Blocks)
+		}
+		items := make([]string, end-start)
+		var wg sync.WaitGroup
+		todo := make(chan int, end-start)
+		for i := start; i < end; i++ {
+			todo <- i
+		}
+		close(todo)
+		for i := uint(0); i < threads; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range todo {
+					key := hot.Blocks[i]
+					if p, err := downloadBlock(client, addr, key, tmp); err != nil {
+						logger.Debugf("copy block %s: %s", key, err)
+					} else {
+						items[i-start] = key + "\t" + p
+					}
+					bar.Increment()
+				}
+			}()
+		}
+		wg.Wait()
+		var loaded []string
+		for i, it := range items {
+			if it == "" {
+				missed = append(missed, hot.Blocks[start+i])
+			} else {
+				loaded = append(loaded, it)
+			}
+		}
+		if len(loaded) > 0 {
+			loadCache(cf, hot.UUID, loaded, threads)
+			copied += len(loaded)
+		}
+		for _, it := range loaded {
+			_ = os.Remove(strings.SplitN(it, "\t", 2)[1])
+		}
+	}
+	progress.Done()
+
+	// download the blocks not copied from object storage
+	for start := 0; start < len(missed); start += batchMax {
+		end := start + batchMax
+		if end > len(missed) {
+			end = len(missed)
+		}
+		sendCommand(cf, meta.FillBlocks, missed[start:end], end-start, threads, false)
+	}
+	logger.Infof("Took over %d cached blocks from %s, %d of them are copied from it", len(hot.Blocks), addr, copied)
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func TestCacheHandler(t *testing.T) {
+	format := &meta.Format{Name: "test", UUID: "uuid-1", Storage: "mem", BlockSize: 1024, Compression: "none"}
+	chunkConf := &chunk.Config{
+		BlockSize:  format.BlockSize * 1024,
+		Compress:   format.Compression,
+		MaxUpload:  2,
+		BufferSize: 30 << 20,
+		CacheSize:  10,
+		CacheDir:   t.TempDir(),
+		AutoCreate: true,
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	store := chunk.NewCachedStore(blob, *chunkConf)
+	w := store.NewWriter(1)
+	if _, err := w.WriteAt(make([]byte, 1000), 0); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if err := w.Finish(1000); err != nil {
+		t.Fatalf("finish: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	v := vfs.NewVFS(&vfs.Config{Meta: &meta.Config{}, Format: format, Chunk: chunkConf}, nil, store)
+	ts := httptest.NewServer(cacheHandler(v))
+	defer ts.Close()
+	addr := ts.Listener.Addr().String()
+
+	resp, err := http.Get(ts.URL + "/cache/hot?limit=10")
+	if err != nil {
+		t.Fatalf("get hot blocks: %s", err)
+	}
+	var hot hotBlocks
+	err = json.NewDecoder(resp.Body).Decode(&hot)
+	_ = resp.Body.Close()
+	if err != nil || hot.UUID != "uuid-1" || len(hot.Blocks) != 1 || hot.Blocks[0] != "chunks/0/0/1_0_1000" {
+		t.Fatalf("hot blocks: %+v %s", hot, err)
+	}
+
+	client := &http.Client{Timeout: time.Second}
+	dir := t.TempDir()
+	p, err := downloadBlock(client, addr, hot.Blocks[0], dir)
+	if err != nil {
+		t.Fatalf("download block: %s", err)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Size() != 1000 {
+		t.Fatalf("downloaded block: %+v %s", fi, err)
+	}
+	if _, err = downloadBlock(client, addr, "chunks/0/0/2_0_1000", dir); err == nil {
+		t.Fatalf("download block not cached should fail")
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func chattrFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "chattr",
+		Usage:     "show or change the immutable and append-only flags of files",
+		ArgsUsage: "PATH ...",
+		Action:    chattr,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "immutable",
+				Usage: "set (true) or clear (false) the immutable flag: the file can't be modified, renamed or removed",
+			},
+			&cli.BoolFlag{
+				Name:  "append-only",
+				Usage: "set (true) or clear (false) the append-only flag: the file can only be appended to",
+			},
+		},
+	}
+}
+
+// flagsString formats the flags like lsattr(1).
+func flagsString(flags uint8) string {
+	s := []byte("--")
+	if flags&meta.FlagImmutable != 0 {
+		s[0] = 'i'
+	}
+	if flags&meta.FlagAppend != 0 {
+		s[1] = 'a'
+	}
+	return string(s)
+}
+
+func chattr(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("PATH is needed")
+	}
+	var add, remove uint8
+	for name, flag := range map[string]uint8{"immutable": meta.FlagImmutable, "append-only": meta.FlagAppend} {
+		if ctx.IsSet(name) {
+			if ctx.Bool(name) {
+				add |= flag
+			} else {
+				remove |= flag
+			}
+		}
+	}
+
+	for i := 0; i < ctx.Args().Len(); i++ {
+		path := ctx.Args().Get(i)
+		p, err := filepath.Abs(path)
+		if err != nil {
+			logger.Fatalf("abs of %s: %s", path, err)
+		}
+		inode, err := utils.GetFileInode(p)
+		if err != nil {
+			logger.Fatalf("lookup inode for %s: %s", path, err)
+		}
+		f := openController(p)
+		if f == nil {
+			logger.Fatalf("%s is not inside JuiceFS", path)
+		}
+		wb := utils.NewBuffer(8 + 10)
+		wb.Put32(meta.Chattr)
+		wb.Put32(10)
+		wb.Put64(inode)
+		wb.Put8(add)
+		wb.Put8(remove)
+		if _, err = f.Write(wb.Bytes()); err != nil {
+			logger.Fatalf("write message: %s", err)
+		}
+		data := make([]byte, 4)
+		n, err := io.ReadFull(f, data)
+		if n == 1 {
+			switch eno := syscall.Errno(data[0]); eno {
+			case syscall.EINVAL:
+				logger.Fatalf("chattr is not supported, please upgrade and mount again")
+			default:
+				logger.Fatalf("chattr %s: %s", path, eno)
+			}
+		}
+		if err != nil {
+			logger.Fatalf("read size: %d %s", n, err)
+		}
+		data = make([]byte, utils.ReadBuffer(data).Get32())
+		if _, err = io.ReadFull(f, data); err != nil {
+			logger.Fatalf("read flags: %s", err)
+		}
+		_ = f.Close()
+		fmt.Printf("%s %s\n", flagsString(data[0]), path)
+	}
+	return nil
+}
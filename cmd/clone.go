@@ -0,0 +1,88 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func cloneFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "clone",
+		Usage:     "clone a file or directory without copying its data",
+		ArgsUsage: "SRC DST",
+		Action:    clone,
+	}
+}
+
+func clone(ctx *cli.Context) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() != 2 {
+		return fmt.Errorf("SRC and DST are needed")
+	}
+	src, err := filepath.Abs(ctx.Args().Get(0))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(0), err)
+	}
+	dst, err := filepath.Abs(ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", ctx.Args().Get(1), err)
+	}
+	srcIno, err := utils.GetFileInode(src)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", src, err)
+	}
+	dir, name := filepath.Dir(dst), filepath.Base(dst)
+	dstParent, err := utils.GetFileInode(dir)
+	if err != nil {
+		return fmt.Errorf("lookup inode for %s: %s", dir, err)
+	}
+	f := openController(dir)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", dir)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 8 + 8 + 1 + uint32(len(name)))
+	wb.Put32(meta.Clone)
+	wb.Put32(8 + 8 + 1 + uint32(len(name)))
+	wb.Put64(srcIno)
+	wb.Put64(dstParent)
+	wb.Put8(uint8(len(name)))
+	wb.Put([]byte(name))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	var errs = make([]byte, 1)
+	n, err := f.Read(errs)
+	if err != nil || n != 1 {
+		return fmt.Errorf("read message: %d %s", n, err)
+	}
+	if errs[0] != 0 {
+		return fmt.Errorf("clone %s to %s: %s", src, dst, syscall.Errno(errs[0]))
+	}
+	return nil
+}
@@ -45,6 +45,28 @@ func userConfirmed() bool {
 	return false
 }
 
+func adminTokenFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:  "admin-token",
+		Usage: "token for administrative commands on a volume protected by it (env JFS_ADMIN_TOKEN)",
+	}
+}
+
+func adminToken(ctx *cli.Context) string {
+	if ctx.IsSet("admin-token") {
+		return ctx.String("admin-token")
+	}
+	return os.Getenv("JFS_ADMIN_TOKEN")
+}
+
+// checkAdmin returns an error if the volume is protected by an admin token but a wrong one is given.
+func checkAdmin(ctx *cli.Context, format *meta.Format) error {
+	if format.CheckAdminToken(adminToken(ctx)) {
+		return nil
+	}
+	return fmt.Errorf("permission denied: volume %s is protected by an admin token, please provide it with --admin-token or JFS_ADMIN_TOKEN", format.Name)
+}
+
 func config(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
 	if ctx.Args().Len() < 1 {
@@ -56,15 +78,24 @@ func config(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	if len(ctx.LocalFlagNames()) == 0 {
+	var flags []string
+	for _, flag := range ctx.LocalFlagNames() {
+		if flag != "admin-token" {
+			flags = append(flags, flag)
+		}
+	}
+	if len(flags) == 0 {
 		format.RemoveSecret()
 		printJson(format)
 		return nil
 	}
+	if err = checkAdmin(ctx, format); err != nil {
+		return err
+	}
 
 	var quota, storage, trash bool
 	var msg strings.Builder
-	for _, flag := range ctx.LocalFlagNames() {
+	for _, flag := range flags {
 		switch flag {
 		case "capacity":
 			if new := ctx.Uint64(flag); new != format.Capacity>>30 {
@@ -102,6 +133,45 @@ func config(ctx *cli.Context) error {
 				format.TrashDays = new
 				trash = true
 			}
+		case "trash-quota":
+			if new := ctx.Uint64(flag); new != format.TrashQuota>>30 {
+				msg.WriteString(fmt.Sprintf("%10s: %d GiB -> %d GiB\n", flag, format.TrashQuota>>30, new))
+				format.TrashQuota = new << 30
+			}
+		case "session-timeout":
+			if new := int(ctx.Duration(flag).Seconds()); new != format.SessionTimeout {
+				msg.WriteString(fmt.Sprintf("%10s: %ds -> %ds\n", flag, format.SessionTimeout, new))
+				format.SessionTimeout = new
+			}
+		case "sustained-grace":
+			if new := int(ctx.Duration(flag).Seconds()); new != format.SustainedGrace {
+				msg.WriteString(fmt.Sprintf("%10s: %ds -> %ds\n", flag, format.SustainedGrace, new))
+				format.SustainedGrace = new
+			}
+		case "cluster-id":
+			if new := ctx.Int(flag); new != format.ClusterID {
+				if new < 0 || new > meta.MaxClusterID {
+					return fmt.Errorf("invalid cluster ID: %d, it should be 0 to %d", new, meta.MaxClusterID)
+				}
+				msg.WriteString(fmt.Sprintf("%10s: %d -> %d\n", flag, format.ClusterID, new))
+				format.ClusterID = new
+			}
+		case "changelog-retention":
+			if new := int(ctx.Duration(flag).Seconds()); new != format.ChangelogRetention {
+				msg.WriteString(fmt.Sprintf("%10s: %ds -> %ds\n", flag, format.ChangelogRetention, new))
+				format.ChangelogRetention = new
+			}
+		case "gc-alert-space":
+			if new := ctx.Uint64(flag); new != format.GCAlertSpace>>30 {
+				msg.WriteString(fmt.Sprintf("%10s: %d GiB -> %d GiB\n", flag, format.GCAlertSpace>>30, new))
+				format.GCAlertSpace = new << 30
+			}
+		case "new-admin-token":
+			old := format.AdminToken
+			format.SetAdminToken(ctx.String(flag))
+			if format.AdminToken != old {
+				msg.WriteString(fmt.Sprintf("%10s: updated\n", "admin-token"))
+			}
 		}
 	}
 	if msg.Len() == 0 {
@@ -177,10 +247,39 @@ func configFlags() *cli.Command {
 				Name:  "trash-days",
 				Usage: "number of days after which removed files will be permanently deleted",
 			},
+			&cli.Uint64Flag{
+				Name:  "trash-quota",
+				Usage: "the limit for space used by trash in GiB, the oldest files are purged when it's exceeded",
+			},
+			&cli.DurationFlag{
+				Name:  "session-timeout",
+				Usage: "duration without heartbeat after which a client session is cleaned up",
+			},
+			&cli.DurationFlag{
+				Name:  "sustained-grace",
+				Usage: "duration to keep the deleted files held open by a dead session before purging them",
+			},
+			&cli.IntFlag{
+				Name:  "cluster-id",
+				Usage: "ID (0-255) of the cluster to namespace new inodes and chunks",
+			},
+			&cli.DurationFlag{
+				Name:  "changelog-retention",
+				Usage: "duration to keep the changes of metadata in changelog, 0 disables the changelog",
+			},
+			&cli.Uint64Flag{
+				Name:  "gc-alert-space",
+				Usage: "alert when the space in GiB held by pending deletions and leaked slices exceeds it, 0 disables the alert",
+			},
+			&cli.StringFlag{
+				Name:  "new-admin-token",
+				Usage: "new token required by administrative commands, empty string removes the protection",
+			},
 			&cli.BoolFlag{
 				Name:  "force",
 				Usage: "skip sanity check and force update the configurations",
 			},
+			adminTokenFlag(),
 		},
 	}
 }
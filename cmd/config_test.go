@@ -19,6 +19,7 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/agiledragon/gomonkey/v2"
@@ -44,6 +45,7 @@ func getStdout(args []string) ([]byte, error) {
 func TestConfig(t *testing.T) {
 	metaUrl := "redis://localhost:6379/10"
 	ResetRedis(metaUrl)
+	_ = os.RemoveAll("/tmp/testBucket/test")
 	if err := Main([]string{"", "format", metaUrl, "--bucket", "/tmp/testBucket", "test"}); err != nil {
 		t.Fatalf("format: %s", err)
 	}
@@ -80,3 +82,43 @@ func TestConfig(t *testing.T) {
 		t.Fatalf("unexpect format: %+v", format)
 	}
 }
+
+func TestAdminToken(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "jfs.db")
+	bucket := t.TempDir()
+	if err := Main([]string{"", "format", metaUrl, "--bucket", bucket, "--admin-token", "secret", "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	if err := Main([]string{"", "config", metaUrl, "--trash-days", "2"}); err == nil {
+		t.Fatalf("config without admin token should fail")
+	}
+	if err := Main([]string{"", "config", metaUrl, "--trash-days", "2", "--admin-token", "wrong"}); err == nil {
+		t.Fatalf("config with wrong admin token should fail")
+	}
+	if err := Main([]string{"", "config", metaUrl, "--trash-days", "2", "--admin-token", "secret"}); err != nil {
+		t.Fatalf("config: %s", err)
+	}
+	dstUrl := "sqlite3://" + filepath.Join(t.TempDir(), "dst.db")
+	if err := Main([]string{"", "migrate-meta", metaUrl, dstUrl}); err == nil {
+		t.Fatalf("migrate-meta without admin token should fail")
+	}
+	if err := Main([]string{"", "config", metaUrl, "--new-admin-token", "secret2", "--admin-token", "secret"}); err != nil {
+		t.Fatalf("change admin token: %s", err)
+	}
+	os.Setenv("JFS_ADMIN_TOKEN", "secret2")
+	defer os.Unsetenv("JFS_ADMIN_TOKEN")
+	if err := Main([]string{"", "config", metaUrl, "--trash-days", "3"}); err != nil {
+		t.Fatalf("config with admin token from env: %s", err)
+	}
+	data, err := getStdout([]string{"", "config", metaUrl})
+	if err != nil {
+		t.Fatalf("getStdout: %s", err)
+	}
+	var format meta.Format
+	if err = json.Unmarshal(data, &format); err != nil {
+		t.Fatalf("json unmarshal: %s", err)
+	}
+	if format.TrashDays != 3 || format.AdminToken != "removed" {
+		t.Fatalf("unexpect format: %+v", format)
+	}
+}
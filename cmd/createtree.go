@@ -0,0 +1,123 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func createTreeFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "create-tree",
+		Usage:     "create directories and empty files listed in a file in batches",
+		ArgsUsage: "META-URL [FILE]",
+		Action:    createTree,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "dir-mode",
+				Value: "755",
+				Usage: "permission bits of new directories in octal",
+			},
+			&cli.StringFlag{
+				Name:  "file-mode",
+				Value: "644",
+				Usage: "permission bits of new files in octal",
+			},
+			&cli.UintFlag{
+				Name:  "uid",
+				Usage: "owner of new entries (default: current user)",
+			},
+			&cli.UintFlag{
+				Name:  "gid",
+				Usage: "group of new entries (default: current group)",
+			},
+		},
+	}
+}
+
+func parseMode(s string) (uint16, error) {
+	mode, err := strconv.ParseUint(s, 8, 16)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode: %s", s)
+	}
+	return uint16(mode), nil
+}
+
+// readPaths reads the paths in r, one per line, the empty lines are skipped.
+func readPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if p := strings.TrimSpace(scanner.Text()); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+func createTree(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	dirMode, err := parseMode(ctx.String("dir-mode"))
+	if err != nil {
+		return err
+	}
+	fileMode, err := parseMode(ctx.String("file-mode"))
+	if err != nil {
+		return err
+	}
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	if ctx.IsSet("uid") {
+		uid = uint32(ctx.Uint("uid"))
+	}
+	if ctx.IsSet("gid") {
+		gid = uint32(ctx.Uint("gid"))
+	}
+	var r io.Reader = os.Stdin
+	if fname := ctx.Args().Get(1); fname != "" && fname != "-" {
+		fp, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		r = fp
+	}
+	paths, err := readPaths(r)
+	if err != nil {
+		return fmt.Errorf("read paths: %s", err)
+	}
+
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	var stats meta.TreeStats
+	err = meta.CreateTree(m, meta.NewContext(uint32(os.Getpid()), uid, []uint32{gid}), 1, paths, dirMode, fileMode, &stats)
+	fmt.Printf("Created %d directories and %d files, %d existed\n", stats.Dirs, stats.Files, stats.Existed)
+	return err
+}
@@ -0,0 +1,67 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestCreateTree(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "tree.db")
+	if err := Main([]string{"", "format", metaUrl, "--bucket", t.TempDir(), "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("shard-%d/", i))
+		for j := 0; j < 100; j++ {
+			lines = append(lines, fmt.Sprintf("shard-%d/part-%d/data", i, j))
+		}
+	}
+	list := filepath.Join(t.TempDir(), "paths")
+	if err := ioutil.WriteFile(list, []byte(strings.Join(lines, "\n")+"\n\n"), 0644); err != nil {
+		t.Fatalf("write %s: %s", list, err)
+	}
+	if err := Main([]string{"", "create-tree", metaUrl, list, "--dir-mode", "750", "--uid", "1000", "--gid", "1000"}); err != nil {
+		t.Fatalf("create-tree: %s", err)
+	}
+	if err := Main([]string{"", "create-tree", metaUrl, list, "--file-mode", "888"}); err == nil {
+		t.Fatalf("create-tree with invalid mode should fail")
+	}
+
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	var parent, inode meta.Ino
+	var attr meta.Attr
+	if st := m.Lookup(meta.Background, 1, "shard-9", &parent, &attr); st != 0 || attr.Mode != 0750 || attr.Uid != 1000 || attr.Nlink != 102 {
+		t.Fatalf("lookup shard-9: %s %+v", st, attr)
+	}
+	if st := m.Lookup(meta.Background, parent, "part-99", &parent, &attr); st != 0 {
+		t.Fatalf("lookup part-99: %s", st)
+	}
+	if st := m.Lookup(meta.Background, parent, "data", &inode, &attr); st != 0 || attr.Typ != meta.TypeFile || attr.Mode != 0644 || attr.Gid != 1000 {
+		t.Fatalf("lookup data: %s %+v", st, attr)
+	}
+}
@@ -41,10 +41,13 @@ func destroy(ctx *cli.Context) error {
 	if uuid := ctx.Args().Get(1); uuid != format.UUID {
 		logger.Fatalf("UUID %s != expected %s", uuid, format.UUID)
 	}
+	if err = checkAdmin(ctx, format); err != nil {
+		logger.Fatalf("%s", err)
+	}
 
 	if !ctx.Bool("force") {
-		m.CleanStaleSessions()
-		sessions, err := m.ListSessions()
+		m.CleanStaleSessions(nil)
+		sessions, err := m.ListSessions(nil)
 		if err != nil {
 			logger.Fatalf("list sessions: %s", err)
 		}
@@ -141,6 +144,7 @@ func destroyFlags() *cli.Command {
 				Name:  "force",
 				Usage: "skip sanity check and force destroy the volume",
 			},
+			adminTokenFlag(),
 		},
 	}
 }
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/urfave/cli/v2"
@@ -30,6 +31,9 @@ func dump(ctx *cli.Context) error {
 	if ctx.Args().Len() < 1 {
 		return fmt.Errorf("META-URL is needed")
 	}
+	if ctx.String("format") == "parquet" {
+		return dumpParquet(ctx)
+	}
 	var fp io.WriteCloser
 	if ctx.Args().Len() == 1 {
 		fp = os.Stdout
@@ -42,24 +46,74 @@ func dump(ctx *cli.Context) error {
 		defer fp.Close()
 	}
 	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, Subdir: ctx.String("subdir")})
-	if err := m.DumpMeta(fp, 0); err != nil {
+	var since time.Time
+	if s := ctx.String("since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.ParseInLocation("2006-01-02 15:04:05", s, time.Local); err != nil {
+			return fmt.Errorf("invalid since %s: %s", s, err)
+		}
+		if ctx.String("format") != "jsonl" {
+			return fmt.Errorf("incremental dump only supports format jsonl")
+		}
+	}
+	var err error
+	switch ctx.String("format") {
+	case "json":
+		err = m.DumpMeta(fp, 0)
+	case "jsonl":
+		err = m.DumpMetaLines(fp, 0, since)
+	default:
+		return fmt.Errorf("unknown format: %s", ctx.String("format"))
+	}
+	if err != nil {
 		return err
 	}
 	logger.Infof("Dump metadata into %s succeed", ctx.Args().Get(1))
 	return nil
 }
 
+func dumpParquet(ctx *cli.Context) error {
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("DIR is needed for format parquet")
+	}
+	if ctx.String("since") != "" {
+		return fmt.Errorf("incremental dump only supports format jsonl")
+	}
+	dir := ctx.Args().Get(1)
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true, Subdir: ctx.String("subdir")})
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(m.DumpMetaLines(w, 0, time.Time{}))
+	}()
+	if err := writeParquet(r, dir); err != nil {
+		_ = r.CloseWithError(err)
+		return fmt.Errorf("dump parquet: %s", err)
+	}
+	logger.Infof("Dump metadata into %s succeed", dir)
+	return nil
+}
+
 func dumpFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "dump",
 		Usage:     "dump metadata into a JSON file",
-		ArgsUsage: "META-URL [FILE]",
+		ArgsUsage: "META-URL [FILE|DIR]",
 		Action:    dump,
 		Flags: []cli.Flag{
 			&cli.StringFlag{
 				Name:  "subdir",
 				Usage: "only dump a sub-directory.",
 			},
+			&cli.StringFlag{
+				Name:  "format",
+				Value: "json",
+				Usage: "format of the dumped file: json, jsonl (one entry per line, using constant memory) or parquet (tables of inodes, dentries and chunks in DIR)",
+			},
+			&cli.StringFlag{
+				Name:  "since",
+				Usage: "only dump the inodes changed since the time (\"2006-01-02 15:04:05\") or duration ago (\"24h\")",
+			},
 		},
 	}
 }
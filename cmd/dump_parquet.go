@@ -0,0 +1,209 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// rows of the tables in the parquet dump, the times are in milliseconds.
+
+type inodeRow struct {
+	Inode   int64  `parquet:"name=inode, type=INT64"`
+	Type    string `parquet:"name=type, type=UTF8"`
+	Mode    int32  `parquet:"name=mode, type=INT32"`
+	Uid     int64  `parquet:"name=uid, type=INT64"`
+	Gid     int64  `parquet:"name=gid, type=INT64"`
+	Atime   int64  `parquet:"name=atime, type=TIMESTAMP_MILLIS"`
+	Mtime   int64  `parquet:"name=mtime, type=TIMESTAMP_MILLIS"`
+	Ctime   int64  `parquet:"name=ctime, type=TIMESTAMP_MILLIS"`
+	Nlink   int64  `parquet:"name=nlink, type=INT64"`
+	Length  int64  `parquet:"name=length, type=INT64"`
+	Symlink string `parquet:"name=symlink, type=UTF8"`
+}
+
+type dentryRow struct {
+	Parent int64  `parquet:"name=parent, type=INT64"`
+	Name   string `parquet:"name=name, type=UTF8"`
+	Inode  int64  `parquet:"name=inode, type=INT64"`
+	Type   string `parquet:"name=type, type=UTF8"`
+}
+
+// chunkRow is a slice in a chunk of a file.
+type chunkRow struct {
+	Inode   int64 `parquet:"name=inode, type=INT64"`
+	Index   int32 `parquet:"name=index, type=INT32"`
+	Pos     int32 `parquet:"name=pos, type=INT32"`
+	Chunkid int64 `parquet:"name=chunkid, type=INT64"`
+	Size    int32 `parquet:"name=size, type=INT32"`
+	Off     int32 `parquet:"name=off, type=INT32"`
+	Len     int32 `parquet:"name=len, type=INT32"`
+}
+
+// parquetFile is a local file used as source.ParquetFile, parquet-go-source is not used because it
+// requires the SDKs of all the cloud storages it supports.
+type parquetFile struct {
+	*os.File
+}
+
+func (f parquetFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return parquetFile{fp}, nil
+}
+
+func (f parquetFile) Create(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	fp, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return parquetFile{fp}, nil
+}
+
+type parquetTable struct {
+	fp *os.File
+	pw *writer.ParquetWriter
+}
+
+func newParquetTable(path string, obj interface{}) (*parquetTable, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriter(parquetFile{fp}, obj, 4)
+	if err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetTable{fp, pw}, nil
+}
+
+func (t *parquetTable) close() error {
+	if err := t.pw.WriteStop(); err != nil {
+		_ = t.fp.Close()
+		return err
+	}
+	return t.fp.Close()
+}
+
+func millis(sec int64, nsec uint32) int64 {
+	return sec*1000 + int64(nsec)/1e6
+}
+
+// writeParquet converts a dump of JSON lines into inode.parquet, dentry.parquet and chunk.parquet under dir.
+func writeParquet(r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var tables []*parquetTable
+	for _, t := range []struct {
+		name string
+		obj  interface{}
+	}{{"inode", new(inodeRow)}, {"dentry", new(dentryRow)}, {"chunk", new(chunkRow)}} {
+		table, err := newParquetTable(filepath.Join(dir, t.name+".parquet"), t.obj)
+		if err != nil {
+			for _, table := range tables {
+				_ = table.close()
+			}
+			return fmt.Errorf("create table %s: %s", t.name, err)
+		}
+		tables = append(tables, table)
+	}
+	inodes, dentries, chunks := tables[0].pw, tables[1].pw, tables[2].pw
+	err := func() error {
+		dec := json.NewDecoder(r)
+		var header meta.DumpedMeta
+		if err := dec.Decode(&header); err != nil {
+			return err
+		}
+		seen := make(map[meta.Ino]bool) // hard links
+		for {
+			var l struct {
+				Parent meta.Ino `json:"parent"`
+				Name   string   `json:"name"`
+				*meta.DumpedEntry
+			}
+			if err := dec.Decode(&l); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if l.DumpedEntry == nil || l.Attr == nil {
+				return fmt.Errorf("invalid entry %s in parent %d", l.Name, l.Parent)
+			}
+			a := l.Attr
+			if l.Parent > 0 {
+				if err := dentries.Write(dentryRow{int64(l.Parent), l.Name, int64(a.Inode), a.Type}); err != nil {
+					return err
+				}
+			}
+			if a.Nlink > 1 && a.Type != "directory" {
+				if seen[a.Inode] {
+					continue
+				}
+				seen[a.Inode] = true
+			}
+			if err := inodes.Write(inodeRow{
+				Inode:   int64(a.Inode),
+				Type:    a.Type,
+				Mode:    int32(a.Mode),
+				Uid:     int64(a.Uid),
+				Gid:     int64(a.Gid),
+				Atime:   millis(a.Atime, a.Atimensec),
+				Mtime:   millis(a.Mtime, a.Mtimensec),
+				Ctime:   millis(a.Ctime, a.Ctimensec),
+				Nlink:   int64(a.Nlink),
+				Length:  int64(a.Length),
+				Symlink: l.Symlink,
+			}); err != nil {
+				return err
+			}
+			for _, c := range l.Chunks {
+				for _, s := range c.Slices {
+					if err := chunks.Write(chunkRow{int64(a.Inode), int32(c.Index), int32(s.Pos), int64(s.Chunkid),
+						int32(s.Size), int32(s.Off), int32(s.Len)}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}()
+	for _, t := range tables {
+		if e := t.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
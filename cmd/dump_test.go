@@ -17,8 +17,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/go-redis/redis/v8"
@@ -69,3 +71,23 @@ func TestDumpAndLoad(t *testing.T) {
 	})
 	rdb.FlushDB(context.Background())
 }
+
+func TestDumpParquet(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "parquet.db")
+	if err := Main([]string{"", "load", metaUrl, "./../pkg/meta/metadata.sample"}); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	dir := filepath.Join(t.TempDir(), "parquet")
+	if err := Main([]string{"", "dump", metaUrl, dir, "--format", "parquet"}); err != nil {
+		t.Fatalf("dump error: %v", err)
+	}
+	for _, name := range []string{"inode", "dentry", "chunk"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".parquet"))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if !bytes.HasPrefix(data, []byte("PAR1")) || !bytes.HasSuffix(data, []byte("PAR1")) {
+			t.Fatalf("%s.parquet is not a parquet file", name)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+func faultFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "fault",
+		Usage:     "show or change the faults injected into requests of a mount point (for testing only)",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    fault,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "target",
+				Value: "all",
+				Usage: "requests to inject faults into: meta, object or all",
+			},
+			&cli.Float64Flag{
+				Name:  "drop",
+				Usage: "percentage of requests to fail",
+			},
+			&cli.DurationFlag{
+				Name:  "delay",
+				Usage: "latency added to the delayed requests",
+			},
+			&cli.Float64Flag{
+				Name:  "delay-percent",
+				Value: 100,
+				Usage: "percentage of requests to delay",
+			},
+			&cli.BoolFlag{
+				Name:  "clear",
+				Usage: "stop injecting faults",
+			},
+		},
+	}
+}
+
+func faultTarget(name string) (uint8, error) {
+	switch name {
+	case "meta":
+		return vfs.FaultMeta, nil
+	case "object":
+		return vfs.FaultObject, nil
+	case "all":
+		return vfs.FaultMeta | vfs.FaultObject, nil
+	default:
+		return 0, fmt.Errorf("invalid target: %s", name)
+	}
+}
+
+func fault(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	target, err := faultTarget(ctx.String("target"))
+	if err != nil {
+		return err
+	}
+	var f utils.Fault
+	if ctx.IsSet("drop") || ctx.IsSet("delay") || ctx.Bool("clear") {
+		if !ctx.Bool("clear") {
+			f.Drop = ctx.Float64("drop")
+			if f.Delay = ctx.Duration("delay"); f.Delay > 0 {
+				f.DelayPercent = ctx.Float64("delay-percent")
+			}
+		}
+		if err = f.Validate(); err != nil {
+			return err
+		}
+	} else {
+		target = 0 // show the current faults only
+	}
+
+	mp, err := filepath.Abs(ctx.Args().First())
+	if err != nil {
+		logger.Fatalf("abs of %s: %s", ctx.Args().First(), err)
+	}
+	cf := openController(mp)
+	if cf == nil {
+		logger.Fatalf("%s is not inside JuiceFS", mp)
+	}
+	defer cf.Close()
+
+	wb := utils.NewBuffer(8 + 13)
+	wb.Put32(meta.Fault)
+	wb.Put32(13)
+	wb.Put8(target)
+	wb.Put32(uint32(f.Drop * 100))
+	wb.Put32(uint32(f.DelayPercent * 100))
+	wb.Put32(uint32(f.Delay / time.Millisecond))
+	if _, err = cf.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	data := make([]byte, 4)
+	n, err := io.ReadFull(cf, data)
+	if n == 1 {
+		switch eno := syscall.Errno(data[0]); eno {
+		case syscall.EINVAL:
+			logger.Fatalf("fault injection is not supported, please upgrade and mount again")
+		case syscall.ENOTSUP:
+			logger.Fatalf("fault injection is not enabled, please mount with --fault-injection")
+		default:
+			logger.Fatalf("inject faults: %s", eno)
+		}
+	}
+	if err != nil {
+		logger.Fatalf("read size: %d %s", n, err)
+	}
+	data = make([]byte, utils.ReadBuffer(data).Get32())
+	if _, err = io.ReadFull(cf, data); err != nil {
+		logger.Fatalf("read report: %s", err)
+	}
+	fmt.Print(string(data))
+	return nil
+}
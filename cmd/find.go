@@ -0,0 +1,265 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func findFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "find",
+		Usage:     "find files by their metadata",
+		ArgsUsage: "META-URL [PATH]",
+		Action:    find,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "name",
+				Usage: "only show files with name matching this shell pattern",
+			},
+			&cli.StringFlag{
+				Name:  "min-size",
+				Usage: "only show files not smaller than this size (with optional unit K, M, G or T)",
+			},
+			&cli.StringFlag{
+				Name:  "max-size",
+				Usage: "only show files not larger than this size (with optional unit K, M, G or T)",
+			},
+			&cli.StringFlag{
+				Name:  "newer",
+				Usage: "only show files modified after this time (a date like 2006-01-02, or a duration ago like 12h or 7d)",
+			},
+			&cli.StringFlag{
+				Name:  "older",
+				Usage: "only show files modified before this time (a date like 2006-01-02, or a duration ago like 12h or 7d)",
+			},
+			&cli.UintFlag{
+				Name:  "uid",
+				Usage: "only show files owned by this user",
+			},
+			&cli.UintFlag{
+				Name:  "gid",
+				Usage: "only show files owned by this group",
+			},
+			&cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "only show files with this tag (key or key=value, set by the extended attribute user.tag.key), can be repeated",
+			},
+			&cli.BoolFlag{
+				Name:    "long",
+				Aliases: []string{"l"},
+				Usage:   "show the size and modification time of files",
+			},
+		},
+	}
+}
+
+func parseSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var shift uint
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		shift = 10
+	case 'm', 'M':
+		shift = 20
+	case 'g', 'G':
+		shift = 30
+	case 't', 'T':
+		shift = 40
+	}
+	num := s
+	if shift > 0 {
+		num = s[:len(s)-1]
+	}
+	v, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return v << shift, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.ParseUint(s[:len(s)-1], 10, 32); err == nil {
+			return time.Now().Add(-time.Duration(days) * time.Hour * 24), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %s", s)
+}
+
+func parseFindFilter(ctx *cli.Context) (*meta.FindFilter, error) {
+	var f meta.FindFilter
+	var err error
+	f.Name = ctx.String("name")
+	if _, err = path.Match(f.Name, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", f.Name)
+	}
+	if f.MinSize, err = parseSize(ctx.String("min-size")); err != nil {
+		return nil, err
+	}
+	if f.MaxSize, err = parseSize(ctx.String("max-size")); err != nil {
+		return nil, err
+	}
+	if f.MinMtime, err = parseTime(ctx.String("newer")); err != nil {
+		return nil, err
+	}
+	if f.MaxMtime, err = parseTime(ctx.String("older")); err != nil {
+		return nil, err
+	}
+	if ctx.IsSet("uid") {
+		uid := uint32(ctx.Uint("uid"))
+		f.Uid = &uid
+	}
+	if ctx.IsSet("gid") {
+		gid := uint32(ctx.Uint("gid"))
+		f.Gid = &gid
+	}
+	return &f, nil
+}
+
+type tagCond struct {
+	key   string
+	value []byte // nil for any value
+}
+
+func parseTags(tags []string) ([]tagCond, error) {
+	var conds []tagCond
+	for _, t := range tags {
+		var c tagCond
+		if p := strings.IndexByte(t, '='); p >= 0 {
+			c.key, c.value = t[:p], []byte(t[p+1:])
+		} else {
+			c.key = t
+		}
+		if c.key == "" || c.value != nil && len(c.value) == 0 {
+			return nil, fmt.Errorf("invalid tag: %q", t)
+		}
+		conds = append(conds, c)
+	}
+	return conds, nil
+}
+
+func find(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	filter, err := parseFindFilter(ctx)
+	if err != nil {
+		return err
+	}
+	conds, err := parseTags(ctx.StringSlice("tag"))
+	if err != nil {
+		return err
+	}
+	prefix := "/"
+	if ctx.Args().Len() > 1 {
+		prefix = path.Join("/", ctx.Args().Get(1))
+	}
+
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	show := func(p string, attr *meta.Attr) {
+		if prefix != "/" && p != prefix && !strings.HasPrefix(p, prefix+"/") {
+			return
+		}
+		if ctx.Bool("long") {
+			mtime := time.Unix(attr.Mtime, int64(attr.Mtimensec))
+			fmt.Printf("%12d %s %s\n", attr.Length, mtime.Format("2006-01-02 15:04:05"), p)
+		} else {
+			fmt.Println(p)
+		}
+	}
+
+	if len(conds) > 0 {
+		var inodes []meta.Ino
+		if st := m.ListTagged(meta.Background, conds[0].key, conds[0].value, &inodes); st != 0 {
+			logger.Fatalf("list files tagged with %s: %s", conds[0].key, st)
+		}
+		for _, inode := range inodes {
+			matched := true
+			for _, c := range conds[1:] {
+				var v []byte
+				if st := m.GetXattr(meta.Background, inode, meta.TagPrefix+c.key, &v); st != 0 || c.value != nil && string(v) != string(c.value) {
+					matched = false
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+			p, st := meta.GetPath(m, meta.Background, inode)
+			if st != 0 {
+				logger.Warnf("get path of inode %d: %s", inode, st)
+				continue
+			}
+			var attr meta.Attr
+			if st = m.GetAttr(meta.Background, inode, &attr); st == 0 && filter.Match(path.Base(p), &attr) {
+				show(p, &attr)
+			}
+		}
+		return nil
+	}
+
+	dirs := make(map[meta.Ino]string)
+	var cursor string
+	for {
+		var entries []*meta.Entry
+		if st := m.Find(meta.Background, filter, &cursor, 1000, &entries); st != 0 {
+			logger.Fatalf("find: %s", st)
+		}
+		for _, e := range entries {
+			dir, ok := dirs[e.Attr.Parent]
+			if !ok {
+				var st syscall.Errno
+				if dir, st = meta.GetPath(m, meta.Background, e.Attr.Parent); st != 0 {
+					logger.Debugf("get path of inode %d: %s", e.Attr.Parent, st)
+					continue
+				}
+				dirs[e.Attr.Parent] = dir
+			}
+			show(path.Join(dir, string(e.Name)), e.Attr)
+		}
+		if cursor == "" {
+			return nil
+		}
+	}
+}
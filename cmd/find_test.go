@@ -0,0 +1,54 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]uint64{"": 0, "100": 100, "4K": 4 << 10, "2m": 2 << 20, "1G": 1 << 30, "3T": 3 << 40} {
+		if v, err := parseSize(s); err != nil || v != expected {
+			t.Fatalf("parse size %q: expect %d, but got %d (%v)", s, expected, v, err)
+		}
+	}
+	for _, s := range []string{"K", "1.5G", "10X", "-1"} {
+		if _, err := parseSize(s); err == nil {
+			t.Fatalf("parse size %q should fail", s)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Now()
+	if v, err := parseTime("7d"); err != nil || now.Sub(v)-time.Hour*24*7 > time.Second {
+		t.Fatalf("parse 7d: %s %v", v, err)
+	}
+	if v, err := parseTime("90m"); err != nil || now.Sub(v)-time.Minute*90 > time.Second {
+		t.Fatalf("parse 90m: %s %v", v, err)
+	}
+	if v, err := parseTime("2022-01-02"); err != nil || v.Year() != 2022 || v.YearDay() != 2 {
+		t.Fatalf("parse 2022-01-02: %s %v", v, err)
+	}
+	if v, err := parseTime("2022-01-02T03:04:05Z"); err != nil || v.Unix() != 1641092645 {
+		t.Fatalf("parse RFC3339: %s %v", v, err)
+	}
+	if _, err := parseTime("yesterday"); err == nil {
+		t.Fatalf("parse yesterday should fail")
+	}
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -127,6 +128,73 @@ func doTesting(store object.ObjectStorage, key string, data []byte) error {
 	return nil
 }
 
+// volumeMarker is an object in the bucket to identify the volume it belongs to
+const volumeMarker = "juicefs_uuid"
+
+type volumeMark struct {
+	Name        string
+	UUID        string
+	BlockSize   int
+	Compression string
+}
+
+func writeMarker(blob object.ObjectStorage, format *meta.Format) error {
+	data, err := json.MarshalIndent(&volumeMark{format.Name, format.UUID, format.BlockSize, format.Compression}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return blob.Put(volumeMarker, bytes.NewReader(data))
+}
+
+func readMarker(blob object.ObjectStorage) (*volumeMark, error) {
+	r, err := blob.Get(volumeMarker, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, err
+	}
+	var mark volumeMark
+	if err = json.Unmarshal(data, &mark); err != nil {
+		return nil, fmt.Errorf("invalid marker: %s", err)
+	}
+	return &mark, nil
+}
+
+// checkMarker verifies that the bucket belongs to the volume and is written with the same
+// block size and compression, the marker is written if it's missing (formatted by old versions).
+func checkMarker(blob object.ObjectStorage, format *meta.Format, readOnly bool) error {
+	mark, err := readMarker(blob)
+	if err != nil {
+		// only overwrite a missing marker, the errors of not found differ among object storages,
+		// so list it to tell them from others
+		if !os.IsNotExist(err) {
+			objs, e := blob.List(volumeMarker, "", 1)
+			if e != nil {
+				return fmt.Errorf("read marker of volume from %s: %s, list: %s", blob, err, e)
+			}
+			if len(objs) > 0 && objs[0].Key() == volumeMarker {
+				return fmt.Errorf("read marker of volume from %s: %s", blob, err)
+			}
+		}
+		logger.Warnf("Marker of volume is not found in %s: %s", blob, err)
+		if readOnly {
+			return nil
+		}
+		return writeMarker(blob, format)
+	}
+	if mark.UUID != format.UUID {
+		return fmt.Errorf("the bucket belongs to volume %s (UUID %s), not %s (UUID %s)", mark.Name, mark.UUID, format.Name, format.UUID)
+	}
+	if mark.BlockSize != format.BlockSize || mark.Compression != format.Compression {
+		return fmt.Errorf("the data is written with block size %d KiB and compression %s, but the volume has %d KiB and %s",
+			mark.BlockSize, mark.Compression, format.BlockSize, format.Compression)
+	}
+	return nil
+}
+
 func test(store object.ObjectStorage) error {
 	rand.Seed(time.Now().UnixNano())
 	key := "testing/" + randSeq(10)
@@ -183,6 +251,17 @@ func format(c *cli.Context) error {
 		BlockSize:   fixObjectSize(c.Int("block-size")),
 		Compression: c.String("compress"),
 		TrashDays:   c.Int("trash-days"),
+		TrashQuota:  c.Uint64("trash-quota") << 30,
+
+		SessionTimeout: int(c.Duration("session-timeout").Seconds()),
+		SustainedGrace: int(c.Duration("sustained-grace").Seconds()),
+		ClusterID:      c.Int("cluster-id"),
+
+		ChangelogRetention: int(c.Duration("changelog-retention").Seconds()),
+		GCAlertSpace:       c.Uint64("gc-alert-space") << 30,
+	}
+	if format.ClusterID < 0 || format.ClusterID > meta.MaxClusterID {
+		logger.Fatalf("invalid cluster ID: %d, it should be 0 to %d", format.ClusterID, meta.MaxClusterID)
 	}
 	if format.AccessKey == "" && os.Getenv("ACCESS_KEY") != "" {
 		format.AccessKey = os.Getenv("ACCESS_KEY")
@@ -193,6 +272,13 @@ func format(c *cli.Context) error {
 		_ = os.Unsetenv("SECRET_KEY")
 	}
 
+	if old, err := m.Load(); err == nil { // formatting an existing volume updates or overwrites it
+		if err = checkAdmin(c, old); err != nil {
+			logger.Fatalf("%s", err)
+		}
+	}
+	format.SetAdminToken(adminToken(c))
+
 	if format.Storage == "file" && !strings.HasSuffix(format.Bucket, "/") {
 		format.Bucket += "/"
 	}
@@ -215,6 +301,13 @@ func format(c *cli.Context) error {
 		if err := test(blob); err != nil {
 			logger.Fatalf("Storage %s is not configured correctly: %s", blob, err)
 		}
+		id := format.UUID
+		if old, err := m.Load(); err == nil {
+			id = old.UUID
+		}
+		if mark, err := readMarker(blob); err == nil && mark.UUID != id && !c.Bool("force") {
+			logger.Fatalf("Storage %s is used by volume %s (UUID %s), use --force to take it over", blob, mark.Name, mark.UUID)
+		}
 	}
 
 	if !c.Bool("force") && format.Compression == "none" { // default
@@ -222,10 +315,21 @@ func format(c *cli.Context) error {
 			format.Compression = old.Compression // keep the existing default compress algr
 		}
 	}
+	if !c.Bool("force") {
+		if old, err := m.Load(); err == nil {
+			format.CompressDict = old.CompressDict // trained by train-dict
+		}
+	}
 	err = m.Init(format, c.Bool("force"))
 	if err != nil {
 		logger.Fatalf("format: %s", err)
 	}
+	if old, err := m.Load(); err == nil { // the existing volume may be updated
+		format = *old
+	}
+	if err = writeMarker(blob, &format); err != nil {
+		logger.Warnf("Write marker of volume into %s: %s", blob, err)
+	}
 	format.RemoveSecret()
 	logger.Infof("Volume is formatted as %+v", format)
 	return nil
@@ -302,6 +406,33 @@ func formatFlags() *cli.Command {
 				Value: 1,
 				Usage: "number of days after which removed files will be permanently deleted",
 			},
+			&cli.Uint64Flag{
+				Name:  "trash-quota",
+				Value: 0,
+				Usage: "the limit for space used by trash in GiB, the oldest files are purged when it's exceeded",
+			},
+			&cli.DurationFlag{
+				Name:  "session-timeout",
+				Value: time.Minute * 5,
+				Usage: "duration without heartbeat after which a client session is cleaned up",
+			},
+			&cli.DurationFlag{
+				Name:  "sustained-grace",
+				Value: time.Hour,
+				Usage: "duration to keep the deleted files held open by a dead session before purging them",
+			},
+			&cli.IntFlag{
+				Name:  "cluster-id",
+				Usage: "ID (0-255) of the cluster to namespace inodes and chunks, so volumes from different clusters never collide",
+			},
+			&cli.DurationFlag{
+				Name:  "changelog-retention",
+				Usage: "duration to keep the changes of metadata in changelog for subscribers, 0 disables the changelog",
+			},
+			&cli.Uint64Flag{
+				Name:  "gc-alert-space",
+				Usage: "alert when the space in GiB held by pending deletions and leaked slices exceeds it, 0 disables the alert",
+			},
 
 			&cli.BoolFlag{
 				Name:  "force",
@@ -311,6 +442,10 @@ func formatFlags() *cli.Command {
 				Name:  "no-update",
 				Usage: "don't update existing volume",
 			},
+			&cli.StringFlag{
+				Name:  "admin-token",
+				Usage: "token required by administrative commands (destroy, load, config and formatting it again), or env JFS_ADMIN_TOKEN",
+			},
 		},
 		Action: format,
 	}
@@ -19,13 +19,63 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
 
 	"github.com/go-redis/redis/v8"
 )
 
+func TestCheckMarker(t *testing.T) {
+	blob, err := object.CreateStorage("file", t.TempDir()+"/", "", "")
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+	format := &meta.Format{Name: "test", UUID: "uuid-1", BlockSize: 4096, Compression: "none"}
+	if err = checkMarker(blob, format, true); err != nil {
+		t.Fatalf("check missing marker in read-only mode: %s", err)
+	}
+	if _, err = readMarker(blob); err == nil {
+		t.Fatalf("marker should not be written in read-only mode")
+	}
+	if err = checkMarker(blob, format, false); err != nil {
+		t.Fatalf("check missing marker: %s", err)
+	}
+	if mark, err := readMarker(blob); err != nil || mark.UUID != "uuid-1" {
+		t.Fatalf("marker should be written: %+v, %s", mark, err)
+	}
+	if err = checkMarker(blob, format, false); err != nil {
+		t.Fatalf("check marker: %s", err)
+	}
+	other := *format
+	other.UUID = "uuid-2"
+	if err = checkMarker(blob, &other, false); err == nil {
+		t.Fatalf("bucket of another volume should be rejected")
+	}
+	other = *format
+	other.BlockSize = 1024
+	if err = checkMarker(blob, &other, false); err == nil {
+		t.Fatalf("mismatched block size should be rejected")
+	}
+	other = *format
+	other.Compression = "lz4"
+	if err = checkMarker(blob, &other, false); err == nil {
+		t.Fatalf("mismatched compression should be rejected")
+	}
+	if err = blob.Put(volumeMarker, strings.NewReader("corrupted")); err != nil {
+		t.Fatalf("put marker: %s", err)
+	}
+	if err = checkMarker(blob, format, false); err == nil {
+		t.Fatalf("unreadable marker should be reported")
+	}
+	if _, err = readMarker(blob); err == nil {
+		t.Fatalf("unreadable marker should not be overwritten")
+	}
+}
+
 func TestFixObjectSize(t *testing.T) {
 	t.Run("Should make sure the size is in range", func(t *testing.T) {
 		cases := []struct {
@@ -69,6 +119,7 @@ func TestFormat(t *testing.T) {
 	rdb.FlushDB(ctx)
 	defer rdb.FlushDB(ctx)
 	name := "test"
+	_ = os.RemoveAll("/tmp/testMountDir/" + name)
 	formatArgs := []string{"", "format", "--storage", "file", "--bucket", "/tmp/testMountDir", metaUrl, name}
 	err = Main(formatArgs)
 	if err != nil {
@@ -0,0 +1,128 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func freezeFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "freeze",
+		Usage:     "block the modifications of a mount point and flush its buffered data, to take a consistent snapshot",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    freeze,
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "wait",
+				Value: time.Minute,
+				Usage: "max duration to wait for the modifications in progress, and for the upload of the blocks staged by writeback",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Usage: "thaw automatically after this duration (0 means never)",
+			},
+		},
+	}
+}
+
+func thawFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "thaw",
+		Usage:     "unblock the modifications of a mount point frozen by freeze",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    thaw,
+	}
+}
+
+func sendFreeze(mountpoint string, freeze bool, wait, timeout time.Duration) error {
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	mp, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return fmt.Errorf("abs of %s: %s", mountpoint, err)
+	}
+	f := openController(mp)
+	if f == nil {
+		return fmt.Errorf("%s is not inside JuiceFS", mp)
+	}
+	defer f.Close()
+	wb := utils.NewBuffer(8 + 9)
+	wb.Put32(meta.Freeze)
+	wb.Put32(9)
+	if freeze {
+		wb.Put8(1)
+	} else {
+		wb.Put8(0)
+	}
+	wb.Put32(uint32(wait / time.Second))
+	wb.Put32(uint32(timeout / time.Second))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		return fmt.Errorf("write message: %s", err)
+	}
+	var errs = make([]byte, 1)
+	n, err := f.Read(errs)
+	if err != nil || n != 1 {
+		return fmt.Errorf("read message: %d %s", n, err)
+	}
+	switch eno := syscall.Errno(errs[0]); {
+	case eno == 0:
+		return nil
+	case eno == syscall.EINVAL && !freeze:
+		return fmt.Errorf("%s is not frozen", mp)
+	case eno == syscall.EINVAL:
+		return fmt.Errorf("freeze is not supported, please upgrade and mount again")
+	case eno == syscall.EBUSY:
+		return fmt.Errorf("%s is frozen already", mp)
+	case eno == syscall.ETIMEDOUT:
+		return fmt.Errorf("the modifications in progress are not finished in %s", wait)
+	case freeze:
+		return fmt.Errorf("freeze %s: %s", mp, eno)
+	default:
+		return fmt.Errorf("thaw %s: %s", mp, eno)
+	}
+}
+
+func freeze(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	if err := sendFreeze(ctx.Args().First(), true, ctx.Duration("wait"), ctx.Duration("timeout")); err != nil {
+		return err
+	}
+	logger.Infof("%s is frozen, run `juicefs thaw %s` after the snapshot is taken", ctx.Args().First(), ctx.Args().First())
+	return nil
+}
+
+func thaw(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("MOUNTPOINT is needed")
+	}
+	return sendFreeze(ctx.Args().First(), false, 0, 0)
+}
@@ -17,15 +17,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
-	osync "github.com/juicedata/juicefs/pkg/sync"
 	"github.com/juicedata/juicefs/pkg/utils"
 
 	"github.com/urfave/cli/v2"
@@ -37,9 +40,104 @@ func checkFlags() *cli.Command {
 		Usage:     "Check consistency of file system",
 		ArgsUsage: "META-URL",
 		Action:    fsck,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "use-listing",
+				Usage: "read objects from the listing `FILE` saved by list-save instead of listing the bucket",
+			},
+			&cli.IntFlag{
+				Name:  "threads",
+				Value: 10,
+				Usage: "number of threads to check the blocks missing in the listing, or to download the blocks with --scrub",
+			},
+			&cli.BoolFlag{
+				Name:  "scrub",
+				Usage: "download all the blocks to verify their length and content, instead of only checking existence",
+			},
+			&cli.Int64Flag{
+				Name:  "download-limit",
+				Value: 0,
+				Usage: "bandwidth limit for downloading the blocks with --scrub in Mbps",
+			},
+			&cli.BoolFlag{
+				Name:  "meta",
+				Usage: "only check the consistency of metadata: orphan inodes, nlink, dangling entries, parents of directories and used space",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the report in JSON format",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "write the report in JSON format into `FILE`",
+			},
+		},
 	}
 }
 
+// the blocks not found in the listing are checked in batches
+const fsckBatchSize = 100
+
+type fsckBlock struct {
+	inode   meta.Ino
+	chunkid uint64
+	key     string // name of the block, without the directories
+	size    int
+	indx    int
+	length  int // size of the slice
+}
+
+// fsckReport is the report in JSON format, for monitoring systems and repairing jobs
+type fsckReport struct {
+	Blocks        int64 // blocks found in the object storage
+	BlockBytes    int64
+	Slices        int64 // slices scanned in the metadata
+	SliceBytes    int64
+	Scrubbed      int64 // blocks downloaded and verified with --scrub
+	ScrubbedBytes int64
+	LostBlocks    int64
+	LostBytes     int64
+	Lost          []*fsckLostBlock
+	BrokenFiles   []*fsckBrokenFile
+}
+
+type fsckLostBlock struct {
+	Inode meta.Ino
+	Key   string
+	Size  int
+	Error string
+}
+
+type fsckBrokenFile struct {
+	Inode      meta.Ino
+	Paths      []string
+	Length     uint64
+	LostBlocks int
+	LostBytes  int64
+}
+
+type fsckMetaReport struct {
+	*meta.NamespaceReport
+	Counts map[string]int // number of problems in each class
+}
+
+// writeReport prints the report in JSON format or writes it into the file given by --output.
+func writeReport(ctx *cli.Context, v interface{}) error {
+	if out := ctx.String("output"); out != "" {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("json: %s", err)
+		}
+		if err = ioutil.WriteFile(out, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("write report into %s: %s", out, err)
+		}
+	}
+	if ctx.Bool("json") {
+		printJson(v)
+	}
+	return nil
+}
+
 func fsck(ctx *cli.Context) error {
 	setLoggerLevel(ctx)
 	if ctx.Args().Len() < 1 {
@@ -50,16 +148,22 @@ func fsck(ctx *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	if ctx.Bool("meta") {
+		return fsckMeta(ctx, m)
+	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		CompressDict: format.CompressDict,
+		Partitions:   format.Partitions,
 
-		GetTimeout: time.Second * 60,
-		PutTimeout: time.Second * 60,
-		MaxUpload:  20,
-		BufferSize: 300 << 20,
-		CacheDir:   "memory",
+		GetTimeout:    time.Second * 60,
+		PutTimeout:    time.Second * 60,
+		MaxUpload:     20,
+		BufferSize:    300 << 20,
+		DownloadLimit: ctx.Int64("download-limit") * 1e6 / 8,
+		CacheDir:      "memory",
 	}
 
 	blob, err := createStorage(format)
@@ -67,92 +171,183 @@ func fsck(ctx *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
-	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
-	if err != nil {
-		logger.Fatalf("list all blocks: %s", err)
-	}
-
-	// Find all blocks in object storage
+	var report fsckReport
 	progress := utils.NewProgress(false, false)
-	blockDSpin := progress.AddDoubleSpinner("Found blocks")
 	var blocks = make(map[string]int64)
-	for obj := range objs {
-		if obj == nil {
-			break // failed listing
-		}
-		if obj.IsDir() {
-			continue
+	scrub := ctx.Bool("scrub")
+	var store chunk.ChunkStore
+	if scrub {
+		// all the blocks are downloaded, so the listing is not needed
+		store = chunk.NewCachedStore(blob, chunkConf)
+	} else {
+		objs, err := listBlocks(ctx, blob)
+		if err != nil {
+			logger.Fatalf("list all blocks: %s", err)
 		}
 
-		logger.Debugf("found block %s", obj.Key())
-		parts := strings.Split(obj.Key(), "/")
-		if len(parts) != 3 {
-			continue
-		}
-		name := parts[2]
-		blocks[name] = obj.Size()
-		blockDSpin.IncrInt64(obj.Size())
-	}
-	blockDSpin.Done()
-	if progress.Quiet {
-		c, b := blockDSpin.Current()
-		logger.Infof("Found %d blocks (%d bytes)", c, b)
-	}
+		// Find all blocks in object storage
+		blockDSpin := progress.AddDoubleSpinner("Found blocks")
+		for obj := range objs {
+			if obj == nil {
+				break // failed listing
+			}
+			if obj.IsDir() {
+				continue
+			}
 
-	// List all slices in metadata engine
-	sliceCSpin := progress.AddCountSpinner("Listed slices")
-	var c = meta.NewContext(0, 0, []uint32{0})
-	slices := make(map[meta.Ino][]meta.Slice)
-	r := m.ListSlices(c, slices, false, sliceCSpin.Increment)
-	if r != 0 {
-		logger.Fatalf("list all slices: %s", r)
+			logger.Debugf("found block %s", obj.Key())
+			parts := strings.Split(obj.Key(), "/")
+			if len(parts) != 3 {
+				continue
+			}
+			name := parts[2]
+			blocks[name] = obj.Size()
+			blockDSpin.IncrInt64(obj.Size())
+		}
+		blockDSpin.Done()
+		report.Blocks, report.BlockBytes = blockDSpin.Current()
+		if progress.Quiet {
+			logger.Infof("Found %d blocks (%d bytes)", report.Blocks, report.BlockBytes)
+		}
 	}
-	sliceCSpin.Done()
+	blob = object.WithPrefix(blob, "chunks/")
 
-	// Scan all slices to find lost blocks
-	sliceCBar := progress.AddCountBar("Scanned slices", sliceCSpin.Current())
+	// Scan all slices in metadata engine to find lost blocks
+	sliceCSpin := progress.AddCountSpinner("Scanned slices")
 	sliceBSpin := progress.AddByteSpinner("Scanned slices")
 	lostDSpin := progress.AddDoubleSpinner("Lost blocks")
-	brokens := make(map[meta.Ino]string)
-	for inode, ss := range slices {
-		for _, s := range ss {
-			n := (s.Size - 1) / uint32(chunkConf.BlockSize)
-			for i := uint32(0); i <= n; i++ {
-				sz := chunkConf.BlockSize
-				if i == n {
-					sz = int(s.Size) - int(i)*chunkConf.BlockSize
-				}
-				key := fmt.Sprintf("%d_%d_%d", s.Chunkid, i, sz)
-				if _, ok := blocks[key]; !ok {
-					if _, err := blob.Head(key); err != nil {
-						if _, ok := brokens[inode]; !ok {
-							if p, st := meta.GetPath(m, meta.Background, inode); st == 0 {
-								brokens[inode] = p
-							} else {
-								logger.Warnf("getpath of inode %d: %s", inode, st)
-								brokens[inode] = st.Error()
-							}
-						}
-						logger.Errorf("can't find block %s for file %s: %s", key, brokens[inode], err)
-						lostDSpin.IncrInt64(int64(sz))
+	brokens := make(map[meta.Ino]*fsckBrokenFile)
+	var brokenLock sync.Mutex
+	var scrubDSpin *utils.DoubleSpinner
+	if scrub {
+		scrubDSpin = progress.AddDoubleSpinner("Scrubbed blocks")
+	}
+	lost := func(b *fsckBlock, err error) {
+		brokenLock.Lock()
+		defer brokenLock.Unlock()
+		f := brokens[b.inode]
+		if f == nil {
+			f = &fsckBrokenFile{Inode: b.inode}
+			if ps := meta.GetPaths(m, meta.Background, b.inode); len(ps) > 0 {
+				f.Paths = ps
+			} else {
+				logger.Warnf("getpath of inode %d: not found", b.inode)
+				f.Paths = []string{"unknown"}
+			}
+			var attr meta.Attr
+			if st := m.GetAttr(meta.Background, b.inode, &attr); st == 0 {
+				f.Length = attr.Length
+			}
+			brokens[b.inode] = f
+			report.BrokenFiles = append(report.BrokenFiles, f)
+		}
+		f.LostBlocks++
+		f.LostBytes += int64(b.size)
+		report.Lost = append(report.Lost, &fsckLostBlock{b.inode, b.key, b.size, err.Error()})
+		if scrub {
+			logger.Errorf("can't read block %s for file %s: %s", b.key, strings.Join(f.Paths, ", "), err)
+		} else {
+			logger.Errorf("can't find block %s for file %s: %s", b.key, strings.Join(f.Paths, ", "), err)
+		}
+		lostDSpin.IncrInt64(int64(b.size))
+	}
+
+	// the blocks missing in the listing could be created after listed, check them in parallel
+	check := func(b *fsckBlock) error {
+		if scrub {
+			// the length is verified when loaded, also the content of compressed or encrypted blocks
+			page := chunk.NewOffPage(b.size)
+			defer page.Release()
+			_, err := store.NewReader(b.chunkid, b.length).ReadAt(context.Background(), page, b.indx*chunkConf.BlockSize)
+			if err == nil {
+				scrubDSpin.IncrInt64(int64(b.size))
+			}
+			return err
+		}
+		key := fmt.Sprintf("%d/%d/%s", b.chunkid/1000/1000, b.chunkid/1000, b.key)
+		if format.Partitions > 1 {
+			key = fmt.Sprintf("%02X/%d/%s", b.chunkid%256, b.chunkid/1000/1000, b.key)
+		}
+		_, err := blob.Head(key)
+		return err
+	}
+	threads := ctx.Int("threads")
+	if threads <= 0 {
+		threads = 1
+	}
+	batches := make(chan []*fsckBlock, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, b := range batch {
+					if err := check(b); err != nil {
+						lost(b, err)
 					}
 				}
 			}
-			sliceCBar.Increment()
-			sliceBSpin.IncrInt64(int64(s.Size))
+		}()
+	}
+	var batch []*fsckBlock
+	var c = meta.NewContext(0, 0, []uint32{0})
+	r := m.ListSlices(c, false, func(inode meta.Ino, s meta.Slice) error {
+		n := (s.Size - 1) / uint32(chunkConf.BlockSize)
+		for i := uint32(0); i <= n; i++ {
+			sz := chunkConf.BlockSize
+			if i == n {
+				sz = int(s.Size) - int(i)*chunkConf.BlockSize
+			}
+			key := fmt.Sprintf("%d_%d_%d", s.Chunkid, i, sz)
+			if _, ok := blocks[key]; !ok {
+				batch = append(batch, &fsckBlock{inode, s.Chunkid, key, sz, int(i), int(s.Size)})
+				if len(batch) == fsckBatchSize {
+					batches <- batch
+					batch = nil
+				}
+			}
 		}
+		sliceCSpin.Increment()
+		sliceBSpin.IncrInt64(int64(s.Size))
+		return nil
+	})
+	if len(batch) > 0 {
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+	if r != 0 {
+		logger.Fatalf("list all slices: %s", r)
 	}
 	progress.Done()
 	if progress.Quiet {
-		logger.Infof("Used by %d slices (%d bytes)", sliceCBar.Current(), sliceBSpin.Current())
+		logger.Infof("Used by %d slices (%d bytes)", sliceCSpin.Current(), sliceBSpin.Current())
+		if scrub {
+			c, b := scrubDSpin.Current()
+			logger.Infof("Scrubbed %d blocks (%d bytes)", c, b)
+		}
+	}
+	report.Slices, report.SliceBytes = sliceCSpin.Current(), sliceBSpin.Current()
+	if scrub {
+		report.Scrubbed, report.ScrubbedBytes = scrubDSpin.Current()
+	}
+	report.LostBlocks, report.LostBytes = lostDSpin.Current()
+	sort.Slice(report.BrokenFiles, func(i, j int) bool { return report.BrokenFiles[i].Inode < report.BrokenFiles[j].Inode })
+	if err = writeReport(ctx, &report); err != nil {
+		return err
 	}
-	if lc, lb := lostDSpin.Current(); lc > 0 {
-		msg := fmt.Sprintf("%d objects are lost (%d bytes), %d broken files:\n", lc, lb, len(brokens))
-		msg += fmt.Sprintf("%13s: PATH\n", "INODE")
+	if lc, lb := report.LostBlocks, report.LostBytes; lc > 0 {
+		msg := fmt.Sprintf("%d objects are lost (%d bytes), %d broken files", lc, lb, len(brokens))
+		if ctx.Bool("json") {
+			logger.Fatal(msg)
+		}
+		msg += fmt.Sprintf(":\n%13s: PATH\n", "INODE")
 		var fileList []string
-		for i, p := range brokens {
-			fileList = append(fileList, fmt.Sprintf("%13d: %s", i, p))
+		for _, f := range report.BrokenFiles {
+			for _, p := range f.Paths {
+				fileList = append(fileList, fmt.Sprintf("%13d: %s", f.Inode, p))
+			}
 		}
 		sort.Strings(fileList)
 		msg += strings.Join(fileList, "\n")
@@ -161,3 +356,33 @@ func fsck(ctx *cli.Context) error {
 
 	return nil
 }
+
+// problem classes in the order of the summary
+var problemClasses = []string{meta.ProblemOrphan, meta.ProblemNlink, meta.ProblemDangling, meta.ProblemParent, meta.ProblemUsage}
+
+func fsckMeta(ctx *cli.Context, m meta.Meta) error {
+	var report meta.NamespaceReport
+	if st := m.CheckNamespace(meta.Background, &report); st != 0 {
+		return fmt.Errorf("check metadata: %s", st)
+	}
+	for _, p := range report.Problems {
+		logger.Warnf("%s", p)
+	}
+	counts := make(map[string]int)
+	for _, class := range problemClasses {
+		counts[class] = report.Count(class)
+	}
+	if err := writeReport(ctx, &fsckMetaReport{&report, counts}); err != nil {
+		return err
+	}
+	if !ctx.Bool("json") {
+		fmt.Printf("Checked %d inodes and %d entries, %d problems found\n", report.Inodes, report.Entries, len(report.Problems))
+		for _, class := range problemClasses {
+			fmt.Printf("%10s: %d\n", class, counts[class])
+		}
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("metadata is inconsistent")
+	}
+	return nil
+}
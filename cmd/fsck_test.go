@@ -17,9 +17,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"testing"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
 )
 
 func TestFsck(t *testing.T) {
@@ -49,3 +55,138 @@ func TestFsck(t *testing.T) {
 		t.Fatalf("fsck failed: %v", err)
 	}
 }
+
+func TestFsckMeta(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "fsck.db")
+	if err := Main([]string{"", "format", metaUrl, "--bucket", t.TempDir(), "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	if err := Main([]string{"", "fsck", metaUrl, "--meta"}); err != nil {
+		t.Fatalf("fsck a new volume: %s", err)
+	}
+	// the client without session never flushes the counters
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	var inode meta.Ino
+	if st := m.Mkdir(meta.Background, 1, "d", 0755, 022, 0, &inode, &meta.Attr{}); st != 0 {
+		t.Fatalf("mkdir: %s", st)
+	}
+	output := filepath.Join(t.TempDir(), "report.json")
+	if err := Main([]string{"", "fsck", metaUrl, "--meta", "--output", output}); err == nil {
+		t.Fatalf("fsck should find the wrong counters")
+	}
+	var report fsckMetaReport
+	if data, err := ioutil.ReadFile(output); err != nil {
+		t.Fatalf("read report: %s", err)
+	} else if err = json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("parse report: %s", err)
+	}
+	if report.Inodes != 3 || report.Counts[meta.ProblemUsage] == 0 || len(report.Problems) == 0 {
+		t.Fatalf("unexpected report: %+v %+v", report.NamespaceReport, report.Counts)
+	}
+}
+
+func TestFsckThreads(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "fsck.db")
+	if err := Main([]string{"", "format", metaUrl, "--bucket", t.TempDir(), "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	// the blocks written after the listing are checked one by one
+	listing := filepath.Join(t.TempDir(), "listing")
+	if err := Main([]string{"", "list-save", metaUrl, listing}); err != nil {
+		t.Fatalf("list-save: %s", err)
+	}
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	blob, err := createStorage(format)
+	if err != nil {
+		t.Fatalf("object storage: %s", err)
+	}
+	ctx := meta.Background
+	for i := 0; i < 250; i++ {
+		var inode meta.Ino
+		if st := m.Create(ctx, 1, fmt.Sprintf("f%d", i), 0644, 022, 0, &inode, &meta.Attr{}); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+		var id uint64
+		if st := m.NewChunk(ctx, &id); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		key := fmt.Sprintf("chunks/%d/%d/%d_0_4", id/1000/1000, id/1000, id)
+		if err = blob.Put(key, bytes.NewReader([]byte("test"))); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+		if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: id, Size: 4, Len: 4}); st != 0 {
+			t.Fatalf("write: %s", st)
+		}
+	}
+	output := filepath.Join(t.TempDir(), "report.json")
+	if err = Main([]string{"", "fsck", metaUrl, "--use-listing", listing, "--threads", "4", "--output", output}); err != nil {
+		t.Fatalf("fsck: %s", err)
+	}
+	var report fsckReport
+	if data, err := ioutil.ReadFile(output); err != nil {
+		t.Fatalf("read report: %s", err)
+	} else if err = json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("parse report: %s", err)
+	}
+	if report.Slices != 250 || report.SliceBytes != 1000 || report.LostBlocks != 0 || len(report.BrokenFiles) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestFsckScrub(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "fsck.db")
+	if err := Main([]string{"", "format", metaUrl, "--bucket", t.TempDir(), "--compress", "lz4", "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	blob, err := createStorage(format)
+	if err != nil {
+		t.Fatalf("object storage: %s", err)
+	}
+	store := chunk.NewCachedStore(blob, chunk.Config{BlockSize: format.BlockSize << 10, Compress: format.Compression, MaxUpload: 1, BufferSize: 10 << 20})
+	ctx := meta.Background
+	for i := 0; i < 10; i++ {
+		var inode meta.Ino
+		if st := m.Create(ctx, 1, fmt.Sprintf("f%d", i), 0644, 022, 0, &inode, &meta.Attr{}); st != 0 {
+			t.Fatalf("create: %s", st)
+		}
+		var id uint64
+		if st := m.NewChunk(ctx, &id); st != 0 {
+			t.Fatalf("new chunk: %s", st)
+		}
+		w := store.NewWriter(id)
+		if _, err = w.WriteAt([]byte("hello world"), 0); err != nil {
+			t.Fatalf("write chunk %d: %s", id, err)
+		}
+		if err = w.Finish(11); err != nil {
+			t.Fatalf("upload chunk %d: %s", id, err)
+		}
+		if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: id, Size: 11, Len: 11}); st != 0 {
+			t.Fatalf("write: %s", st)
+		}
+	}
+	output := filepath.Join(t.TempDir(), "report.json")
+	if err = Main([]string{"", "fsck", metaUrl, "--scrub", "--download-limit", "100", "--output", output}); err != nil {
+		t.Fatalf("fsck --scrub: %s", err)
+	}
+	var report fsckReport
+	if data, err := ioutil.ReadFile(output); err != nil {
+		t.Fatalf("read report: %s", err)
+	} else if err = json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("parse report: %s", err)
+	}
+	if report.Scrubbed != 10 || report.ScrubbedBytes != 110 || report.LostBlocks != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
@@ -19,6 +19,7 @@
 package main
 
 import (
+	"context"
 	"path/filepath"
 
 	"github.com/juicedata/juicefs/pkg/metric"
@@ -29,6 +30,7 @@ import (
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
 	jfsgateway "github.com/juicedata/juicefs/pkg/gateway"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/usage"
@@ -76,6 +78,23 @@ func gatewayFlags() *cli.Command {
 		&cli.BoolFlag{
 			Name:  "no-usage-report",
 			Usage: "do not send usage report",
+		})
+	flags = append(flags, s3Flags()...)
+	return &cli.Command{
+		Name:      "gateway",
+		Usage:     "S3-compatible gateway",
+		ArgsUsage: "META-URL ADDRESS",
+		Flags:     flags,
+		Action:    gateway,
+	}
+}
+
+// s3Flags returns the options of S3 service, which are shared by gateway and mount --gateway.
+func s3Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "s3-access-log",
+			Usage: "path for access log of S3 requests (in the format of S3 server access log)",
 		},
 		&cli.BoolFlag{
 			Name:  "no-banner",
@@ -88,23 +107,50 @@ func gatewayFlags() *cli.Command {
 		&cli.BoolFlag{
 			Name:  "keep-etag",
 			Usage: "keep the ETag for uploaded objects",
-		})
-	return &cli.Command{
-		Name:      "gateway",
-		Usage:     "S3-compatible gateway",
-		ArgsUsage: "META-URL ADDRESS",
-		Flags:     flags,
-		Action:    gateway,
+		},
+		&cli.DurationFlag{
+			Name:  "object-lock-retention",
+			Usage: "lock new objects for the duration (\"m\", \"h\"), so they can't be overwritten or deleted (0 means disable)",
+		},
+		&cli.StringFlag{
+			Name:  "object-lock-mode",
+			Value: "COMPLIANCE",
+			Usage: "mode of the default retention: COMPLIANCE or GOVERNANCE (can be bypassed with x-amz-bypass-governance-retention by the users with s3:BypassGovernanceRetention)",
+		},
 	}
 }
 
+// mountGatewayFlags returns the options of mount to serve the volume over S3 in the same process.
+func mountGatewayFlags() []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "gateway",
+			Usage: "serve the volume over S3 at this `ADDRESS` too, sharing the cache, buffers and metadata session with the mount point",
+		},
+	}, s3Flags()...)
+}
+
 func gateway(c *cli.Context) error {
 	setLoggerLevel(c)
+	adjustForCgroup(c, c.LocalFlagNames())
 
 	if c.Args().Len() < 2 {
 		logger.Fatalf("Meta URL and listen address are required")
 	}
 
+	gw = &GateWay{ctx: c}
+	return serveS3(c, c.Args().Get(1))
+}
+
+// mountGateway serves the mounted volume over S3, it exits the process if the service stops.
+func mountGateway(c *cli.Context, v *vfs.VFS) {
+	gw = &GateWay{ctx: c, v: v}
+	if err := serveS3(c, c.String("gateway")); err != nil {
+		logger.Fatalf("gateway: %s", err)
+	}
+}
+
+func serveS3(c *cli.Context, address string) error {
 	ak := os.Getenv("MINIO_ROOT_USER")
 	if ak == "" {
 		ak = os.Getenv("MINIO_ACCESS_KEY")
@@ -120,9 +166,6 @@ func gateway(c *cli.Context) error {
 		logger.Fatalf("MINIO_ROOT_PASSWORD should be specified as an environment variable with at least 8 characters")
 	}
 
-	address := c.Args().Get(1)
-	gw = &GateWay{c}
-
 	args := []string{"gateway", "--address", address, "--anonymous"}
 	if c.Bool("no-banner") {
 		args = append(args, "--quiet")
@@ -155,12 +198,14 @@ func gateway(c *cli.Context) error {
 var gw *GateWay
 
 func gateway2(ctx *mcli.Context) error {
+	jfsgateway.RegisterHandler()
 	minio.StartGateway(ctx, gw)
 	return nil
 }
 
 type GateWay struct {
 	ctx *cli.Context
+	v   *vfs.VFS // the mounted volume to share with
 }
 
 func (g *GateWay) Name() string {
@@ -173,6 +218,9 @@ func (g *GateWay) Production() bool {
 
 func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, error) {
 	c := g.ctx
+	if g.v != nil {
+		return g.mountedLayer()
+	}
 	addr := c.Args().Get(0)
 	m := meta.NewClient(addr, &meta.Config{
 		Retries:    10,
@@ -182,6 +230,14 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		MountPoint: "s3gateway",
 		Subdir:     c.String("subdir"),
 		MaxDeletes: c.Int("max-deletes"),
+
+		MaxOpenFiles:  c.Int("max-open-files"),
+		Broker:        c.String("meta-broker"),
+		Heartbeat:     c.Duration("heartbeat"),
+		SkipDirMtime:  c.Duration("skip-dir-mtime"),
+		ScrubInterval: c.Duration("meta-scrub-interval"),
+		AtimeMode:     atimeMode(c),
+		MetaCache:     c.Duration("meta-cache"),
 	})
 	format, err := m.Load()
 	if err != nil {
@@ -190,11 +246,13 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	wrapRegister("s3gateway", format.Name)
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		CompressDict: format.CompressDict,
 
 		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
 		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
+		UploadRetry:   c.Duration("upload-retry-window"),
 		MaxUpload:     c.Int("max-uploads"),
 		Writeback:     c.Bool("writeback"),
 		Prefetch:      c.Int("prefetch"),
@@ -207,7 +265,16 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		FreeSpace:      float32(c.Float64("free-space-ratio")),
 		CacheMode:      os.FileMode(0600),
 		CacheFullBlock: !c.Bool("cache-partial-only"),
+		CacheAdmission: c.String("cache-admission"),
 		AutoCreate:     true,
+		IdleShrink:     c.Duration("idle-shrink"),
+		WritebackPeer:  c.String("writeback-peer"),
+		ReplicaListen:  c.String("replica-listen"),
+		ReplicaSecret:  c.String("replica-secret"),
+		ReplicaVolume:  format.UUID,
+		ReplicaTLSCert: c.String("replica-tls-cert"),
+		ReplicaTLSKey:  c.String("replica-tls-key"),
+		ReplicaTLSCA:   c.String("replica-tls-ca"),
 	}
 	if chunkConf.CacheDir != "memory" {
 		ds := utils.SplitDir(chunkConf.CacheDir)
@@ -224,6 +291,12 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	if os.Getenv("JFS_NO_CHECK_OBJECT_STORAGE") == "" {
+		if err = checkMarker(blob, format, c.Bool("read-only")); err != nil {
+			logger.Fatalf("Check object storage %s: %s", blob, err)
+		}
+	}
+	blob = withBilling(c, blob, format)
 
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
@@ -255,6 +328,7 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	}
 
 	metricsAddr := exposeMetrics(m, c)
+	jfsgateway.InitMetrics()
 	if c.IsSet("consul") {
 		metric.RegisterToConsul(c.String("consul"), metricsAddr, "s3gateway")
 	}
@@ -264,5 +338,48 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 	if !c.Bool("no-usage-report") {
 		go usage.ReportUsage(m, "gateway "+version.Version())
 	}
-	return jfsgateway.NewJFSGateway(conf, m, store, c.Bool("multi-buckets"), c.Bool("keep-etag"))
+	layer, err := jfsgateway.NewJFSGateway(conf, m, store, c.Bool("multi-buckets"), c.Bool("keep-etag"), c.Duration("object-lock-retention"), c.String("object-lock-mode"))
+	if err != nil {
+		return nil, err
+	}
+	return jfsgateway.Instrument(layer, c.String("s3-access-log"))
+}
+
+// mountedLayer returns a gateway layer on the mounted volume, which shares the cache and buffers
+// of it, so the files written through one interface can be read from the other one at once.
+func (g *GateWay) mountedLayer() (minio.ObjectLayer, error) {
+	c := g.ctx
+	conf := *g.v.Conf // the timeouts of the mount are set by itself concurrently
+	conf.AttrTimeout = time.Millisecond * time.Duration(c.Float64("attr-cache")*1000)
+	conf.EntryTimeout = time.Millisecond * time.Duration(c.Float64("entry-cache")*1000)
+	conf.DirEntryTimeout = time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000)
+	conf.AccessLog = ""
+	jfs, err := fs.NewFileSystemOnVFS(&conf, g.v)
+	if err != nil {
+		return nil, err
+	}
+	jfsgateway.InitMetrics()
+	layer, err := jfsgateway.NewJFSGatewayOnFS(&conf, jfs, c.Bool("multi-buckets"), c.Bool("keep-etag"), c.Duration("object-lock-retention"), c.String("object-lock-mode"))
+	if err != nil {
+		return nil, err
+	}
+	layer, err = jfsgateway.Instrument(layer, c.String("s3-access-log"))
+	if err != nil {
+		return nil, err
+	}
+	return &mountedGateway{layer, g.v.Conf.Mountpoint}, nil
+}
+
+// mountedGateway umounts the volume when the gateway is shut down, which exits the process then.
+type mountedGateway struct {
+	minio.ObjectLayer
+	mp string
+}
+
+func (g *mountedGateway) Shutdown(ctx context.Context) error {
+	err := g.ObjectLayer.Shutdown(ctx)
+	if e := doUmount(g.mp, true); e != nil {
+		logger.Warnf("umount %s: %s", g.mp, e)
+	}
+	return err
 }
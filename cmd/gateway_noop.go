@@ -21,6 +21,7 @@ package main
 import (
 	"errors"
 
+	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/urfave/cli/v2"
 )
 
@@ -33,3 +34,11 @@ func gatewayFlags() *cli.Command {
 		},
 	}
 }
+
+func mountGatewayFlags() []cli.Flag {
+	return nil
+}
+
+func mountGateway(c *cli.Context, v *vfs.VFS) {
+	logger.Fatalf("gateway is not supported")
+}
@@ -26,9 +26,9 @@ import (
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/object"
-	osync "github.com/juicedata/juicefs/pkg/sync"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/juju/ratelimit"
 
 	"github.com/urfave/cli/v2"
 )
@@ -51,8 +51,17 @@ func gcFlags() *cli.Command {
 			&cli.IntFlag{
 				Name:  "threads",
 				Value: 10,
-				Usage: "number threads to delete leaked objects",
+				Usage: "number of threads to compact chunks and delete leaked objects",
 			},
+			&cli.IntFlag{
+				Name:  "delete-limit",
+				Usage: "max number of objects to delete per second (0 means unlimited)",
+			},
+			&cli.StringFlag{
+				Name:  "use-listing",
+				Usage: "read objects from the listing `FILE` saved by list-save instead of listing the bucket",
+			},
+			adminTokenFlag(),
 		},
 	}
 }
@@ -76,10 +85,16 @@ func gc(ctx *cli.Context) error {
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
+	if ctx.Bool("delete") {
+		if err = checkAdmin(ctx, format); err != nil {
+			logger.Fatalf("%s", err)
+		}
+	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		CompressDict: format.CompressDict,
 
 		GetTimeout: time.Second * 60,
 		PutTimeout: time.Second * 60,
@@ -111,7 +126,7 @@ func gc(ctx *cli.Context) error {
 			}
 			return err
 		})
-		if st := m.CompactAll(meta.Background, bar); st == 0 {
+		if st := m.CompactAll(meta.Background, ctx.Int("threads"), bar); st == 0 {
 			bar.Done()
 			spin.Done()
 			if progress.Quiet {
@@ -127,6 +142,18 @@ func gc(ctx *cli.Context) error {
 		})
 	}
 
+	// count the data waiting to be deleted before it's cleaned up
+	var stats meta.GCStats
+	if st := m.GetGCStats(meta.Background, &stats); st != 0 {
+		logger.Warnf("count pending deletion: %s", st)
+	}
+
+	// limit the rate of deleting pending chunks and leaked objects
+	var limiter *ratelimit.Bucket
+	if limit := ctx.Int("delete-limit"); limit > 0 {
+		limiter = ratelimit.NewBucketWithRate(float64(limit), int64(limit))
+	}
+
 	// put it above delete count spinner
 	sliceCSpin := progress.AddCountSpinner("Listed slices")
 
@@ -148,6 +175,9 @@ func gc(ctx *cli.Context) error {
 			go func() {
 				defer wg.Done()
 				for c := range chunkChan {
+					if n := (int64(c.length) + int64(chunkConf.BlockSize) - 1) / int64(chunkConf.BlockSize); limiter != nil && n > 0 {
+						limiter.Wait(n) // one object for every block
+					}
 					if err := store.Remove(c.chunkid, int(c.length)); err != nil {
 						logger.Warnf("remove %d_%d: %s", c.chunkid, c.length, err)
 					}
@@ -158,8 +188,18 @@ func gc(ctx *cli.Context) error {
 
 	// List all slices in metadata engine
 	var c = meta.NewContext(0, 0, []uint32{0})
-	slices := make(map[meta.Ino][]meta.Slice)
-	r := m.ListSlices(c, slices, delete, sliceCSpin.Increment)
+	keys := make(map[uint64]uint32)
+	var total int64
+	var totalBytes uint64
+	r := m.ListSlices(c, delete, func(inode meta.Ino, s meta.Slice) error {
+		if _, ok := keys[s.Chunkid]; !ok {
+			keys[s.Chunkid] = s.Size
+			total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
+			totalBytes += uint64(s.Size)
+		}
+		sliceCSpin.Increment()
+		return nil
+	})
 	if r != 0 {
 		logger.Fatalf("list all slices: %s", r)
 	}
@@ -174,21 +214,11 @@ func gc(ctx *cli.Context) error {
 	sliceCSpin.Done()
 
 	// Scan all objects to find leaked ones
+	objs, err := listBlocks(ctx, blob)
 	blob = object.WithPrefix(blob, "chunks/")
-	objs, err := osync.ListAll(blob, "", "")
 	if err != nil {
 		logger.Fatalf("list all blocks: %s", err)
 	}
-	keys := make(map[uint64]uint32)
-	var total int64
-	var totalBytes uint64
-	for _, ss := range slices {
-		for _, s := range ss {
-			keys[s.Chunkid] = s.Size
-			total += int64(int(s.Size-1)/chunkConf.BlockSize) + 1 // s.Size should be > 0
-			totalBytes += uint64(s.Size)
-		}
-	}
 	if progress.Quiet {
 		logger.Infof("using %d slices (%d bytes)", len(keys), totalBytes)
 	}
@@ -204,6 +234,9 @@ func gc(ctx *cli.Context) error {
 		go func() {
 			defer wg.Done()
 			for key := range leakedObj {
+				if limiter != nil {
+					limiter.Wait(1)
+				}
 				if err := blob.Delete(key); err != nil {
 					logger.Warnf("delete %s: %s", key, err)
 				}
@@ -278,6 +311,8 @@ func gc(ctx *cli.Context) error {
 	sc, sb := skipped.Current()
 	logger.Infof("scanned %d objects, %d valid, %d leaked (%d bytes), %d skipped (%d bytes)",
 		bar.Current(), vc, lc, lb, sc, sb)
+	logger.Infof("pending deletion: %d files (%d bytes), %d slices (%d bytes); leaked slices in metadata: %d (%d bytes)",
+		stats.PendingFiles, stats.PendingFileSpace, stats.PendingSlices, stats.PendingSliceSpace, stats.LeakedSlices, stats.LeakedSpace)
 	if lc > 0 && !delete {
 		logger.Infof("Please add `--delete` to clean leaked objects")
 	}
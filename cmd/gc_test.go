@@ -48,5 +48,8 @@ func TestGc(t *testing.T) {
 	if err != nil {
 		t.Fatalf("fsck failed: %v", err)
 	}
+	if err = Main([]string{"", "gc", "--delete", "--delete-limit", "100", metaUrl}); err != nil {
+		t.Fatalf("gc --delete failed: %v", err)
+	}
 
 }
@@ -0,0 +1,109 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func heatFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "heat",
+		Usage:     "show the report of hot, warm and cold data in a directory",
+		ArgsUsage: "PATH",
+		Action:    heat,
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "hot",
+				Value: time.Hour * 24,
+				Usage: "files accessed within this duration are hot",
+			},
+			&cli.DurationFlag{
+				Name:  "warm",
+				Value: time.Hour * 24 * 7,
+				Usage: "files accessed within this duration are warm, others are cold",
+			},
+			&cli.UintFlag{
+				Name:  "top",
+				Value: 10,
+				Usage: "number of the most accessed files to show",
+			},
+		},
+	}
+}
+
+func heat(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if runtime.GOOS == "windows" {
+		logger.Infof("Windows is not supported")
+		return nil
+	}
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("PATH is needed")
+	}
+	hot, warm := ctx.Duration("hot"), ctx.Duration("warm")
+	if hot > warm {
+		return fmt.Errorf("--hot (%s) should not be longer than --warm (%s)", hot, warm)
+	}
+	d, err := filepath.Abs(ctx.Args().First())
+	if err != nil {
+		logger.Fatalf("abs of %s: %s", ctx.Args().First(), err)
+	}
+	inode, err := utils.GetFileInode(d)
+	if err != nil {
+		logger.Fatalf("lookup inode for %s: %s", d, err)
+	}
+	f := openController(d)
+	if f == nil {
+		logger.Fatalf("%s is not inside JuiceFS", d)
+	}
+	defer f.Close()
+
+	wb := utils.NewBuffer(8 + 18)
+	wb.Put32(meta.Heat)
+	wb.Put32(18)
+	wb.Put64(inode)
+	wb.Put32(uint32(hot / time.Second))
+	wb.Put32(uint32(warm / time.Second))
+	wb.Put16(uint16(ctx.Uint("top")))
+	if _, err = f.Write(wb.Bytes()); err != nil {
+		logger.Fatalf("write message: %s", err)
+	}
+	data := make([]byte, 4)
+	n, err := io.ReadFull(f, data)
+	if n == 1 && data[0] == byte(syscall.EINVAL&0xff) {
+		logger.Fatalf("heat is not supported, please upgrade and mount again")
+	}
+	if err != nil {
+		logger.Fatalf("read size: %d %s", n, err)
+	}
+	data = make([]byte, utils.ReadBuffer(data).Get32())
+	if _, err = io.ReadFull(f, data); err != nil {
+		logger.Fatalf("read report: %s", err)
+	}
+	fmt.Print(string(data))
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+	"github.com/urfave/cli/v2"
+)
+
+func listSaveFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "list-save",
+		Usage:     "save a listing of all objects of a volume into a file",
+		ArgsUsage: "META-URL FILE",
+		Action:    listSave,
+	}
+}
+
+func listSave(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and FILE are needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	blob, err := createStorage(format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+
+	path := ctx.Args().Get(1)
+	fp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	count, err := osync.SaveListing(blob, fp)
+	if e := fp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(path + ".tmp")
+		return fmt.Errorf("save listing: %s", err)
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	logger.Infof("Saved %d objects into %s in %s", count, path, time.Since(start))
+	return nil
+}
+
+// listBlocks lists the objects under chunks/ of blob, or reads them from
+// the listing given by --use-listing.
+func listBlocks(ctx *cli.Context, blob object.ObjectStorage) (<-chan object.Object, error) {
+	path := ctx.String("use-listing")
+	if path == "" {
+		return osync.ListAll(object.WithPrefix(blob, "chunks/"), "", "")
+	}
+	l, err := osync.OpenListing(path)
+	if err != nil {
+		return nil, err
+	}
+	if l.Storage != blob.String() {
+		return nil, fmt.Errorf("listing %s was saved from %s, not %s", path, l.Storage, blob)
+	}
+	logger.Infof("Use listing saved at %s (%s ago)", l.Time.Format(time.RFC3339), time.Since(l.Time).Truncate(time.Second))
+	return l.Objects("chunks/", "", "")
+}
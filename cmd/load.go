@@ -30,19 +30,47 @@ func load(ctx *cli.Context) error {
 	if ctx.Args().Len() < 1 {
 		return fmt.Errorf("META-URL is needed")
 	}
-	var fp io.ReadCloser
+	var fp io.Reader
 	if ctx.Args().Len() == 1 {
 		fp = os.Stdin
 	} else {
-		var err error
-		fp, err = os.Open(ctx.Args().Get(1))
-		if err != nil {
-			return err
+		var files []io.Reader
+		for _, name := range ctx.Args().Slice()[1:] {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			files = append(files, f)
+		}
+		fp = files[0]
+		if len(files) > 1 {
+			r, w := io.Pipe()
+			go func() {
+				_ = w.CloseWithError(meta.MergeDumps(w, files[0], files[1:]...))
+			}()
+			fp = r
 		}
-		defer fp.Close()
+	}
+	opts := &meta.LoadOptions{Conflict: ctx.String("conflict"), Conflicts: []*meta.LoadConflict{}}
+	switch opts.Conflict {
+	case meta.ConflictAbort, meta.ConflictSkip, meta.ConflictOverwrite, meta.ConflictRename:
+	default:
+		return fmt.Errorf("invalid conflict policy: %s", opts.Conflict)
 	}
 	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
-	if err := m.LoadMeta(fp); err != nil {
+	if format, err := m.Load(); err == nil {
+		if err = checkAdmin(ctx, format); err != nil {
+			return err
+		}
+	}
+	if err := m.LoadMeta(fp, opts); err != nil {
+		return err
+	}
+	if len(opts.Conflicts) > 0 {
+		logger.Warnf("Resolved %d conflicts of names with policy %s", len(opts.Conflicts), opts.Conflict)
+	}
+	if err := writeReport(ctx, opts.Conflicts); err != nil {
 		return err
 	}
 	logger.Infof("Load metadata from %s succeed", ctx.Args().Get(1))
@@ -53,7 +81,19 @@ func loadFlags() *cli.Command {
 	return &cli.Command{
 		Name:      "load",
 		Usage:     "load metadata from a previously dumped JSON file",
-		ArgsUsage: "META-URL [FILE]",
+		ArgsUsage: "META-URL [FILE [INCREMENTAL ...]]",
 		Action:    load,
+		Flags: []cli.Flag{
+			adminTokenFlag(),
+			&cli.StringFlag{
+				Name:  "conflict",
+				Value: meta.ConflictAbort,
+				Usage: "how to resolve the duplicated names in a directory of dumps in JSON lines: abort, skip, overwrite or rename (with a suffix like ~1)",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "save the conflicts resolved into `FILE` in JSON",
+			},
+		},
 	}
 }
@@ -0,0 +1,192 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+	"github.com/urfave/cli/v2"
+)
+
+// localityHandler serves the data of files under the path (relative to the root of mount) cached by this client.
+func localityHandler(v *vfs.VFS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, st := v.CachedData(r.URL.Query().Get("path"))
+		switch st {
+		case 0:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(files)
+		case syscall.ENOENT:
+			http.Error(w, st.Error(), http.StatusNotFound)
+		case syscall.EINVAL:
+			http.Error(w, st.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, st.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+type cachedNode struct {
+	Sid      uint64
+	Hostname string
+	IP       string `json:",omitempty"`
+	Cached   uint64
+}
+
+type fileLocality struct {
+	Path   string
+	Inode  meta.Ino
+	Length uint64
+	Nodes  []cachedNode
+}
+
+// localityAddr returns the address to reach the locality API of the session, or "" if it's not available.
+func localityAddr(s *meta.Session) string {
+	if s.MetricsAddr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(s.MetricsAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if s.IP == "" {
+			return ""
+		}
+		host = s.IP
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// relativePath translates p in the volume into the one in the mount of subdir, ok is false if it's outside of it.
+func relativePath(p, subdir string) (string, bool) {
+	p, subdir = path.Join("/", p), path.Join("/", subdir)
+	if subdir == "/" {
+		return p, true
+	}
+	if p == subdir {
+		return "/", true
+	}
+	if strings.HasPrefix(p, subdir+"/") {
+		return p[len(subdir):], true
+	}
+	return "", false
+}
+
+func queryLocality(client *http.Client, s *meta.Session, p string) ([]vfs.CachedFile, error) {
+	addr := localityAddr(s)
+	if addr == "" {
+		return nil, fmt.Errorf("locality API is not available")
+	}
+	rel, ok := relativePath(p, s.Subdir)
+	if !ok {
+		return nil, nil
+	}
+	u := url.URL{Scheme: "http", Host: addr, Path: "/locality", RawQuery: url.Values{"path": {rel}}.Encode()}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u.String(), resp.Status)
+	}
+	var files []vfs.CachedFile
+	if err = json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		files[i].Path = path.Join("/", s.Subdir, files[i].Path)
+	}
+	return files, nil
+}
+
+func locality(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and PATH are needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	p := path.Join("/", ctx.Args().Get(1))
+	sessions, err := m.ListSessions(&meta.SessionFilter{Hostname: ctx.String("hostname")})
+	if err != nil {
+		logger.Fatalf("list sessions: %s", err)
+	}
+
+	client := &http.Client{Timeout: ctx.Duration("timeout")}
+	byPath := make(map[string]*fileLocality)
+	for _, s := range sessions {
+		files, err := queryLocality(client, s, p)
+		if err != nil {
+			logger.Warnf("query locality from session %d (%s): %s", s.Sid, s.Hostname, err)
+			continue
+		}
+		for _, f := range files {
+			fl := byPath[f.Path]
+			if fl == nil {
+				fl = &fileLocality{Path: f.Path, Inode: f.Inode, Length: f.Length, Nodes: make([]cachedNode, 0)}
+				byPath[f.Path] = fl
+			}
+			if f.Cached > 0 {
+				fl.Nodes = append(fl.Nodes, cachedNode{s.Sid, s.Hostname, s.IP, f.Cached})
+			}
+		}
+	}
+
+	result := make([]*fileLocality, 0, len(byPath))
+	for _, fl := range byPath {
+		sort.Slice(fl.Nodes, func(i, j int) bool { return fl.Nodes[i].Cached > fl.Nodes[j].Cached })
+		result = append(result, fl)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	printJson(result)
+	return nil
+}
+
+func localityFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "locality",
+		Usage:     "show which clients cache the data of files under PATH in the volume",
+		ArgsUsage: "META-URL PATH",
+		Action:    locality,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "hostname",
+				Usage: "only query the clients on this host (name or IP)",
+			},
+			&cli.DurationFlag{
+				Name:  "timeout",
+				Value: time.Second * 5,
+				Usage: "timeout to query each client",
+			},
+		},
+	}
+}
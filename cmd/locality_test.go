@@ -0,0 +1,57 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestLocality(t *testing.T) {
+	addrs := map[string]string{
+		"127.0.0.1:9567":     "127.0.0.1:9567",
+		"0.0.0.0:9567":       "10.0.0.1:9567",
+		"[::]:9567":          "10.0.0.1:9567",
+		":9567":              "10.0.0.1:9567",
+		"":                   "",
+		"host.internal:9567": "host.internal:9567",
+	}
+	for addr, expected := range addrs {
+		s := &meta.Session{SessionInfo: meta.SessionInfo{IP: "10.0.0.1", MetricsAddr: addr}}
+		if a := localityAddr(s); a != expected {
+			t.Fatalf("locality address of %q: %q != %q", addr, a, expected)
+		}
+	}
+
+	cases := []struct {
+		p, subdir, rel string
+		ok             bool
+	}{
+		{"/d/f", "", "/d/f", true},
+		{"d/f", "/", "/d/f", true},
+		{"/d/f", "d", "/f", true},
+		{"/d", "/d/", "/", true},
+		{"/dd/f", "/d", "", false},
+		{"/e", "/d", "", false},
+	}
+	for _, c := range cases {
+		if rel, ok := relativePath(c.p, c.subdir); rel != c.rel || ok != c.ok {
+			t.Fatalf("relative path of %s in %s: %s %t", c.p, c.subdir, rel, ok)
+		}
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/google/gops/agent"
 	"github.com/sirupsen/logrus"
 
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
 	"github.com/urfave/cli/v2"
@@ -78,20 +79,42 @@ func Main(args []string) error {
 			mountFlags(),
 			umountFlags(),
 			gatewayFlags(),
+			sftpFlags(),
 			syncFlags(),
 			rmrFlags(),
+			cloneFlags(),
 			infoFlags(),
+			heatFlags(),
+			faultFlags(),
+			chattrFlags(),
+			freezeFlags(),
+			thawFlags(),
 			benchFlags(),
 			gcFlags(),
 			checkFlags(),
+			findFlags(),
+			createTreeFlags(),
+			quotaFlags(),
+			listSaveFlags(),
+			brokerFlags(),
 			profileFlags(),
 			statsFlags(),
 			statusFlags(),
+			sessionFlags(),
+			localityFlags(),
 			warmupFlags(),
+			cacheFlags(),
+			traceBlocksFlags(),
+			traceBlockFlags(),
 			dumpFlags(),
 			loadFlags(),
+			migrateMetaFlags(),
 			configFlags(),
+			trainDictFlags(),
+			publishFlags(),
+			policyFlags(),
 			destroyFlags(),
+			restoreFlags(),
 		},
 	}
 
@@ -104,6 +127,13 @@ func Main(args []string) error {
 		}
 	}
 
+	// storages provided as Go plugins
+	if plugins := os.Getenv("JFS_OBJECT_PLUGINS"); plugins != "" {
+		if err := object.LoadPlugins(plugins); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	return app.Run(reorderOptions(app, args))
 
 }
@@ -240,6 +270,16 @@ func reorderOptions(app *cli.App, args []string) []string {
 
 	newArgs = append(newArgs, cmdName)
 	args, others = others[1:], nil
+	if len(cmd.Subcommands) > 0 && len(args) > 0 {
+		for _, c := range cmd.Subcommands {
+			if c.Name == args[0] {
+				cmd = c
+				newArgs = append(newArgs, args[0])
+				args = args[1:]
+				break
+			}
+		}
+	}
 	// -h is valid for all the commands
 	cmdFlags := append(cmd.Flags, cli.HelpFlag)
 	for i := 0; i < len(args); i++ {
@@ -251,7 +291,7 @@ func reorderOptions(app *cli.App, args []string) []string {
 				newArgs = append(newArgs, args[i])
 			}
 		} else {
-			if strings.HasPrefix(option, "-") && !stringContains(args, "--generate-bash-completion") {
+			if strings.HasPrefix(option, "-") && option != "-" && !stringContains(args, "--generate-bash-completion") { // "-" for stdin or stdout
 				logger.Fatalf("unknown option: %s", option)
 			}
 			others = append(others, option)
@@ -44,6 +44,19 @@ func TestArgsOrder(t *testing.T) {
 					},
 				},
 			},
+			{
+				Name: "cmd2",
+				Subcommands: []*cli.Command{
+					{
+						Name: "sub",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name: "k3",
+							},
+						},
+					},
+				},
+			},
 		},
 	}
 
@@ -52,6 +65,10 @@ func TestArgsOrder(t *testing.T) {
 		{"test", "--v", "cmd", "-k2", "v2", "a", "b"},
 		{"test", "cmd", "a", "-k2=v", "--h"},
 		{"test", "cmd", "-k2=v", "--h", "a"},
+		{"test", "cmd2", "sub", "a", "--k3", "v3"},
+		{"test", "cmd2", "sub", "--k3", "v3", "a"},
+		{"test", "cmd2", "sub", "a", "-", "--k3", "v3"},
+		{"test", "cmd2", "sub", "--k3", "v3", "a", "-"},
 	}
 	for i := 0; i < len(cases); i += 2 {
 		oreded := reorderOptions(app, cases[i])
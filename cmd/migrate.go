@@ -0,0 +1,194 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func migrateMeta(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("SRC-URL and DST-URL are needed")
+	}
+	src := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := src.Load()
+	if err != nil {
+		return fmt.Errorf("load setting of source: %s", err)
+	}
+	if err = checkAdmin(ctx, format); err != nil {
+		return err
+	}
+	sessions, err := src.ListSessions(nil)
+	if err != nil {
+		return fmt.Errorf("list sessions: %s", err)
+	}
+	var writable []string
+	for _, s := range sessions {
+		if !readOnlySession(s) {
+			writable = append(writable, fmt.Sprintf("%d (%s:%s)", s.Sid, s.Hostname, s.MountPoint))
+		}
+	}
+	if len(writable) > 0 {
+		if !ctx.Bool("force") {
+			return fmt.Errorf("%d clients are not mounted with --read-only: %s, umount or remount them, or use --force",
+				len(writable), strings.Join(writable, ", "))
+		}
+		logger.Warnf("%d clients are not mounted with --read-only: %s, the changes from them may be lost",
+			len(writable), strings.Join(writable, ", "))
+	}
+
+	dst := meta.NewClient(ctx.Args().Get(1), &meta.Config{Retries: 10, Strict: true})
+	r, w := io.Pipe()
+	go func() {
+		_ = w.CloseWithError(src.DumpMetaLines(w, 0, time.Time{}))
+	}()
+	cr := &countedReader{r: r}
+	if err = dst.LoadMeta(cr, nil); err == nil {
+		if _, err = dst.Load(); err == nil {
+			err = verifyMigration(src, dst)
+		}
+	} else {
+		_ = r.CloseWithError(err)
+	}
+	if err != nil {
+		// the destination is checked to be empty before reading anything
+		if cr.n > 0 {
+			if e := dst.Reset(); e != nil {
+				logger.Errorf("Reset the partially migrated destination: %s, please clean it up manually", e)
+			} else {
+				logger.Infof("The partially migrated destination is cleaned up")
+			}
+		}
+		return fmt.Errorf("migrate metadata: %s", err)
+	}
+	logger.Infof("Migrate metadata succeed")
+	return nil
+}
+
+type countedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readOnlySession returns whether the client of session is mounted read-only, according to the
+// mount options recorded in it.
+func readOnlySession(s *meta.Session) bool {
+	for _, o := range strings.Split(s.MountOptions, ",") {
+		// the options of FUSE are in the value of o, separated by comma too
+		if o == "read-only" || o == "o=ro" || o == "ro" || strings.HasPrefix(o, "at=") {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyMigration compares the counters and the number of inodes in the tree of two volumes.
+func verifyMigration(src, dst meta.Meta) error {
+	ctx := meta.Background
+	var stotal, savail, siused, siavail, dtotal, davail, diused, diavail uint64
+	if st := src.StatFS(ctx, &stotal, &savail, &siused, &siavail); st != 0 {
+		return fmt.Errorf("statfs of source: %s", st)
+	}
+	if st := dst.StatFS(ctx, &dtotal, &davail, &diused, &diavail); st != 0 {
+		return fmt.Errorf("statfs of destination: %s", st)
+	}
+	if stotal-savail != dtotal-davail || siused != diused {
+		return fmt.Errorf("counters mismatch: used space %d != %d, used inodes %d != %d",
+			stotal-savail, dtotal-davail, siused, diused)
+	}
+	sinodes, err := countAllInodes(src)
+	if err != nil {
+		return fmt.Errorf("count inodes of source: %s", err)
+	}
+	dinodes, err := countAllInodes(dst)
+	if err != nil {
+		return fmt.Errorf("count inodes of destination: %s", err)
+	}
+	if sinodes != dinodes {
+		return fmt.Errorf("number of inodes mismatch: %d != %d", sinodes, dinodes)
+	}
+	logger.Infof("Verified %d inodes, used space %d bytes", dinodes, dtotal-davail)
+	return nil
+}
+
+// countAllInodes counts the inodes in the tree of root and the trash.
+func countAllInodes(m meta.Meta) (int64, error) {
+	count, err := countInodes(m, 1)
+	if err != nil {
+		return 0, err
+	}
+	n, err := countInodes(m, meta.TrashInode)
+	if err == syscall.ENOENT {
+		return count, nil // no trash
+	} else if err != nil {
+		return 0, err
+	}
+	return count + 1 + n, nil
+}
+
+func countInodes(m meta.Meta, inode meta.Ino) (int64, error) {
+	var entries []*meta.Entry
+	if st := m.Readdir(meta.Background, inode, 0, &entries); st != 0 {
+		return 0, st
+	}
+	var count int64
+	for _, e := range entries {
+		name := string(e.Name)
+		if name == "." || name == ".." {
+			continue
+		}
+		count++
+		if e.Attr.Typ == meta.TypeDirectory {
+			n, err := countInodes(m, e.Inode)
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		}
+	}
+	return count, nil
+}
+
+func migrateMetaFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "migrate-meta",
+		Usage:     "copy metadata from one engine to another",
+		ArgsUsage: "SRC-URL DST-URL",
+		Action:    migrateMeta,
+		Flags: []cli.Flag{
+			adminTokenFlag(),
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "migrate even if some clients are not mounted with --read-only, the changes from them may be lost",
+			},
+		},
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestMigrateMeta(t *testing.T) {
+	srcUrl := "sqlite3://" + filepath.Join(t.TempDir(), "migrate.db")
+	dstUrl := "redis://127.0.0.1:6379/11"
+	opt, err := redis.ParseURL(dstUrl)
+	if err != nil {
+		t.Fatalf("ParseURL: %v", err)
+	}
+	rdb := redis.NewClient(opt)
+	rdb.FlushDB(context.Background())
+	defer rdb.FlushDB(context.Background())
+
+	if err = Main([]string{"", "load", srcUrl, "./../pkg/meta/metadata.sample"}); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if err = Main([]string{"", "migrate-meta", srcUrl, dstUrl}); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if rdb.DBSize(context.Background()).Val() == 0 {
+		t.Fatalf("nothing is migrated")
+	}
+	if err = Main([]string{"", "migrate-meta", srcUrl, dstUrl}); err == nil {
+		t.Fatalf("migrate into non-empty database should fail")
+	}
+}
+
+func TestMigrateMetaSessions(t *testing.T) {
+	dir := t.TempDir()
+	srcUrl := "sqlite3://" + filepath.Join(dir, "src.db")
+	if err := Main([]string{"", "load", srcUrl, "./../pkg/meta/metadata.sample"}); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	ro := meta.NewClient(srcUrl, &meta.Config{MountOptions: "o=allow_other,ro"})
+	if _, err := ro.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if err := ro.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer ro.CloseSession()
+	if err := Main([]string{"", "migrate-meta", srcUrl, "sqlite3://" + filepath.Join(dir, "dst1.db")}); err != nil {
+		t.Fatalf("migrate with read-only clients: %s", err)
+	}
+
+	rw := meta.NewClient(srcUrl, &meta.Config{MountOptions: "cache-size=1024"})
+	if _, err := rw.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if err := rw.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer rw.CloseSession()
+	if err := Main([]string{"", "migrate-meta", srcUrl, "sqlite3://" + filepath.Join(dir, "dst2.db")}); err == nil {
+		t.Fatalf("migrate with writable clients should fail")
+	}
+	if err := Main([]string{"", "migrate-meta", "--force", srcUrl, "sqlite3://" + filepath.Join(dir, "dst2.db")}); err != nil {
+		t.Fatalf("migrate with --force: %s", err)
+	}
+}
+
+func TestReadOnlySession(t *testing.T) {
+	for opts, expected := range map[string]bool{
+		"":                        false,
+		"cache-size=1024":         false,
+		"read-only":               true,
+		"o=ro":                    true,
+		"o=allow_other,ro,debug":  true,
+		"at=2022-01-01T00:00:00Z": true,
+		"o=allow_other":           false,
+	} {
+		if ro := readOnlySession(&meta.Session{SessionInfo: meta.SessionInfo{MountOptions: opts}}); ro != expected {
+			t.Fatalf("read-only of %q should be %v", opts, expected)
+		}
+	}
+}
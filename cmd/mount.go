@@ -17,6 +17,9 @@
 package main
 
 import (
+	"compress/gzip"
+	"fmt"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -25,6 +28,8 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,6 +41,7 @@ import (
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/meta"
 	"github.com/juicedata/juicefs/pkg/metric"
+	"github.com/juicedata/juicefs/pkg/object"
 	"github.com/juicedata/juicefs/pkg/usage"
 	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/version"
@@ -59,6 +65,15 @@ func installHandler(mp string) {
 	}()
 }
 
+// withBilling counts the requests and traffic to object storage, and estimates the cost of them.
+func withBilling(c *cli.Context, blob object.ObjectStorage, format *meta.Format) object.ObjectStorage {
+	prices, err := object.ParsePrices(c.String("billing-prices"))
+	if err != nil {
+		logger.Fatalf("billing prices: %s", err)
+	}
+	return object.WithBilling(blob, strings.ToLower(format.Storage), prices)
+}
+
 func exposeMetrics(m meta.Meta, c *cli.Context) string {
 	var ip, port string
 	//default set
@@ -127,8 +142,145 @@ func wrapRegister(mp, name string) {
 	prometheus.MustRegister(prometheus.NewGoCollector())
 }
 
+// adjustForCgroup derives the default buffer size, memory cache size and concurrency from
+// the limits of the container, to avoid being killed by OOM. The options in explicit are kept.
+func adjustForCgroup(c *cli.Context, explicit []string) {
+	mem, cpus := utils.CgroupLimits()
+	if mem > 0 {
+		limit := int(mem>>20) / 4 // MiB
+		if limit < 32 {
+			limit = 32
+		}
+		if !stringContains(explicit, "buffer-size") && c.Int("buffer-size") > limit {
+			logger.Infof("Memory is limited to %d MiB by cgroup, reduce buffer-size from %d to %d MiB", mem>>20, c.Int("buffer-size"), limit)
+			_ = c.Set("buffer-size", strconv.Itoa(limit))
+		}
+		if c.String("cache-dir") == "memory" && !stringContains(explicit, "cache-size") && c.Int("cache-size") > limit {
+			logger.Infof("Memory is limited to %d MiB by cgroup, reduce cache-size from %d to %d MiB", mem>>20, c.Int("cache-size"), limit)
+			_ = c.Set("cache-size", strconv.Itoa(limit))
+		}
+	}
+	if cpus > 0 {
+		if os.Getenv("GOMAXPROCS") == "" && int(math.Ceil(cpus)) < runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(int(math.Ceil(cpus)))
+		}
+		uploads := int(cpus * 10)
+		if uploads < 2 {
+			uploads = 2
+		}
+		if !stringContains(explicit, "max-uploads") && c.Int("max-uploads") > uploads {
+			logger.Infof("CPU is limited to %.1f cores by cgroup, reduce max-uploads from %d to %d", cpus, c.Int("max-uploads"), uploads)
+			_ = c.Set("max-uploads", strconv.Itoa(uploads))
+		}
+	}
+}
+
+// mountProfiles are bundles of options for common workloads, the options set explicitly take precedence.
+var mountProfiles = map[string]map[string]string{
+	"general": {},
+	// datasets are read repeatedly and rarely changed
+	"ml-training": {
+		"attr-cache":         "10",
+		"entry-cache":        "10",
+		"dir-entry-cache":    "10",
+		"open-cache":         "10",
+		"prefetch":           "3",
+		"buffer-size":        "1024",
+		"cache-partial-only": "false",
+	},
+	// large files are written sequentially and seldom read back
+	"backup": {
+		"open-cache":         "0",
+		"prefetch":           "0",
+		"buffer-size":        "1024",
+		"max-uploads":        "50",
+		"cache-partial-only": "true",
+	},
+	// small random reads and writes, which need strong consistency
+	"database": {
+		"attr-cache":         "1",
+		"entry-cache":        "1",
+		"dir-entry-cache":    "1",
+		"open-cache":         "0",
+		"prefetch":           "0",
+		"buffer-size":        "300",
+		"writeback":          "false",
+		"cache-partial-only": "false",
+	},
+}
+
+func applyProfile(c *cli.Context) error {
+	name := c.String("profile")
+	if name == "" {
+		return nil
+	}
+	profile, ok := mountProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %s", name)
+	}
+	options := profileOptions()
+	for k, v := range profile {
+		if stringContains(options, k) && !c.IsSet(k) {
+			if err := c.Set(k, v); err != nil {
+				return fmt.Errorf("set %s=%s: %s", k, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// profileOptions returns the options tuned by profiles, some of them are not supported on Windows.
+func profileOptions() []string {
+	var options []string
+	for _, f := range mountFlags().Flags {
+		k := f.Names()[0]
+		for _, p := range mountProfiles {
+			if _, ok := p[k]; ok && !stringContains(options, k) {
+				options = append(options, k)
+			}
+		}
+	}
+	sort.Strings(options)
+	return options
+}
+
+// logProfile prints the effective values of the options tuned by profiles.
+func logProfile(c *cli.Context) {
+	var effective []string
+	for _, k := range profileOptions() {
+		effective = append(effective, fmt.Sprintf("%s=%v", k, c.Value(k)))
+	}
+	logger.Infof("Mount profile %s: %s", c.String("profile"), strings.Join(effective, " "))
+}
+
+// mountOptions returns the options set for the mount (including the ones from profile),
+// which are recorded in the session.
+func mountOptions(c *cli.Context) string {
+	var opts []string
+	for _, f := range c.Command.Flags {
+		name := f.Names()[0]
+		if !c.IsSet(name) {
+			continue
+		}
+		if v, ok := c.Value(name).(bool); ok && v {
+			opts = append(opts, name)
+		} else {
+			opts = append(opts, fmt.Sprintf("%s=%v", name, c.Value(name)))
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
 func mount(c *cli.Context) error {
 	setLoggerLevel(c)
+	explicit := c.LocalFlagNames()
+	if err := applyProfile(c); err != nil {
+		logger.Fatalf("%s", err)
+	}
+	adjustForCgroup(c, explicit)
+	if c.IsSet("profile") {
+		logProfile(c)
+	}
 	if c.Args().Len() < 1 {
 		logger.Fatalf("Meta URL and mountpoint are required")
 	}
@@ -170,6 +322,20 @@ func mount(c *cli.Context) error {
 		MountPoint:  mp,
 		Subdir:      c.String("subdir"),
 		MaxDeletes:  c.Int("max-deletes"),
+
+		MountOptions:  mountOptions(c),
+		MaxOpenFiles:  c.Int("max-open-files"),
+		Broker:        c.String("meta-broker"),
+		Heartbeat:     c.Duration("heartbeat"),
+		SkipDirMtime:  c.Duration("skip-dir-mtime"),
+		ScrubInterval: c.Duration("meta-scrub-interval"),
+		AtimeMode:     atimeMode(c),
+		MetaCache:     c.Duration("meta-cache"),
+	}
+	var objectFaults *utils.FaultInjector
+	if c.Bool("fault-injection") {
+		logger.Warnf("Fault injection is enabled, which should only be used for testing")
+		metaConf.Faults, objectFaults = &utils.FaultInjector{}, &utils.FaultInjector{}
 	}
 	m := meta.NewClient(addr, metaConf)
 	format, err := m.Load()
@@ -183,13 +349,24 @@ func mount(c *cli.Context) error {
 	if !c.Bool("writeback") && c.IsSet("upload-delay") {
 		logger.Warnf("delayed upload only work in writeback mode")
 	}
+	if !c.Bool("writeback") && c.IsSet("writeback-peer") {
+		logger.Warnf("replication to peer only work in writeback mode")
+	}
+	if (c.IsSet("writeback-peer") || c.IsSet("replica-listen")) && c.String("replica-secret") == "" {
+		logger.Fatalf("replica-secret is required to replicate staged blocks with peers")
+	}
+	if c.IsSet("replica-tls-cert") != c.IsSet("replica-tls-key") {
+		logger.Fatalf("replica-tls-cert and replica-tls-key should be set together")
+	}
 
 	chunkConf := chunk.Config{
-		BlockSize: format.BlockSize * 1024,
-		Compress:  format.Compression,
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		CompressDict: format.CompressDict,
 
 		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
 		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
+		UploadRetry:   c.Duration("upload-retry-window"),
 		MaxUpload:     c.Int("max-uploads"),
 		Writeback:     c.Bool("writeback"),
 		UploadDelay:   c.Duration("upload-delay"),
@@ -203,7 +380,16 @@ func mount(c *cli.Context) error {
 		FreeSpace:      float32(c.Float64("free-space-ratio")),
 		CacheMode:      os.FileMode(0600),
 		CacheFullBlock: !c.Bool("cache-partial-only"),
+		CacheAdmission: c.String("cache-admission"),
 		AutoCreate:     true,
+		IdleShrink:     c.Duration("idle-shrink"),
+		WritebackPeer:  c.String("writeback-peer"),
+		ReplicaListen:  c.String("replica-listen"),
+		ReplicaSecret:  c.String("replica-secret"),
+		ReplicaVolume:  format.UUID,
+		ReplicaTLSCert: c.String("replica-tls-cert"),
+		ReplicaTLSKey:  c.String("replica-tls-key"),
+		ReplicaTLSCA:   c.String("replica-tls-ca"),
 	}
 
 	if chunkConf.CacheDir != "memory" {
@@ -221,6 +407,23 @@ func mount(c *cli.Context) error {
 		logger.Fatalf("object storage: %s", err)
 	}
 	logger.Infof("Data use %s", blob)
+	if os.Getenv("JFS_NO_CHECK_OBJECT_STORAGE") == "" {
+		if err = checkMarker(blob, format, readOnly || c.IsSet("at")); err != nil {
+			logger.Fatalf("Check object storage %s: %s", blob, err)
+		}
+	}
+	blob = withBilling(c, blob, format)
+	if objectFaults != nil {
+		blob = object.WithFaults(blob, objectFaults)
+	}
+	var snapshot string
+	if at := c.String("at"); at != "" {
+		t, err := parseTimePoint(at)
+		if err != nil {
+			logger.Fatalf("invalid time %s: %s", at, err)
+		}
+		m, snapshot = loadBackup(blob, format, t, metaConf)
+	}
 	store := chunk.NewCachedStore(blob, chunkConf)
 	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
 		chunkid := args[0].(uint64)
@@ -233,11 +436,16 @@ func mount(c *cli.Context) error {
 		return vfs.Compact(chunkConf, store, slices, chunkid)
 	})
 	conf := &vfs.Config{
-		Meta:       metaConf,
-		Format:     format,
-		Version:    version.Version(),
-		Mountpoint: mp,
-		Chunk:      &chunkConf,
+		Meta:          metaConf,
+		Format:        format,
+		Version:       version.Version(),
+		Mountpoint:    mp,
+		Chunk:         &chunkConf,
+		ObjectFaults:  objectFaults,
+		OrderedAppend: c.Bool("ordered-append"),
+	}
+	if c.IsSet("timestamp-granularity") {
+		conf.TimestampGranularity = time.Duration(c.Float64("timestamp-granularity") * 1e9)
 	}
 
 	if c.Bool("background") && os.Getenv("JFS_FOREGROUND") == "" {
@@ -278,26 +486,83 @@ func mount(c *cli.Context) error {
 		go checkMountpoint(conf.Format.Name, mp)
 	}
 
+	setLogHooks(c)
+	metricsAddr := exposeMetrics(m, c)
+	metaConf.MetricsAddr = metricsAddr
 	err = m.NewSession()
 	if err != nil {
 		logger.Fatalf("new session: %s", err)
 	}
 	installHandler(mp)
 	v := vfs.NewVFS(conf, m, store)
-	metricsAddr := exposeMetrics(m, c)
+	http.HandleFunc("/locality", localityHandler(v))
+	http.HandleFunc("/cache/", cacheHandler(v))
 	if c.IsSet("consul") {
 		metric.RegisterToConsul(c.String("consul"), metricsAddr, mp)
 	}
+	if snapshot != "" { // a past version of the volume
+		mount_main(v, c)
+		_ = os.Remove(snapshot)
+		return nil
+	}
 	if d := c.Duration("backup-meta"); d > 0 {
 		go vfs.Backup(m, blob, d)
 	}
+	if d := c.Duration("scrub-interval"); d > 0 {
+		go v.Scrub(d)
+	}
 	if !c.Bool("no-usage-report") {
 		go usage.ReportUsage(m, version.Version())
 	}
+	if c.IsSet("gateway") {
+		go mountGateway(c, v)
+	}
 	mount_main(v, c)
 	return m.CloseSession()
 }
 
+func parseTimePoint(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// loadBackup loads the latest metadata backup made at or before t into a read-only in-memory engine.
+// The engine is saved in a local snapshot file, so it can be reused by the daemon process.
+func loadBackup(blob object.ObjectStorage, format *meta.Format, t time.Time, conf *meta.Config) (meta.Meta, string) {
+	key, err := vfs.FindBackup(blob, t)
+	if err != nil {
+		logger.Fatalf("find metadata backup: %s", err)
+	}
+	name := strings.TrimSuffix(path.Base(key), ".json.gz")
+	snapshot := filepath.Join(os.TempDir(), fmt.Sprintf("juicefs-%s-%s.snapshot", format.UUID, name))
+	if _, err = os.Stat(snapshot); os.IsNotExist(err) {
+		logger.Infof("Load metadata backup %s for %s", key, t.Format(time.RFC3339))
+		r, err := blob.Get(key, 0, -1)
+		if err != nil {
+			logger.Fatalf("get metadata backup %s: %s", key, err)
+		}
+		defer r.Close()
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			logger.Fatalf("open metadata backup %s: %s", key, err)
+		}
+		if err = meta.NewClient("memkv://"+snapshot, &meta.Config{Retries: 10, Strict: true}).LoadMeta(zr, nil); err != nil {
+			_ = os.Remove(snapshot)
+			logger.Fatalf("load metadata backup %s: %s", key, err)
+		}
+	}
+	conf.ReadOnly = true
+	m := meta.NewClient("memkv://"+snapshot, conf)
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	return m, snapshot
+}
+
 func clientFlags() []cli.Flag {
 	var defaultCacheDir = "/var/jfsCache"
 	switch runtime.GOOS {
@@ -326,6 +591,11 @@ func clientFlags() []cli.Flag {
 			Value: 60,
 			Usage: "the max number of seconds to upload an object",
 		},
+		&cli.DurationFlag{
+			Name:  "upload-retry-window",
+			Value: time.Minute * 5,
+			Usage: "max duration to retry uploading an object after transient failures (\"s\", \"m\", \"h\")",
+		},
 		&cli.IntFlag{
 			Name:  "io-retries",
 			Value: 30,
@@ -356,6 +626,10 @@ func clientFlags() []cli.Flag {
 			Value: 0,
 			Usage: "bandwidth limit for download in Mbps",
 		},
+		&cli.StringFlag{
+			Name:  "billing-prices",
+			Usage: "price table to estimate the cost of object storage in metrics, e.g. `class-a=0.005,class-b=0.0004,download=0.09` (per 1000 requests or GiB)",
+		},
 
 		&cli.IntFlag{
 			Name:  "prefetch",
@@ -370,6 +644,31 @@ func clientFlags() []cli.Flag {
 			Name:  "upload-delay",
 			Usage: "delayed duration for uploading objects (\"s\", \"m\", \"h\")",
 		},
+		&cli.StringFlag{
+			Name:  "writeback-peer",
+			Usage: "address (host:port) of a peer to replicate staged blocks to before acknowledging writes in writeback mode",
+		},
+		&cli.StringFlag{
+			Name:  "replica-listen",
+			Usage: "address (host:port) to accept replicas of staged blocks from peers, they are uploaded if not confirmed by the peer in 10 minutes (plus upload-delay)",
+		},
+		&cli.StringFlag{
+			Name:    "replica-secret",
+			Usage:   "secret shared by the peers to authenticate the replicas (required by writeback-peer and replica-listen)",
+			EnvVars: []string{"JUICEFS_REPLICA_SECRET"},
+		},
+		&cli.StringFlag{
+			Name:  "replica-tls-cert",
+			Usage: "certificate file to accept replicas over TLS (with replica-tls-key)",
+		},
+		&cli.StringFlag{
+			Name:  "replica-tls-key",
+			Usage: "private key file of replica-tls-cert",
+		},
+		&cli.StringFlag{
+			Name:  "replica-tls-ca",
+			Usage: "CA certificate file to verify the peer, replicas are sent over TLS if it's set",
+		},
 		&cli.StringFlag{
 			Name:  "cache-dir",
 			Value: defaultCacheDir,
@@ -389,6 +688,15 @@ func clientFlags() []cli.Flag {
 			Name:  "cache-partial-only",
 			Usage: "cache only random/small read",
 		},
+		&cli.StringFlag{
+			Name:  "cache-admission",
+			Value: "none",
+			Usage: "admission policy of disk cache when it's full (none, tinylfu)",
+		},
+		&cli.DurationFlag{
+			Name:  "idle-shrink",
+			Usage: "release idle connections and buffers, and pause scanning the cache after no IO for this duration (0 means disabled)",
+		},
 		&cli.DurationFlag{
 			Name:  "backup-meta",
 			Value: time.Hour,
@@ -404,11 +712,60 @@ func clientFlags() []cli.Flag {
 			Value: 0.0,
 			Usage: "open files cache timeout in seconds (0 means disable this feature)",
 		},
+		&cli.DurationFlag{
+			Name:  "meta-cache",
+			Usage: "cache attributes and entries for this duration, invalidated by the changes from other clients if the meta engine supports (0 means disable this feature)",
+		},
 		&cli.StringFlag{
 			Name:  "subdir",
 			Usage: "mount a sub-directory as root",
 		},
+		&cli.IntFlag{
+			Name:  "max-open-files",
+			Value: 0,
+			Usage: "max number of open file handles (0 means unlimited)",
+		},
+		&cli.StringFlag{
+			Name:    "meta-broker",
+			EnvVars: []string{"JUICEFS_META_BROKER"},
+			Usage:   "connect Redis through the local broker listening on this unix `SOCKET`",
+		},
+		&cli.DurationFlag{
+			Name:  "heartbeat",
+			Value: time.Minute,
+			Usage: "interval to send heartbeat of the session, randomized by 20%",
+		},
+		&cli.DurationFlag{
+			Name:  "skip-dir-mtime",
+			Usage: "skip updating mtime/ctime of the parent directories in rename if they were updated within this duration",
+		},
+		&cli.DurationFlag{
+			Name:  "meta-scrub-interval",
+			Usage: "interval to check the consistency of a sample of inodes in background, randomized by 20% (0 means disabled)",
+		},
+		&cli.StringFlag{
+			Name:  "atime-mode",
+			Value: meta.RelAtime,
+			Usage: "when to update atime of files and directories after they are read: noatime, relatime (only if it's earlier than mtime/ctime or older than a day) or strictatime",
+		},
+	}
+}
+
+func atimeMode(c *cli.Context) string {
+	mode := c.String("atime-mode")
+	if mode != meta.NoAtime && mode != meta.RelAtime && mode != meta.StrictAtime {
+		logger.Fatalf("Invalid atime mode: %s, should be one of %s, %s and %s", mode, meta.NoAtime, meta.RelAtime, meta.StrictAtime)
+	}
+	return mode
+}
+
+func setLogHooks(c *cli.Context) {
+	if n := c.Int("log-ring"); n > 0 {
+		ring := utils.NewLogRing(n)
+		utils.AddLogHook(ring)
+		http.Handle("/debug/logs", ring)
 	}
+	addSystemLogHooks(c)
 }
 
 func mountFlags() *cli.Command {
@@ -432,9 +789,26 @@ func mountFlags() *cli.Command {
 				Name:  "no-usage-report",
 				Usage: "do not send usage report",
 			},
+			&cli.StringFlag{
+				Name:  "at",
+				Usage: "mount the volume read-only as it was at the time (e.g. 2006-01-02T15:04), using the latest metadata backup before it",
+			},
+			&cli.StringFlag{
+				Name:  "profile",
+				Usage: "bundle of options for the workload (general, ml-training, backup, database)",
+			},
+			&cli.IntFlag{
+				Name:  "log-ring",
+				Usage: "number of the latest log lines kept in memory and served at /debug/logs of the metrics address",
+			},
+			&cli.BoolFlag{
+				Name:  "fault-injection",
+				Usage: "allow injecting faults into requests to meta engine and object storage with `juicefs fault` (for testing only)",
+			},
 		},
 	}
 	cmd.Flags = append(cmd.Flags, mount_flags()...)
 	cmd.Flags = append(cmd.Flags, clientFlags()...)
+	cmd.Flags = append(cmd.Flags, mountGatewayFlags()...)
 	return cmd
 }
@@ -22,6 +22,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -80,6 +81,7 @@ func ResetPrometheus() {
 
 func MountTmp(metaUrl, mountpoint string) error {
 	ResetRedis(metaUrl)
+	_ = os.RemoveAll("/tmp/testMountDir/test")
 	formatArgs := []string{"", "format", "--storage", "file", "--bucket", "/tmp/testMountDir", metaUrl, "test"}
 	err := Main(formatArgs)
 	if err != nil {
@@ -125,3 +127,25 @@ func TestMount(t *testing.T) {
 	}
 
 }
+
+func TestMountProfile(t *testing.T) {
+	app := &cli.App{
+		Flags: mountFlags().Flags,
+		Action: func(c *cli.Context) error {
+			if err := applyProfile(c); err != nil {
+				return err
+			}
+			if c.Int("prefetch") != 5 || c.Int("buffer-size") != 1024 || c.Float64("open-cache") != 10 || c.Bool("cache-partial-only") {
+				t.Fatalf("unexpected options: prefetch %d, buffer-size %d, open-cache %f, cache-partial-only %t",
+					c.Int("prefetch"), c.Int("buffer-size"), c.Float64("open-cache"), c.Bool("cache-partial-only"))
+			}
+			return nil
+		},
+	}
+	if err := app.Run([]string{"juicefs", "--profile", "ml-training", "--prefetch", "5"}); err != nil {
+		t.Fatalf("run: %s", err)
+	}
+	if err := app.Run([]string{"juicefs", "--profile", "unknown"}); err == nil {
+		t.Fatalf("unknown profile should fail")
+	}
+}
@@ -31,6 +31,7 @@ import (
 
 	"github.com/juicedata/godaemon"
 	"github.com/juicedata/juicefs/pkg/fuse"
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/urfave/cli/v2"
 )
@@ -52,6 +53,17 @@ func checkMountpoint(name, mp string) {
 	logger.Fatalf("fail to mount after 10 seconds, please check the log (/var/log/juicefs.log) or re-mount in foreground")
 }
 
+func addSystemLogHooks(c *cli.Context) {
+	if c.Bool("journald") {
+		hook, err := utils.NewJournaldHook()
+		if err != nil {
+			logger.Warnf("Connect to journald: %s", err)
+		} else {
+			utils.AddLogHook(hook)
+		}
+	}
+}
+
 func makeDaemon(c *cli.Context, name, mp string) error {
 	var attrs godaemon.DaemonAttr
 	attrs.OnExit = func(stage int) error {
@@ -107,6 +119,10 @@ func mount_flags() []cli.Flag {
 			Name:  "no-syslog",
 			Usage: "disable syslog",
 		},
+		&cli.BoolFlag{
+			Name:  "journald",
+			Usage: "send logs to systemd-journald",
+		},
 		&cli.StringFlag{
 			Name:  "log",
 			Value: path.Join(defaultLogDir, "juicefs.log"),
@@ -135,6 +151,23 @@ func mount_flags() []cli.Flag {
 			Name:  "enable-xattr",
 			Usage: "enable extended attributes (xattr)",
 		},
+		&cli.Float64Flag{
+			Name:  "timestamp-granularity",
+			Value: 0,
+			Usage: "batch updates of atime/mtime within the granularity in seconds (0 means no batching)",
+		},
+		&cli.BoolFlag{
+			Name:  "ordered-append",
+			Usage: "reserve the range at the end of file in metadata for every write to files opened with O_APPEND, so concurrent appends from multiple clients never overwrite each other",
+		},
+		&cli.DurationFlag{
+			Name:  "op-timeout",
+			Usage: "cancel the FUSE operations running longer than this, they fail with EINTR; the reads in flight are aborted, but not the metadata transactions already started (0 means unlimited)",
+		},
+		&cli.DurationFlag{
+			Name:  "scrub-interval",
+			Usage: "interval to verify a rotating subset of blocks against the object storage in background, randomized by 20% (0 means disabled)",
+		},
 	}
 }
 
@@ -176,6 +209,7 @@ func mount_main(v *vfs.VFS, c *cli.Context) {
 	conf.AttrTimeout = time.Millisecond * time.Duration(c.Float64("attr-cache")*1000)
 	conf.EntryTimeout = time.Millisecond * time.Duration(c.Float64("entry-cache")*1000)
 	conf.DirEntryTimeout = time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000)
+	conf.OpTimeout = c.Duration("op-timeout")
 	logger.Infof("Mounting volume %s at %s ...", conf.Format.Name, conf.Mountpoint)
 	err := fuse.Serve(v, c.String("o"), c.Bool("enable-xattr"))
 	if err != nil {
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"github.com/juicedata/juicefs/pkg/utils"
 	"github.com/juicedata/juicefs/pkg/vfs"
 	"github.com/juicedata/juicefs/pkg/winfsp"
 	"github.com/urfave/cli/v2"
@@ -41,6 +42,21 @@ func mount_flags() []cli.Flag {
 			Name:  "delay-close",
 			Usage: "delay file closing in seconds.",
 		},
+		&cli.BoolFlag{
+			Name:  "eventlog",
+			Usage: "send logs to Windows Event Log",
+		},
+	}
+}
+
+func addSystemLogHooks(c *cli.Context) {
+	if c.Bool("eventlog") {
+		hook, err := utils.NewEventLogHook("juicefs")
+		if err != nil {
+			logger.Warnf("Open event log: %s", err)
+		} else {
+			utils.AddLogHook(hook)
+		}
 	}
 }
 
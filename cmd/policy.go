@@ -0,0 +1,165 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+type policyStatement struct {
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string][]string `json:",omitempty"`
+}
+
+type accessPolicy struct {
+	Version   string
+	Statement []policyStatement
+}
+
+// bucketName guesses the name of bucket from the endpoint, which is the first path segment
+// for path-style endpoints, or the first label of host for virtual-hosted style ones.
+func bucketName(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+	}
+	if p := strings.Split(strings.Trim(u.Path, "/"), "/")[0]; p != "" {
+		return p, nil
+	}
+	if name := strings.Split(u.Hostname(), ".")[0]; name != "" {
+		return name, nil
+	}
+	return "", fmt.Errorf("no bucket in endpoint %s", endpoint)
+}
+
+// prefixPolicy returns a policy which only allows the access to objects under prefix of the buckets,
+// so that multiple volumes can share the buckets with their own credentials.
+func prefixPolicy(typ string, buckets []string, prefix string) (*accessPolicy, error) {
+	var arn, version, prefixKey string
+	var actions map[string][]string // list of bucket, list of uploads, access of objects
+	switch typ {
+	case "s3", "minio", "ceph":
+		arn, version, prefixKey = "arn:aws:s3:::", "2012-10-17", "s3:prefix"
+		actions = map[string][]string{
+			"bucket":  {"s3:ListBucket"},
+			"uploads": {"s3:ListBucketMultipartUploads"},
+			"objects": {"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"},
+		}
+	case "oss":
+		arn, version, prefixKey = "acs:oss:*:*:", "1", "oss:Prefix"
+		actions = map[string][]string{
+			"bucket":  {"oss:ListObjects"},
+			"uploads": {"oss:ListMultipartUploads"},
+			"objects": {"oss:GetObject", "oss:PutObject", "oss:DeleteObject", "oss:AbortMultipartUpload", "oss:ListParts"},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type of policy: %s", typ)
+	}
+	var bucketRes, objectRes []string
+	for _, b := range buckets {
+		bucketRes = append(bucketRes, arn+b)
+		objectRes = append(objectRes, arn+b+"/"+prefix+"*")
+	}
+	return &accessPolicy{
+		Version: version,
+		Statement: []policyStatement{
+			{
+				Effect:    "Allow",
+				Action:    actions["bucket"],
+				Resource:  bucketRes,
+				Condition: map[string]map[string][]string{"StringLike": {prefixKey: {prefix + "*"}}},
+			},
+			{
+				Effect:   "Allow",
+				Action:   actions["uploads"],
+				Resource: bucketRes,
+			},
+			{
+				Effect:   "Allow",
+				Action:   actions["objects"],
+				Resource: objectRes,
+			},
+		},
+	}, nil
+}
+
+func policy(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	var buckets []string
+	if name := ctx.String("bucket-name"); name != "" {
+		buckets = append(buckets, name)
+	} else {
+		endpoints := []string{format.Bucket}
+		if format.Shards > 1 {
+			endpoints = endpoints[:0]
+			for i := 0; i < format.Shards; i++ {
+				endpoints = append(endpoints, fmt.Sprintf(format.Bucket, i))
+			}
+		}
+		for _, ep := range endpoints {
+			name, err := bucketName(ep)
+			if err != nil {
+				return err
+			}
+			buckets = append(buckets, name)
+		}
+	}
+	p, err := prefixPolicy(ctx.String("type"), buckets, format.Name+"/")
+	if err != nil {
+		return err
+	}
+	printJson(p)
+	return nil
+}
+
+func policyFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "policy",
+		Usage:     "generate an access policy of object storage scoped to the prefix of volume",
+		ArgsUsage: "META-URL",
+		Action:    policy,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "type",
+				Value: "s3",
+				Usage: "syntax of the policy: s3 (also for MinIO and Ceph) or oss",
+			},
+			&cli.StringFlag{
+				Name:  "bucket-name",
+				Usage: "name of the bucket (guessed from the endpoint by default)",
+			},
+		},
+	}
+}
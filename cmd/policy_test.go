@@ -0,0 +1,49 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPrefixPolicy(t *testing.T) {
+	cases := map[string]string{
+		"https://mybucket.s3.us-east-1.amazonaws.com": "mybucket",
+		"http://127.0.0.1:9000/mybucket":              "mybucket",
+		"https://gateway.us1.storjshare.io/mybucket/": "mybucket",
+		"mybucket.oss-cn-hangzhou.aliyuncs.com":       "mybucket",
+	}
+	for ep, expected := range cases {
+		if name, err := bucketName(ep); err != nil || name != expected {
+			t.Fatalf("bucket of %s: %s %s", ep, name, err)
+		}
+	}
+
+	p, err := prefixPolicy("s3", []string{"b1", "b2"}, "vol/")
+	if err != nil {
+		t.Fatalf("policy: %s", err)
+	}
+	if len(p.Statement) != 3 || len(p.Statement[2].Resource) != 2 || p.Statement[2].Resource[1] != "arn:aws:s3:::b2/vol/*" {
+		t.Fatalf("policy: %+v", p)
+	}
+	if prefixes := p.Statement[0].Condition["StringLike"]["s3:prefix"]; len(prefixes) != 1 || prefixes[0] != "vol/*" {
+		t.Fatalf("condition of list: %+v", p.Statement[0].Condition)
+	}
+	if _, err = prefixPolicy("gcs", []string{"b1"}, "vol/"); err == nil {
+		t.Fatalf("policy of gcs should not be supported")
+	}
+}
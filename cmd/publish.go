@@ -0,0 +1,314 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/nats-io/nats.go"
+	"github.com/urfave/cli/v2"
+)
+
+func publishFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "publish",
+		Usage:     "publish changes of metadata from the changelog to Kafka or NATS",
+		ArgsUsage: "META-URL SINK-URL",
+		Action:    publish,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "types",
+				Value: "create,delete,rename,setattr",
+				Usage: "types of events to publish",
+			},
+			&cli.StringFlag{
+				Name:  "offset-file",
+				Usage: "file to save the ID of the last published event, so publishing can be resumed from it",
+			},
+			&cli.Uint64Flag{
+				Name:  "from",
+				Usage: "publish the events after this ID if there is no saved offset (default: all the retained ones)",
+			},
+			&cli.IntFlag{
+				Name:  "batch",
+				Value: 100,
+				Usage: "max number of events to publish at once",
+			},
+		},
+	}
+}
+
+// eventSink publishes events to a message queue, it returns after all of them are acknowledged.
+type eventSink interface {
+	publish(events []*meta.Event) error
+	close() error
+}
+
+// parseSinkURL parses SINK-URL like kafka://host1:9092,host2:9092/topic or nats://host:4222/subject.
+func parseSinkURL(uri string) (scheme string, hosts []string, topic string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("invalid sink %s: %s", uri, err)
+	}
+	topic = strings.Trim(u.Path, "/")
+	if u.Host == "" || topic == "" || strings.Contains(topic, "/") {
+		return "", nil, "", fmt.Errorf("invalid sink %s: it should be like %s://HOST[,HOST]/TOPIC", uri, u.Scheme)
+	}
+	switch u.Scheme {
+	case "kafka", "nats":
+	default:
+		return "", nil, "", fmt.Errorf("unsupported sink: %s", u.Scheme)
+	}
+	return u.Scheme, strings.Split(u.Host, ","), topic, nil
+}
+
+func newSink(uri string) (eventSink, error) {
+	scheme, hosts, topic, err := parseSinkURL(uri)
+	if err != nil {
+		return nil, err
+	}
+	switch scheme {
+	case "kafka":
+		return newKafkaSink(hosts, topic)
+	default:
+		return newNATSSink(hosts, topic)
+	}
+}
+
+type kafkaSink struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func newKafkaSink(brokers []string, topic string) (eventSink, error) {
+	conf := sarama.NewConfig()
+	conf.Producer.RequiredAcks = sarama.WaitForAll
+	conf.Producer.Return.Successes = true
+	conf.Producer.Retry.Max = 10
+	producer, err := sarama.NewSyncProducer(brokers, conf)
+	if err != nil {
+		return nil, fmt.Errorf("connect to kafka %s: %s", brokers, err)
+	}
+	return &kafkaSink{topic, producer}, nil
+}
+
+func (s *kafkaSink) publish(events []*meta.Event) error {
+	msgs := make([]*sarama.ProducerMessage, 0, len(events))
+	for _, e := range events {
+		data, _ := json.Marshal(e)
+		// events of the same inode go to the same partition to keep their order
+		key := e.Inode
+		if key == 0 {
+			key = e.Parent
+		}
+		msgs = append(msgs, &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(key.String()),
+			Value: sarama.ByteEncoder(data),
+		})
+	}
+	return s.producer.SendMessages(msgs)
+}
+
+func (s *kafkaSink) close() error {
+	return s.producer.Close()
+}
+
+// natsSink publishes events through JetStream, so the subject should be captured by a stream.
+type natsSink struct {
+	subject string
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+}
+
+func newNATSSink(hosts []string, subject string) (eventSink, error) {
+	servers := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		servers = append(servers, "nats://"+h)
+	}
+	conn, err := nats.Connect(strings.Join(servers, ","), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats %s: %s", hosts, err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("jetstream: %s", err)
+	}
+	return &natsSink{subject, conn, js}, nil
+}
+
+func (s *natsSink) publish(events []*meta.Event) error {
+	futures := make([]nats.PubAckFuture, 0, len(events))
+	for _, e := range events {
+		data, _ := json.Marshal(e)
+		// the ID deduplicates the events published again after a failure
+		msg := &nats.Msg{Subject: s.subject, Data: data, Header: nats.Header{}}
+		msg.Header.Set(nats.MsgIdHdr, strconv.FormatUint(e.ID, 10))
+		f, err := s.js.PublishMsgAsync(msg)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			return err
+		case <-time.After(time.Second * 30):
+			return fmt.Errorf("timeout waiting for ack of %s", f.Msg().Header.Get(nats.MsgIdHdr))
+		}
+	}
+	return nil
+}
+
+func (s *natsSink) close() error {
+	s.conn.Close()
+	return nil
+}
+
+func parseEventTypes(types string) (uint8, error) {
+	var mask uint8
+	for _, t := range strings.Split(types, ",") {
+		switch strings.TrimSpace(t) {
+		case "create":
+			mask |= meta.EventCreate
+		case "delete":
+			mask |= meta.EventDelete
+		case "rename":
+			mask |= meta.EventRename
+		case "setattr":
+			mask |= meta.EventSetAttr
+		case "":
+		default:
+			return 0, fmt.Errorf("unknown event type: %s", t)
+		}
+	}
+	if mask == 0 {
+		return 0, fmt.Errorf("no event type is selected")
+	}
+	return mask, nil
+}
+
+func loadOffset(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func saveOffset(path string, id uint64) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(id, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func publish(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and SINK-URL are needed")
+	}
+	types, err := parseEventTypes(ctx.String("types"))
+	if err != nil {
+		return err
+	}
+	batch := ctx.Int("batch")
+	if batch <= 0 {
+		return fmt.Errorf("invalid batch: %d", batch)
+	}
+	after := ctx.Uint64("from")
+	offsetFile := ctx.String("offset-file")
+	if offsetFile != "" {
+		if id, err := loadOffset(offsetFile); err != nil {
+			return fmt.Errorf("load offset from %s: %s", offsetFile, err)
+		} else if id > 0 {
+			after = id
+		}
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err = m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	sink, err := newSink(ctx.Args().Get(1))
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	defer sink.close()
+
+	// events are published in batches from another goroutine, the offset is saved after they are acknowledged
+	queue := make(chan *meta.Event, batch)
+	failed := make(chan error, 1)
+	go func() {
+		var pending []*meta.Event
+		var last, saved uint64 // IDs of the last received and saved events
+		flush := func() {
+			for len(pending) > 0 {
+				if err := sink.publish(pending); err != nil {
+					logger.Warnf("publish %d events: %s, retry later", len(pending), err)
+					time.Sleep(time.Second)
+					continue
+				}
+				logger.Debugf("published %d events (%d-%d)", len(pending), pending[0].ID, pending[len(pending)-1].ID)
+				pending = pending[:0]
+			}
+			if offsetFile != "" && last > saved {
+				if err := saveOffset(offsetFile, last); err != nil {
+					failed <- fmt.Errorf("save offset %d into %s: %s", last, offsetFile, err)
+					return
+				}
+				saved = last
+			}
+		}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case e := <-queue:
+				pending = append(pending, e)
+				last = e.ID
+				if len(pending) >= batch {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+	logger.Infof("Publishing events after %d to %s", after, ctx.Args().Get(1))
+	return m.Subscribe(meta.Background, types, after, func(e *meta.Event) error {
+		select {
+		case queue <- e:
+			return nil
+		case err := <-failed:
+			return err
+		}
+	})
+}
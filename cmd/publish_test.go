@@ -0,0 +1,68 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestParseSinkURL(t *testing.T) {
+	scheme, hosts, topic, err := parseSinkURL("kafka://k1:9092,k2:9092/jfs-events")
+	if err != nil || scheme != "kafka" || !reflect.DeepEqual(hosts, []string{"k1:9092", "k2:9092"}) || topic != "jfs-events" {
+		t.Fatalf("parse kafka sink: %s %v %s %s", scheme, hosts, topic, err)
+	}
+	scheme, hosts, topic, err = parseSinkURL("nats://localhost:4222/jfs.events")
+	if err != nil || scheme != "nats" || !reflect.DeepEqual(hosts, []string{"localhost:4222"}) || topic != "jfs.events" {
+		t.Fatalf("parse nats sink: %s %v %s %s", scheme, hosts, topic, err)
+	}
+	for _, uri := range []string{"kafka://k1:9092", "kafka:///topic", "nats://n1/a/b", "http://localhost/events"} {
+		if _, _, _, err := parseSinkURL(uri); err == nil {
+			t.Fatalf("parse %s should fail", uri)
+		}
+	}
+}
+
+func TestParseEventTypes(t *testing.T) {
+	if mask, err := parseEventTypes("create,delete,rename,setattr"); err != nil || mask != meta.EventAll {
+		t.Fatalf("parse all types: %d %s", mask, err)
+	}
+	if mask, err := parseEventTypes("create, rename"); err != nil || mask != meta.EventCreate|meta.EventRename {
+		t.Fatalf("parse create and rename: %d %s", mask, err)
+	}
+	for _, types := range []string{"", "write", "create,write"} {
+		if _, err := parseEventTypes(types); err == nil {
+			t.Fatalf("parse %q should fail", types)
+		}
+	}
+}
+
+func TestOffsetFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offset")
+	if id, err := loadOffset(path); err != nil || id != 0 {
+		t.Fatalf("load missing offset: %d %s", id, err)
+	}
+	if err := saveOffset(path, 1234); err != nil {
+		t.Fatalf("save offset: %s", err)
+	}
+	if id, err := loadOffset(path); err != nil || id != 1234 {
+		t.Fatalf("load offset: %d %s", id, err)
+	}
+}
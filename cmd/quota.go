@@ -0,0 +1,218 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func quotaFlags() *cli.Command {
+	pathFlag := &cli.StringFlag{
+		Name:     "path",
+		Usage:    "path of the directory in JuiceFS",
+		Required: true,
+	}
+	return &cli.Command{
+		Name:  "quota",
+		Usage: "manage quotas of directories",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "set",
+				Usage:     "set quota of a directory",
+				ArgsUsage: "META-URL",
+				Action:    quotaSet,
+				Flags: []cli.Flag{
+					pathFlag,
+					&cli.Uint64Flag{
+						Name:  "capacity",
+						Usage: "the limit for space in GiB (0 for unlimited)",
+					},
+					&cli.Uint64Flag{
+						Name:  "inodes",
+						Usage: "the limit for number of inodes (0 for unlimited)",
+					},
+				},
+			},
+			{
+				Name:      "get",
+				Usage:     "show quota of a directory",
+				ArgsUsage: "META-URL",
+				Action:    quotaGet,
+				Flags:     []cli.Flag{pathFlag},
+			},
+			{
+				Name:      "delete",
+				Usage:     "delete quota of a directory",
+				ArgsUsage: "META-URL",
+				Action:    quotaDelete,
+				Flags:     []cli.Flag{pathFlag},
+			},
+			{
+				Name:      "list",
+				Usage:     "list all quotas",
+				ArgsUsage: "META-URL",
+				Action:    quotaList,
+			},
+			{
+				Name:      "check",
+				Usage:     "check the usage of a directory against its quota",
+				ArgsUsage: "META-URL",
+				Action:    quotaCheck,
+				Flags: []cli.Flag{
+					pathFlag,
+					&cli.BoolFlag{
+						Name:  "repair",
+						Usage: "fix the usage recorded in quota if it's not accurate",
+					},
+				},
+			},
+		},
+	}
+}
+
+type quotaInfo struct {
+	Path       string
+	Inode      meta.Ino
+	Capacity   int64 // in bytes
+	Inodes     int64
+	UsedSpace  int64
+	UsedInodes int64
+}
+
+func newQuotaInfo(p string, inode meta.Ino, q *meta.Quota) *quotaInfo {
+	return &quotaInfo{p, inode, q.MaxSpace, q.MaxInodes, q.UsedSpace, q.UsedInodes}
+}
+
+func lookupPath(m meta.Meta, p string) (meta.Ino, error) {
+	var inode meta.Ino = 1
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		var attr meta.Attr
+		if st := m.Lookup(meta.Background, inode, name, &inode, &attr); st != 0 {
+			return 0, fmt.Errorf("lookup %s: %s", name, st)
+		}
+	}
+	return inode, nil
+}
+
+// openQuotaClient returns a client and the inode of the directory specified by --path.
+func openQuotaClient(ctx *cli.Context) (meta.Meta, string, meta.Ino) {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		logger.Fatalf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	p := path.Join("/", ctx.String("path"))
+	inode, err := lookupPath(m, p)
+	if err != nil {
+		logger.Fatalf("%s", err)
+	}
+	return m, p, inode
+}
+
+func quotaSet(ctx *cli.Context) error {
+	if !ctx.IsSet("capacity") && !ctx.IsSet("inodes") {
+		return fmt.Errorf("--capacity or --inodes is needed")
+	}
+	m, p, inode := openQuotaClient(ctx)
+	var q meta.Quota
+	if st := m.GetQuota(meta.Background, inode, &q); st != 0 && st != meta.ENOATTR {
+		logger.Fatalf("get quota of %s: %s", p, st)
+	}
+	if ctx.IsSet("capacity") {
+		q.MaxSpace = int64(ctx.Uint64("capacity") << 30)
+	}
+	if ctx.IsSet("inodes") {
+		q.MaxInodes = int64(ctx.Uint64("inodes"))
+	}
+	if st := m.SetQuota(meta.Background, inode, q.MaxSpace, q.MaxInodes); st != 0 {
+		logger.Fatalf("set quota of %s: %s", p, st)
+	}
+	return nil
+}
+
+func quotaGet(ctx *cli.Context) error {
+	m, p, inode := openQuotaClient(ctx)
+	var q meta.Quota
+	if st := m.GetQuota(meta.Background, inode, &q); st != 0 {
+		logger.Fatalf("get quota of %s: %s", p, st)
+	}
+	printJson(newQuotaInfo(p, inode, &q))
+	return nil
+}
+
+func quotaDelete(ctx *cli.Context) error {
+	m, p, inode := openQuotaClient(ctx)
+	if st := m.DelQuota(meta.Background, inode); st != 0 {
+		logger.Fatalf("delete quota of %s: %s", p, st)
+	}
+	return nil
+}
+
+func quotaList(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	quotas := make(map[meta.Ino]*meta.Quota)
+	if st := m.ListQuotas(meta.Background, quotas); st != 0 {
+		logger.Fatalf("list quotas: %s", st)
+	}
+	infos := make([]*quotaInfo, 0, len(quotas))
+	for inode, q := range quotas {
+		p, st := meta.GetPath(m, meta.Background, inode)
+		if st != 0 {
+			p = st.Error()
+		}
+		infos = append(infos, newQuotaInfo(p, inode, q))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Path < infos[j].Path })
+	printJson(infos)
+	return nil
+}
+
+func quotaCheck(ctx *cli.Context) error {
+	m, p, inode := openQuotaClient(ctx)
+	var q, actual meta.Quota
+	if st := m.GetQuota(meta.Background, inode, &q); st != 0 {
+		logger.Fatalf("get quota of %s: %s", p, st)
+	}
+	if st := m.CheckQuota(meta.Background, inode, ctx.Bool("repair"), &actual); st != 0 {
+		logger.Fatalf("check quota of %s: %s", p, st)
+	}
+	if !ctx.Bool("repair") && (q.UsedSpace != actual.UsedSpace || q.UsedInodes != actual.UsedInodes) {
+		logger.Warnf("usage of %s is not accurate: space %d (actual %d), inodes %d (actual %d), use --repair to fix it",
+			p, q.UsedSpace, actual.UsedSpace, q.UsedInodes, actual.UsedInodes)
+	}
+	printJson(newQuotaInfo(p, inode, &actual))
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func restoreFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "restore",
+		Usage:     "restore files from trash",
+		ArgsUsage: "META-URL HOUR-DIR ...",
+		Action:    restore,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "put-back",
+				Usage: "move the recovered files into the original directory",
+			},
+		},
+	}
+}
+
+// trashEntry is an entry in trash, which is named as {parentInode}-{inode}-{name}.
+type trashEntry struct {
+	*meta.Entry
+	parent meta.Ino
+	name   string
+}
+
+func parseTrashEntry(e *meta.Entry) (*trashEntry, error) {
+	ps := strings.SplitN(string(e.Name), "-", 3)
+	if len(ps) != 3 {
+		return nil, fmt.Errorf("invalid name %s", e.Name)
+	}
+	parent, err := strconv.ParseUint(ps[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parent of %s: %s", e.Name, err)
+	}
+	if inode, err := strconv.ParseUint(ps[1], 10, 64); err != nil || meta.Ino(inode) != e.Inode {
+		return nil, fmt.Errorf("invalid inode of %s", e.Name)
+	}
+	return &trashEntry{e, meta.Ino(parent), ps[2]}, nil
+}
+
+func restore(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and HOUR-DIR are needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	if format.TrashDays == 0 {
+		logger.Warnf("Trash is disabled for volume %s", format.Name)
+	}
+	for _, hour := range ctx.Args().Slice()[1:] {
+		if err = doRestore(m, hour, ctx.Bool("put-back")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func doRestore(m meta.Meta, hour string, putBack bool) error {
+	c := meta.Background
+	var parent meta.Ino
+	var attr meta.Attr
+	if st := m.Lookup(c, meta.TrashInode, hour, &parent, &attr); st != 0 {
+		return fmt.Errorf("lookup %s in trash: %s", hour, st)
+	}
+	var entries []*meta.Entry
+	if st := m.Readdir(c, parent, 1, &entries); st != 0 {
+		return fmt.Errorf("readdir %s: %s", hour, st)
+	}
+	var todo []*trashEntry
+	for _, e := range entries {
+		if name := string(e.Name); name == "." || name == ".." {
+			continue
+		}
+		te, err := parseTrashEntry(e)
+		if err != nil {
+			logger.Warnf("Skip entry in trash %s: %s", hour, err)
+			continue
+		}
+		todo = append(todo, te)
+	}
+	// directories are restored first, so the entries inside them could be put back
+	sort.SliceStable(todo, func(i, j int) bool {
+		return todo[i].Attr.Typ == meta.TypeDirectory && todo[j].Attr.Typ != meta.TypeDirectory
+	})
+
+	var restored, failed int
+	for _, e := range todo {
+		if !putBack {
+			fmt.Printf("%s\t%d\t%d/%s\n", e.Name, e.Attr.Length, e.parent, e.name)
+			continue
+		}
+		var inode meta.Ino
+		st := m.Rename(c, parent, string(e.Name), e.parent, e.name, meta.RenameNoReplace, &inode, &attr)
+		if st != 0 {
+			logger.Warnf("Restore %s into %d/%s: %s", e.Name, e.parent, e.name, st)
+			failed++
+		} else {
+			restored++
+		}
+	}
+	if putBack {
+		logger.Infof("Restored %d entries from trash %s, %d failed", restored, hour, failed)
+	} else {
+		logger.Infof("Found %d entries in trash %s, use --put-back to restore them", len(todo), hour)
+	}
+	return nil
+}
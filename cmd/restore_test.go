@@ -0,0 +1,74 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestRestore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "restore")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	metaUrl := "sqlite3://" + dir + "/meta.db"
+	if err = Main([]string{"", "format", "--bucket", dir + "/bucket", metaUrl, "test-restore"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	if _, err = m.Load(); err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	ctx := meta.Background
+	var parent, inode meta.Ino
+	var attr meta.Attr
+	if st := m.Mkdir(ctx, 1, "d", 0755, 022, 0, &parent, &attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	if st := m.Create(ctx, parent, "f", 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create d/f: %s", st)
+	}
+	hour := time.Now().UTC().Format("2006-01-02-15")
+	if st := m.Unlink(ctx, parent, "f"); st != 0 {
+		t.Fatalf("unlink d/f: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "d"); st != 0 {
+		t.Fatalf("rmdir d: %s", st)
+	}
+
+	if err = Main([]string{"", "restore", metaUrl, hour}); err != nil {
+		t.Fatalf("list trash: %s", err)
+	}
+	if st := m.Lookup(ctx, 1, "d", &parent, &attr); st == 0 {
+		t.Fatalf("d should not be restored without --put-back")
+	}
+	if err = Main([]string{"", "restore", "--put-back", metaUrl, hour}); err != nil {
+		t.Fatalf("restore: %s", err)
+	}
+	if st := m.Lookup(ctx, 1, "d", &parent, &attr); st != 0 {
+		t.Fatalf("lookup d: %s", st)
+	}
+	if st := m.Lookup(ctx, parent, "f", &inode, &attr); st != 0 || attr.Parent != parent {
+		t.Fatalf("lookup d/f: %s, parent %d", st, attr.Parent)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func sessionFlags() *cli.Command {
+	return &cli.Command{
+		Name:  "session",
+		Usage: "manage client sessions",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "kill",
+				Usage:     "remove a session and release its locks and files, when the client is gone for good",
+				ArgsUsage: "META-URL SID",
+				Action:    sessionKill,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "kill the session even if it's still active",
+					},
+					adminTokenFlag(),
+				},
+			},
+		},
+	}
+}
+
+func sessionKill(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and SID are needed")
+	}
+	sid, err := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	if err != nil || sid == 0 {
+		return fmt.Errorf("invalid session id: %s", ctx.Args().Get(1))
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	if ctx.Bool("force") {
+		if err = checkAdmin(ctx, format); err != nil {
+			logger.Fatalf("%s", err)
+		}
+	}
+	s, err := m.GetSession(sid)
+	if err != nil {
+		logger.Fatalf("get session %d: %s", sid, err)
+	}
+	timeout := time.Minute * 5
+	if format.SessionTimeout > 0 {
+		timeout = time.Duration(format.SessionTimeout) * time.Second
+	}
+	if idle := time.Since(s.Heartbeat); idle < timeout && !ctx.Bool("force") {
+		logger.Fatalf("session %d (%s, %s) is still active (last heartbeat %s ago), use --force to kill it anyway",
+			sid, s.Hostname, s.MountPoint, idle.Truncate(time.Second))
+	}
+	if err = m.KillSession(sid); err != nil {
+		logger.Fatalf("kill session %d: %s", sid, err)
+	}
+	logger.Infof("Session %d (%s, %s) is killed: %d flocks, %d plocks and %d sustained inodes are released",
+		sid, s.Hostname, s.MountPoint, len(s.Flocks), len(s.Plocks), len(s.Sustained))
+	return nil
+}
@@ -0,0 +1,243 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	jfssftp "github.com/juicedata/juicefs/pkg/sftp"
+	"github.com/juicedata/juicefs/pkg/usage"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/version"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func sftpFlags() *cli.Command {
+	flags := append(clientFlags(),
+		&cli.StringFlag{
+			Name:  "users",
+			Usage: "file of users, each line is \"NAME HOME PUBLIC-KEY\" (public key in authorized_keys format)",
+		},
+		&cli.StringFlag{
+			Name:  "host-key",
+			Usage: "path of the private host key (a temporary key is generated if not set)",
+		},
+		&cli.Float64Flag{
+			Name:  "attr-cache",
+			Value: 1.0,
+			Usage: "attributes cache timeout in seconds",
+		},
+		&cli.Float64Flag{
+			Name:  "entry-cache",
+			Value: 0,
+			Usage: "file entry cache timeout in seconds",
+		},
+		&cli.Float64Flag{
+			Name:  "dir-entry-cache",
+			Value: 1.0,
+			Usage: "dir entry cache timeout in seconds",
+		},
+		&cli.StringFlag{
+			Name:  "access-log",
+			Usage: "path for JuiceFS access log",
+		},
+		&cli.StringFlag{
+			Name:  "metrics",
+			Value: "127.0.0.1:9567",
+			Usage: "address to export metrics",
+		},
+		&cli.BoolFlag{
+			Name:  "no-usage-report",
+			Usage: "do not send usage report",
+		})
+	return &cli.Command{
+		Name:      "sftp",
+		Usage:     "serve the volume over SFTP",
+		ArgsUsage: "META-URL ADDRESS",
+		Flags:     flags,
+		Action:    sftpServe,
+	}
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err == nil {
+			logger.Warnf("Use temporary host key %s, please specify one with --host-key", ssh.FingerprintSHA256(signer.PublicKey()))
+		}
+		return signer, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func sftpServe(c *cli.Context) error {
+	setLoggerLevel(c)
+	adjustForCgroup(c, c.LocalFlagNames())
+	if c.Args().Len() < 2 {
+		logger.Fatalf("Meta URL and listen address are required")
+	}
+	if !c.IsSet("users") {
+		logger.Fatalf("--users is required")
+	}
+	users, err := jfssftp.LoadUsers(c.String("users"))
+	if err != nil {
+		logger.Fatalf("load users from %s: %s", c.String("users"), err)
+	}
+	hostKey, err := loadHostKey(c.String("host-key"))
+	if err != nil {
+		logger.Fatalf("load host key: %s", err)
+	}
+
+	addr := c.Args().Get(0)
+	m := meta.NewClient(addr, &meta.Config{
+		Retries:    10,
+		Strict:     true,
+		ReadOnly:   c.Bool("read-only"),
+		OpenCache:  time.Duration(c.Float64("open-cache") * 1e9),
+		MountPoint: "sftp",
+		Subdir:     c.String("subdir"),
+		MaxDeletes: c.Int("max-deletes"),
+
+		MaxOpenFiles:  c.Int("max-open-files"),
+		Broker:        c.String("meta-broker"),
+		Heartbeat:     c.Duration("heartbeat"),
+		SkipDirMtime:  c.Duration("skip-dir-mtime"),
+		ScrubInterval: c.Duration("meta-scrub-interval"),
+		AtimeMode:     atimeMode(c),
+	})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	wrapRegister("sftp", format.Name)
+
+	chunkConf := chunk.Config{
+		BlockSize:    format.BlockSize * 1024,
+		Compress:     format.Compression,
+		CompressDict: format.CompressDict,
+
+		GetTimeout:    time.Second * time.Duration(c.Int("get-timeout")),
+		PutTimeout:    time.Second * time.Duration(c.Int("put-timeout")),
+		UploadRetry:   c.Duration("upload-retry-window"),
+		MaxUpload:     c.Int("max-uploads"),
+		Writeback:     c.Bool("writeback"),
+		UploadDelay:   c.Duration("upload-delay"),
+		Prefetch:      c.Int("prefetch"),
+		BufferSize:    c.Int("buffer-size") << 20,
+		UploadLimit:   c.Int64("upload-limit") * 1e6 / 8,
+		DownloadLimit: c.Int64("download-limit") * 1e6 / 8,
+
+		CacheDir:       c.String("cache-dir"),
+		CacheSize:      int64(c.Int("cache-size")),
+		FreeSpace:      float32(c.Float64("free-space-ratio")),
+		CacheMode:      os.FileMode(0600),
+		CacheFullBlock: !c.Bool("cache-partial-only"),
+		CacheAdmission: c.String("cache-admission"),
+		AutoCreate:     true,
+		IdleShrink:     c.Duration("idle-shrink"),
+	}
+	if chunkConf.CacheDir != "memory" {
+		ds := utils.SplitDir(chunkConf.CacheDir)
+		for i := range ds {
+			ds[i] = filepath.Join(ds[i], format.UUID)
+		}
+		chunkConf.CacheDir = strings.Join(ds, string(os.PathListSeparator))
+	}
+	if c.IsSet("bucket") {
+		format.Bucket = c.String("bucket")
+	}
+	blob, err := createStorage(format)
+	if err != nil {
+		logger.Fatalf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	if os.Getenv("JFS_NO_CHECK_OBJECT_STORAGE") == "" {
+		if err = checkMarker(blob, format, c.Bool("read-only")); err != nil {
+			logger.Fatalf("Check object storage %s: %s", blob, err)
+		}
+	}
+	blob = withBilling(c, blob, format)
+
+	store := chunk.NewCachedStore(blob, chunkConf)
+	m.OnMsg(meta.DeleteChunk, func(args ...interface{}) error {
+		chunkid := args[0].(uint64)
+		length := args[1].(uint32)
+		return store.Remove(chunkid, int(length))
+	})
+	m.OnMsg(meta.CompactChunk, func(args ...interface{}) error {
+		slices := args[0].([]meta.Slice)
+		chunkid := args[1].(uint64)
+		return vfs.Compact(chunkConf, store, slices, chunkid)
+	})
+	err = m.NewSession()
+	if err != nil {
+		logger.Fatalf("new session: %s", err)
+	}
+
+	conf := &vfs.Config{
+		Meta: &meta.Config{
+			Retries: 10,
+		},
+		Format:          format,
+		Version:         version.Version(),
+		AttrTimeout:     time.Millisecond * time.Duration(c.Float64("attr-cache")*1000),
+		EntryTimeout:    time.Millisecond * time.Duration(c.Float64("entry-cache")*1000),
+		DirEntryTimeout: time.Millisecond * time.Duration(c.Float64("dir-entry-cache")*1000),
+		AccessLog:       c.String("access-log"),
+		Chunk:           &chunkConf,
+	}
+	exposeMetrics(m, c)
+	if d := c.Duration("backup-meta"); d > 0 {
+		go vfs.Backup(m, blob, d)
+	}
+	if !c.Bool("no-usage-report") {
+		go usage.ReportUsage(m, "sftp "+version.Version())
+	}
+	jfs, err := fs.NewFileSystem(conf, m, store)
+	if err != nil {
+		logger.Fatalf("initialize: %s", err)
+	}
+
+	l, err := net.Listen("tcp", c.Args().Get(1))
+	if err != nil {
+		logger.Fatalf("listen on %s: %s", c.Args().Get(1), err)
+	}
+	logger.Infof("SFTP server listening on %s", l.Addr())
+	err = jfssftp.NewServer(jfs, users, hostKey).Serve(l)
+	_ = m.CloseSession()
+	return err
+}
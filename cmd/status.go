@@ -27,6 +27,61 @@ import (
 type sections struct {
 	Setting  *meta.Format
 	Sessions []*meta.Session
+	Pending  *meta.PendingUsage    `json:",omitempty"`
+	GC       *meta.GCStats         `json:",omitempty"`
+	Deferred []*meta.DumpedDelFile `json:",omitempty"`
+}
+
+type openFile struct {
+	Sid        uint64
+	Hostname   string
+	IP         string `json:",omitempty"`
+	MountPoint string
+	ProcessID  int
+	Inode      meta.Ino
+	Refs       int
+	Path       string
+	Deleted    bool `json:",omitempty"`
+}
+
+func listOpenFiles(m meta.Meta, filter *meta.SessionFilter) ([]openFile, error) {
+	sessions, err := m.ListSessions(filter)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]openFile, 0)
+	for _, s := range sessions {
+		detail, err := m.GetSession(s.Sid)
+		if err != nil {
+			logger.Warnf("get session %d: %s", s.Sid, err)
+			continue
+		}
+		sustained := make(map[meta.Ino]bool, len(detail.Sustained))
+		for _, inode := range detail.Sustained {
+			sustained[inode] = true
+		}
+		for _, f := range detail.OpenFiles {
+			of := openFile{
+				Sid:        s.Sid,
+				Hostname:   detail.Hostname,
+				IP:         detail.IP,
+				MountPoint: detail.MountPoint,
+				ProcessID:  detail.ProcessID,
+				Inode:      f.Inode,
+				Refs:       f.Refs,
+				Deleted:    sustained[f.Inode],
+			}
+			if !of.Deleted {
+				if p, st := meta.GetPath(m, meta.Background, f.Inode); st == 0 {
+					of.Path = p
+				} else {
+					of.Path = st.Error()
+				}
+			}
+			files = append(files, of)
+		}
+	}
+	return files, nil
 }
 
 func printJson(v interface{}) {
@@ -43,6 +98,7 @@ func status(ctx *cli.Context) error {
 		return fmt.Errorf("META-URL is needed")
 	}
 	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	filter := &meta.SessionFilter{Hostname: ctx.String("hostname"), Idle: ctx.Duration("idle")}
 
 	if sid := ctx.Uint64("session"); sid != 0 {
 		s, err := m.GetSession(sid)
@@ -53,18 +109,42 @@ func status(ctx *cli.Context) error {
 		return nil
 	}
 
+	if ctx.Bool("open-files") {
+		files, err := listOpenFiles(m, filter)
+		if err != nil {
+			logger.Fatalf("list open files: %s", err)
+		}
+		printJson(files)
+		return nil
+	}
+
 	format, err := m.Load()
 	if err != nil {
 		logger.Fatalf("load setting: %s", err)
 	}
 	format.RemoveSecret()
 
-	sessions, err := m.ListSessions()
+	sessions, err := m.ListSessions(filter)
 	if err != nil {
 		logger.Fatalf("list sessions: %s", err)
 	}
 
-	printJson(&sections{format, sessions})
+	var pending meta.PendingUsage
+	if st := m.GetPendingUsage(meta.Background, &pending); st != 0 {
+		logger.Warnf("get pending usage: %s", st)
+	}
+
+	deferred, err := m.ListDeferredFiles()
+	if err != nil {
+		logger.Warnf("list deferred files: %s", err)
+	}
+
+	var gc meta.GCStats
+	if st := m.GetGCStats(meta.Background, &gc); st != 0 {
+		logger.Warnf("get gc stats: %s", st)
+	}
+
+	printJson(&sections{format, sessions, &pending, &gc, deferred})
 	return nil
 }
 
@@ -80,6 +160,18 @@ func statusFlags() *cli.Command {
 				Aliases: []string{"s"},
 				Usage:   "show detailed information (sustained inodes, locks) of the specified session (sid)",
 			},
+			&cli.BoolFlag{
+				Name:  "open-files",
+				Usage: "list files held open by all sessions (refreshed with the heartbeat)",
+			},
+			&cli.StringFlag{
+				Name:  "hostname",
+				Usage: "only show sessions from this host (name or IP)",
+			},
+			&cli.DurationFlag{
+				Name:  "idle",
+				Usage: "only show sessions without heartbeat for longer than this duration",
+			},
 		},
 	}
 }
@@ -188,6 +188,13 @@ func doSync(c *cli.Context) error {
 	if strings.HasSuffix(srcURL, "/") != strings.HasSuffix(dstURL, "/") {
 		logger.Fatalf("SRC and DST should both end with path separator or not!")
 	}
+	if config.Listing != "" && config.Perms {
+		logger.Fatalf("--perms can't be used together with --use-listing")
+	}
+	if config.Listing != "" && config.DeleteDst {
+		// the objects created in source after the listing was saved would be deleted from destination
+		logger.Fatalf("--delete-dst can't be used together with --use-listing")
+	}
 	src, err := createSyncStorage(srcURL, config)
 	if err != nil {
 		return err
@@ -293,6 +300,14 @@ func syncFlags() *cli.Command {
 				Name:  "check-new",
 				Usage: "verify integrity of newly copied files",
 			},
+			&cli.BoolFlag{
+				Name:  "delta",
+				Usage: "update existing files in destination like rsync, only the data not found in them by rolling checksums is written (file:// only)",
+			},
+			&cli.StringFlag{
+				Name:  "use-listing",
+				Usage: "read objects in SRC from the listing `FILE` saved by list-save instead of listing it (not with --perms or --delete-dst)",
+			},
 		},
 	}
 }
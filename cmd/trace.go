@@ -0,0 +1,129 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/urfave/cli/v2"
+)
+
+func traceBlocksFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "trace-blocks",
+		Usage:     "record blocks read from a mount point into a manifest for warmup",
+		ArgsUsage: "MOUNTPOINT",
+		Action:    traceBlocks,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "manifest file to write (default: stdout)",
+			},
+			&cli.DurationFlag{
+				Name:  "duration",
+				Usage: "stop tracing after this duration (default: until interrupted)",
+			},
+		},
+	}
+}
+
+func traceBlocks(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		logger.Fatalln("MOUNTPOINT must be provided!")
+	}
+	mp := ctx.Args().First()
+	inode, err := utils.GetFileInode(mp)
+	if err != nil {
+		logger.Fatalf("Failed to lookup inode for %s: %s", mp, err)
+	}
+	if inode != 1 {
+		logger.Fatalf("Path %s is not a mount point!", mp)
+	}
+	logPath := path.Join(mp, ".blocklog")
+	file, err := os.Open(logPath)
+	if err != nil {
+		logger.Fatalf("Failed to open block log %s: %s", logPath, err)
+	}
+
+	var out io.Writer = os.Stdout
+	if name := ctx.String("output"); name != "" {
+		f, err := os.Create(name)
+		if err != nil {
+			logger.Fatalf("Failed to create manifest %s: %s", name, err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	keys := make(chan string, 1024)
+	go func() {
+		defer close(keys)
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+					logger.Errorf("Read block log: %s", err)
+				}
+				return
+			}
+			keys <- strings.TrimSpace(line)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if d := ctx.Duration("duration"); d > 0 {
+		timeout = time.After(d)
+	}
+
+	seen := make(map[string]bool)
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok {
+				logger.Infof("Traced %d blocks", len(seen))
+				return nil
+			}
+			if key == "" || key == "#" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			if _, err := w.WriteString(key + "\n"); err != nil {
+				logger.Fatalf("Write manifest: %s", err)
+			}
+		case <-stop:
+			_ = file.Close()
+		case <-timeout:
+			_ = file.Close()
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/urfave/cli/v2"
+)
+
+func traceBlockFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "trace-block",
+		Aliases:   []string{"inspect-object"},
+		Usage:     "find the slice, files and paths that an object in the bucket belongs to",
+		ArgsUsage: "META-URL BLOCKKEY...",
+		Description: `BLOCKKEY is the key of an object like chunks/0/1/1024_2_4194304, the prefix before chunks/ is optional.
+The slices are not indexed by their ids, so all of them are scanned to find the files using them,
+it could take a while for a large volume.`,
+		Action: traceBlock,
+	}
+}
+
+// blockKey is the parsed name of an object in the bucket, like chunks/0/0/1024_2_4194304
+type blockKey struct {
+	chunkid uint64
+	indx    uint32 // index of the block in the slice
+	size    uint32 // size of the block
+}
+
+func parseBlockKey(key string) (*blockKey, error) {
+	parts := strings.Split(path.Base(key), "_")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid block key: %s", key)
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("invalid chunk id in block key: %s", key)
+	}
+	indx, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block index in block key: %s", key)
+	}
+	size, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil || size == 0 {
+		return nil, fmt.Errorf("invalid block size in block key: %s", key)
+	}
+	return &blockKey{id, uint32(indx), uint32(size)}, nil
+}
+
+// blockRange is a range of a file that stores the data of a block.
+type blockRange struct {
+	Off uint64 // offset in the file
+	Len uint32
+}
+
+// traceRanges returns the ranges of a file that read the data in [start, end) of slice id.
+func traceRanges(m meta.Meta, inode meta.Ino, length uint64, id uint64, start, end uint32) ([]blockRange, error) {
+	var ranges []blockRange
+	for indx := uint64(0); indx*meta.ChunkSize < length; indx++ {
+		var ss []meta.Slice
+		if st := m.Read(meta.Background, inode, uint32(indx), &ss); st != 0 {
+			return nil, fmt.Errorf("read chunk %d of inode %d: %s", indx, inode, st)
+		}
+		var pos uint32
+		for _, s := range ss {
+			if s.Chunkid == id {
+				lo, hi := s.Off, s.Off+s.Len
+				if lo < start {
+					lo = start
+				}
+				if hi > end {
+					hi = end
+				}
+				if lo < hi {
+					ranges = append(ranges, blockRange{indx*meta.ChunkSize + uint64(pos+lo-s.Off), hi - lo})
+				}
+			}
+			pos += s.Len
+		}
+	}
+	return ranges, nil
+}
+
+func traceBlock(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 2 {
+		return fmt.Errorf("META-URL and BLOCKKEY are needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		logger.Fatalf("load setting: %s", err)
+	}
+	blockSize := uint32(format.BlockSize * 1024)
+
+	args := ctx.Args().Slice()[1:]
+	blocks := make([]*blockKey, len(args))
+	ids := make(map[uint64]bool)
+	for i, arg := range args {
+		if blocks[i], err = parseBlockKey(arg); err != nil {
+			return err
+		}
+		ids[blocks[i].chunkid] = true
+	}
+
+	// the slices are not indexed by their ids, so scan all of them
+	sizes := make(map[uint64]uint32)
+	files := make(map[uint64]map[meta.Ino]bool)
+	if st := m.ListSlices(meta.Background, false, func(inode meta.Ino, s meta.Slice) error {
+		if ids[s.Chunkid] {
+			sizes[s.Chunkid] = s.Size
+			if files[s.Chunkid] == nil {
+				files[s.Chunkid] = make(map[meta.Ino]bool)
+			}
+			files[s.Chunkid][inode] = true
+		}
+		return nil
+	}); st != 0 {
+		return fmt.Errorf("list slices: %s", st)
+	}
+
+	for i, k := range blocks {
+		start := k.indx * blockSize
+		fmt.Printf("%s:\n", args[i])
+		size, ok := sizes[k.chunkid]
+		if !ok {
+			fmt.Printf(" slice %d is not used by any file\n", k.chunkid)
+			continue
+		}
+		fmt.Printf(" slice:\t%d (%d bytes), block %d at %d-%d\n", k.chunkid, size, k.indx, start, start+k.size)
+		if start+k.size > size || k.size != blockSize && start+k.size != size {
+			fmt.Printf(" size of the block does not match the slice\n")
+		}
+		var inodes []meta.Ino
+		for inode := range files[k.chunkid] {
+			inodes = append(inodes, inode)
+		}
+		sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+		for _, inode := range inodes {
+			var attr meta.Attr
+			if st := m.GetAttr(meta.Background, inode, &attr); st != 0 {
+				fmt.Printf(" inode:\t%d (%s)\n", inode, st)
+				continue
+			}
+			fmt.Printf(" inode:\t%d %s\n", inode, strings.Join(meta.GetPaths(m, meta.Background, inode), " "))
+			ranges, err := traceRanges(m, inode, attr.Length, k.chunkid, start, start+k.size)
+			if err != nil {
+				logger.Warnf("%s", err)
+				continue
+			}
+			if len(ranges) == 0 {
+				fmt.Printf("\tnot visible in the file\n")
+			}
+			for _, r := range ranges {
+				fmt.Printf("\t%d-%d\n", r.Off, r.Off+uint64(r.Len))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestParseBlockKey(t *testing.T) {
+	for key, expected := range map[string]blockKey{
+		"1024_2_4194304":                  {1024, 2, 4194304},
+		"chunks/0/1/1024_0_100":           {1024, 0, 100},
+		"myjfs/chunks/0/1/1024_3_1048576": {1024, 3, 1048576},
+	} {
+		k, err := parseBlockKey(key)
+		if err != nil || *k != expected {
+			t.Fatalf("parse %s: %+v %s", key, k, err)
+		}
+	}
+	for _, key := range []string{"", "chunks/0/0/1024_2", "a_2_4096", "0_1_4096", "1024_2_0"} {
+		if _, err := parseBlockKey(key); err == nil {
+			t.Fatalf("parse %s should fail", key)
+		}
+	}
+}
+
+func TestTraceBlock(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "jfs.db")
+	if err := Main([]string{"", "format", metaUrl, "--bucket", t.TempDir(), "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	if _, err := m.Load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	ctx := meta.Background
+	var inode meta.Ino
+	var attr meta.Attr
+	if st := m.Create(ctx, 1, "f", 0644, 022, 0, &inode, &attr); st != 0 {
+		t.Fatalf("create: %s", st)
+	}
+	var id, id2 uint64
+	if st := m.NewChunk(ctx, &id); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, meta.Slice{Chunkid: id, Size: 6 << 20, Len: 6 << 20}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+	if st := m.NewChunk(ctx, &id2); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 1<<20, meta.Slice{Chunkid: id2, Size: 1 << 20, Len: 1 << 20}); st != 0 {
+		t.Fatalf("write: %s", st)
+	}
+
+	block0 := fmt.Sprintf("chunks/0/0/%d_0_4194304", id)
+	block1 := fmt.Sprintf("%d_1_2097152", id)
+	leaked := fmt.Sprintf("%d_0_4096", id2+100)
+	out, err := getStdout([]string{"", "trace-block", metaUrl, block0, block1, leaked})
+	if err != nil {
+		t.Fatalf("trace-block: %s", err)
+	}
+	expected := fmt.Sprintf(`%s:
+ slice:	%d (6291456 bytes), block 0 at 0-4194304
+ inode:	%d /f
+	0-1048576
+	2097152-4194304
+%s:
+ slice:	%d (6291456 bytes), block 1 at 4194304-6291456
+ inode:	%d /f
+	4194304-6291456
+%s:
+ slice %d is not used by any file
+`, block0, id, inode, block1, id, inode, leaked, id2+100)
+	if string(out) != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	expected = fmt.Sprintf(`%s:
+ slice:	%d (6291456 bytes), block 0 at 0-4194304
+ inode:	%d /f
+	0-1048576
+	2097152-4194304
+`, block0, id, inode)
+	if out, err := getStdout([]string{"", "inspect-object", metaUrl, block0}); err != nil {
+		t.Fatalf("inspect-object: %s", err)
+	} else if string(out) != expected {
+		t.Fatalf("unexpected output of inspect-object:\n%s\nexpected:\n%s", out, expected)
+	}
+
+	if _, err := getStdout([]string{"", "trace-block", metaUrl, "chunks/0/0/bad"}); err == nil || !strings.Contains(err.Error(), "invalid block key") {
+		t.Fatalf("trace invalid key: %v", err)
+	}
+}
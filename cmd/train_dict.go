@@ -0,0 +1,168 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/compress"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/urfave/cli/v2"
+)
+
+// only the beginning of large blocks is sampled
+const maxSampleSize = 128 << 10
+
+func trainDictFlags() *cli.Command {
+	return &cli.Command{
+		Name:      "train-dict",
+		Usage:     "train a zstd dictionary from sampled blocks to compress small files better",
+		ArgsUsage: "META-URL",
+		Action:    trainDict,
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "samples",
+				Value: 1000,
+				Usage: "number of blocks to sample",
+			},
+			&cli.IntFlag{
+				Name:  "dict-size",
+				Value: 110,
+				Usage: "max size of the dictionary in KiB",
+			},
+			&cli.StringFlag{
+				Name:  "use-listing",
+				Usage: "read objects from the listing `FILE` saved by list-save instead of listing the bucket",
+			},
+			adminTokenFlag(),
+		},
+	}
+}
+
+// blockSize returns the size of a block from its key, which is {id/1000/1000}/{id/1000}/{id}_{indx}_{size} under chunks/
+func blockSize(key string) int {
+	ps := strings.Split(key[strings.LastIndexByte(key, '/')+1:], "_")
+	if len(ps) != 3 {
+		return 0
+	}
+	size, _ := strconv.Atoi(ps[2])
+	return size
+}
+
+// sampleBlocks picks n blocks randomly and returns their data (at most maxSampleSize bytes of each).
+func sampleBlocks(blob object.ObjectStorage, objs <-chan object.Object, n int, c compress.Compressor) ([][]byte, error) {
+	blob = object.WithPrefix(blob, "chunks/") // the keys listed are relative to chunks/
+	var picked []object.Object
+	var seen int
+	for obj := range objs {
+		if obj == nil {
+			return nil, fmt.Errorf("list blocks failed")
+		}
+		if obj.IsDir() || blockSize(obj.Key()) == 0 {
+			continue
+		}
+		seen++
+		if len(picked) < n {
+			picked = append(picked, obj)
+		} else if i := rand.Intn(seen); i < n {
+			picked[i] = obj
+		}
+	}
+	logger.Infof("Sampled %d out of %d blocks", len(picked), seen)
+	var samples [][]byte
+	for _, obj := range picked {
+		in, err := blob.Get(obj.Key(), 0, -1)
+		if err != nil {
+			logger.Warnf("get block %s: %s", obj.Key(), err)
+			continue
+		}
+		raw, err := io.ReadAll(in)
+		_ = in.Close()
+		if err != nil {
+			logger.Warnf("read block %s: %s", obj.Key(), err)
+			continue
+		}
+		data := make([]byte, blockSize(obj.Key()))
+		size, err := c.Decompress(data, raw)
+		if err != nil {
+			logger.Warnf("decompress block %s: %s", obj.Key(), err)
+			continue
+		}
+		data = data[:size]
+		if len(data) > maxSampleSize {
+			data = data[:maxSampleSize]
+		}
+		samples = append(samples, data)
+	}
+	return samples, nil
+}
+
+func trainDict(ctx *cli.Context) error {
+	setLoggerLevel(ctx)
+	if ctx.Args().Len() < 1 {
+		return fmt.Errorf("META-URL is needed")
+	}
+	m := meta.NewClient(ctx.Args().Get(0), &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		return err
+	}
+	if err = checkAdmin(ctx, format); err != nil {
+		return err
+	}
+	if strings.ToLower(format.Compression) != "zstd" {
+		return fmt.Errorf("dictionary is only supported by zstd, but volume %s is compressed by %q", format.Name, format.Compression)
+	}
+	blob, err := createStorage(format)
+	if err != nil {
+		return fmt.Errorf("object storage: %s", err)
+	}
+	logger.Infof("Data use %s", blob)
+	objs, err := listBlocks(ctx, blob)
+	if err != nil {
+		return fmt.Errorf("list blocks: %s", err)
+	}
+	c := compress.NewZStandardDict(format.CompressDict, func(id uint32) ([]byte, error) {
+		return chunk.LoadDict(blob, id)
+	})
+	samples, err := sampleBlocks(blob, objs, ctx.Int("samples"), c)
+	if err != nil {
+		return err
+	}
+
+	id := format.CompressDict + 1
+	dict, err := compress.TrainDict(samples, ctx.Int("dict-size")<<10, id)
+	if err != nil {
+		return err
+	}
+	if err = blob.Put(chunk.DictKey(id), bytes.NewReader(dict)); err != nil {
+		return fmt.Errorf("save dictionary %d: %s", id, err)
+	}
+	format.CompressDict = id
+	if err = m.Init(*format, false); err != nil {
+		return err
+	}
+	logger.Infof("Dictionary %d (%d bytes) is trained from %d samples, it will be used by newly mounted clients", id, len(dict), len(samples))
+	return nil
+}
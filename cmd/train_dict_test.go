@@ -0,0 +1,74 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/compress"
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestTrainDict(t *testing.T) {
+	metaUrl := "sqlite3://" + filepath.Join(t.TempDir(), "dict.db")
+	bucket := t.TempDir()
+	if err := Main([]string{"", "format", metaUrl, "--bucket", bucket, "--compress", "lz4", "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	if err := Main([]string{"", "train-dict", metaUrl}); err == nil {
+		t.Fatalf("dictionary should not be trained for lz4")
+	}
+	if err := Main([]string{"", "format", metaUrl, "--bucket", bucket, "--compress", "zstd", "--force", "test"}); err != nil {
+		t.Fatalf("format: %s", err)
+	}
+	m := meta.NewClient(metaUrl, &meta.Config{Retries: 10, Strict: true})
+	format, err := m.Load()
+	if err != nil {
+		t.Fatalf("load setting: %s", err)
+	}
+	blob, err := createStorage(format)
+	if err != nil {
+		t.Fatalf("create storage: %s", err)
+	}
+	c := compress.NewCompressor("zstd")
+	for i := 1; i <= 500; i++ {
+		data := []byte(fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":%t}`, i, i*7, i*13, i%3 == 0))
+		buf := make([]byte, c.CompressBound(len(data)))
+		n, _ := c.Compress(buf, data)
+		key := fmt.Sprintf("chunks/0/0/%d_0_%d", i, len(data))
+		if err = blob.Put(key, bytes.NewReader(buf[:n])); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+
+	for id := uint32(1); id <= 2; id++ {
+		if err = Main([]string{"", "train-dict", metaUrl, "--dict-size", "4"}); err != nil {
+			t.Fatalf("train dictionary: %s", err)
+		}
+		if format, err = m.Load(); err != nil || format.CompressDict != id {
+			t.Fatalf("dictionary of volume: %+v %s", format, err)
+		}
+		dict, err := chunk.LoadDict(blob, id)
+		if err != nil || compress.DictID(dict) != id {
+			t.Fatalf("load dictionary %d: %s", id, err)
+		}
+	}
+}
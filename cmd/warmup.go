@@ -29,15 +29,15 @@ import (
 
 const batchMax = 10240
 
-// send fill-cache command to controller file
-func sendCommand(cf *os.File, batch []string, count int, threads uint, background bool) {
+// send fill-cache or fill-blocks command to controller file
+func sendCommand(cf *os.File, cmd uint32, batch []string, count int, threads uint, background bool) {
 	paths := strings.Join(batch[:count], "\n")
 	var back uint8
 	if background {
 		back = 1
 	}
 	wb := utils.NewBuffer(8 + 4 + 3 + uint32(len(paths)))
-	wb.Put32(meta.FillCache)
+	wb.Put32(cmd)
 	wb.Put32(4 + 3 + uint32(len(paths)))
 	wb.Put32(uint32(len(paths)))
 	wb.Put([]byte(paths))
@@ -47,7 +47,7 @@ func sendCommand(cf *os.File, batch []string, count int, threads uint, backgroun
 		logger.Fatalf("Write message: %s", err)
 	}
 	if background {
-		logger.Infof("Warm-up cache for %d paths in backgroud", count)
+		logger.Infof("Warm-up cache for %d items in backgroud", count)
 		return
 	}
 	var errs = make([]byte, 1)
@@ -59,34 +59,31 @@ func sendCommand(cf *os.File, batch []string, count int, threads uint, backgroun
 	}
 }
 
-func warmup(ctx *cli.Context) error {
-	fname := ctx.String("file")
-	paths := ctx.Args().Slice()
-	if fname != "" {
-		fd, err := os.Open(fname)
-		if err != nil {
-			logger.Fatalf("Failed to open file %s: %s", fname, err)
-		}
-		defer fd.Close()
-		scanner := bufio.NewScanner(fd)
-		for scanner.Scan() {
-			if p := strings.TrimSpace(scanner.Text()); p != "" {
-				paths = append(paths, p)
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			logger.Fatalf("Reading file %s failed with error: %s", fname, err)
+// read non-empty lines from a file, lines started with "#" are ignored
+func readLines(fname string) []string {
+	fd, err := os.Open(fname)
+	if err != nil {
+		logger.Fatalf("Failed to open file %s: %s", fname, err)
+	}
+	defer fd.Close()
+	var lines []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if l := strings.TrimSpace(scanner.Text()); l != "" && !strings.HasPrefix(l, "#") {
+			lines = append(lines, l)
 		}
 	}
-	if len(paths) == 0 {
-		logger.Infof("Nothing to warm up")
-		return nil
+	if err := scanner.Err(); err != nil {
+		logger.Fatalf("Reading file %s failed with error: %s", fname, err)
 	}
+	return lines
+}
 
-	// find mount point
-	first, err := filepath.Abs(paths[0])
+// find the mount point of JuiceFS that p belongs to
+func findMountpoint(p string) string {
+	first, err := filepath.Abs(p)
 	if err != nil {
-		logger.Fatalf("Failed to get abs of %s: %s", paths[0], err)
+		logger.Fatalf("Failed to get abs of %s: %s", p, err)
 	}
 	st, err := os.Stat(first)
 	if err != nil {
@@ -110,7 +107,26 @@ func warmup(ctx *cli.Context) error {
 	if mp == "/" {
 		logger.Fatalf("Path %s is not inside JuiceFS", first)
 	}
+	return mp
+}
 
+func warmup(ctx *cli.Context) error {
+	fname := ctx.String("file")
+	manifest := ctx.String("manifest")
+	paths := ctx.Args().Slice()
+	if manifest != "" {
+		if fname != "" || len(paths) != 1 {
+			logger.Fatalf("Only MOUNTPOINT is expected with --manifest")
+		}
+	} else if fname != "" {
+		paths = append(paths, readLines(fname)...)
+	}
+	if len(paths) == 0 {
+		logger.Infof("Nothing to warm up")
+		return nil
+	}
+
+	mp := findMountpoint(paths[0])
 	controller := openController(mp)
 	if controller == nil {
 		logger.Fatalf("Failed to open control file under %s", mp)
@@ -119,11 +135,31 @@ func warmup(ctx *cli.Context) error {
 
 	threads := ctx.Uint("threads")
 	background := ctx.Bool("background")
-	start := len(mp)
 	batch := make([]string, batchMax)
 	progress := utils.NewProgress(background, false)
-	bar := progress.AddCountBar("Warmed up paths", int64(len(paths)))
 	var index int
+	if manifest != "" {
+		keys := readLines(manifest)
+		bar := progress.AddCountBar("Warmed up blocks", int64(len(keys)))
+		for _, key := range keys {
+			batch[index] = key
+			index++
+			if index >= batchMax {
+				sendCommand(controller, meta.FillBlocks, batch, index, threads, background)
+				bar.IncrBy(index)
+				index = 0
+			}
+		}
+		if index > 0 {
+			sendCommand(controller, meta.FillBlocks, batch, index, threads, background)
+			bar.IncrBy(index)
+		}
+		progress.Done()
+		return nil
+	}
+
+	start := len(mp)
+	bar := progress.AddCountBar("Warmed up paths", int64(len(paths)))
 	for _, path := range paths {
 		if strings.HasPrefix(path, mp) {
 			batch[index] = path[start:]
@@ -133,13 +169,13 @@ func warmup(ctx *cli.Context) error {
 			continue
 		}
 		if index >= batchMax {
-			sendCommand(controller, batch, index, threads, background)
+			sendCommand(controller, meta.FillCache, batch, index, threads, background)
 			bar.IncrBy(index)
 			index = 0
 		}
 	}
 	if index > 0 {
-		sendCommand(controller, batch, index, threads, background)
+		sendCommand(controller, meta.FillCache, batch, index, threads, background)
 		bar.IncrBy(index)
 	}
 	progress.Done()
@@ -159,6 +195,10 @@ func warmupFlags() *cli.Command {
 				Aliases: []string{"f"},
 				Usage:   "file containing a list of paths",
 			},
+			&cli.StringFlag{
+				Name:  "manifest",
+				Usage: "file containing a list of blocks generated by trace-blocks",
+			},
 			&cli.UintFlag{
 				Name:    "threads",
 				Aliases: []string{"p"},
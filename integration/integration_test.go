@@ -383,5 +383,5 @@ func (g *GateWay) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, er
 		DirEntryTimeout: time.Second,
 		Chunk:           &chunkConf,
 	}
-	return jfsgateway.NewJFSGateway(conf, m, store, true, true)
+	return jfsgateway.NewJFSGateway(conf, m, store, true, true, 0, "")
 }
@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import "hash/fnv"
+
+const sketchDepth = 4
+
+// tinyLFU estimates the recent access frequency of blocks with a count-min sketch,
+// the counters are halved periodically so that old popularity fades out.
+type tinyLFU struct {
+	counters [sketchDepth][]uint8
+	mask     uint64
+	added    int
+	resetAt  int
+}
+
+func newTinyLFU(entries int) *tinyLFU {
+	width := 1024
+	for width < entries && width < 1<<24 {
+		width <<= 1
+	}
+	s := &tinyLFU{mask: uint64(width - 1), resetAt: width * 10}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *tinyLFU) hash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	v := h.Sum64()
+	return v, v>>32 | 1
+}
+
+// increment records an access of key.
+func (s *tinyLFU) increment(key string) {
+	h1, h2 := s.hash(key)
+	for i := range s.counters {
+		idx := (h1 + uint64(i)*h2) & s.mask
+		if s.counters[i][idx] < 15 {
+			s.counters[i][idx]++
+		}
+	}
+	s.added++
+	if s.added >= s.resetAt {
+		s.reset()
+	}
+}
+
+// estimate returns the approximate number of recent accesses of key.
+func (s *tinyLFU) estimate(key string) uint8 {
+	h1, h2 := s.hash(key)
+	var min uint8 = 15
+	for i := range s.counters {
+		if c := s.counters[i][(h1+uint64(i)*h2)&s.mask]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (s *tinyLFU) reset() {
+	for i := range s.counters {
+		for j := range s.counters[i] {
+			s.counters[i][j] >>= 1
+		}
+	}
+	s.added /= 2
+}
@@ -0,0 +1,137 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/version"
+)
+
+// cacheVersion is the version of the layout of a cache directory and the format of cached blocks,
+// bump it when any of them is changed, and add a migration from the previous one.
+const cacheVersion = 1
+
+// the sidecar in the cache directory which records the version of it
+const cacheMetaFile = ".cacheinfo"
+
+type cacheMeta struct {
+	Version int
+	Client  string // the version of client which wrote it
+	Updated time.Time
+}
+
+// cacheMigrations[i] upgrades a cache directory from version i to i+1, where version 0 is the
+// ones created before the version is recorded.
+var cacheMigrations = []func(dir string) error{
+	func(dir string) error { return nil }, // the same layout as version 1
+}
+
+func readCacheMeta(dir string) (*cacheMeta, error) {
+	data, err := os.ReadFile(filepath.Join(dir, cacheMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var m cacheMeta
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func writeCacheMeta(dir string, mode os.FileMode) error {
+	data, err := json.MarshalIndent(&cacheMeta{cacheVersion, version.Version(), time.Now()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, cacheMetaFile)
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// evictCached moves away the cached blocks in dir and removes them in background. The staging
+// blocks are kept, since they may not be uploaded yet.
+func evictCached(dir string) {
+	cached := filepath.Join(dir, cacheDir)
+	evicted := fmt.Sprintf("%s.evicted.%d", cached, time.Now().UnixNano())
+	if err := os.Rename(cached, evicted); err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnf("Evict cached blocks in %s: %s", dir, err)
+		}
+		return
+	}
+	go func() {
+		if err := os.RemoveAll(evicted); err != nil {
+			logger.Warnf("Remove evicted blocks %s: %s", evicted, err)
+		}
+	}()
+}
+
+// checkCacheVersion upgrades the cache directory to the current version. The cached blocks which
+// can't be migrated, or written by a newer client, are evicted instead of being used silently.
+func checkCacheVersion(dir string, mode os.FileMode) {
+	var ver int
+	m, err := readCacheMeta(dir)
+	if err == nil {
+		if m.Version == cacheVersion {
+			return
+		}
+		ver = m.Version
+	} else if !os.IsNotExist(err) {
+		logger.Warnf("Invalid %s in %s: %s", cacheMetaFile, dir, err)
+		ver = -1
+	} else if !exists(filepath.Join(dir, cacheDir)) && !exists(filepath.Join(dir, stagingDir)) {
+		ver = cacheVersion // a new one
+	}
+	switch {
+	case ver == cacheVersion:
+	case ver < 0 || ver > cacheVersion:
+		logger.Warnf("Cache in %s is in an unknown format (version %d, client %s), evict cached blocks", dir, ver, clientOf(m))
+		evictCached(dir)
+	default:
+		for ; ver < cacheVersion; ver++ {
+			if err = cacheMigrations[ver](dir); err != nil {
+				logger.Warnf("Migrate cache in %s from version %d to %d: %s, evict cached blocks", dir, ver, ver+1, err)
+				evictCached(dir)
+				break
+			}
+			logger.Infof("Migrated cache in %s from version %d to %d", dir, ver, ver+1)
+		}
+	}
+	if err = writeCacheMeta(dir, mode); err != nil {
+		logger.Warnf("Write %s in %s: %s", cacheMetaFile, dir, err)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func clientOf(m *cacheMeta) string {
+	if m == nil || m.Client == "" {
+		return "unknown"
+	}
+	return m.Client
+}
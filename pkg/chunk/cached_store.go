@@ -23,9 +23,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/compress"
@@ -58,6 +61,10 @@ var (
 		Name: "blockcache_drops",
 		Help: "dropped block",
 	})
+	cacheRejects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "blockcache_rejects",
+		Help: "rejected block by the admission policy",
+	})
 	cacheEvicts = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "blockcache_evicts",
 		Help: "evicted cache blocks",
@@ -98,6 +105,14 @@ var (
 		Name: "object_request_data_bytes",
 		Help: "Object requests size in bytes.",
 	}, []string{"method"})
+	objectUploadRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_upload_retries",
+		Help: "retried uploads after transient failures",
+	})
+	objectUploadAbandoned = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "object_upload_abandoned",
+		Help: "uploads given up after the retry window",
+	})
 )
 
 // chunk for read only
@@ -108,6 +123,7 @@ type rChunk struct {
 }
 
 func chunkForRead(id uint64, length int, store *cachedStore) *rChunk {
+	store.touch()
 	return &rChunk{id, length, store}
 }
 
@@ -176,6 +192,9 @@ func (c *rChunk) ReadAt(ctx context.Context, page *Page, off int) (n int, err er
 	}
 
 	key := c.key(indx)
+	if c.store.tracer != nil {
+		c.store.tracer(key)
+	}
 	if c.store.conf.CacheSize > 0 {
 		start := time.Now()
 		r, err := c.store.bcache.load(key)
@@ -324,6 +343,7 @@ type wChunk struct {
 }
 
 func chunkForWrite(id uint64, store *cachedStore) *wChunk {
+	store.touch()
 	return &wChunk{
 		rChunk: rChunk{id, 0, store},
 		pages:  make([][]*Page, chunkSize/store.conf.BlockSize),
@@ -431,8 +451,10 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 		<-c.store.currentUpload
 	}()
 
+	// the block is kept in buffer until it's uploaded or the retry window is over
+	deadline := time.Now().Add(c.store.conf.UploadRetry)
 	try := 0
-	for try <= 10 && c.uploadError == nil {
+	for c.uploadError == nil {
 		err = c.put(key, buf)
 		if err == nil {
 			c.errors <- nil
@@ -440,12 +462,31 @@ func (c *wChunk) syncUpload(key string, block *Page) {
 		}
 		try++
 		logger.Warnf("upload %s: %s (try %d)", key, err, try)
-		time.Sleep(time.Second * time.Duration(try*try))
+		if !isTransient(err) || !time.Now().Before(deadline) {
+			break
+		}
+		objectUploadRetries.Add(1)
+		backoff := time.Second * time.Duration(try*try)
+		if left := time.Until(deadline); backoff > left {
+			backoff = left
+		}
+		time.Sleep(backoff)
+	}
+	objectUploadAbandoned.Add(1)
+	c.errors <- fmt.Errorf("upload block %s: %w (after %d tries)", key, err, try)
+}
+
+// isTransient returns whether an upload failed with err could succeed by retrying.
+func isTransient(err error) bool {
+	switch utils.ClassOf(err) {
+	case utils.ErrUnknown, utils.ErrNetwork, utils.ErrTimeout:
+		return true
 	}
-	c.errors <- fmt.Errorf("upload block %s: %s (after %d tries)", key, err, try)
+	return false
 }
 
 func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
+	defer atomic.AddInt32(&c.store.uploading, -1)
 	blockSize := len(block.Data)
 	defer c.store.bcache.uploaded(key, blockSize)
 	defer func() {
@@ -514,11 +555,13 @@ func (c *wChunk) asyncUpload(key string, block *Page, stagingPath string) {
 			break
 		}
 		logger.Warnf("upload %s: %s (tried %d)", key, err, try)
+		objectUploadRetries.Add(1)
 		try++
 		time.Sleep(time.Second * time.Duration(try))
 	}
 	buf.Release()
 	_ = os.Remove(stagingPath)
+	c.store.dropReplica(key)
 }
 
 func (c *wChunk) upload(indx int) {
@@ -545,12 +588,22 @@ func (c *wChunk) upload(indx int) {
 		}
 		if c.store.conf.Writeback {
 			stagingPath, err := c.store.bcache.stage(key, block.Data, c.store.shouldCache(blen))
+			if err == nil && c.store.conf.WritebackPeer != "" {
+				if err := c.store.replicate(key, block.Data); err != nil {
+					logger.Warnf("replicate %s to %s: %s, upload it directly", key, c.store.conf.WritebackPeer, err)
+					_ = os.Remove(stagingPath)
+					c.store.bcache.uploaded(key, blen)
+					c.syncUpload(key, block)
+					return
+				}
+			}
 			if err != nil {
 				logger.Warnf("write %s to disk: %s, upload it directly", stagingPath, err)
 				c.syncUpload(key, block)
 			} else {
 				c.errors <- nil
 				if c.store.conf.UploadDelay == 0 {
+					atomic.AddInt32(&c.store.uploading, 1)
 					go c.asyncUpload(key, block, stagingPath)
 				} else {
 					block.Release()
@@ -629,6 +682,7 @@ type Config struct {
 	FreeSpace      float32
 	AutoCreate     bool
 	Compress       string
+	CompressDict   uint32 // ID of the zstd dictionary to compress blocks, 0 means no dictionary
 	MaxUpload      int
 	UploadLimit    int64 // bytes per second
 	DownloadLimit  int64 // bytes per second
@@ -638,13 +692,26 @@ type Config struct {
 	BlockSize      int
 	GetTimeout     time.Duration
 	PutTimeout     time.Duration
+	UploadRetry    time.Duration // window to retry transient upload failures
 	CacheFullBlock bool
+	CacheAdmission string // admission policy of disk cache: none or tinylfu
 	BufferSize     int
 	Readahead      int
 	Prefetch       int
+	IdleShrink     time.Duration // shrink the resources after no IO for this duration, 0 means never
+	WritebackPeer  string        // address of the peer to replicate staged blocks to before acknowledging writes
+	ReplicaListen  string        // address to accept replicas of staged blocks from peers
+	ReplicaSecret  string        // secret shared by the peers to authenticate the replicas
+	ReplicaVolume  string        // UUID of the volume, replicas of other volumes are refused
+	ReplicaTLSCert string        // certificate to accept replicas over TLS
+	ReplicaTLSKey  string        // private key of ReplicaTLSCert
+	ReplicaTLSCA   string        // CA to verify the peer, replicas are sent over TLS if it's set
 }
 
 type cachedStore struct {
+	lastIO        int64      // unix nano
+	idle          int32      // 1 if the resources are shrunk
+	idleMu        sync.Mutex // serializes shrinking and growing the resources
 	storage       object.ObjectStorage
 	bcache        CacheManager
 	fetcher       *prefetcher
@@ -653,10 +720,13 @@ type cachedStore struct {
 	currentUpload chan bool
 	pendingKeys   map[string]time.Time
 	pendingMutex  sync.Mutex
+	uploading     int32 // staged blocks being uploaded by asyncUpload
 	compressor    compress.Compressor
 	seekable      bool
 	upLimit       *ratelimit.Bucket
 	downLimit     *ratelimit.Bucket
+	tracer        func(key string)
+	replicas      replicas
 }
 
 func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bool) (err error) {
@@ -715,14 +785,15 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	objectReqsHistogram.WithLabelValues("GET").Observe(used.Seconds())
 	if err != nil {
 		objectReqErrors.Add(1)
-		return fmt.Errorf("get %s: %s", key, err)
+		return fmt.Errorf("get %s: %w", key, err)
 	}
 	if compressed {
 		n, err = store.compressor.Decompress(page.Data, buf[:n])
 	}
 	if err != nil || n < len(page.Data) {
-		return fmt.Errorf("read %s fully: %s (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
-			used, tried)
+		// the object is broken or shorter than expected
+		return utils.NewError(utils.ErrCorrupt, fmt.Errorf("read %s fully: %v (%d < %d) after %s (tried %d)", key, err, n, len(page.Data),
+			used, tried))
 	}
 	if cache {
 		store.bcache.cache(key, page, forceCache)
@@ -730,18 +801,51 @@ func (store *cachedStore) load(key string, page *Page, cache bool, forceCache bo
 	return nil
 }
 
+// fetch downloads a block into cache, sharing the GET with concurrent readers of the same block.
+func (store *cachedStore) fetch(key string, size int) error {
+	p, err := store.group.Execute(key, func() (*Page, error) {
+		p := NewOffPage(size)
+		return p, store.load(key, p, true, true)
+	})
+	p.Release()
+	return err
+}
+
+// DictKey returns the key of a zstd dictionary in object storage.
+func DictKey(id uint32) string {
+	return fmt.Sprintf("dicts/%d", id)
+}
+
+// LoadDict reads a zstd dictionary from object storage.
+func LoadDict(storage object.ObjectStorage, id uint32) ([]byte, error) {
+	in, err := storage.Get(DictKey(id), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return io.ReadAll(in)
+}
+
 // NewCachedStore create a cached store.
 func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	compressor := compress.NewCompressor(config.Compress)
 	if compressor == nil {
 		logger.Fatalf("unknown compress algorithm: %s", config.Compress)
 	}
+	if _, ok := compressor.(compress.ZStandard); ok {
+		compressor = compress.NewZStandardDict(config.CompressDict, func(id uint32) ([]byte, error) {
+			return LoadDict(storage, id)
+		})
+	}
 	if config.GetTimeout == 0 {
 		config.GetTimeout = time.Second * 60
 	}
 	if config.PutTimeout == 0 {
 		config.PutTimeout = time.Second * 60
 	}
+	if config.UploadRetry == 0 {
+		config.UploadRetry = time.Minute * 5
+	}
 	store := &cachedStore{
 		storage:       storage,
 		conf:          config,
@@ -750,6 +854,7 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 		seekable:      compressor.CompressBound(0) == 0,
 		pendingKeys:   make(map[string]time.Time),
 		group:         &Controller{},
+		replicas:      replicas{sent: make(map[string]bool), received: make(map[string]time.Time)},
 	}
 	if config.UploadLimit > 0 {
 		// there are overheads coming from HTTP/TCP/IP
@@ -767,9 +872,7 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 		if size == 0 || size > store.conf.BlockSize {
 			return
 		}
-		p := NewOffPage(size)
-		defer p.Release()
-		_ = store.load(key, p, true, true)
+		_ = store.fetch(key, size)
 	})
 	_ = prometheus.Register(cacheHits)
 	_ = prometheus.Register(cacheHitBytes)
@@ -778,6 +881,7 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	_ = prometheus.Register(cacheWrites)
 	_ = prometheus.Register(cacheWriteBytes)
 	_ = prometheus.Register(cacheDrops)
+	_ = prometheus.Register(cacheRejects)
 	_ = prometheus.Register(cacheEvicts)
 	_ = prometheus.Register(cacheReadHist)
 	_ = prometheus.Register(cacheWriteHist)
@@ -802,7 +906,16 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	_ = prometheus.Register(objectReqsHistogram)
 	_ = prometheus.Register(objectReqErrors)
 	_ = prometheus.Register(objectDataBytes)
+	_ = prometheus.Register(objectUploadRetries)
+	_ = prometheus.Register(objectUploadAbandoned)
 
+	if store.conf.IdleShrink > 0 {
+		store.touch()
+		go store.shrinkIdle()
+	}
+	if store.conf.ReplicaListen != "" {
+		go store.serveReplicas(store.conf.ReplicaListen)
+	}
 	if store.conf.CacheDir != "memory" && store.conf.Writeback && store.conf.UploadDelay > 0 {
 		logger.Infof("delay uploading by %s", store.conf.UploadDelay)
 		go func() {
@@ -819,10 +932,64 @@ func NewCachedStore(storage object.ObjectStorage, config Config) ChunkStore {
 	return store
 }
 
+// touch records the time of IO, and grows the shrunk resources back.
+func (store *cachedStore) touch() {
+	if store.conf.IdleShrink == 0 {
+		return
+	}
+	atomic.StoreInt64(&store.lastIO, time.Now().UnixNano())
+	if atomic.LoadInt32(&store.idle) == 1 {
+		store.idleMu.Lock()
+		if atomic.CompareAndSwapInt32(&store.idle, 1, 0) {
+			logger.Debugf("Resume from idle")
+			store.bcache.setIdle(false)
+		}
+		store.idleMu.Unlock()
+	}
+}
+
+// shrinkIdle releases the idle connections and buffers, and pauses the scanners of cache
+// once there is no IO for conf.IdleShrink, to reduce the footprint of idle mounts.
+func (store *cachedStore) shrinkIdle() {
+	interval := store.conf.IdleShrink / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	for {
+		time.Sleep(interval)
+		if time.Since(time.Unix(0, atomic.LoadInt64(&store.lastIO))) < store.conf.IdleShrink {
+			continue
+		}
+		store.idleMu.Lock()
+		if !atomic.CompareAndSwapInt32(&store.idle, 0, 1) {
+			store.idleMu.Unlock()
+			continue
+		}
+		// an IO started before idle is set sees it unset, so check again after setting it
+		last := time.Unix(0, atomic.LoadInt64(&store.lastIO))
+		if time.Since(last) < store.conf.IdleShrink {
+			atomic.StoreInt32(&store.idle, 0)
+			store.idleMu.Unlock()
+			continue
+		}
+		store.bcache.setIdle(true)
+		store.idleMu.Unlock()
+		logger.Infof("No IO since %s, shrink idle resources", last.Format(time.RFC3339))
+		object.CloseIdleConnections()
+		debug.FreeOSMemory()
+	}
+}
+
 func (store *cachedStore) shouldCache(size int) bool {
 	return store.conf.CacheFullBlock || size < store.conf.BlockSize || store.conf.UploadDelay > 0
 }
 
+func parseObjChunkid(key string) uint64 {
+	name := key[strings.LastIndexByte(key, '/')+1:]
+	id, _ := strconv.ParseUint(name[:strings.IndexByte(name, '_')], 10, 64)
+	return id
+}
+
 func parseObjOrigSize(key string) int {
 	p := strings.LastIndexByte(key, '_')
 	l, _ := strconv.Atoi(key[p+1:])
@@ -879,6 +1046,7 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 				objectReqErrors.Add(1)
 			}
 			logger.Warnf("upload %s: %s (try %d)", key, err, try)
+			objectUploadRetries.Add(1)
 			try++
 			time.Sleep(time.Second * time.Duration(try*try))
 		}
@@ -887,6 +1055,7 @@ func (store *cachedStore) uploadStagingFile(key string, stagingPath string) {
 		delete(store.pendingKeys, key)
 		store.pendingMutex.Unlock()
 		_ = os.Remove(stagingPath)
+		store.dropReplica(key)
 	}()
 }
 
@@ -903,6 +1072,34 @@ func (store *cachedStore) uploadDelayedStaging() {
 	store.pendingMutex.Unlock()
 }
 
+func (store *cachedStore) FlushStaging(timeout time.Duration) error {
+	if store.conf.UploadDelay > 0 {
+		store.pendingMutex.Lock()
+		keys := make([]string, 0, len(store.pendingKeys))
+		for key := range store.pendingKeys {
+			keys = append(keys, key)
+		}
+		store.pendingMutex.Unlock()
+		for _, key := range keys {
+			store.uploadStagingFile(key, store.bcache.stagePath(key))
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		store.pendingMutex.Lock()
+		n := len(store.pendingKeys)
+		store.pendingMutex.Unlock()
+		n += int(atomic.LoadInt32(&store.uploading))
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d staged blocks are not uploaded in %s", n, timeout)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
 func (store *cachedStore) NewReader(chunkid uint64, length int) Reader {
 	return chunkForRead(chunkid, length, store)
 }
@@ -931,9 +1128,7 @@ func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 			logger.Warnf("Invalid size: %s %d", k, size)
 			continue
 		}
-		p := NewOffPage(size)
-		defer p.Release()
-		if e := store.load(k, p, true, true); e != nil {
+		if e := store.fetch(k, size); e != nil {
 			logger.Warnf("Failed to load key: %s %s", k, e)
 			err = e
 		}
@@ -941,6 +1136,121 @@ func (store *cachedStore) FillCache(chunkid uint64, length uint32) error {
 	return err
 }
 
+// FillBlock builds cache for a block with its key in the object storage.
+func (store *cachedStore) FillBlock(key string) error {
+	store.touch()
+	size := parseObjOrigSize(key)
+	if size == 0 || size > store.conf.BlockSize {
+		return fmt.Errorf("invalid block key: %s", key)
+	}
+	if f, err := store.bcache.load(key); err == nil { // already cached
+		_ = f.Close()
+		return nil
+	}
+	return store.fetch(key, size)
+}
+
+func (store *cachedStore) CachedBlocks() map[string]string {
+	return store.bcache.cachedKeys()
+}
+
+// hotKey is a cached block with the unix time of its last access.
+type hotKey struct {
+	key   string
+	atime int64
+}
+
+func (store *cachedStore) HotBlocks(limit int) []string {
+	hks := store.bcache.hotKeys()
+	sort.Slice(hks, func(i, j int) bool { return hks[i].atime > hks[j].atime })
+	if limit > 0 && len(hks) > limit {
+		hks = hks[:limit]
+	}
+	keys := make([]string, len(hks))
+	for i, hk := range hks {
+		keys[i] = hk.key
+	}
+	return keys
+}
+
+func (store *cachedStore) CachedBlock(key string) ([]byte, error) {
+	size := parseObjOrigSize(key)
+	if size == 0 || size > store.conf.BlockSize {
+		return nil, fmt.Errorf("invalid block key: %s", key)
+	}
+	f, err := store.bcache.load(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	if n, err := f.ReadAt(data, 0); n != size {
+		return nil, fmt.Errorf("read %d bytes of cached block %s: %v", n, key, err)
+	}
+	return data, nil
+}
+
+func (store *cachedStore) LoadBlock(key, path string) error {
+	store.touch()
+	size := parseObjOrigSize(key)
+	if size == 0 || size > store.conf.BlockSize {
+		return fmt.Errorf("invalid block key: %s", key)
+	}
+	if store.bcache.exist(key) {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) != size {
+		return fmt.Errorf("size of %s is %d, but %d expected from key %s", path, len(data), size, key)
+	}
+	p := NewPage(data)
+	store.bcache.cache(key, p, false)
+	p.Release()
+	return nil
+}
+
+func (store *cachedStore) SetTracer(tracer func(key string)) {
+	store.tracer = tracer
+}
+
+func (store *cachedStore) CheckCache(chunkid uint64, length uint32, off, size uint32) uint64 {
+	r := chunkForRead(chunkid, int(length), store)
+	bs := uint32(store.conf.BlockSize)
+	var cached uint64
+	for i, k := range r.keys() {
+		start, end := uint32(i)*bs, uint32(i)*bs+uint32(r.blockSize(i))
+		if start < off {
+			start = off
+		}
+		if end > off+size {
+			end = off + size
+		}
+		if start < end && store.bcache.exist(k) {
+			cached += uint64(end - start)
+		}
+	}
+	return cached
+}
+
+func (store *cachedStore) VerifyBlocks(chunkid uint64, length uint32) map[string]error {
+	r := chunkForRead(chunkid, int(length), store)
+	var failed map[string]error
+	for i, k := range r.keys() {
+		p := NewOffPage(r.blockSize(i))
+		if err := store.load(k, p, false, false); err != nil {
+			if failed == nil {
+				failed = make(map[string]error)
+			}
+			failed[k] = err
+		}
+		p.Release()
+	}
+	return failed
+}
+
 func (store *cachedStore) UsedMemory() int64 {
 	return store.bcache.usedMemory()
 }
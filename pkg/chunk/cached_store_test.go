@@ -20,13 +20,21 @@ package chunk
 import (
 	"bytes"
 	"context"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func forgeChunk(store ChunkStore, chunkid uint64, size int) error {
@@ -201,6 +209,28 @@ func TestStoreDelayed(t *testing.T) {
 	}
 }
 
+func TestFlushStaging(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.Writeback = true
+	conf.UploadDelay = time.Hour
+	store := NewCachedStore(mem, conf)
+	time.Sleep(time.Millisecond * 100) // wait for the scanning of staging blocks
+	if err := forgeChunk(store, 11, 1024); err != nil {
+		t.Fatalf("forge chunk 11 1024: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/11_0_1024"); err == nil {
+		t.Fatalf("object 11_0_1024 should be delayed")
+	}
+	if err := store.FlushStaging(time.Second * 5); err != nil {
+		t.Fatalf("flush staging: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/11_0_1024"); err != nil {
+		t.Fatalf("head object 11_0_1024: %s", err)
+	}
+}
+
 func TestStoreMultiBuckets(t *testing.T) {
 	mem, _ := object.CreateStorage("mem", "", "", "")
 	conf := defaultConf
@@ -243,6 +273,213 @@ func TestFillCache(t *testing.T) {
 	}
 }
 
+type flakyStorage struct {
+	object.ObjectStorage
+	fails int
+	err   error
+}
+
+func (s *flakyStorage) Put(key string, in io.Reader) error {
+	if s.fails > 0 {
+		s.fails--
+		return s.err
+	}
+	return s.ObjectStorage.Put(key, in)
+}
+
+func TestUploadRetry(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	blob := &flakyStorage{ObjectStorage: mem, fails: 1, err: syscall.ECONNRESET}
+	conf := defaultConf
+	conf.CacheSize = 0
+	conf.UploadRetry = time.Second * 3
+	store := NewCachedStore(blob, conf)
+
+	retries := testutil.ToFloat64(objectUploadRetries)
+	abandoned := testutil.ToFloat64(objectUploadAbandoned)
+	if err := forgeChunk(store, 1, 1024); err != nil {
+		t.Fatalf("write with transient failure: %s", err)
+	}
+	if n := testutil.ToFloat64(objectUploadRetries) - retries; n != 1 {
+		t.Fatalf("retries %v != 1", n)
+	}
+
+	blob.fails, blob.err = 10, syscall.EACCES
+	start := time.Now()
+	if err := forgeChunk(store, 2, 1024); err == nil {
+		t.Fatalf("write with permanent failure should fail")
+	} else if time.Since(start) > time.Second {
+		t.Fatalf("permanent failure should not be retried: %s", time.Since(start))
+	}
+
+	blob.fails, blob.err = 10, syscall.ETIMEDOUT
+	start = time.Now()
+	if err := forgeChunk(store, 3, 1024); err == nil {
+		t.Fatalf("write should fail after the retry window")
+	} else if used := time.Since(start); used < conf.UploadRetry || used > conf.UploadRetry+time.Second*2 {
+		t.Fatalf("write failed after %s, retry window %s", used, conf.UploadRetry)
+	}
+	if n := testutil.ToFloat64(objectUploadAbandoned) - abandoned; n != 2 {
+		t.Fatalf("abandoned %v != 2", n)
+	}
+}
+
+type slowStorage struct {
+	object.ObjectStorage
+	gets int32
+}
+
+func (s *slowStorage) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	atomic.AddInt32(&s.gets, 1)
+	time.Sleep(time.Millisecond * 200)
+	return s.ObjectStorage.Get(key, off, limit)
+}
+
+func TestSharedDownload(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	if err := forgeChunk(NewCachedStore(mem, conf), 20, 1024); err != nil {
+		t.Fatalf("forge chunk 20 1024: %s", err)
+	}
+	blob := &slowStorage{ObjectStorage: mem}
+	store := NewCachedStore(blob, conf)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := NewPage(make([]byte, 1024))
+			defer p.Release()
+			if n, err := store.NewReader(20, 1024).ReadAt(context.Background(), p, 0); err != nil || n != 1024 {
+				t.Errorf("read chunk 20: %d %s", n, err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := store.FillCache(20, 1024); err != nil {
+			t.Errorf("fill cache 20 1024: %s", err)
+		}
+	}()
+	wg.Wait()
+	if n := atomic.LoadInt32(&blob.gets); n != 1 {
+		t.Fatalf("concurrent readers of the same block should share one GET, but got %d", n)
+	}
+}
+
+func TestFillBlock(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheSize = 0
+	if err := forgeChunk(NewCachedStore(mem, conf), 21, 1024); err != nil {
+		t.Fatalf("forge chunk 21 1024: %s", err)
+	}
+
+	var traced []string
+	store := NewCachedStore(mem, conf)
+	store.SetTracer(func(key string) { traced = append(traced, key) })
+	p := NewPage(make([]byte, 1024))
+	defer p.Release()
+	if n, err := store.NewReader(21, 1024).ReadAt(context.Background(), p, 0); err != nil || n != 1024 {
+		t.Fatalf("read chunk 21: %d %s", n, err)
+	}
+	if len(traced) != 1 || traced[0] != "chunks/0/0/21_0_1024" {
+		t.Fatalf("traced blocks: %v", traced)
+	}
+
+	dir, err := os.MkdirTemp("", "fillblock")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	conf.CacheDir = dir
+	conf.CacheSize = 10
+	store = NewCachedStore(mem, conf)
+	if err := store.FillBlock(traced[0]); err != nil {
+		t.Fatalf("fill block %s: %s", traced[0], err)
+	}
+	if err := store.FillBlock("chunks/0/0/21_0"); err == nil {
+		t.Fatalf("fill block with invalid key should fail")
+	}
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	if cnt, used := store.(*cachedStore).bcache.stats(); cnt != 1 || used != 1024+4096 {
+		t.Fatalf("cache cnt %d used %d, expect cnt 1 used 5120", cnt, used)
+	}
+}
+
+func TestLoadBlock(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	src, err := os.MkdirTemp("", "loadblock")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(src)
+	conf := defaultConf
+	conf.CacheDir = src
+	conf.CacheSize = 10
+	store := NewCachedStore(mem, conf)
+	if err := forgeChunk(store, 22, 1024); err != nil {
+		t.Fatalf("forge chunk 22 1024: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	cached := store.CachedBlocks()
+	path, ok := cached["chunks/0/0/22_0_1024"]
+	if len(cached) != 1 || !ok || path == "" {
+		t.Fatalf("cached blocks: %v", cached)
+	}
+
+	dst, err := os.MkdirTemp("", "loadblock")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dst)
+	conf.CacheDir = dst
+	store = NewCachedStore(mem, conf)
+	if err := store.LoadBlock("chunks/0/0/22_0_1024", path); err != nil {
+		t.Fatalf("load block: %s", err)
+	}
+	if err := store.LoadBlock("chunks/0/0/22_0_2048", path); err == nil {
+		t.Fatalf("load block with wrong size should fail")
+	}
+	if err := store.LoadBlock("chunks/0/0/22_0", path); err == nil {
+		t.Fatalf("load block with invalid key should fail")
+	}
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	if cached := store.CachedBlocks(); len(cached) != 1 || cached["chunks/0/0/22_0_1024"] == "" {
+		t.Fatalf("cached blocks after loading: %v", cached)
+	}
+}
+
+func TestHotBlocks(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = t.TempDir()
+	conf.CacheSize = 10
+	store := NewCachedStore(mem, conf)
+	if err := forgeChunk(store, 22, 1024); err != nil {
+		t.Fatalf("forge chunk 22 1024: %s", err)
+	}
+	if err := forgeChunk(store, 23, 2048); err != nil {
+		t.Fatalf("forge chunk 23 2048: %s", err)
+	}
+	time.Sleep(time.Millisecond * 100) // waiting for flush
+	if keys := store.HotBlocks(0); len(keys) != 2 {
+		t.Fatalf("hot blocks: %v", keys)
+	}
+	if keys := store.HotBlocks(1); len(keys) != 1 {
+		t.Fatalf("hottest block: %v", keys)
+	}
+	if data, err := store.CachedBlock("chunks/0/0/23_0_2048"); err != nil || len(data) != 2048 {
+		t.Fatalf("cached block: %d %s", len(data), err)
+	}
+	if _, err := store.CachedBlock("chunks/0/0/24_0_1024"); err == nil {
+		t.Fatalf("block not cached should fail")
+	}
+}
+
 func BenchmarkCachedRead(b *testing.B) {
 	blob, _ := object.CreateStorage("mem", "", "", "")
 	config := defaultConf
@@ -288,3 +525,162 @@ func BenchmarkUncachedRead(b *testing.B) {
 		}
 	}
 }
+
+func TestIdleShrink(t *testing.T) {
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf := defaultConf
+	conf.CacheDir = filepath.Join(t.TempDir(), "diskCache")
+	conf.IdleShrink = time.Millisecond * 200
+	store := NewCachedStore(mem, conf).(*cachedStore)
+	idle := func() bool {
+		cs := store.bcache.(*cacheManager).stores[0]
+		return atomic.LoadInt32(&store.idle) == 1 && atomic.LoadInt32(&cs.idle) == 1
+	}
+	if err := forgeChunk(store, 1, 1024); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	if idle() {
+		t.Fatalf("should not be idle after write")
+	}
+	time.Sleep(time.Millisecond * 500)
+	if !idle() {
+		t.Fatalf("should be idle after no IO for %s", conf.IdleShrink)
+	}
+	p := NewPage(make([]byte, 1024))
+	if _, err := store.NewReader(1, 1024).ReadAt(context.Background(), p, 0); err != nil {
+		t.Fatalf("read after idle: %s", err)
+	}
+	if atomic.LoadInt32(&store.idle) == 1 || atomic.LoadInt32(&store.bcache.(*cacheManager).stores[0].idle) == 1 {
+		t.Fatalf("should resume after read")
+	}
+
+	// IO around the time of shrinking never leaves the cache paused
+	cs := store.bcache.(*cacheManager).stores[0]
+	for i := 0; i < 10; i++ {
+		time.Sleep(conf.IdleShrink + time.Duration(i)*conf.IdleShrink/50)
+		store.touch()
+		if atomic.LoadInt32(&store.idle) == 0 && atomic.LoadInt32(&cs.idle) == 1 {
+			t.Fatalf("cache is paused after resumed")
+		}
+	}
+}
+
+func TestWritebackReplica(t *testing.T) {
+	conf := defaultConf
+	conf.Writeback = true
+	conf.ReplicaSecret = "secret"
+	conf.ReplicaVolume = "uuid"
+	conf.CacheDir = filepath.Join(t.TempDir(), "peer")
+	peerStorage, _ := object.CreateStorage("mem", "", "", "")
+	peer := NewCachedStore(peerStorage, conf).(*cachedStore)
+	srv := httptest.NewServer(http.HandlerFunc(peer.handleReplica))
+	defer srv.Close()
+
+	mem, _ := object.CreateStorage("mem", "", "", "")
+	conf.CacheDir = filepath.Join(t.TempDir(), "diskCache")
+	conf.UploadDelay = time.Hour
+	conf.WritebackPeer = srv.Listener.Addr().String()
+	store := NewCachedStore(mem, conf).(*cachedStore)
+	time.Sleep(time.Millisecond * 100) // wait for the scanning of staging blocks
+	if err := forgeChunk(store, 1, 1024); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	key := "chunks/0/0/1_0_1024"
+	if _, err := os.Stat(peer.bcache.replicaPath(key)); err != nil {
+		t.Fatalf("replica of %s should be kept by peer: %s", key, err)
+	}
+	if _, ok := peer.bcache.scanReplicas()[key]; !ok {
+		t.Fatalf("replica of %s should be found after restarted", key)
+	}
+	store.uploadStagingFile(key, store.bcache.stagePath(key))
+	for i := 0; i < 30; i++ {
+		if _, err := os.Stat(peer.bcache.replicaPath(key)); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if _, err := os.Stat(peer.bcache.replicaPath(key)); !os.IsNotExist(err) {
+		t.Fatalf("replica of %s should be dropped after uploaded: %v", key, err)
+	}
+	if _, err := mem.Head(key); err != nil {
+		t.Fatalf("head %s: %s", key, err)
+	}
+
+	// peers of other volumes or with a different secret are refused
+	for _, c := range []Config{{ReplicaSecret: "other", ReplicaVolume: "uuid"}, {ReplicaSecret: "secret", ReplicaVolume: "other"}} {
+		c.WritebackPeer = conf.WritebackPeer
+		other := &cachedStore{conf: c, replicas: replicas{sent: make(map[string]bool)}}
+		if err := other.replicate("chunks/0/0/3_0_4", []byte("data")); err == nil {
+			t.Fatalf("replica with secret %s of volume %s should be refused", c.ReplicaSecret, c.ReplicaVolume)
+		}
+	}
+
+	// the peer uploads the replicas of used slices, without overwriting existing objects
+	for _, id := range []uint64{4, 5, 6} {
+		if err := store.replicate(fmt.Sprintf("chunks/0/0/%d_0_4", id), []byte("data")); err != nil {
+			t.Fatalf("replicate %d: %s", id, err)
+		}
+	}
+	_ = peerStorage.Put("chunks/0/0/6_0_4", bytes.NewReader([]byte("old")))
+	peer.uploadReplicas([]string{"chunks/0/0/4_0_4"})
+	if _, err := peerStorage.Head("chunks/0/0/4_0_4"); err == nil {
+		t.Fatalf("replica should not be uploaded without checking the slices")
+	}
+	peer.SetSliceChecker(func(ids []uint64) (map[uint64]bool, error) {
+		return map[uint64]bool{5: true, 6: true}, nil
+	})
+	peer.uploadReplicas([]string{"chunks/0/0/4_0_4", "chunks/0/0/5_0_4", "chunks/0/0/6_0_4"})
+	if _, err := peerStorage.Head("chunks/0/0/4_0_4"); err == nil {
+		t.Fatalf("replica of unused slice should not be uploaded")
+	}
+	if _, err := peerStorage.Head("chunks/0/0/5_0_4"); err != nil {
+		t.Fatalf("replica of used slice should be uploaded: %s", err)
+	}
+	if r, err := peerStorage.Get("chunks/0/0/6_0_4", 0, -1); err != nil {
+		t.Fatalf("get chunks/0/0/6_0_4: %s", err)
+	} else if data, _ := io.ReadAll(r); string(data) != "old" {
+		t.Fatalf("existing object should not be overwritten: %q", data)
+	}
+	if keys := peer.bcache.scanReplicas(); len(keys) != 0 {
+		t.Fatalf("replicas should be removed after handled: %v", keys)
+	}
+
+	srv.Close()
+	if err := forgeChunk(store, 2, 1024); err != nil {
+		t.Fatalf("write without peer: %s", err)
+	}
+	if _, err := mem.Head("chunks/0/0/2_0_1024"); err != nil {
+		t.Fatalf("block should be uploaded directly when peer is down: %s", err)
+	}
+}
+
+func TestReplicaTLS(t *testing.T) {
+	conf := defaultConf
+	conf.ReplicaSecret = "secret"
+	conf.ReplicaVolume = "uuid"
+	conf.CacheDir = filepath.Join(t.TempDir(), "peer")
+	peerStorage, _ := object.CreateStorage("mem", "", "", "")
+	peer := NewCachedStore(peerStorage, conf).(*cachedStore)
+	srv := httptest.NewTLSServer(http.HandlerFunc(peer.handleReplica))
+	defer srv.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatalf("write CA: %s", err)
+	}
+	conf.WritebackPeer = srv.Listener.Addr().String()
+	key := "chunks/0/0/1_0_4"
+	for _, c := range []struct {
+		ca string
+		ok bool
+	}{{"", false}, {filepath.Join(t.TempDir(), "none"), false}, {ca, true}} {
+		conf.ReplicaTLSCA = c.ca
+		store := &cachedStore{conf: conf, replicas: replicas{sent: make(map[string]bool)}}
+		if err := store.replicate(key, []byte("data")); (err == nil) != c.ok {
+			t.Fatalf("replicate with CA %q: %v", c.ca, err)
+		}
+	}
+	if _, err := os.Stat(peer.bcache.replicaPath(key)); err != nil {
+		t.Fatalf("replica of %s should be kept by peer: %s", key, err)
+	}
+}
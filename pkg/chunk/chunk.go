@@ -19,6 +19,7 @@ package chunk
 import (
 	"context"
 	"io"
+	"time"
 )
 
 type Reader interface {
@@ -39,5 +40,26 @@ type ChunkStore interface {
 	NewWriter(chunkid uint64) Writer
 	Remove(chunkid uint64, length int) error
 	FillCache(chunkid uint64, length uint32) error
+	FillBlock(key string) error
+	// CachedBlocks returns the keys of cached blocks with the paths of their files ("" for the ones in memory).
+	CachedBlocks() map[string]string
+	// LoadBlock builds cache for a block from a local file, which could be exported from the cache of another client.
+	LoadBlock(key, path string) error
+	// HotBlocks returns the keys of at most limit (0 for all) cached blocks, the most recently used first.
+	HotBlocks(limit int) []string
+	// CachedBlock returns the data of a block in cache, or an error if it's not cached.
+	CachedBlock(key string) ([]byte, error)
+	// CheckCache returns the number of bytes in [off, off+size) of a chunk cached locally.
+	CheckCache(chunkid uint64, length uint32, off, size uint32) uint64
+	// VerifyBlocks downloads the blocks of a chunk from the object storage bypassing the cache, and
+	// returns the errors of the ones which are missing or corrupted by their keys.
+	VerifyBlocks(chunkid uint64, length uint32) map[string]error
+	// SetTracer sets a function to be called with the key of every block read.
+	SetTracer(tracer func(key string))
+	// SetSliceChecker sets a function to find out which of the slices are still used by files.
+	SetSliceChecker(check func(ids []uint64) (map[uint64]bool, error))
 	UsedMemory() int64
+	// FlushStaging uploads the blocks staged by writeback without waiting for UploadDelay, and waits
+	// up to timeout until all the staged blocks are uploaded.
+	FlushStaging(timeout time.Duration) error
 }
@@ -63,6 +63,8 @@ type cacheStore struct {
 	scanned  bool
 	full     bool
 	uploader func(key, path string)
+	sketch   *tinyLFU // admission policy, nil means admitting all
+	idle     int32    // 1 if the client is idle
 }
 
 func newCacheStore(dir string, cacheSize int64, pendingPages int, config *Config, uploader func(key, path string)) *cacheStore {
@@ -82,7 +84,11 @@ func newCacheStore(dir string, cacheSize int64, pendingPages int, config *Config
 		pages:     make(map[string]*Page),
 		uploader:  uploader,
 	}
+	if config.CacheAdmission == "tinylfu" && config.BlockSize > 0 {
+		c.sketch = newTinyLFU(int(cacheSize / int64(config.BlockSize)))
+	}
 	c.createDir(c.dir)
+	checkCacheVersion(c.dir, c.mode)
 	br, fr := c.curFreeRatio()
 	if br < c.freeRatio || fr < c.freeRatio {
 		logger.Warnf("not enough space (%d%%) or inodes (%d%%) for caching in %s: free ratio should be >= %d%%", int(br*100), int(fr*100), c.dir, int(c.freeRatio*100))
@@ -107,6 +113,10 @@ func (cache *cacheStore) stats() (int64, int64) {
 
 func (cache *cacheStore) checkFreeSpace() {
 	for {
+		if atomic.LoadInt32(&cache.idle) == 1 { // nothing is written into cache
+			time.Sleep(time.Second)
+			continue
+		}
 		br, fr := cache.curFreeRatio()
 		cache.full = br < cache.freeRatio/2 || fr < cache.freeRatio/2
 		if br < cache.freeRatio || fr < cache.freeRatio {
@@ -126,7 +136,9 @@ func (cache *cacheStore) checkFreeSpace() {
 
 func (cache *cacheStore) refreshCacheKeys() {
 	for {
-		cache.scanCached()
+		if atomic.LoadInt32(&cache.idle) == 0 {
+			cache.scanCached()
+		}
 		time.Sleep(time.Minute * 5)
 	}
 }
@@ -140,6 +152,11 @@ func (cache *cacheStore) cache(key string, p *Page, force bool) {
 	if _, ok := cache.pages[key]; ok {
 		return
 	}
+	if !force && !cache.admit(key, len(p.Data)) {
+		logger.Debugf("Cache is full (%s), reject %s (%d bytes)", cache.dir, key, len(p.Data))
+		cacheRejects.Add(1)
+		return
+	}
 	p.Acquire()
 	cache.pages[key] = p
 	atomic.AddInt64(&cache.totalPages, int64(cap(p.Data)))
@@ -161,6 +178,36 @@ func (cache *cacheStore) cache(key string, p *Page, force bool) {
 	}
 }
 
+// admit decides whether a new block should replace an older one when the cache is full,
+// so one-off scans of a huge dataset will not evict the blocks accessed frequently.
+func (cache *cacheStore) admit(key string, size int) bool {
+	if cache.sketch == nil || cache.used+int64(size+4096) <= cache.capacity {
+		return true
+	}
+	freq := cache.sketch.estimate(key)
+	if freq == 0 {
+		return true // written by this client, never read
+	}
+	// the older one of two random keys, same as cleanup
+	var victim string
+	var value cacheItem
+	var cnt int
+	for k, v := range cache.keys {
+		if v.size < 0 {
+			continue // staging
+		}
+		if cnt == 0 || value.atime > v.atime {
+			victim = k
+			value = v
+		}
+		cnt++
+		if cnt > 1 {
+			break
+		}
+	}
+	return cnt == 0 || freq > cache.sketch.estimate(victim)
+}
+
 func (cache *cacheStore) curFreeRatio() (float32, float32) {
 	total, free, files, ffree := getDiskUsage(cache.dir)
 	return float32(free) / float32(total), float32(ffree) / float32(files)
@@ -239,6 +286,11 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 	if p, ok := cache.pages[key]; ok {
 		return NewPageReader(p), nil
 	}
+	now := uint32(time.Now().Unix())
+	if cache.sketch != nil && cache.keys[key].atime != now {
+		// sequential reads of a block within one second count as one access
+		cache.sketch.increment(key)
+	}
 	if cache.scanned && cache.keys[key].atime == 0 {
 		return nil, errors.New("not cached")
 	}
@@ -248,12 +300,50 @@ func (cache *cacheStore) load(key string) (ReadCloser, error) {
 	if err == nil {
 		if it, ok := cache.keys[key]; ok {
 			// update atime
-			cache.keys[key] = cacheItem{it.size, uint32(time.Now().Unix())}
+			cache.keys[key] = cacheItem{it.size, now}
 		}
 	}
 	return f, err
 }
 
+// exist checks whether the block is cached, without counting it as an access.
+func (cache *cacheStore) exist(key string) bool {
+	cache.Lock()
+	_, pending := cache.pages[key]
+	cached := cache.keys[key].atime > 0
+	scanned := cache.scanned
+	cache.Unlock()
+	if pending || cached {
+		return true
+	} else if scanned {
+		return false
+	}
+	_, err := os.Stat(cache.cachePath(key))
+	return err == nil
+}
+
+func (cache *cacheStore) cachedKeys() map[string]string {
+	cache.Lock()
+	defer cache.Unlock()
+	keys := make(map[string]string, len(cache.keys))
+	for key := range cache.keys {
+		keys[key] = cache.cachePath(key)
+	}
+	return keys
+}
+
+func (cache *cacheStore) hotKeys() []hotKey {
+	cache.Lock()
+	defer cache.Unlock()
+	keys := make([]hotKey, 0, len(cache.keys))
+	for key, it := range cache.keys {
+		if it.atime > 0 {
+			keys = append(keys, hotKey{key, int64(it.atime)})
+		}
+	}
+	return keys
+}
+
 func (cache *cacheStore) cachePath(key string) string {
 	return filepath.Join(cache.dir, cacheDir, key)
 }
@@ -262,6 +352,10 @@ func (cache *cacheStore) stagePath(key string) string {
 	return filepath.Join(cache.dir, stagingDir, key)
 }
 
+func (cache *cacheStore) replicaPath(key string) string {
+	return filepath.Join(cache.dir, replicaDir, key)
+}
+
 // flush cached block into disk
 func (cache *cacheStore) flush() {
 	for {
@@ -520,6 +614,28 @@ func (cache *cacheStore) scanStaging() {
 	}
 }
 
+// scanReplicas returns the keys of replicas received from peers with their paths.
+func (cache *cacheStore) scanReplicas() map[string]string {
+	keys := make(map[string]string)
+	prefix := filepath.Join(cache.dir, replicaDir)
+	_ = filepath.Walk(prefix, func(path string, fi os.FileInfo, err error) error {
+		if fi == nil || fi.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			_ = os.Remove(path)
+			return nil
+		}
+		key := path[len(prefix)+1:]
+		if runtime.GOOS == "windows" {
+			key = strings.ReplaceAll(key, "\\", "/")
+		}
+		keys[key] = path
+		return nil
+	})
+	return keys
+}
+
 type cacheManager struct {
 	stores []*cacheStore
 }
@@ -576,8 +692,19 @@ type CacheManager interface {
 	uploaded(key string, size int)
 	stage(key string, data []byte, keepCache bool) (string, error)
 	stagePath(key string) string
+	// replicaPath returns the path to keep the replica of a block staged by a peer, "" if not supported.
+	replicaPath(key string) string
+	// scanReplicas returns the keys of replicas received from peers with their paths.
+	scanReplicas() map[string]string
+	exist(key string) bool
+	// cachedKeys returns the keys of cached blocks with the paths of their files ("" for the ones in memory).
+	cachedKeys() map[string]string
+	// hotKeys returns the keys of cached blocks with their last access time.
+	hotKeys() []hotKey
 	stats() (int64, int64)
 	usedMemory() int64
+	// setIdle pauses the background scanners while the client is idle.
+	setIdle(idle bool)
 }
 
 func newCacheManager(config *Config, uploader func(key, path string)) CacheManager {
@@ -601,6 +728,11 @@ func newCacheManager(config *Config, uploader func(key, path string)) CacheManag
 		logger.Warnf("No cache dir existed")
 		return newMemStore(config)
 	}
+	switch config.CacheAdmission {
+	case "", "none", "tinylfu":
+	default:
+		logger.Warnf("Unknown cache admission policy %q, admit all blocks", config.CacheAdmission)
+	}
 	sort.Strings(dirs)
 	dirCacheSize := config.CacheSize << 20
 	dirCacheSize /= int64(len(dirs))
@@ -619,6 +751,16 @@ func (m *cacheManager) getStore(key string) *cacheStore {
 	return m.stores[keyHash(key)%uint32(len(m.stores))]
 }
 
+func (m *cacheManager) setIdle(idle bool) {
+	var v int32
+	if idle {
+		v = 1
+	}
+	for _, s := range m.stores {
+		atomic.StoreInt32(&s.idle, v)
+	}
+}
+
 func (m *cacheManager) usedMemory() int64 {
 	var used int64
 	for _, s := range m.stores {
@@ -663,6 +805,42 @@ func (m *cacheManager) stagePath(key string) string {
 	return m.getStore(key).stagePath(key)
 }
 
+func (m *cacheManager) replicaPath(key string) string {
+	return m.getStore(key).replicaPath(key)
+}
+
+func (m *cacheManager) scanReplicas() map[string]string {
+	keys := make(map[string]string)
+	for _, s := range m.stores {
+		for k, p := range s.scanReplicas() {
+			keys[k] = p
+		}
+	}
+	return keys
+}
+
+func (m *cacheManager) exist(key string) bool {
+	return m.getStore(key).exist(key)
+}
+
+func (m *cacheManager) cachedKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, s := range m.stores {
+		for k, p := range s.cachedKeys() {
+			keys[k] = p
+		}
+	}
+	return keys
+}
+
+func (m *cacheManager) hotKeys() []hotKey {
+	var keys []hotKey
+	for _, s := range m.stores {
+		keys = append(keys, s.hotKeys()...)
+	}
+	return keys
+}
+
 func (m *cacheManager) uploaded(key string, size int) {
 	m.getStore(key).uploaded(key, size)
 }
@@ -51,6 +51,78 @@ func TestExpand(t *testing.T) {
 	}
 }
 
+func TestCacheAdmission(t *testing.T) {
+	conf := defaultConf
+	conf.BlockSize = 1024
+	conf.CacheAdmission = "tinylfu"
+	dir, err := os.MkdirTemp("", "admission")
+	if err != nil {
+		t.Fatalf("create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir) // blocks are flushed in background
+	s := newCacheStore(dir, 3*(1024+4096), 10, &conf, nil)
+	hot := []string{"chunks/0/0/1_0_1024", "chunks/0/0/2_0_1024", "chunks/0/0/3_0_1024"}
+	for _, k := range hot {
+		s.cache(k, NewPage(make([]byte, 1024)), false)
+		for i := 0; i < 5; i++ {
+			s.sketch.increment(k)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	cached := func(key string) bool {
+		s.Lock()
+		defer s.Unlock()
+		_, ok := s.pages[key]
+		return ok || s.keys[key].atime > 0
+	}
+	for _, k := range hot {
+		if !cached(k) {
+			t.Fatalf("%s should be cached", k)
+		}
+	}
+
+	scan := "chunks/0/0/4_0_1024"
+	if _, err := s.load(scan); err == nil {
+		t.Fatalf("%s should not be cached", scan)
+	}
+	s.cache(scan, NewPage(make([]byte, 1024)), false)
+	if cached(scan) {
+		t.Fatalf("one-off block %s should be rejected", scan)
+	}
+	s.cache(scan, NewPage(make([]byte, 1024)), true)
+	if !cached(scan) {
+		t.Fatalf("forced block %s should be cached", scan)
+	}
+
+	popular := "chunks/0/0/5_0_1024"
+	for i := 0; i < 10; i++ {
+		s.sketch.increment(popular)
+	}
+	s.cache(popular, NewPage(make([]byte, 1024)), false)
+	if !cached(popular) {
+		t.Fatalf("popular block %s should be cached", popular)
+	}
+}
+
+func TestTinyLFU(t *testing.T) {
+	s := newTinyLFU(0)
+	for i := 0; i < 20; i++ {
+		s.increment("a")
+	}
+	if n := s.estimate("a"); n != 15 {
+		t.Fatalf("expect 15 but got %d", n)
+	}
+	if n := s.estimate("b"); n != 0 {
+		t.Fatalf("expect 0 but got %d", n)
+	}
+	for i := 0; i < 10*1024; i++ {
+		s.increment("c")
+	}
+	if n := s.estimate("a"); n >= 15 {
+		t.Fatalf("counter should be halved, but got %d", n)
+	}
+}
+
 func BenchmarkLoadCached(b *testing.B) {
 	dir := b.TempDir()
 	s := newCacheStore(filepath.Join(dir, "diskCache"), 1<<30, 1, &defaultConf, nil)
@@ -79,3 +151,39 @@ func BenchmarkLoadUncached(b *testing.B) {
 		}
 	}
 }
+
+func TestCacheVersion(t *testing.T) {
+	dir := t.TempDir()
+	block := filepath.Join(dir, cacheDir, "chunks", "0", "0", "1_0_4")
+	staged := filepath.Join(dir, stagingDir, "chunks", "0", "0", "2_0_4")
+	for _, p := range []string{block, staged} {
+		_ = os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte("test"), 0600); err != nil {
+			t.Fatalf("write %s: %s", p, err)
+		}
+	}
+
+	// created by an old client without version
+	checkCacheVersion(dir, 0600)
+	if m, err := readCacheMeta(dir); err != nil || m.Version != cacheVersion {
+		t.Fatalf("cache meta: %+v %s", m, err)
+	}
+	if _, err := os.Stat(block); err != nil {
+		t.Fatalf("cached block should be kept: %s", err)
+	}
+
+	// written by a newer client
+	if err := os.WriteFile(filepath.Join(dir, cacheMetaFile), []byte(`{"Version": 100}`), 0600); err != nil {
+		t.Fatalf("write cache meta: %s", err)
+	}
+	checkCacheVersion(dir, 0600)
+	if m, err := readCacheMeta(dir); err != nil || m.Version != cacheVersion {
+		t.Fatalf("cache meta: %+v %s", m, err)
+	}
+	if _, err := os.Stat(block); !os.IsNotExist(err) {
+		t.Fatalf("cached block should be evicted: %s", err)
+	}
+	if _, err := os.Stat(staged); err != nil {
+		t.Fatalf("staging block should be kept: %s", err)
+	}
+}
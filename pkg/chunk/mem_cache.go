@@ -49,6 +49,8 @@ func newMemStore(config *Config) *memcache {
 	return c
 }
 
+func (c *memcache) setIdle(idle bool) {}
+
 func (c *memcache) usedMemory() int64 {
 	c.Lock()
 	defer c.Unlock()
@@ -137,3 +139,34 @@ func (c *memcache) stage(key string, data []byte, keepCache bool) (string, error
 }
 func (c *memcache) uploaded(key string, size int) {}
 func (c *memcache) stagePath(key string) string   { return "" }
+func (c *memcache) replicaPath(key string) string { return "" }
+func (c *memcache) scanReplicas() map[string]string {
+	return nil
+}
+
+func (c *memcache) cachedKeys() map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	keys := make(map[string]string, len(c.pages))
+	for key := range c.pages {
+		keys[key] = ""
+	}
+	return keys
+}
+
+func (c *memcache) hotKeys() []hotKey {
+	c.Lock()
+	defer c.Unlock()
+	keys := make([]hotKey, 0, len(c.pages))
+	for key, it := range c.pages {
+		keys = append(keys, hotKey{key, it.atime.Unix()})
+	}
+	return keys
+}
+
+func (c *memcache) exist(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.pages[key]
+	return ok
+}
@@ -0,0 +1,346 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package chunk
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a replica is uploaded by the peer itself if the owner doesn't confirm the upload in this duration
+	// (plus the upload delay)
+	replicaGrace = time.Minute * 10
+	// max difference of clocks between peers, older requests are refused
+	replicaSkew = time.Minute * 5
+	replicaDir  = "replicas"
+)
+
+var replicaKey = regexp.MustCompile(`^chunks/[0-9A-F]+/\d+/\d+_\d+_\d+$`)
+
+// replicas tracks the staged blocks replicated to the peer, and the ones received from peers.
+type replicas struct {
+	sync.Mutex
+	sent     map[string]bool
+	received map[string]time.Time
+	// client sends the replicas to the peer, over TLS if a CA is given to verify it
+	client    *http.Client
+	scheme    string
+	clientErr error
+	// checkSlices is called with the ids of the slices before their replicas are uploaded, and
+	// returns the ones still used by files.
+	checkSlices func(ids []uint64) (map[uint64]bool, error)
+}
+
+// SetSliceChecker sets the function to find out which slices are still used, the replicas received
+// from peers are uploaded only if it's set and the slice is used.
+func (store *cachedStore) SetSliceChecker(check func(ids []uint64) (map[uint64]bool, error)) {
+	store.replicas.Lock()
+	store.replicas.checkSlices = check
+	store.replicas.Unlock()
+}
+
+// signReplica authenticates a request to the peer with the shared secret, it covers the volume,
+// so replicas of other volumes are refused.
+func (store *cachedStore) signReplica(method, key, date string, data []byte) string {
+	h := hmac.New(sha256.New, []byte(store.conf.ReplicaSecret))
+	_, _ = fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", method, key, store.conf.ReplicaVolume, date)
+	_, _ = h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replicaClient returns the client to talk with the peer, it's created at the first call.
+func (store *cachedStore) replicaClient() (*http.Client, string, error) {
+	store.replicas.Lock()
+	defer store.replicas.Unlock()
+	r := &store.replicas
+	if r.client == nil && r.clientErr == nil {
+		r.client, r.scheme = &http.Client{Timeout: time.Second * 10}, "http"
+		if ca := store.conf.ReplicaTLSCA; ca != "" {
+			pem, err := os.ReadFile(ca)
+			if err != nil {
+				r.clientErr = fmt.Errorf("read CA %s: %s", ca, err)
+			} else if pool := x509.NewCertPool(); !pool.AppendCertsFromPEM(pem) {
+				r.clientErr = fmt.Errorf("no certificate found in CA %s", ca)
+			} else {
+				r.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+				r.scheme = "https"
+			}
+			if r.clientErr != nil {
+				logger.Errorf("Replicate to %s: %s", store.conf.WritebackPeer, r.clientErr)
+			}
+		}
+	}
+	return r.client, r.scheme, r.clientErr
+}
+
+func (store *cachedStore) replicaRequest(method, key string, data []byte) (*http.Client, *http.Request, error) {
+	client, scheme, err := store.replicaClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(method, scheme+"://"+store.conf.WritebackPeer+"/replica/"+key, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	date := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-JuiceFS-Date", date)
+	req.Header.Set("Authorization", "JuiceFS "+store.signReplica(method, key, date, data))
+	return client, req, nil
+}
+
+// replicate sends a staged block to the peer, so it survives the failure of this node before uploaded.
+func (store *cachedStore) replicate(key string, data []byte) error {
+	if store.conf.ReplicaSecret == "" {
+		return errors.New("no secret to authenticate with the peer")
+	}
+	client, req, err := store.replicaRequest(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	store.replicas.Lock()
+	store.replicas.sent[key] = true
+	store.replicas.Unlock()
+	return nil
+}
+
+// dropReplica tells the peer that the block is uploaded, so the replica is not needed any more.
+func (store *cachedStore) dropReplica(key string) {
+	if store.conf.WritebackPeer == "" {
+		return
+	}
+	store.replicas.Lock()
+	sent := store.replicas.sent[key]
+	delete(store.replicas.sent, key)
+	store.replicas.Unlock()
+	if !sent {
+		return
+	}
+	client, req, err := store.replicaRequest(http.MethodDelete, key, nil)
+	var resp *http.Response
+	if err == nil {
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		// the peer will find the object existed after the grace period, which is harmless
+		logger.Warnf("drop replica of %s from %s: %s", key, store.conf.WritebackPeer, err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// verifyReplica checks the signature of a request from the peer.
+func (store *cachedStore) verifyReplica(r *http.Request, key string, data []byte) error {
+	date := r.Header.Get("X-JuiceFS-Date")
+	ts, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return errors.New("invalid date")
+	}
+	if d := time.Since(time.Unix(ts, 0)); math.Abs(float64(d)) > float64(replicaSkew) {
+		return errors.New("request expired")
+	}
+	sig := strings.TrimPrefix(r.Header.Get("Authorization"), "JuiceFS ")
+	if !hmac.Equal([]byte(sig), []byte(store.signReplica(r.Method, key, date, data))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// handleReplica receives the replicas of staged blocks from peers, and removes them after uploaded by the peer.
+func (store *cachedStore) handleReplica(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[len("/replica/"):]
+	size := parseObjOrigSize(key)
+	if !replicaKey.MatchString(key) || size <= 0 || size > store.conf.BlockSize {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	path := store.bcache.replicaPath(key)
+	if path == "" {
+		http.Error(w, "no cache directory", http.StatusInsufficientStorage)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r.Body, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := store.verifyReplica(r, key, data); err != nil {
+			logger.Warnf("refuse replica of %s from %s: %s", key, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err := writeReplica(path, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		store.replicas.Lock()
+		store.replicas.received[key] = time.Now()
+		store.replicas.Unlock()
+		logger.Debugf("received replica of %s from %s", key, r.RemoteAddr)
+	case http.MethodDelete:
+		if err := store.verifyReplica(r, key, nil); err != nil {
+			logger.Warnf("refuse to drop replica of %s from %s: %s", key, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		store.replicas.Lock()
+		delete(store.replicas.received, key)
+		store.replicas.Unlock()
+		_ = os.Remove(path)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeReplica(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// uploadReplicas uploads the replicas not confirmed by the peer in time. Only the ones of slices still
+// used by files are uploaded, and existing objects are never overwritten.
+func (store *cachedStore) uploadReplicas(keys []string) {
+	store.replicas.Lock()
+	check := store.replicas.checkSlices
+	store.replicas.Unlock()
+	if check == nil {
+		logger.Warnf("Can't check the slices of %d replicas, keep them", len(keys))
+		return
+	}
+	var ids []uint64
+	for _, key := range keys {
+		ids = append(ids, parseObjChunkid(key))
+	}
+	used, err := check(ids)
+	if err != nil {
+		logger.Warnf("Check the slices of %d replicas: %s, try again later", len(keys), err)
+		return
+	}
+	for _, key := range keys {
+		path := store.bcache.replicaPath(key)
+		if !used[parseObjChunkid(key)] {
+			logger.Infof("Slice of replica %s is not used any more, drop it", key)
+		} else if _, err := store.storage.Head(key); err == nil {
+			logger.Debugf("Replica of %s is uploaded by the peer, drop it", key)
+		} else if err = store.uploadReplica(key, path); err != nil {
+			logger.Warnf("Upload replica of %s: %s, try again later", key, err)
+			continue
+		} else {
+			logger.Infof("Replica of %s is not confirmed by the peer, uploaded", key)
+		}
+		store.replicas.Lock()
+		delete(store.replicas.received, key)
+		store.replicas.Unlock()
+		_ = os.Remove(path)
+	}
+}
+
+func (store *cachedStore) uploadReplica(key, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	buf := NewOffPage(store.compressor.CompressBound(len(data)))
+	defer buf.Release()
+	n, err := store.compressor.Compress(buf.Data, data)
+	if err != nil {
+		return err
+	}
+	return store.storage.Put(key, bytes.NewReader(buf.Data[:n]))
+}
+
+// serveReplicas accepts replicas from peers on addr, and uploads the ones not confirmed in time.
+func (store *cachedStore) serveReplicas(addr string) {
+	if store.conf.ReplicaSecret == "" {
+		logger.Errorf("No secret to authenticate the peers, refuse to accept replicas on %s", addr)
+		return
+	}
+	// the replicas received before restarting are kept on disk
+	now := time.Now()
+	store.replicas.Lock()
+	for key := range store.bcache.scanReplicas() {
+		store.replicas.received[key] = now
+	}
+	store.replicas.Unlock()
+	grace := replicaGrace + store.conf.UploadDelay
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			cutoff := time.Now().Add(-grace)
+			var expired []string
+			store.replicas.Lock()
+			for key, received := range store.replicas.received {
+				if received.Before(cutoff) {
+					expired = append(expired, key)
+				}
+			}
+			store.replicas.Unlock()
+			if len(expired) > 0 {
+				store.uploadReplicas(expired)
+			}
+		}
+	}()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replica/", store.handleReplica)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	var err error
+	if store.conf.ReplicaTLSCert != "" || store.conf.ReplicaTLSKey != "" {
+		logger.Infof("Accept replicas of staged blocks on %s over TLS", addr)
+		err = srv.ListenAndServeTLS(store.conf.ReplicaTLSCert, store.conf.ReplicaTLSKey)
+	} else {
+		logger.Infof("Accept replicas of staged blocks on %s", addr)
+		err = srv.ListenAndServe()
+	}
+	if err != nil {
+		logger.Errorf("serve replicas on %s: %s", addr, err)
+	}
+}
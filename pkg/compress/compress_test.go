@@ -17,6 +17,7 @@
 package compress
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"testing"
@@ -55,6 +56,51 @@ func TestZstd(t *testing.T) {
 	testCompress(t, NewCompressor("zstd"))
 }
 
+func TestZstdDict(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":%t}`, i, i*7, i*13, i%3 == 0)))
+	}
+	dict, err := TrainDict(samples, 4<<10, 3)
+	if err != nil {
+		t.Fatalf("train: %s", err)
+	}
+	if DictID(dict) != 3 {
+		t.Fatalf("dict id %d != 3", DictID(dict))
+	}
+	load := func(id uint32) ([]byte, error) {
+		if id != 3 {
+			return nil, fmt.Errorf("no dictionary %d", id)
+		}
+		return dict, nil
+	}
+	c := NewZStandardDict(3, load)
+	testCompress(t, c)
+
+	src := []byte(`{"id":12345,"name":"user86415","email":"user160485@example.com","active":false}`)
+	dst := make([]byte, c.CompressBound(len(src)))
+	n, err := c.Compress(dst, src)
+	if err != nil {
+		t.Fatalf("compress: %s", err)
+	}
+	if FrameDictID(dst[:n]) != 3 {
+		t.Fatalf("dict id in frame: %d", FrameDictID(dst[:n]))
+	}
+	plain := make([]byte, c.CompressBound(len(src)))
+	pn, _ := NewCompressor("zstd").Compress(plain, src)
+	if n >= pn {
+		t.Fatalf("compressed with dictionary %d >= %d", n, pn)
+	}
+	// the data compressed before the dictionary is trained
+	src2 := make([]byte, len(src))
+	if n, err = NewZStandardDict(0, load).Decompress(src2, dst[:n]); err != nil || string(src2[:n]) != string(src) {
+		t.Fatalf("decompress: %s %q", err, src2[:n])
+	}
+	if n, err = c.Decompress(src2, plain[:pn]); err != nil || string(src2[:n]) != string(src) {
+		t.Fatalf("decompress without dictionary: %s %q", err, src2[:n])
+	}
+}
+
 func TestLZ4(t *testing.T) {
 	testCompress(t, NewCompressor("lz4"))
 }
@@ -0,0 +1,208 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compress
+
+/*
+#include <stddef.h>
+
+// from zdict.h, which is built within github.com/DataDog/zstd
+size_t ZDICT_trainFromBuffer(void* dictBuffer, size_t dictBufferCapacity,
+                             const void* samplesBuffer, const size_t* samplesSizes, unsigned nbSamples);
+unsigned ZDICT_isError(size_t errorCode);
+const char* ZDICT_getErrorName(size_t errorCode);
+*/
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+
+	"github.com/DataDog/zstd"
+)
+
+const (
+	frameMagic = 0xFD2FB528
+	dictMagic  = 0xEC30A437
+)
+
+// DictLoader returns the content of a dictionary by its ID.
+type DictLoader func(id uint32) ([]byte, error)
+
+// ZStandardDict is a ZStandard that compresses with the current dictionary of the volume. The ID of dictionary
+// is recorded in every frame, so the data compressed by any previous dictionary (or without one) can still be
+// decompressed.
+type ZStandardDict struct {
+	ZStandard
+	current uint32
+	load    DictLoader
+
+	sync.Mutex
+	dicts map[uint32][]byte
+}
+
+// NewZStandardDict returns a ZStandard using the dictionary of current ID (0 means no dictionary) to compress,
+// the dictionaries are loaded when they are used first time.
+func NewZStandardDict(current uint32, load DictLoader) *ZStandardDict {
+	return &ZStandardDict{ZStandard: ZStandard{ZSTD_LEVEL}, current: current, load: load, dicts: make(map[uint32][]byte)}
+}
+
+func (n *ZStandardDict) dict(id uint32) ([]byte, error) {
+	n.Lock()
+	defer n.Unlock()
+	if d, ok := n.dicts[id]; ok {
+		return d, nil
+	}
+	d, err := n.load(id)
+	if err != nil {
+		return nil, fmt.Errorf("load dictionary %d: %s", id, err)
+	}
+	if DictID(d) != id {
+		return nil, fmt.Errorf("invalid dictionary %d", id)
+	}
+	n.dicts[id] = d
+	return d, nil
+}
+
+// fixedBuffer keeps the error of writing, which is ignored by zstd.Writer.Close()
+type fixedBuffer struct {
+	buf []byte
+	n   int
+	err error
+}
+
+func (b *fixedBuffer) Write(p []byte) (int, error) {
+	if b.err == nil && b.n+len(p) > len(b.buf) {
+		b.err = fmt.Errorf("buffer too short: %d < %d", len(b.buf), b.n+len(p))
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.n += copy(b.buf[b.n:], p)
+	return len(p), nil
+}
+
+// Compress using Zstd with the current dictionary
+func (n *ZStandardDict) Compress(dst, src []byte) (int, error) {
+	if n.current == 0 {
+		return n.ZStandard.Compress(dst, src)
+	}
+	d, err := n.dict(n.current)
+	if err != nil {
+		return 0, err
+	}
+	b := &fixedBuffer{buf: dst}
+	w := zstd.NewWriterLevelDict(b, n.level, d)
+	if _, err = w.Write(src); err != nil {
+		_ = w.Close()
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	return b.n, b.err
+}
+
+// Decompress using Zstd with the dictionary recorded in the frame
+func (n *ZStandardDict) Decompress(dst, src []byte) (int, error) {
+	id := FrameDictID(src)
+	if id == 0 {
+		return n.ZStandard.Decompress(dst, src)
+	}
+	d, err := n.dict(id)
+	if err != nil {
+		return 0, err
+	}
+	r := zstd.NewReaderDict(bytes.NewReader(src), d)
+	defer r.Close()
+	got, err := io.ReadFull(r, dst)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return got, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var more [1]byte
+	if m, _ := r.Read(more[:]); m > 0 {
+		return 0, fmt.Errorf("buffer too short: %d", len(dst))
+	}
+	return got, nil
+}
+
+// FrameDictID returns the ID of dictionary used to compress a zstd frame, 0 means no dictionary.
+func FrameDictID(frame []byte) uint32 {
+	if len(frame) < 5 || binary.LittleEndian.Uint32(frame) != frameMagic {
+		return 0
+	}
+	fhd := frame[4]
+	p := 5
+	if fhd&(1<<5) == 0 { // no single segment, skip the window descriptor
+		p++
+	}
+	switch fhd & 3 {
+	case 1:
+		if len(frame) >= p+1 {
+			return uint32(frame[p])
+		}
+	case 2:
+		if len(frame) >= p+2 {
+			return uint32(binary.LittleEndian.Uint16(frame[p:]))
+		}
+	case 3:
+		if len(frame) >= p+4 {
+			return binary.LittleEndian.Uint32(frame[p:])
+		}
+	}
+	return 0
+}
+
+// DictID returns the ID of a zstd dictionary, 0 means it's not a valid one.
+func DictID(dict []byte) uint32 {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict) != dictMagic {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(dict[4:])
+}
+
+// TrainDict trains a zstd dictionary of at most size bytes from samples, and sets its ID to id.
+func TrainDict(samples [][]byte, size int, id uint32) ([]byte, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no samples")
+	}
+	var all []byte
+	sizes := make([]C.size_t, len(samples))
+	for i, s := range samples {
+		all = append(all, s...)
+		sizes[i] = C.size_t(len(s))
+	}
+	if len(all) == 0 {
+		return nil, fmt.Errorf("empty samples")
+	}
+	dict := make([]byte, size)
+	r := C.ZDICT_trainFromBuffer(unsafe.Pointer(&dict[0]), C.size_t(size), unsafe.Pointer(&all[0]), &sizes[0], C.unsigned(len(samples)))
+	if C.ZDICT_isError(r) != 0 {
+		return nil, fmt.Errorf("train dictionary: %s", C.GoString(C.ZDICT_getErrorName(r)))
+	}
+	dict = dict[:r]
+	if DictID(dict) == 0 {
+		return nil, fmt.Errorf("invalid dictionary trained")
+	}
+	binary.LittleEndian.PutUint32(dict[4:], id)
+	return dict, nil
+}
@@ -156,11 +156,21 @@ type File struct {
 
 func NewFileSystem(conf *vfs.Config, m meta.Meta, d chunk.ChunkStore) (*FileSystem, error) {
 	reader := vfs.NewDataReader(conf, m, d)
+	return newFileSystem(conf, m, reader, vfs.NewDataWriter(conf, m, d, reader))
+}
+
+// NewFileSystemOnVFS returns a FileSystem sharing the buffers and cache of a mounted VFS, so
+// the data written through either of them can be read from the other one before flushed.
+func NewFileSystemOnVFS(conf *vfs.Config, v *vfs.VFS) (*FileSystem, error) {
+	return newFileSystem(conf, v.Meta, v.Reader(), v.Writer())
+}
+
+func newFileSystem(conf *vfs.Config, m meta.Meta, reader vfs.DataReader, writer vfs.DataWriter) (*FileSystem, error) {
 	fs := &FileSystem{
 		m:       m,
 		conf:    conf,
 		reader:  reader,
-		writer:  vfs.NewDataWriter(conf, m, d, reader),
+		writer:  writer,
 		entries: make(map[meta.Ino]map[string]*entryCache),
 		attrs:   make(map[meta.Ino]*attrCache),
 	}
@@ -430,6 +440,27 @@ func (fs *FileSystem) Delete(ctx meta.Context, p string) (err syscall.Errno) {
 	return
 }
 
+// DeleteBatch removes the files named in the directory dir in batches, the result of each is put into sts.
+func (fs *FileSystem) DeleteBatch(ctx meta.Context, dir string, names []string) (sts []syscall.Errno, err syscall.Errno) {
+	defer trace.StartRegion(context.TODO(), "fs.DeleteBatch").End()
+	l := vfs.NewLogContext(ctx)
+	defer func() { fs.log(l, "DeleteBatch (%s,%d): %s", dir, len(names), errstr(err)) }()
+	parent, err := fs.resolve(ctx, dir, true)
+	if err != 0 {
+		return
+	}
+	err = fs.m.Access(ctx, parent.inode, mMaskW, parent.attr)
+	if err != 0 {
+		return
+	}
+	sts = make([]syscall.Errno, len(names))
+	err = fs.m.UnlinkBatch(ctx, parent.inode, names, sts)
+	for _, name := range names {
+		fs.invalidateEntry(parent.inode, name)
+	}
+	return
+}
+
 func (fs *FileSystem) Rmr(ctx meta.Context, p string) (err syscall.Errno) {
 	defer trace.StartRegion(context.TODO(), "fs.Rmr").End()
 	l := vfs.NewLogContext(ctx)
@@ -964,6 +995,7 @@ func (f *File) pread(ctx meta.Context, b []byte, offset int64) (n int, err error
 		err = eno
 		return
 	}
+	_ = f.fs.m.TouchAtime(ctx, f.inode)
 	if got == 0 {
 		return 0, io.EOF
 	}
@@ -1059,8 +1091,14 @@ func (f *File) Close(ctx meta.Context) (err syscall.Errno) {
 }
 
 func (f *File) Readdir(ctx meta.Context, count int) (fi []os.FileInfo, err syscall.Errno) {
+	return f.ReaddirAttrs(ctx, count, meta.ReaddirFull)
+}
+
+// ReaddirAttrs is like Readdir, but only the attributes asked by wantattr (meta.ReaddirType, etc)
+// are fetched. The entries are cached in the first call, so wantattr of later calls is ignored.
+func (f *File) ReaddirAttrs(ctx meta.Context, count int, wantattr uint8) (fi []os.FileInfo, err syscall.Errno) {
 	l := vfs.NewLogContext(ctx)
-	defer func() { f.fs.log(l, "Readdir (%s,%d): (%s,%d)", f.path, count, errstr(err), len(fi)) }()
+	defer func() { f.fs.log(l, "Readdir (%s,%d,%d): (%s,%d)", f.path, count, wantattr, errstr(err), len(fi)) }()
 	f.Lock()
 	defer f.Unlock()
 	fi = f.dircache
@@ -1070,7 +1108,7 @@ func (f *File) Readdir(ctx meta.Context, count int) (fi []os.FileInfo, err sysca
 			return nil, err
 		}
 		var inodes []*meta.Entry
-		err = f.fs.m.Readdir(ctx, f.inode, 1, &inodes)
+		err = f.fs.m.Readdir(ctx, f.inode, wantattr, &inodes)
 		if err != 0 {
 			return
 		}
@@ -1131,6 +1169,6 @@ func (f *File) Summary(ctx meta.Context) (s *meta.Summary, err syscall.Errno) {
 		f.fs.log(l, "Summary (%s): %s (%d,%d,%d,%d)", f.path, errstr(err), s.Length, s.Size, s.Files, s.Dirs)
 	}()
 	s = &meta.Summary{}
-	err = meta.GetSummary(f.fs.m, ctx, f.inode, s, true)
+	err = f.fs.m.GetSummary(ctx, f.inode, s, true)
 	return
 }
@@ -249,6 +249,16 @@ func TestFileSystem(t *testing.T) {
 	if err := fs.Delete(ctx, "/d/f"); err == 0 || !IsNotExist(err) {
 		t.Fatalf("delete /d/f: %s", err)
 	}
+	for _, name := range []string{"/d/b1", "/d/b2"} {
+		if f, e := fs.Create(ctx, name, 0644); e != 0 {
+			t.Fatalf("create %s: %s", name, e)
+		} else {
+			_ = f.Close(ctx)
+		}
+	}
+	if sts, e := fs.DeleteBatch(ctx, "/d", []string{"b1", "b3", "b2"}); e != 0 || sts[0] != 0 || sts[1] != syscall.ENOENT || sts[2] != 0 {
+		t.Fatalf("delete batch: %s %v", e, sts)
+	}
 	if e := fs.Rmr(ctx, "/d"); e != 0 {
 		t.Fatalf("delete /d -r: %s", e)
 	}
@@ -287,3 +297,44 @@ func TestFileSystem(t *testing.T) {
 		t.Fatalf("stat /ttt/: %s", err)
 	}
 }
+
+func TestFileSystemOnVFS(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	format := meta.Format{
+		Name:      "test",
+		BlockSize: 4096,
+	}
+	_ = m.Init(format, true)
+	var conf = vfs.Config{
+		Meta:   &meta.Config{},
+		Format: &format,
+		Chunk: &chunk.Config{
+			BlockSize:  format.BlockSize << 10,
+			MaxUpload:  1,
+			BufferSize: 100 << 20,
+		},
+	}
+	objStore, _ := object.CreateStorage("mem", "", "", "")
+	store := chunk.NewCachedStore(objStore, *conf.Chunk)
+	v := vfs.NewVFS(&conf, m, store)
+	fs, _ := NewFileSystemOnVFS(&conf, v)
+	ctx := meta.NewContext(1, 0, []uint32{0})
+	f, err := fs.Create(ctx, "/shared", 0644)
+	if err != 0 {
+		t.Fatalf("create /shared: %s", err)
+	}
+	defer f.Close(ctx)
+	if n, err := f.Write(ctx, []byte("hello")); err != 0 || n != 5 {
+		t.Fatalf("write 5 bytes: %d %s", n, err)
+	}
+	// the data buffered by the file system is visible to the VFS before closed
+	_, fh, st := v.Open(vfs.NewLogContext(ctx), f.Inode(), syscall.O_RDONLY)
+	if st != 0 {
+		t.Fatalf("open by vfs: %s", st)
+	}
+	defer v.Release(vfs.NewLogContext(ctx), f.Inode(), fh)
+	buf := make([]byte, 10)
+	if n, st := v.Read(vfs.NewLogContext(ctx), f.Inode(), buf, 0, fh); st != 0 || string(buf[:n]) != "hello" {
+		t.Fatalf("read by vfs: %s %q", st, buf[:n])
+	}
+}
@@ -42,7 +42,8 @@ type fuseContext struct {
 	start    time.Time
 	header   *fuse.InHeader
 	canceled bool
-	cancel   <-chan struct{}
+	cancel   <-chan struct{}    // closed when the request is interrupted
+	stop     context.CancelFunc // releases the timer of OpTimeout, nil if there is no timeout
 }
 
 var contextPool = sync.Pool{
@@ -54,6 +55,7 @@ var contextPool = sync.Pool{
 func newContext(cancel <-chan struct{}, header *fuse.InHeader) *fuseContext {
 	ctx := contextPool.Get().(*fuseContext)
 	ctx.Context = context.Background()
+	ctx.stop = nil
 	ctx.start = time.Now()
 	ctx.canceled = false
 	ctx.cancel = cancel
@@ -61,7 +63,27 @@ func newContext(cancel <-chan struct{}, header *fuse.InHeader) *fuseContext {
 	return ctx
 }
 
+// newContext returns a context which is also canceled after OpTimeout.
+func (fs *fileSystem) newContext(cancel <-chan struct{}, header *fuse.InHeader) *fuseContext {
+	ctx := newContext(cancel, header)
+	if fs.conf.OpTimeout > 0 {
+		c, stop := context.WithTimeout(ctx.Context, fs.conf.OpTimeout)
+		go func() {
+			select {
+			case <-cancel:
+				stop()
+			case <-c.Done():
+			}
+		}()
+		ctx.Context, ctx.stop = c, stop
+	}
+	return ctx
+}
+
 func releaseContext(ctx *fuseContext) {
+	if ctx.stop != nil {
+		ctx.stop()
+	}
 	contextPool.Put(ctx)
 }
 
@@ -96,6 +118,8 @@ func (c *fuseContext) Canceled() bool {
 	select {
 	case <-c.cancel:
 		return true
+	case <-c.Context.Done():
+		return true
 	default:
 		return false
 	}
@@ -105,10 +129,22 @@ func (c *fuseContext) WithValue(k, v interface{}) {
 	c.Context = context.WithValue(c.Context, k, v)
 }
 
-func (c *fuseContext) Err() error {
-	return syscall.EINTR
+// Done is closed when the request is interrupted or runs out of OpTimeout, so the reads from meta engine
+// using this context are aborted. The writes and transactions are not aborted in the middle, since they
+// could be committed already, the interruption is checked by Canceled() before starting them instead.
+func (c *fuseContext) Done() <-chan struct{} {
+	if c.stop != nil {
+		return c.Context.Done()
+	}
+	return c.cancel
 }
 
-// func (c *fuseContext) Done() <-chan struct{} {
-// 	return c.cancel
-// }
+func (c *fuseContext) Err() error {
+	if c.stop != nil && c.Context.Err() == context.DeadlineExceeded {
+		return syscall.ETIMEDOUT
+	}
+	if c.Canceled() {
+		return syscall.EINTR
+	}
+	return nil
+}
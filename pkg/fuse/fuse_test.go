@@ -35,6 +35,7 @@ import (
 	"time"
 
 	"github.com/gofrs/flock"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/google/uuid"
 	"github.com/hanwen/go-fuse/v2/posixtest"
 	"github.com/juicedata/juicefs/pkg/chunk"
@@ -303,3 +304,39 @@ func TestFUSE(t *testing.T) {
 		})
 	}
 }
+
+func TestContextTimeout(t *testing.T) {
+	fs := &fileSystem{conf: &vfs.Config{OpTimeout: time.Millisecond * 100}}
+	cancel := make(chan struct{})
+	ctx := fs.newContext(cancel, &fuse.InHeader{})
+	if ctx.Canceled() || ctx.Err() != nil {
+		t.Fatalf("new context should not be canceled")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("context is not done after timeout")
+	}
+	if !ctx.Canceled() {
+		t.Fatalf("context is not canceled after timeout")
+	}
+	if ctx.Err() != syscall.ETIMEDOUT {
+		t.Fatalf("expect ETIMEDOUT, got %v", ctx.Err())
+	}
+	releaseContext(ctx)
+
+	ctx = fs.newContext(cancel, &fuse.InHeader{})
+	close(cancel)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("context is not done after interrupted")
+	}
+	if !ctx.Canceled() {
+		t.Fatalf("context is not canceled after interrupted")
+	}
+	if ctx.Err() != syscall.EINTR {
+		t.Fatalf("expect EINTR, got %v", ctx.Err())
+	}
+	releaseContext(ctx)
+}
@@ -32,6 +32,7 @@ import (
 
 	"github.com/minio/minio-go/pkg/s3utils"
 	minio "github.com/minio/minio/cmd"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
 
 	"github.com/juicedata/juicefs/pkg/chunk"
 	"github.com/juicedata/juicefs/pkg/fs"
@@ -48,13 +49,25 @@ const (
 var mctx meta.Context
 var logger = utils.GetLogger("juicefs")
 
-func NewJFSGateway(conf *vfs.Config, m meta.Meta, store chunk.ChunkStore, multiBucket, keepEtag bool) (minio.ObjectLayer, error) {
+func NewJFSGateway(conf *vfs.Config, m meta.Meta, store chunk.ChunkStore, multiBucket, keepEtag bool, retention time.Duration, lockMode string) (minio.ObjectLayer, error) {
 	jfs, err := fs.NewFileSystem(conf, m, store)
 	if err != nil {
 		return nil, fmt.Errorf("Initialize failed: %s", err)
 	}
+	return NewJFSGatewayOnFS(conf, jfs, multiBucket, keepEtag, retention, lockMode)
+}
+
+// NewJFSGatewayOnFS returns a gateway serving an existing FileSystem, which may share
+// the buffers and cache with a mount point in the same process.
+func NewJFSGatewayOnFS(conf *vfs.Config, jfs *fs.FileSystem, multiBucket, keepEtag bool, retention time.Duration, lockMode string) (minio.ObjectLayer, error) {
+	mode, err := parseLockMode(lockMode, retention)
+	if err != nil {
+		return nil, err
+	}
 	mctx = meta.NewContext(uint32(os.Getpid()), uint32(os.Getuid()), []uint32{uint32(os.Getgid())})
-	return &jfsObjects{fs: jfs, conf: conf, listPool: minio.NewTreeWalkPool(time.Minute * 30), multiBucket: multiBucket, keepEtag: keepEtag}, nil
+	n := &jfsObjects{fs: jfs, conf: conf, listPool: minio.NewTreeWalkPool(time.Minute * 30), multiBucket: multiBucket, keepEtag: keepEtag, retention: retention, lockMode: mode}
+	go n.expireObjects(time.Hour)
+	return n, nil
 }
 
 type jfsObjects struct {
@@ -64,6 +77,8 @@ type jfsObjects struct {
 	listPool    *minio.TreeWalkPool
 	multiBucket bool
 	keepEtag    bool
+	retention   time.Duration
+	lockMode    objectlock.RetMode
 }
 
 func (n *jfsObjects) IsCompressionSupported() bool {
@@ -201,6 +216,9 @@ func (n *jfsObjects) GetBucketInfo(ctx context.Context, bucket string) (bi minio
 			Name:    bucket,
 			Created: time.Unix(fi.Atime()/1000, 0),
 		}
+		if r := getRequest(ctx); r != nil {
+			r.objects = n // MinIO checks the bucket after the request is authenticated
+		}
 	}
 	return bi, jfsToObjectErr(ctx, eno, bucket)
 }
@@ -262,7 +280,7 @@ func (n *jfsObjects) isObjectDir(ctx context.Context, bucket, object string) boo
 	}
 	defer f.Close(mctx)
 
-	fis, err := f.Readdir(mctx, 0)
+	fis, err := f.ReaddirAttrs(mctx, 0, meta.ReaddirType)
 	if err != 0 {
 		return false
 	}
@@ -284,7 +302,8 @@ func (n *jfsObjects) listDirFactory() minio.ListDirFunc {
 			return fs.IsNotExist(eno), nil, false
 		}
 		defer f.Close(mctx)
-		fis, eno := f.Readdir(mctx, 0)
+		// only names and types are needed
+		fis, eno := f.ReaddirAttrs(mctx, 0, meta.ReaddirType)
 		if eno != 0 {
 			return
 		}
@@ -371,6 +390,9 @@ func (n *jfsObjects) DeleteObject(ctx context.Context, bucket, object string, op
 	if err = n.checkBucket(ctx, bucket); err != nil {
 		return
 	}
+	if err = n.checkRetention(ctx, bucket, object); err != nil {
+		return
+	}
 	info.Bucket = bucket
 	info.Name = object
 	p := n.path(bucket, object)
@@ -389,16 +411,64 @@ func (n *jfsObjects) DeleteObject(ctx context.Context, bucket, object string, op
 	return info, jfsToObjectErr(ctx, err, bucket, object)
 }
 
-func (n *jfsObjects) DeleteObjects(ctx context.Context, bucket string, objects []minio.ObjectToDelete, options minio.ObjectOptions) (objs []minio.DeletedObject, errs []error) {
-	for _, object := range objects {
-		_, err := n.DeleteObject(ctx, bucket, object.ObjectName, options)
-		if err == nil {
-			objs = append(objs, minio.DeletedObject{ObjectName: object.ObjectName})
-		} else {
-			errs = append(errs, err)
+func (n *jfsObjects) DeleteObjects(ctx context.Context, bucket string, objects []minio.ObjectToDelete, options minio.ObjectOptions) ([]minio.DeletedObject, []error) {
+	objs := make([]minio.DeletedObject, len(objects))
+	errs := make([]error, len(objects))
+	for i, object := range objects {
+		objs[i].ObjectName = object.ObjectName
+	}
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		for i := range errs {
+			errs[i] = err
 		}
+		return objs, errs
 	}
-	return
+	// files in the same directory are removed together with one batch
+	var dirs []string
+	groups := make(map[string][]int)
+	for i, object := range objects {
+		if strings.HasSuffix(object.ObjectName, sep) {
+			_, errs[i] = n.DeleteObject(ctx, bucket, object.ObjectName, options)
+			continue
+		}
+		if errs[i] = n.checkRetention(ctx, bucket, object.ObjectName); errs[i] != nil {
+			continue
+		}
+		dir := path.Dir(n.path(bucket, object.ObjectName))
+		if _, ok := groups[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		groups[dir] = append(groups[dir], i)
+	}
+	root := n.path(bucket)
+	for _, dir := range dirs {
+		idx := groups[dir]
+		names := make([]string, len(idx))
+		for k, i := range idx {
+			names[k] = path.Base(n.path(bucket, objects[i].ObjectName))
+		}
+		sts, eno := n.fs.DeleteBatch(mctx, dir, names)
+		var removed bool
+		for k, i := range idx {
+			switch {
+			case eno == 0 && sts[k] == 0:
+				removed = true
+			case eno == 0 && sts[k] == syscall.ENOENT:
+				errs[i] = jfsToObjectErr(ctx, sts[k], bucket, objects[i].ObjectName)
+			default:
+				_, errs[i] = n.DeleteObject(ctx, bucket, objects[i].ObjectName, options)
+			}
+		}
+		if !removed {
+			continue
+		}
+		for p := dir; p != root; p = path.Dir(p) {
+			if n.fs.Delete(mctx, p) != 0 {
+				break
+			}
+		}
+	}
+	return objs, errs
 }
 
 type fReader struct {
@@ -442,6 +512,9 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 	if minio.IsStringEqual(src, dst) {
 		return n.GetObjectInfo(ctx, srcBucket, srcObject, minio.ObjectOptions{})
 	}
+	if err = n.checkRetention(ctx, dstBucket, dstObject); err != nil {
+		return
+	}
 	tmp := n.tpath(dstBucket, "tmp", minio.MustGetUUID())
 	_ = n.mkdirAll(ctx, path.Dir(tmp), 0755)
 	_, eno := n.fs.Create(mctx, tmp, 0644)
@@ -479,15 +552,17 @@ func (n *jfsObjects) CopyObject(ctx context.Context, srcBucket, srcObject, dstBu
 			}
 		}
 	}
+	n.setRetention(dst)
 
 	return minio.ObjectInfo{
-		Bucket:  dstBucket,
-		Name:    dstObject,
-		ETag:    string(etag),
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      dstBucket,
+		Name:        dstObject,
+		ETag:        string(etag),
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		UserDefined: n.retentionMeta(dst),
 	}, nil
 }
 
@@ -547,14 +622,19 @@ func (n *jfsObjects) GetObjectInfo(ctx context.Context, bucket, object string, o
 	if n.keepEtag {
 		etag, _ = n.fs.GetXattr(mctx, n.path(bucket, object), s3Etag)
 	}
+	var userDefined map[string]string
+	if !fi.IsDir() {
+		userDefined = n.retentionMeta(n.path(bucket, object))
+	}
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
-		ETag:    string(etag),
+		Bucket:      bucket,
+		Name:        object,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		ETag:        string(etag),
+		UserDefined: userDefined,
 	}, nil
 }
 
@@ -649,6 +729,8 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 			}
 			return
 		}
+	} else if err = n.checkRetention(ctx, bucket, object); err != nil {
+		return
 	} else if err = n.putObject(ctx, bucket, p, r, opts); err != nil {
 		return
 	}
@@ -663,14 +745,18 @@ func (n *jfsObjects) PutObject(ctx context.Context, bucket string, object string
 			logger.Errorf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", p, s3Etag, etag, 0)
 		}
 	}
+	if !fi.IsDir() {
+		n.setRetention(p)
+	}
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ETag:    etag,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ETag:        etag,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		UserDefined: n.retentionMeta(p),
 	}, nil
 }
 
@@ -853,6 +939,9 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 		total += copied
 	}
 
+	if err = n.checkRetention(ctx, bucket, object); err != nil {
+		return
+	}
 	name := n.path(bucket, object)
 	dir := path.Dir(name)
 	if dir != "" {
@@ -889,14 +978,16 @@ func (n *jfsObjects) CompleteMultipartUpload(ctx context.Context, bucket, object
 			logger.Warnf("set xattr error, path: %s,xattr: %s,value: %s,flags: %d", name, s3Etag, s3MD5, 0)
 		}
 	}
+	n.setRetention(name)
 	return minio.ObjectInfo{
-		Bucket:  bucket,
-		Name:    object,
-		ETag:    s3MD5,
-		ModTime: fi.ModTime(),
-		Size:    fi.Size(),
-		IsDir:   fi.IsDir(),
-		AccTime: fi.ModTime(),
+		Bucket:      bucket,
+		Name:        object,
+		ETag:        s3MD5,
+		ModTime:     fi.ModTime(),
+		Size:        fi.Size(),
+		IsDir:       fi.IsDir(),
+		AccTime:     fi.ModTime(),
+		UserDefined: n.retentionMeta(name),
 	}, nil
 }
 
@@ -0,0 +1,69 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/hash"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func newTestGateway(t *testing.T, retention time.Duration, lockMode string) *jfsObjects {
+	m := meta.NewClient("memkv://", &meta.Config{})
+	format := meta.Format{Name: "test", BlockSize: 4096}
+	if err := m.Init(format, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	conf := &vfs.Config{
+		Meta:   &meta.Config{},
+		Format: &format,
+		Chunk: &chunk.Config{
+			BlockSize:  format.BlockSize << 10,
+			MaxUpload:  1,
+			BufferSize: 100 << 20,
+		},
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	store := chunk.NewCachedStore(blob, *conf.Chunk)
+	layer, err := NewJFSGateway(conf, m, store, true, false, retention, lockMode)
+	if err != nil {
+		t.Fatalf("new gateway: %s", err)
+	}
+	n := layer.(*jfsObjects)
+	if err = n.MakeBucketWithLocation(context.Background(), "bucket", minio.BucketOptions{}); err != nil {
+		t.Fatalf("make bucket: %s", err)
+	}
+	return n
+}
+
+func putObject(ctx context.Context, n *jfsObjects, object string, data []byte) error {
+	r, err := hash.NewReader(bytes.NewReader(data), int64(len(data)), "", "", int64(len(data)), false)
+	if err != nil {
+		return err
+	}
+	_, err = n.PutObject(ctx, "bucket", object, minio.NewPutObjReader(r), minio.ObjectOptions{})
+	return err
+}
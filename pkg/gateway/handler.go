@@ -0,0 +1,253 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	_ "unsafe" // for go:linkname
+
+	"github.com/gorilla/mux"
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/bucket/lifecycle"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
+	"github.com/minio/minio/pkg/bucket/policy"
+)
+
+// globalHandlers are the middlewares used by the router of MinIO, which can't be extended otherwise.
+//
+//go:linkname globalHandlers github.com/minio/minio/cmd.globalHandlers
+var globalHandlers []mux.MiddlewareFunc
+
+// checkRequestAuthType verifies the signature of a request and whether the action is allowed
+// by the IAM and bucket policies.
+//
+//go:linkname checkRequestAuthType github.com/minio/minio/cmd.checkRequestAuthType
+func checkRequestAuthType(ctx context.Context, r *http.Request, action policy.Action, bucket, object string) minio.APIErrorCode
+
+// checkAuth is replaced in tests, which have no IAM system.
+var checkAuth = checkRequestAuthType
+
+// RegisterHandler adds the middleware of JuiceFS into the router of MinIO, it should be called
+// before the gateway is started.
+func RegisterHandler() {
+	globalHandlers = append(globalHandlers, handler)
+}
+
+type requestKey struct{}
+
+// request keeps the details of an HTTP request which are not passed to ObjectLayer by MinIO.
+type request struct {
+	method  string
+	uri     string
+	proto   string
+	referer string
+	http    *http.Request
+	objects *jfsObjects // set once the request is authenticated
+}
+
+func getRequest(ctx context.Context) *request {
+	r, _ := ctx.Value(requestKey{}).(*request)
+	return r
+}
+
+// allowed returns whether the authenticated request is allowed to do the action by the policies.
+func (r *request) allowed(action policy.Action, bucket, object string) bool {
+	return r.http != nil && checkAuth(r.http.Context(), r.http, action, bucket, object) == minio.ErrNone
+}
+
+// apiHandler serves an API which is not supported by MinIO for gateways.
+type apiHandler func(n *jfsObjects, w http.ResponseWriter, r *http.Request, body []byte)
+
+func route(r *http.Request) apiHandler {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	if vars["object"] != "" {
+		if _, ok := query["retention"]; ok && r.Method == http.MethodPut {
+			return putObjectRetention
+		}
+		return nil
+	}
+	if _, ok := query["lifecycle"]; ok {
+		switch r.Method {
+		case http.MethodPut:
+			return putBucketLifecycle
+		case http.MethodGet:
+			return getBucketLifecycle
+		case http.MethodDelete:
+			return deleteBucketLifecycle
+		}
+	}
+	return nil
+}
+
+func handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &request{
+			method:  r.Method,
+			uri:     r.RequestURI,
+			proto:   r.Proto,
+			referer: r.Referer(),
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, req))
+		// a shallow copy, so the body read by MinIO is not touched when checking the policies
+		req.http = r.WithContext(r.Context())
+		serve := route(r)
+		if serve == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		// MinIO authenticates the request and fails it as not supported, which is dropped then
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(&authWriter{w: w, req: req, header: w.Header().Clone()}, r)
+		if req.objects != nil {
+			serve(req.objects, w, r, body)
+		}
+	})
+}
+
+// authWriter passes the response of MinIO through until the request is authenticated.
+type authWriter struct {
+	w      http.ResponseWriter
+	req    *request
+	header http.Header
+}
+
+func (a *authWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *authWriter) WriteHeader(code int) {
+	if a.req.objects == nil {
+		for k, v := range a.header {
+			a.w.Header()[k] = v
+		}
+		a.w.WriteHeader(code)
+	}
+}
+
+func (a *authWriter) Write(b []byte) (int, error) {
+	if a.req.objects == nil {
+		return a.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// Flush is required by MinIO, which flushes every response.
+func (a *authWriter) Flush() {
+	if a.req.objects == nil {
+		if f, ok := a.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+func writeObjectError(w http.ResponseWriter, err error) {
+	status, code := errorCode(err)
+	writeError(w, status, code, err.Error())
+}
+
+func putObjectRetention(n *jfsObjects, w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Header.Get("Content-Md5") == "" {
+		writeError(w, http.StatusBadRequest, "MissingContentMD5", "Missing required header for this request: Content-Md5.")
+		return
+	}
+	ret, err := objectlock.ParseObjectRetention(bytes.NewReader(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	vars := mux.Vars(r)
+	object, err := url.PathUnescape(vars["object"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	// MinIO only verifies the signature of it
+	if req := getRequest(r.Context()); req == nil || !req.allowed(policy.PutObjectRetentionAction, vars["bucket"], object) {
+		writeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+		return
+	}
+	if err = n.PutObjectRetention(r.Context(), vars["bucket"], object, ret); err != nil {
+		writeObjectError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func putBucketLifecycle(n *jfsObjects, w http.ResponseWriter, r *http.Request, body []byte) {
+	if r.Header.Get("Content-Md5") == "" {
+		writeError(w, http.StatusBadRequest, "MissingContentMD5", "Missing required header for this request: Content-Md5.")
+		return
+	}
+	lc, err := lifecycle.ParseLifecycleConfig(bytes.NewReader(body))
+	if err == nil {
+		err = lc.Validate()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if err = n.SetBucketLifecycle(r.Context(), mux.Vars(r)["bucket"], lc); err != nil {
+		writeObjectError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func getBucketLifecycle(n *jfsObjects, w http.ResponseWriter, r *http.Request, body []byte) {
+	lc, err := n.GetBucketLifecycle(r.Context(), mux.Vars(r)["bucket"])
+	if err != nil {
+		writeObjectError(w, err)
+		return
+	}
+	data, err := xml.Marshal(lc)
+	if err != nil {
+		writeObjectError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func deleteBucketLifecycle(n *jfsObjects, w http.ResponseWriter, r *http.Request, body []byte) {
+	if err := n.DeleteBucketLifecycle(r.Context(), mux.Vars(r)["bucket"]); err != nil {
+		writeObjectError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
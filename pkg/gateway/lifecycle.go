@@ -0,0 +1,144 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"os"
+	"path"
+	"time"
+
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/bucket/lifecycle"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// s3Lifecycle keeps the lifecycle configuration (XML) of a bucket on its root directory.
+const s3Lifecycle = "s3-lifecycle"
+
+func (n *jfsObjects) SetBucketLifecycle(ctx context.Context, bucket string, lc *lifecycle.Lifecycle) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	for _, rule := range lc.Rules {
+		if !rule.Transition.IsNull() || !rule.NoncurrentVersionTransition.IsDaysNull() {
+			return minio.NotImplemented{}
+		}
+	}
+	data, err := xml.Marshal(lc)
+	if err != nil {
+		return err
+	}
+	return jfsToObjectErr(ctx, n.fs.SetXattr(mctx, n.path(bucket), s3Lifecycle, data, 0), bucket)
+}
+
+func (n *jfsObjects) GetBucketLifecycle(ctx context.Context, bucket string) (*lifecycle.Lifecycle, error) {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return nil, err
+	}
+	data, eno := n.fs.GetXattr(mctx, n.path(bucket), s3Lifecycle)
+	if eno == meta.ENOATTR || eno == 0 && len(data) == 0 {
+		return nil, minio.BucketLifecycleNotFound{Bucket: bucket}
+	} else if eno != 0 {
+		return nil, jfsToObjectErr(ctx, eno, bucket)
+	}
+	return lifecycle.ParseLifecycleConfig(bytes.NewReader(data))
+}
+
+func (n *jfsObjects) DeleteBucketLifecycle(ctx context.Context, bucket string) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if eno := n.fs.RemoveXattr(mctx, n.path(bucket), s3Lifecycle); eno != 0 && eno != meta.ENOATTR {
+		return jfsToObjectErr(ctx, eno, bucket)
+	}
+	return nil
+}
+
+// expireObjects removes the objects that are expired by the lifecycle rules of their buckets periodically,
+// and unlocks the objects whose retention is expired.
+func (n *jfsObjects) expireObjects(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		n.expire(context.Background())
+	}
+}
+
+func (n *jfsObjects) expire(ctx context.Context) {
+	buckets, err := n.ListBuckets(ctx)
+	if err != nil {
+		logger.Warnf("list buckets: %s", err)
+		return
+	}
+	for _, b := range buckets {
+		lc, err := n.GetBucketLifecycle(ctx, b.Name)
+		if err != nil {
+			lc = nil // only release the expired retention
+		}
+		var expired, released int
+		n.walkObjects(b.Name, "", func(object string, fi os.FileInfo) {
+			if fi.Sys().(*meta.Attr).Flags&meta.FlagImmutable != 0 {
+				if !n.releaseExpired(n.path(b.Name, object)) {
+					return
+				}
+				released++
+			}
+			if lc == nil || lc.ComputeAction(lifecycle.ObjectOpts{Name: object, ModTime: fi.ModTime()}) != lifecycle.DeleteAction {
+				return
+			}
+			if _, err := n.DeleteObject(ctx, b.Name, object, minio.ObjectOptions{}); err != nil {
+				logger.Debugf("expire object %s/%s: %s", b.Name, object, err)
+			} else {
+				expired++
+			}
+		})
+		if released > 0 {
+			logger.Infof("released %d objects with expired retention in bucket %s", released, b.Name)
+		}
+		if expired > 0 {
+			logger.Infof("expired %d objects in bucket %s", expired, b.Name)
+		}
+	}
+}
+
+func (n *jfsObjects) walkObjects(bucket, prefix string, fn func(object string, fi os.FileInfo)) {
+	p := n.path(bucket, prefix)
+	f, eno := n.fs.Open(mctx, p, 0)
+	if eno != 0 {
+		return
+	}
+	fis, eno := f.Readdir(mctx, 0)
+	_ = f.Close(mctx)
+	if eno != 0 {
+		logger.Warnf("readdir %s: %s", p, eno)
+		return
+	}
+	for _, fi := range fis {
+		if p == sep && fi.Name() == metaBucket {
+			continue
+		}
+		object := path.Join(prefix, fi.Name())
+		if fi.IsDir() {
+			n.walkObjects(bucket, object, fn)
+		} else {
+			fn(object, fi)
+		}
+	}
+}
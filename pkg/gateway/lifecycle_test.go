@@ -0,0 +1,157 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mcli "github.com/minio/cli"
+	miniogo "github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	mlifecycle "github.com/minio/minio-go/v7/pkg/lifecycle"
+	minio "github.com/minio/minio/cmd"
+	"github.com/minio/minio/pkg/auth"
+)
+
+type testGateway struct {
+	layer minio.ObjectLayer
+}
+
+func (g *testGateway) Name() string     { return "JuiceFS" }
+func (g *testGateway) Production() bool { return true }
+func (g *testGateway) NewGatewayLayer(creds auth.Credentials) (minio.ObjectLayer, error) {
+	return g.layer, nil
+}
+
+// startGateway serves the layer by MinIO in the background, it can be called only once in a process.
+func startGateway(t *testing.T, layer minio.ObjectLayer) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	address := l.Addr().String()
+	_ = l.Close()
+	dir := t.TempDir()
+	os.Setenv("MINIO_ROOT_USER", "testUser")
+	os.Setenv("MINIO_ROOT_PASSWORD", "testUserPassword")
+	RegisterHandler()
+	app := &mcli.App{
+		Action: func(c *mcli.Context) { minio.StartGateway(c, &testGateway{layer}) },
+		Flags: []mcli.Flag{
+			mcli.StringFlag{Name: "address"},
+			mcli.StringFlag{Name: "config-dir"},
+			mcli.StringFlag{Name: "certs-dir"},
+			mcli.BoolFlag{Name: "quiet"},
+		},
+	}
+	go func() {
+		_ = app.Run([]string{"gateway", "--address", address, "--config-dir", dir, "--certs-dir", filepath.Join(dir, "certs"), "--quiet"})
+	}()
+	for i := 0; i < 100; i++ {
+		if c, err := net.Dial("tcp", address); err == nil {
+			_ = c.Close()
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return address
+}
+
+func TestLifecycle(t *testing.T) {
+	n := newTestGateway(t, 0, "")
+	ctx := context.Background()
+	for _, object := range []string{"logs/a", "logs/b", "data/c"} {
+		if err := putObject(ctx, n, object, []byte("hello")); err != nil {
+			t.Fatalf("put object %s: %s", object, err)
+		}
+	}
+	address := startGateway(t, n)
+	newClient := func(secret string) *miniogo.Client {
+		client, err := miniogo.New(address, &miniogo.Options{Creds: credentials.NewStaticV4("testUser", secret, "")})
+		if err != nil {
+			t.Fatalf("create client: %s", err)
+		}
+		return client
+	}
+	client := newClient("testUserPassword")
+
+	if _, err := client.GetBucketLifecycle(ctx, "bucket"); miniogo.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+		t.Fatalf("get lifecycle before it's set: %v", err)
+	}
+	config := mlifecycle.NewConfiguration()
+	config.Rules = []mlifecycle.Rule{{
+		ID:         "logs",
+		Status:     "Enabled",
+		RuleFilter: mlifecycle.Filter{Prefix: "logs/"},
+		Expiration: mlifecycle.Expiration{Days: 1},
+	}}
+	if err := newClient("wrongPassword").SetBucketLifecycle(ctx, "bucket", config); miniogo.ToErrorResponse(err).Code != "SignatureDoesNotMatch" {
+		t.Fatalf("set lifecycle with wrong password: %v", err)
+	}
+	if _, err := n.GetBucketLifecycle(ctx, "bucket"); err == nil {
+		t.Fatalf("lifecycle is set by unauthenticated request")
+	}
+	if err := client.SetBucketLifecycle(ctx, "bucket", config); err != nil {
+		t.Fatalf("set lifecycle: %s", err)
+	}
+	if lc, err := client.GetBucketLifecycle(ctx, "bucket"); err != nil || len(lc.Rules) != 1 || lc.Rules[0].RuleFilter.Prefix != "logs/" {
+		t.Fatalf("get lifecycle: %+v %v", lc, err)
+	}
+	transition := mlifecycle.NewConfiguration()
+	transition.Rules = []mlifecycle.Rule{{
+		ID:         "tier",
+		Status:     "Enabled",
+		Transition: mlifecycle.Transition{Days: 1, StorageClass: "GLACIER"},
+	}}
+	if err := client.SetBucketLifecycle(ctx, "bucket", transition); miniogo.ToErrorResponse(err).Code != "NotImplemented" {
+		t.Fatalf("transition should not be supported: %v", err)
+	}
+
+	// objects modified two days ago are expired by the rule
+	past := time.Now().Add(-48*time.Hour).UnixNano() / 1e6
+	for _, object := range []string{"logs/a", "data/c"} {
+		f, eno := n.fs.Open(mctx, n.path("bucket", object), 0)
+		if eno == 0 {
+			eno = f.Utime(mctx, past, past)
+			_ = f.Close(mctx)
+		}
+		if eno != 0 {
+			t.Fatalf("utime %s: %s", object, eno)
+		}
+	}
+	n.expire(ctx)
+	if _, err := client.StatObject(ctx, "bucket", "logs/a", miniogo.StatObjectOptions{}); miniogo.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Fatalf("logs/a should be expired: %v", err)
+	}
+	for _, object := range []string{"logs/b", "data/c"} {
+		if _, err := client.StatObject(ctx, "bucket", object, miniogo.StatObjectOptions{}); err != nil {
+			t.Fatalf("%s should not be expired: %s", object, err)
+		}
+	}
+
+	if err := client.SetBucketLifecycle(ctx, "bucket", mlifecycle.NewConfiguration()); err != nil {
+		t.Fatalf("delete lifecycle: %s", err)
+	}
+	if _, err := client.GetBucketLifecycle(ctx, "bucket"); miniogo.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+		t.Fatalf("get lifecycle after it's deleted: %v", err)
+	}
+}
@@ -0,0 +1 @@
+// This file allows the functions declared without body for go:linkname.
@@ -0,0 +1,193 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	minio "github.com/minio/minio/cmd"
+	xhttp "github.com/minio/minio/cmd/http"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
+	"github.com/minio/minio/pkg/bucket/policy"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// s3RetainUntil keeps the time (RFC3339) until which an object can not be
+// overwritten or deleted (WORM), and s3LockMode keeps the mode of the retention
+// (COMPLIANCE if not set). A locked object is also marked as immutable, so
+// it can't be changed or removed through POSIX interfaces either.
+const (
+	s3RetainUntil = "s3-retain-until"
+	s3LockMode    = "s3-lock-mode"
+)
+
+func parseLockMode(mode string, retention time.Duration) (objectlock.RetMode, error) {
+	if mode == "" {
+		mode = string(objectlock.RetCompliance)
+	}
+	m := objectlock.RetMode(strings.ToUpper(mode))
+	if retention > 0 && !m.Valid() {
+		return m, fmt.Errorf("invalid object lock mode: %s", mode)
+	}
+	return m, nil
+}
+
+func (n *jfsObjects) getRetention(p string) (mode objectlock.RetMode, until time.Time) {
+	v, eno := n.fs.GetXattr(mctx, p, s3RetainUntil)
+	if eno != 0 || len(v) == 0 {
+		return
+	}
+	until, err := time.Parse(time.RFC3339, string(v))
+	if err != nil {
+		logger.Warnf("invalid retention of %s: %s", p, v)
+	}
+	mode = objectlock.RetCompliance
+	if v, eno = n.fs.GetXattr(mctx, p, s3LockMode); eno == 0 && len(v) > 0 {
+		mode = objectlock.RetMode(v)
+	}
+	return
+}
+
+// bypassGovernance returns whether the request asks to bypass the governance mode, and it's
+// allowed to by the s3:BypassGovernanceRetention permission.
+func bypassGovernance(ctx context.Context, bucket, object string) bool {
+	r := getRequest(ctx)
+	return r != nil && r.http != nil && objectlock.IsObjectLockGovernanceBypassSet(r.http.Header) &&
+		r.allowed(policy.BypassGovernanceRetentionAction, bucket, object)
+}
+
+// checkRetention returns an error if the object is still under retention, otherwise it's
+// unlocked so that it can be overwritten or deleted.
+func (n *jfsObjects) checkRetention(ctx context.Context, bucket, object string) error {
+	p := n.path(bucket, object)
+	mode, until := n.getRetention(p)
+	if until.IsZero() {
+		return nil
+	}
+	if time.Now().Before(until) && !(mode == objectlock.RetGovernance && bypassGovernance(ctx, bucket, object)) {
+		logger.Warnf("object %s/%s is locked in %s mode until %s", bucket, object, mode, until.Format(time.RFC3339))
+		return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+	}
+	return jfsToObjectErr(ctx, n.unlock(p), bucket, object)
+}
+
+// setRetention locks a newly written object for the default retention period.
+func (n *jfsObjects) setRetention(p string) {
+	if n.retention <= 0 {
+		return
+	}
+	if eno := n.lock(p, n.lockMode, time.Now().Add(n.retention)); eno != 0 {
+		logger.Errorf("lock %s: %s", p, eno)
+	}
+}
+
+// PutObjectRetention changes the retention of an object. A retention in compliance mode can only
+// be extended, and one in governance mode can only be shortened or removed with bypass.
+func (n *jfsObjects) PutObjectRetention(ctx context.Context, bucket, object string, ret *objectlock.ObjectRetention) error {
+	if err := n.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	p := n.path(bucket, object)
+	fi, eno := n.fs.Stat(mctx, p)
+	if eno != 0 {
+		return jfsToObjectErr(ctx, eno, bucket, object)
+	}
+	if fi.IsDir() {
+		return minio.ObjectNotFound{Bucket: bucket, Object: object}
+	}
+	mode, until := n.getRetention(p)
+	if time.Now().Before(until) {
+		weaken := !ret.Mode.Valid() || ret.RetainUntilDate.Before(until)
+		if mode == objectlock.RetCompliance && (weaken || ret.Mode != mode) ||
+			mode == objectlock.RetGovernance && weaken && !bypassGovernance(ctx, bucket, object) {
+			logger.Warnf("object %s/%s is locked in %s mode until %s", bucket, object, mode, until.Format(time.RFC3339))
+			return minio.PrefixAccessDenied{Bucket: bucket, Object: object}
+		}
+	}
+	if ret.Mode.Valid() {
+		eno = n.lock(p, ret.Mode, ret.RetainUntilDate.Time)
+	} else {
+		eno = n.unlock(p)
+	}
+	return jfsToObjectErr(ctx, eno, bucket, object)
+}
+
+// releaseExpired unlocks an object whose retention is expired, so that it can be changed
+// through POSIX interfaces again.
+func (n *jfsObjects) releaseExpired(p string) bool {
+	_, until := n.getRetention(p)
+	if until.IsZero() || time.Now().Before(until) {
+		return false
+	}
+	if eno := n.unlock(p); eno != 0 {
+		logger.Warnf("unlock %s: %s", p, eno)
+		return false
+	}
+	return true
+}
+
+func (n *jfsObjects) lock(p string, mode objectlock.RetMode, until time.Time) syscall.Errno {
+	if eno := n.fs.SetXattr(mctx, p, s3RetainUntil, []byte(until.UTC().Format(time.RFC3339)), 0); eno != 0 {
+		return eno
+	}
+	if eno := n.fs.SetXattr(mctx, p, s3LockMode, []byte(mode), 0); eno != 0 {
+		return eno
+	}
+	return n.setImmutable(p, true)
+}
+
+func (n *jfsObjects) unlock(p string) syscall.Errno {
+	if eno := n.setImmutable(p, false); eno != 0 {
+		return eno
+	}
+	for _, name := range []string{s3RetainUntil, s3LockMode} {
+		if eno := n.fs.RemoveXattr(mctx, p, name); eno != 0 && eno != meta.ENOATTR {
+			return eno
+		}
+	}
+	return 0
+}
+
+func (n *jfsObjects) setImmutable(p string, immutable bool) syscall.Errno {
+	fi, eno := n.fs.Stat(mctx, p)
+	if eno != 0 {
+		return eno
+	}
+	flags := fi.Sys().(*meta.Attr).Flags &^ meta.FlagImmutable
+	if immutable {
+		flags |= meta.FlagImmutable
+	}
+	// only root can change the flags
+	return n.fs.Meta().SetAttr(meta.Background, fi.Inode(), meta.SetAttrFlag, 0, &meta.Attr{Flags: flags})
+}
+
+// retentionMeta returns the object lock headers of an object.
+func (n *jfsObjects) retentionMeta(p string) map[string]string {
+	mode, until := n.getRetention(p)
+	if until.IsZero() {
+		return nil
+	}
+	return map[string]string{
+		xhttp.AmzObjectLockMode:            string(mode),
+		xhttp.AmzObjectLockRetainUntilDate: until.UTC().Format(time.RFC3339),
+	}
+}
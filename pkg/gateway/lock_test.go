@@ -0,0 +1,245 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	minio "github.com/minio/minio/cmd"
+	xhttp "github.com/minio/minio/cmd/http"
+	objectlock "github.com/minio/minio/pkg/bucket/object/lock"
+	"github.com/minio/minio/pkg/bucket/policy"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func retainUntil(d time.Duration) objectlock.RetentionDate {
+	return objectlock.RetentionDate{Time: time.Now().Add(d).Truncate(time.Second)}
+}
+
+// allowActions replaces the policies with the ones allowing only the actions.
+func allowActions(t *testing.T, actions ...policy.Action) {
+	old := checkAuth
+	checkAuth = func(ctx context.Context, r *http.Request, action policy.Action, bucket, object string) minio.APIErrorCode {
+		for _, a := range actions {
+			if a == action {
+				return minio.ErrNone
+			}
+		}
+		return minio.ErrAccessDenied
+	}
+	t.Cleanup(func() { checkAuth = old })
+}
+
+// withBypass returns the context of a request asking to bypass the governance mode.
+func withBypass(ctx context.Context) context.Context {
+	r := httptest.NewRequest(http.MethodDelete, "/bucket/obj", nil)
+	r.Header.Set(xhttp.AmzObjectLockBypassGovernance, "true")
+	return context.WithValue(ctx, requestKey{}, &request{http: r})
+}
+
+func TestComplianceRetention(t *testing.T) {
+	n := newTestGateway(t, time.Hour, "")
+	ctx := context.Background()
+	if err := putObject(ctx, n, "obj", []byte("hello")); err != nil {
+		t.Fatalf("put object: %s", err)
+	}
+	info, err := n.GetObjectInfo(ctx, "bucket", "obj", minio.ObjectOptions{})
+	if err != nil {
+		t.Fatalf("get object info: %s", err)
+	}
+	if info.UserDefined[xhttp.AmzObjectLockMode] != string(objectlock.RetCompliance) {
+		t.Fatalf("expect compliance mode: %+v", info.UserDefined)
+	}
+	if err = putObject(ctx, n, "obj", []byte("world")); err == nil {
+		t.Fatalf("overwrite a locked object should fail")
+	}
+	if _, err = n.DeleteObject(ctx, "bucket", "obj", minio.ObjectOptions{}); err == nil {
+		t.Fatalf("delete a locked object should fail")
+	}
+	// POSIX interfaces can't change it either
+	if eno := n.fs.Delete(mctx, n.path("bucket", "obj")); eno != syscall.EPERM {
+		t.Fatalf("unlink a locked file: %s", eno)
+	}
+	if _, eno := n.fs.Open(mctx, n.path("bucket", "obj"), vfs.MODE_MASK_W); eno != syscall.EPERM {
+		t.Fatalf("open a locked file for writing: %s", eno)
+	}
+	allowActions(t, policy.BypassGovernanceRetentionAction)
+	bypass := withBypass(ctx)
+	if _, err = n.DeleteObject(bypass, "bucket", "obj", minio.ObjectOptions{}); err == nil {
+		t.Fatalf("compliance mode can't be bypassed")
+	}
+
+	for _, ret := range []objectlock.ObjectRetention{
+		{Mode: objectlock.RetCompliance, RetainUntilDate: retainUntil(time.Minute)},
+		{Mode: objectlock.RetGovernance, RetainUntilDate: retainUntil(time.Hour * 2)},
+		{},
+	} {
+		if err = n.PutObjectRetention(bypass, "bucket", "obj", &ret); err == nil {
+			t.Fatalf("retention in compliance mode can't be weakened: %+v", ret)
+		}
+	}
+	ret := objectlock.ObjectRetention{Mode: objectlock.RetCompliance, RetainUntilDate: retainUntil(time.Hour * 2)}
+	if err = n.PutObjectRetention(ctx, "bucket", "obj", &ret); err != nil {
+		t.Fatalf("extend retention: %s", err)
+	}
+	if _, until := n.getRetention(n.path("bucket", "obj")); !until.Equal(ret.RetainUntilDate.Time) {
+		t.Fatalf("expect retention until %s, got %s", ret.RetainUntilDate, until)
+	}
+
+	// expired
+	if eno := n.lock(n.path("bucket", "obj"), objectlock.RetCompliance, time.Now().Add(-time.Second)); eno != 0 {
+		t.Fatalf("lock: %s", eno)
+	}
+	if _, err = n.DeleteObject(ctx, "bucket", "obj", minio.ObjectOptions{}); err != nil {
+		t.Fatalf("delete an expired object: %s", err)
+	}
+}
+
+func TestGovernanceRetention(t *testing.T) {
+	n := newTestGateway(t, time.Hour, "governance")
+	ctx := context.Background()
+	bypass := withBypass(ctx)
+	for _, name := range []string{"a", "b"} {
+		if err := putObject(ctx, n, name, []byte("hello")); err != nil {
+			t.Fatalf("put object: %s", err)
+		}
+	}
+	if _, err := n.DeleteObject(ctx, "bucket", "a", minio.ObjectOptions{}); err == nil {
+		t.Fatalf("delete a locked object without bypass should fail")
+	}
+	allowActions(t)
+	if _, err := n.DeleteObject(bypass, "bucket", "a", minio.ObjectOptions{}); err == nil {
+		t.Fatalf("bypass without s3:BypassGovernanceRetention should fail")
+	}
+	allowActions(t, policy.BypassGovernanceRetentionAction)
+	if _, err := n.DeleteObject(bypass, "bucket", "a", minio.ObjectOptions{}); err != nil {
+		t.Fatalf("delete a locked object with bypass: %s", err)
+	}
+
+	shorter := objectlock.ObjectRetention{Mode: objectlock.RetGovernance, RetainUntilDate: retainUntil(time.Minute)}
+	if err := n.PutObjectRetention(ctx, "bucket", "b", &shorter); err == nil {
+		t.Fatalf("shorten retention without bypass should fail")
+	}
+	if err := n.PutObjectRetention(bypass, "bucket", "b", &shorter); err != nil {
+		t.Fatalf("shorten retention with bypass: %s", err)
+	}
+	if err := n.PutObjectRetention(bypass, "bucket", "b", &objectlock.ObjectRetention{}); err != nil {
+		t.Fatalf("remove retention with bypass: %s", err)
+	}
+	if info, _ := n.GetObjectInfo(ctx, "bucket", "b", minio.ObjectOptions{}); info.UserDefined != nil {
+		t.Fatalf("retention is not removed: %+v", info.UserDefined)
+	}
+	if eno := n.fs.Delete(mctx, n.path("bucket", "b")); eno != 0 {
+		t.Fatalf("unlink an unlocked file: %s", eno)
+	}
+}
+
+func TestPutObjectRetentionHandler(t *testing.T) {
+	n := newTestGateway(t, 0, "")
+	if err := putObject(context.Background(), n, "obj", []byte("hello")); err != nil {
+		t.Fatalf("put object: %s", err)
+	}
+	// MinIO authenticates the request and rejects it since object lock is not enabled for gateways
+	router := mux.NewRouter()
+	router.Use(handler)
+	router.Methods(http.MethodPut).Path("/{bucket}/{object:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "valid" && auth != "readonly" {
+			writeError(w, http.StatusForbidden, "AccessDenied", "Access Denied.")
+			return
+		}
+		if _, err := n.GetBucketInfo(r.Context(), mux.Vars(r)["bucket"]); err != nil {
+			writeObjectError(w, err)
+			return
+		}
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Bucket is missing ObjectLockConfiguration")
+	})
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := `<Retention><Mode>GOVERNANCE</Mode><RetainUntilDate>` + until + `</RetainUntilDate></Retention>`
+	put := func(auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/bucket/obj?retention", strings.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		r.Header.Set("Content-Md5", "any")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	if w := put("invalid"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "AccessDenied") {
+		t.Fatalf("unauthenticated request: %d %s", w.Code, w.Body)
+	}
+	if mode, _ := n.getRetention(n.path("bucket", "obj")); mode != "" {
+		t.Fatalf("retention is changed by unauthenticated request: %s", mode)
+	}
+	checkAuth = func(ctx context.Context, r *http.Request, action policy.Action, bucket, object string) minio.APIErrorCode {
+		if r.Header.Get("Authorization") == "valid" && action == policy.PutObjectRetentionAction && bucket == "bucket" && object == "obj" {
+			return minio.ErrNone
+		}
+		return minio.ErrAccessDenied
+	}
+	defer func() { checkAuth = checkRequestAuthType }()
+	if w := put("readonly"); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "AccessDenied") {
+		t.Fatalf("request without s3:PutObjectRetention: %d %s", w.Code, w.Body)
+	}
+	if mode, _ := n.getRetention(n.path("bucket", "obj")); mode != "" {
+		t.Fatalf("retention is changed without s3:PutObjectRetention: %s", mode)
+	}
+	if w := put("valid"); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("put retention: %d %s", w.Code, w.Body)
+	}
+	if mode, t2 := n.getRetention(n.path("bucket", "obj")); mode != objectlock.RetGovernance || t2.UTC().Format(time.RFC3339) != until {
+		t.Fatalf("unexpected retention: %s %s", mode, t2)
+	}
+}
+
+func TestReleaseExpiredRetention(t *testing.T) {
+	n := newTestGateway(t, time.Hour, "")
+	ctx := context.Background()
+	for _, name := range []string{"expired", "locked"} {
+		if err := putObject(ctx, n, name, []byte("hello")); err != nil {
+			t.Fatalf("put object: %s", err)
+		}
+	}
+	if eno := n.lock(n.path("bucket", "expired"), objectlock.RetCompliance, time.Now().Add(-time.Second)); eno != 0 {
+		t.Fatalf("lock: %s", eno)
+	}
+	n.expire(ctx)
+	fi, eno := n.fs.Stat(mctx, n.path("bucket", "expired"))
+	if eno != 0 {
+		t.Fatalf("stat: %s", eno)
+	}
+	if fi.Sys().(*meta.Attr).Flags&meta.FlagImmutable != 0 {
+		t.Fatalf("the object with expired retention is still immutable")
+	}
+	if info, _ := n.GetObjectInfo(ctx, "bucket", "expired", minio.ObjectOptions{}); info.UserDefined != nil {
+		t.Fatalf("expired retention is not removed: %+v", info.UserDefined)
+	}
+	if eno := n.fs.Delete(mctx, n.path("bucket", "expired")); eno != 0 {
+		t.Fatalf("unlink a released file: %s", eno)
+	}
+	if eno := n.fs.Delete(mctx, n.path("bucket", "locked")); eno != syscall.EPERM {
+		t.Fatalf("unlink a locked file: %s", eno)
+	}
+}
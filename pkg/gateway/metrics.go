@@ -0,0 +1,346 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	minio "github.com/minio/minio/cmd"
+	mlogger "github.com/minio/minio/cmd/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	s3ReqsHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3_request_durations_histogram_seconds",
+		Help:    "S3 requests latency distributions.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 1.5, 30),
+	}, []string{"api"})
+	s3ReqsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3_requests_total",
+		Help: "Number of S3 requests.",
+	}, []string{"api", "code"})
+	s3DataBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3_request_data_bytes",
+		Help: "S3 requests size in bytes.",
+	}, []string{"api"})
+)
+
+func InitMetrics() {
+	prometheus.MustRegister(s3ReqsHistogram)
+	prometheus.MustRegister(s3ReqsTotal)
+	prometheus.MustRegister(s3DataBytes)
+}
+
+// the method of ObjectLayer which serves an S3 API, others called by the same request are ignored
+var apiMethods = map[string]string{
+	"GetObject":             "GetObjectNInfo",
+	"HeadObject":            "GetObjectInfo",
+	"DeleteMultipleObjects": "DeleteObjects",
+	"ListObjectsV1":         "ListObjects",
+	"HeadBucket":            "GetBucketInfo",
+	"PutBucket":             "MakeBucketWithLocation",
+}
+
+// operations in S3 server access log
+var apiOperations = map[string]string{
+	"GetObject":               "REST.GET.OBJECT",
+	"HeadObject":              "REST.HEAD.OBJECT",
+	"PutObject":               "REST.PUT.OBJECT",
+	"CopyObject":              "REST.COPY.OBJECT",
+	"DeleteObject":            "REST.DELETE.OBJECT",
+	"DeleteMultipleObjects":   "REST.POST.MULTI_OBJECT_DELETE",
+	"ListObjectsV1":           "REST.GET.BUCKET",
+	"ListObjectsV2":           "REST.GET.BUCKET",
+	"ListBuckets":             "REST.GET.SERVICE",
+	"HeadBucket":              "REST.HEAD.BUCKET",
+	"PutBucket":               "REST.PUT.BUCKET",
+	"DeleteBucket":            "REST.DELETE.BUCKET",
+	"GetBucketLocation":       "REST.GET.LOCATION",
+	"NewMultipartUpload":      "REST.POST.UPLOADS",
+	"PutObjectPart":           "REST.PUT.PART",
+	"CopyObjectPart":          "REST.COPY.PART",
+	"CompleteMultipartUpload": "REST.POST.UPLOAD",
+	"AbortMultipartUpload":    "REST.DELETE.UPLOAD",
+	"ListObjectParts":         "REST.GET.UPLOAD",
+	"ListMultipartUploads":    "REST.GET.UPLOADS",
+}
+
+// errorCode returns the HTTP status and S3 error code of an error returned by ObjectLayer.
+func errorCode(err error) (int, string) {
+	switch err.(type) {
+	case nil:
+		return http.StatusOK, "-"
+	case minio.ObjectNotFound:
+		return http.StatusNotFound, "NoSuchKey"
+	case minio.BucketNotFound:
+		return http.StatusNotFound, "NoSuchBucket"
+	case minio.InvalidUploadID:
+		return http.StatusNotFound, "NoSuchUpload"
+	case minio.BucketLifecycleNotFound:
+		return http.StatusNotFound, "NoSuchLifecycleConfiguration"
+	case minio.PrefixAccessDenied:
+		return http.StatusForbidden, "AccessDenied"
+	case minio.BucketAlreadyOwnedByYou:
+		return http.StatusConflict, "BucketAlreadyOwnedByYou"
+	case minio.BucketAlreadyExists, minio.BucketExists:
+		return http.StatusConflict, "BucketAlreadyExists"
+	case minio.BucketNotEmpty:
+		return http.StatusConflict, "BucketNotEmpty"
+	case minio.BucketNameInvalid:
+		return http.StatusBadRequest, "InvalidBucketName"
+	case minio.ObjectNameInvalid:
+		return http.StatusBadRequest, "XMinioInvalidObjectName"
+	case minio.InvalidPart:
+		return http.StatusBadRequest, "InvalidPart"
+	case minio.InvalidRange:
+		return http.StatusRequestedRangeNotSatisfiable, "InvalidRange"
+	case minio.PreConditionFailed:
+		return http.StatusPreconditionFailed, "PreconditionFailed"
+	case minio.NotImplemented:
+		return http.StatusNotImplemented, "NotImplemented"
+	default:
+		return http.StatusInternalServerError, "InternalError"
+	}
+}
+
+type instrumentedObjects struct {
+	minio.ObjectLayer
+	accessLog *os.File
+}
+
+// Instrument collects metrics of S3 requests served by layer, and writes
+// them into accessLog (if not empty) in the format of S3 server access log.
+func Instrument(layer minio.ObjectLayer, accessLog string) (minio.ObjectLayer, error) {
+	o := &instrumentedObjects{ObjectLayer: layer}
+	if accessLog != "" {
+		f, err := os.OpenFile(accessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open access log %s: %s", accessLog, err)
+		}
+		o.accessLog = f
+	}
+	return o, nil
+}
+
+func (o *instrumentedObjects) Shutdown(ctx context.Context) error {
+	if o.accessLog != nil {
+		_ = o.accessLog.Close()
+	}
+	return o.ObjectLayer.Shutdown(ctx)
+}
+
+func quote(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strconv.Quote(s)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (o *instrumentedObjects) observe(ctx context.Context, method string, start time.Time, err error, bytes, size int64) {
+	req := mlogger.GetReqInfo(ctx)
+	api := method
+	if req != nil && req.API != "" {
+		api = req.API
+	}
+	if m, ok := apiMethods[api]; ok && m != method {
+		return
+	}
+	used := time.Since(start)
+	status, code := errorCode(err)
+	if err == nil && (api == "DeleteObject" || api == "DeleteBucket" || api == "AbortMultipartUpload") {
+		status = http.StatusNoContent
+	}
+	s3ReqsHistogram.WithLabelValues(api).Observe(used.Seconds())
+	s3ReqsTotal.WithLabelValues(api, strconv.Itoa(status)).Inc()
+	if bytes > 0 {
+		s3DataBytes.WithLabelValues(api).Add(float64(bytes))
+	}
+	if o.accessLog == nil || req == nil {
+		return
+	}
+	op, ok := apiOperations[api]
+	if !ok {
+		op = "REST." + api
+	}
+	var sent = "-"
+	if bytes > 0 {
+		sent = strconv.FormatInt(bytes, 10)
+	}
+	var osize = "-"
+	if size > 0 {
+		osize = strconv.FormatInt(size, 10)
+	}
+	var uri, referer = "-", "-"
+	if r := getRequest(ctx); r != nil {
+		uri = quote(r.method + " " + r.uri + " " + r.proto)
+		referer = quote(r.referer)
+	}
+	// bucket_owner bucket [time] remote_ip requester request_id operation key "request_uri" http_status
+	// error_code bytes_sent object_size total_time turn_around_time "referer" "user_agent" version_id
+	line := fmt.Sprintf("%s %s [%s] %s %s %s %s %s %s %d %s %s %s %d - %s %s -\n",
+		dash(req.AccessKey), dash(req.BucketName), start.Format("02/Jan/2006:15:04:05 -0700"), dash(req.RemoteHost),
+		dash(req.AccessKey), dash(req.RequestID), op, dash(req.ObjectName), uri, status, code, sent, osize,
+		used.Milliseconds(), referer, quote(req.UserAgent))
+	if _, err := o.accessLog.WriteString(line); err != nil {
+		logger.Warnf("write access log: %s", err)
+	}
+}
+
+type countedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countedReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (o *instrumentedObjects) GetObjectNInfo(ctx context.Context, bucket, object string, rs *minio.HTTPRangeSpec, h http.Header, lockType minio.LockType, opts minio.ObjectOptions) (*minio.GetObjectReader, error) {
+	start := time.Now()
+	gr, err := o.ObjectLayer.GetObjectNInfo(ctx, bucket, object, rs, h, lockType, opts)
+	if err != nil {
+		o.observe(ctx, "GetObjectNInfo", start, err, 0, 0)
+		return nil, err
+	}
+	r := &countedReader{r: gr}
+	return minio.NewGetObjectReaderFromReader(r, gr.ObjInfo, minio.ObjectOptions{}, func() {
+		_ = gr.Close()
+		o.observe(ctx, "GetObjectNInfo", start, nil, atomic.LoadInt64(&r.n), gr.ObjInfo.Size)
+	})
+}
+
+func (o *instrumentedObjects) GetObject(ctx context.Context, bucket, object string, startOffset, length int64, writer io.Writer, etag string, opts minio.ObjectOptions) (err error) {
+	defer func(start time.Time) { o.observe(ctx, "GetObject", start, err, length, 0) }(time.Now())
+	return o.ObjectLayer.GetObject(ctx, bucket, object, startOffset, length, writer, etag, opts)
+}
+
+func (o *instrumentedObjects) GetObjectInfo(ctx context.Context, bucket, object string, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "GetObjectInfo", start, err, 0, objInfo.Size) }(time.Now())
+	return o.ObjectLayer.GetObjectInfo(ctx, bucket, object, opts)
+}
+
+func (o *instrumentedObjects) PutObject(ctx context.Context, bucket, object string, data *minio.PutObjReader, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "PutObject", start, err, objInfo.Size, objInfo.Size) }(time.Now())
+	return o.ObjectLayer.PutObject(ctx, bucket, object, data, opts)
+}
+
+func (o *instrumentedObjects) CopyObject(ctx context.Context, srcBucket, srcObject, destBucket, destObject string, srcInfo minio.ObjectInfo, srcOpts, dstOpts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "CopyObject", start, err, 0, objInfo.Size) }(time.Now())
+	return o.ObjectLayer.CopyObject(ctx, srcBucket, srcObject, destBucket, destObject, srcInfo, srcOpts, dstOpts)
+}
+
+func (o *instrumentedObjects) DeleteObject(ctx context.Context, bucket, object string, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "DeleteObject", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.DeleteObject(ctx, bucket, object, opts)
+}
+
+func (o *instrumentedObjects) DeleteObjects(ctx context.Context, bucket string, objects []minio.ObjectToDelete, opts minio.ObjectOptions) ([]minio.DeletedObject, []error) {
+	start := time.Now()
+	deleted, errs := o.ObjectLayer.DeleteObjects(ctx, bucket, objects, opts)
+	var err error
+	for _, e := range errs {
+		if e != nil {
+			err = e
+			break
+		}
+	}
+	o.observe(ctx, "DeleteObjects", start, err, 0, 0)
+	return deleted, errs
+}
+
+func (o *instrumentedObjects) ListObjects(ctx context.Context, bucket, prefix, marker, delimiter string, maxKeys int) (result minio.ListObjectsInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "ListObjects", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.ListObjects(ctx, bucket, prefix, marker, delimiter, maxKeys)
+}
+
+func (o *instrumentedObjects) ListObjectsV2(ctx context.Context, bucket, prefix, continuationToken, delimiter string, maxKeys int, fetchOwner bool, startAfter string) (result minio.ListObjectsV2Info, err error) {
+	defer func(start time.Time) { o.observe(ctx, "ListObjectsV2", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.ListObjectsV2(ctx, bucket, prefix, continuationToken, delimiter, maxKeys, fetchOwner, startAfter)
+}
+
+func (o *instrumentedObjects) ListBuckets(ctx context.Context) (buckets []minio.BucketInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "ListBuckets", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.ListBuckets(ctx)
+}
+
+func (o *instrumentedObjects) GetBucketInfo(ctx context.Context, bucket string) (bi minio.BucketInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "GetBucketInfo", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.GetBucketInfo(ctx, bucket)
+}
+
+func (o *instrumentedObjects) MakeBucketWithLocation(ctx context.Context, bucket string, opts minio.BucketOptions) (err error) {
+	defer func(start time.Time) { o.observe(ctx, "MakeBucketWithLocation", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.MakeBucketWithLocation(ctx, bucket, opts)
+}
+
+func (o *instrumentedObjects) DeleteBucket(ctx context.Context, bucket string, forceDelete bool) (err error) {
+	defer func(start time.Time) { o.observe(ctx, "DeleteBucket", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.DeleteBucket(ctx, bucket, forceDelete)
+}
+
+func (o *instrumentedObjects) NewMultipartUpload(ctx context.Context, bucket, object string, opts minio.ObjectOptions) (uploadID string, err error) {
+	defer func(start time.Time) { o.observe(ctx, "NewMultipartUpload", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.NewMultipartUpload(ctx, bucket, object, opts)
+}
+
+func (o *instrumentedObjects) PutObjectPart(ctx context.Context, bucket, object, uploadID string, partID int, data *minio.PutObjReader, opts minio.ObjectOptions) (info minio.PartInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "PutObjectPart", start, err, info.Size, info.Size) }(time.Now())
+	return o.ObjectLayer.PutObjectPart(ctx, bucket, object, uploadID, partID, data, opts)
+}
+
+func (o *instrumentedObjects) CopyObjectPart(ctx context.Context, srcBucket, srcObject, destBucket, destObject string, uploadID string, partID int,
+	startOffset int64, length int64, srcInfo minio.ObjectInfo, srcOpts, dstOpts minio.ObjectOptions) (info minio.PartInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "CopyObjectPart", start, err, 0, info.Size) }(time.Now())
+	return o.ObjectLayer.CopyObjectPart(ctx, srcBucket, srcObject, destBucket, destObject, uploadID, partID, startOffset, length, srcInfo, srcOpts, dstOpts)
+}
+
+func (o *instrumentedObjects) CompleteMultipartUpload(ctx context.Context, bucket, object, uploadID string, uploadedParts []minio.CompletePart, opts minio.ObjectOptions) (objInfo minio.ObjectInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "CompleteMultipartUpload", start, err, 0, objInfo.Size) }(time.Now())
+	return o.ObjectLayer.CompleteMultipartUpload(ctx, bucket, object, uploadID, uploadedParts, opts)
+}
+
+func (o *instrumentedObjects) AbortMultipartUpload(ctx context.Context, bucket, object, uploadID string, opts minio.ObjectOptions) (err error) {
+	defer func(start time.Time) { o.observe(ctx, "AbortMultipartUpload", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.AbortMultipartUpload(ctx, bucket, object, uploadID, opts)
+}
+
+func (o *instrumentedObjects) ListObjectParts(ctx context.Context, bucket, object, uploadID string, partNumberMarker int, maxParts int, opts minio.ObjectOptions) (result minio.ListPartsInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "ListObjectParts", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.ListObjectParts(ctx, bucket, object, uploadID, partNumberMarker, maxParts, opts)
+}
+
+func (o *instrumentedObjects) ListMultipartUploads(ctx context.Context, bucket, prefix, keyMarker, uploadIDMarker, delimiter string, maxUploads int) (result minio.ListMultipartsInfo, err error) {
+	defer func(start time.Time) { o.observe(ctx, "ListMultipartUploads", start, err, 0, 0) }(time.Now())
+	return o.ObjectLayer.ListMultipartUploads(ctx, bucket, prefix, keyMarker, uploadIDMarker, delimiter, maxUploads)
+}
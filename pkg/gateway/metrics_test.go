@@ -0,0 +1,129 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	minio "github.com/minio/minio/cmd"
+	mlogger "github.com/minio/minio/cmd/logger"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeObjects struct {
+	minio.ObjectLayer
+}
+
+func (f *fakeObjects) GetObjectInfo(ctx context.Context, bucket, object string, opts minio.ObjectOptions) (minio.ObjectInfo, error) {
+	if object == "missing" {
+		return minio.ObjectInfo{}, minio.ObjectNotFound{Bucket: bucket, Object: object}
+	}
+	return minio.ObjectInfo{Bucket: bucket, Name: object, Size: 5000}, nil
+}
+
+func (f *fakeObjects) DeleteObject(ctx context.Context, bucket, object string, opts minio.ObjectOptions) (minio.ObjectInfo, error) {
+	return minio.ObjectInfo{}, nil
+}
+
+func (f *fakeObjects) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// serve runs call within an HTTP request passing through the middleware, like the handlers of MinIO.
+func serve(api, object string, header http.Header, call func(ctx context.Context)) {
+	r := httptest.NewRequest(http.MethodHead, "/bucket/"+object+"?versionId=1", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := mlogger.NewReqInfo("10.0.0.1", r.UserAgent(), "", "REQID", api, "bucket", object)
+		req.AccessKey = "admin"
+		call(mlogger.SetReqInfo(r.Context(), req))
+	})).ServeHTTP(httptest.NewRecorder(), r)
+}
+
+func TestMetrics(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	layer, err := Instrument(&fakeObjects{}, logPath)
+	if err != nil {
+		t.Fatalf("instrument: %s", err)
+	}
+	defer layer.Shutdown(context.Background())
+
+	ok := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("HeadObject", "200"))
+	notFound := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("HeadObject", "404"))
+	deleted := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("DeleteObject", "204"))
+	header := http.Header{"Referer": {"http://example.com/"}, "User-Agent": {"test-agent"}}
+	serve("HeadObject", "key", header, func(ctx context.Context) {
+		_, _ = layer.GetObjectInfo(ctx, "bucket", "key", minio.ObjectOptions{})
+	})
+	serve("HeadObject", "missing", nil, func(ctx context.Context) {
+		_, _ = layer.GetObjectInfo(ctx, "bucket", "missing", minio.ObjectOptions{})
+	})
+	serve("DeleteObject", "key", nil, func(ctx context.Context) {
+		_, _ = layer.DeleteObject(ctx, "bucket", "key", minio.ObjectOptions{})
+	})
+	// the same method called by another API is not counted
+	serve("GetObject", "key", nil, func(ctx context.Context) {
+		_, _ = layer.GetObjectInfo(ctx, "bucket", "key", minio.ObjectOptions{})
+	})
+
+	if v := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("HeadObject", "200")); v != ok+1 {
+		t.Fatalf("expect 1 successful HeadObject, got %v", v-ok)
+	}
+	if v := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("HeadObject", "404")); v != notFound+1 {
+		t.Fatalf("expect 1 failed HeadObject, got %v", v-notFound)
+	}
+	if v := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("DeleteObject", "204")); v != deleted+1 {
+		t.Fatalf("expect 1 DeleteObject, got %v", v-deleted)
+	}
+	if v := testutil.ToFloat64(s3ReqsTotal.WithLabelValues("GetObject", "200")); v != 0 {
+		t.Fatalf("GetObject should not be counted by GetObjectInfo, got %v", v)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read access log: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 lines in access log, got %d:\n%s", len(lines), data)
+	}
+	for _, expect := range []string{
+		"admin bucket [",
+		" 10.0.0.1 admin REQID REST.HEAD.OBJECT key ",
+		` "HEAD /bucket/key?versionId=1 HTTP/1.1" 200 - - 5000 `,
+		` - "http://example.com/" "test-agent" -`,
+	} {
+		if !strings.Contains(lines[0], expect) {
+			t.Fatalf("expect %q in access log: %s", expect, lines[0])
+		}
+	}
+	if !strings.Contains(lines[1], ` "HEAD /bucket/missing?versionId=1 HTTP/1.1" 404 NoSuchKey - - `) ||
+		!strings.HasSuffix(lines[1], ` - - - -`) {
+		t.Fatalf("unexpected access log: %s", lines[1])
+	}
+	if !strings.Contains(lines[2], " REST.DELETE.OBJECT key ") || !strings.Contains(lines[2], " 204 - - - ") {
+		t.Fatalf("unexpected access log: %s", lines[2])
+	}
+}
@@ -18,8 +18,11 @@ package meta
 
 import (
 	"fmt"
+	"math/rand"
+	"path"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -32,27 +35,90 @@ import (
 const (
 	inodeBatch   = 100
 	chunkIDBatch = 1000
+	// max number of retries of a forced compaction when the chunk is changed by others
+	maxCompactRetries = 10
 )
 
 type engine interface {
 	incrCounter(name string, value int64) (int64, error)
 
 	doCleanStaleSession(sid uint64)
+	doRefreshOpenFiles(sid uint64, files map[Ino]int) error
 	doDeleteSustainedInode(sid uint64, inode Ino) error
 	doDeleteFileData(inode Ino, length uint64)
 	doDeleteSlice(chunkid uint64, size uint32) error
+	doAddEvent(e *Event) error
+	// doReadEvents returns up to limit events with ID bigger than after, ordered by ID.
+	doReadEvents(ctx Context, after uint64, limit int) ([]*Event, error)
+	// doCleanupEvents deletes the events added before edge and returns the number of them.
+	doCleanupEvents(edge time.Time) (int, error)
+	// doCountUnrefSlices adds the slices whose refs are negative (to be deleted) or zero (never used) into stats.
+	doCountUnrefSlices(ctx Context, stats *GCStats) error
+	// doScanInodes calls fn with every inode and its attributes until fn returns false.
+	doScanInodes(ctx Context, fn func(inode Ino, attr *Attr) bool) error
+	// doNotify tells other clients to invalidate their cached metadata by msg.
+	doNotify(msg string) error
+	// doWatch calls cb with the messages from doNotify of all clients, it blocks until the watching fails.
+	doWatch(cb func(msg string)) error
 
 	doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	doLookup(ctx Context, parent Ino, name string, inode *Ino, attr *Attr) syscall.Errno
 	doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno
+	// doBatchMknod creates empty files or directories in a directory (not in trash) in one transaction,
+	// the inode and result of every entry are set into inodes and sts. ENOTSUP means they should be
+	// created one by one.
+	doBatchMknod(ctx Context, parent Ino, names []string, _type uint8, mode, cumask uint16, inodes []Ino, sts []syscall.Errno) syscall.Errno
 	doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno
-	doUnlink(ctx Context, parent Ino, name string) syscall.Errno
+	// doUnlink removes the entry, attr is filled with the attributes of the removed node.
+	doUnlink(ctx Context, parent Ino, name string, attr *Attr) syscall.Errno
+	// doBatchUnlink removes the file entries of a directory (not in trash) in one transaction, the
+	// result of every entry is set into sts, and the usage of removed ones is returned in space and
+	// inodes. ENOTSUP means they should be removed one by one.
+	doBatchUnlink(ctx Context, parent Ino, names []string, sts []syscall.Errno, space, inodes *int64) syscall.Errno
 	doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 	doReadlink(ctx Context, inode Ino) ([]byte, error)
+	// doGetParents returns the recorded parents of a hard linked file with the number of links in each.
+	doGetParents(ctx Context, inode Ino) (map[Ino]int, error)
+	// doTouchAtime sets atime to now if it still needs to be updated, and returns whether it's updated.
+	doTouchAtime(ctx Context, inode Ino, attr *Attr, now time.Time) (bool, error)
+	Read(ctx Context, inode Ino, indx uint32, slices *[]Slice) syscall.Errno
 	doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno
-	doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno
+	// doReaddirAt appends about limit entries from cursor and returns the cursor to continue with.
+	doReaddirAt(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, error)
+	doFillAttrs(ctx Context, entries []*Entry) syscall.Errno
+	// doGetDirSummary adds up the entries other than directories in a directory into summary,
+	// and returns the sub-directories.
+	doGetDirSummary(ctx Context, inode Ino, summary *Summary) ([]Ino, syscall.Errno)
+	// doRename fills inode and attr with the renamed node, and rinode and rattr with the replaced
+	// (or exchanged) one, rinode is left as 0 if there is none.
+	doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode, rinode *Ino, attr, rattr *Attr) syscall.Errno
 	GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno
-	SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
+	ListXattr(ctx Context, inode Ino, dbuff *[]byte) syscall.Errno
+	SetAttr(ctx Context, inode Ino, set uint16, sggidclearmode uint8, attr *Attr) syscall.Errno
+	CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno
+	doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
+	doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	doTag(inode Ino, key string, value []byte, add bool) error
+	doFindTagged(key string, value []byte) ([]tagged, error)
+	// doFind returns about limit entries from cursor with their attributes (Parent is the directory
+	// found in), and the cursor to continue with. It could skip the ones not selected by filter.
+	doFind(ctx Context, filter *FindFilter, cursor string, limit int, entries *[]*Entry) (string, error)
+	doGetQuota(inode Ino) (*Quota, error)
+	doSetQuota(inode Ino, quota *Quota) error
+	doDelQuota(inode Ino) error
+	doLoadQuotas() (map[Ino]*Quota, error)
+	// doFlushQuotas adds UsedSpace and UsedInodes in quotas to the existing ones.
+	doFlushQuotas(quotas map[Ino]*Quota) error
+	// doFlushSustained adds the changes of space and inodes held by sustained files to the counters.
+	doFlushSustained(space, inodes int64) error
+	compactChunk(inode Ino, indx uint32, force bool)
+	findStaleSessions(edge time.Time, limit int) ([]uint64, error)
+	GetSession(sid uint64) (*Session, error)
+	doRefreshSession() error
+	Load() (*Format, error)
+	// dumpHeader returns the settings, counters, sustained inodes and delayed files without the tree.
+	dumpHeader() (*DumpedMeta, error)
+	dumpEntry(inode Ino) (*DumpedEntry, error)
 }
 
 type baseMeta struct {
@@ -64,6 +130,7 @@ type baseMeta struct {
 	subTrash     internalNode
 	sid          uint64
 	of           *openfiles
+	writing      *inodeQueue
 	removedFiles map[Ino]bool
 	compacting   map[uint64]bool
 	deleting     chan int
@@ -75,9 +142,22 @@ type baseMeta struct {
 	usedInodes   int64
 	umounting    bool
 
-	freeMu     sync.Mutex
-	freeInodes freeID
-	freeChunks freeID
+	quotaMu    sync.RWMutex
+	dirQuotas  map[Ino]*Quota
+	dirParents map[Ino]Ino // cached parents of directories
+	trashUsage Quota       // usage of the trash, saved as the quota of TrashInode
+	purging    int32
+
+	sustainedUsage Quota // usage of sustained inodes, saved in counters
+	pendingMu      sync.Mutex
+	pendingUsage   PendingUsage // cached by GetPendingUsage
+	pendingTime    time.Time
+
+	generation uint64
+
+	freeInodes idLease
+	freeChunks idLease
+	mc         *metaCache // cached attributes and entries, nil if disabled
 
 	en engine
 }
@@ -86,20 +166,50 @@ func newBaseMeta(conf *Config) baseMeta {
 	if conf.Retries == 0 {
 		conf.Retries = 30
 	}
+	if conf.Heartbeat == 0 {
+		conf.Heartbeat = time.Minute
+	}
+	of := newOpenFiles(conf.OpenCache)
+	var mc *metaCache
+	if conf.MetaCache > 0 {
+		mc = newMetaCache(conf.MetaCache)
+		of.mc = mc
+	}
 	return baseMeta{
 		conf:         conf,
 		root:         1,
-		of:           newOpenFiles(conf.OpenCache),
+		of:           of,
+		mc:           mc,
+		writing:      newInodeQueue(),
 		removedFiles: make(map[Ino]bool),
 		compacting:   make(map[uint64]bool),
 		deleting:     make(chan int, conf.MaxDeletes),
 		symlinks:     &sync.Map{},
+		freeInodes:   newIDLease("nextInode", inodeBatch, inodeBatch<<10),
+		freeChunks:   newIDLease("nextChunk", chunkIDBatch, chunkIDBatch<<10),
+		dirQuotas:    make(map[Ino]*Quota),
+		dirParents:   make(map[Ino]Ino),
 		msgCallbacks: &msgCallbacks{
 			callbacks: make(map[uint32]MsgCallback),
 		},
 	}
 }
 
+// Generation returns the generation of inode numbers, it's the number of loads plus one, so it's 1
+// for a volume never loaded from a dump.
+func (m *baseMeta) Generation() uint64 {
+	if g := atomic.LoadUint64(&m.generation); g > 0 {
+		return g
+	}
+	v, err := m.en.incrCounter("generation", 0)
+	if err != nil {
+		logger.Warnf("get counter generation: %s", err)
+		return 1
+	}
+	atomic.StoreUint64(&m.generation, uint64(v)+1)
+	return uint64(v) + 1
+}
+
 func (m *baseMeta) checkRoot(inode Ino) Ino {
 	if inode == 1 {
 		return m.root
@@ -134,6 +244,150 @@ func (m *baseMeta) CloseSession() error {
 	return nil
 }
 
+func (m *baseMeta) sessionTimeout() time.Duration {
+	if m.fmt.SessionTimeout > 0 {
+		return time.Duration(m.fmt.SessionTimeout) * time.Second
+	}
+	return time.Minute * 5
+}
+
+// sustainedGrace returns how long the sustained inodes of session sid are kept after they are
+// released. The ones left by dead sessions are kept for the grace period of volume in the
+// deletion queue, together with their data, so a client which lost its session can still use
+// the files it has open. They are purged by cleanupDeletedFiles, which retries the deletion
+// queue an hour (a minute for TKV) after the expire time, so they're kept up to that much longer.
+func (m *baseMeta) sustainedGrace(sid uint64) time.Duration {
+	if sid == 0 || sid == m.sid {
+		return 0
+	}
+	return time.Duration(m.fmt.SustainedGrace) * time.Second
+}
+
+func (m *baseMeta) ListDeferredFiles() ([]*DumpedDelFile, error) {
+	dm, err := m.en.dumpHeader()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	var files []*DumpedDelFile
+	for _, f := range dm.DelFiles {
+		if f.Expire > now {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (m *baseMeta) GetGCStats(ctx Context, stats *GCStats) syscall.Errno {
+	dm, err := m.en.dumpHeader()
+	if err != nil {
+		return errno(err)
+	}
+	for _, f := range dm.DelFiles {
+		stats.PendingFiles++
+		stats.PendingFileSpace += f.Length
+	}
+	return errno(m.en.doCountUnrefSlices(ctx, stats))
+}
+
+func (m *baseMeta) CleanStaleSessions(filter *SessionFilter) {
+	timeout := m.sessionTimeout()
+	var hostname string
+	if filter != nil {
+		hostname = filter.Hostname
+		if filter.Idle > 0 {
+			timeout = filter.Idle
+		}
+	}
+	sids, err := m.en.findStaleSessions(time.Now().Add(-timeout), 100)
+	if err != nil {
+		logger.Warnf("scan stale sessions: %s", err)
+		return
+	}
+	staleSessions.Set(float64(len(sids)))
+	for _, sid := range sids {
+		if hostname != "" {
+			if s, err := m.en.GetSession(sid); err != nil || s.Hostname != hostname && s.IP != hostname {
+				continue
+			}
+		}
+		logger.Infof("clean up stale session %d", sid)
+		m.en.doCleanStaleSession(sid)
+	}
+}
+
+// KillSession removes the session sid no matter whether it's still active, releasing its locks and
+// deleting its sustained inodes. It should only be used when the client is gone for good.
+func (m *baseMeta) KillSession(sid uint64) error {
+	if sid == m.sid && sid != 0 {
+		return fmt.Errorf("can't kill the session of this client: %d", sid)
+	}
+	if _, err := m.en.GetSession(sid); err != nil {
+		return fmt.Errorf("get session %d: %s", sid, err)
+	}
+	logger.Infof("kill session %d", sid)
+	m.en.doCleanStaleSession(sid)
+	if _, err := m.en.GetSession(sid); err == nil {
+		return fmt.Errorf("session %d is not cleaned up completely, please try again", sid)
+	}
+	return nil
+}
+
+// refreshSession updates the heartbeat of the session periodically. The interval is
+// randomized by up to 20% to spread the heartbeats of many clients, and failed ones
+// are retried with exponential backoff.
+func (m *baseMeta) refreshSession() {
+	interval := m.conf.Heartbeat
+	if timeout := m.sessionTimeout(); interval*2 > timeout {
+		logger.Warnf("Heartbeat interval %s is too long for session timeout %s", interval, timeout)
+	}
+	wait := interval
+	last := time.Now()
+	var failures int
+	for {
+		time.Sleep(wait + time.Duration(rand.Int63n(int64(wait)/5+1)) - wait/10)
+		m.Lock()
+		if m.umounting {
+			m.Unlock()
+			return
+		}
+		err := m.en.doRefreshSession()
+		m.Unlock()
+		if err != nil {
+			failures++
+			logger.Warnf("Heartbeat failed (%d times, last succeeded %s ago): %s", failures, time.Since(last).Truncate(time.Second), err)
+			if time.Since(last) > m.sessionTimeout()/2 {
+				logger.Errorf("Session %d may be cleaned up by other clients as no heartbeat in %s", m.sid, time.Since(last).Truncate(time.Second))
+			}
+			if wait = time.Second << failures; wait > interval {
+				wait = interval
+			}
+			continue
+		}
+		if missed := time.Since(last); missed > interval*2 {
+			logger.Warnf("Heartbeat is missed for %s", missed.Truncate(time.Second))
+		}
+		failures = 0
+		last = time.Now()
+		wait = interval
+		m.refreshOpenFiles()
+		if _, err := m.en.Load(); err != nil {
+			logger.Warnf("reload setting: %s", err)
+		}
+		go m.CleanStaleSessions(nil)
+	}
+}
+
+func (m *baseMeta) refreshOpenFiles() {
+	if err := m.en.doRefreshOpenFiles(m.sid, m.of.Snapshot()); err != nil {
+		logger.Warnf("refresh open files of session %d: %s", m.sid, err)
+	}
+}
+
+func (m *baseMeta) tooManyOpenFiles() bool {
+	return m.conf.MaxOpenFiles > 0 && m.of.Handles() >= m.conf.MaxOpenFiles
+}
+
 func (m *baseMeta) refreshUsage() {
 	for {
 		if v, err := m.en.incrCounter(usedSpace, 0); err == nil {
@@ -142,12 +396,13 @@ func (m *baseMeta) refreshUsage() {
 		if v, err := m.en.incrCounter(totalInodes, 0); err == nil {
 			atomic.StoreInt64(&m.usedInodes, v)
 		}
+		m.loadQuotas()
 		time.Sleep(time.Second * 10)
 	}
 }
 
 func (m *baseMeta) checkQuota(size, inodes int64) bool {
-	if size > 0 && m.fmt.Capacity > 0 && atomic.LoadInt64(&m.usedSpace)+atomic.LoadInt64(&m.newSpace)+size > int64(m.fmt.Capacity) {
+	if size > 0 && m.fmt.Capacity > 0 && atomic.LoadInt64(&m.usedSpace)+atomic.LoadInt64(&m.newSpace)+m.trashReserved()+size > int64(m.fmt.Capacity) {
 		return true
 	}
 	return inodes > 0 && m.fmt.Inodes > 0 && atomic.LoadInt64(&m.usedInodes)+atomic.LoadInt64(&m.newInodes)+inodes > int64(m.fmt.Inodes)
@@ -178,6 +433,15 @@ func (m *baseMeta) flushStats() {
 	}
 }
 
+// flushUsage saves the usage of directories with quota, the trash and sustained files periodically.
+func (m *baseMeta) flushUsage() {
+	for {
+		m.flushQuotas()
+		m.flushSustained()
+		time.Sleep(time.Second)
+	}
+}
+
 func (m *baseMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno {
 	defer timeit(time.Now())
 	var used, inodes int64
@@ -213,6 +477,12 @@ func (m *baseMeta) StatFS(ctx Context, totalspace, availspace, iused, iavail *ui
 		}
 	}
 	*availspace = *totalspace - uint64(used)
+	// the unused part of trash quota is reserved for removed files
+	if r := uint64(m.trashReserved()); *availspace > r {
+		*availspace -= r
+	} else {
+		*availspace = 0
+	}
 	if inodes < 0 {
 		inodes = 0
 	}
@@ -281,7 +551,20 @@ func (m *baseMeta) Lookup(ctx Context, parent Ino, name string, inode *Ino, attr
 		*inode = TrashInode
 		return 0
 	}
+	if m.mc != nil {
+		if ino, ok := m.mc.getEntry(parent, name); ok {
+			if m.GetAttr(ctx, ino, attr) == 0 {
+				*inode = ino
+				return 0
+			}
+			m.mc.invalidateEntry(parent, name)
+		}
+	}
 	st := m.en.doLookup(ctx, parent, name, inode, attr)
+	if st == 0 && m.mc != nil {
+		m.mc.putEntry(parent, name, *inode)
+		m.mc.putAttr(*inode, attr)
+	}
 	if st == syscall.ENOENT && m.conf.CaseInsensi {
 		if e := m.resolveCase(ctx, parent, name); e != nil {
 			*inode = e.Inode
@@ -396,6 +679,9 @@ func (m *baseMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	if m.conf.OpenCache > 0 && m.of.Check(inode, attr) {
 		return 0
 	}
+	if m.mc != nil && m.mc.getAttr(inode, attr) {
+		return 0
+	}
 	defer timeit(time.Now())
 	var err syscall.Errno
 	if inode == 1 {
@@ -415,28 +701,65 @@ func (m *baseMeta) GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	}
 	if err == 0 {
 		m.of.Update(inode, attr)
+		if m.mc != nil && inode != 1 {
+			m.mc.putAttr(inode, attr)
+		}
 	}
 	return err
 }
 
 func (m *baseMeta) nextInode() (Ino, error) {
-	m.freeMu.Lock()
-	defer m.freeMu.Unlock()
-	if m.freeInodes.next >= m.freeInodes.maxid {
-		v, err := m.en.incrCounter("nextInode", inodeBatch)
+	for {
+		n, err := m.freeInodes.alloc(m.en)
 		if err != nil {
 			return 0, err
 		}
-		m.freeInodes.next = uint64(v) - inodeBatch
-		m.freeInodes.maxid = uint64(v)
+		if n > 1 {
+			return Ino(namespaced(m.fmt.ClusterID, n)), nil
+		}
 	}
-	n := m.freeInodes.next
-	m.freeInodes.next++
-	for n <= 1 {
-		n = m.freeInodes.next
-		m.freeInodes.next++
+}
+
+func (m *baseMeta) mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
+	parent = m.checkRoot(parent)
+	if m.checkDirQuota(ctx, parent, align4K(0), 1) {
+		return syscall.EDQUOT
+	}
+	st := m.en.doMknod(ctx, parent, name, _type, mode, cumask, rdev, path, inode, attr)
+	if st == 0 {
+		m.updateDirQuota(ctx, parent, align4K(0), 1)
+		e := &Event{Type: EventCreate, Parent: parent, Name: name}
+		if inode != nil {
+			e.Inode = *inode
+		}
+		m.emit(e)
+		m.invalidateEntry(parent, name)
 	}
-	return Ino(n), nil
+	return st
+}
+
+// inheritedXattrs returns the xattrs of a new child of the directory with xattrs, derived from the
+// default xattrs of it (see DefaultXattrPrefix). They are set in the transaction creating the child,
+// together with the index of the tags in them. The tags which can't be set are skipped.
+func inheritedXattrs(xattrs map[string][]byte, dir bool) map[string][]byte {
+	var inherited map[string][]byte
+	for name, value := range xattrs {
+		if !strings.HasPrefix(name, DefaultXattrPrefix) || len(name) == len(DefaultXattrPrefix) {
+			continue
+		}
+		child := "user." + name[len(DefaultXattrPrefix):]
+		if strings.HasPrefix(child, TagPrefix) && !validTag(child[len(TagPrefix):], value) {
+			continue
+		}
+		if inherited == nil {
+			inherited = make(map[string][]byte)
+		}
+		inherited[child] = value
+		if dir {
+			inherited[name] = value
+		}
+	}
+	return inherited
 }
 
 func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, inode *Ino, attr *Attr) syscall.Errno {
@@ -447,7 +770,54 @@ func (m *baseMeta) Mknod(ctx Context, parent Ino, name string, _type uint8, mode
 		return syscall.EPERM
 	}
 	defer timeit(time.Now())
-	return m.en.doMknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+	return m.mknod(ctx, parent, name, _type, mode, cumask, rdev, "", inode, attr)
+}
+
+// the max number of entries created in a transaction by MknodBatch
+const mknodBatchSize = 500
+
+func (m *baseMeta) MknodBatch(ctx Context, parent Ino, names []string, _type uint8, mode, cumask uint16, inodes []Ino, sts []syscall.Errno) syscall.Errno {
+	if len(inodes) != len(names) || len(sts) != len(names) || _type != TypeFile && _type != TypeDirectory {
+		return syscall.EINVAL
+	}
+	if isTrash(parent) {
+		return syscall.EPERM
+	}
+	parent = m.checkRoot(parent)
+	// case insensitive names are resolved one by one
+	batched := !m.conf.CaseInsensi
+	for _, name := range names {
+		if parent == 1 && name == TrashName {
+			batched = false // rejected by Mknod
+		}
+	}
+	defer timeit(time.Now())
+	for start := 0; start < len(names); start += mknodBatchSize {
+		end := start + mknodBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		var st syscall.Errno = syscall.ENOTSUP
+		// the quota is checked for every entry if it could be exceeded
+		if n := int64(end - start); batched && !m.checkDirQuota(ctx, parent, align4K(0)*n, n) {
+			st = m.en.doBatchMknod(ctx, parent, names[start:end], _type, mode, cumask, inodes[start:end], sts[start:end])
+			if st != 0 && st != syscall.ENOTSUP {
+				return st
+			}
+		}
+		var n int64
+		for i := start; i < end; i++ {
+			if st == syscall.ENOTSUP {
+				sts[i] = m.Mknod(ctx, parent, names[i], _type, mode, cumask, 0, &inodes[i], nil)
+			} else if sts[i] == 0 {
+				n++
+				m.emit(&Event{Type: EventCreate, Parent: parent, Name: names[i], Inode: inodes[i]})
+				m.invalidateEntry(parent, names[i])
+			}
+		}
+		m.updateDirQuota(ctx, parent, align4K(0)*n, n)
+	}
+	return 0
 }
 
 func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
@@ -457,11 +827,14 @@ func (m *baseMeta) Create(ctx Context, parent Ino, name string, mode uint16, cum
 	if parent == 1 && name == TrashName {
 		return syscall.EPERM
 	}
+	if m.tooManyOpenFiles() {
+		return syscall.EMFILE
+	}
 	defer timeit(time.Now())
 	if attr == nil {
 		attr = &Attr{}
 	}
-	err := m.en.doMknod(ctx, parent, name, TypeFile, mode, cumask, 0, "", inode, attr)
+	err := m.mknod(ctx, parent, name, TypeFile, mode, cumask, 0, "", inode, attr)
 	if err == syscall.EEXIST && (flags&syscall.O_EXCL) == 0 && attr.Typ == TypeFile {
 		err = 0
 	}
@@ -479,7 +852,7 @@ func (m *baseMeta) Mkdir(ctx Context, parent Ino, name string, mode uint16, cuma
 		return syscall.EPERM
 	}
 	defer timeit(time.Now())
-	return m.en.doMknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, "", inode, attr)
+	return m.mknod(ctx, parent, name, TypeDirectory, mode, cumask, 0, "", inode, attr)
 }
 
 func (m *baseMeta) Symlink(ctx Context, parent Ino, name string, path string, inode *Ino, attr *Attr) syscall.Errno {
@@ -490,7 +863,7 @@ func (m *baseMeta) Symlink(ctx Context, parent Ino, name string, path string, in
 		return syscall.EPERM
 	}
 	defer timeit(time.Now())
-	return m.en.doMknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
+	return m.mknod(ctx, parent, name, TypeSymlink, 0644, 022, 0, path, inode, attr)
 }
 
 func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
@@ -503,7 +876,77 @@ func (m *baseMeta) Link(ctx Context, inode, parent Ino, name string, attr *Attr)
 	defer timeit(time.Now())
 	parent = m.checkRoot(parent)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return m.en.doLink(ctx, inode, parent, name, attr)
+	var space, inodes int64
+	if m.hasDirQuotas() {
+		var a Attr
+		if st := m.en.doGetAttr(ctx, inode, &a); st == 0 {
+			space, inodes = usage(&a)
+		}
+		if m.checkDirQuota(ctx, parent, space, inodes) {
+			return syscall.EDQUOT
+		}
+	}
+	st := m.en.doLink(ctx, inode, parent, name, attr)
+	if st == 0 {
+		m.updateDirQuota(ctx, parent, space, inodes)
+		m.emit(&Event{Type: EventCreate, Inode: inode, Parent: parent, Name: name})
+		m.invalidateEntry(parent, name)
+	}
+	return st
+}
+
+func (m *baseMeta) GetParents(ctx Context, inode Ino) map[Ino]int {
+	inode = m.checkRoot(inode)
+	defer timeit(time.Now())
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		logger.Warnf("Get attr of inode %d: %s", inode, st)
+		return nil
+	}
+	if attr.Typ != TypeDirectory && attr.Nlink > 1 {
+		parents, err := m.en.doGetParents(ctx, inode)
+		if err != nil {
+			logger.Warnf("Get parents of inode %d: %s", inode, err)
+			return nil
+		}
+		if len(parents) > 0 {
+			return parents
+		}
+		// linked before the parents are recorded
+	}
+	return map[Ino]int{attr.Parent: 1}
+}
+
+// updateParents moves a link of a hard linked file from directory src to dst, src is 0 for a new link and dst is 0
+// for a removed one. parents are the recorded parents of the file (empty if it had only one link), and attr is its
+// attributes with Nlink updated. It returns the new parents (nil if it has only one link now), and keeps attr.Parent
+// as one of them.
+func updateParents(parents map[Ino]int, attr *Attr, src, dst Ino) map[Ino]int {
+	if len(parents) == 0 {
+		parents = make(map[Ino]int)
+		if attr.Parent > 0 {
+			parents[attr.Parent] = 1
+		}
+	}
+	if src > 0 {
+		if parents[src]--; parents[src] <= 0 {
+			delete(parents, src)
+		}
+	}
+	if dst > 0 {
+		parents[dst]++
+	}
+	if _, ok := parents[attr.Parent]; !ok {
+		for p := range parents {
+			if !ok || p < attr.Parent {
+				attr.Parent, ok = p, true
+			}
+		}
+	}
+	if attr.Nlink <= 1 {
+		return nil
+	}
+	return parents
 }
 
 func (m *baseMeta) ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno {
@@ -530,7 +973,69 @@ func (m *baseMeta) Unlink(ctx Context, parent Ino, name string) syscall.Errno {
 	}
 	defer timeit(time.Now())
 	parent = m.checkRoot(parent)
-	return m.en.doUnlink(ctx, parent, name)
+	var attr Attr
+	toTrash := m.toTrash(parent)
+	st := m.en.doUnlink(ctx, parent, name, &attr)
+	if st == 0 {
+		m.emit(&Event{Type: EventDelete, Parent: parent, Name: name})
+		m.invalidateEntry(parent, name)
+		space, inodes := usage(&attr)
+		m.updateDirQuota(ctx, parent, -space, -inodes)
+		if toTrash {
+			m.updateTrashUsage(space, inodes)
+		} else if isTrash(parent) {
+			m.updateTrashUsage(-space, -inodes)
+		}
+	}
+	return st
+}
+
+// the max number of entries removed in a transaction by UnlinkBatch
+const unlinkBatchSize = 500
+
+func (m *baseMeta) UnlinkBatch(ctx Context, parent Ino, names []string, sts []syscall.Errno) syscall.Errno {
+	if len(sts) != len(names) {
+		return syscall.EINVAL
+	}
+	if isTrash(parent) && ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	parent = m.checkRoot(parent)
+	// the ones moved into trash are counted by the trash, and case insensitive names are resolved one by one
+	batched := !m.toTrash(parent) && !isTrash(parent) && !m.conf.CaseInsensi
+	for _, name := range names {
+		if parent == 1 && name == TrashName {
+			batched = false // rejected by Unlink
+		}
+	}
+	defer timeit(time.Now())
+	for start := 0; start < len(names); start += unlinkBatchSize {
+		end := start + unlinkBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		var st syscall.Errno = syscall.ENOTSUP
+		if batched {
+			var space, inodes int64
+			if st = m.en.doBatchUnlink(ctx, parent, names[start:end], sts[start:end], &space, &inodes); st == 0 {
+				m.updateDirQuota(ctx, parent, -space, -inodes)
+			} else if st != syscall.ENOTSUP {
+				return st
+			}
+		}
+		for i := start; i < end; i++ {
+			if st == syscall.ENOTSUP {
+				sts[i] = m.Unlink(ctx, parent, names[i])
+			} else if sts[i] == 0 {
+				m.emit(&Event{Type: EventDelete, Parent: parent, Name: names[i]})
+				m.invalidateEntry(parent, names[i])
+			}
+		}
+		if st == syscall.ENOTSUP {
+			batched = false
+		}
+	}
+	return 0
 }
 
 func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
@@ -545,7 +1050,142 @@ func (m *baseMeta) Rmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	}
 	defer timeit(time.Now())
 	parent = m.checkRoot(parent)
-	return m.en.doRmdir(ctx, parent, name)
+	toTrash := m.toTrash(parent)
+	st := m.en.doRmdir(ctx, parent, name)
+	if st == 0 {
+		m.emit(&Event{Type: EventDelete, Parent: parent, Name: name})
+		m.invalidateEntry(parent, name)
+		m.updateDirQuota(ctx, parent, -align4K(0), -1)
+		if toTrash {
+			m.updateTrashUsage(align4K(0), 1)
+		} else if isTrash(parent) {
+			m.updateTrashUsage(-align4K(0), -1)
+		}
+	}
+	return st
+}
+
+func (m *baseMeta) Remove(ctx Context, parent Ino, name string, count *uint64) syscall.Errno {
+	if st := m.Access(ctx, parent, 3, nil); st != 0 {
+		return st
+	}
+	var inode Ino
+	var attr Attr
+	if st := m.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		st := m.Unlink(ctx, parent, name)
+		if st == 0 && count != nil {
+			atomic.AddUint64(count, 1)
+		}
+		return st
+	}
+	concurrent := make(chan int, 50)
+	return m.emptyEntry(ctx, parent, name, inode, concurrent, count)
+}
+
+// emptyDir removes all the entries in a directory, the sub-directories are emptied concurrently.
+func (m *baseMeta) emptyDir(ctx Context, inode Ino, concurrent chan int, count *uint64) (st syscall.Errno) {
+	if st := m.Access(ctx, inode, 3, nil); st != 0 {
+		return st
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var status syscall.Errno // the first error of the subdirectories emptied in background
+	defer func() {
+		wg.Wait()
+		if st == 0 {
+			st = status
+		}
+	}()
+	var cursor string
+	for {
+		var entries []*Entry
+		next, err := m.en.doReaddirAt(ctx, inode, ReaddirType, cursor, unlinkBatchSize, &entries)
+		if err != nil {
+			return errno(err)
+		}
+		var names []string
+		for _, e := range entries {
+			if e.Attr.Typ != TypeDirectory {
+				names = append(names, string(e.Name))
+				continue
+			}
+			select {
+			case concurrent <- 1:
+				wg.Add(1)
+				go func(child Ino, name string) {
+					defer wg.Done()
+					if st := m.emptyEntry(ctx, inode, name, child, concurrent, count); st != 0 {
+						mu.Lock()
+						if status == 0 {
+							status = st
+						}
+						mu.Unlock()
+					}
+					<-concurrent
+				}(e.Inode, string(e.Name))
+			default:
+				if st := m.emptyEntry(ctx, inode, string(e.Name), e.Inode, concurrent, count); st != 0 {
+					return st
+				}
+			}
+		}
+		if len(names) > 0 {
+			sts := make([]syscall.Errno, len(names))
+			if st := m.UnlinkBatch(ctx, inode, names, sts); st != 0 {
+				return st
+			}
+			for _, st := range sts {
+				if st == 0 && count != nil {
+					atomic.AddUint64(count, 1)
+				} else if st != 0 && st != syscall.ENOENT { // ENOENT: removed by others
+					return st
+				}
+			}
+		}
+		if next == "" {
+			break
+		}
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
+		cursor = next
+	}
+	return 0
+}
+
+func (m *baseMeta) emptyEntry(ctx Context, parent Ino, name string, inode Ino, concurrent chan int, count *uint64) syscall.Errno {
+	st := m.emptyDir(ctx, inode, concurrent, count)
+	if st == 0 {
+		st = m.Rmdir(ctx, parent, name)
+		if st == syscall.ENOTEMPTY {
+			st = m.emptyEntry(ctx, parent, name, inode, concurrent, count)
+		} else if st == 0 && count != nil {
+			atomic.AddUint64(count, 1)
+		}
+	}
+	return st
+}
+
+// whiteoutAttr returns the attributes of a whiteout (a character device with 0/0 device
+// number) left in place of the source by rename with RenameWhiteout, used by overlayfs.
+func whiteoutAttr(ctx Context, parent Ino, now time.Time) *Attr {
+	return &Attr{
+		Typ:       TypeCharDev,
+		Uid:       ctx.Uid(),
+		Gid:       ctx.Gid(),
+		Atime:     now.Unix(),
+		Mtime:     now.Unix(),
+		Ctime:     now.Unix(),
+		Atimensec: uint32(now.Nanosecond()),
+		Mtimensec: uint32(now.Nanosecond()),
+		Ctimensec: uint32(now.Nanosecond()),
+		Nlink:     1,
+		Parent:    parent,
+		Full:      true,
+	}
 }
 
 func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
@@ -558,21 +1198,89 @@ func (m *baseMeta) Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 	switch flags {
 	case 0, RenameNoReplace, RenameExchange:
 	case RenameWhiteout, RenameNoReplace | RenameWhiteout:
-		return syscall.ENOTSUP
+		if isTrash(parentSrc) {
+			return syscall.EPERM
+		}
 	default:
 		return syscall.EINVAL
 	}
 	defer timeit(time.Now())
 	parentSrc = m.checkRoot(parentSrc)
 	parentDst = m.checkRoot(parentDst)
-	return m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, attr)
+	whiteout := flags&RenameWhiteout != 0
+	if whiteout && m.checkDirQuota(ctx, parentSrc, align4K(0), 1) {
+		return syscall.EDQUOT
+	}
+	var srcIno Ino
+	var srcAttr, dstAttr *Attr
+	if m.hasDirQuotas() {
+		srcAttr = &Attr{}
+		if m.en.doLookup(ctx, parentSrc, nameSrc, &srcIno, srcAttr) != 0 {
+			srcAttr = nil
+		}
+	}
+	exchange := flags == RenameExchange
+	if srcAttr != nil {
+		var dstIno Ino
+		dstAttr = &Attr{}
+		if m.en.doLookup(ctx, parentDst, nameDst, &dstIno, dstAttr) != 0 || dstIno == srcIno {
+			dstAttr = nil
+		}
+		if st := m.checkRenameQuota(ctx, parentSrc, parentDst, srcAttr, dstAttr, exchange); st != 0 {
+			return st
+		}
+	}
+	if inode == nil {
+		inode = new(Ino)
+	}
+	if attr == nil {
+		attr = &Attr{}
+	}
+	var rinode Ino
+	var rattr Attr
+	st := m.en.doRename(ctx, parentSrc, nameSrc, parentDst, nameDst, flags, inode, &rinode, attr, &rattr)
+	if st == 0 {
+		e := &Event{Type: EventRename, Parent: parentSrc, Name: nameSrc, NewParent: parentDst, NewName: nameDst}
+		if inode != nil {
+			e.Inode = *inode
+		}
+		m.emit(e)
+		m.invalidateEntry(parentSrc, nameSrc)
+		m.invalidateEntry(parentDst, nameDst)
+		if rinode > 0 && rinode != *inode && !exchange && m.toTrash(parentDst) { // the replaced one was moved into trash
+			m.updateTrashUsage(usage(&rattr))
+		}
+		if isTrash(parentSrc) { // restored from trash
+			space, inodes := usage(attr)
+			m.updateTrashUsage(-space, -inodes)
+		}
+	}
+	if st == 0 && whiteout {
+		m.updateDirQuota(ctx, parentSrc, align4K(0), 1)
+	}
+	if st == 0 && srcAttr != nil {
+		m.updateRenameQuota(ctx, parentSrc, parentDst, srcAttr, dstAttr, exchange)
+		if srcAttr.Typ == TypeDirectory {
+			m.quotaMu.Lock()
+			delete(m.dirParents, srcIno)
+			m.quotaMu.Unlock()
+		}
+	}
+	return st
 }
 
 func (m *baseMeta) Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscall.Errno {
 	if m.conf.ReadOnly && flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
 		return syscall.EROFS
 	}
+	if m.tooManyOpenFiles() {
+		return syscall.EMFILE
+	}
 	if m.conf.OpenCache > 0 && m.of.OpenCheck(inode, attr) {
+		if st := checkOpenFlags(attr, flags); st != 0 {
+			m.of.Close(inode)
+			return st
+		}
 		return 0
 	}
 	var err syscall.Errno
@@ -580,30 +1288,42 @@ func (m *baseMeta) Open(ctx Context, inode Ino, flags uint32, attr *Attr) syscal
 	if attr != nil && !attr.Full {
 		err = m.GetAttr(ctx, inode, attr)
 	}
+	if err == 0 {
+		err = checkOpenFlags(attr, flags)
+	}
 	if err == 0 {
 		m.of.Open(inode, attr)
 	}
 	return err
 }
 
+// checkOpenFlags checks the flags of open against the flags of inode: immutable ones can't be opened
+// for writing, and append-only ones can only be opened for writing with O_APPEND.
+func checkOpenFlags(attr *Attr, flags uint32) syscall.Errno {
+	if attr == nil || attr.Flags == 0 {
+		return 0
+	}
+	write := flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0
+	if attr.Flags&FlagImmutable != 0 && write {
+		return syscall.EPERM
+	}
+	if attr.Flags&FlagAppend != 0 && write && (flags&syscall.O_APPEND == 0 || flags&syscall.O_TRUNC != 0) {
+		return syscall.EPERM
+	}
+	return 0
+}
+
 func (m *baseMeta) InvalidateChunkCache(ctx Context, inode Ino, indx uint32) syscall.Errno {
 	m.of.InvalidateChunk(inode, indx)
 	return 0
 }
 
 func (m *baseMeta) NewChunk(ctx Context, chunkid *uint64) syscall.Errno {
-	m.freeMu.Lock()
-	defer m.freeMu.Unlock()
-	if m.freeChunks.next >= m.freeChunks.maxid {
-		v, err := m.en.incrCounter("nextChunk", chunkIDBatch)
-		if err != nil {
-			return errno(err)
-		}
-		m.freeChunks.next = uint64(v) - chunkIDBatch
-		m.freeChunks.maxid = uint64(v)
+	id, err := m.freeChunks.alloc(m.en)
+	if err != nil {
+		return errno(err)
 	}
-	*chunkid = m.freeChunks.next
-	m.freeChunks.next++
+	*chunkid = namespaced(m.fmt.ClusterID, id)
 	return 0
 }
 
@@ -643,7 +1363,297 @@ func (m *baseMeta) Readdir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 		Name:  []byte(".."),
 		Attr:  &Attr{Typ: TypeDirectory},
 	})
-	return m.en.doReaddir(ctx, inode, plus, entries)
+	if st := m.en.doReaddir(ctx, inode, plus, entries); st != 0 {
+		return st
+	}
+	trimAttrs(*entries, plus)
+	m.touchAtime(ctx, inode, &attr)
+	return 0
+}
+
+// trimAttrs clears the attributes not asked by wantattr.
+func trimAttrs(entries []*Entry, wantattr uint8) {
+	if wantattr == ReaddirType || wantattr&ReaddirFull != 0 {
+		return
+	}
+	for _, e := range entries {
+		a := Attr{Typ: e.Attr.Typ}
+		if wantattr&ReaddirSize != 0 {
+			a.Length = e.Attr.Length
+		}
+		if wantattr&ReaddirMtime != 0 {
+			a.Mtime, a.Mtimensec = e.Attr.Mtime, e.Attr.Mtimensec
+		}
+		*e.Attr = a
+	}
+}
+
+func (m *baseMeta) ReaddirAt(ctx Context, inode Ino, plus uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno {
+	inode = m.checkRoot(inode)
+	if limit <= 0 {
+		limit = 1000
+	}
+	*entries = (*entries)[:0]
+	if *cursor == "" {
+		var attr Attr
+		if err := m.GetAttr(ctx, inode, &attr); err != 0 {
+			return err
+		}
+		if inode == m.root {
+			attr.Parent = m.root
+		}
+		*entries = append(*entries, &Entry{
+			Inode: inode,
+			Name:  []byte("."),
+			Attr:  &Attr{Typ: TypeDirectory},
+		}, &Entry{
+			Inode: attr.Parent,
+			Name:  []byte(".."),
+			Attr:  &Attr{Typ: TypeDirectory},
+		})
+		defer m.touchAtime(ctx, inode, &attr)
+	}
+	defer timeit(time.Now())
+	next, err := m.en.doReaddirAt(ctx, inode, plus, *cursor, limit, entries)
+	if err != nil {
+		return errno(err)
+	}
+	trimAttrs(*entries, plus)
+	*cursor = next
+	return 0
+}
+
+func (m *baseMeta) TouchAtime(ctx Context, inode Ino) syscall.Errno {
+	inode = m.checkRoot(inode)
+	if m.conf.AtimeMode == NoAtime || m.conf.ReadOnly {
+		return 0
+	}
+	var attr Attr
+	if !m.of.CachedAttr(inode, &attr) {
+		if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+			return st
+		}
+	}
+	return m.touchAtime(ctx, inode, &attr)
+}
+
+// touchAtime updates atime of the inode according to the atime mode, attr is the known attributes of it.
+func (m *baseMeta) touchAtime(ctx Context, inode Ino, attr *Attr) syscall.Errno {
+	if m.conf.AtimeMode == NoAtime || m.conf.ReadOnly {
+		return 0
+	}
+	now := time.Now()
+	if !m.atimeNeedsUpdate(attr, now) {
+		return 0
+	}
+	updated, err := m.en.doTouchAtime(ctx, inode, attr, now)
+	if err != nil {
+		logger.Warnf("Update atime of inode %d: %s", inode, err)
+		return errno(err)
+	}
+	if updated {
+		m.of.Update(inode, attr)
+	}
+	return 0
+}
+
+// atimeNeedsUpdate returns whether atime should be updated to now. In relatime mode, it's updated if it's
+// earlier than mtime or ctime, or older than a day, so most reads don't write metadata; in strictatime mode,
+// it's updated on every access, but at most once per second for a file.
+func (m *baseMeta) atimeNeedsUpdate(attr *Attr, now time.Time) bool {
+	atime := time.Unix(attr.Atime, int64(attr.Atimensec))
+	switch m.conf.AtimeMode {
+	case NoAtime:
+		return false
+	case StrictAtime:
+		return now.Sub(atime) >= time.Second
+	default:
+		return atime.Before(time.Unix(attr.Mtime, int64(attr.Mtimensec))) ||
+			atime.Before(time.Unix(attr.Ctime, int64(attr.Ctimensec))) || now.Sub(atime) > time.Hour*24
+	}
+}
+
+func (m *baseMeta) GetSummary(ctx Context, inode Ino, summary *Summary, recursive bool) syscall.Errno {
+	inode = m.checkRoot(inode)
+	var attr Attr
+	if st := m.GetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	defer timeit(time.Now())
+	if attr.Typ != TypeDirectory {
+		summary.add(&attr)
+		return 0
+	}
+	return m.getDirSummary(ctx, inode, summary, recursive)
+}
+
+func (m *baseMeta) getDirSummary(ctx Context, inode Ino, summary *Summary, recursive bool) syscall.Errno {
+	if ctx.Canceled() {
+		return syscall.EINTR
+	}
+	dirs, st := m.en.doGetDirSummary(ctx, inode, summary)
+	if st != 0 {
+		return st
+	}
+	summary.Dirs++
+	summary.Size += 4096
+	for _, dir := range dirs {
+		if !recursive {
+			summary.Dirs++
+			summary.Size += 4096
+		} else if st = m.getDirSummary(ctx, dir, summary, true); st != 0 {
+			return st
+		}
+	}
+	return 0
+}
+
+// sumEntries adds up the entries other than directories into summary after their attributes
+// are filled by fill, and returns the inodes of directories.
+func sumEntries(ctx Context, entries []*Entry, summary *Summary, fill func(Context, []*Entry) syscall.Errno) ([]Ino, syscall.Errno) {
+	var dirs []Ino
+	var files []*Entry
+	for _, e := range entries {
+		if e.Attr.Typ == TypeDirectory {
+			dirs = append(dirs, e.Inode)
+		} else {
+			files = append(files, e)
+		}
+	}
+	if len(files) > 0 {
+		if st := fill(ctx, files); st != 0 {
+			return nil, st
+		}
+	}
+	for _, e := range files {
+		summary.add(e.Attr)
+	}
+	return dirs, 0
+}
+
+func (m *baseMeta) FillAttrs(ctx Context, entries []*Entry) syscall.Errno {
+	if len(entries) == 0 {
+		return 0
+	}
+	defer timeit(time.Now())
+	return m.en.doFillAttrs(ctx, entries)
+}
+
+func (m *baseMeta) Find(ctx Context, filter *FindFilter, cursor *string, limit int, entries *[]*Entry) syscall.Errno {
+	if _, err := path.Match(filter.Name, ""); err != nil {
+		return syscall.EINVAL
+	}
+	if limit <= 0 {
+		limit = 1000
+	}
+	defer timeit(time.Now())
+	var found []*Entry
+	next, err := m.en.doFind(ctx, filter, *cursor, limit, &found)
+	if err != nil {
+		return errno(err)
+	}
+	*entries = (*entries)[:0]
+	for _, e := range found {
+		// skip the ones removed after listed, and those in trash
+		if e.Attr.Full && !isTrash(e.Attr.Parent) && filter.Match(string(e.Name), e.Attr) {
+			*entries = append(*entries, e)
+		}
+	}
+	*cursor = next
+	return 0
+}
+
+func (m *baseMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+	if name == "" {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	if !strings.HasPrefix(name, TagPrefix) {
+		return m.en.doSetXattr(ctx, inode, name, value, flags)
+	}
+	key := name[len(TagPrefix):]
+	if !validTag(key, value) {
+		return syscall.EINVAL
+	}
+	var old []byte
+	st := m.en.GetXattr(ctx, inode, name, &old)
+	if st != 0 && st != ENOATTR {
+		return st
+	}
+	// the index is updated before the tag, so it always covers all the tags
+	if err := m.en.doTag(inode, key, value, true); err != nil {
+		return errno(err)
+	}
+	if st = m.en.doSetXattr(ctx, inode, name, value, flags); st != 0 {
+		return st
+	}
+	if old != nil && string(old) != string(value) {
+		if err := m.en.doTag(inode, key, old, false); err != nil {
+			logger.Warnf("remove tag %s=%s of inode %d from index: %s", key, old, inode, err)
+		}
+	}
+	return 0
+}
+
+func (m *baseMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	if name == "" {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	if !strings.HasPrefix(name, TagPrefix) {
+		return m.en.doRemoveXattr(ctx, inode, name)
+	}
+	var old []byte
+	if st := m.en.GetXattr(ctx, inode, name, &old); st != 0 {
+		return st
+	}
+	if st := m.en.doRemoveXattr(ctx, inode, name); st != 0 {
+		return st
+	}
+	if err := m.en.doTag(inode, name[len(TagPrefix):], old, false); err != nil {
+		logger.Warnf("remove tag %s=%s of inode %d from index: %s", name[len(TagPrefix):], old, inode, err)
+	}
+	return 0
+}
+
+// tagged is an entry in the index of tags.
+type tagged struct {
+	inode Ino
+	value []byte
+}
+
+func (m *baseMeta) ListTagged(ctx Context, key string, value []byte, inodes *[]Ino) syscall.Errno {
+	if key == "" || len(key) > maxTagLen || len(value) > maxTagLen {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	ts, err := m.en.doFindTagged(key, value)
+	if err != nil {
+		return errno(err)
+	}
+	*inodes = (*inodes)[:0]
+	for _, t := range ts {
+		if t.inode == 1 && m.root != 1 {
+			continue // not visible
+		}
+		var v []byte
+		st := m.en.GetXattr(ctx, t.inode, TagPrefix+key, &v)
+		if st == 0 && string(v) == string(t.value) {
+			*inodes = append(*inodes, t.inode)
+			continue
+		}
+		if st != 0 && st != ENOATTR {
+			return st
+		}
+		// the tag was changed or removed (maybe with the inode) after indexed
+		logger.Debugf("remove stale tag %s=%s of inode %d from index", key, t.value, t.inode)
+		if err = m.en.doTag(t.inode, key, t.value, false); err != nil {
+			logger.Warnf("remove tag %s=%s of inode %d from index: %s", key, t.value, t.inode, err)
+		}
+	}
+	return 0
 }
 
 func (m *baseMeta) fileDeleted(opened bool, inode Ino, length uint64) {
@@ -651,6 +1661,7 @@ func (m *baseMeta) fileDeleted(opened bool, inode Ino, length uint64) {
 		m.Lock()
 		m.removedFiles[inode] = true
 		m.Unlock()
+		m.sustainedUsage.update(align4K(length), 1)
 	} else {
 		go m.en.doDeleteFileData(inode, length)
 	}
@@ -677,6 +1688,13 @@ func (m *baseMeta) toTrash(parent Ino) bool {
 	return m.fmt.TrashDays > 0 && !isTrash(parent)
 }
 
+// skipDirMtime returns whether the update of mtime/ctime of a directory can be skipped,
+// so that concurrent renames in a busy directory will not contend on it.
+func (m *baseMeta) skipDirMtime(mtime, now time.Time) bool {
+	d := now.Sub(mtime)
+	return d >= 0 && d < m.conf.SkipDirMtime
+}
+
 func (m *baseMeta) checkTrash(parent Ino, trash *Ino) syscall.Errno {
 	if !m.toTrash(parent) {
 		return 0
@@ -730,11 +1748,14 @@ func (m *baseMeta) cleanupTrash() {
 			continue
 		}
 		if now := time.Now(); now.Sub(last) >= time.Hour {
-			if st := m.en.SetXattr(ctx, TrashInode, key, []byte(now.Format(time.RFC3339)), XattrCreateOrReplace); st != 0 {
+			if st := m.en.doSetXattr(ctx, TrashInode, key, []byte(now.Format(time.RFC3339)), XattrCreateOrReplace); st != 0 {
 				logger.Warnf("setxattr inode %d key %s: %s", TrashInode, key, st)
 				continue
 			}
-			go m.doCleanupTrash(false)
+			go func() {
+				m.doCleanupTrash(false)
+				m.recountTrash()
+			}()
 		}
 	}
 }
@@ -757,6 +1778,7 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 		}
 	}()
 
+	// the oldest entries are also purged when the trash quota is exceeded
 	edge := now.Add(-time.Duration(24*m.fmt.TrashDays+1) * time.Hour)
 	for _, e := range entries {
 		ts, err := time.Parse("2006-01-02-15", string(e.Name))
@@ -764,21 +1786,27 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 			logger.Warnf("bad entry as a subTrash: %s", e.Name)
 			continue
 		}
-		if ts.Before(edge) || force {
+		expired := ts.Before(edge) || force
+		if expired || m.trashExceeded() {
 			var subEntries []*Entry
-			if st = m.en.doReaddir(ctx, e.Inode, 0, &subEntries); st != 0 {
+			if st = m.en.doReaddir(ctx, e.Inode, 1, &subEntries); st != 0 {
 				logger.Warnf("readdir subTrash %d: %s", e.Inode, st)
 				continue
 			}
 			rmdir := true
 			for _, se := range subEntries {
+				if !expired && !m.trashExceeded() {
+					return
+				}
 				if se.Attr.Typ == TypeDirectory {
 					st = m.en.doRmdir(ctx, e.Inode, string(se.Name))
 				} else {
-					st = m.en.doUnlink(ctx, e.Inode, string(se.Name))
+					st = m.en.doUnlink(ctx, e.Inode, string(se.Name), &Attr{})
 				}
 				if st == 0 {
 					count++
+					space, inodes := usage(se.Attr)
+					m.updateTrashUsage(-space, -inodes)
 				} else {
 					logger.Warnf("delete from trash %s/%s: %s", e.Name, se.Name, st)
 					rmdir = false
@@ -788,9 +1816,15 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 					return
 				}
 			}
-			if rmdir {
+			if rmdir && expired { // the recent one could be still in use
 				if st = m.en.doRmdir(ctx, TrashInode, string(e.Name)); st != 0 {
 					logger.Warnf("rmdir subTrash %s: %s", e.Name, st)
+				} else {
+					m.Lock()
+					if m.subTrash.inode == e.Inode {
+						m.subTrash = internalNode{}
+					}
+					m.Unlock()
 				}
 			}
 		} else {
@@ -798,3 +1832,77 @@ func (m *baseMeta) doCleanupTrash(force bool) {
 		}
 	}
 }
+
+type chunkPos struct {
+	inode Ino
+	indx  uint32
+}
+
+// compactChunks compacts the chunks in cs with threads goroutines. As chunks are compacted
+// in the order of inode, the progress is saved as the smallest inode not finished yet,
+// so an interrupted run can skip the finished ones next time.
+func (m *baseMeta) compactChunks(cs []chunkPos, threads int, bar *utils.Bar) syscall.Errno {
+	ctx := Background
+	key := "compactProgress"
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].inode < cs[j].inode || cs[i].inode == cs[j].inode && cs[i].indx < cs[j].indx
+	})
+	var value []byte
+	var saved Ino
+	if st := m.en.GetXattr(ctx, TrashInode, key, &value); st != 0 && st != ENOATTR {
+		logger.Warnf("getxattr inode %d key %s: %s", TrashInode, key, st)
+	} else if start, _ := strconv.ParseUint(string(value), 10, 64); start > 0 {
+		i := sort.Search(len(cs), func(i int) bool { return cs[i].inode >= Ino(start) })
+		logger.Infof("Resume compaction from inode %d, skip %d chunks", start, i)
+		cs = cs[i:]
+		saved = Ino(start)
+	}
+	save := func(inode Ino) {
+		if st := m.en.doSetXattr(ctx, TrashInode, key, []byte(strconv.FormatUint(uint64(inode), 10)), XattrCreateOrReplace); st != 0 {
+			logger.Warnf("setxattr inode %d key %s: %s", TrashInode, key, st)
+		}
+	}
+	if threads <= 0 {
+		threads = 1
+	}
+	bar.IncrTotal(int64(len(cs)))
+
+	var mu sync.Mutex
+	done := make([]bool, len(cs))
+	var low int // all chunks before it are done
+	var lastSave time.Time
+	todo := make(chan int, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				c := cs[i]
+				logger.Debugf("compact chunk %d:%d", c.inode, c.indx)
+				m.en.compactChunk(c.inode, c.indx, true)
+				bar.Increment()
+				mu.Lock()
+				done[i] = true
+				for low < len(cs) && done[low] {
+					low++
+				}
+				if low < len(cs) && cs[low].inode != saved && time.Since(lastSave) > time.Second*10 {
+					saved = cs[low].inode
+					lastSave = time.Now()
+					save(saved)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range cs {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+	if saved > 0 {
+		save(0)
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Types of the events in changelog, they can be combined as a mask to subscribe.
+const (
+	EventCreate  uint8 = 1 << iota // a file, directory, symlink or hard link is created
+	EventDelete                    // an entry is removed
+	EventRename                    // an entry is renamed
+	EventSetAttr                   // attributes of an inode are changed (including truncate)
+
+	EventAll = EventCreate | EventDelete | EventRename | EventSetAttr
+)
+
+// Event is a change of the file system recorded in the changelog.
+type Event struct {
+	ID        uint64 `json:"id"` // increasing, but there could be gaps
+	Type      uint8  `json:"type"`
+	Time      int64  `json:"time"` // unix time in nanoseconds
+	Inode     Ino    `json:"inode,omitempty"`
+	Parent    Ino    `json:"parent,omitempty"`
+	Name      string `json:"name,omitempty"`
+	NewParent Ino    `json:"newParent,omitempty"` // for rename only
+	NewName   string `json:"newName,omitempty"`   // for rename only
+}
+
+func (e *Event) TypeName() string {
+	switch e.Type {
+	case EventCreate:
+		return "create"
+	case EventDelete:
+		return "delete"
+	case EventRename:
+		return "rename"
+	case EventSetAttr:
+		return "setattr"
+	default:
+		return fmt.Sprintf("unknown(%d)", e.Type)
+	}
+}
+
+func (e *Event) marshal() []byte {
+	data, _ := json.Marshal(e)
+	return data
+}
+
+func parseEvent(data []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid event %q: %s", data, err)
+	}
+	return &e, nil
+}
+
+const (
+	eventBatch = 1000
+	// an event could be added after the ones with bigger IDs, so a gap is waited for this duration
+	// before it's skipped (the event may be lost when the client crashed)
+	eventGapTimeout = time.Second * 3
+	eventPoll       = time.Millisecond * 200
+)
+
+func (m *baseMeta) changelogEnabled() bool {
+	return m.fmt.ChangelogRetention > 0
+}
+
+// emit adds an event into the changelog if it's enabled.
+func (m *baseMeta) emit(e *Event) {
+	if !m.changelogEnabled() {
+		return
+	}
+	id, err := m.en.incrCounter("nextEvent", 1)
+	if err != nil {
+		logger.Warnf("allocate ID for event: %s", err)
+		return
+	}
+	e.ID, e.Time = uint64(id), time.Now().UnixNano()
+	if err = m.en.doAddEvent(e); err != nil {
+		logger.Warnf("add event %+v into changelog: %s", e, err)
+	}
+}
+
+func (m *baseMeta) Subscribe(ctx Context, types uint8, after uint64, cb func(e *Event) error) error {
+	if !m.changelogEnabled() {
+		return fmt.Errorf("changelog is not enabled")
+	}
+	var gapSince time.Time
+	for ctx.Err() == nil && !ctx.Canceled() {
+		events, err := m.en.doReadEvents(ctx, after, eventBatch)
+		if err != nil {
+			logger.Warnf("read events after %d: %s", after, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		var waiting bool
+		for _, e := range events {
+			if e.ID > after+1 {
+				if gapSince.IsZero() {
+					gapSince = time.Now()
+				}
+				if time.Since(gapSince) < eventGapTimeout {
+					waiting = true
+					break
+				}
+				logger.Warnf("Events %d-%d are missing in changelog", after+1, e.ID-1)
+			}
+			gapSince = time.Time{}
+			after = e.ID
+			if e.Type&types != 0 {
+				if err = cb(e); err != nil {
+					return err
+				}
+			}
+		}
+		if waiting || len(events) < eventBatch {
+			time.Sleep(eventPoll)
+		}
+	}
+	return ctx.Err()
+}
+
+func (m *baseMeta) cleanupChangelog() {
+	for {
+		time.Sleep(time.Minute * 10)
+		edge := time.Now().Add(-time.Duration(m.fmt.ChangelogRetention) * time.Second)
+		if n, err := m.en.doCleanupEvents(edge); err != nil {
+			logger.Warnf("cleanup changelog: %s", err)
+		} else if n > 0 {
+			logger.Debugf("cleanup changelog: deleted %d events before %s", n, edge)
+		}
+	}
+}
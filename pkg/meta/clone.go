@@ -0,0 +1,190 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"syscall"
+	"time"
+)
+
+func (m *baseMeta) Clone(ctx Context, srcIno, dstParent Ino, name string) syscall.Errno {
+	defer timeit(time.Now())
+	srcIno, dstParent = m.checkRoot(srcIno), m.checkRoot(dstParent)
+	if st := m.Access(ctx, dstParent, 3, nil); st != 0 { // write and search
+		return st
+	}
+	var attr Attr
+	if st := m.GetAttr(ctx, srcIno, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		// a directory can't be cloned into itself
+		for p := dstParent; p != m.root && p != 1 && p != 0; {
+			if p == srcIno {
+				return syscall.EINVAL
+			}
+			var pattr Attr
+			if st := m.GetAttr(ctx, p, &pattr); st != 0 {
+				return st
+			}
+			p = pattr.Parent
+		}
+		if dstParent == srcIno {
+			return syscall.EINVAL
+		}
+	}
+	c := &cloner{m: m, ctx: ctx, links: make(map[Ino]Ino)}
+	st := c.clone(srcIno, &attr, dstParent, name)
+	if st != 0 && c.top != 0 {
+		// remove the partially cloned tree, as root because the modes of cloned directories are restored
+		var inode Ino
+		var dattr Attr
+		if m.Lookup(Background, dstParent, name, &inode, &dattr) == 0 && inode == c.top {
+			if rst := m.Remove(Background, dstParent, name, nil); rst != 0 {
+				logger.Warnf("remove partially cloned %s in %d: %s", name, dstParent, rst)
+			}
+		}
+	}
+	return st
+}
+
+// cloner copies a tree with the references to the slices of files instead of their data.
+type cloner struct {
+	m     *baseMeta
+	ctx   Context
+	links map[Ino]Ino // cloned inodes of hard links
+	top   Ino         // the root of the cloned tree, 0 before it's created
+}
+
+func (c *cloner) clone(src Ino, attr *Attr, parent Ino, name string) syscall.Errno {
+	if c.ctx.Canceled() {
+		return syscall.EINTR
+	}
+	m, ctx := c.m, c.ctx
+	if attr.Typ != TypeDirectory && attr.Nlink > 1 {
+		if dst, ok := c.links[src]; ok {
+			return m.Link(ctx, dst, parent, name, &Attr{})
+		}
+	}
+	// the caller should be able to read everything cloned, as it owns the clone
+	switch attr.Typ {
+	case TypeDirectory:
+		if st := m.Access(ctx, src, 5, attr); st != 0 { // read and search
+			return st
+		}
+	case TypeFile:
+		if st := m.Access(ctx, src, 4, attr); st != 0 { // read
+			return st
+		}
+	}
+	var dst Ino
+	var dattr Attr
+	var st syscall.Errno
+	switch attr.Typ {
+	case TypeDirectory:
+		// writable until the children are cloned, the mode is restored at last
+		st = m.Mkdir(ctx, parent, name, attr.Mode|0700, 0, 0, &dst, &dattr)
+	case TypeSymlink:
+		var target []byte
+		if st = m.ReadLink(ctx, src, &target); st == 0 {
+			st = m.Symlink(ctx, parent, name, string(target), &dst, &dattr)
+		}
+	case TypeFile:
+		if st = m.Create(ctx, parent, name, attr.Mode|0600, 0, 0, &dst, &dattr); st == 0 {
+			st = c.copyData(src, dst, attr.Length)
+			m.Close(ctx, dst)
+		}
+	default:
+		st = m.Mknod(ctx, parent, name, attr.Typ, attr.Mode, 0, attr.Rdev, &dst, &dattr)
+	}
+	if st != 0 {
+		return st
+	}
+	if c.top == 0 {
+		c.top = dst
+	}
+	if attr.Typ != TypeDirectory && attr.Nlink > 1 {
+		c.links[src] = dst
+	}
+	if st = c.copyXattrs(src, dst); st != 0 {
+		return st
+	}
+	if attr.Typ == TypeDirectory {
+		var entries []*Entry
+		if st = m.Readdir(ctx, src, 1, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			if n := string(e.Name); n == "." || n == ".." {
+				continue
+			}
+			if st = c.clone(e.Inode, e.Attr, dst, string(e.Name)); st != 0 {
+				return st
+			}
+		}
+	}
+	if attr.Typ == TypeSymlink {
+		return 0 // the times of symlinks can't be changed
+	}
+	// keep the owner only for root, like `cp -p`
+	set := uint16(SetAttrMode | SetAttrAtime | SetAttrMtime)
+	if ctx.Uid() == 0 {
+		set |= SetAttrUID | SetAttrGID
+	}
+	return m.en.SetAttr(ctx, dst, set, 0, attr)
+}
+
+// copyData copies the slices of a file chunk by chunk, so every transaction is small.
+func (c *cloner) copyData(src, dst Ino, length uint64) syscall.Errno {
+	for off := uint64(0); off < length; off += ChunkSize {
+		size := uint64(ChunkSize)
+		if off+size > length {
+			size = length - off
+		}
+		var copied uint64
+		if st := c.m.en.CopyFileRange(c.ctx, src, off, dst, off, size, 0, &copied); st != 0 {
+			return st
+		}
+	}
+	return 0
+}
+
+func (c *cloner) copyXattrs(src, dst Ino) syscall.Errno {
+	var names []byte
+	if st := c.m.en.ListXattr(c.ctx, src, &names); st != 0 {
+		if st == ENOATTR || st == syscall.ENOTSUP {
+			return 0
+		}
+		return st
+	}
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		var value []byte
+		if st := c.m.en.GetXattr(c.ctx, src, string(name), &value); st == ENOATTR {
+			continue
+		} else if st != 0 {
+			return st
+		}
+		if st := c.m.SetXattr(c.ctx, dst, string(name), value, 0); st != 0 {
+			return st
+		}
+	}
+	return 0
+}
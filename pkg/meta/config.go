@@ -16,18 +16,43 @@
 
 package meta
 
-import "time"
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+// Modes of updating atime when files are read or directories are listed.
+const (
+	NoAtime     = "noatime"     // never update atime
+	RelAtime    = "relatime"    // update atime if it's earlier than mtime or ctime, or older than a day
+	StrictAtime = "strictatime" // update atime on every access
+)
 
 // Config for clients.
 type Config struct {
-	Strict      bool // update ctime
-	Retries     int
-	CaseInsensi bool
-	ReadOnly    bool
-	OpenCache   time.Duration
-	MountPoint  string
-	Subdir      string
-	MaxDeletes  int
+	Strict        bool // update ctime
+	Retries       int
+	CaseInsensi   bool
+	ReadOnly      bool
+	OpenCache     time.Duration
+	MountPoint    string
+	MountOptions  string // options of the mount, recorded in the session
+	MetricsAddr   string // address of the metrics and locality API, recorded in the session
+	Subdir        string
+	MaxDeletes    int
+	MaxOpenFiles  int    // max number of open handles in a session, 0 means unlimited
+	Broker        string // unix socket of the local broker to connect Redis through
+	Heartbeat     time.Duration
+	SkipDirMtime  time.Duration // skip updating the times of parents in rename if they were updated within it
+	ScrubInterval time.Duration // interval to check a sample of inodes in background, 0 means disabled
+	AtimeMode     string        // when to update atime, one of NoAtime, RelAtime (default) and StrictAtime
+	MetaCache     time.Duration // cache attributes and entries for it, invalidated by the changes from other clients
+
+	Faults *utils.FaultInjector `json:"-"` // inject faults into requests to meta engine, for testing
 }
 
 type Format struct {
@@ -45,6 +70,21 @@ type Format struct {
 	Inodes      uint64
 	EncryptKey  string `json:",omitempty"`
 	TrashDays   int
+	TrashQuota  uint64 `json:",omitempty"` // limit of space used by the trash in bytes, 0 for unlimited
+	// seconds without heartbeat before a session is cleaned up, 0 means 5 minutes
+	SessionTimeout int `json:",omitempty"`
+	// seconds to keep the unlinked files held open by a dead session, 0 deletes them immediately
+	SustainedGrace int `json:",omitempty"`
+	// namespace of inodes and chunk IDs, so volumes of different clusters never share IDs
+	ClusterID int `json:",omitempty"`
+	// SHA-256 of the token required by administrative commands, empty means no protection
+	AdminToken string `json:",omitempty"`
+	// seconds to keep the events in changelog, 0 disables the changelog
+	ChangelogRetention int `json:",omitempty"`
+	// alert when the space held by pending deletions and leaked slices exceeds it in bytes, 0 means no alert
+	GCAlertSpace uint64 `json:",omitempty"`
+	// ID of the zstd dictionary to compress blocks, which is stored in object storage, 0 means no dictionary
+	CompressDict uint32 `json:",omitempty"`
 }
 
 func (f *Format) RemoveSecret() {
@@ -54,4 +94,29 @@ func (f *Format) RemoveSecret() {
 	if f.EncryptKey != "" {
 		f.EncryptKey = "removed"
 	}
+	if f.AdminToken != "" {
+		f.AdminToken = "removed"
+	}
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// SetAdminToken sets the token required by administrative commands, an empty token removes the protection.
+func (f *Format) SetAdminToken(token string) {
+	if token == "" {
+		f.AdminToken = ""
+	} else {
+		f.AdminToken = hashToken(token)
+	}
+}
+
+// CheckAdminToken returns whether the token is allowed to run administrative commands on the volume.
+func (f *Format) CheckAdminToken(token string) bool {
+	if f.AdminToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(f.AdminToken)) == 1
 }
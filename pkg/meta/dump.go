@@ -18,10 +18,16 @@ package meta
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/utils"
 )
 
 const (
@@ -36,7 +42,8 @@ type DumpedCounters struct {
 	NextChunk         int64 `json:"nextChunk"`
 	NextSession       int64 `json:"nextSession"`
 	NextTrash         int64 `json:"nextTrash"`
-	NextCleanupSlices int64 `json:"nextCleanupSlices"` // deprecated, always 0
+	Generation        int64 `json:"generation,omitempty"` // number of loads, as inode numbers could be reused by a load
+	NextCleanupSlices int64 `json:"nextCleanupSlices"`    // deprecated, always 0
 }
 
 type DumpedDelFile struct {
@@ -88,6 +95,7 @@ type DumpedXattr struct {
 type DumpedEntry struct {
 	Name    string                  `json:"-"`
 	Parent  Ino                     `json:"-"`
+	Parents []Ino                   `json:"-"` // all the parents of a hard linked file
 	Attr    *DumpedAttr             `json:"attr"`
 	Symlink string                  `json:"symlink,omitempty"`
 	Xattrs  []*DumpedXattr          `json:"xattrs,omitempty"`
@@ -171,6 +179,7 @@ type DumpedMeta struct {
 	DelFiles  []*DumpedDelFile
 	FSTree    *DumpedEntry `json:",omitempty"`
 	Trash     *DumpedEntry `json:",omitempty"`
+	Since     int64        `json:",omitempty"` // unix time of an incremental dump
 }
 
 func (dm *DumpedMeta) writeJsonWithOutTree(w io.Writer) (*bufio.Writer, error) {
@@ -246,8 +255,13 @@ func collectEntry(e *DumpedEntry, entries map[Ino]*DumpedEntry, showProgress fun
 			return fmt.Errorf("inode conflict: %d", inode)
 		}
 		eattr.Nlink++
+		if len(exist.Parents) == 0 {
+			exist.Parents = []Ino{exist.Parent}
+		}
+		exist.Parents = append(exist.Parents, e.Parent)
 		if eattr.Ctime*1e9+int64(eattr.Ctimensec) < attr.Ctime*1e9+int64(attr.Ctimensec) {
 			attr.Nlink = eattr.Nlink
+			e.Parents = exist.Parents
 			entries[inode] = e
 		}
 		return nil
@@ -276,3 +290,479 @@ func collectEntry(e *DumpedEntry, entries map[Ino]*DumpedEntry, showProgress fun
 	}
 	return nil
 }
+
+// dumpedLine is an entry in the dump of JSON lines, which is written right after its parent
+// in depth-first order, so the whole tree is never kept in memory.
+type dumpedLine struct {
+	Parent Ino    `json:"parent"`
+	Name   string `json:"name"`
+	*DumpedEntry
+}
+
+// DumpMetaLines dumps the settings and counters in the first line, then one entry per line.
+// If since is not zero, only the inodes changed after it are dumped, and a changed directory
+// carries the names of all its children, so it can be merged into the previous dumps.
+func (m *baseMeta) DumpMetaLines(w io.Writer, root Ino, since time.Time) error {
+	if root == 0 {
+		root = m.root
+	}
+	dm, err := m.en.dumpHeader()
+	if err != nil {
+		return err
+	}
+	var plus uint8
+	if !since.IsZero() {
+		dm.Since = since.Unix()
+		plus = 1
+	}
+	bw := bufio.NewWriterSize(w, jsonWriteSize)
+	enc := json.NewEncoder(bw)
+	if err = enc.Encode(dm); err != nil {
+		return err
+	}
+
+	progress := utils.NewProgress(false, false)
+	bar := progress.AddCountBar("Dumped entries", 0)
+	var dump func(parent Ino, name string, inode Ino, attr *Attr) error
+	dump = func(parent Ino, name string, inode Ino, attr *Attr) error {
+		var entries []*Entry
+		if attr.Typ == TypeDirectory {
+			if st := m.en.doReaddir(Background, inode, plus, &entries); st != 0 {
+				return fmt.Errorf("readdir inode %d: %s", inode, st)
+			}
+			sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Name, entries[j].Name) < 0 })
+		}
+		if dm.Since == 0 || attr.Ctime >= dm.Since || attr.Mtime >= dm.Since {
+			e, err := m.en.dumpEntry(inode)
+			if err != nil {
+				return err
+			}
+			if e == nil || e.Attr == nil {
+				logger.Warnf("The entry of inode %d (%s) was not found", inode, name)
+				return nil
+			}
+			if dm.Since > 0 && attr.Typ == TypeDirectory {
+				e.Entries = make(map[string]*DumpedEntry, len(entries))
+				for _, c := range entries {
+					e.Entries[string(c.Name)] = &DumpedEntry{Attr: &DumpedAttr{Inode: c.Inode, Type: typeToString(c.Attr.Typ)}}
+				}
+			}
+			bar.IncrTotal(1)
+			if err = enc.Encode(&dumpedLine{parent, name, e}); err != nil {
+				return err
+			}
+			bar.Increment()
+		}
+		for _, c := range entries {
+			if err := dump(inode, string(c.Name), c.Inode, c.Attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(Background, root, &attr); st != 0 {
+		return fmt.Errorf("getattr inode %d: %s", root, st)
+	}
+	if err = dump(0, "FSTree", root, &attr); err != nil {
+		return err
+	}
+	if root == 1 && m.en.doGetAttr(Background, TrashInode, &attr) == 0 {
+		if err = dump(0, "Trash", TrashInode, &attr); err != nil {
+			return err
+		}
+	}
+	progress.Done()
+	return bw.Flush()
+}
+
+// MergeDumps merges the incremental dumps into a full dump of JSON lines in order, and writes
+// the result into w. The inodes not reachable from the root after merging are dropped.
+func MergeDumps(w io.Writer, base io.Reader, incrementals ...io.Reader) error {
+	lines := make(map[Ino][]byte)            // the latest dumped line of inodes
+	children := make(map[Ino]map[string]Ino) // dentries of directories
+	roots := make(map[string]Ino)            // FSTree and Trash
+	var header *DumpedMeta
+	read := func(r io.Reader, incremental bool) error {
+		dec := json.NewDecoder(r)
+		dm := &DumpedMeta{}
+		if err := dec.Decode(dm); err != nil {
+			return err
+		}
+		if dm.FSTree != nil {
+			return fmt.Errorf("only dumps of JSON lines can be merged")
+		}
+		if incremental != (dm.Since > 0) {
+			return fmt.Errorf("expect incremental %t, but got %t", incremental, dm.Since > 0)
+		}
+		header = dm
+		for {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			var l dumpedLine
+			if err := json.Unmarshal(raw, &l); err != nil {
+				return err
+			}
+			if l.DumpedEntry == nil || l.Attr == nil {
+				return fmt.Errorf("invalid entry %s in parent %d", l.Name, l.Parent)
+			}
+			inode := l.Attr.Inode
+			if l.Parent == 0 {
+				roots[l.Name] = inode
+			} else if !incremental {
+				if children[l.Parent] == nil {
+					children[l.Parent] = make(map[string]Ino)
+				}
+				children[l.Parent][l.Name] = inode
+			}
+			if incremental && typeFromString(l.Attr.Type) == TypeDirectory {
+				cs := make(map[string]Ino, len(l.Entries))
+				for name, c := range l.Entries {
+					cs[name] = c.Attr.Inode
+				}
+				children[inode] = cs
+			}
+			lines[inode] = raw
+		}
+	}
+	if err := read(base, false); err != nil {
+		return fmt.Errorf("read base dump: %s", err)
+	}
+	for i, r := range incrementals {
+		if err := read(r, true); err != nil {
+			return fmt.Errorf("read incremental dump %d: %s", i+1, err)
+		}
+	}
+
+	header.Since = 0
+	bw := bufio.NewWriterSize(w, jsonWriteSize)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	var write func(parent Ino, name string, inode Ino) error
+	write = func(parent Ino, name string, inode Ino) error {
+		raw, ok := lines[inode]
+		if !ok {
+			logger.Warnf("The entry of inode %d (%s) was not found", inode, name)
+			return nil
+		}
+		var l dumpedLine
+		if err := json.Unmarshal(raw, &l); err != nil {
+			return err
+		}
+		l.Parent, l.Name, l.Entries = parent, name, nil
+		if err := enc.Encode(&l); err != nil {
+			return err
+		}
+		cs := children[inode]
+		names := make([]string, 0, len(cs))
+		for n := range cs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if err := write(inode, n, cs[n]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range []string{"FSTree", "Trash"} {
+		if inode, ok := roots[name]; ok {
+			if err := write(0, name, inode); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// policies of duplicated names in a directory when loading a dump
+const (
+	ConflictAbort     = "abort"     // fail the loading
+	ConflictSkip      = "skip"      // keep the first entry, the later one is dropped with its children
+	ConflictOverwrite = "overwrite" // keep the later entry, it's renamed if the first one is a directory
+	ConflictRename    = "rename"    // keep both, the later one is renamed with a suffix
+)
+
+// LoadOptions controls how LoadMeta resolves the conflicts in a dump.
+type LoadOptions struct {
+	Conflict  string          // policy of duplicated names, ConflictAbort by default
+	Conflicts []*LoadConflict // the conflicts resolved, filled by LoadMeta
+}
+
+// LoadConflict is a duplicated name in a directory found by LoadMeta.
+type LoadConflict struct {
+	Parent   Ino    `json:"parent"`
+	Name     string `json:"name"`
+	Inode    Ino    `json:"inode"`    // the later entry
+	Existing Ino    `json:"existing"` // the first entry
+	Action   string `json:"action"`   // ConflictSkip, ConflictOverwrite or ConflictRename
+	NewName  string `json:"new_name,omitempty"`
+}
+
+func (c *LoadConflict) String() string {
+	switch c.Action {
+	case ConflictSkip:
+		return fmt.Sprintf("skipped inode %d named %s in directory %d, which is used by inode %d", c.Inode, c.Name, c.Parent, c.Existing)
+	case ConflictOverwrite:
+		return fmt.Sprintf("inode %d named %s in directory %d is overwritten by inode %d", c.Existing, c.Name, c.Parent, c.Inode)
+	default:
+		return fmt.Sprintf("renamed inode %d from %s to %s in directory %d, as the name is used by inode %d", c.Inode, c.Name, c.NewName, c.Parent, c.Existing)
+	}
+}
+
+// loadEntries decodes a dump in either format, and calls load for every entry concurrently.
+// The duplicated names in a dump of JSON lines are resolved by the policy in opts.
+// A directory is loaded after all its children are decoded, and a file with hard links after
+// all the entries are decoded, so that their nlink can be counted.
+func loadEntries(r io.Reader, opts *LoadOptions, load func(e *DumpedEntry) error) (*DumpedMeta, error) {
+	dec := json.NewDecoder(r)
+	dm := &DumpedMeta{}
+	if err := dec.Decode(dm); err != nil {
+		return nil, err
+	}
+	if dm.Since > 0 {
+		return nil, fmt.Errorf("incremental dump since %s should be merged with the previous dumps", time.Unix(dm.Since, 0))
+	}
+
+	progress := utils.NewProgress(false, false)
+	bar := progress.AddCountBar("Loaded entries", 0)
+	pool := make(chan struct{}, 100)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var lerr error
+	emit := func(e *DumpedEntry) error {
+		mu.Lock()
+		err := lerr
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		bar.IncrTotal(1)
+		pool <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				bar.Increment()
+				wg.Done()
+				<-pool
+			}()
+			if err := load(e); err != nil {
+				mu.Lock()
+				lerr = err
+				mu.Unlock()
+			}
+		}()
+		return nil
+	}
+
+	var err error
+	if dm.FSTree != nil {
+		err = emitTree(dm, emit)
+	} else {
+		if opts == nil {
+			opts = &LoadOptions{}
+		}
+		err = emitLines(dec, opts, emit)
+	}
+	wg.Wait()
+	if err == nil {
+		err = lerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	progress.Done()
+	return dm, nil
+}
+
+// emitTree collects all the entries from the dumped tree.
+func emitTree(dm *DumpedMeta, emit func(e *DumpedEntry) error) error {
+	dm.FSTree.Attr.Inode = 1
+	entries := make(map[Ino]*DumpedEntry)
+	if err := collectEntry(dm.FSTree, entries, nil); err != nil {
+		return err
+	}
+	if dm.Trash != nil {
+		if err := collectEntry(dm.Trash, entries, nil); err != nil {
+			return err
+		}
+	}
+	dm.FSTree, dm.Trash = nil, nil
+	for _, e := range entries {
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitLines reads the entries line by line, only the directories in current path and
+// the files with hard links are kept in memory. With ConflictOverwrite, the other files
+// are also kept until their parents are finished, in case they are overwritten.
+func emitLines(dec *json.Decoder, opts *LoadOptions, emit func(e *DumpedEntry) error) error {
+	type openDir struct {
+		inode Ino // in the dump, may be different for the root of sub-directory
+		entry *DumpedEntry
+		files map[string]*DumpedEntry // files not emitted yet, only for ConflictOverwrite
+	}
+	var stack []openDir
+	links := make(map[Ino]*DumpedEntry)
+	skipped := make(map[Ino]bool) // directories dropped by ConflictSkip
+	finish := func(d *openDir) error {
+		for _, f := range d.files {
+			if err := emit(f); err != nil {
+				return err
+			}
+		}
+		return emit(d.entry)
+	}
+	// drop removes the entry of name in d before it's loaded, it fails for a directory.
+	drop := func(d *openDir, name string) bool {
+		inode := d.entry.Entries[name].Attr.Inode
+		if _, ok := d.files[name]; ok {
+			delete(d.files, name)
+		} else if l, ok := links[inode]; ok {
+			for i, p := range l.Parents {
+				if p == d.entry.Attr.Inode {
+					l.Parents = append(l.Parents[:i], l.Parents[i+1:]...)
+					break
+				}
+			}
+			if l.Attr.Nlink--; l.Attr.Nlink == 0 {
+				delete(links, inode)
+			} else {
+				l.Parent = l.Parents[0]
+			}
+		} else {
+			return false
+		}
+		delete(d.entry.Entries, name)
+		return true
+	}
+	for {
+		var l dumpedLine
+		if err := dec.Decode(&l); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		e := l.DumpedEntry
+		if e == nil || e.Attr == nil {
+			return fmt.Errorf("invalid entry %s in parent %d", l.Name, l.Parent)
+		}
+		inode := e.Attr.Inode
+		typ := typeFromString(e.Attr.Type)
+		if skipped[l.Parent] {
+			if typ == TypeDirectory {
+				skipped[inode] = true
+			}
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].inode != l.Parent {
+			if err := finish(&stack[len(stack)-1]); err != nil {
+				return err
+			}
+			stack = stack[:len(stack)-1]
+		}
+		e.Name = l.Name
+		if l.Parent == 0 {
+			if l.Name == "FSTree" {
+				e.Attr.Inode = 1
+			}
+			e.Parent = 1
+		} else if len(stack) == 0 {
+			return fmt.Errorf("parent %d of %s (inode %d) is not found", l.Parent, l.Name, inode)
+		} else {
+			d := &stack[len(stack)-1]
+			p := d.entry
+			e.Parent = p.Attr.Inode
+			if exist, ok := p.Entries[e.Name]; ok {
+				c := &LoadConflict{Parent: e.Parent, Name: e.Name, Inode: inode, Existing: exist.Attr.Inode, Action: opts.Conflict}
+				switch opts.Conflict {
+				case ConflictSkip:
+				case ConflictOverwrite:
+					if !drop(d, e.Name) {
+						c.Action = ConflictRename
+					}
+				case ConflictRename:
+				default:
+					return fmt.Errorf("duplicated name %s in directory %d: inode %d and %d", e.Name, e.Parent, exist.Attr.Inode, inode)
+				}
+				if c.Action == ConflictRename {
+					for i := 1; ; i++ {
+						c.NewName = fmt.Sprintf("%s~%d", e.Name, i)
+						if _, ok := p.Entries[c.NewName]; !ok {
+							break
+						}
+					}
+					e.Name = c.NewName
+				}
+				opts.Conflicts = append(opts.Conflicts, c)
+				logger.Warnf("Conflict: %s", c)
+				if c.Action == ConflictSkip {
+					if typ == TypeDirectory {
+						skipped[inode] = true
+					}
+					continue
+				}
+			}
+			p.Entries[e.Name] = &DumpedEntry{Name: e.Name, Attr: &DumpedAttr{Inode: inode, Type: e.Attr.Type}}
+			if typ == TypeDirectory {
+				p.Attr.Nlink++
+			}
+		}
+
+		switch typ {
+		case TypeDirectory:
+			e.Attr.Nlink = 2
+			e.Entries = make(map[string]*DumpedEntry)
+			d := openDir{inode: inode, entry: e}
+			if opts.Conflict == ConflictOverwrite {
+				d.files = make(map[string]*DumpedEntry)
+			}
+			stack = append(stack, d)
+			continue
+		case TypeFile:
+			if e.Attr.Nlink > 1 {
+				if exist, ok := links[inode]; ok {
+					exist.Attr.Nlink++
+					exist.Parents = append(exist.Parents, e.Parent)
+				} else {
+					e.Attr.Nlink = 1
+					e.Parents = []Ino{e.Parent}
+					links[inode] = e
+				}
+				continue
+			}
+		default:
+			if e.Attr.Nlink != 1 {
+				return fmt.Errorf("invalid nlink %d for inode %d type %s", e.Attr.Nlink, inode, e.Attr.Type)
+			}
+		}
+		if len(stack) > 0 && stack[len(stack)-1].files != nil {
+			stack[len(stack)-1].files[e.Name] = e
+			continue
+		}
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		if err := finish(&stack[i]); err != nil {
+			return err
+		}
+	}
+	for _, e := range links {
+		if err := emit(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"xorm.io/xorm/contexts"
+)
+
+// redisFaults injects faults into the commands sent to Redis.
+type redisFaults struct {
+	faults *utils.FaultInjector
+}
+
+func (h redisFaults) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, h.faults.Inject()
+}
+
+func (h redisFaults) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h redisFaults) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, h.faults.Inject()
+}
+
+func (h redisFaults) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// sqlFaults injects faults into the statements sent to the database.
+type sqlFaults struct {
+	faults *utils.FaultInjector
+}
+
+func (h sqlFaults) BeforeProcess(c *contexts.ContextHook) (context.Context, error) {
+	return c.Ctx, h.faults.Inject()
+}
+
+func (h sqlFaults) AfterProcess(c *contexts.ContextHook) error {
+	return nil
+}
+
+// tkvFaults injects faults into the transactions of TKV.
+type tkvFaults struct {
+	tkvClient
+	faults *utils.FaultInjector
+}
+
+func (c *tkvFaults) txn(f func(kvTxn) error) error {
+	if err := c.faults.Inject(); err != nil {
+		return err
+	}
+	return c.tkvClient.txn(f)
+}
@@ -0,0 +1,51 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+func TestFaultInjection(t *testing.T) {
+	for _, addr := range []string{"redis://127.0.0.1:6379/10", "sqlite3://" + path.Join(t.TempDir(), "jfs-fault.db"), "memkv://"} {
+		faults := &utils.FaultInjector{}
+		m := NewClient(addr, &Config{Faults: faults})
+		if err := m.Init(Format{Name: "test"}, true); err != nil {
+			t.Fatalf("%s: init: %s", addr, err)
+		}
+		var inode Ino
+		var attr = &Attr{}
+		if st := m.Lookup(Background, 1, "none", &inode, attr); st != syscall.ENOENT {
+			t.Fatalf("%s: lookup: %s", addr, st)
+		}
+		faults.Set(utils.Fault{Drop: 100})
+		if _, err := m.Load(); err == nil {
+			t.Fatalf("%s: load should fail", addr)
+		}
+		if st := m.Lookup(Background, 1, "none", &inode, attr); st != syscall.ENETUNREACH {
+			t.Fatalf("%s: lookup with fault: %s", addr, st)
+		}
+		faults.Set(utils.Fault{})
+		if _, err := m.Load(); err != nil {
+			t.Fatalf("%s: load: %s", addr, err)
+		}
+	}
+}
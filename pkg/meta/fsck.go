@@ -0,0 +1,173 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"syscall"
+)
+
+// nsNode is what CheckNamespace keeps for every inode.
+type nsNode struct {
+	typ       uint8
+	nlink     uint32
+	parent    Ino
+	ctime     int64
+	ctimensec uint32
+	links     uint32 // number of entries pointing to it
+	subdirs   uint32 // number of sub-directories
+	dir       Ino    // the directory containing it (the last one for hard links)
+}
+
+// changed returns whether the inode is changed (or removed) after scanned, then the problems
+// found in it could be caused by concurrent operations, instead of inconsistency.
+func (m *baseMeta) changed(ctx Context, inode Ino, n *nsNode) bool {
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return true
+	}
+	return attr.Ctime != n.ctime || attr.Ctimensec != n.ctimensec
+}
+
+// countedUsage returns the used space and inodes in the counters, plus the ones not flushed yet.
+func (m *baseMeta) countedUsage() (int64, int64, error) {
+	space, err := m.en.incrCounter(usedSpace, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	inodes, err := m.en.incrCounter(totalInodes, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	return space + atomic.LoadInt64(&m.newSpace), inodes + atomic.LoadInt64(&m.newInodes), nil
+}
+
+func (m *baseMeta) CheckNamespace(ctx Context, report *NamespaceReport) syscall.Errno {
+	// the counters are read before and after the inodes, they are compared only if not changed in between
+	space, inodes, err := m.countedUsage()
+	if err != nil {
+		return errno(err)
+	}
+
+	nodes := make(map[Ino]*nsNode)
+	var dirs []Ino
+	var usedSpace, usedInodes int64
+	err = m.en.doScanInodes(ctx, func(inode Ino, attr *Attr) bool {
+		if _, ok := nodes[inode]; ok {
+			return true // scanned twice
+		}
+		nodes[inode] = &nsNode{typ: attr.Typ, nlink: attr.Nlink, parent: attr.Parent, ctime: attr.Ctime, ctimensec: attr.Ctimensec}
+		if attr.Typ == TypeDirectory {
+			dirs = append(dirs, inode)
+		}
+		if inode != 1 && inode != TrashInode {
+			s, i := usage(attr)
+			usedSpace += s
+			usedInodes += i
+		}
+		return !ctx.Canceled()
+	})
+	if err != nil {
+		return errno(err)
+	}
+	if ctx.Canceled() {
+		return syscall.EINTR
+	}
+	report.Inodes += uint64(len(nodes))
+	problem := func(class string, inode Ino, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, &NamespaceProblem{class, inode, fmt.Sprintf(format, args...)})
+	}
+
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i] < dirs[j] })
+	for _, dir := range dirs {
+		var cursor string
+		for {
+			var entries []*Entry
+			if cursor, err = m.en.doReaddirAt(ctx, dir, ReaddirType, cursor, 1000, &entries); err != nil {
+				if errno(err) == syscall.ENOENT {
+					break // removed after scanned
+				}
+				return errno(err)
+			}
+			for _, e := range entries {
+				report.Entries++
+				n := nodes[e.Inode]
+				if n == nil {
+					var attr Attr
+					if st := m.en.doGetAttr(ctx, e.Inode, &attr); st == syscall.ENOENT {
+						problem(ProblemDangling, e.Inode, "entry %q in directory %d points to a missing inode", e.Name, dir)
+					}
+					continue // created after scanned
+				}
+				n.links++
+				n.dir = dir
+				if n.typ == TypeDirectory {
+					nodes[dir].subdirs++
+				}
+			}
+			if cursor == "" {
+				break
+			}
+			if ctx.Canceled() {
+				return syscall.EINTR
+			}
+		}
+	}
+
+	var inos []Ino
+	for inode := range nodes {
+		inos = append(inos, inode)
+	}
+	sort.Slice(inos, func(i, j int) bool { return inos[i] < inos[j] })
+	for _, inode := range inos {
+		n := nodes[inode]
+		if inode == 1 || inode == TrashInode {
+			if n.nlink != 2+n.subdirs && !m.changed(ctx, inode, n) {
+				problem(ProblemNlink, inode, "nlink is %d, but %d expected from %d sub-directories", n.nlink, 2+n.subdirs, n.subdirs)
+			}
+			continue
+		}
+		if n.links == 0 {
+			// the removed files held open have no entry and zero nlink
+			if n.nlink > 0 && !m.changed(ctx, inode, n) {
+				problem(ProblemOrphan, inode, "nlink is %d, but no entry points to it", n.nlink)
+			}
+			continue
+		}
+		if n.typ == TypeDirectory {
+			if (n.nlink != 2+n.subdirs || n.links > 1) && !m.changed(ctx, inode, n) {
+				problem(ProblemNlink, inode, "nlink is %d with %d entries, but %d expected from %d sub-directories", n.nlink, n.links, 2+n.subdirs, n.subdirs)
+			}
+			if n.parent != n.dir && !m.changed(ctx, inode, n) {
+				problem(ProblemParent, inode, "parent is %d, but it's in directory %d", n.parent, n.dir)
+			}
+		} else if n.nlink != n.links && !m.changed(ctx, inode, n) {
+			problem(ProblemNlink, inode, "nlink is %d, but %d entries point to it", n.nlink, n.links)
+		}
+	}
+
+	space2, inodes2, err := m.countedUsage()
+	if err != nil {
+		return errno(err)
+	}
+	if space == space2 && inodes == inodes2 && (space != usedSpace || inodes != usedInodes) {
+		problem(ProblemUsage, 0, "used space is %d and used inodes is %d, but %d and %d are counted from inodes", space, inodes, usedSpace, usedInodes)
+	}
+	return 0
+}
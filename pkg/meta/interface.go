@@ -17,8 +17,12 @@
 package meta
 
 import (
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"path"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -40,6 +44,22 @@ const (
 	Info = 1003
 	// FillCache is a message to build cache for target directories/files
 	FillCache = 1004
+	// FillBlocks is a message to build cache for blocks listed in a manifest
+	FillBlocks = 1005
+	// Heat is a message to get the report of hot, warm and cold files in a directory
+	Heat = 1006
+	// Fault is a message to show or change the faults injected into requests to meta engine and object storage
+	Fault = 1007
+	// Chattr is a message to show or change the flags (immutable and append-only) of an inode
+	Chattr = 1008
+	// ListCache is a message to list the blocks in cache with the paths of their files
+	ListCache = 1009
+	// LoadCache is a message to build cache for blocks from local files, exported from the cache of another client
+	LoadCache = 1010
+	// Clone is a message to clone a file or directory tree without copying its data
+	Clone = 1011
+	// Freeze is a message to freeze or thaw the modifications of a mount point
+	Freeze = 1012
 )
 
 const (
@@ -69,11 +89,44 @@ const (
 	SetAttrCtime
 	SetAttrAtimeNow
 	SetAttrMtimeNow
+	SetAttrFlag
+)
+
+const (
+	// FlagImmutable is a flag of inode (FS_IMMUTABLE_FL), which can't be modified, renamed or removed.
+	FlagImmutable = 1 << iota
+	// FlagAppend is a flag of inode (FS_APPEND_FL), which can only be appended to, and can't be renamed or removed.
+	FlagAppend
+)
+
+// Attributes asked by the wantattr of Readdir, the ones not asked are left as zero
+// and Attr.Full will be false, so big directories can be listed with less payload.
+const (
+	ReaddirType  = 0 // only type of entries
+	ReaddirFull  = 1 // all the attributes
+	ReaddirSize  = 2 // the length
+	ReaddirMtime = 4 // the modification time
 )
 
 const TrashInode = 0x7FFFFFFF10000000 // larger than vfs.minInternalNode
 const TrashName = ".trash"
 
+// TagPrefix is the prefix of extended attributes that are indexed as tags,
+// so files can be found by them with ListTagged. The key and value of a tag
+// should be not empty and no longer than 255 bytes.
+const TagPrefix = "user.tag."
+
+// DefaultXattrPrefix is the prefix of extended attributes of a directory that are applied to
+// the new files and directories created in it: user.default.NAME of the directory is set as
+// user.NAME of its new children, and new sub-directories inherit user.default.NAME itself.
+const DefaultXattrPrefix = "user.default."
+
+const maxTagLen = 255
+
+func validTag(key string, value []byte) bool {
+	return key != "" && len(key) <= maxTagLen && len(value) > 0 && len(value) <= maxTagLen
+}
+
 func isTrash(ino Ino) bool {
 	return ino >= TrashInode
 }
@@ -88,7 +141,7 @@ type MsgCallback func(...interface{}) error
 
 // Attr represents attributes of a node.
 type Attr struct {
-	Flags     uint8  // reserved flags
+	Flags     uint8  // flags of inode: FlagImmutable and FlagAppend
 	Typ       uint8  // type of a node
 	Mode      uint16 // permission mode
 	Uid       uint32 // owner id
@@ -103,7 +156,7 @@ type Attr struct {
 	Nlink     uint32 // number of links (sub-directories or hardlinks)
 	Length    uint64 // length of regular file
 
-	Parent    Ino  // inode of parent, only for Directory
+	Parent    Ino  // inode of parent, one of them for a hard linked file
 	Full      bool // the attributes are completed or not
 	KeepCache bool // whether to keep the cached page or not
 }
@@ -201,11 +254,85 @@ type Summary struct {
 	Dirs   uint64
 }
 
+func (s *Summary) add(attr *Attr) {
+	s.Files++
+	s.Length += attr.Length
+	s.Size += uint64(align4K(attr.Length))
+}
+
+// PendingUsage is the space which is counted as used but not reachable from the root.
+type PendingUsage struct {
+	SustainedInodes uint64
+	SustainedSpace  uint64
+	TrashInodes     uint64
+	TrashSpace      uint64
+}
+
+// GCStats counts the data which is not reachable from any file but not deleted yet.
+type GCStats struct {
+	PendingFiles      uint64 // removed files in the deletion queue
+	PendingFileSpace  uint64
+	PendingSlices     uint64 // slices not referenced any more, which are going to be deleted
+	PendingSliceSpace uint64
+	LeakedSlices      uint64 // slices which were never referenced, they are leaked unless being written now
+	LeakedSpace       uint64
+}
+
+// Total returns the space in bytes of all the files and slices counted.
+func (s *GCStats) Total() uint64 {
+	return s.PendingFileSpace + s.PendingSliceSpace + s.LeakedSpace
+}
+
+// classes of problems found by CheckNamespace
+const (
+	ProblemOrphan   = "orphan"   // an inode with links but no entry
+	ProblemNlink    = "nlink"    // nlink doesn't match the entries
+	ProblemDangling = "dangling" // an entry pointing to a missing inode
+	ProblemParent   = "parent"   // the parent of a directory is not the one containing it
+	ProblemUsage    = "usage"    // the counters of used space or inodes don't match the inodes
+)
+
+// NamespaceProblem is an inconsistency in the metadata.
+type NamespaceProblem struct {
+	Class  string
+	Inode  Ino
+	Detail string
+}
+
+func (p *NamespaceProblem) String() string {
+	if p.Inode == 0 { // not about a single inode
+		return fmt.Sprintf("%s: %s", p.Class, p.Detail)
+	}
+	return fmt.Sprintf("inode %d (%s): %s", p.Inode, p.Class, p.Detail)
+}
+
+// NamespaceReport is the result of CheckNamespace.
+type NamespaceReport struct {
+	Inodes   uint64 // inodes scanned
+	Entries  uint64 // entries scanned
+	Problems []*NamespaceProblem
+}
+
+// Count returns the number of problems of class.
+func (r *NamespaceReport) Count(class string) int {
+	var n int
+	for _, p := range r.Problems {
+		if p.Class == class {
+			n++
+		}
+	}
+	return n
+}
+
 type SessionInfo struct {
-	Version    string
-	Hostname   string
-	MountPoint string
-	ProcessID  int
+	Version      string
+	Hostname     string
+	IP           string `json:",omitempty"`
+	MountPoint   string
+	MountOptions string `json:",omitempty"`
+	Subdir       string `json:",omitempty"`
+	MetricsAddr  string `json:",omitempty"`
+	ProcessID    int
 }
 
 type Flock struct {
@@ -214,10 +341,24 @@ type Flock struct {
 	Ltype string
 }
 
+// PlockRecord is a range of bytes [Start, End] locked by a POSIX lock.
+type PlockRecord struct {
+	Start uint64
+	End   uint64
+	Type  string // R or W
+	Pid   uint32
+}
+
 type Plock struct {
 	Inode   Ino
 	Owner   uint64
-	Records []byte // FIXME: loadLocks
+	Records []PlockRecord
+}
+
+// OpenFile is a file held open by a session, refreshed with the heartbeat.
+type OpenFile struct {
+	Inode Ino
+	Refs  int
 }
 
 // Session contains detailed information of a client session
@@ -225,9 +366,54 @@ type Session struct {
 	Sid       uint64
 	Heartbeat time.Time
 	SessionInfo
-	Sustained []Ino   `json:",omitempty"`
-	Flocks    []Flock `json:",omitempty"`
-	Plocks    []Plock `json:",omitempty"`
+	Sustained []Ino      `json:",omitempty"`
+	Flocks    []Flock    `json:",omitempty"`
+	Plocks    []Plock    `json:",omitempty"`
+	OpenFiles []OpenFile `json:",omitempty"`
+}
+
+// SessionFilter selects sessions by host and heartbeat, the zero value selects all of them.
+type SessionFilter struct {
+	Hostname string        // sessions from this host (name or IP)
+	Idle     time.Duration // sessions without heartbeat for longer than this
+}
+
+func (f *SessionFilter) match(s *Session) bool {
+	if f == nil {
+		return true
+	}
+	return (f.Hostname == "" || s.Hostname == f.Hostname || s.IP == f.Hostname) && (f.Idle <= 0 || time.Since(s.Heartbeat) > f.Idle)
+}
+
+// FindFilter selects entries by their name and attributes, the zero values are ignored.
+type FindFilter struct {
+	Name     string    // shell pattern of the name, see path.Match
+	MinSize  uint64    // length not less than this
+	MaxSize  uint64    // length not greater than this
+	MinMtime time.Time // modified at or after this
+	MaxMtime time.Time // modified at or before this
+	Uid      *uint32   // owned by this user
+	Gid      *uint32   // owned by this group
+}
+
+func (f *FindFilter) matchName(name string) bool {
+	if f.Name == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Name, name)
+	return ok
+}
+
+// Match returns whether the entry with name and attr is selected by f.
+func (f *FindFilter) Match(name string, attr *Attr) bool {
+	if !f.matchName(name) || attr.Length < f.MinSize || f.MaxSize > 0 && attr.Length > f.MaxSize {
+		return false
+	}
+	mtime := time.Unix(attr.Mtime, int64(attr.Mtimensec))
+	if !f.MinMtime.IsZero() && mtime.Before(f.MinMtime) || !f.MaxMtime.IsZero() && mtime.After(f.MaxMtime) {
+		return false
+	}
+	return (f.Uid == nil || attr.Uid == *f.Uid) && (f.Gid == nil || attr.Gid == *f.Gid)
 }
 
 // Meta is a interface for a meta service for file system.
@@ -240,19 +426,37 @@ type Meta interface {
 	Reset() error
 	// Load loads the existing setting of a formatted volume from meta service.
 	Load() (*Format, error)
+	// Generation returns the generation of inode numbers, which is increased when the metadata is loaded
+	// from a dump, as the inode numbers not in the dump could be reused by other files after that.
+	Generation() uint64
 	// NewSession creates a new client session.
 	NewSession() error
 	// CloseSession does cleanup and close the session.
 	CloseSession() error
 	// GetSession retrieves information of session with sid
 	GetSession(sid uint64) (*Session, error)
-	// ListSessions returns all client sessions.
-	ListSessions() ([]*Session, error)
-	// CleanStaleSessions cleans up sessions not active for more than 5 minutes
-	CleanStaleSessions()
+	// ListSessions returns the client sessions selected by filter (nil for all).
+	ListSessions(filter *SessionFilter) ([]*Session, error)
+	// CleanStaleSessions cleans up sessions not active for longer than the session timeout of the volume
+	// (5 minutes by default), or filter.Idle if set, and from filter.Hostname if set.
+	CleanStaleSessions(filter *SessionFilter)
+	// KillSession removes the session sid even if it's active, releasing its locks and deleting its sustained inodes.
+	KillSession(sid uint64) error
+	// ListDeferredFiles returns the removed files whose data is kept in the deletion queue until
+	// Expire, which were held open by dead sessions.
+	ListDeferredFiles() ([]*DumpedDelFile, error)
+	// GetGCStats counts the removed files and unreferenced slices which are waiting to be deleted,
+	// and the slices which may be leaked. It scans all the slices, so it's expensive for big volumes.
+	GetGCStats(ctx Context, stats *GCStats) syscall.Errno
+	// CheckNamespace verifies the inodes, entries and usage counters of the whole volume against each other,
+	// and adds the problems found into report. It scans all the inodes and entries, so it's expensive for big volumes.
+	CheckNamespace(ctx Context, report *NamespaceReport) syscall.Errno
 
 	// StatFS returns summary statistics of a volume.
 	StatFS(ctx Context, totalspace, availspace, iused, iavail *uint64) syscall.Errno
+	// GetPendingUsage returns the space and inodes held by sustained files and the trash, which
+	// are counted as used but will be freed later. It's cached for a few seconds.
+	GetPendingUsage(ctx Context, usage *PendingUsage) syscall.Errno
 	// Access checks the access permission on given inode.
 	Access(ctx Context, inode Ino, modemask uint8, attr *Attr) syscall.Errno
 	// Lookup returns the inode and attributes for the given entry in a directory.
@@ -263,12 +467,18 @@ type Meta interface {
 	Resolve(ctx Context, parent Ino, path string, inode *Ino, attr *Attr) syscall.Errno
 	// GetAttr returns the attributes for given node.
 	GetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
+	// GetParents returns the parents of given node with the number of links in each of them, a file
+	// could have multiple parents if it's hard linked.
+	GetParents(ctx Context, inode Ino) map[Ino]int
 	// SetAttr updates the attributes for given node.
 	SetAttr(ctx Context, inode Ino, set uint16, sggidclearmode uint8, attr *Attr) syscall.Errno
 	// Truncate changes the length for given file.
 	Truncate(ctx Context, inode Ino, flags uint8, attrlength uint64, attr *Attr) syscall.Errno
 	// Fallocate preallocate given space for given file.
 	Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno
+	// Reserve extends a file by size atomically and returns the offset of the reserved range in off,
+	// so concurrent appends from multiple clients never overlap.
+	Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno
 	// ReadLink returns the target of a symlink.
 	ReadLink(ctx Context, inode Ino, path *[]byte) syscall.Errno
 	// Symlink creates a symlink in a directory with given name.
@@ -277,19 +487,37 @@ type Meta interface {
 	Mknod(ctx Context, parent Ino, name string, _type uint8, mode uint16, cumask uint16, rdev uint32, inode *Ino, attr *Attr) syscall.Errno
 	// Mkdir creates a sub-directory with given name and mode.
 	Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask uint16, copysgid uint8, inode *Ino, attr *Attr) syscall.Errno
+	// MknodBatch creates some empty files or directories (_type) with the same mode in a directory, in a few
+	// transactions of the meta engine. The inode and result of every entry are set into inodes and sts, which
+	// should be as long as names. An existing entry gets EEXIST with its inode.
+	MknodBatch(ctx Context, parent Ino, names []string, _type uint8, mode, cumask uint16, inodes []Ino, sts []syscall.Errno) syscall.Errno
 	// Unlink removes a file entry from a directory.
 	// The file will be deleted if it's not linked by any entries and not open by any sessions.
 	Unlink(ctx Context, parent Ino, name string) syscall.Errno
+	// UnlinkBatch removes some file entries from a directory, in a few transactions of the
+	// meta engine. The result of every entry is set into sts, which should be as long as names.
+	UnlinkBatch(ctx Context, parent Ino, names []string, sts []syscall.Errno) syscall.Errno
 	// Rmdir removes an empty sub-directory.
 	Rmdir(ctx Context, parent Ino, name string) syscall.Errno
+	// Remove removes a file or a directory recursively, the files in a directory are removed in
+	// batches. The number of removed entries are added into count if it's not nil.
+	Remove(ctx Context, parent Ino, name string, count *uint64) syscall.Errno
 	// Rename move an entry from a source directory to another with given name.
 	// The targeted entry will be overwrited if it's a file or empty directory.
 	// For Hadoop, the target should not be overwritten.
 	Rename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno
 	// Link creates an entry for node.
 	Link(ctx Context, inodeSrc, parent Ino, name string, attr *Attr) syscall.Errno
-	// Readdir returns all entries for given directory, which include attributes if plus is true.
+	// Readdir returns all entries for given directory, with the attributes asked by wantattr.
 	Readdir(ctx Context, inode Ino, wantattr uint8, entries *[]*Entry) syscall.Errno
+	// ReaddirAt returns about limit entries of given directory from cursor ("" for the beginning),
+	// and updates cursor to continue with, which is "" after all entries are returned.
+	ReaddirAt(ctx Context, inode Ino, wantattr uint8, cursor *string, limit int, entries *[]*Entry) syscall.Errno
+	// GetSummary adds up the files and directories under inode into summary,
+	// the sub-directories are counted without their contents if recursive is false.
+	GetSummary(ctx Context, inode Ino, summary *Summary, recursive bool) syscall.Errno
+	// FillAttrs fetches the attributes for a batch of entries returned by Readdir.
+	FillAttrs(ctx Context, entries []*Entry) syscall.Errno
 	// Create creates a file in a directory with given name.
 	Create(ctx Context, parent Ino, name string, mode uint16, cumask uint16, flags uint32, inode *Ino, attr *Attr) syscall.Errno
 	// Open checks permission on a node and track it as open.
@@ -298,6 +526,8 @@ type Meta interface {
 	Close(ctx Context, inode Ino) syscall.Errno
 	// Read returns the list of slices on the given chunk.
 	Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno
+	// TouchAtime updates atime of a file after it's read, according to the atime mode of the client.
+	TouchAtime(ctx Context, inode Ino) syscall.Errno
 	// NewChunk returns a new id for new data.
 	NewChunk(ctx Context, chunkid *uint64) syscall.Errno
 	// Write put a slice of data on top of the given chunk.
@@ -306,6 +536,9 @@ type Meta interface {
 	InvalidateChunkCache(ctx Context, inode Ino, indx uint32) syscall.Errno
 	// CopyFileRange copies part of a file to another one.
 	CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno
+	// Clone copies a file or a whole directory tree into dstParent with name, sharing the slices of files
+	// with the source instead of copying the data.
+	Clone(ctx Context, srcIno, dstParent Ino, name string) syscall.Errno
 
 	// GetXattr returns the value of extended attribute for given name.
 	GetXattr(ctx Context, inode Ino, name string, vbuff *[]byte) syscall.Errno
@@ -315,6 +548,26 @@ type Meta interface {
 	SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno
 	// RemoveXattr removes the extended attribute of a node.
 	RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
+	// GetQuota returns the quota of a directory, or ENOATTR if it's not set.
+	GetQuota(ctx Context, inode Ino, quota *Quota) syscall.Errno
+	// SetQuota sets the limits of space and inodes (0 for unlimited) of a directory. The usage of it
+	// is counted by walking through the tree when the quota is set for the first time.
+	SetQuota(ctx Context, inode Ino, maxSpace, maxInodes int64) syscall.Errno
+	// DelQuota removes the quota of a directory.
+	DelQuota(ctx Context, inode Ino) syscall.Errno
+	// ListQuotas returns the quotas of all directories.
+	ListQuotas(ctx Context, quotas map[Ino]*Quota) syscall.Errno
+	// CheckQuota counts the usage of a directory by walking through the tree, and returns it in
+	// quota, the usage in the quota is fixed with it if repair is true.
+	CheckQuota(ctx Context, inode Ino, repair bool, quota *Quota) syscall.Errno
+
+	// Find scans the entries of the file system, and returns the ones selected by filter. It scans
+	// about limit entries from cursor ("" to start) in one call, so fewer entries could be returned,
+	// and updates cursor to continue with, or "" when all entries are scanned. As an entry could be
+	// a hard link, the Parent in its attributes is set to the directory it's found in.
+	Find(ctx Context, filter *FindFilter, cursor *string, limit int, entries *[]*Entry) syscall.Errno
+	// ListTagged returns all the nodes with tag key, which should be value if it's not nil.
+	ListTagged(ctx Context, key string, value []byte, inodes *[]Ino) syscall.Errno
 	// Flock tries to put a lock on given file.
 	Flock(ctx Context, inode Ino, owner uint64, ltype uint32, block bool) syscall.Errno
 	// Getlk returns the current lock owner for a range on a file.
@@ -322,17 +575,32 @@ type Meta interface {
 	// Setlk sets a file range lock on given file.
 	Setlk(ctx Context, inode Ino, owner uint64, block bool, ltype uint32, start, end uint64, pid uint32) syscall.Errno
 
-	// Compact all the chunks by merge small slices together
-	CompactAll(ctx Context, bar *utils.Bar) syscall.Errno
-	// ListSlices returns all slices used by all files.
-	ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno
+	// Compact all the chunks by merge small slices together, using threads goroutines.
+	// An interrupted compaction resumes from where it stopped in the next call.
+	CompactAll(ctx Context, threads int, bar *utils.Bar) syscall.Errno
+	// ListSlices calls fn for every slice used by all files, it stops if fn returns an error.
+	ListSlices(ctx Context, delete bool, fn func(inode Ino, s Slice) error) syscall.Errno
+	// UsedSlices returns the chunkids which are still used according to their reference counts,
+	// the slices being deleted are excluded. Redis and TKV don't keep the references of the slices
+	// used once, so a slice deleted completely is still returned by them.
+	UsedSlices(ctx Context, chunkids []uint64) (map[uint64]bool, syscall.Errno)
+
+	// Subscribe calls cb for the events in changelog with the given types (a mask of EventCreate,
+	// EventDelete, EventRename and EventSetAttr) in the order of their IDs, starting after the one
+	// with ID after (0 for all the retained ones). It blocks until ctx is canceled or cb returns an error.
+	Subscribe(ctx Context, types uint8, after uint64, cb func(e *Event) error) error
 
 	// OnMsg add a callback for the given message type.
 	OnMsg(mtype uint32, cb MsgCallback)
 
 	// Dump the tree under root; 0 means using root of the current metadata engine
 	DumpMeta(w io.Writer, root Ino) error
-	LoadMeta(r io.Reader) error
+	// DumpMetaLines dumps the metadata in JSON lines, with constant memory.
+	// Only the inodes changed after since are dumped if it's not zero.
+	DumpMetaLines(w io.Writer, root Ino, since time.Time) error
+	// LoadMeta loads a dump into an empty volume, the duplicated names in it are resolved by
+	// opts (nil means aborting) and the conflicts are appended into opts.
+	LoadMeta(r io.Reader, opts *LoadOptions) error
 }
 
 func removePassword(uri string) string {
@@ -384,13 +652,43 @@ func NewClient(uri string, conf *Config) Meta {
 	return m
 }
 
-func newSessionInfo() *SessionInfo {
+func newSessionInfo(conf *Config) *SessionInfo {
 	host, err := os.Hostname()
 	if err != nil {
 		logger.Warnf("Failed to get hostname: %s", err)
 		host = ""
 	}
-	return &SessionInfo{Version: version.Version(), Hostname: host, ProcessID: os.Getpid()}
+	return &SessionInfo{
+		Version:      version.Version(),
+		Hostname:     host,
+		IP:           localIP(),
+		MountPoint:   conf.MountPoint,
+		MountOptions: conf.MountOptions,
+		Subdir:       conf.Subdir,
+		MetricsAddr:  conf.MetricsAddr,
+		ProcessID:    os.Getpid(),
+	}
+}
+
+// localIP returns the first global unicast address of this host, prefer IPv4 ones.
+func localIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warnf("Failed to get addresses of interfaces: %s", err)
+		return ""
+	}
+	var ip string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+			if n.IP.To4() != nil {
+				return n.IP.String()
+			}
+			if ip == "" {
+				ip = n.IP.String()
+			}
+		}
+	}
+	return ip
 }
 
 func timeit(start time.Time) {
@@ -430,3 +728,30 @@ func GetPath(m Meta, ctx Context, inode Ino) (string, syscall.Errno) {
 	}
 	return "/" + strings.Join(names, "/"), 0
 }
+
+// GetPaths returns all the paths of an inode, there are more than one if it's hard linked.
+func GetPaths(m Meta, ctx Context, inode Ino) []string {
+	if inode == 1 {
+		return []string{"/"}
+	}
+	var paths []string
+	for parent := range m.GetParents(ctx, inode) {
+		dir, st := GetPath(m, ctx, parent)
+		if st != 0 {
+			logger.Debugf("getpath of parent %d: %s", parent, st)
+			continue
+		}
+		var entries []*Entry
+		if st = m.Readdir(ctx, parent, 0, &entries); st != 0 {
+			logger.Debugf("readdir inode %d: %s", parent, st)
+			continue
+		}
+		for _, e := range entries {
+			if e.Inode == inode && string(e.Name) != "." && string(e.Name) != ".." {
+				paths = append(paths, path.Join(dir, string(e.Name)))
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,117 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"sync"
+	"time"
+)
+
+// IDs of inodes and chunks are namespaced by the cluster ID of volume in the high bits,
+// the low idSeqBits bits are allocated from the counters.
+const (
+	idSeqBits    = 48
+	MaxClusterID = 255 // keep the IDs below TrashInode
+)
+
+// idSeq returns the sequence part of a namespaced ID.
+func idSeq(id uint64) uint64 {
+	return id & (1<<idSeqBits - 1)
+}
+
+// namespaced returns the ID of seq in the namespace of cluster.
+func namespaced(cluster int, seq uint64) uint64 {
+	return uint64(cluster)<<idSeqBits | idSeq(seq)
+}
+
+// idLease hands out IDs from ranges leased from a counter in the metadata engine, so the
+// counter is only touched once per range instead of once per create. The size of range
+// grows when the previous one was used up quickly, and the next range is leased in
+// background before the current one runs out, so creates rarely wait for the counter.
+type idLease struct {
+	sync.Mutex
+	counter  string
+	minBatch uint64
+	maxBatch uint64
+	batch    uint64
+	next     uint64
+	maxid    uint64
+	spare    [2]uint64 // the range leased in advance, [start, end)
+	leasing  bool
+	leased   time.Time
+}
+
+func newIDLease(counter string, minBatch, maxBatch uint64) idLease {
+	return idLease{counter: counter, minBatch: minBatch, maxBatch: maxBatch, batch: minBatch}
+}
+
+// size returns the size of next range, adjusted by how fast the last one was used.
+func (l *idLease) size() uint64 {
+	now := time.Now()
+	if used := now.Sub(l.leased); used < time.Second && l.batch < l.maxBatch {
+		l.batch *= 2
+	} else if used > time.Minute && l.batch > l.minBatch {
+		l.batch /= 2
+	}
+	l.leased = now
+	return l.batch
+}
+
+func (l *idLease) lease(en engine, n uint64) (uint64, uint64, error) {
+	v, err := en.incrCounter(l.counter, int64(n))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(v) - n, uint64(v), nil
+}
+
+func (l *idLease) prefetch(en engine, n uint64) {
+	start, end, err := l.lease(en, n)
+	l.Lock()
+	defer l.Unlock()
+	l.leasing = false
+	if err != nil {
+		logger.Warnf("lease %d IDs of %s: %s", n, l.counter, err)
+		return
+	}
+	l.spare = [2]uint64{start, end}
+}
+
+// alloc returns the next free ID.
+func (l *idLease) alloc(en engine) (uint64, error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.next >= l.maxid {
+		if l.spare[1] > l.spare[0] {
+			l.next, l.maxid = l.spare[0], l.spare[1]
+			l.spare = [2]uint64{}
+		} else {
+			start, end, err := l.lease(en, l.size())
+			if err != nil {
+				return 0, err
+			}
+			l.next, l.maxid = start, end
+		}
+	}
+	id := l.next
+	l.next++
+	if !l.leasing && l.spare[1] == 0 && l.maxid-l.next <= l.batch/2 {
+		l.leasing = true
+		go l.prefetch(en, l.size())
+	}
+	return id, nil
+}
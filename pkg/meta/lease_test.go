@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestIDLease(t *testing.T) {
+	m, err := newKVMeta("memkv", "jfs-id-lease", &Config{})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	en := m.(*kvMeta)
+	l := newIDLease("nextTest", 10, 80)
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var g sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		g.Add(1)
+		go func() {
+			defer g.Done()
+			for j := 0; j < 100; j++ {
+				id, err := l.alloc(en)
+				if err != nil {
+					t.Errorf("alloc: %s", err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("id %d is allocated twice", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	g.Wait()
+	if len(seen) != 800 {
+		t.Fatalf("expect 800 IDs, got %d", len(seen))
+	}
+	l.Lock()
+	batch := l.batch
+	l.Unlock()
+	if batch <= 10 || batch > 80 {
+		t.Fatalf("batch should grow up to 80 under load, but got %d", batch)
+	}
+	v, err := en.getCounter(en.counterKey("nextTest"))
+	if err != nil {
+		t.Fatalf("get counter: %s", err)
+	}
+	// at most one range leased in advance beyond the current one
+	if v < 800 || v > 800+2*80 {
+		t.Fatalf("unexpected counter: %d", v)
+	}
+}
+
+func TestNamespacedID(t *testing.T) {
+	if id := namespaced(0, 100); id != 100 {
+		t.Fatalf("id in default namespace: %d", id)
+	}
+	id := namespaced(3, 100)
+	if id != 3<<idSeqBits|100 || idSeq(id) != 100 {
+		t.Fatalf("id in namespace 3: %x", id)
+	}
+	if namespaced(MaxClusterID, 1<<idSeqBits-1) >= TrashInode {
+		t.Fatalf("namespaced ID should be smaller than TrashInode")
+	}
+}
@@ -18,6 +18,7 @@
 package meta
 
 const scriptLookup = `
+local prefix = string.match(KEYS[1], "^(.*)d%d+$")
 local buf = redis.call('HGET', KEYS[1], KEYS[2])
 if not buf then
     error("ENOENT")
@@ -27,10 +28,12 @@ local ino = struct.unpack(">I8", string.sub(buf, 2))
 if ino > 4503599627370495 then
     error("ENOTSUP")
 end
-return {ino, redis.call('GET', "i" .. string.format("%.f", ino))}
+return {ino, redis.call('GET', prefix .. "i" .. string.format("%.f", ino))}
 `
 
 const scriptResolve = `
+local prefix, root = string.match(KEYS[1], "^(.*)i(%d+)$")
+
 local function unpack_attr(buf)
     local x = {}
     x.flags, x.mode, x.uid, x.gid = struct.unpack(">BHI4I4", string.sub(buf, 0, 11))
@@ -40,7 +43,7 @@ local function unpack_attr(buf)
 end
 
 local function get_attr(ino)
-    local encoded_attr = redis.call('GET', "i" .. string.format("%.f", ino))
+    local encoded_attr = redis.call('GET', prefix .. "i" .. string.format("%.f", ino))
     if not encoded_attr then
         error("ENOENT")
     end
@@ -48,7 +51,7 @@ local function get_attr(ino)
 end
 
 local function lookup(parent, name)
-    local buf = redis.call('HGET', "d" .. string.format("%.f", parent), name)
+    local buf = redis.call('HGET', prefix .. "d" .. string.format("%.f", parent), name)
     if not buf then
         error("ENOENT")
     end
@@ -88,8 +91,8 @@ local function resolve(parent, path, uid, gid)
     if parent > _maxIno then
         error("ENOTSUP")
     end
-    return {parent, redis.call('GET', "i" .. string.format("%.f", parent))}
+    return {parent, redis.call('GET', prefix .. "i" .. string.format("%.f", parent))}
 end
 
-return resolve(tonumber(KEYS[1]), KEYS[2], tonumber(KEYS[3]), tonumber(KEYS[4]))
+return resolve(tonumber(root), KEYS[2], tonumber(KEYS[3]), tonumber(KEYS[4]))
 `
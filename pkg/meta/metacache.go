@@ -0,0 +1,205 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cachedAttr struct {
+	attr   Attr
+	expire time.Time
+}
+
+type cachedEntry struct {
+	inode  Ino
+	expire time.Time
+}
+
+// metaCache keeps the attributes and entries fetched by this client for a while. They are invalidated
+// by the changes from this client at once, and by the ones from other clients through the notifications
+// of engine, or expire after ttl if the engine can't notify.
+type metaCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	attrs   map[Ino]*cachedAttr
+	entries map[Ino]map[string]*cachedEntry
+	notify  chan string
+}
+
+func newMetaCache(ttl time.Duration) *metaCache {
+	mc := &metaCache{
+		ttl:     ttl,
+		attrs:   make(map[Ino]*cachedAttr),
+		entries: make(map[Ino]map[string]*cachedEntry),
+		notify:  make(chan string, 10240),
+	}
+	go mc.cleanup()
+	return mc
+}
+
+func (mc *metaCache) cleanup() {
+	for {
+		time.Sleep(mc.ttl * 10)
+		now := time.Now()
+		mc.Lock()
+		for ino, a := range mc.attrs {
+			if a.expire.Before(now) {
+				delete(mc.attrs, ino)
+			}
+		}
+		for parent, es := range mc.entries {
+			for name, e := range es {
+				if e.expire.Before(now) {
+					delete(es, name)
+				}
+			}
+			if len(es) == 0 {
+				delete(mc.entries, parent)
+			}
+		}
+		mc.Unlock()
+	}
+}
+
+func (mc *metaCache) getAttr(ino Ino, attr *Attr) bool {
+	mc.Lock()
+	defer mc.Unlock()
+	a, ok := mc.attrs[ino]
+	if !ok || a.expire.Before(time.Now()) {
+		return false
+	}
+	*attr = a.attr
+	return true
+}
+
+func (mc *metaCache) putAttr(ino Ino, attr *Attr) {
+	if !attr.Full {
+		return
+	}
+	mc.Lock()
+	mc.attrs[ino] = &cachedAttr{*attr, time.Now().Add(mc.ttl)}
+	mc.Unlock()
+}
+
+func (mc *metaCache) getEntry(parent Ino, name string) (Ino, bool) {
+	mc.Lock()
+	defer mc.Unlock()
+	e, ok := mc.entries[parent][name]
+	if !ok || e.expire.Before(time.Now()) {
+		return 0, false
+	}
+	return e.inode, true
+}
+
+func (mc *metaCache) putEntry(parent Ino, name string, inode Ino) {
+	mc.Lock()
+	defer mc.Unlock()
+	es := mc.entries[parent]
+	if es == nil {
+		es = make(map[string]*cachedEntry)
+		mc.entries[parent] = es
+	}
+	es[name] = &cachedEntry{inode, time.Now().Add(mc.ttl)}
+}
+
+func (mc *metaCache) invalidateAttr(ino Ino) {
+	mc.Lock()
+	delete(mc.attrs, ino)
+	mc.Unlock()
+}
+
+// invalidateEntry drops an entry, the attributes of its parent and the inode it pointed to.
+func (mc *metaCache) invalidateEntry(parent Ino, name string) {
+	mc.Lock()
+	defer mc.Unlock()
+	if e, ok := mc.entries[parent][name]; ok {
+		delete(mc.attrs, e.inode)
+		delete(mc.entries[parent], name)
+	}
+	delete(mc.attrs, parent)
+}
+
+// changedAttr invalidates the cached attributes of an inode changed by this client, and queues a message to
+// invalidate it in other clients, which is "a<inode>".
+func (mc *metaCache) changedAttr(ino Ino) {
+	mc.invalidateAttr(ino)
+	mc.queue("a" + ino.String())
+}
+
+// changedEntry is like changedAttr but for an entry, the message is "e<parent>/<name>".
+func (mc *metaCache) changedEntry(parent Ino, name string) {
+	mc.invalidateEntry(parent, name)
+	mc.queue("e" + parent.String() + "/" + name)
+}
+
+func (mc *metaCache) queue(msg string) {
+	select {
+	case mc.notify <- msg:
+	default:
+		// other clients will see the change after ttl
+		logger.Debugf("too many changes to notify, drop %q", msg)
+	}
+}
+
+func (mc *metaCache) handle(msg string) {
+	if len(msg) > 1 {
+		switch msg[0] {
+		case 'a':
+			if ino, err := strconv.ParseUint(msg[1:], 10, 64); err == nil {
+				mc.invalidateAttr(Ino(ino))
+				return
+			}
+		case 'e':
+			if p := strings.IndexByte(msg, '/'); p > 0 {
+				if parent, err := strconv.ParseUint(msg[1:p], 10, 64); err == nil {
+					mc.invalidateEntry(Ino(parent), msg[p+1:])
+					return
+				}
+			}
+		}
+	}
+	logger.Warnf("invalid message to invalidate cached metadata: %q", msg)
+}
+
+func (m *baseMeta) invalidateEntry(parent Ino, name string) {
+	if m.mc != nil {
+		m.mc.changedEntry(parent, name)
+	}
+}
+
+// startMetaCache sends the changes of this client to others, and receives theirs.
+func (m *baseMeta) startMetaCache() {
+	if m.mc == nil {
+		return
+	}
+	go func() {
+		for msg := range m.mc.notify {
+			if err := m.en.doNotify(msg); err != nil {
+				logger.Warnf("notify %q: %s", msg, err)
+			}
+		}
+	}()
+	go func() {
+		if err := m.en.doWatch(m.mc.handle); err != nil {
+			logger.Warnf("Cached metadata can't be invalidated by other clients, it expires after %s: %s", m.mc.ttl, err)
+		}
+	}()
+}
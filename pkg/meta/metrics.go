@@ -28,15 +28,30 @@ var (
 		Name: "transaction_restart",
 		Help: "The number of times a transaction is restarted.",
 	})
+	staleSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "stale_sessions",
+		Help: "The number of stale sessions found in the last check.",
+	})
 	opDist = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "meta_ops_durations_histogram_seconds",
 		Help:    "Operation latency distributions.",
 		Buckets: prometheus.ExponentialBuckets(0.0001, 1.5, 30),
 	})
+	scrubbedInodes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scrubbed_inodes",
+		Help: "The number of inodes checked by scrub.",
+	})
+	scrubAnomalies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scrub_anomalies",
+		Help: "The number of anomalies found by scrub.",
+	}, []string{"kind"})
 )
 
 func InitMetrics() {
 	prometheus.MustRegister(txDist)
 	prometheus.MustRegister(txRestart)
 	prometheus.MustRegister(opDist)
+	prometheus.MustRegister(staleSessions)
+	prometheus.MustRegister(scrubbedInodes)
+	prometheus.MustRegister(scrubAnomalies)
 }
@@ -15,8 +15,10 @@ type openFile struct {
 
 type openfiles struct {
 	sync.Mutex
-	expire time.Duration
-	files  map[Ino]*openFile
+	expire  time.Duration
+	files   map[Ino]*openFile
+	handles int
+	mc      *metaCache // invalidated together with the open files
 }
 
 func newOpenFiles(expire time.Duration) *openfiles {
@@ -51,6 +53,7 @@ func (o *openfiles) OpenCheck(ino Ino, attr *Attr) bool {
 			*attr = of.attr
 		}
 		of.refs++
+		o.handles++
 		return true
 	}
 	return false
@@ -75,6 +78,7 @@ func (o *openfiles) Open(ino Ino, attr *Attr) {
 	// next open can keep cache if not modified
 	of.attr.KeepCache = true
 	of.refs++
+	o.handles++
 	of.lastCheck = time.Now()
 }
 
@@ -84,11 +88,32 @@ func (o *openfiles) Close(ino Ino) bool {
 	of, ok := o.files[ino]
 	if ok {
 		of.refs--
+		o.handles--
 		return of.refs <= 0
 	}
 	return true
 }
 
+// Handles returns the number of open handles.
+func (o *openfiles) Handles() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.handles
+}
+
+// Snapshot returns the inodes that are currently open and their references.
+func (o *openfiles) Snapshot() map[Ino]int {
+	o.Lock()
+	defer o.Unlock()
+	files := make(map[Ino]int)
+	for ino, of := range o.files {
+		if of.refs > 0 {
+			files[ino] = of.refs
+		}
+	}
+	return files
+}
+
 func (o *openfiles) Check(ino Ino, attr *Attr) bool {
 	if attr == nil {
 		panic("attr is nil")
@@ -103,6 +128,17 @@ func (o *openfiles) Check(ino Ino, attr *Attr) bool {
 	return false
 }
 
+// CachedAttr returns the attributes of an open file, which could be out of date.
+func (o *openfiles) CachedAttr(ino Ino, attr *Attr) bool {
+	o.Lock()
+	defer o.Unlock()
+	of, ok := o.files[ino]
+	if ok {
+		*attr = of.attr
+	}
+	return ok
+}
+
 func (o *openfiles) Update(ino Ino, attr *Attr) bool {
 	if attr == nil {
 		panic("attr is nil")
@@ -151,6 +187,9 @@ func (o *openfiles) CacheChunk(ino Ino, indx uint32, cs []Slice) {
 }
 
 func (o *openfiles) InvalidateChunk(ino Ino, indx uint32) {
+	if o.mc != nil {
+		o.mc.changedAttr(ino)
+	}
 	o.Lock()
 	defer o.Unlock()
 	of, ok := o.files[ino]
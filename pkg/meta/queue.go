@@ -0,0 +1,92 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inodeQueue serializes the modifications (write, truncate, fallocate) of the same inode
+// within one client in the order of arrival, so a stream of small writes from it can't
+// starve a truncate. The modifications from different clients are not queued, their
+// conflicts are resolved by the retries of transactions in the engine.
+type inodeQueue struct {
+	sync.Mutex
+	waiters map[Ino][]chan struct{} // the first one is holding the inode
+}
+
+func newInodeQueue() *inodeQueue {
+	return &inodeQueue{waiters: make(map[Ino][]chan struct{})}
+}
+
+// lock waits for the earlier callers of the same inode, and returns the function to release it.
+// It gives up the place in the queue and returns EINTR if ctx is canceled while waiting.
+func (q *inodeQueue) lock(ctx Context, inode Ino) (func(), syscall.Errno) {
+	ch := make(chan struct{})
+	q.Lock()
+	ws := q.waiters[inode]
+	q.waiters[inode] = append(ws, ch)
+	q.Unlock()
+	unlock := func() { q.unlock(inode) }
+	if len(ws) == 0 {
+		return unlock, 0
+	}
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch:
+			return unlock, 0
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		if ctx.Canceled() || ctx.Err() != nil {
+			if q.cancel(inode, ch) {
+				return nil, syscall.EINTR
+			}
+			return unlock, 0 // woken up already
+		}
+	}
+}
+
+// cancel removes ch from the queue of inode, it returns false if ch is holding the inode.
+func (q *inodeQueue) cancel(inode Ino, ch chan struct{}) bool {
+	q.Lock()
+	defer q.Unlock()
+	ws := q.waiters[inode]
+	for i := 1; i < len(ws); i++ {
+		if ws[i] == ch {
+			q.waiters[inode] = append(ws[:i:i], ws[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *inodeQueue) unlock(inode Ino) {
+	q.Lock()
+	defer q.Unlock()
+	ws := q.waiters[inode][1:]
+	if len(ws) == 0 {
+		delete(q.waiters, inode)
+	} else {
+		q.waiters[inode] = ws
+		close(ws[0])
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInodeQueue(t *testing.T) {
+	q := newInodeQueue()
+	unlock, _ := q.lock(Background, 1)
+	other, _ := q.lock(Background, 2) // different inodes are independent
+	other()
+
+	var mu sync.Mutex
+	var order []int
+	var g sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		g.Add(1)
+		go func(i int) {
+			defer g.Done()
+			unlock, st := q.lock(Background, 1)
+			if st != 0 {
+				t.Errorf("lock: %s", st)
+				return
+			}
+			defer unlock()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		}(i)
+		// wait for it to be queued
+		for {
+			q.Lock()
+			n := len(q.waiters[1])
+			q.Unlock()
+			if n == i+2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	unlock()
+	g.Wait()
+	for i, o := range order {
+		if i != o {
+			t.Fatalf("not in order: %v", order)
+		}
+	}
+	if len(order) != 10 || len(q.waiters) != 0 {
+		t.Fatalf("order %v, waiters %v", order, q.waiters)
+	}
+}
+
+func TestInodeQueueCancel(t *testing.T) {
+	q := newInodeQueue()
+	unlock, _ := q.lock(Background, 1)
+	cctx, cancel := context.WithCancel(context.Background())
+	done := make(chan syscall.Errno)
+	go func() {
+		_, st := q.lock(&emptyContext{cctx}, 1)
+		done <- st
+	}()
+	var g sync.WaitGroup
+	g.Add(1)
+	go func() {
+		defer g.Done()
+		for {
+			q.Lock()
+			n := len(q.waiters[1])
+			q.Unlock()
+			if n == 2 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		last, _ := q.lock(Background, 1) // queued after the canceled one
+		last()
+	}()
+	for {
+		q.Lock()
+		n := len(q.waiters[1])
+		q.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if st := <-done; st != syscall.EINTR {
+		t.Fatalf("lock with canceled context: %s", st)
+	}
+	unlock()
+	g.Wait()
+	if len(q.waiters) != 0 {
+		t.Fatalf("waiters %v", q.waiters)
+	}
+}
@@ -0,0 +1,501 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Quota is the limits and usage of a directory, counting all the entries under it
+// (not including itself), and every hard link of a file is counted as an entry.
+type Quota struct {
+	MaxSpace   int64 // limit of space in bytes, 0 for unlimited
+	MaxInodes  int64 // limit of inodes, 0 for unlimited
+	UsedSpace  int64
+	UsedInodes int64
+	newSpace   int64 // changed by this client but not flushed yet
+	newInodes  int64
+}
+
+func (q *Quota) check(space, inodes int64) bool {
+	if space > 0 && q.MaxSpace > 0 && atomic.LoadInt64(&q.UsedSpace)+atomic.LoadInt64(&q.newSpace)+space > q.MaxSpace {
+		return true
+	}
+	return inodes > 0 && q.MaxInodes > 0 && atomic.LoadInt64(&q.UsedInodes)+atomic.LoadInt64(&q.newInodes)+inodes > q.MaxInodes
+}
+
+func (q *Quota) update(space, inodes int64) {
+	atomic.AddInt64(&q.newSpace, space)
+	atomic.AddInt64(&q.newInodes, inodes)
+}
+
+// usage returns the space and inodes used by a node.
+func usage(attr *Attr) (int64, int64) {
+	if attr.Typ == TypeFile {
+		return align4K(attr.Length), 1
+	}
+	return align4K(0), 1
+}
+
+func (m *baseMeta) hasDirQuotas() bool {
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	return len(m.dirQuotas) > 0
+}
+
+func (m *baseMeta) getDirParent(ctx Context, inode Ino) (Ino, bool) {
+	m.quotaMu.RLock()
+	parent, ok := m.dirParents[inode]
+	m.quotaMu.RUnlock()
+	if ok {
+		return parent, true
+	}
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		logger.Warnf("get parent of directory %d: %s", inode, st)
+		return 0, false
+	}
+	m.quotaMu.Lock()
+	m.dirParents[inode] = attr.Parent
+	m.quotaMu.Unlock()
+	return attr.Parent, true
+}
+
+// dirQuotasOf returns the quotas of parent and all its ancestors.
+func (m *baseMeta) dirQuotasOf(ctx Context, parent Ino) []*Quota {
+	if parent == 0 || isTrash(parent) || !m.hasDirQuotas() {
+		return nil
+	}
+	var qs []*Quota
+	for inode := parent; inode > 0; {
+		m.quotaMu.RLock()
+		q := m.dirQuotas[inode]
+		m.quotaMu.RUnlock()
+		if q != nil {
+			qs = append(qs, q)
+		}
+		if inode == 1 {
+			break
+		}
+		var ok bool
+		if inode, ok = m.getDirParent(ctx, inode); !ok {
+			break
+		}
+	}
+	return qs
+}
+
+// checkDirQuota returns true if any quota of parent or its ancestors would be exceeded.
+func (m *baseMeta) checkDirQuota(ctx Context, parent Ino, space, inodes int64) bool {
+	if space <= 0 && inodes <= 0 {
+		return false
+	}
+	for _, q := range m.dirQuotasOf(ctx, parent) {
+		if q.check(space, inodes) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *baseMeta) updateDirQuota(ctx Context, parent Ino, space, inodes int64) {
+	if space == 0 && inodes == 0 {
+		return
+	}
+	for _, q := range m.dirQuotasOf(ctx, parent) {
+		q.update(space, inodes)
+	}
+}
+
+func sameQuotas(a, b []*Quota) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func excludeQuotas(qs, others []*Quota) []*Quota {
+	var r []*Quota
+	for _, q := range qs {
+		var found bool
+		for _, o := range others {
+			found = found || o == q
+		}
+		if !found {
+			r = append(r, q)
+		}
+	}
+	return r
+}
+
+// checkRenameQuota checks the quotas for moving an entry (with srcAttr) from parentSrc to parentDst,
+// replacing or exchanging with an existing entry (with dstAttr, nil if not existed). As the usage of
+// directories are not tracked, moving them across quotas is not supported.
+func (m *baseMeta) checkRenameQuota(ctx Context, parentSrc, parentDst Ino, srcAttr, dstAttr *Attr, exchange bool) syscall.Errno {
+	if parentSrc == parentDst {
+		return 0
+	}
+	srcQs, dstQs := m.dirQuotasOf(ctx, parentSrc), m.dirQuotasOf(ctx, parentDst)
+	if sameQuotas(srcQs, dstQs) {
+		return 0
+	}
+	if srcAttr.Typ == TypeDirectory || exchange && dstAttr != nil && dstAttr.Typ == TypeDirectory {
+		return syscall.EXDEV
+	}
+	space, inodes := usage(srcAttr)
+	for _, q := range excludeQuotas(dstQs, srcQs) {
+		if q.check(space, inodes) {
+			return syscall.EDQUOT
+		}
+	}
+	if exchange && dstAttr != nil {
+		space, inodes = usage(dstAttr)
+		for _, q := range excludeQuotas(srcQs, dstQs) {
+			if q.check(space, inodes) {
+				return syscall.EDQUOT
+			}
+		}
+	}
+	return 0
+}
+
+func (m *baseMeta) updateRenameQuota(ctx Context, parentSrc, parentDst Ino, srcAttr, dstAttr *Attr, exchange bool) {
+	if dstAttr != nil {
+		space, inodes := usage(dstAttr)
+		m.updateDirQuota(ctx, parentDst, -space, -inodes)
+		if exchange {
+			m.updateDirQuota(ctx, parentSrc, space, inodes)
+		}
+	}
+	if parentSrc != parentDst {
+		space, inodes := usage(srcAttr)
+		m.updateDirQuota(ctx, parentSrc, -space, -inodes)
+		m.updateDirQuota(ctx, parentDst, space, inodes)
+	}
+}
+
+// loadQuotas reloads the quotas changed by other clients, and drops the cached parents
+// of directories, which could be renamed.
+func (m *baseMeta) loadQuotas() {
+	quotas, err := m.en.doLoadQuotas()
+	if err != nil {
+		logger.Warnf("load quotas: %s", err)
+		return
+	}
+	if q := quotas[TrashInode]; q != nil {
+		atomic.StoreInt64(&m.trashUsage.UsedSpace, q.UsedSpace)
+		atomic.StoreInt64(&m.trashUsage.UsedInodes, q.UsedInodes)
+		delete(quotas, TrashInode)
+	} else if m.fmt.TrashDays > 0 { // the trash was just enabled or not counted by older clients
+		m.recountTrash()
+	}
+	m.quotaMu.Lock()
+	defer m.quotaMu.Unlock()
+	for inode, q := range quotas {
+		if old := m.dirQuotas[inode]; old != nil {
+			q.newSpace, q.newInodes = atomic.LoadInt64(&old.newSpace), atomic.LoadInt64(&old.newInodes)
+		}
+	}
+	m.dirQuotas = quotas
+	m.dirParents = make(map[Ino]Ino)
+}
+
+func (m *baseMeta) flushQuotas() {
+	m.quotaMu.RLock()
+	deltas := make(map[Ino]*Quota)
+	for inode, q := range m.dirQuotas {
+		space, inodes := atomic.SwapInt64(&q.newSpace, 0), atomic.SwapInt64(&q.newInodes, 0)
+		if space != 0 || inodes != 0 {
+			deltas[inode] = &Quota{UsedSpace: space, UsedInodes: inodes}
+		}
+	}
+	m.quotaMu.RUnlock()
+	space, inodes := atomic.SwapInt64(&m.trashUsage.newSpace, 0), atomic.SwapInt64(&m.trashUsage.newInodes, 0)
+	if space != 0 || inodes != 0 {
+		deltas[TrashInode] = &Quota{UsedSpace: space, UsedInodes: inodes}
+	}
+	if len(deltas) == 0 {
+		return
+	}
+	err := m.en.doFlushQuotas(deltas)
+	if d := deltas[TrashInode]; d != nil {
+		if err != nil {
+			m.trashUsage.update(d.UsedSpace, d.UsedInodes)
+		} else {
+			atomic.AddInt64(&m.trashUsage.UsedSpace, d.UsedSpace)
+			atomic.AddInt64(&m.trashUsage.UsedInodes, d.UsedInodes)
+		}
+	}
+	m.quotaMu.RLock()
+	defer m.quotaMu.RUnlock()
+	for inode, d := range deltas {
+		if q := m.dirQuotas[inode]; q != nil {
+			if err != nil {
+				q.update(d.UsedSpace, d.UsedInodes)
+			} else {
+				atomic.AddInt64(&q.UsedSpace, d.UsedSpace)
+				atomic.AddInt64(&q.UsedInodes, d.UsedInodes)
+			}
+		}
+	}
+	if err != nil {
+		logger.Warnf("update usage of quotas: %s", err)
+	}
+}
+
+// countUsage walks the tree of inode, and returns the space and inodes used by the entries in it.
+func (m *baseMeta) countUsage(ctx Context, inode Ino) (space, inodes int64, st syscall.Errno) {
+	var entries []*Entry
+	if st = m.en.doReaddir(ctx, inode, 1, &entries); st != 0 {
+		return
+	}
+	for _, e := range entries {
+		s, i := usage(e.Attr)
+		space += s
+		inodes += i
+		if e.Attr.Typ == TypeDirectory {
+			if s, i, st = m.countUsage(ctx, e.Inode); st != 0 {
+				return
+			}
+			space += s
+			inodes += i
+		}
+	}
+	return
+}
+
+func (m *baseMeta) checkDir(ctx Context, inode Ino) syscall.Errno {
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		return st
+	}
+	if attr.Typ != TypeDirectory {
+		return syscall.ENOTDIR
+	}
+	return 0
+}
+
+func (m *baseMeta) GetQuota(ctx Context, inode Ino, quota *Quota) syscall.Errno {
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	q, err := m.en.doGetQuota(inode)
+	if err != nil {
+		return errno(err)
+	}
+	if q == nil {
+		return ENOATTR
+	}
+	*quota = *q
+	return 0
+}
+
+func (m *baseMeta) SetQuota(ctx Context, inode Ino, maxSpace, maxInodes int64) syscall.Errno {
+	if maxSpace < 0 || maxInodes < 0 {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	if st := m.checkDir(ctx, inode); st != 0 {
+		return st
+	}
+	q, err := m.en.doGetQuota(inode)
+	if err != nil {
+		return errno(err)
+	}
+	if q == nil {
+		q = &Quota{}
+		var st syscall.Errno
+		if q.UsedSpace, q.UsedInodes, st = m.countUsage(ctx, inode); st != 0 {
+			return st
+		}
+	}
+	q.MaxSpace, q.MaxInodes = maxSpace, maxInodes
+	return errno(m.en.doSetQuota(inode, q))
+}
+
+func (m *baseMeta) DelQuota(ctx Context, inode Ino) syscall.Errno {
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	q, err := m.en.doGetQuota(inode)
+	if err != nil {
+		return errno(err)
+	}
+	if q == nil {
+		return ENOATTR
+	}
+	return errno(m.en.doDelQuota(inode))
+}
+
+func (m *baseMeta) ListQuotas(ctx Context, quotas map[Ino]*Quota) syscall.Errno {
+	defer timeit(time.Now())
+	qs, err := m.en.doLoadQuotas()
+	if err != nil {
+		return errno(err)
+	}
+	for inode, q := range qs {
+		if inode != TrashInode {
+			quotas[inode] = q
+		}
+	}
+	return 0
+}
+
+// trashUsed returns the space used by the entries in trash.
+func (m *baseMeta) trashUsed() int64 {
+	return atomic.LoadInt64(&m.trashUsage.UsedSpace) + atomic.LoadInt64(&m.trashUsage.newSpace)
+}
+
+// trashReserved returns the space reserved for the trash but not used yet.
+func (m *baseMeta) trashReserved() int64 {
+	if m.fmt.TrashDays == 0 || m.fmt.TrashQuota == 0 {
+		return 0
+	}
+	if r := int64(m.fmt.TrashQuota) - m.trashUsed(); r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (m *baseMeta) trashExceeded() bool {
+	return m.fmt.TrashQuota > 0 && m.trashUsed() > int64(m.fmt.TrashQuota)
+}
+
+// updateTrashUsage records the usage of entries moved into (or removed from) the trash,
+// and purges the oldest entries in background once the trash quota is exceeded.
+func (m *baseMeta) updateTrashUsage(space, inodes int64) {
+	if m.fmt.TrashDays == 0 || space == 0 && inodes == 0 {
+		return
+	}
+	m.trashUsage.update(space, inodes)
+	if space > 0 && m.trashExceeded() && atomic.CompareAndSwapInt32(&m.purging, 0, 1) {
+		go func() {
+			m.doCleanupTrash(false)
+			atomic.StoreInt32(&m.purging, 0)
+		}()
+	}
+}
+
+// recountTrash walks the trash to correct the usage of it, which could drift
+// when clients crashed before flushing their changes.
+func (m *baseMeta) recountTrash() {
+	ctx := Background
+	var entries []*Entry
+	if st := m.en.doReaddir(ctx, TrashInode, 0, &entries); st != 0 {
+		logger.Warnf("readdir trash %d: %s", TrashInode, st)
+		return
+	}
+	var space, inodes int64
+	for _, e := range entries {
+		s, i, st := m.countUsage(ctx, e.Inode)
+		if st != 0 {
+			logger.Warnf("count usage of subTrash %s: %s", e.Name, st)
+			return
+		}
+		space += s
+		inodes += i
+	}
+	if err := m.en.doSetQuota(TrashInode, &Quota{UsedSpace: space, UsedInodes: inodes}); err != nil {
+		logger.Warnf("update usage of trash: %s", err)
+		return
+	}
+	atomic.StoreInt64(&m.trashUsage.UsedSpace, space)
+	atomic.StoreInt64(&m.trashUsage.UsedInodes, inodes)
+}
+
+// flushSustained saves the changes of space and inodes held by sustained files into counters.
+func (m *baseMeta) flushSustained() {
+	space, inodes := atomic.SwapInt64(&m.sustainedUsage.newSpace, 0), atomic.SwapInt64(&m.sustainedUsage.newInodes, 0)
+	if space == 0 && inodes == 0 {
+		return
+	}
+	if err := m.en.doFlushSustained(space, inodes); err != nil {
+		logger.Warnf("update usage of sustained files: %s", err)
+		m.sustainedUsage.update(space, inodes)
+	}
+}
+
+func (m *baseMeta) GetPendingUsage(ctx Context, usage *PendingUsage) syscall.Errno {
+	defer timeit(time.Now())
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+	if time.Since(m.pendingTime) > time.Second*10 {
+		space, err := m.en.incrCounter(sustainedSpace, 0)
+		if err != nil {
+			return errno(err)
+		}
+		inodes, err := m.en.incrCounter(sustainedInodes, 0)
+		if err != nil {
+			return errno(err)
+		}
+		trash, err := m.en.doGetQuota(TrashInode)
+		if err != nil {
+			return errno(err)
+		}
+		if trash == nil {
+			trash = &Quota{}
+		}
+		// the counters could be a bit off when sustained files are written or truncated
+		m.pendingUsage = PendingUsage{
+			SustainedInodes: uint64(positive(inodes)),
+			SustainedSpace:  uint64(positive(space)),
+			TrashInodes:     uint64(positive(trash.UsedInodes)),
+			TrashSpace:      uint64(positive(trash.UsedSpace)),
+		}
+		m.pendingTime = time.Now()
+	}
+	*usage = m.pendingUsage
+	return 0
+}
+
+func positive(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+func (m *baseMeta) CheckQuota(ctx Context, inode Ino, repair bool, quota *Quota) syscall.Errno {
+	defer timeit(time.Now())
+	inode = m.checkRoot(inode)
+	q, err := m.en.doGetQuota(inode)
+	if err != nil {
+		return errno(err)
+	}
+	if q == nil {
+		return ENOATTR
+	}
+	space, inodes, st := m.countUsage(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	if repair && (space != q.UsedSpace || inodes != q.UsedInodes) {
+		logger.Infof("fix usage of quota on %d: space %d -> %d, inodes %d -> %d", inode, q.UsedSpace, space, q.UsedInodes, inodes)
+		if err = m.en.doSetQuota(inode, &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: space, UsedInodes: inodes}); err != nil {
+			return errno(err)
+		}
+	}
+	*quota = *q
+	quota.UsedSpace, quota.UsedInodes = space, inodes
+	return 0
+}
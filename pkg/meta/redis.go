@@ -50,15 +50,23 @@ import (
 	File:  c$inode_$indx -> [Slice{pos,id,length,off,len}]
 	Symlink: s$inode -> target
 	Xattr: x$inode -> {name -> value}
+	Parents: p$inode -> {parent -> count} (only for the files with multiple hard links)
+	Tags: tag$key -> [$value\x00$inode] (sorted by lex)
+	Quotas: dirQuota -> {$inode -> {maxSpace, maxInodes}}
+		dirUsedSpace -> {$inode -> usedSpace}, dirUsedInodes -> {$inode -> usedInodes}
 	Flock: lockf$inode -> { $sid_$owner -> ltype }
 	POSIX lock: lockp$inode -> { $sid_$owner -> Plock(pid,ltype,start,end) }
 	Sessions: sessions -> [ $sid -> heartbeat ]
 	sustained: session$sid -> [$inode]
 	locked: locked$sid -> { lockf$inode or lockp$inode }
+	open files: openfiles$sid -> { $inode -> refs }
 
 	Removed files: delfiles -> [$inode:$length -> seconds]
+	Sustained usage: sustainedSpace, sustainedInodes (counters)
 	Slices refs: k$chunkid_$size -> refcount
 
+	In Redis Cluster, all the keys above are prefixed with a hash tag {$db}, so they are in the same slot.
+
 	Redis features:
 	  Sorted Set: 1.2+
 	  Hash Set: 2.0+
@@ -69,11 +77,13 @@ import (
 
 type redisMeta struct {
 	baseMeta
-	rdb        *redis.Client
+	rdb        redis.UniversalClient
+	prefix     string           // hash tag of all the keys in Redis Cluster
 	txlocks    [1024]sync.Mutex // Pessimistic locks to reduce conflict on Redis
 	shaLookup  string           // The SHA returned by Redis for the loaded `scriptLookup`
 	shaResolve string           // The SHA returned by Redis for the loaded `scriptResolve`
 	snap       *redisSnap
+	broker     bool // connected through the local broker, which also batches the heartbeats
 }
 
 var _ Meta = &redisMeta{}
@@ -81,17 +91,26 @@ var _ Meta = &redisMeta{}
 func init() {
 	Register("redis", newRedisMeta)
 	Register("rediss", newRedisMeta)
+	Register("redis+cluster", newRedisMeta)
+	Register("rediss+cluster", newRedisMeta)
 }
 
 // newRedisMeta return a meta store using Redis.
 func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
-	url := driver + "://" + addr
+	if strings.HasSuffix(driver, "+cluster") {
+		return newRedisClusterMeta(strings.TrimSuffix(driver, "+cluster"), addr, conf)
+	}
+	url := driver + "://" + sentinelAddr(addr)
 	opt, err := redis.ParseURL(url)
 	if err != nil {
 		return nil, fmt.Errorf("parse %s: %s", url, err)
 	}
-	var rdb *redis.Client
+	var rdb redis.UniversalClient
+	var broker bool
 	if strings.Contains(opt.Addr, ",") {
+		if conf.Broker != "" {
+			logger.Warnf("Broker %s is ignored for redis sentinel", conf.Broker)
+		}
 		var fopt redis.FailoverOptions
 		ps := strings.Split(opt.Addr, ",")
 		fopt.MasterName = ps[0]
@@ -131,21 +150,148 @@ func newRedisMeta(driver, addr string, conf *Config) (Meta, error) {
 		opt.MaxRetryBackoff = time.Minute * 1
 		opt.ReadTimeout = time.Second * 30
 		opt.WriteTimeout = time.Second * 5
+		if conf.Broker != "" {
+			broker = true
+			id := brokerID(opt)
+			opt.Network, opt.Addr = "unix", conf.Broker
+			opt.Username, opt.Password, opt.DB, opt.TLSConfig = "", "", 0, nil
+			opt.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+				return cn.Process(ctx, redis.NewStatusCmd(ctx, brokerCmd, id))
+			}
+		}
 		rdb = redis.NewClient(opt)
 	}
 
+	if conf.Faults != nil {
+		rdb.AddHook(redisFaults{conf.Faults})
+	}
+	rdb.AddHook(redisWrites{})
 	m := &redisMeta{
 		baseMeta: newBaseMeta(conf),
 		rdb:      rdb,
+		broker:   broker,
+	}
+	m.en = m
+	m.checkServerConfig()
+	m.root, err = lookupSubdir(m, conf.Subdir)
+	return m, err
+}
+
+// sentinelAddr rewrites the address of Sentinels like [user:password@]host1,host2/master[/db]
+// into the form of [user:password@]master,host1,host2[/db], other addresses are returned as they are.
+func sentinelAddr(addr string) string {
+	var auth string
+	if p := strings.LastIndex(addr, "@"); p >= 0 {
+		auth, addr = addr[:p+1], addr[p+1:]
+	}
+	var query string
+	if p := strings.Index(addr, "?"); p >= 0 {
+		addr, query = addr[:p], addr[p:]
+	}
+	ps := strings.SplitN(addr, "/", 3)
+	if len(ps) < 2 || ps[0] == "" || ps[1] == "" {
+		return auth + addr + query
+	}
+	if _, err := strconv.Atoi(ps[1]); err == nil {
+		return auth + addr + query
+	}
+	addr = ps[1] + "," + ps[0]
+	if len(ps) == 3 {
+		addr += "/" + ps[2]
+	}
+	return auth + addr + query
+}
+
+// newRedisClusterMeta connects to Redis Cluster with addr like [user:password@]host1:6379,host2:6379/db,
+// the db is used as the hash tag of all the keys, so multiple volumes can share the same cluster.
+func newRedisClusterMeta(driver, addr string, conf *Config) (Meta, error) {
+	hosts := addr
+	if p := strings.LastIndex(hosts, "@"); p >= 0 {
+		hosts = hosts[p+1:]
+	}
+	if p := strings.Index(hosts, "/"); p >= 0 {
+		hosts = hosts[:p]
+	}
+	addrs := strings.Split(hosts, ",")
+	// parse the first host for the options
+	url := driver + "://" + strings.Replace(addr, hosts, addrs[0], 1)
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", url, err)
+	}
+	for i, a := range addrs {
+		if _, _, e := net.SplitHostPort(a); e != nil {
+			addrs[i] = net.JoinHostPort(a, "6379")
+		}
+	}
+	if conf.Broker != "" {
+		logger.Warnf("Broker %s is ignored for redis cluster", conf.Broker)
+	}
+	copt := &redis.ClusterOptions{
+		Addrs:           addrs,
+		Username:        opt.Username,
+		Password:        opt.Password,
+		TLSConfig:       opt.TLSConfig,
+		MaxRetries:      conf.Retries,
+		MinRetryBackoff: time.Millisecond * 100,
+		MaxRetryBackoff: time.Minute * 1,
+		ReadTimeout:     time.Second * 30,
+		WriteTimeout:    time.Second * 5,
+		NewClient: func(opt *redis.Options) *redis.Client {
+			c := redis.NewClient(opt)
+			c.AddHook(redisWrites{}) // for the transactions, which are sent by the clients of nodes
+			return c
+		},
+	}
+	if copt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
+		copt.Password = os.Getenv("REDIS_PASSWORD")
+	}
+	m := &redisMeta{
+		baseMeta: newBaseMeta(conf),
+		rdb:      redis.NewClusterClient(copt),
+		prefix:   fmt.Sprintf("{%d}", opt.DB),
+	}
+	if conf.Faults != nil {
+		m.rdb.AddHook(redisFaults{conf.Faults})
 	}
+	m.rdb.AddHook(redisWrites{})
 	m.en = m
 	m.checkServerConfig()
 	m.root, err = lookupSubdir(m, conf.Subdir)
 	return m, err
 }
 
+// withSlotNode calls f with a client of the node serving all the keys, which is needed
+// by the commands without any key (e.g. SCAN) in Redis Cluster.
+func (r *redisMeta) withSlotNode(ctx context.Context, f func(c redis.Cmdable) error) error {
+	if _, ok := r.rdb.(*redis.ClusterClient); !ok {
+		return f(r.rdb)
+	}
+	// the connection of a transaction is bound to the node of the watched key
+	return r.rdb.Watch(ctx, func(tx *redis.Tx) error {
+		return f(tx)
+	}, r.prefix+"setting")
+}
+
+// scan iterates the keys matching pattern (without prefix) in the node serving all the keys.
+func (r *redisMeta) scan(ctx context.Context, cursor uint64, match string, count int64) (keys []string, next uint64, err error) {
+	err = r.withSlotNode(ctx, func(c redis.Cmdable) error {
+		keys, next, err = c.Scan(ctx, cursor, r.prefix+match, count).Result()
+		return err
+	})
+	return
+}
+
+func (r *redisMeta) scriptLoad(script string) (sha string, err error) {
+	err = r.withSlotNode(Background, func(c redis.Cmdable) error {
+		sha, err = c.ScriptLoad(Background, script).Result()
+		return err
+	})
+	return
+}
+
 func (m *redisMeta) doDeleteSlice(chunkid uint64, size uint32) error {
-	return m.rdb.HDel(Background, sliceRefs, m.sliceKey(chunkid, size)).Err()
+	return m.rdb.HDel(Background, m.prefix+sliceRefs, m.sliceKey(chunkid, size)).Err()
 }
 
 func (r *redisMeta) Name() string {
@@ -154,7 +300,7 @@ func (r *redisMeta) Name() string {
 
 func (r *redisMeta) Init(format Format, force bool) error {
 	ctx := Background
-	body, err := r.rdb.Get(ctx, "setting").Bytes()
+	body, err := r.rdb.Get(ctx, r.prefix+"setting").Bytes()
 	if err != nil && err != redis.Nil {
 		return err
 	}
@@ -176,6 +322,14 @@ func (r *redisMeta) Init(format Format, force bool) error {
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.TrashQuota = format.TrashQuota
+			old.SessionTimeout = format.SessionTimeout
+			old.SustainedGrace = format.SustainedGrace
+			old.ClusterID = format.ClusterID
+			old.AdminToken = format.AdminToken
+			old.ChangelogRetention = format.ChangelogRetention
+			old.GCAlertSpace = format.GCAlertSpace
+			old.CompressDict = format.CompressDict
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -204,7 +358,7 @@ func (r *redisMeta) Init(format Format, force bool) error {
 			return err
 		}
 	}
-	if err = r.rdb.Set(ctx, "setting", data, 0).Err(); err != nil {
+	if err = r.rdb.Set(ctx, r.prefix+"setting", data, 0).Err(); err != nil {
 		return err
 	}
 	r.fmt = format
@@ -218,11 +372,30 @@ func (r *redisMeta) Init(format Format, force bool) error {
 }
 
 func (r *redisMeta) Reset() error {
-	return r.rdb.FlushDB(Background).Err()
+	if r.prefix == "" {
+		return r.rdb.FlushDB(Background).Err()
+	}
+	// other volumes may share the same cluster
+	var cursor uint64
+	for {
+		keys, c, err := r.scan(Background, cursor, "*", 10000)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err = r.rdb.Del(Background, keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if c == 0 {
+			return nil
+		}
+		cursor = c
+	}
 }
 
 func (r *redisMeta) Load() (*Format, error) {
-	body, err := r.rdb.Get(Background, "setting").Bytes()
+	body, err := r.rdb.Get(Background, r.prefix+"setting").Bytes()
 	if err == redis.Nil {
 		return nil, fmt.Errorf("database is not formatted")
 	}
@@ -238,6 +411,7 @@ func (r *redisMeta) Load() (*Format, error) {
 
 func (r *redisMeta) NewSession() error {
 	go r.refreshUsage()
+	r.startMetaCache()
 	if r.conf.ReadOnly {
 		return nil
 	}
@@ -247,21 +421,20 @@ func (r *redisMeta) NewSession() error {
 	}
 	r.sid = uint64(sid)
 	logger.Debugf("session is %d", r.sid)
-	r.rdb.ZAdd(Background, allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))})
-	info := newSessionInfo()
-	info.MountPoint = r.conf.MountPoint
+	r.rdb.ZAdd(Background, r.prefix+allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))})
+	info := newSessionInfo(r.conf)
 	data, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("json: %s", err)
 	}
-	r.rdb.HSet(Background, sessionInfos, r.sid, data)
+	r.rdb.HSet(Background, r.prefix+sessionInfos, r.sid, data)
 
-	r.shaLookup, err = r.rdb.ScriptLoad(Background, scriptLookup).Result()
+	r.shaLookup, err = r.scriptLoad(scriptLookup)
 	if err != nil {
 		logger.Warnf("load scriptLookup: %v", err)
 		r.shaLookup = ""
 	}
-	r.shaResolve, err = r.rdb.ScriptLoad(Background, scriptResolve).Result()
+	r.shaResolve, err = r.scriptLoad(scriptResolve)
 	if err != nil {
 		logger.Warnf("load scriptResolve: %v", err)
 		r.shaResolve = ""
@@ -271,6 +444,11 @@ func (r *redisMeta) NewSession() error {
 	go r.cleanupDeletedFiles()
 	go r.cleanupSlices()
 	go r.cleanupTrash()
+	go r.cleanupChangelog()
+	if r.conf.ScrubInterval > 0 {
+		go r.scrubInodes()
+	}
+	go r.flushUsage()
 	return nil
 }
 
@@ -278,15 +456,15 @@ func (r *redisMeta) incrCounter(name string, v int64) (int64, error) {
 	if name == "nextInode" || name == "nextChunk" {
 		// for nextinode, nextchunk
 		// the current one is already used
-		v, err := r.rdb.IncrBy(Background, strings.ToLower(name), v).Result()
+		v, err := r.rdb.IncrBy(Background, r.prefix+strings.ToLower(name), v).Result()
 		return v + 1, err
 	}
-	return r.rdb.IncrBy(Background, name, v).Result()
+	return r.rdb.IncrBy(Background, r.prefix+name, v).Result()
 }
 
 func (r *redisMeta) getSession(sid string, detail bool) (*Session, error) {
 	ctx := Background
-	info, err := r.rdb.HGet(ctx, sessionInfos, sid).Bytes()
+	info, err := r.rdb.HGet(ctx, r.prefix+sessionInfos, sid).Bytes()
 	if err == redis.Nil { // legacy client has no info
 		info = []byte("{}")
 	} else if err != nil {
@@ -319,8 +497,8 @@ func (r *redisMeta) getSession(sid string, detail bool) (*Session, error) {
 			if err != nil {
 				return nil, fmt.Errorf("HGetAll %s: %s", lock, err)
 			}
-			isFlock := strings.HasPrefix(lock, "lockf")
-			inode, _ := strconv.ParseUint(lock[5:], 10, 64)
+			isFlock := strings.HasPrefix(lock, r.prefix+"lockf")
+			inode, _ := strconv.ParseUint(lock[len(r.prefix)+5:], 10, 64)
 			for k, v := range owners {
 				parts := strings.Split(k, "_")
 				if parts[0] != sid {
@@ -330,17 +508,29 @@ func (r *redisMeta) getSession(sid string, detail bool) (*Session, error) {
 				if isFlock {
 					s.Flocks = append(s.Flocks, Flock{Ino(inode), owner, v})
 				} else {
-					s.Plocks = append(s.Plocks, Plock{Ino(inode), owner, []byte(v)})
+					s.Plocks = append(s.Plocks, Plock{Ino(inode), owner, decodeLocks([]byte(v))})
 				}
 			}
 		}
+
+		files, err := r.rdb.HGetAll(ctx, r.openFilesKey(s.Sid)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("HGetAll %s: %s", r.openFilesKey(s.Sid), err)
+		}
+		s.OpenFiles = make([]OpenFile, 0, len(files))
+		for k, v := range files {
+			inode, _ := strconv.ParseUint(k, 10, 64)
+			refs, _ := strconv.Atoi(v)
+			s.OpenFiles = append(s.OpenFiles, OpenFile{Ino(inode), refs})
+		}
+		sort.Slice(s.OpenFiles, func(i, j int) bool { return s.OpenFiles[i].Inode < s.OpenFiles[j].Inode })
 	}
 	return &s, nil
 }
 
 func (r *redisMeta) GetSession(sid uint64) (*Session, error) {
 	key := strconv.FormatUint(sid, 10)
-	score, err := r.rdb.ZScore(Background, allSessions, key).Result()
+	score, err := r.rdb.ZScore(Background, r.prefix+allSessions, key).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -352,8 +542,8 @@ func (r *redisMeta) GetSession(sid uint64) (*Session, error) {
 	return s, nil
 }
 
-func (r *redisMeta) ListSessions() ([]*Session, error) {
-	keys, err := r.rdb.ZRangeWithScores(Background, allSessions, 0, -1).Result()
+func (r *redisMeta) ListSessions(filter *SessionFilter) ([]*Session, error) {
+	keys, err := r.rdb.ZRangeWithScores(Background, r.prefix+allSessions, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -365,45 +555,68 @@ func (r *redisMeta) ListSessions() ([]*Session, error) {
 			continue
 		}
 		s.Heartbeat = time.Unix(int64(k.Score), 0)
-		sessions = append(sessions, s)
+		if filter.match(s) {
+			sessions = append(sessions, s)
+		}
 	}
 	return sessions, nil
 }
 
 func (r *redisMeta) sustained(sid uint64) string {
-	return "session" + strconv.FormatUint(sid, 10)
+	return r.prefix + "session" + strconv.FormatUint(sid, 10)
 }
 
 func (r *redisMeta) lockedKey(sid uint64) string {
-	return "locked" + strconv.FormatUint(sid, 10)
+	return r.prefix + "locked" + strconv.FormatUint(sid, 10)
+}
+
+func (r *redisMeta) openFilesKey(sid uint64) string {
+	return r.prefix + "openfiles" + strconv.FormatUint(sid, 10)
 }
 
 func (r *redisMeta) symKey(inode Ino) string {
-	return "s" + inode.String()
+	return r.prefix + "s" + inode.String()
 }
 
 func (r *redisMeta) inodeKey(inode Ino) string {
-	return "i" + inode.String()
+	return r.prefix + "i" + inode.String()
 }
 
 func (r *redisMeta) entryKey(parent Ino) string {
-	return "d" + parent.String()
+	return r.prefix + "d" + parent.String()
+}
+
+func (r *redisMeta) parentKey(inode Ino) string {
+	return r.prefix + "p" + inode.String()
 }
 
 func (r *redisMeta) chunkKey(inode Ino, indx uint32) string {
-	return "c" + inode.String() + "_" + strconv.FormatInt(int64(indx), 10)
+	return r.prefix + "c" + inode.String() + "_" + strconv.FormatInt(int64(indx), 10)
 }
 
+// sliceKey is the field of a slice in the hash of sliceRefs
 func (r *redisMeta) sliceKey(chunkid uint64, size uint32) string {
 	return "k" + strconv.FormatUint(chunkid, 10) + "_" + strconv.FormatUint(uint64(size), 10)
 }
 
 func (r *redisMeta) xattrKey(inode Ino) string {
-	return "x" + inode.String()
+	return r.prefix + "x" + inode.String()
+}
+
+func (r *redisMeta) tagKey(key string) string {
+	return r.prefix + "tag" + key
+}
+
+func (r *redisMeta) changelogKey() string {
+	return r.prefix + "changelog"
+}
+
+func (r *redisMeta) invalidateChannel() string {
+	return r.prefix + "invalidate"
 }
 
 func (r *redisMeta) flockKey(inode Ino) string {
-	return "lockf" + inode.String()
+	return r.prefix + "lockf" + inode.String()
 }
 
 func (r *redisMeta) ownerKey(owner uint64) string {
@@ -411,7 +624,7 @@ func (r *redisMeta) ownerKey(owner uint64) string {
 }
 
 func (r *redisMeta) plockKey(inode Ino) string {
-	return "lockp" + inode.String()
+	return r.prefix + "lockp" + inode.String()
 }
 
 func (r *redisMeta) packEntry(_type uint8, inode Ino) []byte {
@@ -435,9 +648,9 @@ func (r *redisMeta) handleLuaResult(op string, res interface{}, err error, retur
 			var err2 error
 			switch op {
 			case "lookup":
-				r.shaLookup, err2 = r.rdb.ScriptLoad(Background, scriptLookup).Result()
+				r.shaLookup, err2 = r.scriptLoad(scriptLookup)
 			case "resolve":
-				r.shaResolve, err2 = r.rdb.ScriptLoad(Background, scriptResolve).Result()
+				r.shaResolve, err2 = r.scriptLoad(scriptResolve)
 			default:
 				return syscall.ENOTSUP
 			}
@@ -540,7 +753,7 @@ func (r *redisMeta) Resolve(ctx Context, parent Ino, path string, inode *Ino, at
 	}
 	defer timeit(time.Now())
 	parent = r.checkRoot(parent)
-	args := []string{parent.String(), path,
+	args := []string{r.inodeKey(parent), path,
 		strconv.FormatUint(uint64(ctx.Uid()), 10),
 		strconv.FormatUint(uint64(ctx.Gid()), 10)}
 	res, err := r.rdb.EvalSha(ctx, r.shaResolve, args).Result()
@@ -566,6 +779,32 @@ func (r *redisMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno
 	return errno(err)
 }
 
+func (r *redisMeta) doTouchAtime(ctx Context, inode Ino, attr *Attr, now time.Time) (bool, error) {
+	var updated bool
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		r.parseAttr(a, attr)
+		if !r.atimeNeedsUpdate(attr, now) {
+			return nil
+		}
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(attr), 0)
+			return nil
+		})
+		updated = err == nil
+		return err
+	}, r.inodeKey(inode))
+	if st != 0 {
+		return false, st
+	}
+	return updated, nil
+}
+
 type timeoutError interface {
 	Timeout() bool
 }
@@ -614,6 +853,62 @@ func shouldRetry(err error, retryOnFailure bool) bool {
 	return true
 }
 
+// clusterTxnErr hides the errno (e.g. EAGAIN looks like a timeout) from the retries of ClusterClient.
+type clusterTxnErr struct {
+	eno syscall.Errno
+}
+
+func (e clusterTxnErr) Error() string {
+	return e.eno.Error()
+}
+
+// redisReads are the commands that can be aborted safely when the context is canceled.
+var redisReads = map[string]bool{
+	"get": true, "mget": true, "exists": true, "type": true, "scan": true, "ping": true, "info": true,
+	"hget": true, "hmget": true, "hgetall": true, "hexists": true, "hlen": true, "hkeys": true, "hscan": true,
+	"lrange": true, "llen": true, "lindex": true, "smembers": true, "scard": true, "sismember": true, "sscan": true,
+	"zrange": true, "zrangebyscore": true, "zrangebylex": true, "zrevrange": true, "zscore": true, "zcard": true,
+	"zcount": true, "zscan": true, "evalsha": true, // only lookup and resolve are called with EVALSHA
+	"watch": true, "unwatch": true,
+}
+
+// uncanceled keeps the values of a context, but it's never canceled.
+type uncanceled struct {
+	context.Context
+}
+
+func (c uncanceled) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (c uncanceled) Done() <-chan struct{}       { return nil }
+func (c uncanceled) Err() error                  { return nil }
+
+// redisWrites lets the reads be aborted once the context is canceled (interrupted or timed out), but
+// not the writes or transactions, which could be executed by Redis already.
+type redisWrites struct{}
+
+func (h redisWrites) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if !redisReads[cmd.Name()] {
+		ctx = uncanceled{ctx}
+	}
+	return ctx, nil
+}
+
+func (h redisWrites) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h redisWrites) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		if !redisReads[cmd.Name()] {
+			return uncanceled{ctx}, nil
+		}
+	}
+	return ctx, nil
+}
+
+func (h redisWrites) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
 func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...string) syscall.Errno {
 	if r.conf.ReadOnly {
 		return syscall.EROFS
@@ -626,10 +921,27 @@ func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 	defer func() { txDist.Observe(time.Since(start).Seconds()) }()
 	l.Lock()
 	defer l.Unlock()
+	if _, ok := r.rdb.(*redis.ClusterClient); ok {
+		fn := txf
+		txf = func(tx *redis.Tx) error {
+			err := fn(tx)
+			if eno, ok := err.(syscall.Errno); ok {
+				return clusterTxnErr{eno}
+			}
+			return err
+		}
+	}
 	// TODO: enable retry for some of idempodent transactions
 	var retryOnFailture = false
 	for i := 0; i < 50; i++ {
+		// the transaction is not aborted once EXEC is sent (see redisWrites), so check the context before it starts
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
 		err = r.rdb.Watch(ctx, txf, keys...)
+		if e, ok := err.(clusterTxnErr); ok {
+			err = e.eno
+		}
 		if shouldRetry(err, retryOnFailture) {
 			txRestart.Add(1)
 			time.Sleep(time.Millisecond * time.Duration(rand.Int()%((i+1)*(i+1))))
@@ -642,20 +954,27 @@ func (r *redisMeta) txn(ctx Context, txf func(tx *redis.Tx) error, keys ...strin
 
 func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := r.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := r.of.find(inode)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	var newSpace int64
+	var parent Ino
+	st = r.txn(ctx, func(tx *redis.Tx) error {
 		var t Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
 		r.parseAttr(a, &t)
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || t.Flags&(FlagImmutable|FlagAppend) != 0 {
 			return syscall.EPERM
 		}
 		if length == t.Length {
@@ -664,10 +983,14 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 			}
 			return nil
 		}
-		newSpace := align4K(length) - align4K(t.Length)
+		newSpace = align4K(length) - align4K(t.Length)
 		if newSpace > 0 && r.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = t.Parent
+		if r.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		var zeroChunks []uint32
 		var left, right = t.Length, length
 		if left > right {
@@ -678,7 +1001,7 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 			var cursor uint64
 			var keys []string
 			for {
-				keys, cursor, err = tx.Scan(ctx, cursor, fmt.Sprintf("c%d_*", inode), 10000).Result()
+				keys, cursor, err = tx.Scan(ctx, cursor, r.prefix+fmt.Sprintf("c%d_*", inode), 10000).Result()
 				if err != nil {
 					return err
 				}
@@ -722,7 +1045,7 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 			if right > (left/ChunkSize+1)*ChunkSize && right%ChunkSize > 0 {
 				pipe.RPush(ctx, r.chunkKey(inode, uint32(right/ChunkSize)), marshalSlice(0, 0, 0, 0, uint32(right%ChunkSize)))
 			}
-			pipe.IncrBy(ctx, usedSpace, newSpace)
+			pipe.IncrBy(ctx, r.prefix+usedSpace, newSpace)
 			return nil
 		})
 		if err == nil {
@@ -732,6 +1055,11 @@ func (r *redisMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64,
 		}
 		return err
 	}, r.inodeKey(inode))
+	if st == 0 {
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.emit(&Event{Type: EventSetAttr, Inode: inode})
+	}
+	return st
 }
 
 func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size uint64) syscall.Errno {
@@ -751,13 +1079,24 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		return syscall.EINVAL
 	}
 	defer timeit(time.Now())
+	unlock, st := r.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := r.of.find(inode)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	var newSpace int64
+	var parent Ino
+	var holes []holeChunk
+	var released []*slice
+	var rs []*redis.IntCmd
+	st = r.txn(ctx, func(tx *redis.Tx) error {
+		holes, released, rs = nil, nil, nil
 		var t Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
@@ -770,6 +1109,9 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		if t.Typ != TypeFile {
 			return syscall.EPERM
 		}
+		if t.Flags&FlagImmutable != 0 || t.Flags&FlagAppend != 0 && mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			return syscall.EPERM
+		}
 		length := t.Length
 		if off+size > t.Length {
 			if mode&fallocKeepSize == 0 {
@@ -778,51 +1120,148 @@ func (r *redisMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, si
 		}
 
 		old := t.Length
-		if length > old && r.checkQuota(align4K(length)-align4K(old), 0) {
+		newSpace = align4K(length) - align4K(old)
+		if newSpace > 0 && r.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = t.Parent
+		if r.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		t.Length = length
 		now := time.Now()
 		t.Mtime = now.Unix()
 		t.Mtimensec = uint32(now.Nanosecond())
 		t.Ctime = now.Unix()
 		t.Ctimensec = uint32(now.Nanosecond())
+		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			holes = holeChunks(off, size, old)
+			for _, h := range holes {
+				if h.whole {
+					key := r.chunkKey(inode, h.indx)
+					if err = tx.Watch(ctx, key).Err(); err != nil {
+						return err
+					}
+					vals, err := tx.LRange(ctx, key, 0, -1).Result()
+					if err != nil {
+						return err
+					}
+					for _, s := range readSlices(vals) {
+						if s.chunkid > 0 {
+							released = append(released, s)
+						}
+					}
+				}
+			}
+		}
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
-			if mode&(fallocZeroRange|fallocPunchHole) != 0 {
-				if off+size > old {
-					size = old - off
-				}
-				for size > 0 {
-					indx := uint32(off / ChunkSize)
-					coff := off % ChunkSize
-					l := size
-					if coff+size > ChunkSize {
-						l = ChunkSize - coff
-					}
-					pipe.RPush(ctx, r.chunkKey(inode, indx), marshalSlice(uint32(coff), 0, 0, 0, uint32(l)))
-					off += l
-					size -= l
+			for _, h := range holes {
+				if h.whole {
+					pipe.Del(ctx, r.chunkKey(inode, h.indx))
+				} else {
+					pipe.RPush(ctx, r.chunkKey(inode, h.indx), marshalSlice(h.off, 0, 0, 0, h.len))
 				}
 			}
-			pipe.IncrBy(ctx, usedSpace, align4K(length)-align4K(old))
+			for _, s := range released {
+				rs = append(rs, pipe.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(s.chunkid, s.size), -1))
+			}
+			pipe.IncrBy(ctx, r.prefix+usedSpace, newSpace)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode))
+	if st == 0 {
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		r.emit(&Event{Type: EventSetAttr, Inode: inode})
+		for i, s := range released {
+			if rs[i].Val() < 0 {
+				r.deleteSlice(s.chunkid, s.size)
+			}
+		}
+		for _, h := range holes {
+			if !h.whole {
+				// release the slices covered by the hole
+				go r.compactChunk(inode, h.indx, false)
+			}
+		}
+	}
+	return st
+}
+
+func (r *redisMeta) Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno {
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	unlock, st := r.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
+	f := r.of.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+	}
+	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
+	var newSpace int64
+	var parent Ino
+	st = r.txn(ctx, func(tx *redis.Tx) error {
+		var t Attr
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err != nil {
+			return err
+		}
+		r.parseAttr(a, &t)
+		if t.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		newSpace = align4K(t.Length+size) - align4K(t.Length)
+		if newSpace > 0 && r.checkQuota(newSpace, 0) {
+			return syscall.ENOSPC
+		}
+		parent = t.Parent
+		if r.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
+		*off = t.Length
+		t.Length += size
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&t), 0)
+			pipe.IncrBy(ctx, r.prefix+usedSpace, newSpace)
 			return nil
 		})
 		return err
 	}, r.inodeKey(inode))
+	if st == 0 {
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+	}
+	return st
 }
 
 func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	defer timeit(time.Now())
 	inode = r.checkRoot(inode)
 	defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	st := r.txn(ctx, func(tx *redis.Tx) error {
 		var cur Attr
 		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
 		if err != nil {
 			return err
 		}
 		r.parseAttr(a, &cur)
+		if st := checkFlags(ctx, cur.Flags, set, attr); st != 0 {
+			return st
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -831,6 +1270,10 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 			clearSUGID(ctx, &cur, attr)
 			changed = true
 		}
+		if set&SetAttrFlag != 0 && cur.Flags != attr.Flags {
+			cur.Flags = attr.Flags
+			changed = true
+		}
 		if set&SetAttrUID != 0 && cur.Uid != attr.Uid {
 			cur.Uid = attr.Uid
 			changed = true
@@ -886,6 +1329,10 @@ func (r *redisMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode u
 		}
 		return err
 	}, r.inodeKey(inode))
+	if st == 0 {
+		r.emit(&Event{Type: EventSetAttr, Inode: inode})
+	}
+	return st
 }
 
 func (m *redisMeta) doReadlink(ctx Context, inode Ino) ([]byte, error) {
@@ -913,6 +1360,7 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		attr = &Attr{}
 	}
 	attr.Typ = _type
+	attr.Flags = 0
 	attr.Mode = mode & ^cumask
 	attr.Uid = ctx.Uid()
 	attr.Gid = ctx.Gid()
@@ -944,6 +1392,9 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 
 		buf, err := tx.HGet(ctx, r.entryKey(parent), name).Bytes()
 		if err != nil && err != redis.Nil {
@@ -995,6 +1446,18 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 				attr.Mode |= pattr.Mode & 02000
 			}
 		}
+		var inherited map[string][]byte
+		if _type != TypeSymlink {
+			xattrs, err := tx.HGetAll(ctx, r.xattrKey(parent)).Result()
+			if err != nil {
+				return err
+			}
+			vals := make(map[string][]byte, len(xattrs))
+			for k, v := range xattrs {
+				vals[k] = []byte(v)
+			}
+			inherited = inheritedXattrs(vals, _type == TypeDirectory)
+		}
 
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(_type, ino))
@@ -1003,15 +1466,21 @@ func (r *redisMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, m
 			if _type == TypeSymlink {
 				pipe.Set(ctx, r.symKey(ino), path, 0)
 			}
-			pipe.IncrBy(ctx, usedSpace, align4K(0))
-			pipe.Incr(ctx, totalInodes)
+			for k, v := range inherited {
+				pipe.HSet(ctx, r.xattrKey(ino), k, v)
+				if strings.HasPrefix(k, TagPrefix) {
+					pipe.ZAdd(ctx, r.tagKey(k[len(TagPrefix):]), &redis.Z{Member: string(v) + "\x00" + ino.String()})
+				}
+			}
+			pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(0))
+			pipe.Incr(ctx, r.prefix+totalInodes)
 			return nil
 		})
 		return err
 	}, r.inodeKey(parent), r.entryKey(parent))
 }
 
-func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
+func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string, attr *Attr) syscall.Errno {
 	buf, err := r.rdb.HGet(ctx, r.entryKey(parent), name).Bytes()
 	if err == redis.Nil && r.conf.CaseInsensi {
 		if e := r.resolveCase(ctx, parent, name); e != nil {
@@ -1038,8 +1507,9 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 		defer func() { r.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
 	}
 	var opened bool
-	var attr Attr
 	eno := r.txn(ctx, func(tx *redis.Tx) error {
+		var linked bool
+		var parents map[Ino]int
 		rs, _ := tx.MGet(ctx, r.inodeKey(parent), r.inodeKey(inode)).Result()
 		if rs[0] == nil {
 			return redis.Nil
@@ -1049,20 +1519,32 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		now := time.Now()
 		pattr.Mtime = now.Unix()
 		pattr.Mtimensec = uint32(now.Nanosecond())
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
-		attr = Attr{}
+		*attr = Attr{}
 		opened = false
 		if rs[1] != nil {
-			r.parseAttr([]byte(rs[1].(string)), &attr)
+			r.parseAttr([]byte(rs[1].(string)), attr)
+			if attr.Flags&(FlagImmutable|FlagAppend) != 0 || pattr.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
 			attr.Ctime = now.Unix()
 			attr.Ctimensec = uint32(now.Nanosecond())
+			if linked = attr.Nlink > 1; linked {
+				var err error
+				if parents, err = r.getParents(ctx, tx, inode); err != nil {
+					return err
+				}
+			}
 			if trash == 0 {
 				attr.Nlink--
 				if _type == TypeFile && attr.Nlink == 0 {
@@ -1071,6 +1553,9 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 			} else if attr.Nlink == 1 { // don't change parent if it has hard links
 				attr.Parent = trash
 			}
+			if linked {
+				parents = updateParents(parents, attr, parent, trash)
+			}
 		} else {
 			logger.Warnf("no attribute for inode %d (%d, %s)", inode, parent, name)
 			trash = 0
@@ -1088,8 +1573,11 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
 			pipe.HDel(ctx, r.entryKey(parent), name)
 			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
+			if linked {
+				r.setParents(ctx, pipe, inode, parents)
+			}
 			if attr.Nlink > 0 {
-				pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+				pipe.Set(ctx, r.inodeKey(inode), r.marshal(attr), 0)
 				if trash > 0 {
 					pipe.HSet(ctx, r.entryKey(trash), fmt.Sprintf("%d-%d-%s", parent, inode, name), buf)
 				}
@@ -1097,21 +1585,21 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 				switch _type {
 				case TypeFile:
 					if opened {
-						pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
+						pipe.Set(ctx, r.inodeKey(inode), r.marshal(attr), 0)
 						pipe.SAdd(ctx, r.sustained(r.sid), strconv.Itoa(int(inode)))
 					} else {
-						pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(inode, attr.Length)})
+						pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(inode, attr.Length)})
 						pipe.Del(ctx, r.inodeKey(inode))
-						pipe.IncrBy(ctx, usedSpace, -align4K(attr.Length))
-						pipe.Decr(ctx, totalInodes)
+						pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
+						pipe.Decr(ctx, r.prefix+totalInodes)
 					}
 				case TypeSymlink:
 					pipe.Del(ctx, r.symKey(inode))
 					fallthrough
 				default:
 					pipe.Del(ctx, r.inodeKey(inode))
-					pipe.IncrBy(ctx, usedSpace, -align4K(0))
-					pipe.Decr(ctx, totalInodes)
+					pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(0))
+					pipe.Decr(ctx, r.prefix+totalInodes)
 				}
 				pipe.Del(ctx, r.xattrKey(inode))
 			}
@@ -1126,6 +1614,17 @@ func (r *redisMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno
 	return eno
 }
 
+func (r *redisMeta) doBatchUnlink(ctx Context, parent Ino, names []string, sts []syscall.Errno, space, inodes *int64) syscall.Errno {
+	// a transaction watching the entries and inodes of a whole batch conflicts easily in a busy
+	// directory, and the round trips to Redis are cheap, so they are removed one by one.
+	return syscall.ENOTSUP
+}
+
+func (r *redisMeta) doBatchMknod(ctx Context, parent Ino, names []string, _type uint8, mode, cumask uint16, inodes []Ino, sts []syscall.Errno) syscall.Errno {
+	// created one by one, for the same reason as doBatchUnlink
+	return syscall.ENOTSUP
+}
+
 func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	buf, err := r.rdb.HGet(ctx, r.entryKey(parent), name).Bytes()
 	if err == redis.Nil && r.conf.CaseInsensi {
@@ -1161,6 +1660,9 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		now := time.Now()
 		pattr.Nlink--
 		pattr.Mtime = now.Unix()
@@ -1186,6 +1688,9 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 		}
 		if rs[1] != nil {
 			r.parseAttr([]byte(rs[1].(string)), &attr)
+			if attr.Flags&(FlagImmutable|FlagAppend) != 0 || pattr.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
@@ -1208,8 +1713,8 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 			} else {
 				pipe.Del(ctx, r.inodeKey(inode))
 				pipe.Del(ctx, r.xattrKey(inode))
-				pipe.IncrBy(ctx, usedSpace, -align4K(0))
-				pipe.Decr(ctx, totalInodes)
+				pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(0))
+				pipe.Decr(ctx, r.prefix+totalInodes)
 			}
 			return nil
 		})
@@ -1217,8 +1722,18 @@ func (r *redisMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno
 	}, keys...)
 }
 
-func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode, rinode *Ino, attr, rattr *Attr) syscall.Errno {
 	exchange := flags == RenameExchange
+	var wino Ino
+	if flags&RenameWhiteout != 0 {
+		if r.checkQuota(4<<10, 1) {
+			return syscall.ENOSPC
+		}
+		var err error
+		if wino, err = r.nextInode(); err != nil {
+			return errno(err)
+		}
+	}
 	buf, err := r.rdb.HGet(ctx, r.entryKey(parentSrc), nameSrc).Bytes()
 	if err == redis.Nil && r.conf.CaseInsensi {
 		if e := r.resolveCase(ctx, parentSrc, nameSrc); e != nil {
@@ -1276,10 +1791,16 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 		if sattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if sattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		r.parseAttr([]byte(rs[1].(string)), &dattr)
 		if dattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if dattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		r.parseAttr([]byte(rs[2].(string)), &iattr)
 
 		dbuf, err := tx.HGet(ctx, r.entryKey(parentDst), nameDst).Bytes()
@@ -1289,8 +1810,10 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 		now := time.Now()
 		tattr = Attr{}
 		opened = false
+		var dlinked, ilinked bool
+		var dparents, iparents map[Ino]int
 		if err == nil {
-			if flags == RenameNoReplace {
+			if flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
 			dtyp1, dino1 := r.parseEntry(dbuf)
@@ -1307,12 +1830,20 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 			r.parseAttr(a, &tattr)
 			tattr.Ctime = now.Unix()
 			tattr.Ctimensec = uint32(now.Nanosecond())
+			if dlinked = dtyp != TypeDirectory && tattr.Nlink > 1 && dino != ino; dlinked {
+				if dparents, err = r.getParents(ctx, tx, dino); err != nil {
+					return err
+				}
+			}
 			if exchange {
 				tattr.Parent = parentSrc
 				if dtyp == TypeDirectory && parentSrc != parentDst {
 					dattr.Nlink--
 					sattr.Nlink++
 				}
+				if dlinked {
+					dparents = updateParents(dparents, &tattr, parentDst, parentSrc)
+				}
 			} else {
 				if dtyp == TypeDirectory {
 					cnt, err := tx.HLen(ctx, r.entryKey(dino)).Result()
@@ -1336,8 +1867,14 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 					} else if tattr.Nlink == 1 {
 						tattr.Parent = trash
 					}
+					if dlinked {
+						dparents = updateParents(dparents, &tattr, parentDst, trash)
+					}
 				}
 			}
+			if tattr.Flags&(FlagImmutable|FlagAppend) != 0 || dattr.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && dattr.Mode&01000 != 0 && ctx.Uid() != dattr.Uid && ctx.Uid() != tattr.Uid {
 				return syscall.EACCES
 			}
@@ -1355,6 +1892,9 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 		if ino1 != ino || typ1 != typ {
 			return syscall.EAGAIN
 		}
+		if iattr.Flags&(FlagImmutable|FlagAppend) != 0 || sattr.Flags&FlagAppend != 0 {
+			return syscall.EPERM
+		}
 		if ctx.Uid() != 0 && sattr.Mode&01000 != 0 && ctx.Uid() != sattr.Uid && ctx.Uid() != iattr.Uid {
 			return syscall.EACCES
 		}
@@ -1367,9 +1907,17 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 		dattr.Mtimensec = uint32(now.Nanosecond())
 		dattr.Ctime = now.Unix()
 		dattr.Ctimensec = uint32(now.Nanosecond())
+		if ilinked = typ != TypeDirectory && iattr.Nlink > 1 && parentSrc != parentDst; ilinked {
+			if iparents, err = r.getParents(ctx, tx, ino); err != nil {
+				return err
+			}
+		}
 		iattr.Parent = parentDst
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
+		if ilinked {
+			iparents = updateParents(iparents, &iattr, parentSrc, parentDst)
+		}
 		if typ == TypeDirectory && parentSrc != parentDst {
 			sattr.Nlink--
 			dattr.Nlink++
@@ -1385,7 +1933,14 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 				pipe.HSet(ctx, r.entryKey(parentSrc), nameSrc, dbuf)
 				pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
 			} else {
-				pipe.HDel(ctx, r.entryKey(parentSrc), nameSrc)
+				if wino > 0 {
+					pipe.HSet(ctx, r.entryKey(parentSrc), nameSrc, r.packEntry(TypeCharDev, wino))
+					pipe.Set(ctx, r.inodeKey(wino), r.marshal(whiteoutAttr(ctx, parentSrc, now)), 0)
+					pipe.IncrBy(ctx, r.prefix+usedSpace, align4K(0))
+					pipe.Incr(ctx, r.prefix+totalInodes)
+				} else {
+					pipe.HDel(ctx, r.entryKey(parentSrc), nameSrc)
+				}
 				if dino > 0 {
 					if trash > 0 {
 						pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
@@ -1398,23 +1953,29 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 								pipe.Set(ctx, r.inodeKey(dino), r.marshal(&tattr), 0)
 								pipe.SAdd(ctx, r.sustained(r.sid), strconv.Itoa(int(dino)))
 							} else {
-								pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(dino, tattr.Length)})
+								pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(now.Unix()), Member: r.toDelete(dino, tattr.Length)})
 								pipe.Del(ctx, r.inodeKey(dino))
-								pipe.IncrBy(ctx, usedSpace, -align4K(tattr.Length))
-								pipe.Decr(ctx, totalInodes)
+								pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(tattr.Length))
+								pipe.Decr(ctx, r.prefix+totalInodes)
 							}
 						} else {
 							if dtyp == TypeSymlink {
 								pipe.Del(ctx, r.symKey(dino))
 							}
 							pipe.Del(ctx, r.inodeKey(dino))
-							pipe.IncrBy(ctx, usedSpace, -align4K(0))
-							pipe.Decr(ctx, totalInodes)
+							pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(0))
+							pipe.Decr(ctx, r.prefix+totalInodes)
 						}
 						pipe.Del(ctx, r.xattrKey(dino))
 					}
 				}
 			}
+			if dlinked {
+				r.setParents(ctx, pipe, dino, dparents)
+			}
+			if ilinked {
+				r.setParents(ctx, pipe, ino, iparents)
+			}
 			if parentDst != parentSrc && !isTrash(parentSrc) {
 				pipe.Set(ctx, r.inodeKey(parentSrc), r.marshal(&sattr), 0)
 			}
@@ -1425,6 +1986,9 @@ func (r *redisMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentD
 		})
 		return err
 	}, keys...)
+	if eno == 0 && dino > 0 {
+		*rinode, *rattr = dino, tattr
+	}
 	if eno == 0 && !exchange && dino > 0 && dtyp == TypeFile && tattr.Nlink == 0 {
 		r.fileDeleted(opened, dino, tattr.Length)
 	}
@@ -1445,18 +2009,28 @@ func (r *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		now := time.Now()
 		pattr.Mtime = now.Unix()
 		pattr.Mtimensec = uint32(now.Nanosecond())
 		pattr.Ctime = now.Unix()
 		pattr.Ctimensec = uint32(now.Nanosecond())
 		r.parseAttr([]byte(rs[1].(string)), &iattr)
-		if iattr.Typ == TypeDirectory {
+		if iattr.Typ == TypeDirectory || iattr.Flags&(FlagImmutable|FlagAppend) != 0 {
 			return syscall.EPERM
 		}
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
 		iattr.Nlink++
+		var parents map[Ino]int
+		if iattr.Nlink > 2 {
+			if parents, err = r.getParents(ctx, tx, inode); err != nil {
+				return err
+			}
+		}
+		parents = updateParents(parents, &iattr, 0, parent)
 
 		err = tx.HGet(ctx, r.entryKey(parent), name).Err()
 		if err != nil && err != redis.Nil {
@@ -1471,6 +2045,7 @@ func (r *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 			pipe.HSet(ctx, r.entryKey(parent), name, r.packEntry(iattr.Typ, inode))
 			pipe.Set(ctx, r.inodeKey(parent), r.marshal(&pattr), 0)
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&iattr), 0)
+			r.setParents(ctx, pipe, inode, parents)
 			return nil
 		})
 		if err == nil && attr != nil {
@@ -1480,6 +2055,40 @@ func (r *redisMeta) doLink(ctx Context, inode, parent Ino, name string, attr *At
 	}, r.inodeKey(inode), r.entryKey(parent), r.inodeKey(parent))
 }
 
+func (r *redisMeta) getParents(ctx Context, c redis.Cmdable, inode Ino) (map[Ino]int, error) {
+	vals, err := c.HGetAll(ctx, r.parentKey(inode)).Result()
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[Ino]int, len(vals))
+	for k, v := range vals {
+		p, err := strconv.ParseUint(k, 10, 64)
+		if err != nil {
+			logger.Warnf("invalid parent %s of inode %d", k, inode)
+			continue
+		}
+		n, _ := strconv.Atoi(v)
+		parents[Ino(p)] = n
+	}
+	return parents, nil
+}
+
+// setParents replaces the parents of a hard linked file, it's removed if parents is empty.
+func (r *redisMeta) setParents(ctx Context, pipe redis.Pipeliner, inode Ino, parents map[Ino]int) {
+	pipe.Del(ctx, r.parentKey(inode))
+	if len(parents) > 0 {
+		vals := make(map[string]interface{}, len(parents))
+		for p, n := range parents {
+			vals[p.String()] = n
+		}
+		pipe.HSet(ctx, r.parentKey(inode), vals)
+	}
+}
+
+func (r *redisMeta) doGetParents(ctx Context, inode Ino) (map[Ino]int, error) {
+	return r.getParents(ctx, r.rdb, inode)
+}
+
 func (r *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
 	var keys []string
 	var cursor uint64
@@ -1506,57 +2115,142 @@ func (r *redisMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*En
 	}
 
 	if plus != 0 {
-		fillAttr := func(es []*Entry) error {
-			var keys = make([]string, len(es))
-			for i, e := range es {
-				keys[i] = r.inodeKey(e.Inode)
-			}
-			rs, err := r.rdb.MGet(ctx, keys...).Result()
-			if err != nil {
-				return err
+		return r.doFillAttrs(ctx, *entries)
+	}
+	return 0
+}
+
+func (r *redisMeta) doReaddirAt(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, error) {
+	var c uint64
+	if cursor != "" {
+		var err error
+		if c, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return "", syscall.EINVAL
+		}
+	}
+	keys, c, err := r.rdb.HScan(ctx, r.entryKey(inode), c, "*", int64(limit)).Result()
+	if err != nil {
+		return "", err
+	}
+	start := len(*entries)
+	for i := 0; i < len(keys); i += 2 {
+		typ, inode := r.parseEntry([]byte(keys[i+1]))
+		*entries = append(*entries, &Entry{Inode: inode, Name: []byte(keys[i]), Attr: &Attr{Typ: typ}})
+	}
+	if plus != 0 {
+		if st := r.doFillAttrs(ctx, (*entries)[start:]); st != 0 {
+			return "", st
+		}
+	}
+	if c == 0 {
+		return "", nil
+	}
+	return strconv.FormatUint(c, 10), nil
+}
+
+func (r *redisMeta) doGetDirSummary(ctx Context, inode Ino, summary *Summary) ([]Ino, syscall.Errno) {
+	var entries []*Entry
+	if st := r.doReaddir(ctx, inode, 0, &entries); st != 0 {
+		return nil, st
+	}
+	return sumEntries(ctx, entries, summary, r.doFillAttrs)
+}
+
+func (r *redisMeta) doFind(ctx Context, filter *FindFilter, cursor string, limit int, entries *[]*Entry) (string, error) {
+	var c uint64
+	if cursor != "" {
+		var err error
+		if c, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			return "", syscall.EINVAL
+		}
+	}
+	keys, c, err := r.scan(ctx, c, "d*", int64(limit))
+	if err != nil {
+		return "", err
+	}
+	var parents []Ino
+	for _, key := range keys {
+		parent, err := strconv.ParseUint(key[len(r.prefix)+1:], 10, 64)
+		if err != nil {
+			continue // delfiles
+		}
+		vals, err := r.rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			return "", err
+		}
+		for name, v := range vals {
+			if !filter.matchName(name) {
+				continue
 			}
-			for j, re := range rs {
-				if re != nil {
-					if a, ok := re.(string); ok {
-						r.parseAttr([]byte(a), es[j].Attr)
-					}
+			typ, inode := r.parseEntry([]byte(v))
+			*entries = append(*entries, &Entry{Inode: inode, Name: []byte(name), Attr: &Attr{Typ: typ}})
+			parents = append(parents, Ino(parent))
+		}
+	}
+	if st := r.doFillAttrs(ctx, *entries); st != 0 {
+		return "", st
+	}
+	for i, e := range *entries {
+		e.Attr.Parent = parents[i]
+	}
+	if c == 0 {
+		return "", nil
+	}
+	return strconv.FormatUint(c, 10), nil
+}
+
+func (r *redisMeta) doFillAttrs(ctx Context, entries []*Entry) syscall.Errno {
+	var err error
+	fillAttr := func(es []*Entry) error {
+		var keys = make([]string, len(es))
+		for i, e := range es {
+			keys[i] = r.inodeKey(e.Inode)
+		}
+		rs, err := r.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+		for j, re := range rs {
+			if re != nil {
+				if a, ok := re.(string); ok {
+					r.parseAttr([]byte(a), es[j].Attr)
 				}
 			}
-			return nil
 		}
-		batchSize := 4096
-		nEntries := len(*entries)
-		if nEntries <= batchSize {
-			err = fillAttr(*entries)
-		} else {
-			indexCh := make(chan []*Entry, 10)
-			var wg sync.WaitGroup
-			for i := 0; i < 2; i++ {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for es := range indexCh {
-						e := fillAttr(es)
-						if e != nil {
-							err = e
-							break
-						}
+		return nil
+	}
+	batchSize := 4096
+	nEntries := len(entries)
+	if nEntries <= batchSize {
+		err = fillAttr(entries)
+	} else {
+		indexCh := make(chan []*Entry, 10)
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for es := range indexCh {
+					e := fillAttr(es)
+					if e != nil {
+						err = e
+						break
 					}
-				}()
-			}
-			for i := 0; i < nEntries; i += batchSize {
-				if i+batchSize > nEntries {
-					indexCh <- (*entries)[i:]
-				} else {
-					indexCh <- (*entries)[i : i+batchSize]
 				}
-			}
-			close(indexCh)
-			wg.Wait()
+			}()
 		}
-		if err != nil {
-			return errno(err)
+		for i := 0; i < nEntries; i += batchSize {
+			if i+batchSize > nEntries {
+				indexCh <- entries[i:]
+			} else {
+				indexCh <- entries[i : i+batchSize]
+			}
 		}
+		close(indexCh)
+		wg.Wait()
+	}
+	if err != nil {
+		return errno(err)
 	}
 	return 0
 }
@@ -1599,36 +2293,49 @@ func (r *redisMeta) doCleanStaleSession(sid uint64) {
 		}
 	}
 	if done {
-		r.rdb.HDel(ctx, sessionInfos, ssid)
-		r.rdb.ZRem(ctx, allSessions, ssid)
+		r.rdb.Del(ctx, r.openFilesKey(sid))
+		r.rdb.HDel(ctx, r.prefix+sessionInfos, ssid)
+		r.rdb.ZRem(ctx, r.prefix+allSessions, ssid)
 		logger.Infof("cleanup session %d", sid)
 	}
 }
 
-func (r *redisMeta) CleanStaleSessions() {
-	rng := &redis.ZRangeBy{Max: strconv.Itoa(int(time.Now().Add(time.Minute * -5).Unix())), Count: 100}
-	staleSessions, _ := r.rdb.ZRangeByScore(Background, allSessions, rng).Result()
-	for _, ssid := range staleSessions {
-		sid, _ := strconv.Atoi(ssid)
-		r.doCleanStaleSession(uint64(sid))
+func (r *redisMeta) findStaleSessions(edge time.Time, limit int) ([]uint64, error) {
+	rng := &redis.ZRangeBy{Max: strconv.FormatInt(edge.Unix(), 10), Count: int64(limit)}
+	ssids, err := r.rdb.ZRangeByScore(Background, r.prefix+allSessions, rng).Result()
+	if err != nil {
+		return nil, err
+	}
+	sids := make([]uint64, 0, len(ssids))
+	for _, ssid := range ssids {
+		sid, _ := strconv.ParseUint(ssid, 10, 64)
+		sids = append(sids, sid)
+	}
+	return sids, nil
+}
+
+func (r *redisMeta) doRefreshSession() error {
+	if r.broker {
+		return r.rdb.Do(Background, brokerHeartbeat, r.prefix+allSessions, strconv.Itoa(int(r.sid))).Err()
 	}
+	return r.rdb.ZAdd(Background, r.prefix+allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))}).Err()
 }
 
-func (r *redisMeta) refreshSession() {
-	for {
-		time.Sleep(time.Minute)
-		r.Lock()
-		if r.umounting {
-			r.Unlock()
-			return
-		}
-		r.rdb.ZAdd(Background, allSessions, &redis.Z{Score: float64(time.Now().Unix()), Member: strconv.Itoa(int(r.sid))})
-		r.Unlock()
-		if _, err := r.Load(); err != nil {
-			logger.Warnf("reload setting: %s", err)
+func (r *redisMeta) doRefreshOpenFiles(sid uint64, files map[Ino]int) error {
+	ctx := Background
+	key := r.openFilesKey(sid)
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if len(files) > 0 {
+			fields := make(map[string]interface{}, len(files))
+			for inode, refs := range files {
+				fields[inode.String()] = refs
+			}
+			pipe.HSet(ctx, key, fields)
 		}
-		go r.CleanStaleSessions()
-	}
+		return nil
+	})
+	return err
 }
 
 func (r *redisMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
@@ -1642,20 +2349,60 @@ func (r *redisMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
 		return err
 	}
 	r.parseAttr(a, &attr)
+	grace := r.sustainedGrace(sid)
 	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
-		pipe.ZAdd(ctx, delfiles, &redis.Z{Score: float64(time.Now().Unix()), Member: r.toDelete(inode, attr.Length)})
-		pipe.Del(ctx, r.inodeKey(inode))
-		pipe.IncrBy(ctx, usedSpace, -align4K(attr.Length))
-		pipe.Decr(ctx, totalInodes)
+		pipe.ZAdd(ctx, r.prefix+delfiles, &redis.Z{Score: float64(time.Now().Add(grace).Unix()), Member: r.toDelete(inode, attr.Length)})
+		if grace == 0 {
+			// or the inode is removed with its data, see deleteDeferredInode
+			pipe.Del(ctx, r.inodeKey(inode))
+			pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
+			pipe.Decr(ctx, r.prefix+totalInodes)
+		}
 		pipe.SRem(ctx, r.sustained(sid), strconv.Itoa(int(inode)))
 		return nil
 	})
 	if err == nil {
-		go r.doDeleteFileData(inode, attr.Length)
+		r.sustainedUsage.update(-align4K(attr.Length), -1)
+		if grace > 0 {
+			logger.Infof("Defer deleting inode %d of session %d for %s", inode, sid, grace)
+		} else {
+			go r.doDeleteFileData(inode, attr.Length)
+		}
 	}
 	return err
 }
 
+// deleteDeferredInode removes the inode of a file held open by a dead session, which is kept
+// until its data is purged.
+func (r *redisMeta) deleteDeferredInode(inode Ino) error {
+	var ctx = Background
+	st := r.txn(ctx, func(tx *redis.Tx) error {
+		a, err := tx.Get(ctx, r.inodeKey(inode)).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var attr Attr
+		r.parseAttr(a, &attr)
+		if attr.Nlink > 0 {
+			return fmt.Errorf("inode %d is linked again", inode)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, r.inodeKey(inode), r.xattrKey(inode))
+			pipe.IncrBy(ctx, r.prefix+usedSpace, -align4K(attr.Length))
+			pipe.Decr(ctx, r.prefix+totalInodes)
+			return nil
+		})
+		return err
+	}, r.inodeKey(inode))
+	if st != 0 {
+		return st
+	}
+	return nil
+}
+
 func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) syscall.Errno {
 	f := r.of.find(inode)
 	if f != nil {
@@ -1682,12 +2429,19 @@ func (r *redisMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) s
 
 func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := r.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := r.of.find(inode)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(inode, indx) }()
+	var newSpace int64
+	var parent Ino
 	var needCompact bool
 	eno := r.txn(ctx, func(tx *redis.Tx) error {
 		var attr Attr
@@ -1696,18 +2450,22 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			return err
 		}
 		r.parseAttr(a, &attr)
-		if attr.Typ != TypeFile {
+		if attr.Typ != TypeFile || attr.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
-		var added int64
+		newSpace = 0
 		if newleng > attr.Length {
-			added = align4K(newleng) - align4K(attr.Length)
+			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if r.checkQuota(added, 0) {
+		if r.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = attr.Parent
+		if r.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1720,8 +2478,8 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 			// most of chunk are used by single inode, so use that as the default (1 == not exists)
 			// pipe.Incr(ctx, r.sliceKey(slice.Chunkid, slice.Size))
 			pipe.Set(ctx, r.inodeKey(inode), r.marshal(&attr), 0)
-			if added > 0 {
-				pipe.IncrBy(ctx, usedSpace, added)
+			if newSpace > 0 {
+				pipe.IncrBy(ctx, r.prefix+usedSpace, newSpace)
 			}
 			return nil
 		})
@@ -1730,21 +2488,31 @@ func (r *redisMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice
 		}
 		return err
 	}, r.inodeKey(inode))
-	if eno == 0 && needCompact {
-		go r.compactChunk(inode, indx, false)
+	if eno == 0 {
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+		if needCompact {
+			go r.compactChunk(inode, indx, false)
+		}
 	}
 	return eno
 }
 
 func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := r.writing.lock(ctx, fout)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := r.of.find(fout)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	defer func() { r.of.InvalidateChunk(fout, 0xFFFFFFFF) }()
-	return r.txn(ctx, func(tx *redis.Tx) error {
+	var newSpace int64
+	var parent Ino
+	st = r.txn(ctx, func(tx *redis.Tx) error {
 		rs, err := tx.MGet(ctx, r.inodeKey(fin), r.inodeKey(fout)).Result()
 		if err != nil {
 			return err
@@ -1769,16 +2537,23 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if attr.Flags&FlagImmutable != 0 || attr.Flags&FlagAppend != 0 && offOut < attr.Length {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
-		var added int64
+		newSpace = 0
 		if newleng > attr.Length {
-			added = align4K(newleng) - align4K(attr.Length)
+			newSpace = align4K(newleng) - align4K(attr.Length)
 			attr.Length = newleng
 		}
-		if r.checkQuota(added, 0) {
+		if r.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = attr.Parent
+		if r.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1822,18 +2597,18 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 						if dpos+s.Len > ChunkSize {
 							pipe.RPush(ctx, r.chunkKey(fout, indx), marshalSlice(dpos, s.Chunkid, s.Size, s.Off, ChunkSize-dpos))
 							if s.Chunkid > 0 {
-								pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(s.Chunkid, s.Size), 1)
+								pipe.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(s.Chunkid, s.Size), 1)
 							}
 
 							skip := ChunkSize - dpos
 							pipe.RPush(ctx, r.chunkKey(fout, indx+1), marshalSlice(0, s.Chunkid, s.Size, s.Off+skip, s.Len-skip))
 							if s.Chunkid > 0 {
-								pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(s.Chunkid, s.Size), 1)
+								pipe.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(s.Chunkid, s.Size), 1)
 							}
 						} else {
 							pipe.RPush(ctx, r.chunkKey(fout, indx), marshalSlice(dpos, s.Chunkid, s.Size, s.Off, s.Len))
 							if s.Chunkid > 0 {
-								pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(s.Chunkid, s.Size), 1)
+								pipe.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(s.Chunkid, s.Size), 1)
 							}
 						}
 					}
@@ -1841,8 +2616,8 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 				coff += ChunkSize
 			}
 			pipe.Set(ctx, r.inodeKey(fout), r.marshal(&attr), 0)
-			if added > 0 {
-				pipe.IncrBy(ctx, usedSpace, added)
+			if newSpace > 0 {
+				pipe.IncrBy(ctx, r.prefix+usedSpace, newSpace)
 			}
 			return nil
 		})
@@ -1851,13 +2626,17 @@ func (r *redisMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino,
 		}
 		return err
 	}, r.inodeKey(fout), r.inodeKey(fin))
+	if st == 0 {
+		r.updateDirQuota(ctx, parent, newSpace, 0)
+	}
+	return st
 }
 
 func (r *redisMeta) cleanupDeletedFiles() {
 	for {
 		time.Sleep(time.Minute)
 		now := time.Now()
-		members, _ := r.rdb.ZRangeByScore(Background, delfiles, &redis.ZRangeBy{Min: strconv.Itoa(0), Max: strconv.Itoa(int(now.Add(-time.Hour).Unix())), Count: 1000}).Result()
+		members, _ := r.rdb.ZRangeByScore(Background, r.prefix+delfiles, &redis.ZRangeBy{Min: strconv.Itoa(0), Max: strconv.Itoa(int(now.Add(-time.Hour).Unix())), Count: 1000}).Result()
 		for _, member := range members {
 			ps := strings.Split(member, ":")
 			inode, _ := strconv.ParseInt(ps[0], 10, 0)
@@ -1879,12 +2658,12 @@ func (r *redisMeta) cleanupSlices() {
 
 		// once per hour
 		var ctx = Background
-		last, _ := r.rdb.Get(ctx, "nextCleanupSlices").Uint64()
+		last, _ := r.rdb.Get(ctx, r.prefix+"nextCleanupSlices").Uint64()
 		now := time.Now().Unix()
 		if last+3600 > uint64(now) {
 			continue
 		}
-		r.rdb.Set(ctx, "nextCleanupSlices", now, 0)
+		r.rdb.Set(ctx, r.prefix+"nextCleanupSlices", now, 0)
 		r.doCleanupSlices()
 	}
 }
@@ -1895,13 +2674,13 @@ func (r *redisMeta) doCleanupSlices() {
 	var cursor uint64
 	var err error
 	for {
-		ckeys, cursor, err = r.rdb.HScan(ctx, sliceRefs, cursor, "*", 1000).Result()
+		ckeys, cursor, err = r.rdb.HScan(ctx, r.prefix+sliceRefs, cursor, "*", 1000).Result()
 		if err != nil {
 			logger.Errorf("scan slices: %s", err)
 			break
 		}
 		if len(ckeys) > 0 {
-			values, err := r.rdb.HMGet(ctx, sliceRefs, ckeys...).Result()
+			values, err := r.rdb.HMGet(ctx, r.prefix+sliceRefs, ckeys...).Result()
 			if err != nil {
 				logger.Warnf("mget slices: %s", err)
 				break
@@ -1930,10 +2709,78 @@ func (r *redisMeta) doCleanupSlices() {
 	}
 }
 
+func (r *redisMeta) doCountUnrefSlices(ctx Context, stats *GCStats) error {
+	var cursor uint64
+	for {
+		ckeys, next, err := r.rdb.HScan(ctx, r.prefix+sliceRefs, cursor, "*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		if len(ckeys) > 0 {
+			values, err := r.rdb.HMGet(ctx, r.prefix+sliceRefs, ckeys...).Result()
+			if err != nil {
+				return err
+			}
+			for i, v := range values {
+				s, ok := v.(string)
+				if !ok || s != "0" && !strings.HasPrefix(s, "-") {
+					continue
+				}
+				ps := strings.Split(ckeys[i], "_")
+				if len(ps) != 2 {
+					continue
+				}
+				size, _ := strconv.ParseUint(ps[1], 10, 32)
+				if s == "0" {
+					stats.LeakedSlices++
+					stats.LeakedSpace += size
+				} else {
+					stats.PendingSlices++
+					stats.PendingSliceSpace += size
+				}
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (r *redisMeta) doScanInodes(ctx Context, fn func(inode Ino, attr *Attr) bool) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.scan(ctx, cursor, "i*", 1000)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			values, err := r.rdb.MGet(ctx, keys...).Result()
+			if err != nil {
+				return err
+			}
+			for i, v := range values {
+				inode, err := strconv.ParseUint(keys[i][len(r.prefix)+1:], 10, 64)
+				a, ok := v.(string)
+				if err != nil || !ok {
+					continue
+				}
+				attr := &Attr{}
+				r.parseAttr([]byte(a), attr)
+				if !fn(Ino(inode), attr) {
+					return nil
+				}
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
 func (r *redisMeta) cleanupZeroRef(key string) {
 	var ctx = Background
 	_ = r.txn(ctx, func(tx *redis.Tx) error {
-		v, err := tx.HGet(ctx, sliceRefs, key).Int()
+		v, err := tx.HGet(ctx, r.prefix+sliceRefs, key).Int()
 		if err != nil {
 			return err
 		}
@@ -1941,11 +2788,11 @@ func (r *redisMeta) cleanupZeroRef(key string) {
 			return syscall.EINVAL
 		}
 		_, err = tx.Pipelined(ctx, func(p redis.Pipeliner) error {
-			p.HDel(ctx, sliceRefs, key)
+			p.HDel(ctx, r.prefix+sliceRefs, key)
 			return nil
 		})
 		return err
-	}, sliceRefs)
+	}, r.prefix+sliceRefs)
 }
 
 func (r *redisMeta) cleanupLeakedChunks() {
@@ -1954,7 +2801,7 @@ func (r *redisMeta) cleanupLeakedChunks() {
 	var cursor uint64
 	var err error
 	for {
-		ckeys, cursor, err = r.rdb.Scan(ctx, cursor, "c*", 1000).Result()
+		ckeys, cursor, err = r.scan(ctx, cursor, "c*", 1000)
 		if err != nil {
 			logger.Errorf("scan all chunks: %s", err)
 			break
@@ -1967,7 +2814,7 @@ func (r *redisMeta) cleanupLeakedChunks() {
 			if len(ps) != 2 {
 				continue
 			}
-			ino, _ := strconv.ParseInt(ps[0][1:], 10, 0)
+			ino, _ := strconv.ParseInt(ps[0][len(r.prefix)+1:], 10, 0)
 			ikeys = append(ikeys, k)
 			rs = append(rs, p.Exists(ctx, r.inodeKey(Ino(ino))))
 		}
@@ -1982,7 +2829,7 @@ func (r *redisMeta) cleanupLeakedChunks() {
 					key := ikeys[i]
 					logger.Infof("found leaked chunk %s", key)
 					ps := strings.Split(key, "_")
-					ino, _ := strconv.ParseInt(ps[0][1:], 10, 0)
+					ino, _ := strconv.ParseInt(ps[0][len(r.prefix)+1:], 10, 0)
 					indx, _ := strconv.Atoi(ps[1])
 					_ = r.deleteChunk(Ino(ino), uint32(indx))
 				}
@@ -2000,7 +2847,7 @@ func (r *redisMeta) cleanupOldSliceRefs() {
 	var cursor uint64
 	var err error
 	for {
-		ckeys, cursor, err = r.rdb.Scan(ctx, cursor, "k*", 1000).Result()
+		ckeys, cursor, err = r.scan(ctx, cursor, "k*", 1000)
 		if err != nil {
 			logger.Errorf("scan slices: %s", err)
 			break
@@ -2021,7 +2868,7 @@ func (r *redisMeta) cleanupOldSliceRefs() {
 					todel = append(todel, ckeys[i])
 				} else {
 					vv, _ := strconv.Atoi(v.(string))
-					r.rdb.HIncrBy(ctx, sliceRefs, ckeys[i], int64(vv))
+					r.rdb.HIncrBy(ctx, r.prefix+sliceRefs, ckeys[i][len(r.prefix):], int64(vv))
 					r.rdb.DecrBy(ctx, ckeys[i], int64(vv))
 					logger.Infof("move refs %d for slice %s", vv, ckeys[i])
 				}
@@ -2058,7 +2905,7 @@ func (r *redisMeta) deleteChunk(inode Ino, indx uint32) error {
 					size := rb.Get32()
 					slices = append(slices, &slice{chunkid: chunkid, size: size})
 					pipe.LPop(ctx, key)
-					rs = append(rs, pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(chunkid, size), -1))
+					rs = append(rs, pipe.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(chunkid, size), -1))
 				}
 				return nil
 			})
@@ -2085,6 +2932,10 @@ func (r *redisMeta) doDeleteFileData(inode Ino, length uint64) {
 
 func (r *redisMeta) doDeleteFileData_(inode Ino, length uint64, tracking string) {
 	var ctx = Background
+	if err := r.deleteDeferredInode(inode); err != nil {
+		logger.Warnf("delete inode %d: %s", inode, err)
+		return
+	}
 	var indx uint32
 	p := r.rdb.Pipeline()
 	for uint64(indx)*ChunkSize < length {
@@ -2116,7 +2967,7 @@ func (r *redisMeta) doDeleteFileData_(inode Ino, length uint64, tracking string)
 	if tracking == "" {
 		tracking = inode.String() + ":" + strconv.FormatInt(int64(length), 10)
 	}
-	_ = r.rdb.ZRem(ctx, delfiles, tracking)
+	_ = r.rdb.ZRem(ctx, r.prefix+delfiles, tracking)
 }
 
 func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
@@ -2137,108 +2988,123 @@ func (r *redisMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		}()
 	}
 
-	var ctx = Background
-	vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000).Result()
-	if err != nil {
-		return
-	}
+	for retry := 0; ; retry++ {
+		var ctx = Background
+		vals, err := r.rdb.LRange(ctx, r.chunkKey(inode, indx), 0, 1000).Result()
+		if err != nil {
+			return
+		}
 
-	ss := readSlices(vals)
-	skipped := skipSome(ss)
-	ss = ss[skipped:]
-	pos, size, chunks := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
-		return
-	}
+		ss := readSlices(vals)
+		skipped := skipSome(ss)
+		ss = ss[skipped:]
+		pos, size, chunks := compactChunk(ss)
+		if len(ss) < 2 || size == 0 {
+			return
+		}
 
-	var chunkid uint64
-	st := r.NewChunk(ctx, &chunkid)
-	if st != 0 {
-		return
-	}
-	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = r.newMsg(CompactChunk, chunks, chunkid)
-	if err != nil {
-		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
-			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+		var chunkid uint64
+		st := r.NewChunk(ctx, &chunkid)
+		if st != 0 {
+			return
 		}
-		return
-	}
-	var rs []*redis.IntCmd
-	key := r.chunkKey(inode, indx)
-	errno := r.txn(ctx, func(tx *redis.Tx) error {
-		rs = nil
-		vals2, err := tx.LRange(ctx, key, 0, int64(len(vals)-1)).Result()
+		logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
+		err = r.newMsg(CompactChunk, chunks, chunkid)
 		if err != nil {
-			return err
-		}
-		if len(vals2) != len(vals) {
-			return syscall.EINVAL
+			if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
+				logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+			}
+			return
 		}
-		for i, val := range vals2 {
-			if val != vals[i] {
+		var rs []*redis.IntCmd
+		key := r.chunkKey(inode, indx)
+		errno := r.txn(ctx, func(tx *redis.Tx) error {
+			rs = nil
+			vals2, err := tx.LRange(ctx, key, 0, int64(len(vals)-1)).Result()
+			if err != nil {
+				return err
+			}
+			if len(vals2) != len(vals) {
 				return syscall.EINVAL
 			}
+			for i, val := range vals2 {
+				if val != vals[i] {
+					return syscall.EINVAL
+				}
+			}
+
+			_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.LTrim(ctx, key, int64(len(vals)), -1)
+				pipe.LPush(ctx, key, marshalSlice(pos, chunkid, size, 0, size))
+				for i := skipped; i > 0; i-- {
+					pipe.LPush(ctx, key, vals[i-1])
+				}
+				pipe.HSet(ctx, r.prefix+sliceRefs, r.sliceKey(chunkid, size), "0") // create the key to tracking it
+				for _, s := range ss {
+					rs = append(rs, pipe.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(s.chunkid, s.size), -1))
+				}
+				return nil
+			})
+			return err
+		}, key)
+		// there could be false-negative that the compaction is successful, double-check
+		if errno != 0 && errno != syscall.EINVAL {
+			if e := r.rdb.HGet(ctx, r.prefix+sliceRefs, r.sliceKey(chunkid, size)).Err(); e == redis.Nil {
+				errno = syscall.EINVAL // failed
+			} else if e == nil {
+				errno = 0 // successful
+			}
 		}
 
-		_, err = tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
-			pipe.LTrim(ctx, key, int64(len(vals)), -1)
-			pipe.LPush(ctx, key, marshalSlice(pos, chunkid, size, 0, size))
-			for i := skipped; i > 0; i-- {
-				pipe.LPush(ctx, key, vals[i-1])
+		if errno == syscall.EINVAL {
+			r.rdb.HIncrBy(ctx, r.prefix+sliceRefs, r.sliceKey(chunkid, size), -1)
+			logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, chunkid, size)
+			r.deleteSlice(chunkid, size)
+			if !force {
+				return
 			}
-			pipe.HSet(ctx, sliceRefs, r.sliceKey(chunkid, size), "0") // create the key to tracking it
-			for _, s := range ss {
-				rs = append(rs, pipe.HIncrBy(ctx, sliceRefs, r.sliceKey(s.chunkid, s.size), -1))
+		} else if errno == 0 {
+			r.of.InvalidateChunk(inode, indx)
+			r.cleanupZeroRef(r.sliceKey(chunkid, size))
+			for i, s := range ss {
+				if rs[i].Err() == nil && rs[i].Val() < 0 {
+					r.deleteSlice(s.chunkid, s.size)
+				}
 			}
-			return nil
-		})
-		return err
-	}, key)
-	// there could be false-negative that the compaction is successful, double-check
-	if errno != 0 && errno != syscall.EINVAL {
-		if e := r.rdb.HGet(ctx, sliceRefs, r.sliceKey(chunkid, size)).Err(); e == redis.Nil {
-			errno = syscall.EINVAL // failed
-		} else if e == nil {
-			errno = 0 // successful
-		}
-	}
-
-	if errno == syscall.EINVAL {
-		r.rdb.HIncrBy(ctx, sliceRefs, r.sliceKey(chunkid, size), -1)
-		logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, chunkid, size)
-		r.deleteSlice(chunkid, size)
-	} else if errno == 0 {
-		r.of.InvalidateChunk(inode, indx)
-		r.cleanupZeroRef(r.sliceKey(chunkid, size))
-		for i, s := range ss {
-			if rs[i].Err() == nil && rs[i].Val() < 0 {
-				r.deleteSlice(s.chunkid, s.size)
+			if r.rdb.LLen(ctx, r.chunkKey(inode, indx)).Val() <= 5 {
+				return
 			}
+			if !force {
+				go func() {
+					// wait for the current compaction to finish
+					time.Sleep(time.Millisecond * 10)
+					r.compactChunk(inode, indx, force)
+				}()
+				return
+			}
+		} else {
+			logger.Warnf("compact %s: %s", key, errno)
+			return
+		}
+		// compact the rest, or retry the one wasted by others (a background compaction or writes),
+		// so the chunk is compacted once a forced compaction returns, unless it keeps changing
+		if retry >= maxCompactRetries {
+			logger.Warnf("compact %s: chunk is still changing after %d retries", key, retry)
+			return
 		}
-		if r.rdb.LLen(ctx, r.chunkKey(inode, indx)).Val() > 5 {
-			go func() {
-				// wait for the current compaction to finish
-				time.Sleep(time.Millisecond * 10)
-				r.compactChunk(inode, indx, force)
-			}()
-		}
-	} else {
-		logger.Warnf("compact %s: %s", key, errno)
 	}
 }
 
-func (r *redisMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
+func (r *redisMeta) CompactAll(ctx Context, threads int, bar *utils.Bar) syscall.Errno {
 	var cursor uint64
 	p := r.rdb.Pipeline()
-
+	var cs []chunkPos
 	for {
-		keys, c, err := r.rdb.Scan(ctx, cursor, "c*_*", 10000).Result()
+		keys, c, err := r.scan(ctx, cursor, "c*_*", 10000)
 		if err != nil {
 			logger.Warnf("scan chunks: %s", err)
 			return errno(err)
 		}
-		bar.IncrTotal(int64(len(keys)))
 		for _, key := range keys {
 			_ = p.LLen(ctx, key)
 		}
@@ -2252,20 +3118,18 @@ func (r *redisMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 			if cnt > 1 {
 				var inode uint64
 				var indx uint32
-				n, err := fmt.Sscanf(keys[i], "c%d_%d", &inode, &indx)
+				n, err := fmt.Sscanf(keys[i][len(r.prefix):], "c%d_%d", &inode, &indx)
 				if err == nil && n == 2 {
-					logger.Debugf("compact chunk %d:%d (%d slices)", inode, indx, cnt)
-					r.compactChunk(Ino(inode), indx, true)
+					cs = append(cs, chunkPos{Ino(inode), indx})
 				}
 			}
-			bar.Increment()
 		}
 		if c == 0 {
 			break
 		}
 		cursor = c
 	}
-	return 0
+	return r.compactChunks(cs, threads, bar)
 }
 
 func (r *redisMeta) cleanupLeakedInodes(delete bool) {
@@ -2276,20 +3140,21 @@ func (r *redisMeta) cleanupLeakedInodes(delete bool) {
 	var foundInodes = make(map[Ino]struct{})
 	cutoff := time.Now().Add(time.Hour * -1)
 	for {
-		keys, cursor, err = r.rdb.Scan(ctx, cursor, "d*", 1000).Result()
+		keys, cursor, err = r.scan(ctx, cursor, "d*", 1000)
 		if err != nil {
 			logger.Errorf("scan dentry: %s", err)
 			return
 		}
 		if len(keys) > 0 {
 			for _, key := range keys {
-				ino, _ := strconv.Atoi(key[1:])
+				ino, _ := strconv.Atoi(key[len(r.prefix)+1:])
 				var entries []*Entry
-				eno := r.Readdir(ctx, Ino(ino), 0, &entries)
+				eno := r.doReaddir(ctx, Ino(ino), 0, &entries)
 				if eno != syscall.ENOENT && eno != 0 {
 					logger.Errorf("readdir %d: %s", ino, eno)
 					return
 				}
+				foundInodes[Ino(ino)] = struct{}{}
 				for _, e := range entries {
 					foundInodes[e.Inode] = struct{}{}
 				}
@@ -2300,7 +3165,7 @@ func (r *redisMeta) cleanupLeakedInodes(delete bool) {
 		}
 	}
 	for {
-		keys, cursor, err = r.rdb.Scan(ctx, cursor, "i*", 1000).Result()
+		keys, cursor, err = r.scan(ctx, cursor, "i*", 1000)
 		if err != nil {
 			logger.Errorf("scan inodes: %s", err)
 			break
@@ -2317,7 +3182,7 @@ func (r *redisMeta) cleanupLeakedInodes(delete bool) {
 				}
 				var attr Attr
 				r.parseAttr([]byte(v.(string)), &attr)
-				ino, _ := strconv.Atoi(keys[i][1:])
+				ino, _ := strconv.Atoi(keys[i][len(r.prefix)+1:])
 				if _, ok := foundInodes[Ino(ino)]; !ok && time.Unix(attr.Ctime, 0).Before(cutoff) {
 					logger.Infof("found dangling inode: %s %+v", keys[i], attr)
 					if delete {
@@ -2335,7 +3200,42 @@ func (r *redisMeta) cleanupLeakedInodes(delete bool) {
 	}
 }
 
-func (r *redisMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno {
+func (r *redisMeta) UsedSlices(ctx Context, chunkids []uint64) (map[uint64]bool, syscall.Errno) {
+	used := make(map[uint64]bool, len(chunkids))
+	for _, id := range chunkids {
+		used[id] = true
+	}
+	// only the slices referenced more than once or being deleted are in sliceRefs
+	var cursor uint64
+	for {
+		ckeys, next, err := r.rdb.HScan(ctx, r.prefix+sliceRefs, cursor, "*", 1000).Result()
+		if err != nil {
+			return nil, errno(err)
+		}
+		if len(ckeys) > 0 {
+			values, err := r.rdb.HMGet(ctx, r.prefix+sliceRefs, ckeys...).Result()
+			if err != nil {
+				return nil, errno(err)
+			}
+			for i, v := range values {
+				if s, ok := v.(string); !ok || !strings.HasPrefix(s, "-") { // >= 0
+					continue
+				}
+				ps := strings.Split(ckeys[i], "_")
+				if len(ps) != 2 || len(ps[0]) < 2 {
+					continue
+				}
+				chunkid, _ := strconv.ParseUint(ps[0][1:], 10, 64)
+				delete(used, chunkid)
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return used, 0
+		}
+	}
+}
+
+func (r *redisMeta) ListSlices(ctx Context, delete bool, fn func(inode Ino, s Slice) error) syscall.Errno {
 	r.cleanupLeakedInodes(delete)
 	r.cleanupLeakedChunks()
 	r.cleanupOldSliceRefs()
@@ -2346,7 +3246,7 @@ func (r *redisMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool,
 	var cursor uint64
 	p := r.rdb.Pipeline()
 	for {
-		keys, c, err := r.rdb.Scan(ctx, cursor, "c*_*", 10000).Result()
+		keys, c, err := r.scan(ctx, cursor, "c*_*", 10000)
 		if err != nil {
 			logger.Warnf("scan chunks: %s", err)
 			return errno(err)
@@ -2361,14 +3261,13 @@ func (r *redisMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool,
 		}
 		for _, cmd := range cmds {
 			key := cmd.(*redis.StringSliceCmd).Args()[1].(string)
-			inode, _ := strconv.Atoi(strings.Split(key[1:], "_")[0])
+			inode, _ := strconv.Atoi(strings.Split(key[len(r.prefix)+1:], "_")[0])
 			vals := cmd.(*redis.StringSliceCmd).Val()
 			ss := readSlices(vals)
 			for _, s := range ss {
 				if s.chunkid > 0 {
-					slices[Ino(inode)] = append(slices[Ino(inode)], Slice{Chunkid: s.chunkid, Size: s.size})
-					if showProgress != nil {
-						showProgress()
+					if err = fn(Ino(inode), Slice{Chunkid: s.chunkid, Size: s.size}); err != nil {
+						return errno(err)
 					}
 				}
 			}
@@ -2407,12 +3306,7 @@ func (r *redisMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Err
 	return 0
 }
 
-func (r *redisMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
-	if name == "" {
-		return syscall.EINVAL
-	}
-	defer timeit(time.Now())
-	inode = r.checkRoot(inode)
+func (r *redisMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
 	c := Background
 	key := r.xattrKey(inode)
 	return r.txn(ctx, func(tx *redis.Tx) error {
@@ -2432,21 +3326,22 @@ func (r *redisMeta) SetXattr(ctx Context, inode Ino, name string, value []byte,
 			} else if !ok {
 				return ENOATTR
 			}
-			_, err := r.rdb.HSet(ctx, key, name, value).Result()
+			_, err := tx.TxPipelined(c, func(pipe redis.Pipeliner) error {
+				pipe.HSet(c, key, name, value)
+				return nil
+			})
 			return err
 		default: // XattrCreateOrReplace
-			_, err := r.rdb.HSet(ctx, key, name, value).Result()
+			_, err := tx.TxPipelined(c, func(pipe redis.Pipeliner) error {
+				pipe.HSet(c, key, name, value)
+				return nil
+			})
 			return err
 		}
 	}, key)
 }
 
-func (r *redisMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
-	if name == "" {
-		return syscall.EINVAL
-	}
-	defer timeit(time.Now())
-	inode = r.checkRoot(inode)
+func (r *redisMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
 	n, err := r.rdb.HDel(ctx, r.xattrKey(inode), name).Result()
 	if err != nil {
 		return errno(err)
@@ -2457,6 +3352,214 @@ func (r *redisMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Err
 	}
 }
 
+func (r *redisMeta) doTag(inode Ino, key string, value []byte, add bool) error {
+	member := string(value) + "\x00" + inode.String()
+	if add {
+		return r.rdb.ZAdd(Background, r.tagKey(key), &redis.Z{Member: member}).Err()
+	}
+	return r.rdb.ZRem(Background, r.tagKey(key), member).Err()
+}
+
+func (r *redisMeta) doFindTagged(key string, value []byte) ([]tagged, error) {
+	min, max := "-", "+"
+	if value != nil {
+		min, max = "["+string(value)+"\x00", "["+string(value)+"\x01"
+	}
+	members, err := r.rdb.ZRangeByLex(Background, r.tagKey(key), &redis.ZRangeBy{Min: min, Max: max}).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ts []tagged
+	for _, member := range members {
+		p := strings.LastIndexByte(member, 0)
+		inode, err := strconv.ParseUint(member[p+1:], 10, 64)
+		if p < 0 || err != nil {
+			logger.Warnf("invalid member %q in %s", member, r.tagKey(key))
+			continue
+		}
+		if value != nil && member[:p] != string(value) {
+			continue
+		}
+		ts = append(ts, tagged{Ino(inode), []byte(member[:p])})
+	}
+	return ts, nil
+}
+
+func (r *redisMeta) doAddEvent(e *Event) error {
+	return r.rdb.ZAdd(Background, r.changelogKey(), &redis.Z{Score: float64(e.ID), Member: e.marshal()}).Err()
+}
+
+func (r *redisMeta) doReadEvents(ctx Context, after uint64, limit int) ([]*Event, error) {
+	members, err := r.rdb.ZRangeByScore(ctx, r.changelogKey(), &redis.ZRangeBy{
+		Min:   "(" + strconv.FormatUint(after, 10),
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0, len(members))
+	for _, member := range members {
+		e, err := parseEvent([]byte(member))
+		if err != nil {
+			logger.Warnf("%s: %s", r.changelogKey(), err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (r *redisMeta) doCleanupEvents(edge time.Time) (int, error) {
+	var total int
+	for {
+		zs, err := r.rdb.ZRangeWithScores(Background, r.changelogKey(), 0, eventBatch-1).Result()
+		if err != nil {
+			return total, err
+		}
+		var n int
+		for _, z := range zs {
+			if e, err := parseEvent([]byte(z.Member.(string))); err == nil && e.Time >= edge.UnixNano() {
+				break
+			}
+			n++
+		}
+		if n > 0 {
+			max := strconv.FormatFloat(zs[n-1].Score, 'f', -1, 64)
+			if err = r.rdb.ZRemRangeByScore(Background, r.changelogKey(), "-inf", max).Err(); err != nil {
+				return total, err
+			}
+		}
+		total += n
+		if n < eventBatch {
+			return total, nil
+		}
+	}
+}
+
+func (r *redisMeta) doNotify(msg string) error {
+	return r.rdb.Publish(Background, r.invalidateChannel(), msg).Err()
+}
+
+func (r *redisMeta) doWatch(cb func(msg string)) error {
+	sub := r.rdb.Subscribe(Background, r.invalidateChannel())
+	defer sub.Close()
+	if _, err := sub.Receive(Background); err != nil {
+		return err
+	}
+	// the channel is reconnected automatically, the messages during reconnecting are lost
+	for msg := range sub.Channel() {
+		cb(msg.Payload)
+	}
+	return nil
+}
+
+func (r *redisMeta) doGetQuota(inode Ino) (*Quota, error) {
+	ctx := Background
+	field := inode.String()
+	buf, err := r.rdb.HGet(ctx, r.prefix+"dirQuota", field).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(buf) != 16 {
+		return nil, fmt.Errorf("invalid quota of %d: %v", inode, buf)
+	}
+	rb := utils.ReadBuffer(buf)
+	q := &Quota{MaxSpace: int64(rb.Get64()), MaxInodes: int64(rb.Get64())}
+	if q.UsedSpace, err = r.rdb.HGet(ctx, r.prefix+"dirUsedSpace", field).Int64(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if q.UsedInodes, err = r.rdb.HGet(ctx, r.prefix+"dirUsedInodes", field).Int64(); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (r *redisMeta) doSetQuota(inode Ino, quota *Quota) error {
+	ctx := Background
+	field := inode.String()
+	wb := utils.NewBuffer(16)
+	wb.Put64(uint64(quota.MaxSpace))
+	wb.Put64(uint64(quota.MaxInodes))
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.prefix+"dirQuota", field, wb.Bytes())
+		pipe.HSet(ctx, r.prefix+"dirUsedSpace", field, quota.UsedSpace)
+		pipe.HSet(ctx, r.prefix+"dirUsedInodes", field, quota.UsedInodes)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doDelQuota(inode Ino) error {
+	ctx := Background
+	field := inode.String()
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, r.prefix+"dirQuota", field)
+		pipe.HDel(ctx, r.prefix+"dirUsedSpace", field)
+		pipe.HDel(ctx, r.prefix+"dirUsedInodes", field)
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doLoadQuotas() (map[Ino]*Quota, error) {
+	ctx := Background
+	limits, err := r.rdb.HGetAll(ctx, r.prefix+"dirQuota").Result()
+	if err != nil {
+		return nil, err
+	}
+	quotas := make(map[Ino]*Quota, len(limits))
+	if len(limits) == 0 {
+		return quotas, nil
+	}
+	spaces, err := r.rdb.HGetAll(ctx, r.prefix+"dirUsedSpace").Result()
+	if err != nil {
+		return nil, err
+	}
+	inodes, err := r.rdb.HGetAll(ctx, r.prefix+"dirUsedInodes").Result()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range limits {
+		inode, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || len(v) != 16 {
+			logger.Warnf("invalid quota: %s -> %v", k, []byte(v))
+			continue
+		}
+		rb := utils.ReadBuffer([]byte(v))
+		q := &Quota{MaxSpace: int64(rb.Get64()), MaxInodes: int64(rb.Get64())}
+		q.UsedSpace, _ = strconv.ParseInt(spaces[k], 10, 64)
+		q.UsedInodes, _ = strconv.ParseInt(inodes[k], 10, 64)
+		quotas[Ino(inode)] = q
+	}
+	return quotas, nil
+}
+
+func (r *redisMeta) doFlushQuotas(quotas map[Ino]*Quota) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for inode, q := range quotas {
+			field := inode.String()
+			pipe.HIncrBy(ctx, r.prefix+"dirUsedSpace", field, q.UsedSpace)
+			pipe.HIncrBy(ctx, r.prefix+"dirUsedInodes", field, q.UsedInodes)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisMeta) doFlushSustained(space, inodes int64) error {
+	ctx := Background
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.IncrBy(ctx, r.prefix+sustainedSpace, space)
+		pipe.IncrBy(ctx, r.prefix+sustainedInodes, inodes)
+		return nil
+	})
+	return err
+}
+
 func (r *redisMeta) checkServerConfig() {
 	rawInfo, err := r.rdb.Info(Background).Result()
 	if err != nil {
@@ -2686,7 +3789,7 @@ func (m *redisMeta) makeSnap(bar *utils.Bar) error {
 	hashType := func(keys []string) error {
 		p := m.rdb.Pipeline()
 		for _, key := range keys {
-			if key == delfiles {
+			if key == m.prefix+delfiles {
 				continue
 			}
 			p.HGetAll(ctx, key)
@@ -2717,7 +3820,7 @@ func (m *redisMeta) makeSnap(bar *utils.Bar) error {
 	scanner := func(match string, handlerKey func(keys []string) error) error {
 		var cursor uint64
 		for {
-			keys, c, err := m.rdb.Scan(ctx, cursor, match, 10000).Result()
+			keys, c, err := m.scan(ctx, cursor, match, 10000)
 			if err != nil {
 				return err
 			}
@@ -2742,60 +3845,33 @@ func (m *redisMeta) makeSnap(bar *utils.Bar) error {
 	return nil
 }
 
-func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
-	defer func() {
-		if p := recover(); p != nil {
-			if e, ok := p.(error); ok {
-				err = e
-			} else {
-				err = errors.Errorf("DumpMeta error: %v", p)
-			}
-		}
-	}()
+func (m *redisMeta) dumpHeader() (*DumpedMeta, error) {
 	ctx := Background
-	zs, err := m.rdb.ZRangeWithScores(ctx, delfiles, 0, -1).Result()
+	zs, err := m.rdb.ZRangeWithScores(ctx, m.prefix+delfiles, 0, -1).Result()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dels := make([]*DumpedDelFile, 0, len(zs))
 	for _, z := range zs {
 		parts := strings.Split(z.Member.(string), ":")
 		if len(parts) != 2 {
-			return fmt.Errorf("invalid delfile string: %s", z.Member.(string))
+			return nil, fmt.Errorf("invalid delfile string: %s", z.Member.(string))
 		}
 		inode, _ := strconv.ParseUint(parts[0], 10, 64)
 		length, _ := strconv.ParseUint(parts[1], 10, 64)
 		dels = append(dels, &DumpedDelFile{Ino(inode), length, int64(z.Score)})
 	}
 
-	progress := utils.NewProgress(false, false)
-	var tree, trash *DumpedEntry
-	if root == 0 {
-		root = m.root
-	}
-	if root == 1 {
-		bar := progress.AddCountBar("Snapshot keys", m.rdb.DBSize(ctx).Val())
-		if err = m.makeSnap(bar); err != nil {
-			return errors.Errorf("Fetch all metadata from Redis: %s", err)
-		}
-		bar.Done()
-		tree = m.dumpEntryFast(root)
-		trash = m.dumpEntryFast(TrashInode)
-	} else {
-		if tree, err = m.dumpEntry(root); err != nil {
-			return err
-		}
-	}
-	if tree == nil {
-		return errors.New("The entry of the root inode was not found")
-	}
-	tree.Name = "FSTree"
 	format, err := m.Load()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rs, _ := m.rdb.MGet(ctx, []string{usedSpace, totalInodes, "nextinode", "nextchunk", "nextsession", "nextTrash"}...).Result()
+	counters := []string{usedSpace, totalInodes, "nextinode", "nextchunk", "nextsession", "nextTrash", "generation"}
+	for i := range counters {
+		counters[i] = m.prefix + counters[i]
+	}
+	rs, _ := m.rdb.MGet(ctx, counters...).Result()
 	cs := make([]int64, len(rs))
 	for i, r := range rs {
 		if r != nil {
@@ -2803,21 +3879,16 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		}
 	}
 
-	keys, err := m.rdb.ZRange(ctx, allSessions, 0, -1).Result()
+	keys, err := m.rdb.ZRange(ctx, m.prefix+allSessions, 0, -1).Result()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	sessions := make([]*DumpedSustained, 0, len(keys))
 	for _, k := range keys {
 		sid, _ := strconv.ParseUint(k, 10, 64)
-		var ss []string
-		if root == 1 {
-			ss = m.snap.listMap[m.sustained(sid)]
-		} else {
-			ss, err = m.rdb.SMembers(ctx, m.sustained(sid)).Result()
-			if err != nil {
-				return err
-			}
+		ss, err := m.rdb.SMembers(ctx, m.sustained(sid)).Result()
+		if err != nil {
+			return nil, err
 		}
 		if len(ss) > 0 {
 			inodes := make([]Ino, 0, len(ss))
@@ -2829,7 +3900,7 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		}
 	}
 
-	dm := &DumpedMeta{
+	return &DumpedMeta{
 		Setting: format,
 		Counters: &DumpedCounters{
 			UsedSpace:   cs[0],
@@ -2838,9 +3909,49 @@ func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 			NextChunk:   cs[3] + 1,
 			NextSession: cs[4],
 			NextTrash:   cs[5],
+			Generation:  cs[6],
 		},
 		Sustained: sessions,
 		DelFiles:  dels,
+	}, nil
+}
+
+func (m *redisMeta) DumpMeta(w io.Writer, root Ino) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if e, ok := p.(error); ok {
+				err = e
+			} else {
+				err = errors.Errorf("DumpMeta error: %v", p)
+			}
+		}
+	}()
+	ctx := Background
+	progress := utils.NewProgress(false, false)
+	var tree, trash *DumpedEntry
+	if root == 0 {
+		root = m.root
+	}
+	if root == 1 {
+		bar := progress.AddCountBar("Snapshot keys", m.rdb.DBSize(ctx).Val())
+		if err = m.makeSnap(bar); err != nil {
+			return errors.Errorf("Fetch all metadata from Redis: %s", err)
+		}
+		bar.Done()
+		tree = m.dumpEntryFast(root)
+		trash = m.dumpEntryFast(TrashInode)
+	} else {
+		if tree, err = m.dumpEntry(root); err != nil {
+			return err
+		}
+	}
+	if tree == nil {
+		return errors.New("The entry of the root inode was not found")
+	}
+	tree.Name = "FSTree"
+	dm, err := m.dumpHeader()
+	if err != nil {
+		return err
 	}
 	bw, err := dm.writeJsonWithOutTree(w)
 	if err != nil {
@@ -2897,8 +4008,8 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[strin
 				m.Lock()
 				refs[m.sliceKey(s.Chunkid, s.Size)]++
 				m.Unlock()
-				if cs.NextChunk < int64(s.Chunkid) {
-					cs.NextChunk = int64(s.Chunkid)
+				if cs.NextChunk < int64(idSeq(s.Chunkid)) {
+					cs.NextChunk = int64(idSeq(s.Chunkid))
 				}
 			}
 			p.RPush(ctx, m.chunkKey(inode, c.Index), slices)
@@ -2916,13 +4027,18 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[strin
 		attr.Length = uint64(len(e.Symlink))
 		p.Set(ctx, m.symKey(inode), e.Symlink, 0)
 	}
+	if len(e.Parents) > 1 {
+		for _, parent := range e.Parents {
+			p.HIncrBy(ctx, m.parentKey(inode), parent.String(), 1)
+		}
+	}
 	if inode > 1 && inode != TrashInode {
 		cs.UsedSpace += align4K(attr.Length)
 		cs.UsedInodes += 1
 	}
 	if inode < TrashInode {
-		if cs.NextInode < int64(inode) {
-			cs.NextInode = int64(inode)
+		if cs.NextInode < int64(idSeq(uint64(inode))) {
+			cs.NextInode = int64(idSeq(uint64(inode)))
 		}
 	} else {
 		if cs.NextTrash < int64(inode)-TrashInode {
@@ -2936,15 +4052,26 @@ func (m *redisMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[strin
 			xattrs[x.Name] = x.Value
 		}
 		p.HSet(ctx, m.xattrKey(inode), xattrs)
+		for _, x := range e.Xattrs {
+			if strings.HasPrefix(x.Name, TagPrefix) {
+				p.ZAdd(ctx, m.tagKey(x.Name[len(TagPrefix):]), &redis.Z{Member: x.Value + "\x00" + inode.String()})
+			}
+		}
 	}
 	p.Set(ctx, m.inodeKey(inode), m.marshal(attr), 0)
 	_, err := p.Exec(ctx)
 	return err
 }
 
-func (m *redisMeta) LoadMeta(r io.Reader) error {
+func (m *redisMeta) LoadMeta(r io.Reader, opts *LoadOptions) error {
 	ctx := Background
-	dbsize, err := m.rdb.DBSize(ctx).Result()
+	var dbsize int64
+	var err error
+	if m.prefix == "" {
+		dbsize, err = m.rdb.DBSize(ctx).Result()
+	} else { // other volumes may share the same cluster
+		dbsize, err = m.rdb.Exists(ctx, m.prefix+"setting", m.inodeKey(1)).Result()
+	}
 	if err != nil {
 		return err
 	}
@@ -2952,86 +4079,31 @@ func (m *redisMeta) LoadMeta(r io.Reader) error {
 		return fmt.Errorf("Database %s is not empty", m.Name())
 	}
 
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err = dec.Decode(dm); err != nil {
+	counters := &DumpedCounters{}
+	refs := make(map[string]int)
+	dm, err := loadEntries(r, opts, func(e *DumpedEntry) error { return m.loadEntry(e, counters, refs) })
+	if err != nil {
 		return err
 	}
 	format, err := json.MarshalIndent(dm.Setting, "", "")
 	if err != nil {
 		return err
 	}
-
-	progress := utils.NewProgress(false, false)
-	bar := progress.AddCountBar("Collected entries", 1) // with root
-	showProgress := func(totalIncr, currentIncr int64) {
-		bar.IncrTotal(totalIncr)
-		bar.IncrInt64(currentIncr)
-	}
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, showProgress); err != nil {
-		return err
-	}
-	if dm.Trash != nil {
-		bar.IncrTotal(1)
-		if err = collectEntry(dm.Trash, entries, showProgress); err != nil {
-			return err
-		}
-	}
-	bar.Done()
-
-	counters := &DumpedCounters{}
-	refs := make(map[string]int)
-	bar = progress.AddCountBar("Loaded entries", int64(len(entries)))
-	maxNum := 100
-	pool := make(chan struct{}, maxNum)
-	errCh := make(chan error, 100)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	for _, entry := range entries {
-		select {
-		case err = <-errCh:
-			return err
-		default:
-		}
-		pool <- struct{}{}
-		wg.Add(1)
-		go func(entry *DumpedEntry) {
-			defer func() {
-				wg.Done()
-				bar.Increment()
-				<-pool
-			}()
-			if err = m.loadEntry(entry, counters, refs); err != nil {
-				errCh <- err
-			}
-		}(entry)
-	}
-
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case err = <-errCh:
-		return err
-	case <-done:
-	}
-	progress.Done()
+	// the inode numbers not in the dump could be reused by other files after loaded
+	counters.Generation = dm.Counters.Generation + 1
 	logger.Infof("Dumped counters: %+v", *dm.Counters)
 	logger.Infof("Loaded counters: %+v", *counters)
 
 	p := m.rdb.Pipeline()
-	p.Set(ctx, "setting", format, 0)
+	p.Set(ctx, m.prefix+"setting", format, 0)
 	cs := make(map[string]interface{})
-	cs[usedSpace] = counters.UsedSpace
-	cs[totalInodes] = counters.UsedInodes
-	cs["nextinode"] = counters.NextInode
-	cs["nextchunk"] = counters.NextChunk
-	cs["nextsession"] = counters.NextSession
-	cs["nextTrash"] = counters.NextTrash
+	cs[m.prefix+usedSpace] = counters.UsedSpace
+	cs[m.prefix+totalInodes] = counters.UsedInodes
+	cs[m.prefix+"nextinode"] = counters.NextInode
+	cs[m.prefix+"nextchunk"] = counters.NextChunk
+	cs[m.prefix+"nextsession"] = counters.NextSession
+	cs[m.prefix+"nextTrash"] = counters.NextTrash
+	cs[m.prefix+"generation"] = counters.Generation
 	p.MSet(ctx, cs)
 	if len(dm.DelFiles) > 0 {
 		zs := make([]*redis.Z, 0, len(dm.DelFiles))
@@ -3041,7 +4113,7 @@ func (m *redisMeta) LoadMeta(r io.Reader) error {
 				Member: m.toDelete(d.Inode, d.Length),
 			})
 		}
-		p.ZAdd(ctx, delfiles, zs...)
+		p.ZAdd(ctx, m.prefix+delfiles, zs...)
 	}
 	slices := make(map[string]interface{})
 	for k, v := range refs {
@@ -3050,7 +4122,7 @@ func (m *redisMeta) LoadMeta(r io.Reader) error {
 		}
 	}
 	if len(slices) > 0 {
-		p.HSet(ctx, sliceRefs, slices)
+		p.HSet(ctx, m.prefix+sliceRefs, slices)
 	}
 	_, err = p.Exec(ctx)
 	return err
@@ -0,0 +1,591 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// brokerCmd is sent by the clients right after connected to make sure
+// that the broker is serving the same Redis database.
+const brokerCmd = "juicefs-broker"
+
+// brokerHeartbeat is sent by the clients to refresh their sessions, the broker
+// refreshes the sessions of all the clients in one command every second.
+const brokerHeartbeat = "juicefs-heartbeat"
+
+// commands that change the state of a connection or block it
+var brokerUnsupported = map[string]bool{
+	"AUTH": true, "SELECT": true, "HELLO": true, "SWAPDB": true, "MONITOR": true,
+	"PSUBSCRIBE": true, "PUNSUBSCRIBE": true, "BLPOP": true, "BRPOP": true, "BRPOPLPUSH": true,
+	"BZPOPMIN": true, "BZPOPMAX": true, "BLMOVE": true, "CLIENT": true, "WAIT": true,
+}
+
+func brokerID(opt *redis.Options) string {
+	return opt.Addr + "/" + strconv.Itoa(opt.DB)
+}
+
+type brokerConn struct {
+	net.Conn
+	r    *bufio.Reader
+	used time.Time
+}
+
+// send sends a command without reading the reply.
+func (c *brokerConn) send(args ...string) error {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&req, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err := c.Write(req.Bytes())
+	return err
+}
+
+func (c *brokerConn) call(args ...string) error {
+	if err := c.send(args...); err != nil {
+		return err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	reply, err := readValue(c.r, nil)
+	if err != nil {
+		return err
+	}
+	if reply[0] == '-' {
+		return errors.New(string(reply[1 : len(reply)-2]))
+	}
+	return nil
+}
+
+// RedisBroker multiplexes the connections from many clients on the same host
+// onto a small pool of connections to Redis. A connection is borrowed for a
+// single command, or kept by a client from WATCH/MULTI until EXEC/DISCARD/UNWATCH.
+// The heartbeats of the clients are also batched into one command, and the
+// channels subscribed by them are received through one more connection.
+type RedisBroker struct {
+	opt    *redis.Options
+	id     string
+	tokens chan struct{}
+	mu     sync.Mutex
+	idle   []*brokerConn
+	beatMu sync.Mutex
+	beats  *brokerBeats
+	subMu  sync.Mutex
+	subs   map[string]map[*brokerSub]bool // channel -> clients subscribing it
+	subUp  *brokerConn                    // the connection subscribing all the channels in subs
+}
+
+// brokerSub is a client which subscribed some channels.
+type brokerSub struct {
+	sync.Mutex // protects w, which is written by the broker and the client
+	cn         net.Conn
+	w          *bufio.Writer
+	channels   map[string]bool
+}
+
+// forward sends a message to the client, the slow ones are disconnected.
+func (s *brokerSub) forward(msg []byte) {
+	s.Lock()
+	defer s.Unlock()
+	_ = s.cn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err := s.w.Write(msg)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	_ = s.cn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		logger.Warnf("forward message to %s: %s", s.cn.RemoteAddr(), err)
+		_ = s.cn.Close() // the client will subscribe again after reconnected
+	}
+}
+
+// brokerBeats are the sessions to refresh in the next batch.
+type brokerBeats struct {
+	sessions map[string][]string // key of sessions -> sids
+	done     chan struct{}
+	err      error
+}
+
+// NewRedisBroker creates a broker for the Redis database in url, using at most conns connections.
+func NewRedisBroker(url string, conns int) (*RedisBroker, error) {
+	if !strings.Contains(url, "://") {
+		url = "redis://" + url
+	}
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", url, err)
+	}
+	if strings.Contains(opt.Addr, ",") {
+		return nil, fmt.Errorf("redis sentinel is not supported by broker")
+	}
+	if opt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
+		opt.Password = os.Getenv("REDIS_PASSWORD")
+	}
+	if conns <= 0 {
+		conns = 1
+	}
+	b := &RedisBroker{opt: opt, id: brokerID(opt), tokens: make(chan struct{}, conns)}
+	for i := 0; i < conns; i++ {
+		b.tokens <- struct{}{}
+	}
+	c, err := b.acquire()
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %s", opt.Addr, err)
+	}
+	b.release(c, false)
+	return b, nil
+}
+
+func (b *RedisBroker) dial() (*brokerConn, error) {
+	d := &net.Dialer{Timeout: time.Second * 5, KeepAlive: time.Minute * 5}
+	var conn net.Conn
+	var err error
+	if b.opt.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(d, b.opt.Network, b.opt.Addr, b.opt.TLSConfig)
+	} else {
+		conn, err = d.Dial(b.opt.Network, b.opt.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &brokerConn{Conn: conn, r: bufio.NewReader(conn)}
+	if b.opt.Password != "" {
+		if b.opt.Username != "" {
+			err = c.call("AUTH", b.opt.Username, b.opt.Password)
+		} else {
+			err = c.call("AUTH", b.opt.Password)
+		}
+	}
+	if err == nil && b.opt.DB > 0 {
+		err = c.call("SELECT", strconv.Itoa(b.opt.DB))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (b *RedisBroker) acquire() (*brokerConn, error) {
+	select {
+	case <-b.tokens:
+	case <-time.After(time.Minute):
+		return nil, fmt.Errorf("no available connection in 1 minute")
+	}
+	b.mu.Lock()
+	if n := len(b.idle); n > 0 {
+		c := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.mu.Unlock()
+		return c, nil
+	}
+	b.mu.Unlock()
+	c, err := b.dial()
+	if err != nil {
+		b.tokens <- struct{}{}
+	}
+	return c, err
+}
+
+func (b *RedisBroker) release(c *brokerConn, broken bool) {
+	if broken {
+		_ = c.Close()
+	} else {
+		c.used = time.Now()
+		b.putIdle(c)
+	}
+	b.tokens <- struct{}{}
+}
+
+func (b *RedisBroker) putIdle(c *brokerConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.idle) < cap(b.tokens) {
+		b.idle = append(b.idle, c)
+	} else {
+		_ = c.Close()
+	}
+}
+
+// heartbeat pings the idle connections, so broken ones are dropped before used by clients.
+func (b *RedisBroker) heartbeat(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		b.mu.Lock()
+		var stale []*brokerConn
+		var i int
+		for _, c := range b.idle {
+			if time.Since(c.used) > interval {
+				stale = append(stale, c)
+			} else {
+				b.idle[i] = c
+				i++
+			}
+		}
+		b.idle = b.idle[:i]
+		b.mu.Unlock()
+		for _, c := range stale {
+			if err := c.call("PING"); err != nil {
+				logger.Warnf("ping %s: %s", b.opt.Addr, err)
+				_ = c.Close()
+			} else {
+				c.used = time.Now()
+				b.putIdle(c)
+			}
+		}
+	}
+}
+
+// beat queues the session of a client into the next batch, and waits for the batch to finish.
+func (b *RedisBroker) beat(key, sid string) error {
+	b.beatMu.Lock()
+	if b.beats == nil {
+		b.beats = &brokerBeats{sessions: make(map[string][]string), done: make(chan struct{})}
+	}
+	beats := b.beats
+	beats.sessions[key] = append(beats.sessions[key], sid)
+	b.beatMu.Unlock()
+	<-beats.done
+	return beats.err
+}
+
+// refreshSessions refreshes the sessions queued by beat in every interval.
+func (b *RedisBroker) refreshSessions(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		b.beatMu.Lock()
+		beats := b.beats
+		b.beats = nil
+		b.beatMu.Unlock()
+		if beats == nil {
+			continue
+		}
+		c, err := b.acquire()
+		if err == nil {
+			now := strconv.FormatInt(time.Now().Unix(), 10)
+			for key, sids := range beats.sessions {
+				args := []string{"ZADD", key}
+				for _, sid := range sids {
+					args = append(args, now, sid)
+				}
+				if err = c.call(args...); err != nil {
+					logger.Warnf("refresh %d sessions in %s: %s", len(sids), key, err)
+					break
+				}
+			}
+			b.release(c, err != nil)
+		}
+		beats.err = err
+		close(beats.done)
+	}
+}
+
+// subscribe adds a channel subscribed by s, and returns the number of channels subscribed by it.
+func (b *RedisBroker) subscribe(s *brokerSub, channel string) int {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[string]map[*brokerSub]bool)
+		go b.receive()
+	}
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[*brokerSub]bool)
+		if b.subUp != nil {
+			_ = b.subUp.send("SUBSCRIBE", channel) // receive will reconnect if it fails
+		}
+	}
+	b.subs[channel][s] = true
+	s.channels[channel] = true
+	return len(s.channels)
+}
+
+// unsubscribe removes a channel subscribed by s, and returns the number of channels subscribed by it.
+func (b *RedisBroker) unsubscribe(s *brokerSub, channel string) int {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	delete(s.channels, channel)
+	if subs := b.subs[channel]; subs != nil {
+		delete(subs, s)
+		if len(subs) == 0 {
+			delete(b.subs, channel)
+			if b.subUp != nil {
+				_ = b.subUp.send("UNSUBSCRIBE", channel)
+			}
+		}
+	}
+	return len(s.channels)
+}
+
+// receive subscribes the channels of the clients from Redis, and forwards the messages to them.
+func (b *RedisBroker) receive() {
+	for {
+		c, err := b.dial()
+		if err != nil {
+			logger.Warnf("connect to %s for subscribing: %s", b.opt.Addr, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		_ = c.SetDeadline(time.Time{})
+		b.subMu.Lock()
+		b.subUp = c
+		for channel := range b.subs {
+			if err = c.send("SUBSCRIBE", channel); err != nil {
+				break
+			}
+		}
+		b.subMu.Unlock()
+		var msg []byte
+		for err == nil {
+			if msg, err = readValue(c.r, msg[:0]); err != nil {
+				break
+			}
+			// the confirmations of SUBSCRIBE and UNSUBSCRIBE are ignored, they are replied by the broker
+			if args := parseArgs(msg); len(args) == 3 && string(args[0]) == "message" {
+				b.subMu.Lock()
+				for s := range b.subs[string(args[1])] {
+					s.forward(msg)
+				}
+				b.subMu.Unlock()
+			}
+		}
+		// the messages are lost until reconnected, the same as the clients connecting Redis directly
+		logger.Warnf("receive messages from %s: %s", b.opt.Addr, err)
+		b.subMu.Lock()
+		b.subUp = nil
+		b.subMu.Unlock()
+		_ = c.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// Serve accepts connections from clients on l, until it's closed.
+func (b *RedisBroker) Serve(l net.Listener) error {
+	go b.heartbeat(time.Second * 30)
+	go b.refreshSessions(time.Second)
+	for {
+		cn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go b.handle(cn)
+	}
+}
+
+func (b *RedisBroker) handle(cn net.Conn) {
+	defer cn.Close()
+	var pinned *brokerConn
+	defer func() {
+		if pinned != nil {
+			b.release(pinned, true)
+		}
+	}()
+	r := bufio.NewReader(cn)
+	w := bufio.NewWriter(cn)
+	var sub *brokerSub
+	defer func() {
+		if sub != nil {
+			for channel := range sub.channels {
+				b.unsubscribe(sub, channel)
+			}
+		}
+	}()
+	var req, reply []byte
+	var err error
+	for {
+		if req, err = readValue(r, req[:0]); err != nil {
+			if err != io.EOF {
+				logger.Debugf("read request: %s", err)
+			}
+			return
+		}
+		if req[0] != '*' {
+			_, _ = w.WriteString("-ERR invalid request\r\n")
+			_ = w.Flush()
+			return
+		}
+		args := parseArgs(req)
+		name := strings.ToUpper(string(args[0]))
+		switch {
+		case name == "QUIT":
+			_, _ = w.WriteString("+OK\r\n")
+			_ = w.Flush()
+			return
+		case name == strings.ToUpper(brokerCmd):
+			if len(args) == 2 && string(args[1]) == b.id {
+				reply = append(reply[:0], "+OK\r\n"...)
+			} else {
+				reply = append(reply[:0], fmt.Sprintf("-ERR broker is serving %s\r\n", b.id)...)
+			}
+		case name == strings.ToUpper(brokerHeartbeat):
+			if len(args) != 3 {
+				reply = append(reply[:0], "-ERR wrong number of arguments\r\n"...)
+			} else if err = b.beat(string(args[1]), string(args[2])); err != nil {
+				reply = append(reply[:0], fmt.Sprintf("-ERR broker: %s\r\n", err)...)
+			} else {
+				reply = append(reply[:0], "+OK\r\n"...)
+			}
+		case name == "SUBSCRIBE" || name == "UNSUBSCRIBE":
+			if sub == nil {
+				sub = &brokerSub{cn: cn, w: w, channels: make(map[string]bool)}
+			}
+			channels := args[1:]
+			if name == "UNSUBSCRIBE" && len(channels) == 0 {
+				for channel := range sub.channels {
+					channels = append(channels, []byte(channel))
+				}
+			}
+			kind := strings.ToLower(name)
+			reply = reply[:0]
+			for _, channel := range channels {
+				var n int
+				if name == "SUBSCRIBE" {
+					n = b.subscribe(sub, string(channel))
+				} else {
+					n = b.unsubscribe(sub, string(channel))
+				}
+				reply = append(reply, fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(kind), kind, len(channel), channel, n)...)
+			}
+			if len(channels) == 0 {
+				reply = append(reply, fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$-1\r\n:0\r\n", len(kind), kind)...)
+			}
+		case sub != nil && name == "PING":
+			var payload []byte
+			if len(args) > 1 {
+				payload = args[1]
+			}
+			reply = append(reply[:0], fmt.Sprintf("*2\r\n$4\r\npong\r\n$%d\r\n%s\r\n", len(payload), payload)...)
+		case sub != nil:
+			reply = append(reply[:0], fmt.Sprintf("-ERR %s is not allowed after SUBSCRIBE\r\n", name)...)
+		case brokerUnsupported[name]:
+			reply = append(reply[:0], fmt.Sprintf("-ERR %s is not supported by broker\r\n", name)...)
+		default:
+			up := pinned
+			if up == nil {
+				if up, err = b.acquire(); err != nil {
+					reply = append(reply[:0], fmt.Sprintf("-ERR broker: %s\r\n", err)...)
+					break
+				}
+			}
+			_ = up.SetDeadline(time.Now().Add(time.Minute))
+			if _, err = up.Write(req); err == nil {
+				reply, err = readValue(up.r, reply[:0])
+			}
+			if err != nil {
+				logger.Warnf("forward %s to %s: %s", name, b.opt.Addr, err)
+				pinned = nil
+				b.release(up, true)
+				return
+			}
+			switch name {
+			case "WATCH", "MULTI":
+				pinned = up
+			case "EXEC", "DISCARD", "UNWATCH":
+				pinned = nil
+			}
+			if pinned == nil {
+				b.release(up, false)
+			}
+		}
+		if sub != nil {
+			sub.Lock()
+		}
+		_, err = w.Write(reply)
+		if err == nil && r.Buffered() == 0 {
+			err = w.Flush()
+		}
+		if sub != nil {
+			sub.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readValue reads a RESP value from r and appends it into buf.
+func readValue(r *bufio.Reader, buf []byte) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return buf, fmt.Errorf("invalid line: %q", line)
+	}
+	buf = append(buf, line...)
+	switch line[0] {
+	case '+', '-', ':':
+		return buf, nil
+	case '$', '*':
+		n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+		if err != nil {
+			return buf, fmt.Errorf("invalid length: %q", line)
+		}
+		if n < 0 {
+			return buf, nil
+		}
+		if line[0] == '$' {
+			off := len(buf)
+			buf = append(buf, make([]byte, n+2)...)
+			_, err = io.ReadFull(r, buf[off:])
+			return buf, err
+		}
+		for i := 0; i < n && err == nil; i++ {
+			buf, err = readValue(r, buf)
+		}
+		return buf, err
+	default:
+		return buf, fmt.Errorf("invalid type: %q", line)
+	}
+}
+
+// parseArgs returns the arguments of a request read by readValue.
+func parseArgs(req []byte) [][]byte {
+	var args [][]byte
+	p := bytes.IndexByte(req, '\n') + 1
+	for p < len(req) && req[p] == '$' {
+		e := p + bytes.IndexByte(req[p:], '\n')
+		n, _ := strconv.Atoi(string(req[p+1 : e-1]))
+		if n < 0 {
+			args = append(args, nil)
+			p = e + 1
+			continue
+		}
+		args = append(args, req[e+1:e+1+n])
+		p = e + 1 + n + 2
+	}
+	if len(args) == 0 {
+		args = append(args, nil)
+	}
+	return args
+}
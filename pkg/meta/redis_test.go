@@ -18,14 +18,24 @@
 package meta
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/juicedata/juicefs/pkg/utils"
 )
 
@@ -42,6 +52,245 @@ func TestRedisClient(t *testing.T) {
 	testMeta(t, m)
 }
 
+func TestSentinelAddr(t *testing.T) {
+	cases := map[string]string{
+		"127.0.0.1:6379/10":                          "127.0.0.1:6379/10",
+		"127.0.0.1:6379":                             "127.0.0.1:6379",
+		"mymaster,h1,h2:26379/1":                     "mymaster,h1,h2:26379/1",
+		"h1,h2,h3:26379/mymaster/1":                  "mymaster,h1,h2,h3:26379/1",
+		"h1:26379/mymaster":                          "mymaster,h1:26379",
+		":pass@h1,h2/mymaster/2":                     ":pass@mymaster,h1,h2/2",
+		"user:p@ss@h1,h2/mymaster/2?dial_timeout=3s": "user:p@ss@mymaster,h1,h2/2?dial_timeout=3s",
+		"127.0.0.1:6379/10?dial_timeout=3s":          "127.0.0.1:6379/10?dial_timeout=3s",
+		"h1/mymaster?dial_timeout=3s":                "mymaster,h1?dial_timeout=3s",
+	}
+	for addr, expected := range cases {
+		if got := sentinelAddr(addr); got != expected {
+			t.Fatalf("sentinel address of %s: %s != %s", addr, got, expected)
+		}
+	}
+}
+
+func TestRedisClusterClient(t *testing.T) {
+	var conf = Config{MaxDeletes: 1}
+	m, err := newRedisMeta("redis+cluster", "127.0.0.1:7000,127.0.0.1:7001,127.0.0.1:7002/2", &conf)
+	if err != nil || m.Name() != "redis" {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+
+	// all the keys should be in the same slot
+	rdb := m.(*redisMeta).rdb.(*redis.ClusterClient)
+	err = rdb.ForEachMaster(Background, func(ctx context.Context, c *redis.Client) error {
+		keys, err := c.Keys(ctx, "*").Result()
+		for _, k := range keys {
+			if !strings.HasPrefix(k, "{2}") {
+				t.Fatalf("key %s is not in the slot of the volume", k)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("list keys: %s", err)
+	}
+}
+
+func TestRedisBroker(t *testing.T) {
+	b, err := NewRedisBroker("redis://127.0.0.1:6379/10", 2)
+	if err != nil {
+		t.Fatalf("create broker: %s", err)
+	}
+	sock := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go b.Serve(l)
+
+	m, err := newRedisMeta("redis", "127.0.0.1:6379/11", &Config{Broker: sock})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.(*redisMeta).rdb.Ping(Background).Err(); err == nil {
+		t.Fatalf("broker should refuse clients of another database")
+	}
+	m, err = newRedisMeta("redis", "127.0.0.1:6379/10", &Config{MaxDeletes: 1, Broker: sock})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
+
+func TestRedisWrites(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	var h redisWrites
+	ctx, _ := h.BeforeProcess(c, redis.NewStringCmd(c, "get", "k"))
+	if ctx.Err() == nil {
+		t.Fatalf("reads should be aborted")
+	}
+	ctx, _ = h.BeforeProcess(c, redis.NewStatusCmd(c, "set", "k", "v"))
+	if ctx.Err() != nil || ctx.Done() != nil {
+		t.Fatalf("writes should not be aborted")
+	}
+	ctx, _ = h.BeforeProcessPipeline(c, []redis.Cmder{redis.NewStringCmd(c, "hget", "k", "f"), redis.NewIntCmd(c, "hincrby", "k", "f", 1)})
+	if ctx.Err() != nil {
+		t.Fatalf("pipelines with writes should not be aborted")
+	}
+}
+
+// fakeRedis serves the Redis protocol with handle, and returns its address.
+func fakeRedis(t *testing.T, handle func(cn net.Conn, args []string)) string {
+	srv, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	go func() {
+		for {
+			cn, err := srv.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer cn.Close()
+				r := bufio.NewReader(cn)
+				for {
+					req, err := readValue(r, nil)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, a := range parseArgs(req) {
+						args = append(args, string(a))
+					}
+					handle(cn, args)
+				}
+			}()
+		}
+	}()
+	return srv.Addr().String()
+}
+
+// serveBroker starts a broker for the Redis at addr, and returns its socket.
+func serveBroker(t *testing.T, addr string) string {
+	b, err := NewRedisBroker("redis://"+addr+"/3", 2)
+	if err != nil {
+		t.Fatalf("create broker: %s", err)
+	}
+	sock := filepath.Join(t.TempDir(), "broker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go b.Serve(l)
+	return sock
+}
+
+func TestBrokerHeartbeat(t *testing.T) {
+	// a fake Redis that records ZADD and replies OK to all the commands
+	var mu sync.Mutex
+	var zadds [][]string
+	sock := serveBroker(t, fakeRedis(t, func(cn net.Conn, args []string) {
+		if strings.ToUpper(args[0]) == "ZADD" {
+			mu.Lock()
+			zadds = append(zadds, args)
+			mu.Unlock()
+		}
+		_, _ = cn.Write([]byte("+OK\r\n"))
+	}))
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 5; i++ {
+		wg.Add(1)
+		go func(sid int) {
+			defer wg.Done()
+			rdb := redis.NewClient(&redis.Options{Network: "unix", Addr: sock})
+			defer rdb.Close()
+			if err := rdb.Do(Background, brokerHeartbeat, "allSessions", strconv.Itoa(sid)).Err(); err != nil {
+				t.Errorf("heartbeat of session %d: %s", sid, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	var sids []string
+	for _, args := range zadds {
+		if args[1] != "allSessions" {
+			t.Fatalf("unexpected key: %v", args)
+		}
+		for i := 3; i < len(args); i += 2 {
+			sids = append(sids, args[i])
+		}
+	}
+	sort.Strings(sids)
+	if len(zadds) >= 5 || strings.Join(sids, ",") != "1,2,3,4,5" {
+		t.Fatalf("heartbeats should be batched: %v", zadds)
+	}
+}
+
+func TestBrokerPubSub(t *testing.T) {
+	// a fake Redis supporting SUBSCRIBE and PUBLISH only
+	var mu sync.Mutex
+	subs := make(map[string][]net.Conn)
+	var upstreams int
+	sock := serveBroker(t, fakeRedis(t, func(cn net.Conn, args []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "SUBSCRIBE":
+			upstreams++
+			subs[args[1]] = append(subs[args[1]], cn)
+			fmt.Fprintf(cn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+		case "PUBLISH":
+			for _, c := range subs[args[1]] {
+				fmt.Fprintf(c, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(args[1]), args[1], len(args[2]), args[2])
+			}
+			fmt.Fprintf(cn, ":%d\r\n", len(subs[args[1]]))
+		default:
+			_, _ = cn.Write([]byte("+OK\r\n"))
+		}
+	}))
+
+	var clients []*redis.Client
+	var pubsubs []*redis.PubSub
+	for i := 0; i < 3; i++ {
+		rdb := redis.NewClient(&redis.Options{Network: "unix", Addr: sock})
+		defer rdb.Close()
+		clients = append(clients, rdb)
+		sub := rdb.Subscribe(Background, "invalidate")
+		defer sub.Close()
+		if _, err := sub.Receive(Background); err != nil {
+			t.Fatalf("subscribe: %s", err)
+		}
+		pubsubs = append(pubsubs, sub)
+	}
+	if err := clients[0].Publish(Background, "invalidate", "hello").Err(); err != nil {
+		t.Fatalf("publish: %s", err)
+	}
+	for i, sub := range pubsubs {
+		select {
+		case msg := <-sub.Channel():
+			if msg.Channel != "invalidate" || msg.Payload != "hello" {
+				t.Fatalf("client %d received %+v", i, msg)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("client %d received no message", i)
+		}
+	}
+	if err := pubsubs[0].Ping(Background); err != nil {
+		t.Fatalf("ping after subscribed: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if upstreams != 1 {
+		t.Fatalf("channel is subscribed %d times from Redis", upstreams)
+	}
+}
+
 func testMeta(t *testing.T, m Meta) {
 	if err := m.Reset(); err != nil {
 		t.Fatalf("reset meta: %s", err)
@@ -56,15 +305,36 @@ func testMeta(t *testing.T, m Meta) {
 		base = &m.baseMeta
 	}
 	testMetaClient(t, m)
+	testParents(t, m)
 	testTruncateAndDelete(t, m)
 	testTrash(t, m)
+	testTrashQuota(t, m, base)
 	testRemove(t, m)
+	testBatchUnlink(t, m)
+	testMknodBatch(t, m)
 	testStickyBit(t, m)
 	testLocks(t, m)
 	testConcurrentWrite(t, m)
+	testConcurrentRename(t, m, base)
 	testCompaction(t, m)
 	testCopyFileRange(t, m)
-	testCloseSession(t, m)
+	testTags(t, m)
+	testDefaultXattrs(t, m)
+	testFind(t, m)
+	testReaddirAt(t, m)
+	testQuota(t, m, base)
+	testDeferredDelete(t, m, base)
+	testKillSession(t, m, base)
+	testFlags(t, m)
+	testScrub(t, m, base)
+	testCheckNamespace(t, m)
+	testAtime(t, m, base)
+	testChangelog(t, m, base)
+	testMetaCache(t, m, base)
+	testGCStats(t, m)
+	testClone(t, m)
+	testReserve(t, m)
+	testCloseSession(t, m, base)
 	base.conf.CaseInsensi = true
 	testCaseIncensi(t, m)
 	base.conf.OpenCache = time.Second
@@ -95,10 +365,13 @@ func testMetaClient(t *testing.T, m Meta) {
 	if format.Name != "test" {
 		t.Fatalf("load got volume name %s, expected %s", format.Name, "test")
 	}
+	if g := m.Generation(); g != 1 {
+		t.Fatalf("generation of a new volume: %d", g)
+	}
 	if err = m.NewSession(); err != nil {
 		t.Fatalf("new session: %s", err)
 	}
-	ses, err := m.ListSessions()
+	ses, err := m.ListSessions(nil)
 	if err != nil || len(ses) != 1 {
 		t.Fatalf("list sessions %+v: %s", ses, err)
 	}
@@ -116,7 +389,26 @@ func testMetaClient(t *testing.T, m Meta) {
 			t.Fatalf("my sid %d != registered sid %d", r.sid, ses[0].Sid)
 		}
 	}
-	go m.CleanStaleSessions()
+	host, _ := os.Hostname()
+	if ses[0].Hostname != host || ses[0].IP != localIP() {
+		t.Fatalf("session info: %+v", ses[0].SessionInfo)
+	}
+	if ip := ses[0].IP; ip != "" {
+		if ses, err = m.ListSessions(&SessionFilter{Hostname: ip}); err != nil || len(ses) != 1 {
+			t.Fatalf("list sessions of IP %s %+v: %s", ip, ses, err)
+		}
+	}
+	if ses, err = m.ListSessions(&SessionFilter{Hostname: host + "-other"}); err != nil || len(ses) != 0 {
+		t.Fatalf("list sessions of another host %+v: %s", ses, err)
+	}
+	if ses, err = m.ListSessions(&SessionFilter{Hostname: host, Idle: time.Hour}); err != nil || len(ses) != 0 {
+		t.Fatalf("list idle sessions %+v: %s", ses, err)
+	}
+	m.CleanStaleSessions(&SessionFilter{Hostname: host + "-other", Idle: time.Nanosecond})
+	if ses, err = m.ListSessions(nil); err != nil || len(ses) != 1 {
+		t.Fatalf("session of this host should not be cleaned %+v: %s", ses, err)
+	}
+	go m.CleanStaleSessions(nil)
 
 	var parent, inode, dummyInode Ino
 	if st := m.Mkdir(ctx, 1, "d", 0640, 022, 0, &parent, attr); st != 0 {
@@ -257,8 +549,23 @@ func testMetaClient(t *testing.T, m Meta) {
 	} else if string(entries[0].Name) != "." || string(entries[1].Name) != ".." || string(entries[2].Name) != "f" {
 		t.Fatalf("entries: %+v", entries)
 	}
-	if st := m.Rename(ctx, parent, "f", 1, "f2", RenameWhiteout, &inode, attr); st != syscall.ENOTSUP {
-		t.Fatalf("rename d/f -> f2: %s", st)
+	if st := m.Rename(ctx, parent, "f", 1, "f2", RenameWhiteout, &inode, attr); st != 0 {
+		t.Fatalf("rename d/f -> f2 with whiteout: %s", st)
+	}
+	var wino Ino
+	if st := m.Lookup(ctx, parent, "f", &wino, attr); st != 0 {
+		t.Fatalf("lookup whiteout d/f: %s", st)
+	} else if wino == inode || attr.Typ != TypeCharDev || attr.Rdev != 0 || attr.Nlink != 1 {
+		t.Fatalf("whiteout d/f: inode %d attr %+v", wino, attr)
+	}
+	if st := m.Rename(ctx, 1, "f2", parent, "f", RenameNoReplace|RenameWhiteout, &inode, attr); st != syscall.EEXIST {
+		t.Fatalf("rename f2 -> d/f with whiteout: %s", st)
+	}
+	if st := m.Unlink(ctx, parent, "f"); st != 0 {
+		t.Fatalf("unlink whiteout d/f: %s", st)
+	}
+	if st := m.Rename(ctx, 1, "f2", parent, "f", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename f2 -> d/f: %s", st)
 	}
 	if st := m.Rename(ctx, parent, "f", 1, "f2", 0, &inode, attr); st != 0 {
 		t.Fatalf("rename d/f -> f2: %s", st)
@@ -420,6 +727,19 @@ func testMetaClient(t *testing.T, m Meta) {
 	if len(chunks) != 3 || chunks[1].Chunkid != 0 || chunks[1].Len != 50 || chunks[2].Chunkid != chunkid || chunks[2].Len != 50 {
 		t.Fatalf("chunks: %v", chunks)
 	}
+	if st := m.Fallocate(ctx, inode, fallocPunchHole|fallocKeepSize, 300, 50); st != 0 {
+		t.Fatalf("punch hole beyond the end: %s", st)
+	}
+	// the chunk is released when it's covered by the hole entirely
+	if st := m.Fallocate(ctx, inode, fallocZeroRange|fallocKeepSize, 0, 300); st != 0 {
+		t.Fatalf("zero range: %s", st)
+	}
+	if st := m.Read(ctx, inode, 0, &chunks); st != 0 || len(chunks) != 0 {
+		t.Fatalf("read zeroed chunk: %s %v", st, chunks)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 200 {
+		t.Fatalf("length after zero range: %s %d", st, attr.Length)
+	}
 
 	// xattr
 	if st := m.SetXattr(ctx, inode, "a", []byte("v"), XattrCreateOrReplace); st != 0 {
@@ -477,7 +797,7 @@ func testMetaClient(t *testing.T, m Meta) {
 		t.Fatalf("total space %d, iavail %d", totalspace, iavail)
 	}
 	var summary Summary
-	if st := GetSummary(m, ctx, parent, &summary, false); st != 0 {
+	if st := m.GetSummary(ctx, parent, &summary, false); st != 0 {
 		t.Fatalf("summary: %s", st)
 	}
 	expected := Summary{Length: 0, Size: 4096, Files: 0, Dirs: 1}
@@ -485,14 +805,14 @@ func testMetaClient(t *testing.T, m Meta) {
 		t.Fatalf("summary %+v not equal to expected: %+v", summary, expected)
 	}
 	summary = Summary{}
-	if st := GetSummary(m, ctx, 1, &summary, true); st != 0 {
+	if st := m.GetSummary(ctx, 1, &summary, true); st != 0 {
 		t.Fatalf("summary: %s", st)
 	}
 	expected = Summary{Length: 402, Size: 20480, Files: 3, Dirs: 2}
 	if summary != expected {
 		t.Fatalf("summary %+v not equal to expected: %+v", summary, expected)
 	}
-	if st := GetSummary(m, ctx, inode, &summary, true); st != 0 {
+	if st := m.GetSummary(ctx, inode, &summary, true); st != 0 {
 		t.Fatalf("summary: %s", st)
 	}
 	expected = Summary{Length: 602, Size: 24576, Files: 4, Dirs: 2}
@@ -725,11 +1045,170 @@ func testRemove(t *testing.T, m Meta) {
 	} else if len(entries) != 4099 {
 		t.Fatalf("entries: %d", len(entries))
 	}
+	entries = entries[:0]
+	if st := m.Readdir(ctx, 1, 0, &entries); st != 0 {
+		t.Fatalf("readdir: %s", st)
+	}
+	if st := m.FillAttrs(ctx, entries[2:]); st != 0 {
+		t.Fatalf("fill attrs: %s", st)
+	}
+	for _, e := range entries[2:] {
+		if !e.Attr.Full || e.Attr.Typ == TypeFile && e.Attr.Mode != 0644 {
+			t.Fatalf("attr of %s is not filled: %+v", e.Name, e.Attr)
+		}
+	}
 	if st := Remove(m, ctx, 1, "d"); st != 0 {
 		t.Fatalf("rmr d: %s", st)
 	}
 }
 
+func testBatchUnlink(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var d, f0, f2, sub, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "bu", 0755, 022, 0, &d, attr); st != 0 {
+		t.Fatalf("mkdir bu: %s", st)
+	}
+	for i := 0; i < 4; i++ {
+		if st := m.Create(ctx, d, fmt.Sprintf("f%d", i), 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create f%d: %s", i, st)
+		}
+		_ = m.Close(ctx, inode)
+		switch i {
+		case 0:
+			f0 = inode
+		case 2:
+			f2 = inode
+		}
+	}
+	if st := m.Link(ctx, f0, d, "h0", attr); st != 0 {
+		t.Fatalf("link h0: %s", st)
+	}
+	if st := m.Link(ctx, f2, 1, "bu-h2", attr); st != 0 {
+		t.Fatalf("link bu-h2: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "bu-h2")
+	if st := m.Symlink(ctx, d, "s", "f1", &inode, attr); st != 0 {
+		t.Fatalf("symlink s: %s", st)
+	}
+	if st := m.Mkdir(ctx, d, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+	if st := m.SetAttr(ctx, f0+3, SetAttrFlag, 0, &Attr{Flags: FlagImmutable}); st != 0 {
+		t.Fatalf("set immutable flag of f3: %s", st)
+	}
+
+	names := []string{"f0", "f1", "none", "sub", "f1", "s", "h0", "f2", "f3"}
+	expected := []syscall.Errno{0, 0, syscall.ENOENT, syscall.EPERM, syscall.ENOENT, 0, 0, 0, syscall.EPERM}
+	sts := make([]syscall.Errno, len(names))
+	if st := m.UnlinkBatch(ctx, d, names, sts); st != 0 {
+		t.Fatalf("unlink batch: %s", st)
+	}
+	for i := range names {
+		if sts[i] != expected[i] {
+			t.Fatalf("unlink %s: expect %s, but got %s", names[i], expected[i], sts[i])
+		}
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, d, 0, &entries); st != 0 || len(entries) != 4 { // ., .., sub, f3
+		t.Fatalf("readdir bu: %s %d", st, len(entries))
+	}
+	if st := m.GetAttr(ctx, f0, attr); st != syscall.ENOENT {
+		t.Fatalf("f0 with both links removed: %s", st)
+	}
+	if st := m.GetAttr(ctx, f2, attr); st != 0 || attr.Nlink != 1 || attr.Parent != 1 {
+		t.Fatalf("f2 linked in root: %s %+v", st, attr)
+	}
+	if st := m.UnlinkBatch(ctx, d, names, sts[1:]); st != syscall.EINVAL {
+		t.Fatalf("unlink batch with short status: %s", st)
+	}
+	if st := m.SetAttr(ctx, f0+3, SetAttrFlag, 0, &Attr{}); st != 0 {
+		t.Fatalf("clear flags of f3: %s", st)
+	}
+
+	// more files than a batch
+	for i := 0; i < unlinkBatchSize+10; i++ {
+		if st := m.Create(ctx, sub, fmt.Sprintf("f%d", i), 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create sub/f%d: %s", i, st)
+		}
+		_ = m.Close(ctx, inode)
+	}
+	if st := m.Mkdir(ctx, sub, "d", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir sub/d: %s", st)
+	}
+	var count uint64
+	if st := m.Remove(ctx, 1, "bu", &count); st != 0 {
+		t.Fatalf("remove bu: %s", st)
+	}
+	if count != unlinkBatchSize+10+4 { // files, f3, d, sub and bu
+		t.Fatalf("expect %d entries removed, but got %d", unlinkBatchSize+10+4, count)
+	}
+	if st := m.Lookup(ctx, 1, "bu", &inode, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup bu: %s", st)
+	}
+}
+
+func testMknodBatch(t *testing.T, m Meta) {
+	ctx := Background
+	var d, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "mb", 0755, 022, 0, &d, attr); st != 0 {
+		t.Fatalf("mkdir mb: %s", st)
+	}
+	defer m.Remove(ctx, 1, "mb", nil)
+	if st := m.Mkdir(ctx, d, "d0", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir d0: %s", st)
+	}
+	names := []string{"d0", "d1", "d2", "d1"}
+	inodes := make([]Ino, len(names))
+	sts := make([]syscall.Errno, len(names))
+	if st := m.MknodBatch(ctx, d, names, TypeDirectory, 0750, 022, inodes, sts); st != 0 {
+		t.Fatalf("mknod batch: %s", st)
+	}
+	expected := []syscall.Errno{syscall.EEXIST, 0, 0, syscall.EEXIST}
+	for i := range names {
+		if sts[i] != expected[i] {
+			t.Fatalf("mkdir %s: expect %s, but got %s", names[i], expected[i], sts[i])
+		}
+	}
+	if inodes[0] != inode || inodes[3] != inodes[1] || inodes[1] == inodes[2] {
+		t.Fatalf("inodes: %v", inodes)
+	}
+	if st := m.GetAttr(ctx, inodes[1], attr); st != 0 || attr.Typ != TypeDirectory || attr.Mode != 0750 || attr.Nlink != 2 || attr.Parent != d {
+		t.Fatalf("getattr d1: %s %+v", st, attr)
+	}
+	if st := m.GetAttr(ctx, d, attr); st != 0 || attr.Nlink != 5 {
+		t.Fatalf("getattr mb: %s %+v", st, attr)
+	}
+	if st := m.MknodBatch(ctx, d, names, TypeSymlink, 0750, 022, inodes, sts); st != syscall.EINVAL {
+		t.Fatalf("mknod batch of symlinks: %s", st)
+	}
+
+	var paths []string
+	for i := 0; i < mknodBatchSize+10; i++ {
+		paths = append(paths, fmt.Sprintf("/mb/d1/s/f%d", i))
+	}
+	paths = append(paths, "mb/d0", "mb/d2/e/", "mb/d3/f", "mb/d3/f")
+	var stats TreeStats
+	if err := CreateTree(m, ctx, 1, paths, 0755, 0644, &stats); err != nil {
+		t.Fatalf("create tree: %s", err)
+	}
+	if stats.Dirs != 3 || stats.Files != mknodBatchSize+11 || stats.Existed != 4 { // d1/s, d2/e and d3 are created, mb, d0, d1 and d2 exist
+		t.Fatalf("create tree: %+v", stats)
+	}
+	if st := m.Lookup(ctx, inodes[1], "s", &inode, attr); st != 0 || attr.Typ != TypeDirectory {
+		t.Fatalf("lookup d1/s: %s %+v", st, attr)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, inode, 0, &entries); st != 0 || len(entries) != mknodBatchSize+12 {
+		t.Fatalf("readdir d1/s: %s %d", st, len(entries))
+	}
+	if err := CreateTree(m, ctx, 1, []string{"mb/d3/f/g"}, 0755, 0644, &stats); err == nil {
+		t.Fatalf("create a file in a file should fail")
+	}
+}
+
 func testCaseIncensi(t *testing.T, m Meta) {
 	_ = m.Init(Format{Name: "test"}, false)
 	ctx := Background
@@ -855,12 +1334,40 @@ func testCompaction(t *testing.T, m Meta) {
 
 	// TODO: check result if that's predictable
 	p, bar := utils.MockProgress()
-	if st := m.CompactAll(ctx, bar); st != 0 {
+	if st := m.CompactAll(ctx, 2, bar); st != 0 {
 		t.Fatalf("compactall: %s", st)
 	}
 	p.Done()
-	slices := make(map[Ino][]Slice)
-	if st := m.ListSlices(ctx, slices, false, nil); st != 0 {
+
+	// resume from an interrupted compaction
+	for i := 0; i < 5; i++ {
+		m.NewChunk(ctx, &chunkid)
+		_ = m.Write(ctx, inode, 2, uint32(i)<<16, Slice{Chunkid: chunkid, Size: 1 << 16, Len: 1 << 16})
+	}
+	_ = m.SetXattr(ctx, TrashInode, "compactProgress", []byte(strconv.FormatUint(uint64(inode)+1, 10)), XattrCreateOrReplace)
+	p, bar = utils.MockProgress()
+	if st := m.CompactAll(ctx, 2, bar); st != 0 {
+		t.Fatalf("compactall: %s", st)
+	}
+	p.Done()
+	cs = nil
+	if _ = m.Read(ctx, inode, 2, &cs); len(cs) != 5 {
+		t.Fatalf("chunk before progress should be skipped, but got %d slices", len(cs))
+	}
+	var progress []byte
+	if st := m.GetXattr(ctx, TrashInode, "compactProgress", &progress); st != 0 || string(progress) != "0" {
+		t.Fatalf("progress should be reset: %s %s", progress, st)
+	}
+	p, bar = utils.MockProgress()
+	if st := m.CompactAll(ctx, 2, bar); st != 0 {
+		t.Fatalf("compactall: %s", st)
+	}
+	p.Done()
+	cs = nil
+	if _ = m.Read(ctx, inode, 2, &cs); len(cs) != 1 {
+		t.Fatalf("chunk should be compacted, but got %d slices", len(cs))
+	}
+	if st := m.ListSlices(ctx, false, func(inode Ino, s Slice) error { return nil }); st != 0 {
 		t.Fatalf("list all slices: %s", st)
 	}
 
@@ -914,6 +1421,163 @@ func testConcurrentWrite(t *testing.T, m Meta) {
 	}
 }
 
+func testConcurrentRename(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var src, dst, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "rsrc", 0755, 022, 0, &src, attr); st != 0 {
+		t.Fatalf("mkdir rsrc: %s", st)
+	}
+	defer Remove(m, ctx, 1, "rsrc")
+	if st := m.Mkdir(ctx, 1, "rdst", 0755, 022, 0, &dst, attr); st != 0 {
+		t.Fatalf("mkdir rdst: %s", st)
+	}
+	defer Remove(m, ctx, 1, "rdst")
+	inodes := make(map[string]Ino)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("e%d", i)
+		var st syscall.Errno
+		if i%4 == 0 {
+			st = m.Mkdir(ctx, src, name, 0755, 022, 0, &inode, attr)
+		} else {
+			st = m.Create(ctx, src, name, 0644, 022, 0, &inode, attr)
+		}
+		if st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		inodes[name] = inode
+	}
+	var dattr Attr
+	if st := m.GetAttr(ctx, dst, &dattr); st != 0 {
+		t.Fatalf("getattr rdst: %s", st)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	var mu sync.Mutex
+	var errno syscall.Errno
+	var g sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		g.Add(1)
+		go func(name string) {
+			defer g.Done()
+			if st := m.Rename(ctx, src, name, dst, name, 0, nil, nil); st != 0 {
+				mu.Lock()
+				errno = st
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("e%d", i))
+	}
+	g.Wait()
+	if errno != 0 {
+		t.Fatalf("concurrent rename: %s", errno)
+	}
+	if st := m.GetAttr(ctx, src, attr); st != 0 || attr.Nlink != 2 {
+		t.Fatalf("nlink of rsrc: %s %d", st, attr.Nlink)
+	}
+	if st := m.GetAttr(ctx, dst, attr); st != 0 || attr.Nlink != 7 {
+		t.Fatalf("nlink of rdst: %s %d", st, attr.Nlink)
+	}
+	if attr.Mtime*1e9+int64(attr.Mtimensec) <= dattr.Mtime*1e9+int64(dattr.Mtimensec) {
+		t.Fatalf("mtime of rdst is not updated: %d.%d", attr.Mtime, attr.Mtimensec)
+	}
+	checkEntries := func(parent Ino, expected map[string]Ino) {
+		var entries []*Entry
+		if st := m.Readdir(ctx, parent, 0, &entries); st != 0 {
+			t.Fatalf("readdir %d: %s", parent, st)
+		}
+		found := make(map[string]Ino)
+		for _, e := range entries {
+			name := string(e.Name)
+			if name == "." || name == ".." {
+				continue
+			}
+			if _, ok := found[name]; ok {
+				t.Fatalf("duplicated entry %s in %d", name, parent)
+			}
+			found[name] = e.Inode
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Fatalf("entries of %d: %v, expected %v", parent, found, expected)
+		}
+	}
+	checkEntries(src, map[string]Ino{})
+	checkEntries(dst, inodes)
+
+	// rmdir of the destination and renames into it can't both succeed
+	var dst2 Ino
+	if st := m.Mkdir(ctx, 1, "rdst2", 0755, 022, 0, &dst2, attr); st != 0 {
+		t.Fatalf("mkdir rdst2: %s", st)
+	}
+	var rmdirSt syscall.Errno
+	moved := make(map[string]Ino)
+	for i := 0; i < 10; i++ {
+		g.Add(1)
+		go func(name string) {
+			defer g.Done()
+			st := m.Rename(ctx, dst, name, dst2, name, 0, nil, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			if st == 0 {
+				moved[name] = inodes[name]
+			} else if st != syscall.ENOENT {
+				errno = st
+			}
+		}(fmt.Sprintf("e%d", i))
+	}
+	g.Add(1)
+	go func() {
+		defer g.Done()
+		rmdirSt = m.Rmdir(ctx, 1, "rdst2")
+	}()
+	g.Wait()
+	if errno != 0 {
+		t.Fatalf("rename into rdst2: %s", errno)
+	}
+	if rmdirSt == 0 && len(moved) > 0 {
+		t.Fatalf("rdst2 is removed with %d entries moved into it", len(moved))
+	} else if rmdirSt != 0 && rmdirSt != syscall.ENOTEMPTY {
+		t.Fatalf("rmdir rdst2: %s", rmdirSt)
+	}
+	remained := make(map[string]Ino)
+	for name, ino := range inodes {
+		if _, ok := moved[name]; !ok {
+			remained[name] = ino
+		}
+	}
+	checkEntries(dst, remained)
+	if rmdirSt != 0 {
+		checkEntries(dst2, moved)
+		for name := range moved {
+			if st := m.Rename(ctx, dst2, name, dst, name, 0, nil, nil); st != 0 {
+				t.Fatalf("rename %s back: %s", name, st)
+			}
+		}
+		if st := m.Rmdir(ctx, 1, "rdst2"); st != 0 {
+			t.Fatalf("rmdir rdst2: %s", st)
+		}
+	}
+
+	if _, ok := m.(*redisMeta); ok {
+		return
+	}
+	base.conf.SkipDirMtime = time.Hour
+	defer func() { base.conf.SkipDirMtime = 0 }()
+	var sattr Attr
+	if st := m.GetAttr(ctx, src, &sattr); st != 0 {
+		t.Fatalf("getattr rsrc: %s", st)
+	}
+	if st := m.Rename(ctx, dst, "e0", src, "e0", 0, nil, nil); st != 0 {
+		t.Fatalf("rename e0: %s", st)
+	}
+	if st := m.GetAttr(ctx, src, attr); st != 0 || attr.Nlink != 3 {
+		t.Fatalf("nlink of rsrc: %s %d", st, attr.Nlink)
+	}
+	if attr.Mtime != sattr.Mtime || attr.Mtimensec != sattr.Mtimensec {
+		t.Fatalf("mtime of rsrc should not be updated: %d.%d != %d.%d", attr.Mtime, attr.Mtimensec, sattr.Mtime, sattr.Mtimensec)
+	}
+}
+
 func testTruncateAndDelete(t *testing.T, m Meta) {
 	m.OnMsg(DeleteChunk, func(args ...interface{}) error {
 		return nil
@@ -947,15 +1611,16 @@ func testTruncateAndDelete(t *testing.T, m Meta) {
 	if st := m.Truncate(ctx, inode, 0, (300<<20)+10, attr); st != 0 {
 		t.Fatalf("truncate file %s", st)
 	}
-	var total int64
-	slices := make(map[Ino][]Slice)
-	m.ListSlices(ctx, slices, false, func() { total++ })
-	var totalSlices int
-	for _, ss := range slices {
-		totalSlices += len(ss)
+	var slices []Slice
+	m.ListSlices(ctx, false, func(inode Ino, s Slice) error {
+		slices = append(slices, s)
+		return nil
+	})
+	if len(slices) != 1 {
+		t.Fatalf("number of chunks: %d != 1, %+v", len(slices), slices)
 	}
-	if totalSlices != 1 {
-		t.Fatalf("number of chunks: %d != 1, %+v", totalSlices, slices)
+	if used, st := m.UsedSlices(ctx, []uint64{cid}); st != 0 || !used[cid] {
+		t.Fatalf("slice %d should be used: %v %s", cid, used, st)
 	}
 	_ = m.Close(ctx, inode)
 	if st := m.Unlink(ctx, 1, "f"); st != 0 {
@@ -963,15 +1628,19 @@ func testTruncateAndDelete(t *testing.T, m Meta) {
 	}
 
 	time.Sleep(time.Millisecond * 100)
-	slices = make(map[Ino][]Slice)
-	m.ListSlices(ctx, slices, false, nil)
-	totalSlices = 0
-	for _, ss := range slices {
-		totalSlices += len(ss)
+	if _, ok := m.(*dbMeta); ok {
+		if used, st := m.UsedSlices(ctx, []uint64{cid}); st != 0 || used[cid] {
+			t.Fatalf("slice %d should not be used after deleted: %v %s", cid, used, st)
+		}
 	}
+	slices = slices[:0]
+	m.ListSlices(ctx, false, func(inode Ino, s Slice) error {
+		slices = append(slices, s)
+		return nil
+	})
 	// the last chunk could be found and deleted
-	if totalSlices > 1 {
-		t.Fatalf("number of chunks: %d > 1, %+v", totalSlices, slices)
+	if len(slices) > 1 {
+		t.Fatalf("number of chunks: %d > 1, %+v", len(slices), slices)
 	}
 }
 
@@ -1028,60 +1697,1247 @@ func testCopyFileRange(t *testing.T, m Meta) {
 	}
 }
 
-func testCloseSession(t *testing.T, m Meta) {
+func testTags(t *testing.T, m Meta) {
 	_ = m.Init(Format{Name: "test"}, false)
-	if err := m.NewSession(); err != nil {
-		t.Fatalf("new session: %s", err)
-	}
-
 	ctx := Background
-	var inode Ino
+	var f1, f2 Ino
 	var attr = &Attr{}
-	if st := m.Create(ctx, 1, "f", 0644, 022, 0, &inode, attr); st != 0 {
-		t.Fatalf("create f: %s", st)
+	if st := m.Create(ctx, 1, "t1", 0644, 022, 0, &f1, attr); st != 0 {
+		t.Fatalf("create t1: %s", st)
 	}
-	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != 0 {
-		t.Fatalf("flock wlock: %s", st)
+	defer m.Unlink(ctx, 1, "t1")
+	if st := m.Create(ctx, 1, "t2", 0644, 022, 0, &f2, attr); st != 0 {
+		t.Fatalf("create t2: %s", st)
 	}
-	if st := m.Setlk(ctx, inode, 1, false, syscall.F_WRLCK, 0x10000, 0x20000, 1); st != 0 {
-		t.Fatalf("plock wlock: %s", st)
+	if st := m.SetXattr(ctx, f1, TagPrefix+"label", []byte("cat"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("tag t1: %s", st)
 	}
-	if st := m.Open(ctx, inode, syscall.O_RDWR, attr); st != 0 {
-		t.Fatalf("open f: %s", st)
+	if st := m.SetXattr(ctx, f2, TagPrefix+"label", []byte("dog"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("tag t2: %s", st)
 	}
-	if st := m.Unlink(ctx, 1, "f"); st != 0 {
-		t.Fatalf("unlink f: %s", st)
+	if st := m.SetXattr(ctx, f2, TagPrefix+"label", []byte("x"), XattrCreate); st != syscall.EEXIST {
+		t.Fatalf("tag t2 again: %s", st)
 	}
-	var sid uint64
-	switch m := m.(type) {
-	case *redisMeta:
-		sid = m.sid
-	case *dbMeta:
-		sid = m.sid
-	case *kvMeta:
-		sid = m.sid
+	if st := m.SetXattr(ctx, f2, TagPrefix+"label", make([]byte, 256), XattrCreateOrReplace); st != syscall.EINVAL {
+		t.Fatalf("tag with long value: %s", st)
 	}
-	s, err := m.GetSession(sid)
-	if err != nil {
-		t.Fatalf("get session: %s", err)
-	} else {
-		if len(s.Flocks) != 1 || len(s.Plocks) != 1 || len(s.Sustained) != 1 {
-			t.Fatalf("incorrect session: flock %d plock %d sustained %d", len(s.Flocks), len(s.Plocks), len(s.Sustained))
+	var inodes []Ino
+	check := func(key, value string, expected ...Ino) {
+		var v []byte
+		if value != "*" {
+			v = []byte(value)
+		}
+		if st := m.ListTagged(ctx, key, v, &inodes); st != 0 {
+			t.Fatalf("list tagged %s=%s: %s", key, value, st)
+		}
+		sort.Slice(inodes, func(i, j int) bool { return inodes[i] < inodes[j] })
+		if len(inodes) != len(expected) {
+			t.Fatalf("expect %s=%s on %v, but got %v", key, value, expected, inodes)
+		}
+		for i := range inodes {
+			if inodes[i] != expected[i] {
+				t.Fatalf("expect %s=%s on %v, but got %v", key, value, expected, inodes)
+			}
 		}
 	}
-	if err = m.CloseSession(); err != nil {
-		t.Fatalf("close session: %s", err)
+	check("label", "cat", f1)
+	check("label", "dog", f2)
+	check("label", "*", f1, f2)
+	check("label", "")
+	check("color", "*")
+
+	if st := m.SetXattr(ctx, f1, TagPrefix+"label", []byte("dog"), XattrReplace); st != 0 {
+		t.Fatalf("retag t1: %s", st)
 	}
-	if _, err = m.GetSession(sid); err == nil {
-		t.Fatalf("get a deleted session: %s", err)
+	check("label", "cat")
+	check("label", "dog", f1, f2)
+	if st := m.RemoveXattr(ctx, f1, TagPrefix+"label"); st != 0 {
+		t.Fatalf("untag t1: %s", st)
 	}
-	switch m := m.(type) {
-	case *redisMeta:
-		s, err = m.getSession(strconv.FormatUint(sid, 10), true)
-	case *dbMeta:
-		s, err = m.getSession(&session{Sid: sid}, true)
-	case *kvMeta:
-		s, err = m.getSession(sid, true)
+	check("label", "dog", f2)
+	if st := m.SetXattr(ctx, f1, TagPrefix+"empty", nil, XattrCreateOrReplace); st != syscall.EINVAL {
+		t.Fatalf("tag t1 with empty value: %s", st)
+	}
+	// the index of removed files are cleaned up lazily
+	if st := m.Unlink(ctx, 1, "t2"); st != 0 {
+		t.Fatalf("unlink t2: %s", st)
+	}
+	check("label", "*")
+}
+
+func testDefaultXattrs(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var d, sub, f, g, s Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "xdir", 0755, 022, 0, &d, attr); st != 0 {
+		t.Fatalf("mkdir xdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "xdir")
+	if st := m.SetXattr(ctx, d, DefaultXattrPrefix+"project", []byte("p1"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("set default xattr: %s", st)
+	}
+	if st := m.SetXattr(ctx, d, DefaultXattrPrefix+"tag.owner", []byte("alice"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("set default tag: %s", st)
+	}
+	if st := m.SetXattr(ctx, d, "user.other", []byte("x"), XattrCreateOrReplace); st != 0 {
+		t.Fatalf("set xattr: %s", st)
+	}
+	if st := m.Create(ctx, d, "f", 0644, 022, 0, &f, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	defer m.Unlink(ctx, d, "f")
+	if st := m.Mkdir(ctx, d, "sub", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+	defer m.Rmdir(ctx, d, "sub")
+	if st := m.Mknod(ctx, sub, "g", TypeFile, 0644, 022, 0, &g, attr); st != 0 {
+		t.Fatalf("mknod g: %s", st)
+	}
+	defer m.Unlink(ctx, sub, "g")
+	if st := m.Symlink(ctx, d, "s", "f", &s, attr); st != 0 {
+		t.Fatalf("symlink s: %s", st)
+	}
+	defer m.Unlink(ctx, d, "s")
+	batch := make([]Ino, 2)
+	sts := make([]syscall.Errno, 2)
+	if st := m.MknodBatch(ctx, sub, []string{"b1", "b2"}, TypeFile, 0644, 022, batch, sts); st != 0 || sts[0] != 0 || sts[1] != 0 {
+		t.Fatalf("mknod batch: %s %v", st, sts)
+	}
+	defer m.Unlink(ctx, sub, "b1")
+	defer m.Unlink(ctx, sub, "b2")
+
+	expect := func(inode Ino, names ...string) {
+		var list []byte
+		if st := m.ListXattr(ctx, inode, &list); st != 0 {
+			t.Fatalf("list xattrs of %d: %s", inode, st)
+		}
+		var got []string
+		for _, name := range strings.Split(string(list), "\x00") {
+			if name != "" {
+				got = append(got, name)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(names)
+		if strings.Join(got, ",") != strings.Join(names, ",") {
+			t.Fatalf("expect xattrs %v of inode %d, but got %v", names, inode, got)
+		}
+	}
+	expect(f, "user.project", "user.tag.owner")
+	expect(sub, "user.project", "user.tag.owner", DefaultXattrPrefix+"project", DefaultXattrPrefix+"tag.owner")
+	expect(g, "user.project", "user.tag.owner")
+	expect(batch[0], "user.project", "user.tag.owner")
+	expect(batch[1], "user.project", "user.tag.owner")
+	expect(s)
+	var value []byte
+	if st := m.GetXattr(ctx, g, "user.project", &value); st != 0 || string(value) != "p1" {
+		t.Fatalf("get inherited xattr: %s %q", st, value)
+	}
+	var inodes []Ino
+	if st := m.ListTagged(ctx, "owner", []byte("alice"), &inodes); st != 0 || len(inodes) != 5 {
+		t.Fatalf("list inherited tags: %s %v", st, inodes)
+	}
+}
+
+func testQuota(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var d, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "qdir", 0755, 022, 0, &d, attr); st != 0 {
+		t.Fatalf("mkdir qdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "qdir")
+	if st := m.Create(ctx, d, "f1", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f1: %s", st)
+	}
+	defer m.Unlink(ctx, d, "f1")
+	if st := m.SetQuota(ctx, inode, 1<<20, 0); st != syscall.ENOTDIR {
+		t.Fatalf("set quota on file: %s", st)
+	}
+	if st := m.SetQuota(ctx, d, 16<<10, 3); st != 0 {
+		t.Fatalf("set quota: %s", st)
+	}
+	var q Quota
+	if st := m.GetQuota(ctx, d, &q); st != 0 || q.MaxSpace != 16<<10 || q.MaxInodes != 3 || q.UsedSpace != 4<<10 || q.UsedInodes != 1 {
+		t.Fatalf("get quota: %s %+v", st, q)
+	}
+	base.loadQuotas()
+
+	for _, name := range []string{"f2", "f3"} {
+		if st := m.Create(ctx, d, name, 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		defer m.Unlink(ctx, d, name)
+	}
+	if st := m.Create(ctx, d, "f4", 0644, 022, 0, &inode, attr); st != syscall.EDQUOT {
+		t.Fatalf("create f4 over quota: %s", st)
+	}
+	if st := m.Truncate(ctx, inode, 0, 8<<10, attr); st != 0 {
+		t.Fatalf("truncate f3: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 8<<10, Slice{Chunkid: 1, Size: 4 << 10, Len: 4 << 10}); st != syscall.EDQUOT {
+		t.Fatalf("write over quota: %s", st)
+	}
+	base.flushQuotas()
+	if st := m.GetQuota(ctx, d, &q); st != 0 || q.UsedSpace != 16<<10 || q.UsedInodes != 3 {
+		t.Fatalf("get quota after flush: %s %+v", st, q)
+	}
+
+	// moving files out of the directory releases the quota
+	if st := m.Rename(ctx, d, "f3", 1, "qf3", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename f3: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "qf3")
+	if st := m.Create(ctx, d, "f4", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f4: %s", st)
+	}
+	defer m.Unlink(ctx, d, "f4")
+	if st := m.Mkdir(ctx, 1, "qsub", 0755, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("mkdir qsub: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "qsub")
+	if st := m.Rename(ctx, 1, "qsub", d, "qsub", 0, &inode, attr); st != syscall.EXDEV {
+		t.Fatalf("rename directory across quotas: %s", st)
+	}
+	base.flushQuotas()
+	if st := m.CheckQuota(ctx, d, false, &q); st != 0 || q.UsedSpace != 12<<10 || q.UsedInodes != 3 {
+		t.Fatalf("check quota: %s %+v", st, q)
+	}
+
+	if err := base.en.doSetQuota(d, &Quota{MaxSpace: 16 << 10, MaxInodes: 3, UsedSpace: 1, UsedInodes: 1}); err != nil {
+		t.Fatalf("set usage: %s", err)
+	}
+	if st := m.CheckQuota(ctx, d, true, &q); st != 0 || q.UsedSpace != 12<<10 || q.UsedInodes != 3 {
+		t.Fatalf("repair quota: %s %+v", st, q)
+	}
+	if st := m.GetQuota(ctx, d, &q); st != 0 || q.UsedSpace != 12<<10 || q.UsedInodes != 3 {
+		t.Fatalf("get quota after repair: %s %+v", st, q)
+	}
+
+	quotas := make(map[Ino]*Quota)
+	if st := m.ListQuotas(ctx, quotas); st != 0 || len(quotas) != 1 || quotas[d] == nil {
+		t.Fatalf("list quotas: %s %v", st, quotas)
+	}
+	if st := m.DelQuota(ctx, d); st != 0 {
+		t.Fatalf("delete quota: %s", st)
+	}
+	if st := m.GetQuota(ctx, d, &q); st != ENOATTR {
+		t.Fatalf("get deleted quota: %s", st)
+	}
+	base.loadQuotas()
+}
+
+func testReaddirAt(t *testing.T, m Meta) {
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "pdir", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir pdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "pdir")
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		if st := m.Create(ctx, dir, name, 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		defer m.Unlink(ctx, dir, name)
+	}
+
+	var cursor string
+	var pages int
+	seen := make(map[string]bool)
+	for {
+		var entries []*Entry
+		if st := m.ReaddirAt(ctx, dir, 1, &cursor, 10, &entries); st != 0 {
+			t.Fatalf("readdir pdir: %s", st)
+		}
+		pages++
+		for _, e := range entries {
+			name := string(e.Name)
+			if seen[name] {
+				t.Fatalf("entry %s is returned twice", name)
+			}
+			seen[name] = true
+			if name != "." && name != ".." && (!e.Attr.Full || e.Attr.Typ != TypeFile) {
+				t.Fatalf("attributes of %s are not filled: %+v", name, e.Attr)
+			}
+		}
+		if cursor == "" {
+			break
+		}
+		if pages > 27 {
+			t.Fatalf("too many pages")
+		}
+	}
+	if len(seen) != 27 || !seen["."] || !seen[".."] {
+		t.Fatalf("expect 27 entries, got %d: %v", len(seen), seen)
+	}
+
+	// only the asked attributes are returned
+	if st := m.Truncate(ctx, inode, 0, 100, attr); st != 0 {
+		t.Fatalf("truncate f24: %s", st)
+	}
+	var entries []*Entry
+	if st := m.Readdir(ctx, dir, ReaddirSize, &entries); st != 0 {
+		t.Fatalf("readdir pdir: %s", st)
+	}
+	for _, e := range entries {
+		if string(e.Name) == "f24" {
+			if e.Attr.Full || e.Attr.Typ != TypeFile || e.Attr.Length != 100 || e.Attr.Mode != 0 || e.Attr.Mtime != 0 {
+				t.Fatalf("attributes of f24: %+v", e.Attr)
+			}
+		}
+	}
+}
+
+func testFind(t *testing.T, m Meta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "fdir", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir fdir: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "fdir")
+	now := time.Now().Unix()
+	for i, name := range []string{"find1.log", "find2.log", "find3.txt"} {
+		if st := m.Create(ctx, dir, name, 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+		defer m.Unlink(ctx, dir, name)
+		if st := m.Truncate(ctx, inode, 0, uint64(i)<<20, attr); st != 0 {
+			t.Fatalf("truncate %s: %s", name, st)
+		}
+		attr.Uid = uint32(i)
+		attr.Mtime = now - int64(i)*86400
+		if st := m.SetAttr(ctx, inode, SetAttrUID|SetAttrMtime, 0, attr); st != 0 {
+			t.Fatalf("setattr %s: %s", name, st)
+		}
+	}
+	if st := m.Link(ctx, inode, 1, "find4.txt", attr); st != 0 {
+		t.Fatalf("link find4.txt: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "find4.txt")
+
+	find := func(filter *FindFilter, expected ...string) {
+		var cursor string
+		var found []string
+		for {
+			var entries []*Entry
+			if st := m.Find(ctx, filter, &cursor, 2, &entries); st != 0 {
+				t.Fatalf("find %+v: %s", filter, st)
+			}
+			for _, e := range entries {
+				if strings.HasPrefix(string(e.Name), "find") {
+					found = append(found, fmt.Sprintf("%d/%s", e.Attr.Parent, e.Name))
+				}
+			}
+			if cursor == "" {
+				break
+			}
+		}
+		sort.Strings(found)
+		for i := range expected {
+			p := strings.IndexByte(expected[i], '/')
+			d := dir
+			if expected[i][:p] == "" {
+				d = 1
+			}
+			expected[i] = fmt.Sprintf("%d/%s", d, expected[i][p+1:])
+		}
+		sort.Strings(expected)
+		if strings.Join(found, ",") != strings.Join(expected, ",") {
+			t.Fatalf("find %+v: expect %v, but got %v", filter, expected, found)
+		}
+	}
+	uid := uint32(1)
+	find(&FindFilter{Name: "find?.*"}, "d/find1.log", "d/find2.log", "d/find3.txt", "/find4.txt")
+	find(&FindFilter{Name: "*.log"}, "d/find1.log", "d/find2.log")
+	find(&FindFilter{Name: "find*", MinSize: 1 << 20}, "d/find2.log", "d/find3.txt", "/find4.txt")
+	find(&FindFilter{Name: "find*", MaxSize: 1 << 20}, "d/find1.log", "d/find2.log")
+	find(&FindFilter{Name: "find*", MinMtime: time.Unix(now-3600, 0)}, "d/find1.log")
+	find(&FindFilter{Name: "find*", MaxMtime: time.Unix(now-3600, 0)}, "d/find2.log", "d/find3.txt", "/find4.txt")
+	find(&FindFilter{Name: "find*", Uid: &uid}, "d/find2.log")
+	find(&FindFilter{Name: "find*.txt", Uid: &uid})
+	var cursor string
+	var entries []*Entry
+	if st := m.Find(ctx, &FindFilter{Name: "["}, &cursor, 10, &entries); st != syscall.EINVAL {
+		t.Fatalf("find with bad pattern: %s", st)
+	}
+}
+
+func testKillSession(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	var inode, locked Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "ks", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create ks: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "ks"); st != 0 {
+		t.Fatalf("unlink ks: %s", st)
+	}
+	if st := m.Create(ctx, 1, "kl", 0644, 022, 0, &locked, attr); st != 0 {
+		t.Fatalf("create kl: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "kl")
+	if st := m.Flock(ctx, locked, 1, syscall.F_WRLCK, false); st != 0 {
+		t.Fatalf("flock wlock: %s", st)
+	}
+	if st := m.Setlk(ctx, locked, 1, false, syscall.F_WRLCK, 0, 0x10000, 1); st != 0 {
+		t.Fatalf("plock wlock: %s", st)
+	}
+
+	// the client is gone, and its session is killed by a new one
+	sid := base.sid
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	if err := m.KillSession(base.sid); err == nil {
+		t.Fatalf("kill the session of itself should fail")
+	}
+	if err := m.KillSession(sid); err != nil {
+		t.Fatalf("kill session %d: %s", sid, err)
+	}
+	if _, err := m.GetSession(sid); err == nil {
+		t.Fatalf("session %d should be removed", sid)
+	}
+	if err := m.KillSession(sid); err == nil {
+		t.Fatalf("kill removed session %d should fail", sid)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != syscall.ENOENT {
+		t.Fatalf("getattr of sustained inode: %s", st)
+	}
+	if st := m.Flock(ctx, locked, 2, syscall.F_WRLCK, false); st != 0 {
+		t.Fatalf("flock released by killed session: %s", st)
+	}
+	if st := m.Setlk(ctx, locked, 2, false, syscall.F_WRLCK, 0, 0x10000, 1); st != 0 {
+		t.Fatalf("plock released by killed session: %s", st)
+	}
+	_ = m.Flock(ctx, locked, 2, syscall.F_UNLCK, false)
+	_ = m.Setlk(ctx, locked, 2, false, syscall.F_UNLCK, 0, 0x10000, 1)
+}
+
+func testFlags(t *testing.T, m Meta) {
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "fd", 0777, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir fd: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0666, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	attr.Flags = FlagImmutable
+	if st := m.SetAttr(NewContext(0, 1, []uint32{1}), inode, SetAttrFlag, 0, attr); st != syscall.EPERM {
+		t.Fatalf("set flags by non-root: %s", st)
+	}
+	if st := m.SetAttr(ctx, inode, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("set immutable: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Flags != FlagImmutable {
+		t.Fatalf("getattr: %s, flags %d", st, attr.Flags)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, attr); st != syscall.EPERM {
+		t.Fatalf("chmod immutable file: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_WRONLY, attr); st != syscall.EPERM {
+		t.Fatalf("open immutable file for write: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_RDONLY, attr); st != 0 {
+		t.Fatalf("open immutable file for read: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Truncate(ctx, inode, 0, 100, attr); st != syscall.EPERM {
+		t.Fatalf("truncate immutable file: %s", st)
+	}
+	if st := m.Write(ctx, inode, 0, 0, Slice{Chunkid: 1, Size: 100, Len: 100}); st != syscall.EPERM {
+		t.Fatalf("write immutable file: %s", st)
+	}
+	if st := m.Link(ctx, inode, dir, "l", attr); st != syscall.EPERM {
+		t.Fatalf("link immutable file: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f", dir, "f2", 0, nil, nil); st != syscall.EPERM {
+		t.Fatalf("rename immutable file: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink immutable file: %s", st)
+	}
+
+	attr.Flags = FlagAppend
+	if st := m.SetAttr(ctx, inode, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("set append-only: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_WRONLY, attr); st != syscall.EPERM {
+		t.Fatalf("open append-only file without O_APPEND: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_WRONLY|syscall.O_APPEND, attr); st != 0 {
+		t.Fatalf("open append-only file with O_APPEND: %s", st)
+	}
+	_ = m.Close(ctx, inode)
+	if st := m.Truncate(ctx, inode, 0, 0, attr); st != syscall.EPERM {
+		t.Fatalf("truncate append-only file: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink append-only file: %s", st)
+	}
+
+	// entries can be added into an append-only directory, but not removed
+	attr.Flags = 0
+	if st := m.SetAttr(ctx, inode, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("clear flags: %s", st)
+	}
+	attr.Flags = FlagAppend
+	if st := m.SetAttr(ctx, dir, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("set append-only on dir: %s", st)
+	}
+	var inode2 Ino
+	if st := m.Create(ctx, dir, "f2", 0666, 022, 0, &inode2, attr); st != 0 {
+		t.Fatalf("create in append-only dir: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "f"); st != syscall.EPERM {
+		t.Fatalf("unlink in append-only dir: %s", st)
+	}
+	attr.Flags = FlagImmutable
+	if st := m.SetAttr(ctx, dir, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("set immutable on dir: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f3", 0666, 022, 0, &inode2, attr); st != syscall.EPERM {
+		t.Fatalf("create in immutable dir: %s", st)
+	}
+	attr.Flags = 0
+	if st := m.SetAttr(ctx, dir, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("clear flags of dir: %s", st)
+	}
+	if st := Remove(m, ctx, 1, "fd"); st != 0 {
+		t.Fatalf("remove fd: %s", st)
+	}
+}
+
+func testScrub(t *testing.T, m Meta, base *baseMeta) {
+	ctx := Background
+	var dir, file, sub Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "sd", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir sd: %s", st)
+	}
+	defer Remove(m, ctx, 1, "sd")
+	if st := m.Create(ctx, dir, "f", 0644, 022, 0, &file, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "d", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	var chunkid uint64
+	_ = m.NewChunk(ctx, &chunkid)
+	if st := m.Write(ctx, file, 0, 0, Slice{Chunkid: chunkid, Size: 100, Len: 100}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	if st := m.Truncate(ctx, file, 0, 50, attr); st != 0 {
+		t.Fatalf("truncate f: %s", st)
+	}
+	for _, inode := range []Ino{dir, file, sub} {
+		if a, _ := base.checkInode(ctx, inode); a != nil {
+			t.Fatalf("scrub found anomaly of a good inode: %s", a)
+		}
+	}
+	base.scrub(10)
+
+	// remove the entries of f and d behind the namespace
+	setEntry := func(name string, typ uint8, inode Ino, add bool) {
+		var err error
+		switch m := m.(type) {
+		case *redisMeta:
+			if add {
+				err = m.rdb.HSet(ctx, m.entryKey(dir), name, m.packEntry(typ, inode)).Err()
+			} else {
+				err = m.rdb.HDel(ctx, m.entryKey(dir), name).Err()
+			}
+		case *dbMeta:
+			if add {
+				_, err = m.db.Insert(&edge{Parent: dir, Name: name, Inode: inode, Type: typ})
+			} else {
+				_, err = m.db.Delete(&edge{Parent: dir, Name: name})
+			}
+		case *kvMeta:
+			err = m.txn(ctx, func(tx kvTxn) error {
+				if add {
+					tx.set(m.entryKey(dir, name), m.packEntry(typ, inode))
+				} else {
+					tx.dels(m.entryKey(dir, name))
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			t.Fatalf("set entry %s: %s", name, err)
+		}
+	}
+	setEntry("f", TypeFile, file, false)
+	setEntry("d", TypeDirectory, sub, false)
+	if a, _ := base.checkInode(ctx, file); a == nil || a.kind != anomalyEntry {
+		t.Fatalf("anomaly of f: %+v", a)
+	}
+	if a, _ := base.checkInode(ctx, sub); a == nil || a.kind != anomalyEntry {
+		t.Fatalf("anomaly of d: %+v", a)
+	}
+	if a, _ := base.checkInode(ctx, dir); a == nil || a.kind != anomalyNlink {
+		t.Fatalf("anomaly of sd: %+v", a)
+	}
+	setEntry("f", TypeFile, file, true)
+	setEntry("d", TypeDirectory, sub, true)
+	if a, _ := base.checkInode(ctx, dir); a != nil {
+		t.Fatalf("anomaly of repaired sd: %s", a)
+	}
+}
+
+func testCheckNamespace(t *testing.T, m Meta) {
+	ctx := Background
+	check := func() map[string]bool {
+		var report NamespaceReport
+		if st := m.CheckNamespace(ctx, &report); st != 0 {
+			t.Fatalf("check namespace: %s", st)
+		}
+		if report.Inodes == 0 || report.Entries == 0 {
+			t.Fatalf("nothing is checked: %+v", report)
+		}
+		found := make(map[string]bool)
+		for _, p := range report.Problems {
+			if p.Class == ProblemUsage {
+				continue // the stats are flushed in background
+			}
+			found[p.Class+"/"+p.Inode.String()] = true
+		}
+		return found
+	}
+	// the problems left by previous tests are ignored
+	old := check()
+
+	var dir, dir2, file, sub Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "ns", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir ns: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "ns2", 0755, 022, 0, &dir2, attr); st != 0 {
+		t.Fatalf("mkdir ns2: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 022, 0, &file, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Mkdir(ctx, dir, "d", 0755, 022, 0, &sub, attr); st != 0 {
+		t.Fatalf("mkdir d: %s", st)
+	}
+	setEntry := func(parent Ino, name string, typ uint8, inode Ino, add bool) {
+		var err error
+		switch m := m.(type) {
+		case *redisMeta:
+			if add {
+				err = m.rdb.HSet(ctx, m.entryKey(parent), name, m.packEntry(typ, inode)).Err()
+			} else {
+				err = m.rdb.HDel(ctx, m.entryKey(parent), name).Err()
+			}
+		case *dbMeta:
+			if add {
+				_, err = m.db.Insert(&edge{Parent: parent, Name: name, Inode: inode, Type: typ})
+			} else {
+				_, err = m.db.Delete(&edge{Parent: parent, Name: name})
+			}
+		case *kvMeta:
+			err = m.txn(ctx, func(tx kvTxn) error {
+				if add {
+					tx.set(m.entryKey(parent, name), m.packEntry(typ, inode))
+				} else {
+					tx.dels(m.entryKey(parent, name))
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			t.Fatalf("set entry %s: %s", name, err)
+		}
+	}
+	// f has no entry, g points to nothing, and d is moved into ns2 without updating nlink and parent
+	setEntry(dir, "f", TypeFile, file, false)
+	setEntry(dir, "g", TypeFile, 1<<40, true)
+	setEntry(dir, "d", TypeDirectory, sub, false)
+	setEntry(dir2, "d", TypeDirectory, sub, true)
+
+	var found []string
+	for k := range check() {
+		if !old[k] {
+			found = append(found, k)
+		}
+	}
+	sort.Strings(found)
+	expected := []string{
+		ProblemDangling + "/" + Ino(1<<40).String(),
+		ProblemNlink + "/" + dir.String(),
+		ProblemNlink + "/" + dir2.String(),
+		ProblemOrphan + "/" + file.String(),
+		ProblemParent + "/" + sub.String(),
+	}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expect problems %s, but got %s", expected, found)
+	}
+
+	setEntry(dir, "f", TypeFile, file, true)
+	setEntry(dir, "g", TypeFile, 1<<40, false)
+	setEntry(dir, "d", TypeDirectory, sub, true)
+	setEntry(dir2, "d", TypeDirectory, sub, false)
+	if st := Remove(m, ctx, 1, "ns"); st != 0 {
+		t.Fatalf("remove ns: %s", st)
+	}
+}
+
+func testMetaCache(t *testing.T, m Meta, base *baseMeta) {
+	base.mc = newMetaCache(time.Minute)
+	base.of.mc = base.mc
+	defer func() {
+		base.mc = nil
+		base.of.mc = nil
+	}()
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "metacache", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir metacache: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var found Ino
+	if st := m.Lookup(ctx, dir, "f", &found, attr); st != 0 || found != inode {
+		t.Fatalf("lookup f: %s %d != %d", st, found, inode)
+	}
+	if ino, ok := base.mc.getEntry(dir, "f"); !ok || ino != inode {
+		t.Fatalf("entry f is not cached")
+	}
+	if !base.mc.getAttr(inode, attr) {
+		t.Fatalf("attributes of f are not cached")
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("setattr f: %s", st)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Mode != 0600 {
+		t.Fatalf("getattr f: %s mode %o", st, attr.Mode)
+	}
+	// changes from other clients
+	base.mc.handle("a" + inode.String())
+	if base.mc.getAttr(inode, attr) {
+		t.Fatalf("attributes of f should be invalidated")
+	}
+	base.mc.handle("e" + dir.String() + "/f")
+	if _, ok := base.mc.getEntry(dir, "f"); ok {
+		t.Fatalf("entry f should be invalidated")
+	}
+	if st := m.Lookup(ctx, dir, "f", &found, attr); st != 0 {
+		t.Fatalf("lookup f: %s", st)
+	}
+	if st := m.Rename(ctx, dir, "f", dir, "g", 0, &found, attr); st != 0 {
+		t.Fatalf("rename f: %s", st)
+	}
+	if st := m.Lookup(ctx, dir, "f", &found, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup f after rename: %s", st)
+	}
+	if st := m.Lookup(ctx, dir, "g", &found, attr); st != 0 || found != inode {
+		t.Fatalf("lookup g: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "g"); st != 0 {
+		t.Fatalf("unlink g: %s", st)
+	}
+	if st := m.Lookup(ctx, dir, "g", &found, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup g after unlink: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "metacache"); st != 0 {
+		t.Fatalf("rmdir metacache: %s", st)
+	}
+}
+
+func testGCStats(t *testing.T, m Meta) {
+	var before, after GCStats
+	if st := m.GetGCStats(Background, &before); st != 0 {
+		t.Fatalf("get gc stats: %s", st)
+	}
+	// a slice to be deleted and a leaked one
+	switch m := m.(type) {
+	case *redisMeta:
+		m.rdb.HSet(Background, m.prefix+sliceRefs, m.sliceKey(1<<40, 100), "-1", m.sliceKey(1<<40+1, 200), "0")
+		defer m.rdb.HDel(Background, m.prefix+sliceRefs, m.sliceKey(1<<40, 100), m.sliceKey(1<<40+1, 200))
+	case *dbMeta:
+		if _, err := m.db.Insert(&chunkRef{1 << 40, 100, -1}, &chunkRef{1<<40 + 1, 200, 0}); err != nil {
+			t.Fatalf("insert slices: %s", err)
+		}
+		defer m.db.Delete(&chunkRef{Chunkid: 1 << 40})
+		defer m.db.Delete(&chunkRef{Chunkid: 1<<40 + 1})
+	case *kvMeta:
+		_ = m.setValue(m.sliceKey(1<<40, 100), packCounter(-1))
+		_ = m.setValue(m.sliceKey(1<<40+1, 200), packCounter(0))
+		defer m.deleteKeys(m.sliceKey(1<<40, 100), m.sliceKey(1<<40+1, 200))
+	}
+	if st := m.GetGCStats(Background, &after); st != 0 {
+		t.Fatalf("get gc stats: %s", st)
+	}
+	if after.PendingSlices != before.PendingSlices+1 || after.PendingSliceSpace != before.PendingSliceSpace+100 {
+		t.Fatalf("pending slices: %+v -> %+v", before, after)
+	}
+	if after.LeakedSlices != before.LeakedSlices+1 || after.LeakedSpace != before.LeakedSpace+200 {
+		t.Fatalf("leaked slices: %+v -> %+v", before, after)
+	}
+	if after.Total() != before.Total()+300 {
+		t.Fatalf("total space: %d -> %d", before.Total(), after.Total())
+	}
+}
+
+func testClone(t *testing.T, m Meta) {
+	ctx := Background
+	var dir, file, link Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "cloneSrc", 0750, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir cloneSrc: %s", st)
+	}
+	defer Remove(m, ctx, 1, "cloneSrc")
+	if st := m.Create(ctx, dir, "f", 0640, 022, 0, &file, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var chunkid uint64
+	if st := m.NewChunk(ctx, &chunkid); st != 0 {
+		t.Fatalf("new chunk: %s", st)
+	}
+	if st := m.Write(ctx, file, 1, 100, Slice{Chunkid: chunkid, Size: 1000, Len: 1000}); st != 0 {
+		t.Fatalf("write f: %s", st)
+	}
+	_ = m.Close(ctx, file)
+	if st := m.SetXattr(ctx, file, "user.k", []byte("v"), XattrCreate); st != 0 {
+		t.Fatalf("setxattr f: %s", st)
+	}
+	if st := m.Link(ctx, file, dir, "h", attr); st != 0 {
+		t.Fatalf("link f: %s", st)
+	}
+	if st := m.Symlink(ctx, dir, "s", "f", &link, attr); st != 0 {
+		t.Fatalf("symlink s: %s", st)
+	}
+	if st := m.Clone(ctx, dir, dir, "dst"); st != syscall.EINVAL {
+		t.Fatalf("clone into itself: %s", st)
+	}
+	if st := m.Clone(ctx, dir, 1, "cloneDst"); st != 0 {
+		t.Fatalf("clone: %s", st)
+	}
+	defer Remove(m, ctx, 1, "cloneDst")
+	if st := m.Clone(ctx, dir, 1, "cloneDst"); st != syscall.EEXIST {
+		t.Fatalf("clone to existed: %s", st)
+	}
+
+	var cdir, cfile, ch, cs Ino
+	if st := m.Lookup(ctx, 1, "cloneDst", &cdir, attr); st != 0 {
+		t.Fatalf("lookup cloneDst: %s", st)
+	}
+	if attr.Typ != TypeDirectory || attr.Mode != 0750 {
+		t.Fatalf("attr of cloned dir: %+v", attr)
+	}
+	if st := m.Lookup(ctx, cdir, "f", &cfile, attr); st != 0 {
+		t.Fatalf("lookup f: %s", st)
+	}
+	if cfile == file || attr.Mode != 0640 || attr.Length != 64<<20+1100 || attr.Nlink != 2 {
+		t.Fatalf("cloned file %d: %+v", cfile, attr)
+	}
+	if st := m.Lookup(ctx, cdir, "h", &ch, attr); st != 0 || ch != cfile {
+		t.Fatalf("lookup h: %s %d != %d", st, ch, cfile)
+	}
+	var slices []Slice
+	if st := m.Read(ctx, cfile, 1, &slices); st != 0 {
+		t.Fatalf("read cloned file: %s", st)
+	}
+	var found bool
+	for _, s := range slices {
+		if s.Chunkid == chunkid && s.Len == 1000 {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("slices of cloned file: %+v", slices)
+	}
+	var value []byte
+	if st := m.GetXattr(ctx, cfile, "user.k", &value); st != 0 || string(value) != "v" {
+		t.Fatalf("xattr of cloned file: %s %q", st, value)
+	}
+	if st := m.Lookup(ctx, cdir, "s", &cs, attr); st != 0 || attr.Typ != TypeSymlink {
+		t.Fatalf("lookup s: %s %+v", st, attr)
+	}
+	var target []byte
+	if st := m.ReadLink(ctx, cs, &target); st != 0 || string(target) != "f" {
+		t.Fatalf("readlink s: %s %q", st, target)
+	}
+
+	// a normal user can't clone what it can't read, and the partial clone is removed
+	var udir, inode Ino
+	if st := m.Mkdir(ctx, 1, "cloneUser", 0777, 0, 0, &udir, attr); st != 0 {
+		t.Fatalf("mkdir cloneUser: %s", st)
+	}
+	defer Remove(m, ctx, 1, "cloneUser")
+	if st := m.Mkdir(ctx, udir, "src", 0755, 0, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir src: %s", st)
+	}
+	var fa Ino
+	if st := m.Create(ctx, dir, "a", 0644, 0, 0, &fa, attr); st != 0 {
+		t.Fatalf("create a: %s", st)
+	}
+	if st := m.Create(ctx, dir, "b", 0600, 0, 0, &inode, attr); st != 0 {
+		t.Fatalf("create b: %s", st)
+	}
+	uctx := NewContext(1, 1, []uint32{1})
+	if st := m.Clone(uctx, fa, dir, "c"); st != syscall.EACCES {
+		t.Fatalf("clone into a directory not writable: %s", st)
+	}
+	if st := m.Lookup(ctx, dir, "c", &inode, attr); st != syscall.ENOENT {
+		t.Fatalf("lookup c: %s", st)
+	}
+	if st := m.Clone(uctx, fa, udir, "c"); st != 0 {
+		t.Fatalf("clone a readable file: %s", st)
+	}
+	if st := m.Clone(uctx, dir, udir, "dst"); st != syscall.EACCES {
+		t.Fatalf("clone unreadable file: %s", st)
+	}
+	if st := m.Lookup(ctx, udir, "dst", &inode, attr); st != syscall.ENOENT {
+		t.Fatalf("partial clone should be removed: %s", st)
+	}
+	if st := m.SetAttr(ctx, dir, SetAttrMode, 0, &Attr{Mode: 0700}); st != 0 {
+		t.Fatalf("chmod src: %s", st)
+	}
+	if st := m.Clone(uctx, dir, udir, "dst"); st != syscall.EACCES {
+		t.Fatalf("clone unreadable dir: %s", st)
+	}
+}
+
+func testChangelog(t *testing.T, m Meta, base *baseMeta) {
+	defer func() { base.fmt.ChangelogRetention = 0 }()
+	ctx := Background
+	if err := m.Subscribe(ctx, EventAll, 0, nil); err == nil {
+		t.Fatalf("subscribe should fail when changelog is disabled")
+	}
+	base.fmt.ChangelogRetention = 3600
+	start, err := base.en.incrCounter("nextEvent", 0)
+	if err != nil {
+		t.Fatalf("get last event: %s", err)
+	}
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "changelog", 0755, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir changelog: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	var renamed Ino
+	if st := m.Rename(ctx, dir, "f", dir, "g", 0, &renamed, attr); st != 0 {
+		t.Fatalf("rename f: %s", st)
+	}
+	attr.Mode = 0600
+	if st := m.SetAttr(ctx, inode, SetAttrMode, 0, attr); st != 0 {
+		t.Fatalf("setattr g: %s", st)
+	}
+	if st := m.Unlink(ctx, dir, "g"); st != 0 {
+		t.Fatalf("unlink g: %s", st)
+	}
+	if st := m.Rmdir(ctx, 1, "changelog"); st != 0 {
+		t.Fatalf("rmdir changelog: %s", st)
+	}
+
+	done := fmt.Errorf("done")
+	subscribe := func(types uint8, n int) []*Event {
+		var events []*Event
+		err := m.Subscribe(ctx, types, uint64(start), func(e *Event) error {
+			if events = append(events, e); len(events) == n {
+				return done
+			}
+			return nil
+		})
+		if err != done {
+			t.Fatalf("subscribe: %v", err)
+		}
+		return events
+	}
+	var types []string
+	for _, e := range subscribe(EventAll, 6) {
+		types = append(types, e.TypeName())
+	}
+	if expected := "create,create,rename,setattr,delete,delete"; strings.Join(types, ",") != expected {
+		t.Fatalf("expect events %s, but got %s", expected, strings.Join(types, ","))
+	}
+	events := subscribe(EventRename, 1)
+	if e := events[0]; e.Inode != inode || e.Parent != dir || e.Name != "f" || e.NewParent != dir || e.NewName != "g" {
+		t.Fatalf("unexpected rename event: %+v", e)
+	}
+
+	if n, err := base.en.doCleanupEvents(time.Now().Add(time.Second)); err != nil || n < 6 {
+		t.Fatalf("cleanup events: %d, %v", n, err)
+	}
+	if events, err := base.en.doReadEvents(ctx, uint64(start), 100); err != nil || len(events) != 0 {
+		t.Fatalf("events should be cleaned up: %+v, %v", events, err)
+	}
+}
+
+func testAtime(t *testing.T, m Meta, base *baseMeta) {
+	defer func() { base.conf.AtimeMode = "" }()
+	ctx := Background
+	var dir, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "atime", 0777, 022, 0, &dir, attr); st != 0 {
+		t.Fatalf("mkdir atime: %s", st)
+	}
+	if st := m.Create(ctx, dir, "f", 0666, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	old := time.Now().Add(-time.Hour * 48)
+	setOld := func(ino Ino) {
+		attr.Atime, attr.Atimensec = old.Unix(), 0
+		if st := m.SetAttr(ctx, ino, SetAttrAtime, 0, attr); st != 0 {
+			t.Fatalf("set atime of %d: %s", ino, st)
+		}
+	}
+	atime := func(ino Ino) time.Time {
+		if st := m.GetAttr(ctx, ino, attr); st != 0 {
+			t.Fatalf("getattr %d: %s", ino, st)
+		}
+		return time.Unix(attr.Atime, int64(attr.Atimensec))
+	}
+	var entries []*Entry
+
+	base.conf.AtimeMode = NoAtime
+	setOld(dir)
+	setOld(inode)
+	if st := m.Readdir(ctx, dir, 0, &entries); st != 0 {
+		t.Fatalf("readdir: %s", st)
+	}
+	if st := m.TouchAtime(ctx, inode); st != 0 {
+		t.Fatalf("touch atime: %s", st)
+	}
+	if atime(dir).Unix() != old.Unix() || atime(inode).Unix() != old.Unix() {
+		t.Fatalf("atime should not be updated in noatime mode")
+	}
+
+	base.conf.AtimeMode = RelAtime
+	if st := m.Readdir(ctx, dir, 0, &entries); st != 0 {
+		t.Fatalf("readdir: %s", st)
+	}
+	if st := m.TouchAtime(ctx, inode); st != 0 {
+		t.Fatalf("touch atime: %s", st)
+	}
+	if time.Since(atime(dir)) > time.Minute {
+		t.Fatalf("atime of dir should be updated by readdir in relatime mode")
+	}
+	last := atime(inode)
+	if time.Since(last) > time.Minute {
+		t.Fatalf("atime of file should be updated in relatime mode")
+	}
+	time.Sleep(time.Millisecond * 1100)
+	if st := m.TouchAtime(ctx, inode); st != 0 {
+		t.Fatalf("touch atime: %s", st)
+	}
+	if !atime(inode).Equal(last) {
+		t.Fatalf("atime should not be updated again in relatime mode")
+	}
+
+	base.conf.AtimeMode = StrictAtime
+	if st := m.TouchAtime(ctx, inode); st != 0 {
+		t.Fatalf("touch atime: %s", st)
+	}
+	if !atime(inode).After(last) {
+		t.Fatalf("atime should be updated on every access in strictatime mode")
+	}
+}
+
+func testReserve(t *testing.T, m Meta) {
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "reserve", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create reserve: %s", st)
+	}
+	defer m.Unlink(ctx, 1, "reserve")
+	var off uint64
+	if st := m.Reserve(ctx, inode, 100, &off); st != 0 || off != 0 {
+		t.Fatalf("reserve: %s, off %d", st, off)
+	}
+	if st := m.Reserve(ctx, inode, 50, &off); st != 0 || off != 100 {
+		t.Fatalf("reserve: %s, off %d", st, off)
+	}
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Length != 150 {
+		t.Fatalf("getattr: %s, length %d", st, attr.Length)
+	}
+	if st := m.Reserve(ctx, inode, 0, &off); st != syscall.EINVAL {
+		t.Fatalf("reserve nothing: %s", st)
+	}
+	if st := m.Reserve(ctx, 1, 10, &off); st != syscall.EPERM {
+		t.Fatalf("reserve in directory: %s", st)
+	}
+	attr.Flags = FlagImmutable
+	if st := m.SetAttr(ctx, inode, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("set immutable: %s", st)
+	}
+	if st := m.Reserve(ctx, inode, 10, &off); st != syscall.EPERM {
+		t.Fatalf("reserve in immutable file: %s", st)
+	}
+	attr.Flags = 0
+	if st := m.SetAttr(ctx, inode, SetAttrFlag, 0, attr); st != 0 {
+		t.Fatalf("clear flags: %s", st)
+	}
+}
+
+func testParents(t *testing.T, m Meta) {
+	ctx := Background
+	var d1, d2, inode Ino
+	var attr = &Attr{}
+	if st := m.Mkdir(ctx, 1, "pd1", 0755, 022, 0, &d1, attr); st != 0 {
+		t.Fatalf("mkdir pd1: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "pd1")
+	if st := m.Mkdir(ctx, 1, "pd2", 0755, 022, 0, &d2, attr); st != 0 {
+		t.Fatalf("mkdir pd2: %s", st)
+	}
+	defer m.Rmdir(ctx, 1, "pd2")
+	if st := m.Create(ctx, d1, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	check := func(expected map[Ino]int) {
+		t.Helper()
+		if parents := m.GetParents(ctx, inode); !reflect.DeepEqual(parents, expected) {
+			t.Fatalf("parents of inode %d: %v, expected %v", inode, parents, expected)
+		}
+		if st := m.GetAttr(ctx, inode, attr); st != 0 {
+			t.Fatalf("getattr: %s", st)
+		}
+		if expected[attr.Parent] == 0 {
+			t.Fatalf("parent %d is not one of %v", attr.Parent, expected)
+		}
+	}
+	check(map[Ino]int{d1: 1})
+	if parents := m.GetParents(ctx, d1); !reflect.DeepEqual(parents, map[Ino]int{1: 1}) {
+		t.Fatalf("parents of dir: %v", parents)
+	}
+	for _, name := range []string{"l1", "l2"} {
+		if st := m.Link(ctx, inode, d2, name, attr); st != 0 {
+			t.Fatalf("link %s: %s", name, st)
+		}
+	}
+	if st := m.Link(ctx, inode, 1, "pl3", attr); st != 0 {
+		t.Fatalf("link pl3: %s", st)
+	}
+	check(map[Ino]int{d1: 1, d2: 2, 1: 1})
+	if paths := GetPaths(m, ctx, inode); !reflect.DeepEqual(paths, []string{"/pd1/f", "/pd2/l1", "/pd2/l2", "/pl3"}) {
+		t.Fatalf("paths of inode %d: %v", inode, paths)
+	}
+	if paths := GetPaths(m, ctx, d2); !reflect.DeepEqual(paths, []string{"/pd2"}) {
+		t.Fatalf("paths of dir %d: %v", d2, paths)
+	}
+	if st := m.Rename(ctx, d1, "f", d2, "f", 0, nil, attr); st != 0 {
+		t.Fatalf("rename f: %s", st)
+	}
+	check(map[Ino]int{d2: 3, 1: 1})
+	if st := m.Unlink(ctx, d2, "l1"); st != 0 {
+		t.Fatalf("unlink l1: %s", st)
+	}
+	check(map[Ino]int{d2: 2, 1: 1})
+	var other Ino
+	if st := m.Create(ctx, d1, "o", 0644, 022, 0, &other, attr); st != 0 {
+		t.Fatalf("create o: %s", st)
+	}
+	if st := m.Rename(ctx, d1, "o", d2, "l2", 0, nil, attr); st != 0 { // overwrite a link
+		t.Fatalf("rename o: %s", st)
+	}
+	check(map[Ino]int{d2: 1, 1: 1})
+	if st := m.Unlink(ctx, d2, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	check(map[Ino]int{1: 1})
+	if st := m.Unlink(ctx, 1, "pl3"); st != 0 {
+		t.Fatalf("unlink pl3: %s", st)
+	}
+	if st := m.Unlink(ctx, d2, "l2"); st != 0 {
+		t.Fatalf("unlink l2: %s", st)
+	}
+}
+
+func testCloseSession(t *testing.T, m Meta, base *baseMeta) {
+	_ = m.Init(Format{Name: "test"}, false)
+	if err := m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "f", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create f: %s", st)
+	}
+	if st := m.Flock(ctx, inode, 1, syscall.F_WRLCK, false); st != 0 {
+		t.Fatalf("flock wlock: %s", st)
+	}
+	if st := m.Setlk(ctx, inode, 1, false, syscall.F_WRLCK, 0x10000, 0x20000, 1); st != 0 {
+		t.Fatalf("plock wlock: %s", st)
+	}
+	if st := m.Open(ctx, inode, syscall.O_RDWR, attr); st != 0 {
+		t.Fatalf("open f: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "f"); st != 0 {
+		t.Fatalf("unlink f: %s", st)
+	}
+	var sid uint64
+	switch m := m.(type) {
+	case *redisMeta:
+		sid = m.sid
+	case *dbMeta:
+		sid = m.sid
+	case *kvMeta:
+		sid = m.sid
+	}
+	m.(interface{ refreshOpenFiles() }).refreshOpenFiles()
+	s, err := m.GetSession(sid)
+	if err != nil {
+		t.Fatalf("get session: %s", err)
+	} else {
+		if len(s.Flocks) != 1 || len(s.Plocks) != 1 || len(s.Sustained) != 1 {
+			t.Fatalf("incorrect session: flock %d plock %d sustained %d", len(s.Flocks), len(s.Plocks), len(s.Sustained))
+		}
+		if p := s.Plocks[0]; p.Inode != inode || p.Owner != 1 || len(p.Records) != 1 ||
+			p.Records[0] != (PlockRecord{Start: 0x10000, End: 0x20000, Type: "W", Pid: 1}) {
+			t.Fatalf("incorrect plock: %+v", p)
+		}
+		var refs int
+		for _, f := range s.OpenFiles {
+			if f.Inode == inode {
+				refs = f.Refs
+			}
+		}
+		if refs != 2 { // create and open
+			t.Fatalf("incorrect open files: refs of %d is %d", inode, refs)
+		}
+	}
+	base.flushSustained()
+	base.pendingTime = time.Time{} // skip the cache
+	var pending PendingUsage
+	if st := m.GetPendingUsage(ctx, &pending); st != 0 {
+		t.Fatalf("get pending usage: %s", st)
+	}
+	if pending.SustainedInodes < 1 || pending.SustainedSpace < 4096 {
+		t.Fatalf("incorrect pending usage: %+v", pending)
+	}
+	if err = m.CloseSession(); err != nil {
+		t.Fatalf("close session: %s", err)
+	}
+	if _, err = m.GetSession(sid); err == nil {
+		t.Fatalf("get a deleted session: %s", err)
+	}
+	switch m := m.(type) {
+	case *redisMeta:
+		s, err = m.getSession(strconv.FormatUint(sid, 10), true)
+	case *dbMeta:
+		s, err = m.getSession(&session{Sid: sid}, true)
+	case *kvMeta:
+		s, err = m.getSession(sid, true)
 	}
 	if err != nil {
 		t.Fatalf("get session: %s", err)
@@ -1095,6 +2951,54 @@ func testCloseSession(t *testing.T, m Meta) {
 	}
 }
 
+func testDeferredDelete(t *testing.T, m Meta, base *baseMeta) {
+	if err := m.Init(Format{Name: "test", SustainedGrace: 3600}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	defer func() {
+		if err := m.Init(Format{Name: "test"}, false); err != nil {
+			t.Fatalf("init: %s", err)
+		}
+	}()
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	if st := m.Create(ctx, 1, "df", 0644, 022, 0, &inode, attr); st != 0 {
+		t.Fatalf("create df: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "df"); st != 0 {
+		t.Fatalf("unlink df: %s", st)
+	}
+	// the session is cleaned up by another client
+	sid := base.sid
+	base.sid = sid + 1000
+	err := base.en.doDeleteSustainedInode(sid, inode)
+	base.sid = sid
+	if err != nil {
+		t.Fatalf("delete sustained inode %d: %s", inode, err)
+	}
+	// the inode is kept with its data
+	if st := m.GetAttr(ctx, inode, attr); st != 0 || attr.Nlink != 0 {
+		t.Fatalf("getattr of deferred inode: %s %d", st, attr.Nlink)
+	}
+	files, err := m.ListDeferredFiles()
+	if err != nil {
+		t.Fatalf("list deferred files: %s", err)
+	}
+	if len(files) != 1 || files[0].Inode != inode || files[0].Expire < time.Now().Unix()+3000 {
+		t.Fatalf("deferred files: %+v", files)
+	}
+	// purged after the grace period
+	base.en.doDeleteFileData(inode, 0)
+	if st := m.GetAttr(ctx, inode, attr); st != syscall.ENOENT {
+		t.Fatalf("getattr of purged inode: %s", st)
+	}
+	if files, _ = m.ListDeferredFiles(); len(files) != 0 {
+		t.Fatalf("deferred files should be empty: %+v", files)
+	}
+	_ = m.Close(ctx, inode)
+}
+
 func testTrash(t *testing.T, m Meta) {
 	if err := m.Init(Format{Name: "test", TrashDays: 1}, false); err != nil {
 		t.Fatalf("init: %s", err)
@@ -1149,6 +3053,14 @@ func testTrash(t *testing.T, m Meta) {
 	if len(entries) != 6 {
 		t.Fatalf("entries: %d", len(entries))
 	}
+	for _, e := range entries {
+		if name := string(e.Name); name == "." || name == ".." {
+			continue
+		}
+		if st := m.GetAttr(ctx, e.Inode, attr); st != 0 || attr.Parent != TrashInode+1 {
+			t.Fatalf("parent of %s in trash: %s, %d", e.Name, st, attr.Parent)
+		}
+	}
 	ctx2 := NewContext(1000, 1, []uint32{1})
 	if st := m.Unlink(ctx2, TrashInode+1, "d"); st != syscall.EPERM {
 		t.Fatalf("unlink d: %s", st)
@@ -1172,6 +3084,78 @@ func testTrash(t *testing.T, m Meta) {
 	}
 }
 
+func testTrashQuota(t *testing.T, m Meta, base *baseMeta) {
+	if err := m.Init(Format{Name: "test", TrashDays: 1, TrashQuota: 8 << 10}, false); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	defer func() {
+		if err := m.Init(Format{Name: "test", TrashDays: 1}, false); err != nil {
+			t.Fatalf("init: %s", err)
+		}
+	}()
+	base.recountTrash()
+	if used := base.trashUsed(); used != 0 {
+		t.Fatalf("trash should be empty, but used %d", used)
+	}
+	ctx := Background
+	var inode Ino
+	var attr = &Attr{}
+	for _, name := range []string{"tq1", "tq2", "tq3"} {
+		if st := m.Create(ctx, 1, name, 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+	}
+	if st := base.checkTrash(1, &inode); st != 0 {
+		t.Fatalf("create subTrash: %s", st)
+	}
+	var totalspace, availspace, iused, iavail uint64
+	if st := m.StatFS(Background, &totalspace, &availspace, &iused, &iavail); st != 0 {
+		t.Fatalf("statfs: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "tq1"); st != 0 {
+		t.Fatalf("unlink tq1: %s", st)
+	}
+	if used := base.trashUsed(); used != 4<<10 {
+		t.Fatalf("trash used %d, expect 4096", used)
+	}
+	var avail uint64
+	if st := m.StatFS(Background, &totalspace, &avail, &iused, &iavail); st != 0 {
+		t.Fatalf("statfs: %s", st)
+	}
+	if avail != availspace+4<<10 { // the removed file is moved into the space reserved for trash
+		t.Fatalf("available space %d -> %d", availspace, avail)
+	}
+	for _, name := range []string{"tq4", "tq5"} {
+		if st := m.Create(ctx, 1, name, 0644, 022, 0, &inode, attr); st != 0 {
+			t.Fatalf("create %s: %s", name, st)
+		}
+	}
+	if st := m.Rename(ctx, 1, "tq4", 1, "tq5", 0, &inode, attr); st != 0 {
+		t.Fatalf("rename tq4 -> tq5: %s", st)
+	}
+	if used := base.trashUsed(); used != 8<<10 { // the replaced one is moved into trash
+		t.Fatalf("trash used %d, expect 8192", used)
+	}
+	defer m.Unlink(ctx, 1, "tq5")
+	if st := m.Unlink(ctx, 1, "tq2"); st != 0 {
+		t.Fatalf("unlink tq2: %s", st)
+	}
+	if st := m.Unlink(ctx, 1, "tq3"); st != 0 {
+		t.Fatalf("unlink tq3: %s", st)
+	}
+	for i := 0; i < 50 && base.trashUsed() > 8<<10; i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if used := base.trashUsed(); used != 8<<10 {
+		t.Fatalf("trash should be purged to 8192, but used %d", used)
+	}
+	base.flushQuotas()
+	base.recountTrash()
+	if used := base.trashUsed(); used != 8<<10 {
+		t.Fatalf("trash used %d after recount, expect 8192", used)
+	}
+}
+
 func testOpenCache(t *testing.T, m Meta) {
 	ctx := Background
 	var inode Ino
@@ -0,0 +1,179 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"math/rand"
+	"syscall"
+	"time"
+)
+
+const (
+	// number of inodes checked in every round of scrub
+	scrubSample = 100
+	// max number of entries read from a directory to check an inode, to keep scrub lightweight
+	scrubMaxEntries = 10000
+)
+
+// kinds of anomalies found by scrub
+const (
+	anomalyParent = "parent" // the parent is missing or not a directory
+	anomalyEntry  = "entry"  // the parent has no entry of the inode
+	anomalyNlink  = "nlink"  // nlink doesn't match the entries
+	anomalyLength = "length" // there is data beyond the length of a file
+)
+
+type anomaly struct {
+	inode  Ino
+	kind   string
+	detail string
+}
+
+func (a *anomaly) String() string {
+	return fmt.Sprintf("inode %d (%s): %s", a.inode, a.kind, a.detail)
+}
+
+// scrubInodes checks a sample of inodes periodically, and reports the anomalies found as
+// metrics and logs, before they become visible to applications. The interval is randomized
+// by up to 20%, so the clients don't scrub all at once.
+func (m *baseMeta) scrubInodes() {
+	interval := m.conf.ScrubInterval
+	for {
+		time.Sleep(interval + time.Duration(rand.Int63n(int64(interval)/5+1)) - interval/10)
+		for _, a := range m.scrub(scrubSample) {
+			logger.Warnf("Scrub found anomaly of %s", a)
+		}
+	}
+}
+
+// scrub checks the invariants of up to n random inodes, and returns the anomalies found.
+// It only reads the metadata, and an anomaly is confirmed by checking again, in case it's
+// caused by concurrent changes.
+func (m *baseMeta) scrub(n int) []*anomaly {
+	ctx := Background
+	max, err := m.en.incrCounter("nextInode", 0)
+	if err != nil {
+		logger.Warnf("scrub: get counter nextInode: %s", err)
+		return nil
+	}
+	var found []*anomaly
+	if max <= 2 {
+		return found
+	}
+	for i := 0; i < n; i++ {
+		// the inodes are allocated in ranges leased from the counter, some of them are never used
+		inode := Ino(namespaced(m.fmt.ClusterID, uint64(2+rand.Int63n(max-2))))
+		a, checked := m.checkInode(ctx, inode)
+		if a != nil {
+			time.Sleep(time.Millisecond * 100)
+			if a, checked = m.checkInode(ctx, inode); a != nil {
+				scrubAnomalies.WithLabelValues(a.kind).Inc()
+				found = append(found, a)
+			}
+		}
+		if checked {
+			scrubbedInodes.Inc()
+		}
+	}
+	return found
+}
+
+// checkInode returns the anomaly found in the inode, and whether the inode is checked,
+// it's not checked if it doesn't exist or the metadata can't be read.
+func (m *baseMeta) checkInode(ctx Context, inode Ino) (*anomaly, bool) {
+	var attr Attr
+	if st := m.en.doGetAttr(ctx, inode, &attr); st != 0 {
+		if st != syscall.ENOENT {
+			logger.Debugf("scrub: getattr inode %d: %s", inode, st)
+		}
+		return nil, false
+	}
+	// a file with hard links may be not in the directory it was created in
+	if attr.Parent > 0 && (attr.Typ == TypeDirectory || attr.Nlink == 1) {
+		var pattr Attr
+		if st := m.en.doGetAttr(ctx, attr.Parent, &pattr); st == syscall.ENOENT {
+			return &anomaly{inode, anomalyParent, fmt.Sprintf("parent %d is not found", attr.Parent)}, true
+		} else if st != 0 {
+			return nil, false
+		}
+		if pattr.Typ != TypeDirectory {
+			return &anomaly{inode, anomalyParent, fmt.Sprintf("parent %d is not a directory", attr.Parent)}, true
+		}
+		entries, complete := m.scrubEntries(ctx, attr.Parent)
+		var exist bool
+		for _, e := range entries {
+			if e.Inode == inode {
+				exist = true
+				break
+			}
+		}
+		if !exist && complete {
+			return &anomaly{inode, anomalyEntry, fmt.Sprintf("no entry in parent %d", attr.Parent)}, true
+		}
+	}
+	switch attr.Typ {
+	case TypeDirectory:
+		entries, complete := m.scrubEntries(ctx, inode)
+		if !complete {
+			break
+		}
+		nlink := uint32(2)
+		for _, e := range entries {
+			if e.Attr.Typ == TypeDirectory {
+				nlink++
+			}
+		}
+		if attr.Nlink != nlink {
+			return &anomaly{inode, anomalyNlink, fmt.Sprintf("nlink is %d, but %d expected from entries", attr.Nlink, nlink)}, true
+		}
+	case TypeFile:
+		// only the chunk with the end of file and the next one are checked
+		indx := uint32(attr.Length / ChunkSize)
+		for i := indx; i <= indx+1; i++ {
+			var slices []Slice
+			if st := m.en.Read(ctx, inode, i, &slices); st != 0 {
+				return nil, false
+			}
+			var pos uint64 = uint64(i) * ChunkSize
+			for _, s := range slices {
+				if s.Chunkid > 0 && pos+uint64(s.Len) > attr.Length {
+					return &anomaly{inode, anomalyLength, fmt.Sprintf("slice %d at %d is beyond length %d", s.Chunkid, pos, attr.Length)}, true
+				}
+				pos += uint64(s.Len)
+			}
+		}
+	}
+	return nil, true
+}
+
+// scrubEntries returns up to scrubMaxEntries entries in the directory, and whether they are all of them.
+func (m *baseMeta) scrubEntries(ctx Context, inode Ino) ([]*Entry, bool) {
+	var entries []*Entry
+	var cursor string
+	var err error
+	for len(entries) < scrubMaxEntries {
+		if cursor, err = m.en.doReaddirAt(ctx, inode, 0, cursor, 1000, &entries); err != nil {
+			logger.Debugf("scrub: readdir inode %d: %s", inode, err)
+			return entries, false
+		}
+		if cursor == "" {
+			return entries, true
+		}
+	}
+	return entries, false
+}
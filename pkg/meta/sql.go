@@ -29,8 +29,8 @@ import (
 	"io"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -55,7 +55,7 @@ type counter struct {
 type edge struct {
 	Parent Ino    `xorm:"unique(edge) notnull"`
 	Name   string `xorm:"unique(edge) notnull"`
-	Inode  Ino    `xorm:"notnull"`
+	Inode  Ino    `xorm:"index notnull"`
 	Type   uint8  `xorm:"notnull"`
 }
 
@@ -101,6 +101,26 @@ type xattr struct {
 	Value []byte `xorm:"blob notnull"`
 }
 
+type tag struct {
+	Name  string `xorm:"unique(tag) varchar(255) notnull"`
+	Value []byte `xorm:"unique(tag) varbinary(255) notnull"`
+	Inode Ino    `xorm:"unique(tag) notnull"`
+}
+
+type event struct {
+	Id   uint64 `xorm:"pk"`
+	Time int64  `xorm:"index notnull"`
+	Data []byte `xorm:"blob notnull"`
+}
+
+type dirQuota struct {
+	Inode      Ino   `xorm:"pk"`
+	MaxSpace   int64 `xorm:"notnull"`
+	MaxInodes  int64 `xorm:"notnull"`
+	UsedSpace  int64 `xorm:"notnull"`
+	UsedInodes int64 `xorm:"notnull"`
+}
+
 type flock struct {
 	Inode Ino    `xorm:"notnull unique(flock)"`
 	Sid   uint64 `xorm:"notnull unique(flock)"`
@@ -126,6 +146,12 @@ type sustained struct {
 	Inode Ino    `xorm:"unique(sustained) notnull"`
 }
 
+type openfile struct {
+	Sid   uint64 `xorm:"unique(openfile) notnull"`
+	Inode Ino    `xorm:"unique(openfile) notnull"`
+	Refs  int    `xorm:"notnull"`
+}
+
 type delfile struct {
 	Inode  Ino    `xorm:"pk notnull"`
 	Length uint64 `xorm:"notnull"`
@@ -134,8 +160,10 @@ type delfile struct {
 
 type dbMeta struct {
 	baseMeta
-	db   *xorm.Engine
-	snap *dbSnap
+	name      string // name of the engine, CockroachDB uses the driver of postgres
+	db        *xorm.Engine
+	snap      *dbSnap
+	shareLock string // the clause to lock selected rows in share mode
 }
 type dbSnap struct {
 	node    map[Ino]*node
@@ -146,6 +174,10 @@ type dbSnap struct {
 }
 
 func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
+	name := driver
+	if driver == "cockroach" {
+		driver = "postgres"
+	}
 	if driver == "postgres" {
 		addr = driver + "://" + addr
 	}
@@ -175,9 +207,14 @@ func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
 	}
 
 	engine.SetTableMapper(names.NewPrefixMapper(engine.GetTableMapper(), "jfs_"))
+	if conf.Faults != nil {
+		engine.AddHook(sqlFaults{conf.Faults})
+	}
 	m := &dbMeta{
-		baseMeta: newBaseMeta(conf),
-		db:       engine,
+		baseMeta:  newBaseMeta(conf),
+		name:      name,
+		db:        engine,
+		shareLock: shareLockClause(engine, driver),
 	}
 	m.en = m
 	m.root, err = lookupSubdir(m, conf.Subdir)
@@ -185,12 +222,28 @@ func newSQLMeta(driver, addr string, conf *Config) (Meta, error) {
 	return m, err
 }
 
+// shareLockClause returns the clause to lock rows in share mode. SQLite serializes all the writers,
+// and TiDB supports only the exclusive locks.
+func shareLockClause(engine *xorm.Engine, driver string) string {
+	switch driver {
+	case "postgres":
+		return " for share"
+	case "mysql":
+		if r, err := engine.QueryString("select version() as v"); err == nil && len(r) > 0 && strings.Contains(r[0]["v"], "TiDB") {
+			return " for update"
+		}
+		return " lock in share mode"
+	default:
+		return ""
+	}
+}
+
 func (m *dbMeta) Name() string {
-	return m.db.DriverName()
+	return m.name
 }
 
 func (m *dbMeta) doDeleteSlice(chunkid uint64, size uint32) error {
-	return m.txn(func(ses *xorm.Session) error {
+	return m.txn(Background, func(ses *xorm.Session) error {
 		_, err := ses.Exec("delete from jfs_chunk_ref where chunkid=?", chunkid)
 		return err
 	})
@@ -222,8 +275,8 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.db.Sync2(new(edge)); err != nil && !strings.Contains(err.Error(), "Duplicate entry") {
 		logger.Fatalf("create table edge: %s", err)
 	}
-	if err := m.db.Sync2(new(node), new(symlink), new(xattr)); err != nil {
-		logger.Fatalf("create table node, symlink, xattr: %s", err)
+	if err := m.db.Sync2(new(node), new(symlink), new(xattr), new(tag), new(dirQuota)); err != nil {
+		logger.Fatalf("create table node, symlink, xattr, tag: %s", err)
 	}
 	if err := m.db.Sync2(new(chunk), new(chunkRef)); err != nil {
 		logger.Fatalf("create table chunk, chunk_ref: %s", err)
@@ -234,6 +287,12 @@ func (m *dbMeta) Init(format Format, force bool) error {
 	if err := m.db.Sync2(new(flock), new(plock)); err != nil {
 		logger.Fatalf("create table flock, plock: %s", err)
 	}
+	if err := m.db.Sync2(new(openfile)); err != nil {
+		logger.Fatalf("create table openfile: %s", err)
+	}
+	if err := m.db.Sync2(new(event)); err != nil {
+		logger.Fatalf("create table event: %s", err)
+	}
 	if m.db.DriverName() == "mysql" {
 		m.updateCollate()
 	}
@@ -262,6 +321,14 @@ func (m *dbMeta) Init(format Format, force bool) error {
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.TrashQuota = format.TrashQuota
+			old.SessionTimeout = format.SessionTimeout
+			old.SustainedGrace = format.SustainedGrace
+			old.ClusterID = format.ClusterID
+			old.AdminToken = format.AdminToken
+			old.ChangelogRetention = format.ChangelogRetention
+			old.GCAlertSpace = format.GCAlertSpace
+			old.CompressDict = format.CompressDict
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -286,7 +353,7 @@ func (m *dbMeta) Init(format Format, force bool) error {
 		Length: 4 << 10,
 		Parent: 1,
 	}
-	return m.txn(func(s *xorm.Session) error {
+	return m.txn(Background, func(s *xorm.Session) error {
 		if format.TrashDays > 0 {
 			ok2, err := s.Get(&node{Inode: TrashInode})
 			if err != nil {
@@ -321,10 +388,10 @@ func (m *dbMeta) Init(format Format, force bool) error {
 
 func (m *dbMeta) Reset() error {
 	return m.db.DropTables(&setting{}, &counter{},
-		&node{}, &edge{}, &symlink{}, &xattr{},
+		&node{}, &edge{}, &symlink{}, &xattr{}, &tag{}, &dirQuota{},
 		&chunk{}, &chunkRef{},
 		&session{}, &sustained{}, &delfile{},
-		&flock{}, &plock{})
+		&flock{}, &plock{}, &openfile{}, &event{})
 }
 
 func (m *dbMeta) Load() (*Format, error) {
@@ -346,6 +413,7 @@ func (m *dbMeta) Load() (*Format, error) {
 
 func (m *dbMeta) NewSession() error {
 	go m.refreshUsage()
+	m.startMetaCache()
 	if m.conf.ReadOnly {
 		return nil
 	}
@@ -359,9 +427,20 @@ func (m *dbMeta) NewSession() error {
 	if err := m.db.Sync2(new(flock), new(plock)); err != nil {
 		logger.Fatalf("update table flock, plock: %s", err)
 	}
+	if err := m.db.Sync2(new(openfile)); err != nil { // old volume has no openfile table
+		return err
+	}
+	if err := m.db.Sync2(new(tag)); err != nil { // old volume has no tag table
+		return err
+	}
+	if err := m.db.Sync2(new(dirQuota)); err != nil { // old volume has no dir_quota table
+		return err
+	}
+	if err := m.db.Sync2(new(event)); err != nil { // old volume has no event table
+		return err
+	}
 
-	info := newSessionInfo()
-	info.MountPoint = m.conf.MountPoint
+	info := newSessionInfo(m.conf)
 	data, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("json: %s", err)
@@ -372,7 +451,7 @@ func (m *dbMeta) NewSession() error {
 		if err != nil {
 			return fmt.Errorf("create session: %s", err)
 		}
-		err = m.txn(func(s *xorm.Session) error {
+		err = m.txn(Background, func(s *xorm.Session) error {
 			return mustInsert(s, &session{uint64(v), time.Now().Unix(), data})
 		})
 		if err == nil {
@@ -393,7 +472,12 @@ func (m *dbMeta) NewSession() error {
 	go m.cleanupDeletedFiles()
 	go m.cleanupSlices()
 	go m.cleanupTrash()
+	go m.cleanupChangelog()
+	if m.conf.ScrubInterval > 0 {
+		go m.scrubInodes()
+	}
 	go m.flushStats()
+	go m.flushUsage()
 	return nil
 }
 
@@ -434,7 +518,16 @@ func (m *dbMeta) getSession(row *session, detail bool) (*Session, error) {
 		}
 		s.Plocks = make([]Plock, 0, len(prows))
 		for _, prow := range prows {
-			s.Plocks = append(s.Plocks, Plock{prow.Inode, uint64(prow.Owner), prow.Records})
+			s.Plocks = append(s.Plocks, Plock{prow.Inode, uint64(prow.Owner), decodeLocks(prow.Records)})
+		}
+
+		var orows []openfile
+		if err := m.db.Asc("inode").Find(&orows, &openfile{Sid: s.Sid}); err != nil {
+			return nil, fmt.Errorf("find open files %d: %s", s.Sid, err)
+		}
+		s.OpenFiles = make([]OpenFile, 0, len(orows))
+		for _, orow := range orows {
+			s.OpenFiles = append(s.OpenFiles, OpenFile{orow.Inode, orow.Refs})
 		}
 	}
 	return &s, nil
@@ -452,7 +545,7 @@ func (m *dbMeta) GetSession(sid uint64) (*Session, error) {
 	return m.getSession(&row, true)
 }
 
-func (m *dbMeta) ListSessions() ([]*Session, error) {
+func (m *dbMeta) ListSessions(filter *SessionFilter) ([]*Session, error) {
 	var rows []session
 	err := m.db.Find(&rows)
 	if err != nil {
@@ -465,14 +558,16 @@ func (m *dbMeta) ListSessions() ([]*Session, error) {
 			logger.Errorf("get session: %s", err)
 			continue
 		}
-		sessions = append(sessions, s)
+		if filter.match(s) {
+			sessions = append(sessions, s)
+		}
 	}
 	return sessions, nil
 }
 
 func (m *dbMeta) incrCounter(name string, batch int64) (int64, error) {
 	var v int64
-	err := m.txn(func(s *xorm.Session) error {
+	err := m.txn(Background, func(s *xorm.Session) error {
 		var c = counter{Name: name}
 		ok, err := s.Get(&c)
 		if err != nil {
@@ -498,14 +593,20 @@ func mustInsert(s *xorm.Session, beans ...interface{}) error {
 	for i := 0; i < len(beans)/batchSize; i++ {
 		end = start + batchSize
 		inserted, err := s.Insert(beans[start:end]...)
-		if err == nil && int(inserted) < end-start {
+		if err != nil {
+			return err
+		}
+		if int(inserted) < end-start {
 			return fmt.Errorf("%d records not inserted: %+v", end-start-int(inserted), beans[start:end])
 		}
 		start = end
 	}
 	if len(beans)%batchSize != 0 {
 		inserted, err := s.Insert(beans[end:]...)
-		if err == nil && int(inserted) < len(beans)-end {
+		if err != nil {
+			return err
+		}
+		if int(inserted) < len(beans)-end {
 			return fmt.Errorf("%d records not inserted: %+v", len(beans)-end-int(inserted), beans[end:])
 		}
 	}
@@ -530,13 +631,22 @@ func (m *dbMeta) shouldRetry(err error) bool {
 		// MySQL, MariaDB or TiDB
 		return strings.Contains(msg, "try restarting transaction") || strings.Contains(msg, "try again later")
 	case "postgres":
-		return strings.Contains(msg, "current transaction is aborted") || strings.Contains(msg, "deadlock detected")
+		// PostgreSQL or CockroachDB, which asks clients to retry serializable transactions on conflicts
+		return strings.Contains(msg, "current transaction is aborted") || strings.Contains(msg, "deadlock detected") ||
+			strings.Contains(msg, "restart transaction") || strings.Contains(msg, "could not serialize access")
 	default:
 		return false
 	}
 }
 
-func (m *dbMeta) txn(f func(s *xorm.Session) error) error {
+// txn runs f in a single database transaction, retrying it on conflicts.
+//
+// Every operation, including rename with overwrite and moving entries into
+// trash, is applied within one transaction, so a crashed client leaves either
+// all or none of its statements. The work done after commit is recorded in the
+// same transaction (delfile and sustained), and resumed by cleanupDeletedFiles
+// and CleanStaleSessions.
+func (m *dbMeta) txn(ctx Context, f func(s *xorm.Session) error) error {
 	if m.conf.ReadOnly {
 		return syscall.EROFS
 	}
@@ -544,6 +654,10 @@ func (m *dbMeta) txn(f func(s *xorm.Session) error) error {
 	defer func() { txDist.Observe(time.Since(start).Seconds()) }()
 	var err error
 	for i := 0; i < 50; i++ {
+		// the transaction is not aborted once started, since it may be committed already
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
 		_, err = m.db.Transaction(func(s *xorm.Session) (interface{}, error) {
 			s.ForUpdate()
 			return nil, f(s)
@@ -590,7 +704,7 @@ func (m *dbMeta) flushStats() {
 		newSpace := atomic.SwapInt64(&m.newSpace, 0)
 		newInodes := atomic.SwapInt64(&m.newInodes, 0)
 		if newSpace != 0 || newInodes != 0 {
-			err := m.txn(func(s *xorm.Session) error {
+			err := m.txn(Background, func(s *xorm.Session) error {
 				_, err := s.Exec("UPDATE jfs_counter SET value=value+ CAST((CASE name WHEN 'usedSpace' THEN ? ELSE ? END) AS "+inttype+") WHERE name='usedSpace' OR name='totalInodes' ", newSpace, newInodes)
 				return err
 			})
@@ -632,6 +746,31 @@ func (m *dbMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	return errno(err)
 }
 
+func (m *dbMeta) doTouchAtime(ctx Context, inode Ino, attr *Attr, now time.Time) (bool, error) {
+	var updated bool
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		var cur = node{Inode: inode}
+		ok, err := s.Get(&cur)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		m.parseAttr(&cur, attr)
+		if !m.atimeNeedsUpdate(attr, now) {
+			return nil
+		}
+		cur.Atime = now.UnixNano() / 1e3
+		if _, err = s.Cols("atime").Update(&cur, &node{Inode: inode}); err == nil {
+			m.parseAttr(&cur, attr)
+			updated = true
+		}
+		return err
+	})
+	return updated, err
+}
+
 func clearSUGIDSQL(ctx Context, cur *node, set *Attr) {
 	switch runtime.GOOS {
 	case "darwin":
@@ -660,7 +799,7 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 	defer timeit(time.Now())
 	inode = m.checkRoot(inode)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return errno(m.txn(func(s *xorm.Session) error {
+	st := errno(m.txn(ctx, func(s *xorm.Session) error {
 		var cur = node{Inode: inode}
 		ok, err := s.Get(&cur)
 		if err != nil {
@@ -669,6 +808,9 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		if !ok {
 			return syscall.ENOENT
 		}
+		if st := checkFlags(ctx, cur.Flags, set, attr); st != 0 {
+			return st
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -677,6 +819,10 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			clearSUGIDSQL(ctx, &cur, attr)
 			changed = true
 		}
+		if set&SetAttrFlag != 0 && cur.Flags != attr.Flags {
+			cur.Flags = attr.Flags
+			changed = true
+		}
 		if set&SetAttrUID != 0 && cur.Uid != attr.Uid {
 			cur.Uid = attr.Uid
 			changed = true
@@ -718,12 +864,16 @@ func (m *dbMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			return nil
 		}
 		cur.Ctime = now
-		_, err = s.Cols("mode", "uid", "gid", "atime", "mtime", "ctime").Update(&cur, &node{Inode: inode})
+		_, err = s.Cols("flags", "mode", "uid", "gid", "atime", "mtime", "ctime").Update(&cur, &node{Inode: inode})
 		if err == nil {
 			m.parseAttr(&cur, attr)
 		}
 		return err
 	}))
+	if st == 0 {
+		m.emit(&Event{Type: EventSetAttr, Inode: inode})
+	}
+	return st
 }
 
 func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte) error {
@@ -745,6 +895,11 @@ func (m *dbMeta) appendSlice(s *xorm.Session, inode Ino, indx uint32, buf []byte
 
 func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -752,7 +907,8 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
 	var newSpace int64
-	err := m.txn(func(s *xorm.Session) error {
+	var parent Ino
+	err := m.txn(ctx, func(s *xorm.Session) error {
 		var n = node{Inode: inode}
 		ok, err := s.Get(&n)
 		if err != nil {
@@ -761,7 +917,7 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		if !ok {
 			return syscall.ENOENT
 		}
-		if n.Type != TypeFile {
+		if n.Type != TypeFile || n.Flags&(FlagImmutable|FlagAppend) != 0 {
 			return syscall.EPERM
 		}
 		if length == n.Length {
@@ -772,6 +928,10 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		if newSpace > 0 && m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = n.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		var c chunk
 		var zeroChunks []uint32
 		var left, right = n.Length, length
@@ -823,6 +983,8 @@ func (m *dbMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.emit(&Event{Type: EventSetAttr, Inode: inode})
 	}
 	return errno(err)
 }
@@ -844,6 +1006,11 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		return syscall.EINVAL
 	}
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -851,7 +1018,11 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
 	var newSpace int64
-	err := m.txn(func(s *xorm.Session) error {
+	var parent Ino
+	var holes []holeChunk
+	var released []*slice
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		holes, released = nil, nil
 		var n = node{Inode: inode}
 		ok, err := s.Get(&n)
 		if err != nil {
@@ -866,6 +1037,9 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if n.Type != TypeFile {
 			return syscall.EPERM
 		}
+		if n.Flags&FlagImmutable != 0 || n.Flags&FlagAppend != 0 && mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			return syscall.EPERM
+		}
 		length := n.Length
 		if off+size > n.Length {
 			if mode&fallocKeepSize == 0 {
@@ -878,6 +1052,10 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = n.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now().UnixNano() / 1e3
 		n.Length = length
 		n.Mtime = now
@@ -886,28 +1064,110 @@ func (m *dbMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 			return err
 		}
 		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
-			if off+size > old {
-				size = old - off
-			}
-			for size > 0 {
-				indx := uint32(off / ChunkSize)
-				coff := off % ChunkSize
-				l := size
-				if coff+size > ChunkSize {
-					l = ChunkSize - coff
+			holes = holeChunks(off, size, old)
+		}
+		for _, h := range holes {
+			if !h.whole {
+				if err = m.appendSlice(s, inode, h.indx, marshalSlice(h.off, 0, 0, 0, h.len)); err != nil {
+					return err
 				}
-				err = m.appendSlice(s, inode, indx, marshalSlice(uint32(coff), 0, 0, 0, uint32(l)))
-				if err != nil {
+				continue
+			}
+			var c chunk
+			ok, err := s.Where("inode = ? AND indx = ?", inode, h.indx).Get(&c)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			for _, sl := range readSliceBuf(c.Slices) {
+				if sl.chunkid == 0 {
+					continue
+				}
+				if _, err = s.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? AND size=?", sl.chunkid, sl.size); err != nil {
 					return err
 				}
-				off += l
-				size -= l
+				released = append(released, sl)
+			}
+			if _, err = s.Where("inode = ? AND indx = ?", inode, h.indx).Delete(&chunk{}); err != nil {
+				return err
 			}
 		}
 		return nil
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.emit(&Event{Type: EventSetAttr, Inode: inode})
+		for _, sl := range released {
+			var ref = chunkRef{Chunkid: sl.chunkid}
+			if ok, err := m.db.Get(&ref); err == nil && ok && ref.Refs <= 0 {
+				m.deleteSlice(sl.chunkid, sl.size)
+			}
+		}
+		for _, h := range holes {
+			if !h.whole {
+				// release the slices covered by the hole
+				go m.compactChunk(inode, h.indx, false)
+			}
+		}
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno {
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
+	f := m.of.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+	}
+	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
+	var newSpace int64
+	var parent Ino
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		var n = node{Inode: inode}
+		ok, err := s.Get(&n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if n.Type != TypeFile {
+			return syscall.EPERM
+		}
+		if n.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		newSpace = align4K(n.Length+size) - align4K(n.Length)
+		if m.checkQuota(newSpace, 0) {
+			return syscall.ENOSPC
+		}
+		parent = n.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
+		*off = n.Length
+		now := time.Now().UnixNano() / 1e3
+		n.Length += size
+		n.Mtime = now
+		n.Ctime = now
+		_, err = s.Cols("length", "mtime", "ctime").Update(&n, &node{Inode: inode})
+		return err
+	})
+	if err == nil {
+		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -918,6 +1178,42 @@ func (m *dbMeta) doReadlink(ctx Context, inode Ino) ([]byte, error) {
 	return []byte(l.Target), err
 }
 
+// getParents returns the parents of a file with the number of its entries in each of them.
+func (m *dbMeta) getParents(s *xorm.Session, inode Ino) (map[Ino]int, error) {
+	var rows []edge
+	if err := s.Find(&rows, &edge{Inode: inode}); err != nil {
+		return nil, err
+	}
+	parents := make(map[Ino]int)
+	for _, e := range rows {
+		parents[e.Parent]++
+	}
+	return parents, nil
+}
+
+// moveParent keeps the parent of a hard linked file as one of its links when a link is moved
+// from src to dst, it should be called before the entries are changed.
+func (m *dbMeta) moveParent(s *xorm.Session, n *node, src, dst Ino) error {
+	parents, err := m.getParents(s, n.Inode)
+	if err != nil {
+		return err
+	}
+	attr := Attr{Parent: n.Parent, Nlink: n.Nlink}
+	updateParents(parents, &attr, src, dst)
+	n.Parent = attr.Parent
+	return nil
+}
+
+func (m *dbMeta) doGetParents(ctx Context, inode Ino) (map[Ino]int, error) {
+	var parents map[Ino]int
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		var err error
+		parents, err = m.getParents(s, inode)
+		return err
+	})
+	return parents, err
+}
+
 func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode, cumask uint16, rdev uint32, path string, inode *Ino, attr *Attr) syscall.Errno {
 	if m.checkQuota(4<<10, 1) {
 		return syscall.ENOSPC
@@ -958,7 +1254,7 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		*inode = ino
 	}
 
-	err = m.txn(func(s *xorm.Session) error {
+	err = m.txn(ctx, func(s *xorm.Session) error {
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
 		if err != nil {
@@ -970,6 +1266,9 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1028,6 +1327,8 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 			if err = mustInsert(s, &symlink{Inode: ino, Target: path}); err != nil {
 				return err
 			}
+		} else if err = m.inheritXattrs(s, parent, _type == TypeDirectory, ino); err != nil {
+			return err
 		}
 		m.parseAttr(&n, attr)
 		return nil
@@ -1038,7 +1339,125 @@ func (m *dbMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 	return errno(err)
 }
 
-func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
+// inheritXattrs sets the xattrs derived from the default xattrs of parent to the new children of it.
+func (m *dbMeta) inheritXattrs(s *xorm.Session, parent Ino, dir bool, inodes ...Ino) error {
+	var xs []xattr
+	if err := s.Where("inode = ? AND name LIKE ?", parent, DefaultXattrPrefix+"%").Find(&xs); err != nil {
+		return err
+	}
+	xattrs := make(map[string][]byte, len(xs))
+	for _, x := range xs {
+		xattrs[x.Name] = x.Value
+	}
+	inherited := inheritedXattrs(xattrs, dir)
+	if len(inherited) == 0 {
+		return nil
+	}
+	var beans []interface{}
+	for _, inode := range inodes {
+		for name, value := range inherited {
+			beans = append(beans, &xattr{inode, name, value})
+			if strings.HasPrefix(name, TagPrefix) {
+				beans = append(beans, &tag{name[len(TagPrefix):], value, inode})
+			}
+		}
+	}
+	return mustInsert(s, beans...)
+}
+
+func (m *dbMeta) doBatchMknod(ctx Context, parent Ino, names []string, _type uint8, mode, cumask uint16, inodes []Ino, sts []syscall.Errno) syscall.Errno {
+	if m.checkQuota(align4K(0)*int64(len(names)), int64(len(names))) {
+		return syscall.ENOSPC
+	}
+	// the inodes are allocated before the transaction, the ones of existing entries are wasted
+	news := make([]Ino, len(names))
+	for i := range news {
+		ino, err := m.nextInode()
+		if err != nil {
+			return errno(err)
+		}
+		news[i] = ino
+	}
+	var created int64
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		created = 0
+		var pn = node{Inode: parent}
+		ok, err := s.Get(&pn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if pn.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if pn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		var edges []edge
+		if err = s.Where("parent = ?", parent).In("name", names).Find(&edges); err != nil {
+			return err
+		}
+		found := make(map[string]Ino, len(names))
+		for _, e := range edges {
+			found[e.Name] = e.Inode
+		}
+
+		now := time.Now().UnixNano() / 1e3
+		var beans []interface{}
+		for i, name := range names {
+			if ino, ok := found[name]; ok {
+				inodes[i], sts[i] = ino, syscall.EEXIST
+				continue
+			}
+			n := &node{Inode: news[i], Type: _type, Mode: mode & ^cumask, Uid: ctx.Uid(), Gid: ctx.Gid(), Parent: parent}
+			if _type == TypeDirectory {
+				pn.Nlink++
+				n.Nlink = 2
+				n.Length = 4 << 10
+			} else {
+				n.Nlink = 1
+			}
+			n.Atime, n.Mtime, n.Ctime = now, now, now
+			if pn.Mode&02000 != 0 || ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
+				n.Gid = pn.Gid
+				if _type == TypeDirectory && runtime.GOOS == "linux" {
+					n.Mode |= pn.Mode & 02000
+				}
+			}
+			beans = append(beans, &edge{parent, name, n.Inode, _type}, n)
+			found[name] = n.Inode
+			inodes[i], sts[i] = n.Inode, 0
+			created++
+		}
+		if created == 0 {
+			return nil
+		}
+		if err = mustInsert(s, beans...); err != nil {
+			return err
+		}
+		var created []Ino
+		for i := range names {
+			if sts[i] == 0 {
+				created = append(created, inodes[i])
+			}
+		}
+		if err = m.inheritXattrs(s, parent, _type == TypeDirectory, created...); err != nil {
+			return err
+		}
+		pn.Mtime = now
+		pn.Ctime = now
+		_, err = s.Cols("nlink", "mtime", "ctime").Update(&pn, &node{Inode: pn.Inode})
+		return err
+	})
+	if err == nil {
+		m.updateStats(align4K(0)*created, created)
+	}
+	return errno(err)
+}
+
+func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string, attr *Attr) syscall.Errno {
 	var trash Ino
 	if st := m.checkTrash(parent, &trash); st != 0 {
 		return st
@@ -1046,7 +1465,7 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 	var newSpace, newInode int64
 	var n node
 	var opened bool
-	err := m.txn(func(s *xorm.Session) error {
+	err := m.txn(ctx, func(s *xorm.Session) error {
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
 		if err != nil {
@@ -1058,6 +1477,9 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1086,10 +1508,14 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		now := time.Now().UnixNano() / 1e3
 		opened = false
 		if ok {
+			if n.Flags&(FlagImmutable|FlagAppend) != 0 || pn.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && pn.Mode&01000 != 0 && ctx.Uid() != pn.Uid && ctx.Uid() != n.Uid {
 				return syscall.EACCES
 			}
 			n.Ctime = now
+			linked := n.Nlink > 1
 			if trash == 0 {
 				n.Nlink--
 				if n.Type == TypeFile && n.Nlink == 0 {
@@ -1098,6 +1524,11 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			} else if n.Nlink == 1 {
 				n.Parent = trash
 			}
+			if linked {
+				if err = m.moveParent(s, &n, parent, trash); err != nil {
+					return err
+				}
+			}
 		} else {
 			logger.Warnf("no attribute for inode %d (%d, %s)", e.Inode, parent, name)
 			trash = 0
@@ -1114,7 +1545,7 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			return err
 		}
 		if n.Nlink > 0 {
-			if _, err := s.Cols("nlink", "ctime").Update(&n, &node{Inode: e.Inode}); err != nil {
+			if _, err := s.Cols("nlink", "ctime", "parent").Update(&n, &node{Inode: e.Inode}); err != nil {
 				return err
 			}
 			if trash > 0 {
@@ -1158,6 +1589,9 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		}
 		return err
 	})
+	if err == nil {
+		m.parseAttr(&n, attr)
+	}
 	if err == nil && trash == 0 {
 		if n.Type == TypeFile && n.Nlink == 0 {
 			m.fileDeleted(opened, n.Inode, n.Length)
@@ -1167,12 +1601,14 @@ func (m *dbMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 	return errno(err)
 }
 
-func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
-	var trash Ino
-	if st := m.checkTrash(parent, &trash); st != 0 {
-		return st
-	}
-	err := m.txn(func(s *xorm.Session) error {
+func (m *dbMeta) doBatchUnlink(ctx Context, parent Ino, names []string, sts []syscall.Errno, space, inodes *int64) syscall.Errno {
+	var files []node // files to be deleted
+	var opened []bool
+	var newSpace, newInode int64
+	var usedSpace, usedInodes int64
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		files, opened = files[:0], opened[:0]
+		newSpace, newInode, usedSpace, usedInodes = 0, 0, 0, 0
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
 		if err != nil {
@@ -1184,40 +1620,212 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
-		var e = edge{Parent: parent, Name: name}
-		ok, err = s.Get(&e)
-		if err != nil {
-			return err
-		}
-		if !ok && m.conf.CaseInsensi {
-			if ee := m.resolveCase(ctx, parent, name); ee != nil {
-				ok = true
-				e.Inode = ee.Inode
-				e.Name = string(ee.Name)
-				e.Type = ee.Attr.Typ
-			}
-		}
-		if !ok {
-			return syscall.ENOENT
-		}
-		if e.Type != TypeDirectory {
-			return syscall.ENOTDIR
+		if pn.Flags&(FlagImmutable|FlagAppend) != 0 {
+			return syscall.EPERM
 		}
-		exist, err := s.Exist(&edge{Parent: e.Inode})
-		if err != nil {
+		var edges []edge
+		if err = s.Where("parent = ?", parent).In("name", names).Find(&edges); err != nil {
 			return err
 		}
-		if exist {
-			return syscall.ENOTEMPTY
+		found := make(map[string]*edge, len(edges))
+		var inos []Ino
+		for i := range edges {
+			found[edges[i].Name] = &edges[i]
+			inos = append(inos, edges[i].Inode)
 		}
-		var n = node{Inode: e.Inode}
-		ok, err = s.Get(&n)
-		if err != nil {
-			return err
+		var rows []node
+		if len(inos) > 0 {
+			if err = s.In("inode", inos).Find(&rows); err != nil {
+				return err
+			}
+		}
+		nodes := make(map[Ino]*node, len(rows))
+		for i := range rows {
+			nodes[rows[i].Inode] = &rows[i]
+		}
+
+		now := time.Now().UnixNano() / 1e3
+		var removed []string
+		var gone, symlinks, noXattrs []Ino
+		var dels []interface{}
+		for i, name := range names {
+			e := found[name]
+			if e == nil {
+				sts[i] = syscall.ENOENT
+				continue
+			}
+			if e.Type == TypeDirectory {
+				sts[i] = syscall.EPERM
+				continue
+			}
+			n := nodes[e.Inode]
+			if n == nil {
+				logger.Warnf("no attribute for inode %d (%d, %s)", e.Inode, parent, name)
+				delete(found, name)
+				removed = append(removed, name)
+				sts[i] = 0
+				continue
+			}
+			if n.Flags&(FlagImmutable|FlagAppend) != 0 {
+				sts[i] = syscall.EPERM
+				continue
+			}
+			if ctx.Uid() != 0 && pn.Mode&01000 != 0 && ctx.Uid() != pn.Uid && ctx.Uid() != n.Uid {
+				sts[i] = syscall.EACCES
+				continue
+			}
+			delete(found, name)
+			sts[i] = 0
+			var attr Attr
+			m.parseAttr(n, &attr)
+			us, ui := usage(&attr)
+			usedSpace += us
+			usedInodes += ui
+			n.Ctime = now
+			if n.Nlink > 1 {
+				// the parent is calculated from the other links, so it's removed at once
+				if err = m.moveParent(s, n, parent, 0); err != nil {
+					return err
+				}
+				n.Nlink--
+				if _, err = s.Delete(&edge{Parent: parent, Name: name}); err != nil {
+					return err
+				}
+				if _, err = s.Cols("nlink", "ctime", "parent").Update(n, &node{Inode: n.Inode}); err != nil {
+					return err
+				}
+				continue
+			}
+			removed = append(removed, name)
+			n.Nlink = 0
+			noXattrs = append(noXattrs, n.Inode)
+			switch n.Type {
+			case TypeFile:
+				if m.of.IsOpen(n.Inode) {
+					if err = mustInsert(s, sustained{m.sid, n.Inode}); err != nil {
+						return err
+					}
+					if _, err = s.Cols("nlink", "ctime").Update(n, &node{Inode: n.Inode}); err != nil {
+						return err
+					}
+					files = append(files, *n)
+					opened = append(opened, true)
+					continue
+				}
+				dels = append(dels, &delfile{n.Inode, n.Length, time.Now().Unix()})
+				files = append(files, *n)
+				opened = append(opened, false)
+				newSpace, newInode = newSpace-align4K(n.Length), newInode-1
+			case TypeSymlink:
+				symlinks = append(symlinks, n.Inode)
+				fallthrough
+			default:
+				newSpace, newInode = newSpace-align4K(0), newInode-1
+			}
+			gone = append(gone, n.Inode)
+		}
+		if len(removed) > 0 {
+			if _, err = s.Where("parent = ?", parent).In("name", removed).Delete(&edge{}); err != nil {
+				return err
+			}
+		}
+		if len(dels) > 0 {
+			if err = mustInsert(s, dels...); err != nil {
+				return err
+			}
+		}
+		if len(symlinks) > 0 {
+			if _, err = s.In("inode", symlinks).Delete(&symlink{}); err != nil {
+				return err
+			}
+		}
+		if len(gone) > 0 {
+			if _, err = s.In("inode", gone).Delete(&node{}); err != nil {
+				return err
+			}
+		}
+		if len(noXattrs) > 0 {
+			if _, err = s.In("inode", noXattrs).Delete(&xattr{}); err != nil {
+				return err
+			}
+		}
+		pn.Mtime = now
+		pn.Ctime = now
+		_, err = s.Cols("mtime", "ctime").Update(&pn, &node{Inode: pn.Inode})
+		return err
+	})
+	if err != nil {
+		return errno(err)
+	}
+	for i, n := range files {
+		m.of.InvalidateChunk(n.Inode, 0xFFFFFFFE)
+		m.fileDeleted(opened[i], n.Inode, n.Length)
+	}
+	m.updateStats(newSpace, newInode)
+	*space, *inodes = usedSpace, usedInodes
+	return 0
+}
+
+func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
+	var trash Ino
+	if st := m.checkTrash(parent, &trash); st != 0 {
+		return st
+	}
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		var pn = node{Inode: parent}
+		ok, err := s.Get(&pn)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if pn.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if pn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		var e = edge{Parent: parent, Name: name}
+		ok, err = s.ForUpdate().Get(&e)
+		if err != nil {
+			return err
+		}
+		if !ok && m.conf.CaseInsensi {
+			if ee := m.resolveCase(ctx, parent, name); ee != nil {
+				ok = true
+				e.Inode = ee.Inode
+				e.Name = string(ee.Name)
+				e.Type = ee.Attr.Typ
+			}
+		}
+		if !ok {
+			return syscall.ENOENT
+		}
+		if e.Type != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		// lock the directory to be removed (not the parent) before checking it's empty, which waits
+		// for the renames into it, as they lock it in share mode. The check is a locking read too,
+		// so it sees the entries committed after the transaction started.
+		var n = node{Inode: e.Inode}
+		ok, err = s.ForUpdate().Get(&n)
+		if err != nil {
+			return err
+		}
+		exist, err := s.ForUpdate().Get(&edge{Parent: e.Inode})
+		if err != nil {
+			return err
+		}
+		if exist {
+			return syscall.ENOTEMPTY
 		}
 
 		now := time.Now().UnixNano() / 1e3
 		if ok {
+			if n.Flags&(FlagImmutable|FlagAppend) != 0 || pn.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && pn.Mode&01000 != 0 && ctx.Uid() != pn.Uid && ctx.Uid() != n.Uid {
 				return syscall.EACCES
 			}
@@ -1237,7 +1845,7 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 			return err
 		}
 		if trash > 0 {
-			if _, err = s.Cols("nlink", "ctime").Update(&n, &node{Inode: n.Inode}); err != nil {
+			if _, err = s.Cols("ctime", "parent").Update(&n, &node{Inode: n.Inode}); err != nil {
 				return err
 			}
 			if err = mustInsert(s, &edge{trash, fmt.Sprintf("%d-%d-%s", parent, e.Inode, e.Name), e.Inode, e.Type}); err != nil {
@@ -1260,17 +1868,28 @@ func (m *dbMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	return errno(err)
 }
 
-func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode, rinode *Ino, attr, rattr *Attr) syscall.Errno {
 	var trash Ino
 	if st := m.checkTrash(parentDst, &trash); st != 0 {
 		return st
 	}
 	exchange := flags == RenameExchange
+	var wino Ino
+	if flags&RenameWhiteout != 0 {
+		if m.checkQuota(4<<10, 1) {
+			return syscall.ENOSPC
+		}
+		var err error
+		if wino, err = m.nextInode(); err != nil {
+			return errno(err)
+		}
+	}
 	var opened bool
 	var dino Ino
 	var dn node
 	var newSpace, newInode int64
-	err := m.txn(func(s *xorm.Session) error {
+	var smtime, dmtime int64
+	err := m.txn(ctx, func(s *xorm.Session) error {
 		var se = edge{Parent: parentSrc, Name: nameSrc}
 		ok, err := s.Get(&se)
 		if err != nil {
@@ -1304,6 +1923,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		if spn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if spn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		var dpn = node{Inode: parentDst}
 		ok, err = s.Get(&dpn)
 		if err != nil {
@@ -1315,6 +1937,9 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		if dpn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if dpn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		var sn = node{Inode: se.Inode}
 		ok, err = s.Get(&sn)
 		if err != nil {
@@ -1323,6 +1948,7 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		if !ok {
 			return syscall.ENOENT
 		}
+		snlink, dnlink := spn.Nlink, dpn.Nlink
 
 		var de = edge{Parent: parentDst, Name: nameDst}
 		ok, err = s.Get(&de)
@@ -1341,7 +1967,7 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		opened = false
 		dn = node{Inode: de.Inode}
 		if ok {
-			if flags == RenameNoReplace {
+			if flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
 			dino = de.Inode
@@ -1374,6 +2000,7 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 						dn.Parent = trash
 					}
 				} else {
+					linked := dn.Nlink > 1 && dino != se.Inode
 					if trash == 0 {
 						dn.Nlink--
 						if de.Type == TypeFile && dn.Nlink == 0 {
@@ -1383,8 +2010,16 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 					} else if dn.Nlink == 1 {
 						dn.Parent = trash
 					}
+					if linked {
+						if err = m.moveParent(s, &dn, parentDst, trash); err != nil {
+							return err
+						}
+					}
 				}
 			}
+			if dn.Flags&(FlagImmutable|FlagAppend) != 0 || dpn.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && dpn.Mode&01000 != 0 && ctx.Uid() != dpn.Uid && ctx.Uid() != dn.Uid {
 				return syscall.EACCES
 			}
@@ -1394,14 +2029,20 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			}
 			dino = 0
 		}
+		if sn.Flags&(FlagImmutable|FlagAppend) != 0 || spn.Flags&FlagAppend != 0 {
+			return syscall.EPERM
+		}
 		if ctx.Uid() != 0 && spn.Mode&01000 != 0 && ctx.Uid() != spn.Uid && ctx.Uid() != sn.Uid {
 			return syscall.EACCES
 		}
 
-		spn.Mtime = now
-		spn.Ctime = now
-		dpn.Mtime = now
-		dpn.Ctime = now
+		smtime, dmtime = 0, 0
+		if !m.skipDirMtime(time.Unix(0, spn.Mtime*1e3), time.Unix(0, now*1e3)) {
+			smtime = now
+		}
+		if !m.skipDirMtime(time.Unix(0, dpn.Mtime*1e3), time.Unix(0, now*1e3)) {
+			dmtime = now
+		}
 		sn.Parent = parentDst
 		sn.Ctime = now
 		if se.Type == TypeDirectory && parentSrc != parentDst {
@@ -1424,7 +2065,14 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				return err
 			}
 		} else {
-			if n, err := s.Delete(&edge{Parent: parentSrc, Name: se.Name}); err != nil {
+			if wino > 0 {
+				if _, err := s.Cols("inode", "type").Update(&edge{Inode: wino, Type: TypeCharDev}, &edge{Parent: parentSrc, Name: se.Name}); err != nil {
+					return err
+				}
+				if err = mustInsert(s, &node{Inode: wino, Type: TypeCharDev, Uid: ctx.Uid(), Gid: ctx.Gid(), Atime: now, Mtime: now, Ctime: now, Nlink: 1, Parent: parentSrc}); err != nil {
+					return err
+				}
+			} else if n, err := s.Delete(&edge{Parent: parentSrc, Name: se.Name}); err != nil {
 				return err
 			} else if n != 1 {
 				return fmt.Errorf("delete src failed")
@@ -1439,7 +2087,7 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 						return err
 					}
 				} else if de.Type != TypeDirectory && dn.Nlink > 0 {
-					if _, err := s.Cols("ctime", "nlink").Update(dn, &node{Inode: dino}); err != nil {
+					if _, err := s.Cols("ctime", "nlink", "parent").Update(dn, &node{Inode: dino}); err != nil {
 						return err
 					}
 				} else {
@@ -1483,30 +2131,90 @@ func (m *dbMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				return err
 			}
 		}
-		if parentDst != parentSrc && !isTrash(parentSrc) {
-			if _, err := s.Cols("nlink", "mtime", "ctime").Update(&spn, &node{Inode: parentSrc}); err != nil {
-				return err
-			}
-		}
 		if _, err := s.Cols("ctime", "parent").Update(&sn, &node{Inode: sn.Inode}); err != nil {
 			return err
 		}
-		if _, err := s.Cols("nlink", "mtime", "ctime").Update(&dpn, &node{Inode: parentDst}); err != nil {
-			return err
+		// the parents were not locked when read, update them at last and in order of inode
+		// to avoid deadlock. The destination is locked in share mode if its nlink is not changed,
+		// so it can't be removed by rmdir after the new entry is added, but the other renames
+		// into it can go on concurrently.
+		sdelta, ddelta := int(spn.Nlink)-int(snlink), int(dpn.Nlink)-int(dnlink)
+		if parentDst == parentSrc || isTrash(parentSrc) {
+			return m.updateParent(s, parentDst, ddelta, true)
+		}
+		if parentSrc < parentDst {
+			if err = m.updateParent(s, parentSrc, sdelta, false); err == nil {
+				err = m.updateParent(s, parentDst, ddelta, true)
+			}
+		} else {
+			if err = m.updateParent(s, parentDst, ddelta, true); err == nil {
+				err = m.updateParent(s, parentSrc, sdelta, false)
+			}
 		}
 		return err
 	})
-	if err == nil && !exchange && trash == 0 {
-		if dino > 0 && dn.Type == TypeFile && dn.Nlink == 0 {
+	if err == nil {
+		// the times of parents are updated after the rename is committed, which needs the
+		// exclusive lock of them only for a short while
+		if dmtime > 0 {
+			m.updateDirTime(ctx, parentDst, dmtime)
+		}
+		if smtime > 0 && parentSrc != parentDst && !isTrash(parentSrc) {
+			m.updateDirTime(ctx, parentSrc, smtime)
+		}
+		if dino > 0 {
+			*rinode = dino
+			m.parseAttr(&dn, rattr)
+		}
+	}
+	if err == nil && !exchange {
+		if trash == 0 && dino > 0 && dn.Type == TypeFile && dn.Nlink == 0 {
 			m.fileDeleted(opened, dino, dn.Length)
 		}
+		if wino > 0 {
+			newSpace, newInode = newSpace+align4K(0), newInode+1
+		}
 		m.updateStats(newSpace, newInode)
 	}
 	return errno(err)
 }
 
+// updateParent changes the nlink of a directory by delta. If the nlink is not changed and lock is true,
+// the directory is locked in share mode, so it can't be removed by rmdir concurrently.
+func (m *dbMeta) updateParent(s *xorm.Session, inode Ino, delta int, lock bool) error {
+	if delta != 0 {
+		r, err := s.Exec("update jfs_node set nlink=nlink+? where inode=?", delta, inode)
+		if err != nil {
+			return err
+		}
+		if n, _ := r.RowsAffected(); n == 0 && lock {
+			return syscall.ENOENT
+		}
+	} else if lock {
+		rows, err := s.QueryString("select inode from jfs_node where inode=?"+m.shareLock, inode)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return syscall.ENOENT
+		}
+	}
+	return nil
+}
+
+// updateDirTime sets the mtime and ctime of a directory, unless it was updated later by others.
+func (m *dbMeta) updateDirTime(ctx Context, inode Ino, mtime int64) {
+	err := m.txn(ctx, func(s *xorm.Session) error {
+		_, err := s.Exec("update jfs_node set mtime=?, ctime=? where inode=? and mtime<?", mtime, mtime, inode, mtime)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("update mtime of directory %d: %s", inode, err)
+	}
+}
+
 func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
-	return errno(m.txn(func(s *xorm.Session) error {
+	return errno(m.txn(ctx, func(s *xorm.Session) error {
 		var pn = node{Inode: parent}
 		ok, err := s.Get(&pn)
 		if err != nil {
@@ -1518,6 +2226,9 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 		if pn.Type != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pn.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		var e = edge{Parent: parent, Name: name}
 		ok, err = s.Get(&e)
 		if err != nil {
@@ -1535,7 +2246,7 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 		if !ok {
 			return syscall.ENOENT
 		}
-		if n.Type == TypeDirectory {
+		if n.Type == TypeDirectory || n.Flags&(FlagImmutable|FlagAppend) != 0 {
 			return syscall.EPERM
 		}
 
@@ -1561,13 +2272,28 @@ func (m *dbMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 	}))
 }
 
-func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
-	dbSession := m.db.Table(&edge{})
-	if plus != 0 {
-		dbSession = dbSession.Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode")
+// readdirSession selects only the columns asked by plus (wantattr).
+func (m *dbMeta) readdirSession(plus uint8) *xorm.Session {
+	s := m.db.Table(&edge{})
+	if plus != ReaddirType {
+		s = s.Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode")
+		if plus&ReaddirFull == 0 {
+			cols := []string{"jfs_edge.inode", "jfs_edge.name", "jfs_node.type"}
+			if plus&ReaddirSize != 0 {
+				cols = append(cols, "jfs_node.length")
+			}
+			if plus&ReaddirMtime != 0 {
+				cols = append(cols, "jfs_node.mtime")
+			}
+			s = s.Select(strings.Join(cols, ", "))
+		}
 	}
+	return s
+}
+
+func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
 	var nodes []namedNode
-	if err := dbSession.Find(&nodes, &edge{Parent: inode}); err != nil {
+	if err := m.readdirSession(plus).Find(&nodes, &edge{Parent: inode}); err != nil {
 		return errno(err)
 	}
 	for _, n := range nodes {
@@ -1586,6 +2312,138 @@ func (m *dbMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 	return 0
 }
 
+func (m *dbMeta) doReaddirAt(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, error) {
+	// cursor is the name of last entry returned
+	s := m.readdirSession(plus).Where("jfs_edge.parent = ?", inode)
+	if cursor != "" {
+		s = s.And("jfs_edge.name > ?", cursor)
+	}
+	var nodes []namedNode
+	if err := s.OrderBy("jfs_edge.name").Limit(limit).Find(&nodes); err != nil {
+		return "", err
+	}
+	for _, n := range nodes {
+		entry := &Entry{
+			Inode: n.Inode,
+			Name:  []byte(n.Name),
+			Attr:  &Attr{},
+		}
+		if plus != 0 {
+			m.parseAttr(&n.node, entry.Attr)
+		} else {
+			entry.Attr.Typ = n.Type
+		}
+		*entries = append(*entries, entry)
+	}
+	if len(nodes) < limit {
+		return "", nil
+	}
+	return nodes[len(nodes)-1].Name, nil
+}
+
+func (m *dbMeta) doGetDirSummary(ctx Context, inode Ino, summary *Summary) ([]Ino, syscall.Errno) {
+	// the space of every file is aligned to 4K, and 4K for empty ones, the same as align4K
+	sums, err := m.db.Table(&edge{}).Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode").
+		Where("jfs_edge.parent = ? AND jfs_edge.type <> ?", inode, TypeDirectory).
+		SumsInt(&edge{}, "(1)", "jfs_node.length",
+			"CASE WHEN jfs_node.length = 0 THEN 4096 ELSE jfs_node.length + 4095 - (jfs_node.length + 4095) % 4096 END")
+	if err != nil {
+		return nil, errno(err)
+	}
+	var dirs []Ino
+	if err = m.db.Table(&edge{}).Cols("inode").Find(&dirs, &edge{Parent: inode, Type: TypeDirectory}); err != nil {
+		return nil, errno(err)
+	}
+	summary.Files += uint64(sums[0])
+	summary.Length += uint64(sums[1])
+	summary.Size += uint64(sums[2])
+	return dirs, 0
+}
+
+func (m *dbMeta) doFind(ctx Context, filter *FindFilter, cursor string, limit int, entries *[]*Entry) (string, error) {
+	type foundNode struct {
+		node `xorm:"extends"`
+		Name string
+		Dir  Ino
+	}
+	s := m.db.Table(&edge{}).Join("INNER", &node{}, "jfs_edge.inode=jfs_node.inode")
+	s = s.Select("jfs_node.*, jfs_edge.name, jfs_edge.parent AS dir")
+	if cursor != "" {
+		// cursor is the last entry returned: $parent:$name
+		p := strings.IndexByte(cursor, ':')
+		if p < 0 {
+			return "", syscall.EINVAL
+		}
+		parent, err := strconv.ParseUint(cursor[:p], 10, 64)
+		if err != nil {
+			return "", syscall.EINVAL
+		}
+		s = s.Where("jfs_edge.parent > ? OR (jfs_edge.parent = ? AND jfs_edge.name > ?)", parent, parent, cursor[p+1:])
+	}
+	if filter.MinSize > 0 {
+		s = s.And("jfs_node.length >= ?", filter.MinSize)
+	}
+	if filter.MaxSize > 0 {
+		s = s.And("jfs_node.length <= ?", filter.MaxSize)
+	}
+	if !filter.MinMtime.IsZero() {
+		s = s.And("jfs_node.mtime >= ?", filter.MinMtime.UnixNano()/1e3)
+	}
+	if !filter.MaxMtime.IsZero() {
+		s = s.And("jfs_node.mtime <= ?", filter.MaxMtime.UnixNano()/1e3)
+	}
+	if filter.Uid != nil {
+		s = s.And("jfs_node.uid = ?", *filter.Uid)
+	}
+	if filter.Gid != nil {
+		s = s.And("jfs_node.gid = ?", *filter.Gid)
+	}
+	var nodes []foundNode
+	if err := s.OrderBy("jfs_edge.parent, jfs_edge.name").Limit(limit).Find(&nodes); err != nil {
+		return "", err
+	}
+	for i := range nodes {
+		n := &nodes[i]
+		e := &Entry{Inode: n.Inode, Name: []byte(n.Name), Attr: &Attr{}}
+		m.parseAttr(&n.node, e.Attr)
+		e.Attr.Parent = n.Dir
+		*entries = append(*entries, e)
+	}
+	if len(nodes) < limit {
+		return "", nil
+	}
+	last := nodes[len(nodes)-1]
+	return fmt.Sprintf("%d:%s", last.Dir, last.Name), nil
+}
+
+func (m *dbMeta) doFillAttrs(ctx Context, entries []*Entry) syscall.Errno {
+	batchSize := 500 // limited by the number of SQL variables
+	for i := 0; i < len(entries); i += batchSize {
+		es := entries[i:]
+		if len(es) > batchSize {
+			es = es[:batchSize]
+		}
+		inodes := make([]Ino, len(es))
+		for j, e := range es {
+			inodes[j] = e.Inode
+		}
+		var nodes []node
+		if err := m.db.In("inode", inodes).Find(&nodes); err != nil {
+			return errno(err)
+		}
+		attrs := make(map[Ino]*node, len(nodes))
+		for j := range nodes {
+			attrs[nodes[j].Inode] = &nodes[j]
+		}
+		for _, e := range es {
+			if n, ok := attrs[e.Inode]; ok {
+				m.parseAttr(n, e.Attr)
+			}
+		}
+	}
+	return 0
+}
+
 func (m *dbMeta) doCleanStaleSession(sid uint64) {
 	// release locks
 	_, _ = m.db.Delete(flock{Sid: sid})
@@ -1614,7 +2472,10 @@ func (m *dbMeta) doCleanStaleSession(sid uint64) {
 		}
 	}
 	if done {
-		_ = m.txn(func(ses *xorm.Session) error {
+		_ = m.txn(Background, func(ses *xorm.Session) error {
+			if _, err := ses.Delete(&openfile{Sid: sid}); err != nil {
+				return err
+			}
 			_, err = ses.Delete(&session{Sid: sid})
 			logger.Infof("cleanup session %d: %s", sid, err)
 			return err
@@ -1622,12 +2483,11 @@ func (m *dbMeta) doCleanStaleSession(sid uint64) {
 	}
 }
 
-func (m *dbMeta) CleanStaleSessions() {
+func (m *dbMeta) findStaleSessions(edge time.Time, limit int) ([]uint64, error) {
 	var s session
-	rows, err := m.db.Where("Heartbeat < ?", time.Now().Add(time.Minute*-5).Unix()).Rows(&s)
+	rows, err := m.db.Where("Heartbeat < ?", edge.Unix()).Limit(limit).Rows(&s)
 	if err != nil {
-		logger.Warnf("scan stale sessions: %s", err)
-		return
+		return nil, err
 	}
 	var ids []uint64
 	for rows.Next() {
@@ -1636,41 +2496,54 @@ func (m *dbMeta) CleanStaleSessions() {
 		}
 	}
 	_ = rows.Close()
-	for _, sid := range ids {
-		m.doCleanStaleSession(sid)
-	}
+	return ids, nil
 }
 
-func (m *dbMeta) refreshSession() {
-	for {
-		time.Sleep(time.Minute)
-		m.Lock()
-		if m.umounting {
-			m.Unlock()
-			return
+func (m *dbMeta) doRefreshSession() error {
+	return m.txn(Background, func(ses *xorm.Session) error {
+		n, err := ses.Cols("Heartbeat").Update(&session{Heartbeat: time.Now().Unix()}, &session{Sid: m.sid})
+		if err == nil && n == 0 {
+			err = fmt.Errorf("no session found matching sid: %d", m.sid)
 		}
-		_ = m.txn(func(ses *xorm.Session) error {
-			n, err := ses.Cols("Heartbeat").Update(&session{Heartbeat: time.Now().Unix()}, &session{Sid: m.sid})
-			if err == nil && n == 0 {
-				err = fmt.Errorf("no session found matching sid: %d", m.sid)
+		return err
+	})
+}
+
+func (m *dbMeta) doRefreshOpenFiles(sid uint64, files map[Ino]int) error {
+	return m.txn(Background, func(s *xorm.Session) error {
+		if _, err := s.Delete(&openfile{Sid: sid}); err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return nil
+		}
+		rows := make([]openfile, 0, len(files))
+		for inode, refs := range files {
+			rows = append(rows, openfile{sid, inode, refs})
+		}
+		// insert in batches to stay under the limit of SQL variables
+		for len(rows) > 0 {
+			n := len(rows)
+			if n > 200 {
+				n = 200
 			}
-			if err != nil {
-				logger.Errorf("update session: %s", err)
+			batch := rows[:n]
+			if _, err := s.Insert(&batch); err != nil {
+				return err
 			}
-			return err
-		})
-		m.Unlock()
-		if _, err := m.Load(); err != nil {
-			logger.Warnf("reload setting: %s", err)
+			rows = rows[n:]
 		}
-		go m.CleanStaleSessions()
-	}
+		return nil
+	})
 }
 
 func (m *dbMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
 	var n = node{Inode: inode}
 	var newSpace int64
-	err := m.txn(func(s *xorm.Session) error {
+	var released, deleted bool
+	grace := m.sustainedGrace(sid)
+	err := m.txn(Background, func(s *xorm.Session) error {
+		released, deleted = false, false
 		ok, err := s.Get(&n)
 		if err != nil {
 			return err
@@ -1678,7 +2551,11 @@ func (m *dbMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
 		if !ok {
 			return nil
 		}
-		if err = mustInsert(s, &delfile{inode, n.Length, time.Now().Unix()}); err != nil {
+		// replace the deferred one, if it's released by the client which lost its session
+		if _, err = s.Delete(&delfile{Inode: inode}); err != nil {
+			return err
+		}
+		if err = mustInsert(s, &delfile{inode, n.Length, time.Now().Add(grace).Unix()}); err != nil {
 			return err
 		}
 		_, err = s.Delete(&sustained{sid, inode})
@@ -1686,12 +2563,49 @@ func (m *dbMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
 			return err
 		}
 		newSpace = -align4K(n.Length)
+		released = true
+		if grace > 0 {
+			return nil // the inode is removed with its data, see deleteDeferredInode
+		}
 		_, err = s.Delete(&node{Inode: inode})
+		deleted = err == nil
 		return err
 	})
-	if err == nil {
-		m.updateStats(newSpace, -1)
-		go m.doDeleteFileData(inode, n.Length)
+	if err == nil && released {
+		m.sustainedUsage.update(newSpace, -1)
+		if deleted {
+			m.updateStats(newSpace, -1)
+			go m.doDeleteFileData(inode, n.Length)
+		} else {
+			logger.Infof("Defer deleting inode %d of session %d for %s", inode, sid, grace)
+		}
+	}
+	return err
+}
+
+// deleteDeferredInode removes the inode of a file held open by a dead session, which is kept
+// until its data is purged.
+func (m *dbMeta) deleteDeferredInode(inode Ino) error {
+	var n = node{Inode: inode}
+	var deleted bool
+	err := m.txn(Background, func(s *xorm.Session) error {
+		deleted = false
+		ok, err := s.Get(&n)
+		if err != nil || !ok {
+			return err
+		}
+		if n.Nlink > 0 {
+			return fmt.Errorf("inode %d is linked again", inode)
+		}
+		if _, err = s.Delete(&node{Inode: inode}); err != nil {
+			return err
+		}
+		_, err = s.Delete(&xattr{Inode: inode})
+		deleted = err == nil
+		return err
+	})
+	if err == nil && deleted {
+		m.updateStats(-align4K(n.Length), -1)
 	}
 	return err
 }
@@ -1714,7 +2628,7 @@ func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 	}
 	ss := readSliceBuf(c.Slices)
 	if ss == nil {
-		return syscall.EIO
+		return utils.Errno(utils.NewError(utils.ErrCorrupt, fmt.Errorf("corrupt slices of inode %d chunk %d", inode, indx)))
 	}
 	*chunks = buildSlice(ss)
 	m.of.CacheChunk(inode, indx, *chunks)
@@ -1726,6 +2640,11 @@ func (m *dbMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 
 func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1733,8 +2652,9 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
 	var newSpace int64
+	var parent Ino
 	var needCompact bool
-	err := m.txn(func(s *xorm.Session) error {
+	err := m.txn(ctx, func(s *xorm.Session) error {
 		var n = node{Inode: inode}
 		ok, err := s.Get(&n)
 		if err != nil {
@@ -1743,7 +2663,7 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if !ok {
 			return syscall.ENOENT
 		}
-		if n.Type != TypeFile {
+		if n.Type != TypeFile || n.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
@@ -1754,6 +2674,10 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = n.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now().UnixNano() / 1e3
 		n.Mtime = now
 		n.Ctime = now
@@ -1787,20 +2711,27 @@ func (m *dbMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			go m.compactChunk(inode, indx, false)
 		}
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
 	}
 	return errno(err)
 }
 
 func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, fout)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	var newSpace int64
+	var parent Ino
 	defer func() { m.of.InvalidateChunk(fout, 0xFFFFFFFF) }()
-	err := m.txn(func(s *xorm.Session) error {
+	err := m.txn(ctx, func(s *xorm.Session) error {
 		var nin, nout = node{Inode: fin}, node{Inode: fout}
 		ok, err := s.Get(&nin)
 		if err != nil {
@@ -1826,6 +2757,9 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if nout.Type != TypeFile {
 			return syscall.EINVAL
 		}
+		if nout.Flags&FlagImmutable != 0 || nout.Flags&FlagAppend != 0 && offOut < nout.Length {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
 		if newleng > nout.Length {
@@ -1835,6 +2769,10 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = nout.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now().UnixNano() / 1e3
 		nout.Mtime = now
 		nout.Ctime = now
@@ -1916,6 +2854,7 @@ func (m *dbMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -1956,7 +2895,7 @@ func (m *dbMeta) cleanupSlices() {
 		if c.Value+3600 > now {
 			continue
 		}
-		_ = m.txn(func(ses *xorm.Session) error {
+		_ = m.txn(Background, func(ses *xorm.Session) error {
 			_, err := ses.Update(&counter{Value: now}, counter{Name: "nextCleanupSlices"})
 			return err
 		})
@@ -1982,10 +2921,53 @@ func (m *dbMeta) doCleanupSlices() {
 	}
 }
 
+func (m *dbMeta) doCountUnrefSlices(ctx Context, stats *GCStats) error {
+	var ck chunkRef
+	rows, err := m.db.Where("refs <= 0").Rows(&ck)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err = rows.Scan(&ck); err != nil {
+			return err
+		}
+		if ck.Refs == 0 {
+			stats.LeakedSlices++
+			stats.LeakedSpace += uint64(ck.Size)
+		} else {
+			stats.PendingSlices++
+			stats.PendingSliceSpace += uint64(ck.Size)
+		}
+	}
+	return nil
+}
+
+func (m *dbMeta) doScanInodes(ctx Context, fn func(inode Ino, attr *Attr) bool) error {
+	var last Ino
+	for {
+		var nodes []node
+		if err := m.db.Where("inode > ?", last).OrderBy("inode").Limit(1000).Find(&nodes); err != nil {
+			return err
+		}
+		for i := range nodes {
+			attr := &Attr{}
+			m.parseAttr(&nodes[i], attr)
+			if !fn(nodes[i].Inode, attr) {
+				return nil
+			}
+		}
+		if len(nodes) < 1000 {
+			return nil
+		}
+		last = nodes[len(nodes)-1].Inode
+	}
+}
+
 func (m *dbMeta) deleteChunk(inode Ino, indx uint32) error {
 	var c chunk
 	var ss []*slice
-	err := m.txn(func(ses *xorm.Session) error {
+	err := m.txn(Background, func(ses *xorm.Session) error {
 		ok, err := ses.Where("inode = ? AND indx = ?", inode, indx).Get(&c)
 		if err != nil {
 			return err
@@ -2021,6 +3003,10 @@ func (m *dbMeta) deleteChunk(inode Ino, indx uint32) error {
 }
 
 func (m *dbMeta) doDeleteFileData(inode Ino, length uint64) {
+	if err := m.deleteDeferredInode(inode); err != nil {
+		logger.Warnf("delete inode %d: %s", inode, err)
+		return
+	}
 	var c = chunk{Inode: inode}
 	rows, err := m.db.Rows(&c)
 	if err != nil {
@@ -2058,90 +3044,101 @@ func (m *dbMeta) compactChunk(inode Ino, indx uint32, force bool) {
 			m.Lock()
 			delete(m.compacting, k)
 			m.Unlock()
-		}()
-	}
-
-	var c chunk
-	_, err := m.db.Where("inode=? and indx=?", inode, indx).Get(&c)
-	if err != nil {
-		return
-	}
-
-	ss := readSliceBuf(c.Slices)
-	skipped := skipSome(ss)
-	ss = ss[skipped:]
-	pos, size, chunks := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
-		return
-	}
-
-	var chunkid uint64
-	st := m.NewChunk(Background, &chunkid)
-	if st != 0 {
-		return
-	}
-	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, chunks, chunkid)
-	if err != nil {
-		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
-			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
-		}
-		return
+		}()
 	}
-	err = m.txn(func(ses *xorm.Session) error {
-		var c2 = chunk{Inode: inode}
-		_, err := ses.Where("indx=?", indx).Get(&c2)
+
+	for retry := 0; ; retry++ {
+		var c chunk
+		_, err := m.db.Where("inode=? and indx=?", inode, indx).Get(&c)
 		if err != nil {
-			return err
+			return
 		}
-		if len(c2.Slices) < len(c.Slices) || !bytes.Equal(c.Slices, c2.Slices[:len(c.Slices)]) {
-			logger.Infof("chunk %d:%d was changed %d -> %d", inode, indx, len(c.Slices), len(c2.Slices))
-			return syscall.EINVAL
+
+		ss := readSliceBuf(c.Slices)
+		skipped := skipSome(ss)
+		ss = ss[skipped:]
+		pos, size, chunks := compactChunk(ss)
+		if len(ss) < 2 || size == 0 {
+			return
 		}
 
-		c2.Slices = append(append(c2.Slices[:skipped*sliceBytes], marshalSlice(pos, chunkid, size, 0, size)...), c2.Slices[len(c.Slices):]...)
-		if _, err := ses.Where("Inode = ? AND indx = ?", inode, indx).Update(c2); err != nil {
-			return err
+		var chunkid uint64
+		st := m.NewChunk(Background, &chunkid)
+		if st != 0 {
+			return
 		}
-		// create the key to tracking it
-		if err = mustInsert(ses, chunkRef{chunkid, size, 1}); err != nil {
-			return err
+		logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
+		err = m.newMsg(CompactChunk, chunks, chunkid)
+		if err != nil {
+			if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
+				logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+			}
+			return
 		}
-		for _, s := range ss {
-			if _, err := ses.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?", s.chunkid, s.size); err != nil {
+		err = m.txn(Background, func(ses *xorm.Session) error {
+			var c2 = chunk{Inode: inode}
+			_, err := ses.Where("indx=?", indx).Get(&c2)
+			if err != nil {
 				return err
 			}
-		}
-		return nil
-	})
-	// there could be false-negative that the compaction is successful, double-check
-	if err != nil {
-		var c = chunkRef{Chunkid: chunkid}
-		ok, e := m.db.Get(&c)
-		if e == nil {
-			if ok {
-				err = nil
-			} else {
-				logger.Infof("compacted chunk %d was not used", chunkid)
-				err = syscall.EINVAL
+			if len(c2.Slices) < len(c.Slices) || !bytes.Equal(c.Slices, c2.Slices[:len(c.Slices)]) {
+				logger.Infof("chunk %d:%d was changed %d -> %d", inode, indx, len(c.Slices), len(c2.Slices))
+				return syscall.EINVAL
+			}
+
+			c2.Slices = append(append(c2.Slices[:skipped*sliceBytes], marshalSlice(pos, chunkid, size, 0, size)...), c2.Slices[len(c.Slices):]...)
+			if _, err := ses.Where("Inode = ? AND indx = ?", inode, indx).Update(c2); err != nil {
+				return err
+			}
+			// create the key to tracking it
+			if err = mustInsert(ses, chunkRef{chunkid, size, 1}); err != nil {
+				return err
+			}
+			for _, s := range ss {
+				if _, err := ses.Exec("update jfs_chunk_ref set refs=refs-1 where chunkid=? and size=?", s.chunkid, s.size); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		// there could be false-negative that the compaction is successful, double-check
+		if err != nil {
+			var c = chunkRef{Chunkid: chunkid}
+			ok, e := m.db.Get(&c)
+			if e == nil {
+				if ok {
+					err = nil
+				} else {
+					logger.Infof("compacted chunk %d was not used", chunkid)
+					err = syscall.EINVAL
+				}
 			}
 		}
-	}
 
-	if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINVAL {
-		logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, chunkid, size)
-		m.deleteSlice(chunkid, size)
-	} else if err == nil {
-		m.of.InvalidateChunk(inode, indx)
-		for _, s := range ss {
-			var ref = chunkRef{Chunkid: s.chunkid}
-			ok, err := m.db.Get(&ref)
-			if err == nil && ok && ref.Refs <= 0 {
-				m.deleteSlice(s.chunkid, s.size)
+		if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINVAL {
+			logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, chunkid, size)
+			m.deleteSlice(chunkid, size)
+		} else if err == nil {
+			m.of.InvalidateChunk(inode, indx)
+			for _, s := range ss {
+				var ref = chunkRef{Chunkid: s.chunkid}
+				ok, err := m.db.Get(&ref)
+				if err == nil && ok && ref.Refs <= 0 {
+					m.deleteSlice(s.chunkid, s.size)
+				}
 			}
+		} else {
+			logger.Warnf("compact %d %d: %s", inode, indx, err)
+		}
+		if !force || err != nil && err != syscall.EINVAL {
+			break
+		}
+		// compact the rest, or retry the one wasted by others (a background compaction or writes),
+		// so the chunk is compacted once a forced compaction returns, unless it keeps changing
+		if retry >= maxCompactRetries {
+			logger.Warnf("compact %d %d: chunk is still changing after %d retries", inode, indx, retry)
+			return
 		}
-	} else {
-		logger.Warnf("compact %d %d: %s", inode, indx, err)
 	}
 	go func() {
 		// wait for the current compaction to finish
@@ -2156,31 +3153,43 @@ func dup(b []byte) []byte {
 	return r
 }
 
-func (m *dbMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
+func (m *dbMeta) CompactAll(ctx Context, threads int, bar *utils.Bar) syscall.Errno {
 	var c chunk
 	rows, err := m.db.Where("length(slices) >= ?", sliceBytes*2).Cols("inode", "indx").Rows(&c)
 	if err != nil {
 		return errno(err)
 	}
-	var cs []chunk
+	var cs []chunkPos
 	for rows.Next() {
 		if rows.Scan(&c) == nil {
-			c.Slices = dup(c.Slices)
-			cs = append(cs, c)
+			cs = append(cs, chunkPos{c.Inode, c.Indx})
 		}
 	}
 	_ = rows.Close()
+	return m.compactChunks(cs, threads, bar)
+}
 
-	bar.IncrTotal(int64(len(cs)))
-	for _, c := range cs {
-		logger.Debugf("compact chunk %d:%d (%d slices)", c.Inode, c.Indx, len(c.Slices)/sliceBytes)
-		m.compactChunk(c.Inode, c.Indx, true)
-		bar.Increment()
+func (m *dbMeta) UsedSlices(ctx Context, chunkids []uint64) (map[uint64]bool, syscall.Errno) {
+	used := make(map[uint64]bool, len(chunkids))
+	for i := 0; i < len(chunkids); i += 1000 {
+		batch := chunkids[i:]
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		var refs []chunkRef
+		if err := m.db.In("chunkid", batch).Find(&refs); err != nil {
+			return nil, errno(err)
+		}
+		for _, r := range refs {
+			if r.Refs > 0 {
+				used[r.Chunkid] = true
+			}
+		}
 	}
-	return 0
+	return used, 0
 }
 
-func (m *dbMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno {
+func (m *dbMeta) ListSlices(ctx Context, delete bool, fn func(inode Ino, s Slice) error) syscall.Errno {
 	if delete {
 		m.doCleanupSlices()
 	}
@@ -2199,9 +3208,8 @@ func (m *dbMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, sh
 		ss := readSliceBuf(c.Slices)
 		for _, s := range ss {
 			if s.chunkid > 0 {
-				slices[c.Inode] = append(slices[c.Inode], Slice{Chunkid: s.chunkid, Size: s.size})
-				if showProgress != nil {
-					showProgress()
+				if err = fn(c.Inode, Slice{Chunkid: s.chunkid, Size: s.size}); err != nil {
+					return errno(err)
 				}
 			}
 		}
@@ -2245,13 +3253,8 @@ func (m *dbMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno
 	return 0
 }
 
-func (m *dbMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
-	if name == "" {
-		return syscall.EINVAL
-	}
-	defer timeit(time.Now())
-	inode = m.checkRoot(inode)
-	return errno(m.txn(func(s *xorm.Session) error {
+func (m *dbMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
+	return errno(m.txn(ctx, func(s *xorm.Session) error {
 		var x = xattr{inode, name, value}
 		var err error
 		var n int64
@@ -2267,6 +3270,11 @@ func (m *dbMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, fla
 				err = ENOATTR
 			}
 		default:
+			if m.name == "cockroach" {
+				// a failed insert aborts the whole transaction
+				_, err = s.Exec("upsert into jfs_xattr (inode, name, value) values (?, ?, ?)", inode, name, value)
+				break
+			}
 			n, err = s.Insert(&x)
 			if err != nil || n == 0 {
 				if m.db.DriverName() == "postgres" {
@@ -2280,13 +3288,8 @@ func (m *dbMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, fla
 	}))
 }
 
-func (m *dbMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
-	if name == "" {
-		return syscall.EINVAL
-	}
-	defer timeit(time.Now())
-	inode = m.checkRoot(inode)
-	return errno(m.txn(func(s *xorm.Session) error {
+func (m *dbMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
+	return errno(m.txn(ctx, func(s *xorm.Session) error {
 		n, err := s.Delete(&xattr{Inode: inode, Name: name})
 		if err != nil {
 			return err
@@ -2298,9 +3301,163 @@ func (m *dbMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
 	}))
 }
 
+func (m *dbMeta) doTag(inode Ino, key string, value []byte, add bool) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return m.txn(Background, func(s *xorm.Session) error {
+		// value could be empty, which is ignored in conditions built from a bean
+		cond := s.Where("name = ? AND value = ? AND inode = ?", key, value, inode)
+		if !add {
+			_, err := cond.Delete(&tag{})
+			return err
+		}
+		ok, err := cond.Exist(&tag{})
+		if err == nil && !ok {
+			_, err = s.Insert(&tag{key, value, inode})
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doFindTagged(key string, value []byte) ([]tagged, error) {
+	var rows []tag
+	s := m.db.Where("name = ?", key)
+	if value != nil {
+		s = s.And("value = ?", value)
+	}
+	if err := s.Find(&rows); err != nil {
+		return nil, err
+	}
+	ts := make([]tagged, 0, len(rows))
+	for _, t := range rows {
+		ts = append(ts, tagged{t.Inode, t.Value})
+	}
+	return ts, nil
+}
+
+func (m *dbMeta) doAddEvent(e *Event) error {
+	return m.txn(Background, func(s *xorm.Session) error {
+		_, err := s.Insert(&event{e.ID, e.Time, e.marshal()})
+		return err
+	})
+}
+
+func (m *dbMeta) doReadEvents(ctx Context, after uint64, limit int) ([]*Event, error) {
+	var rows []event
+	if err := m.db.Where("id > ?", after).OrderBy("id").Limit(limit).Find(&rows); err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0, len(rows))
+	for _, r := range rows {
+		e, err := parseEvent(r.Data)
+		if err != nil {
+			logger.Warnf("event %d: %s", r.Id, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (m *dbMeta) doCleanupEvents(edge time.Time) (int, error) {
+	var n int64
+	err := m.txn(Background, func(s *xorm.Session) error {
+		var err error
+		n, err = s.Where("time < ?", edge.UnixNano()).Delete(&event{})
+		return err
+	})
+	return int(n), err
+}
+
+func (m *dbMeta) doNotify(msg string) error {
+	return nil
+}
+
+func (m *dbMeta) doWatch(cb func(msg string)) error {
+	return fmt.Errorf("notification is not supported by %s", m.Name())
+}
+
+func (m *dbMeta) doGetQuota(inode Ino) (*Quota, error) {
+	q := dirQuota{Inode: inode}
+	ok, err := m.db.Get(&q)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: q.UsedSpace, UsedInodes: q.UsedInodes}, nil
+}
+
+func (m *dbMeta) doSetQuota(inode Ino, quota *Quota) error {
+	return m.txn(Background, func(s *xorm.Session) error {
+		q := dirQuota{inode, quota.MaxSpace, quota.MaxInodes, quota.UsedSpace, quota.UsedInodes}
+		ok, err := s.Exist(&dirQuota{Inode: inode})
+		if err != nil {
+			return err
+		}
+		if ok {
+			_, err = s.Cols("max_space", "max_inodes", "used_space", "used_inodes").Update(&q, &dirQuota{Inode: inode})
+		} else {
+			_, err = s.Insert(&q)
+		}
+		return err
+	})
+}
+
+func (m *dbMeta) doDelQuota(inode Ino) error {
+	return m.txn(Background, func(s *xorm.Session) error {
+		_, err := s.Delete(&dirQuota{Inode: inode})
+		return err
+	})
+}
+
+func (m *dbMeta) doLoadQuotas() (map[Ino]*Quota, error) {
+	var rows []dirQuota
+	if err := m.db.Find(&rows); err != nil {
+		return nil, err
+	}
+	quotas := make(map[Ino]*Quota, len(rows))
+	for _, q := range rows {
+		quotas[q.Inode] = &Quota{MaxSpace: q.MaxSpace, MaxInodes: q.MaxInodes, UsedSpace: q.UsedSpace, UsedInodes: q.UsedInodes}
+	}
+	return quotas, nil
+}
+
+func (m *dbMeta) doFlushQuotas(quotas map[Ino]*Quota) error {
+	return m.txn(Background, func(s *xorm.Session) error {
+		for inode, q := range quotas {
+			_, err := s.Exec("UPDATE jfs_dir_quota SET used_space=used_space+?, used_inodes=used_inodes+? WHERE inode=?",
+				q.UsedSpace, q.UsedInodes, inode)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *dbMeta) doFlushSustained(space, inodes int64) error {
+	return m.txn(Background, func(s *xorm.Session) error {
+		for _, c := range []counter{{sustainedSpace, space}, {sustainedInodes, inodes}} {
+			if c.Value == 0 {
+				continue
+			}
+			r, err := s.Exec("UPDATE jfs_counter SET value=value+? WHERE name=?", c.Value, c.Name)
+			if err != nil {
+				return err
+			}
+			if n, _ := r.RowsAffected(); n == 0 {
+				if err = mustInsert(s, &c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
 func (m *dbMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 	e := &DumpedEntry{}
-	return e, m.txn(func(s *xorm.Session) error {
+	return e, m.txn(Background, func(s *xorm.Session) error {
 		n := &node{Inode: inode}
 		ok, err := m.db.Get(n)
 		if err != nil {
@@ -2537,55 +3694,24 @@ func (m *dbMeta) makeSnap(bar *utils.Bar) error {
 	return nil
 }
 
-func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
-	defer func() {
-		if p := recover(); p != nil {
-			if e, ok := p.(error); ok {
-				err = e
-			} else {
-				err = fmt.Errorf("DumpMeta error: %v", p)
-			}
-		}
-	}()
+func (m *dbMeta) dumpHeader() (*DumpedMeta, error) {
 	var drows []delfile
 	if err := m.db.Find(&drows); err != nil {
-		return err
+		return nil, err
 	}
 	dels := make([]*DumpedDelFile, 0, len(drows))
 	for _, row := range drows {
 		dels = append(dels, &DumpedDelFile{row.Inode, row.Length, row.Expire})
 	}
 
-	progress := utils.NewProgress(false, false)
-	var tree, trash *DumpedEntry
-	if root == 0 {
-		root = m.root
-	}
-	if root == 1 {
-		bar := progress.AddCountBar("Snapshot keys", 0)
-		if err = m.makeSnap(bar); err != nil {
-			return fmt.Errorf("Fetch all metadata from DB: %s", err)
-		}
-		bar.Done()
-		tree = m.dumpEntryFast(root)
-		trash = m.dumpEntryFast(TrashInode)
-	} else {
-		if tree, err = m.dumpEntry(root); err != nil {
-			return err
-		}
-	}
-	if tree == nil {
-		return errors.New("The entry of the root inode was not found")
-	}
-	tree.Name = "FSTree"
 	format, err := m.Load()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var crows []counter
 	if err = m.db.Find(&crows); err != nil {
-		return err
+		return nil, err
 	}
 	counters := &DumpedCounters{}
 	for _, row := range crows {
@@ -2602,12 +3728,14 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 			counters.NextSession = row.Value
 		case "nextTrash":
 			counters.NextTrash = row.Value
+		case "generation":
+			counters.Generation = row.Value
 		}
 	}
 
 	var srows []sustained
 	if err = m.db.Find(&srows); err != nil {
-		return err
+		return nil, err
 	}
 	ss := make(map[uint64][]Ino)
 	for _, row := range srows {
@@ -2618,13 +3746,50 @@ func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		sessions = append(sessions, &DumpedSustained{k, v})
 	}
 
-	dm := DumpedMeta{
+	return &DumpedMeta{
 		Setting:   format,
 		Counters:  counters,
 		Sustained: sessions,
 		DelFiles:  dels,
-	}
+	}, nil
+}
 
+func (m *dbMeta) DumpMeta(w io.Writer, root Ino) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if e, ok := p.(error); ok {
+				err = e
+			} else {
+				err = fmt.Errorf("DumpMeta error: %v", p)
+			}
+		}
+	}()
+	progress := utils.NewProgress(false, false)
+	var tree, trash *DumpedEntry
+	if root == 0 {
+		root = m.root
+	}
+	if root == 1 {
+		bar := progress.AddCountBar("Snapshot keys", 0)
+		if err = m.makeSnap(bar); err != nil {
+			return fmt.Errorf("Fetch all metadata from DB: %s", err)
+		}
+		bar.Done()
+		tree = m.dumpEntryFast(root)
+		trash = m.dumpEntryFast(TrashInode)
+	} else {
+		if tree, err = m.dumpEntry(root); err != nil {
+			return err
+		}
+	}
+	if tree == nil {
+		return errors.New("The entry of the root inode was not found")
+	}
+	tree.Name = "FSTree"
+	dm, err := m.dumpHeader()
+	if err != nil {
+		return err
+	}
 	bw, err := dm.writeJsonWithOutTree(w)
 	if err != nil {
 		return err
@@ -2672,8 +3837,8 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 		Uid:    attr.Uid,
 		Gid:    attr.Gid,
 		Atime:  attr.Atime*1e6 + int64(attr.Atimensec)/1e3,
-		Mtime:  attr.Mtime*1e6 + int64(attr.Atimensec)/1e3,
-		Ctime:  attr.Ctime*1e6 + int64(attr.Atimensec)/1e3,
+		Mtime:  attr.Mtime*1e6 + int64(attr.Mtimensec)/1e3,
+		Ctime:  attr.Ctime*1e6 + int64(attr.Ctimensec)/1e3,
 		Nlink:  attr.Nlink,
 		Rdev:   attr.Rdev,
 		Parent: e.Parent,
@@ -2696,8 +3861,8 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 					refs[s.Chunkid].Refs++
 				}
 				m.Unlock()
-				if cs.NextChunk <= int64(s.Chunkid) {
-					cs.NextChunk = int64(s.Chunkid) + 1
+				if cs.NextChunk <= int64(idSeq(s.Chunkid)) {
+					cs.NextChunk = int64(idSeq(s.Chunkid)) + 1
 				}
 			}
 			chunks = append(chunks, &chunk{inode, c.Index, slices})
@@ -2728,8 +3893,8 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 		cs.UsedInodes += 1
 	}
 	if inode < TrashInode {
-		if cs.NextInode <= int64(inode) {
-			cs.NextInode = int64(inode) + 1
+		if cs.NextInode <= int64(idSeq(uint64(inode))) {
+			cs.NextInode = int64(idSeq(uint64(inode))) + 1
 		}
 	} else {
 		if cs.NextTrash < int64(inode)-TrashInode {
@@ -2739,10 +3904,17 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 
 	if len(e.Xattrs) > 0 {
 		xattrs := make([]*xattr, 0, len(e.Xattrs))
+		var tags []*tag
 		for _, x := range e.Xattrs {
 			xattrs = append(xattrs, &xattr{inode, x.Name, []byte(x.Value)})
+			if strings.HasPrefix(x.Name, TagPrefix) {
+				tags = append(tags, &tag{x.Name[len(TagPrefix):], []byte(x.Value), inode})
+			}
 		}
 		beans = append(beans, xattrs)
+		if len(tags) > 0 {
+			beans = append(beans, tags)
+		}
 	}
 	beans = append(beans, n)
 	s := m.db.NewSession()
@@ -2750,7 +3922,7 @@ func (m *dbMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[uint64]*
 	return mustInsert(s, beans...)
 }
 
-func (m *dbMeta) LoadMeta(r io.Reader) error {
+func (m *dbMeta) LoadMeta(r io.Reader, opts *LoadOptions) error {
 	tables, err := m.db.DBMetas()
 	if err != nil {
 		return err
@@ -2761,8 +3933,8 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 	if err = m.db.Sync2(new(setting), new(counter)); err != nil {
 		return fmt.Errorf("create table setting, counter: %s", err)
 	}
-	if err = m.db.Sync2(new(node), new(edge), new(symlink), new(xattr)); err != nil {
-		return fmt.Errorf("create table node, edge, symlink, xattr: %s", err)
+	if err = m.db.Sync2(new(node), new(edge), new(symlink), new(xattr), new(tag), new(dirQuota)); err != nil {
+		return fmt.Errorf("create table node, edge, symlink, xattr, tag, dir_quota: %s", err)
 	}
 	if err = m.db.Sync2(new(chunk), new(chunkRef)); err != nil {
 		return fmt.Errorf("create table chunk, chunk_ref: %s", err)
@@ -2774,89 +3946,34 @@ func (m *dbMeta) LoadMeta(r io.Reader) error {
 		return fmt.Errorf("create table flock, plock: %s", err)
 	}
 
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err = dec.Decode(dm); err != nil {
-		return err
-	}
-	format, err := json.MarshalIndent(dm.Setting, "", "")
-	if err != nil {
-		return err
-	}
-
-	progress := utils.NewProgress(false, false)
-	bar := progress.AddCountBar("Collected entries", 1) // with root
-	showProgress := func(totalIncr, currentIncr int64) {
-		bar.IncrTotal(totalIncr)
-		bar.IncrInt64(currentIncr)
-	}
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, showProgress); err != nil {
-		return err
-	}
-	if dm.Trash != nil {
-		bar.IncrTotal(1)
-		if err = collectEntry(dm.Trash, entries, showProgress); err != nil {
-			return err
-		}
-	}
-	bar.Done()
-
 	counters := &DumpedCounters{
 		NextInode: 2,
 		NextChunk: 1,
 	}
 	refs := make(map[uint64]*chunkRef)
-	bar = progress.AddCountBar("Loaded entries", int64(len(entries)))
-	maxNum := 100
-	pool := make(chan struct{}, maxNum)
-	errCh := make(chan error, 100)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	for _, entry := range entries {
-		select {
-		case err = <-errCh:
-			return err
-		default:
-		}
-		pool <- struct{}{}
-		wg.Add(1)
-		go func(entry *DumpedEntry) {
-			defer func() {
-				bar.Increment()
-				wg.Done()
-				<-pool
-			}()
-			if err = m.loadEntry(entry, counters, refs); err != nil {
-				errCh <- err
-			}
-		}(entry)
+	dm, err := loadEntries(r, opts, func(e *DumpedEntry) error { return m.loadEntry(e, counters, refs) })
+	if err != nil {
+		return err
 	}
-
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case err = <-errCh:
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
 		return err
-	case <-done:
 	}
-	progress.Done()
+	// the inode numbers not in the dump could be reused by other files after loaded
+	counters.Generation = dm.Counters.Generation + 1
 	logger.Infof("Dumped counters: %+v", *dm.Counters)
 	logger.Infof("Loaded counters: %+v", *counters)
 
 	beans := make([]interface{}, 0, 4) // setting, counter, delfile, chunkRef
 	beans = append(beans, &setting{"format", string(format)})
-	cs := make([]*counter, 0, 7)
+	cs := make([]*counter, 0, 8)
 	cs = append(cs, &counter{"usedSpace", counters.UsedSpace})
 	cs = append(cs, &counter{"totalInodes", counters.UsedInodes})
 	cs = append(cs, &counter{"nextInode", counters.NextInode})
 	cs = append(cs, &counter{"nextChunk", counters.NextChunk})
 	cs = append(cs, &counter{"nextSession", counters.NextSession})
 	cs = append(cs, &counter{"nextTrash", counters.NextTrash})
+	cs = append(cs, &counter{"generation", counters.Generation})
 	cs = append(cs, &counter{"nextCleanupSlices", 0})
 	beans = append(beans, cs)
 	if len(dm.DelFiles) > 0 {
@@ -30,14 +30,14 @@ import (
 func (m *dbMeta) Flock(ctx Context, inode Ino, owner_ uint64, ltype uint32, block bool) syscall.Errno {
 	owner := int64(owner_)
 	if ltype == F_UNLCK {
-		return errno(m.txn(func(s *xorm.Session) error {
+		return errno(m.txn(ctx, func(s *xorm.Session) error {
 			_, err := s.Delete(&flock{Inode: inode, Owner: owner, Sid: m.sid})
 			return err
 		}))
 	}
 	var err syscall.Errno
 	for {
-		err = errno(m.txn(func(s *xorm.Session) error {
+		err = errno(m.txn(ctx, func(s *xorm.Session) error {
 			if exists, err := s.Get(&node{Inode: inode}); err != nil || !exists {
 				if err == nil && !exists {
 					err = syscall.ENOENT
@@ -153,7 +153,7 @@ func (m *dbMeta) Setlk(ctx Context, inode Ino, owner_ uint64, block bool, ltype
 	lock := plockRecord{ltype, pid, start, end}
 	owner := int64(owner_)
 	for {
-		err = errno(m.txn(func(s *xorm.Session) error {
+		err = errno(m.txn(ctx, func(s *xorm.Session) error {
 			if exists, err := s.Get(&node{Inode: inode}); err != nil || !exists {
 				if err == nil && !exists {
 					err = syscall.ENOENT
@@ -25,4 +25,5 @@ import (
 
 func init() {
 	Register("postgres", newSQLMeta)
+	Register("cockroach", newSQLMeta)
 }
@@ -45,3 +45,11 @@ func TestPostgreSQLClient(t *testing.T) {
 	}
 	testMeta(t, m)
 }
+
+func TestCockroachDBClient(t *testing.T) {
+	m, err := newSQLMeta("cockroach", "root@localhost:26257/test?sslmode=disable", &Config{MaxDeletes: 1})
+	if err != nil || m.Name() != "cockroach" {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
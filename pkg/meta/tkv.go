@@ -20,8 +20,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"math"
 	"math/rand"
@@ -43,7 +45,7 @@ type kvTxn interface {
 	get(key []byte) []byte
 	gets(keys ...[]byte) [][]byte
 	scanRange(begin, end []byte) map[string][]byte
-	scan(prefix []byte, handler func(key, value []byte))
+	scan(prefix []byte, handler func(key, value []byte) bool)
 	scanKeys(prefix []byte) [][]byte
 	scanValues(prefix []byte, filter func(k, v []byte) bool) map[string][]byte
 	exist(prefix []byte) bool
@@ -82,6 +84,9 @@ func newKVMeta(driver, addr string, conf *Config) (Meta, error) {
 	}
 	// TODO: ping server and check latency > Millisecond
 	// logger.Warnf("The latency to database is too high: %s", time.Since(start))
+	if conf.Faults != nil {
+		client = &tkvFaults{client, conf.Faults}
+	}
 	m := &kvMeta{
 		baseMeta: newBaseMeta(conf),
 		client:   client,
@@ -157,13 +162,19 @@ All keys:
   AiiiiiiiiCnnnn     file chunks
   AiiiiiiiiS         symlink target
   AiiiiiiiiX...      extented attribute
+  AiiiiiiiiPiiiiiiii parents of hard linked file
   Diiiiiiiillllllll  delete inodes
   Fiiiiiiii          Flocks
   Piiiiiiii          POSIX locks
   Kccccccccnnnn      slice refs
+  Liiiiiiiin         locks of directory touched by rename
   SHssssssss         session heartbeat
   SIssssssss         session info
   SSssssssssiiiiiiii sustained inode
+  SOssssssssiiiiiiii open files
+  Tk...v...iiiiiiii  tags (k and v are prefixed with their lengths)
+  QDiiiiiiii         directory quota
+  Eeeeeeeee          events in changelog
 */
 
 func (m *kvMeta) inodeKey(inode Ino) []byte {
@@ -190,6 +201,40 @@ func (m *kvMeta) xattrKey(inode Ino, name string) []byte {
 	return m.fmtKey("A", inode, "X", name)
 }
 
+func (m *kvMeta) parentKey(inode, parent Ino) []byte {
+	return m.fmtKey("A", inode, "P", parent)
+}
+
+func (m *kvMeta) tagKey(key string, value []byte, inode Ino) []byte {
+	return m.fmtKey("T", uint8(len(key)), key, uint8(len(value)), string(value), inode)
+}
+
+func (m *kvMeta) eventKey(id uint64) []byte {
+	return m.fmtKey("E", id)
+}
+
+const dirLockShards = 16
+
+// dirLockKey returns the key touched by renames into the directory, which are spread
+// over a few keys by name, so they don't conflict with each other but with rmdir of it.
+func (m *kvMeta) dirLockKey(inode Ino, name string) []byte {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return m.fmtKey("L", inode, uint8(h.Sum32()%dirLockShards))
+}
+
+func (m *kvMeta) dirLockKeys(inode Ino) [][]byte {
+	keys := make([][]byte, dirLockShards)
+	for i := range keys {
+		keys[i] = m.fmtKey("L", inode, uint8(i))
+	}
+	return keys
+}
+
+func (m *kvMeta) dirQuotaKey(inode Ino) []byte {
+	return m.fmtKey("QD", inode)
+}
+
 func (m *kvMeta) flockKey(inode Ino) []byte {
 	return m.fmtKey("F", inode)
 }
@@ -218,6 +263,10 @@ func (m *kvMeta) sustainedKey(sid uint64, inode Ino) []byte {
 	return m.fmtKey("SS", sid, inode)
 }
 
+func (m *kvMeta) openFileKey(sid uint64, inode Ino) []byte {
+	return m.fmtKey("SO", sid, inode)
+}
+
 func (m *kvMeta) encodeInode(ino Ino, buf []byte) {
 	binary.LittleEndian.PutUint64(buf, uint64(ino))
 }
@@ -338,6 +387,14 @@ func (m *kvMeta) Init(format Format, force bool) error {
 			old.Capacity = format.Capacity
 			old.Inodes = format.Inodes
 			old.TrashDays = format.TrashDays
+			old.TrashQuota = format.TrashQuota
+			old.SessionTimeout = format.SessionTimeout
+			old.SustainedGrace = format.SustainedGrace
+			old.ClusterID = format.ClusterID
+			old.AdminToken = format.AdminToken
+			old.ChangelogRetention = format.ChangelogRetention
+			old.GCAlertSpace = format.GCAlertSpace
+			old.CompressDict = format.CompressDict
 			if format != old {
 				old.SecretKey = ""
 				format.SecretKey = ""
@@ -362,7 +419,7 @@ func (m *kvMeta) Init(format Format, force bool) error {
 		Length: 4 << 10,
 		Parent: 1,
 	}
-	return m.txn(func(tx kvTxn) error {
+	return m.txn(Background, func(tx kvTxn) error {
 		if format.TrashDays > 0 {
 			buf := tx.get(m.inodeKey(TrashInode))
 			if buf == nil {
@@ -402,6 +459,7 @@ func (m *kvMeta) Load() (*Format, error) {
 
 func (m *kvMeta) NewSession() error {
 	go m.refreshUsage()
+	m.startMetaCache()
 	if m.conf.ReadOnly {
 		return nil
 	}
@@ -412,8 +470,7 @@ func (m *kvMeta) NewSession() error {
 	m.sid = uint64(v)
 	logger.Debugf("session is %d", m.sid)
 	_ = m.setValue(m.sessionKey(m.sid), m.packInt64(time.Now().Unix()))
-	info := newSessionInfo()
-	info.MountPoint = m.conf.MountPoint
+	info := newSessionInfo(m.conf)
 	data, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("json: %s", err)
@@ -426,25 +483,17 @@ func (m *kvMeta) NewSession() error {
 	go m.cleanupDeletedFiles()
 	go m.cleanupSlices()
 	go m.cleanupTrash()
+	go m.cleanupChangelog()
+	if m.conf.ScrubInterval > 0 {
+		go m.scrubInodes()
+	}
 	go m.flushStats()
+	go m.flushUsage()
 	return nil
 }
 
-func (m *kvMeta) refreshSession() {
-	for {
-		time.Sleep(time.Minute)
-		m.Lock()
-		if m.umounting {
-			m.Unlock()
-			return
-		}
-		_ = m.setValue(m.sessionKey(m.sid), m.packInt64(time.Now().Unix()))
-		m.Unlock()
-		if _, err := m.Load(); err != nil {
-			logger.Warnf("reload setting: %s", err)
-		}
-		go m.CleanStaleSessions()
-	}
+func (m *kvMeta) doRefreshSession() error {
+	return m.setValue(m.sessionKey(m.sid), m.packInt64(time.Now().Unix()))
 }
 
 func (m *kvMeta) doCleanStaleSession(sid uint64) {
@@ -458,7 +507,7 @@ func (m *kvMeta) doCleanStaleSession(sid uint64) {
 		ls := unmarshalFlock(v)
 		for o := range ls {
 			if o.sid == sid {
-				err = m.txn(func(tx kvTxn) error {
+				err = m.txn(Background, func(tx kvTxn) error {
 					v := tx.get([]byte(k))
 					ls := unmarshalFlock(v)
 					delete(ls, o)
@@ -485,7 +534,7 @@ func (m *kvMeta) doCleanStaleSession(sid uint64) {
 		ls := unmarshalPlock(v)
 		for o := range ls {
 			if o.sid == sid {
-				err = m.txn(func(tx kvTxn) error {
+				err = m.txn(Background, func(tx kvTxn) error {
 					v := tx.get([]byte(k))
 					ls := unmarshalPlock(v)
 					delete(ls, o)
@@ -517,26 +566,40 @@ func (m *kvMeta) doCleanStaleSession(sid uint64) {
 		}
 	}
 	if err == nil {
-		err = m.deleteKeys(m.sessionKey(sid), m.sessionInfoKey(sid))
+		err = m.txn(Background, func(tx kvTxn) error {
+			tx.dels(tx.scanKeys(m.fmtKey("SO", sid))...)
+			tx.dels(m.sessionKey(sid), m.sessionInfoKey(sid))
+			return nil
+		})
 		logger.Infof("cleanup session %d: %s", sid, err)
 	}
 }
 
-func (m *kvMeta) CleanStaleSessions() {
+func (m *kvMeta) doRefreshOpenFiles(sid uint64, files map[Ino]int) error {
+	return m.txn(Background, func(tx kvTxn) error {
+		tx.dels(tx.scanKeys(m.fmtKey("SO", sid))...)
+		for inode, refs := range files {
+			tx.set(m.openFileKey(sid, inode), m.packInt64(int64(refs)))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) findStaleSessions(edge time.Time, limit int) ([]uint64, error) {
 	vals, err := m.scanValues(m.fmtKey("SH"), nil)
 	if err != nil {
-		logger.Warnf("scan stale sessions: %s", err)
-		return
+		return nil, err
 	}
 	var ids []uint64
 	for k, v := range vals {
-		if m.parseInt64(v) < time.Now().Add(time.Minute*-5).Unix() {
+		if m.parseInt64(v) < edge.Unix() {
 			ids = append(ids, m.parseSid(k))
+			if len(ids) >= limit {
+				break
+			}
 		}
 	}
-	for _, sid := range ids {
-		m.doCleanStaleSession(sid)
-	}
+	return ids, nil
 }
 
 func (m *kvMeta) getSession(sid uint64, detail bool) (*Session, error) {
@@ -584,10 +647,20 @@ func (m *kvMeta) getSession(sid uint64, detail bool) (*Session, error) {
 			ls := unmarshalPlock(v)
 			for o, l := range ls {
 				if o.sid == sid {
-					s.Plocks = append(s.Plocks, Plock{inode, o.sid, l})
+					s.Plocks = append(s.Plocks, Plock{inode, o.owner, decodeLocks(l)})
 				}
 			}
 		}
+		files, err := m.scanValues(m.fmtKey("SO", sid), nil)
+		if err != nil {
+			return nil, err
+		}
+		s.OpenFiles = make([]OpenFile, 0, len(files))
+		for k, v := range files {
+			inode := m.decodeInode([]byte(k[10:])) // "SO" + sid
+			s.OpenFiles = append(s.OpenFiles, OpenFile{inode, int(m.parseInt64(v))})
+		}
+		sort.Slice(s.OpenFiles, func(i, j int) bool { return s.OpenFiles[i].Inode < s.OpenFiles[j].Inode })
 	}
 	return &s, nil
 }
@@ -608,7 +681,7 @@ func (m *kvMeta) GetSession(sid uint64) (*Session, error) {
 	return s, nil
 }
 
-func (m *kvMeta) ListSessions() ([]*Session, error) {
+func (m *kvMeta) ListSessions(filter *SessionFilter) ([]*Session, error) {
 	vals, err := m.scanValues(m.fmtKey("SH"), nil)
 	if err != nil {
 		return nil, err
@@ -621,7 +694,9 @@ func (m *kvMeta) ListSessions() ([]*Session, error) {
 			continue
 		}
 		s.Heartbeat = time.Unix(m.parseInt64(v), 0)
-		sessions = append(sessions, s)
+		if filter.match(s) {
+			sessions = append(sessions, s)
+		}
 	}
 	return sessions, nil
 }
@@ -637,7 +712,7 @@ func (m *kvMeta) shouldRetry(err error) bool {
 	return strings.Contains(err.Error(), "write conflict") || strings.Contains(err.Error(), "TxnLockNotFound")
 }
 
-func (m *kvMeta) txn(f func(tx kvTxn) error) error {
+func (m *kvMeta) txn(ctx Context, f func(tx kvTxn) error) error {
 	if m.conf.ReadOnly {
 		return syscall.EROFS
 	}
@@ -645,6 +720,10 @@ func (m *kvMeta) txn(f func(tx kvTxn) error) error {
 	defer func() { txDist.Observe(time.Since(start).Seconds()) }()
 	var err error
 	for i := 0; i < 50; i++ {
+		// the transaction is not aborted once started, since it may be committed already
+		if ctx.Canceled() {
+			return syscall.EINTR
+		}
 		if err = m.client.txn(f); m.shouldRetry(err) {
 			txRestart.Add(1)
 			logger.Debugf("conflicted transaction, restart it (tried %d): %s", i+1, err)
@@ -657,7 +736,7 @@ func (m *kvMeta) txn(f func(tx kvTxn) error) error {
 }
 
 func (m *kvMeta) setValue(key, value []byte) error {
-	return m.txn(func(tx kvTxn) error {
+	return m.txn(Background, func(tx kvTxn) error {
 		tx.set(key, value)
 		return nil
 	})
@@ -666,7 +745,7 @@ func (m *kvMeta) setValue(key, value []byte) error {
 func (m *kvMeta) incrCounter(name string, value int64) (int64, error) {
 	var new int64
 	key := m.counterKey(name)
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(Background, func(tx kvTxn) error {
 		new = tx.incrBy(key, value)
 		return nil
 	})
@@ -677,7 +756,7 @@ func (m *kvMeta) deleteKeys(keys ...[]byte) error {
 	if len(keys) == 0 {
 		return nil
 	}
-	return m.txn(func(tx kvTxn) error {
+	return m.txn(Background, func(tx kvTxn) error {
 		tx.dels(keys...)
 		return nil
 	})
@@ -713,17 +792,40 @@ func (m *kvMeta) doGetAttr(ctx Context, inode Ino, attr *Attr) syscall.Errno {
 	return errno(err)
 }
 
+func (m *kvMeta) doTouchAtime(ctx Context, inode Ino, attr *Attr, now time.Time) (bool, error) {
+	var updated bool
+	err := m.txn(ctx, func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		m.parseAttr(a, attr)
+		if !m.atimeNeedsUpdate(attr, now) {
+			return nil
+		}
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(attr))
+		updated = true
+		return nil
+	})
+	return updated, err
+}
+
 func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint8, attr *Attr) syscall.Errno {
 	defer timeit(time.Now())
 	inode = m.checkRoot(inode)
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFE) }()
-	return errno(m.txn(func(tx kvTxn) error {
+	st := errno(m.txn(ctx, func(tx kvTxn) error {
 		var cur Attr
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &cur)
+		if st := checkFlags(ctx, cur.Flags, set, attr); st != 0 {
+			return st
+		}
 		if (set&(SetAttrUID|SetAttrGID)) != 0 && (set&SetAttrMode) != 0 {
 			attr.Mode |= (cur.Mode & 06000)
 		}
@@ -732,6 +834,10 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 			clearSUGID(ctx, &cur, attr)
 			changed = true
 		}
+		if set&SetAttrFlag != 0 && cur.Flags != attr.Flags {
+			cur.Flags = attr.Flags
+			changed = true
+		}
 		if set&SetAttrUID != 0 && cur.Uid != attr.Uid {
 			cur.Uid = attr.Uid
 			changed = true
@@ -782,10 +888,19 @@ func (m *kvMeta) SetAttr(ctx Context, inode Ino, set uint16, sugidclearmode uint
 		*attr = cur
 		return nil
 	}))
+	if st == 0 {
+		m.emit(&Event{Type: EventSetAttr, Inode: inode})
+	}
+	return st
 }
 
 func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, attr *Attr) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -793,14 +908,15 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
 	var newSpace int64
-	err := m.txn(func(tx kvTxn) error {
+	var parent Ino
+	err := m.txn(ctx, func(tx kvTxn) error {
 		var t Attr
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &t)
-		if t.Typ != TypeFile {
+		if t.Typ != TypeFile || t.Flags&(FlagImmutable|FlagAppend) != 0 {
 			return syscall.EPERM
 		}
 		if length == t.Length {
@@ -813,6 +929,10 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 		if newSpace > 0 && m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = t.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		var left, right = t.Length, length
 		if left > right {
 			right, left = left, right
@@ -846,6 +966,8 @@ func (m *kvMeta) Truncate(ctx Context, inode Ino, flags uint8, length uint64, at
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.emit(&Event{Type: EventSetAttr, Inode: inode})
 	}
 	return errno(err)
 }
@@ -867,6 +989,11 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		return syscall.EINVAL
 	}
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -874,7 +1001,11 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 	}
 	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
 	var newSpace int64
-	err := m.txn(func(tx kvTxn) error {
+	var parent Ino
+	var holes []holeChunk
+	var todel []*slice
+	err := m.txn(ctx, func(tx kvTxn) error {
+		holes, todel = nil, nil
 		var t Attr
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
@@ -887,6 +1018,9 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if t.Typ != TypeFile {
 			return syscall.EPERM
 		}
+		if t.Flags&FlagImmutable != 0 || t.Flags&FlagAppend != 0 && mode&(fallocZeroRange|fallocPunchHole) != 0 {
+			return syscall.EPERM
+		}
 		length := t.Length
 		if off+size > t.Length {
 			if mode&fallocKeepSize == 0 {
@@ -899,6 +1033,10 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		if m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = t.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		t.Length = length
 		now := time.Now()
 		t.Mtime = now.Unix()
@@ -907,25 +1045,93 @@ func (m *kvMeta) Fallocate(ctx Context, inode Ino, mode uint8, off uint64, size
 		t.Ctimensec = uint32(now.Nanosecond())
 		tx.set(m.inodeKey(inode), m.marshal(&t))
 		if mode&(fallocZeroRange|fallocPunchHole) != 0 {
-			if off+size > old {
-				size = old - off
-			}
-			for size > 0 {
-				indx := uint32(off / ChunkSize)
-				coff := off % ChunkSize
-				l := size
-				if coff+size > ChunkSize {
-					l = ChunkSize - coff
+			holes = holeChunks(off, size, old)
+		}
+		for _, h := range holes {
+			key := m.chunkKey(inode, h.indx)
+			if !h.whole {
+				tx.append(key, marshalSlice(h.off, 0, 0, 0, h.len))
+				continue
+			}
+			slices := readSliceBuf(tx.get(key))
+			tx.dels(key)
+			for _, s := range slices {
+				if s.chunkid > 0 && tx.incrBy(m.sliceKey(s.chunkid, s.size), -1) < 0 {
+					todel = append(todel, s)
 				}
-				tx.append(m.chunkKey(inode, indx), marshalSlice(uint32(coff), 0, 0, 0, uint32(l)))
-				off += l
-				size -= l
 			}
 		}
 		return nil
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
+		m.emit(&Event{Type: EventSetAttr, Inode: inode})
+		for _, s := range todel {
+			m.deleteSlice(s.chunkid, s.size)
+		}
+		for _, h := range holes {
+			if !h.whole {
+				// release the slices covered by the hole
+				go m.compactChunk(inode, h.indx, false)
+			}
+		}
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) Reserve(ctx Context, inode Ino, size uint64, off *uint64) syscall.Errno {
+	if size == 0 {
+		return syscall.EINVAL
+	}
+	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
+	f := m.of.find(inode)
+	if f != nil {
+		f.Lock()
+		defer f.Unlock()
+	}
+	defer func() { m.of.InvalidateChunk(inode, 0xFFFFFFFF) }()
+	var newSpace int64
+	var parent Ino
+	err := m.txn(ctx, func(tx kvTxn) error {
+		var t Attr
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		m.parseAttr(a, &t)
+		if t.Typ != TypeFile {
+			return syscall.EPERM
+		}
+		if t.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		newSpace = align4K(t.Length+size) - align4K(t.Length)
+		if m.checkQuota(newSpace, 0) {
+			return syscall.ENOSPC
+		}
+		parent = t.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
+		*off = t.Length
+		t.Length += size
+		now := time.Now()
+		t.Mtime = now.Unix()
+		t.Mtimensec = uint32(now.Nanosecond())
+		t.Ctime = now.Unix()
+		t.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&t))
+		return nil
+	})
+	if err == nil {
+		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -955,6 +1161,7 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		attr = &Attr{}
 	}
 	attr.Typ = _type
+	attr.Flags = 0
 	attr.Mode = mode & ^cumask
 	attr.Uid = ctx.Uid()
 	attr.Gid = ctx.Gid()
@@ -976,7 +1183,7 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		*inode = ino
 	}
 
-	err = m.txn(func(tx kvTxn) error {
+	err = m.txn(ctx, func(tx kvTxn) error {
 		var pattr Attr
 		a := tx.get(m.inodeKey(parent))
 		if a == nil {
@@ -986,6 +1193,9 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 
 		buf := tx.get(m.entryKey(parent, name))
 		var foundIno Ino
@@ -1038,6 +1248,8 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 		tx.set(m.inodeKey(ino), m.marshal(attr))
 		if _type == TypeSymlink {
 			tx.set(m.symKey(ino), []byte(path))
+		} else {
+			m.inheritXattrs(tx, parent, _type == TypeDirectory, ino)
 		}
 		return nil
 	})
@@ -1047,17 +1259,125 @@ func (m *kvMeta) doMknod(ctx Context, parent Ino, name string, _type uint8, mode
 	return errno(err)
 }
 
-func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
+// inheritXattrs sets the xattrs derived from the default xattrs of parent to the new children of it.
+func (m *kvMeta) inheritXattrs(tx kvTxn, parent Ino, dir bool, inodes ...Ino) {
+	prefix := len(m.xattrKey(parent, ""))
+	xattrs := make(map[string][]byte)
+	for k, v := range tx.scanValues(m.xattrKey(parent, DefaultXattrPrefix), nil) {
+		xattrs[k[prefix:]] = v
+	}
+	for name, value := range inheritedXattrs(xattrs, dir) {
+		for _, inode := range inodes {
+			tx.set(m.xattrKey(inode, name), value)
+			if strings.HasPrefix(name, TagPrefix) {
+				tx.set(m.tagKey(name[len(TagPrefix):], value, inode), []byte{})
+			}
+		}
+	}
+}
+
+func (m *kvMeta) doBatchMknod(ctx Context, parent Ino, names []string, _type uint8, mode, cumask uint16, inodes []Ino, sts []syscall.Errno) syscall.Errno {
+	if m.checkQuota(align4K(0)*int64(len(names)), int64(len(names))) {
+		return syscall.ENOSPC
+	}
+	// the inodes are allocated before the transaction, the ones of existing entries are wasted
+	news := make([]Ino, len(names))
+	for i := range news {
+		ino, err := m.nextInode()
+		if err != nil {
+			return errno(err)
+		}
+		news[i] = ino
+	}
+	var created int64
+	err := m.txn(ctx, func(tx kvTxn) error {
+		created = 0
+		var pattr Attr
+		a := tx.get(m.inodeKey(parent))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		m.parseAttr(a, &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		keys := make([][]byte, len(names))
+		for i, name := range names {
+			keys[i] = m.entryKey(parent, name)
+		}
+		bufs := tx.gets(keys...)
+		found := make(map[string]Ino, len(names))
+		for i, buf := range bufs {
+			if buf != nil {
+				_, found[names[i]] = m.parseEntry(buf)
+			}
+		}
+
+		now := time.Now()
+		for i, name := range names {
+			if ino, ok := found[name]; ok {
+				inodes[i], sts[i] = ino, syscall.EEXIST
+				continue
+			}
+			attr := Attr{Typ: _type, Mode: mode & ^cumask, Uid: ctx.Uid(), Gid: ctx.Gid(), Parent: parent}
+			if _type == TypeDirectory {
+				pattr.Nlink++
+				attr.Nlink = 2
+				attr.Length = 4 << 10
+			} else {
+				attr.Nlink = 1
+			}
+			attr.Atime, attr.Atimensec = now.Unix(), uint32(now.Nanosecond())
+			attr.Mtime, attr.Mtimensec = now.Unix(), uint32(now.Nanosecond())
+			attr.Ctime, attr.Ctimensec = now.Unix(), uint32(now.Nanosecond())
+			if pattr.Mode&02000 != 0 || ctx.Value(CtxKey("behavior")) == "Hadoop" || runtime.GOOS == "darwin" {
+				attr.Gid = pattr.Gid
+				if _type == TypeDirectory && runtime.GOOS == "linux" {
+					attr.Mode |= pattr.Mode & 02000
+				}
+			}
+			tx.set(keys[i], m.packEntry(_type, news[i]))
+			tx.set(m.inodeKey(news[i]), m.marshal(&attr))
+			found[name] = news[i]
+			inodes[i], sts[i] = news[i], 0
+			created++
+		}
+		if created == 0 {
+			return nil
+		}
+		var news []Ino
+		for i := range names {
+			if sts[i] == 0 {
+				news = append(news, inodes[i])
+			}
+		}
+		m.inheritXattrs(tx, parent, _type == TypeDirectory, news...)
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		return nil
+	})
+	if err == nil {
+		m.updateStats(align4K(0)*created, created)
+	}
+	return errno(err)
+}
+
+func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string, attr *Attr) syscall.Errno {
 	var trash Ino
 	if st := m.checkTrash(parent, &trash); st != 0 {
 		return st
 	}
 	var _type uint8
 	var inode Ino
-	var attr Attr
 	var opened bool
 	var newSpace, newInode int64
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(ctx, func(tx kvTxn) error {
 		buf := tx.get(m.entryKey(parent, name))
 		if buf == nil && m.conf.CaseInsensi {
 			if e := m.resolveCase(ctx, parent, name); e != nil {
@@ -1081,16 +1401,27 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
-		attr = Attr{}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
+		*attr = Attr{}
 		opened = false
 		now := time.Now()
+		var linked bool
+		var parents map[Ino]int
 		if rs[1] != nil {
-			m.parseAttr(rs[1], &attr)
+			m.parseAttr(rs[1], attr)
+			if attr.Flags&(FlagImmutable|FlagAppend) != 0 || pattr.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
 			attr.Ctime = now.Unix()
 			attr.Ctimensec = uint32(now.Nanosecond())
+			if linked = attr.Nlink > 1; linked {
+				parents = m.getParents(tx, inode)
+			}
 			if trash == 0 {
 				attr.Nlink--
 				if _type == TypeFile && attr.Nlink == 0 {
@@ -1099,6 +1430,9 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			} else if attr.Nlink == 1 {
 				attr.Parent = trash
 			}
+			if linked {
+				parents = updateParents(parents, attr, parent, trash)
+			}
 		} else {
 			logger.Warnf("no attribute for inode %d (%d, %s)", inode, parent, name)
 			trash = 0
@@ -1111,8 +1445,11 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 
 		tx.dels(m.entryKey(parent, name))
 		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		if linked {
+			m.setParents(tx, inode, parents)
+		}
 		if attr.Nlink > 0 {
-			tx.set(m.inodeKey(inode), m.marshal(&attr))
+			tx.set(m.inodeKey(inode), m.marshal(attr))
 			if trash > 0 {
 				tx.set(m.entryKey(trash, fmt.Sprintf("%d-%d-%s", parent, inode, name)), buf)
 			}
@@ -1120,7 +1457,7 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 			switch _type {
 			case TypeFile:
 				if opened {
-					tx.set(m.inodeKey(inode), m.marshal(&attr))
+					tx.set(m.inodeKey(inode), m.marshal(attr))
 					tx.set(m.sustainedKey(m.sid, inode), []byte{1})
 				} else {
 					tx.set(m.delfileKey(inode, attr.Length), m.packInt64(now.Unix()))
@@ -1147,12 +1484,146 @@ func (m *kvMeta) doUnlink(ctx Context, parent Ino, name string) syscall.Errno {
 	return errno(err)
 }
 
+func (m *kvMeta) doBatchUnlink(ctx Context, parent Ino, names []string, sts []syscall.Errno, space, inodes *int64) syscall.Errno {
+	type deleted struct {
+		inode  Ino
+		length uint64
+		opened bool
+	}
+	var files []deleted
+	var newSpace, newInode int64
+	var usedSpace, usedInodes int64
+	err := m.txn(ctx, func(tx kvTxn) error {
+		files = files[:0]
+		newSpace, newInode, usedSpace, usedInodes = 0, 0, 0, 0
+		a := tx.get(m.inodeKey(parent))
+		if a == nil {
+			return syscall.ENOENT
+		}
+		var pattr Attr
+		m.parseAttr(a, &pattr)
+		if pattr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+		if pattr.Flags&(FlagImmutable|FlagAppend) != 0 {
+			return syscall.EPERM
+		}
+		keys := make([][]byte, len(names))
+		for i, name := range names {
+			keys[i] = m.entryKey(parent, name)
+		}
+		bufs := tx.gets(keys...)
+		var inos []Ino
+		var ikeys [][]byte
+		for _, buf := range bufs {
+			if buf != nil {
+				_, inode := m.parseEntry(buf)
+				inos = append(inos, inode)
+				ikeys = append(ikeys, m.inodeKey(inode))
+			}
+		}
+		attrs := make(map[Ino][]byte, len(ikeys))
+		for i, a := range tx.gets(ikeys...) {
+			if a != nil {
+				attrs[inos[i]] = a
+			}
+		}
+
+		now := time.Now()
+		removed := make(map[string]bool, len(names))
+		for i, name := range names {
+			buf := bufs[i]
+			if buf == nil || removed[name] {
+				sts[i] = syscall.ENOENT
+				continue
+			}
+			_type, inode := m.parseEntry(buf)
+			if _type == TypeDirectory {
+				sts[i] = syscall.EPERM
+				continue
+			}
+			a := attrs[inode]
+			if a == nil {
+				logger.Warnf("no attribute for inode %d (%d, %s)", inode, parent, name)
+				tx.dels(keys[i])
+				removed[name] = true
+				sts[i] = 0
+				continue
+			}
+			var attr Attr
+			m.parseAttr(a, &attr)
+			if attr.Flags&(FlagImmutable|FlagAppend) != 0 {
+				sts[i] = syscall.EPERM
+				continue
+			}
+			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
+				sts[i] = syscall.EACCES
+				continue
+			}
+			removed[name] = true
+			sts[i] = 0
+			us, ui := usage(&attr)
+			usedSpace += us
+			usedInodes += ui
+			attr.Ctime = now.Unix()
+			attr.Ctimensec = uint32(now.Nanosecond())
+			tx.dels(keys[i])
+			if attr.Nlink > 1 {
+				parents := m.getParents(tx, inode)
+				attr.Nlink--
+				m.setParents(tx, inode, updateParents(parents, &attr, parent, 0))
+				attrs[inode] = m.marshal(&attr) // for other links in the same batch
+				tx.set(m.inodeKey(inode), attrs[inode])
+				continue
+			}
+			attr.Nlink = 0
+			delete(attrs, inode)
+			switch _type {
+			case TypeFile:
+				if m.of.IsOpen(inode) {
+					tx.set(m.inodeKey(inode), m.marshal(&attr))
+					tx.set(m.sustainedKey(m.sid, inode), []byte{1})
+					files = append(files, deleted{inode, attr.Length, true})
+				} else {
+					tx.set(m.delfileKey(inode, attr.Length), m.packInt64(now.Unix()))
+					tx.dels(m.inodeKey(inode))
+					files = append(files, deleted{inode, attr.Length, false})
+					newSpace, newInode = newSpace-align4K(attr.Length), newInode-1
+				}
+			case TypeSymlink:
+				tx.dels(m.symKey(inode))
+				fallthrough
+			default:
+				tx.dels(m.inodeKey(inode))
+				newSpace, newInode = newSpace-align4K(0), newInode-1
+			}
+			tx.dels(tx.scanKeys(m.xattrKey(inode, ""))...)
+		}
+		pattr.Mtime = now.Unix()
+		pattr.Mtimensec = uint32(now.Nanosecond())
+		pattr.Ctime = now.Unix()
+		pattr.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(parent), m.marshal(&pattr))
+		return nil
+	})
+	if err != nil {
+		return errno(err)
+	}
+	for _, f := range files {
+		m.of.InvalidateChunk(f.inode, 0xFFFFFFFE)
+		m.fileDeleted(f.opened, f.inode, f.length)
+	}
+	m.updateStats(newSpace, newInode)
+	*space, *inodes = usedSpace, usedInodes
+	return 0
+}
+
 func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	var trash Ino
 	if st := m.checkTrash(parent, &trash); st != 0 {
 		return st
 	}
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(ctx, func(tx kvTxn) error {
 		buf := tx.get(m.entryKey(parent, name))
 		if buf == nil && m.conf.CaseInsensi {
 			if e := m.resolveCase(ctx, parent, name); e != nil {
@@ -1176,13 +1647,23 @@ func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		if tx.exist(m.entryKey(inode, "")) {
 			return syscall.ENOTEMPTY
 		}
+		// renames into the directory touch one of its lock keys instead of its attribute
+		locks := m.dirLockKeys(inode)
+		tx.gets(locks...)
+		tx.dels(locks...)
 
 		now := time.Now()
 		if rs[1] != nil {
 			m.parseAttr(rs[1], &attr)
+			if attr.Flags&(FlagImmutable|FlagAppend) != 0 || pattr.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && pattr.Mode&01000 != 0 && ctx.Uid() != pattr.Uid && ctx.Uid() != attr.Uid {
 				return syscall.EACCES
 			}
@@ -1218,18 +1699,29 @@ func (m *kvMeta) doRmdir(ctx Context, parent Ino, name string) syscall.Errno {
 	return errno(err)
 }
 
-func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode *Ino, attr *Attr) syscall.Errno {
+func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst Ino, nameDst string, flags uint32, inode, rinode *Ino, attr, rattr *Attr) syscall.Errno {
 	var trash Ino
 	if st := m.checkTrash(parentDst, &trash); st != 0 {
 		return st
 	}
 	exchange := flags == RenameExchange
+	var wino Ino
+	if flags&RenameWhiteout != 0 {
+		if m.checkQuota(4<<10, 1) {
+			return syscall.ENOSPC
+		}
+		var err error
+		if wino, err = m.nextInode(); err != nil {
+			return errno(err)
+		}
+	}
 	var opened bool
 	var dino Ino
 	var dtyp uint8
 	var tattr Attr
 	var newSpace, newInode int64
-	err := m.txn(func(tx kvTxn) error {
+	var smtime, dmtime time.Time
+	err := m.txn(ctx, func(tx kvTxn) error {
 		buf := tx.get(m.entryKey(parentSrc, nameSrc))
 		if buf == nil && m.conf.CaseInsensi {
 			if e := m.resolveCase(ctx, parentSrc, nameSrc); e != nil {
@@ -1256,11 +1748,18 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		if sattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if sattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		m.parseAttr(rs[1], &dattr)
 		if dattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if dattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		m.parseAttr(rs[2], &iattr)
+		snlink, dnlink := sattr.Nlink, dattr.Nlink
 
 		dbuf := tx.get(m.entryKey(parentDst, nameDst))
 		if dbuf == nil && m.conf.CaseInsensi {
@@ -1272,8 +1771,10 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 		now := time.Now()
 		tattr = Attr{}
 		opened = false
+		var dlinked, ilinked bool
+		var dparents, iparents map[Ino]int
 		if dbuf != nil {
-			if flags == RenameNoReplace {
+			if flags&RenameNoReplace != 0 {
 				return syscall.EEXIST
 			}
 			dtyp, dino = m.parseEntry(dbuf)
@@ -1285,12 +1786,18 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			m.parseAttr(a, &tattr)
 			tattr.Ctime = now.Unix()
 			tattr.Ctimensec = uint32(now.Nanosecond())
+			if dlinked = dtyp != TypeDirectory && tattr.Nlink > 1 && dino != ino; dlinked {
+				dparents = m.getParents(tx, dino)
+			}
 			if exchange {
 				tattr.Parent = parentSrc
 				if dtyp == TypeDirectory && parentSrc != parentDst {
 					dattr.Nlink--
 					sattr.Nlink++
 				}
+				if dlinked {
+					dparents = updateParents(dparents, &tattr, parentDst, parentSrc)
+				}
 			} else {
 				if dtyp == TypeDirectory {
 					if tx.exist(m.entryKey(dino, "")) {
@@ -1310,8 +1817,14 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 					} else if tattr.Nlink == 1 {
 						tattr.Parent = trash
 					}
+					if dlinked {
+						dparents = updateParents(dparents, &tattr, parentDst, trash)
+					}
 				}
 			}
+			if tattr.Flags&(FlagImmutable|FlagAppend) != 0 || dattr.Flags&FlagAppend != 0 {
+				return syscall.EPERM
+			}
 			if ctx.Uid() != 0 && dattr.Mode&01000 != 0 && ctx.Uid() != dattr.Uid && ctx.Uid() != tattr.Uid {
 				return syscall.EACCES
 			}
@@ -1321,21 +1834,31 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			}
 			dino, dtyp = 0, 0
 		}
+		if iattr.Flags&(FlagImmutable|FlagAppend) != 0 || sattr.Flags&FlagAppend != 0 {
+			return syscall.EPERM
+		}
 		if ctx.Uid() != 0 && sattr.Mode&01000 != 0 && ctx.Uid() != sattr.Uid && ctx.Uid() != iattr.Uid {
 			return syscall.EACCES
 		}
 
-		sattr.Mtime = now.Unix()
-		sattr.Mtimensec = uint32(now.Nanosecond())
-		sattr.Ctime = now.Unix()
-		sattr.Ctimensec = uint32(now.Nanosecond())
-		dattr.Mtime = now.Unix()
-		dattr.Mtimensec = uint32(now.Nanosecond())
-		dattr.Ctime = now.Unix()
-		dattr.Ctimensec = uint32(now.Nanosecond())
+		// the times of parents are updated after commit, so that the concurrent renames in a busy
+		// directory conflict only on the entries they touch
+		smtime, dmtime = time.Time{}, time.Time{}
+		if !m.skipDirMtime(time.Unix(sattr.Mtime, int64(sattr.Mtimensec)), now) {
+			smtime = now
+		}
+		if !m.skipDirMtime(time.Unix(dattr.Mtime, int64(dattr.Mtimensec)), now) {
+			dmtime = now
+		}
+		if ilinked = typ != TypeDirectory && iattr.Nlink > 1 && parentSrc != parentDst; ilinked {
+			iparents = m.getParents(tx, ino)
+		}
 		iattr.Parent = parentDst
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
+		if ilinked {
+			iparents = updateParents(iparents, &iattr, parentSrc, parentDst)
+		}
 		if typ == TypeDirectory && parentSrc != parentDst {
 			sattr.Nlink--
 			dattr.Nlink++
@@ -1351,7 +1874,12 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 			tx.set(m.entryKey(parentSrc, nameSrc), dbuf)
 			tx.set(m.inodeKey(dino), m.marshal(&tattr))
 		} else {
-			tx.dels(m.entryKey(parentSrc, nameSrc))
+			if wino > 0 {
+				tx.set(m.entryKey(parentSrc, nameSrc), m.packEntry(TypeCharDev, wino))
+				tx.set(m.inodeKey(wino), m.marshal(whiteoutAttr(ctx, parentSrc, now)))
+			} else {
+				tx.dels(m.entryKey(parentSrc, nameSrc))
+			}
 			if dino > 0 {
 				if trash > 0 {
 					tx.set(m.inodeKey(dino), m.marshal(&tattr))
@@ -1379,25 +1907,74 @@ func (m *kvMeta) doRename(ctx Context, parentSrc Ino, nameSrc string, parentDst
 				}
 			}
 		}
-		if parentDst != parentSrc && !isTrash(parentSrc) {
+		if dlinked {
+			m.setParents(tx, dino, dparents)
+		}
+		if ilinked {
+			m.setParents(tx, ino, iparents)
+		}
+		if parentDst != parentSrc && !isTrash(parentSrc) && sattr.Nlink != snlink {
 			tx.set(m.inodeKey(parentSrc), m.marshal(&sattr))
 		}
 		tx.set(m.inodeKey(ino), m.marshal(&iattr))
 		tx.set(m.entryKey(parentDst, nameDst), buf)
-		tx.set(m.inodeKey(parentDst), m.marshal(&dattr))
+		if dattr.Nlink != dnlink {
+			tx.set(m.inodeKey(parentDst), m.marshal(&dattr))
+		} else {
+			// conflict with rmdir of the destination, which touches all its lock keys
+			tx.incrBy(m.dirLockKey(parentDst, nameDst), 1)
+		}
 		return nil
 	})
-	if err == nil && !exchange && trash == 0 {
-		if dino > 0 && dtyp == TypeFile && tattr.Nlink == 0 {
+	if err == nil {
+		if !dmtime.IsZero() {
+			m.updateDirTime(ctx, parentDst, dmtime)
+		}
+		if !smtime.IsZero() && parentSrc != parentDst && !isTrash(parentSrc) {
+			m.updateDirTime(ctx, parentSrc, smtime)
+		}
+		if dino > 0 {
+			*rinode, *rattr = dino, tattr
+		}
+	}
+	if err == nil && !exchange {
+		if trash == 0 && dino > 0 && dtyp == TypeFile && tattr.Nlink == 0 {
 			m.fileDeleted(opened, dino, tattr.Length)
 		}
+		if wino > 0 {
+			newSpace, newInode = newSpace+align4K(0), newInode+1
+		}
 		m.updateStats(newSpace, newInode)
 	}
 	return errno(err)
 }
 
+// updateDirTime sets the mtime and ctime of a directory, unless it was updated later by others.
+func (m *kvMeta) updateDirTime(ctx Context, inode Ino, now time.Time) {
+	err := m.txn(ctx, func(tx kvTxn) error {
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return nil
+		}
+		var attr Attr
+		m.parseAttr(a, &attr)
+		if !time.Unix(attr.Mtime, int64(attr.Mtimensec)).Before(now) {
+			return nil
+		}
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		attr.Ctime = now.Unix()
+		attr.Ctimensec = uint32(now.Nanosecond())
+		tx.set(m.inodeKey(inode), m.marshal(&attr))
+		return nil
+	})
+	if err != nil {
+		logger.Warnf("update mtime of directory %d: %s", inode, err)
+	}
+}
+
 func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr) syscall.Errno {
-	return errno(m.txn(func(tx kvTxn) error {
+	return errno(m.txn(ctx, func(tx kvTxn) error {
 		rs := tx.gets(m.inodeKey(parent), m.inodeKey(inode))
 		if rs[0] == nil || rs[1] == nil {
 			return syscall.ENOENT
@@ -1407,8 +1984,11 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 		if pattr.Typ != TypeDirectory {
 			return syscall.ENOTDIR
 		}
+		if pattr.Flags&FlagImmutable != 0 {
+			return syscall.EPERM
+		}
 		m.parseAttr(rs[1], &iattr)
-		if iattr.Typ == TypeDirectory {
+		if iattr.Typ == TypeDirectory || iattr.Flags&(FlagImmutable|FlagAppend) != 0 {
 			return syscall.EPERM
 		}
 		buf := tx.get(m.entryKey(parent, name))
@@ -1424,6 +2004,11 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 		iattr.Ctime = now.Unix()
 		iattr.Ctimensec = uint32(now.Nanosecond())
 		iattr.Nlink++
+		var parents map[Ino]int
+		if iattr.Nlink > 2 {
+			parents = m.getParents(tx, inode)
+		}
+		m.setParents(tx, inode, updateParents(parents, &iattr, 0, parent))
 		tx.set(m.entryKey(parent, name), m.packEntry(iattr.Typ, inode))
 		tx.set(m.inodeKey(parent), m.marshal(&pattr))
 		tx.set(m.inodeKey(inode), m.marshal(&iattr))
@@ -1434,6 +2019,32 @@ func (m *kvMeta) doLink(ctx Context, inode, parent Ino, name string, attr *Attr)
 	}))
 }
 
+func (m *kvMeta) getParents(tx kvTxn, inode Ino) map[Ino]int {
+	vals := tx.scanValues(m.fmtKey("A", inode, "P"), nil)
+	parents := make(map[Ino]int, len(vals))
+	for k, v := range vals {
+		parents[m.decodeInode([]byte(k[len(k)-8:]))] = int(parseCounter(v))
+	}
+	return parents
+}
+
+// setParents replaces the parents of a hard linked file, they're removed if parents is empty.
+func (m *kvMeta) setParents(tx kvTxn, inode Ino, parents map[Ino]int) {
+	tx.dels(tx.scanKeys(m.fmtKey("A", inode, "P"))...)
+	for p, n := range parents {
+		tx.set(m.parentKey(inode, p), packCounter(int64(n)))
+	}
+}
+
+func (m *kvMeta) doGetParents(ctx Context, inode Ino) (map[Ino]int, error) {
+	var parents map[Ino]int
+	err := m.client.txn(func(tx kvTxn) error {
+		parents = m.getParents(tx, inode)
+		return nil
+	})
+	return parents, err
+}
+
 func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry) syscall.Errno {
 	// TODO: handle big directory
 	vals, err := m.scanValues(m.entryKey(inode, ""), nil)
@@ -1451,58 +2062,186 @@ func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 	}
 
 	if plus != 0 {
-		fillAttr := func(es []*Entry) error {
-			var keys = make([][]byte, len(es))
-			for i, e := range es {
-				keys[i] = m.inodeKey(e.Inode)
-			}
-			var rs [][]byte
-			err := m.client.txn(func(tx kvTxn) error {
-				rs = tx.gets(keys...)
-				return nil
-			})
-			if err != nil {
-				return err
+		return m.doFillAttrs(ctx, *entries)
+	}
+	return 0
+}
+
+func (m *kvMeta) doReaddirAt(ctx Context, inode Ino, plus uint8, cursor string, limit int, entries *[]*Entry) (string, error) {
+	// cursor is the name of next entry to return
+	prefix := m.entryKey(inode, "")
+	start := len(*entries)
+	var next string
+	err := m.client.txn(func(tx kvTxn) error {
+		*entries, next = (*entries)[:start], ""
+		tx.scan(m.entryKey(inode, cursor), func(k, v []byte) bool {
+			if !bytes.HasPrefix(k, prefix) {
+				return false
 			}
-			for j, re := range rs {
-				if re != nil {
-					m.parseAttr(re, es[j].Attr)
-				}
+			if len(*entries)-start >= limit {
+				next = string(k[len(prefix):])
+				return false
 			}
-			return nil
+			typ, inode := m.parseEntry(v)
+			*entries = append(*entries, &Entry{Inode: inode, Name: append([]byte{}, k[len(prefix):]...), Attr: &Attr{Typ: typ}})
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if plus != 0 {
+		if st := m.doFillAttrs(ctx, (*entries)[start:]); st != 0 {
+			return "", st
 		}
-		batchSize := 4096
-		nEntries := len(*entries)
-		if nEntries <= batchSize {
-			err = fillAttr(*entries)
-		} else {
-			indexCh := make(chan []*Entry, 10)
-			var wg sync.WaitGroup
-			for i := 0; i < 2; i++ {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for es := range indexCh {
-						if e := fillAttr(es); e != nil {
-							err = e
-							break
-						}
-					}
-				}()
+	}
+	return next, nil
+}
+
+func (m *kvMeta) doGetDirSummary(ctx Context, inode Ino, summary *Summary) ([]Ino, syscall.Errno) {
+	prefix := m.entryKey(inode, "")
+	var dirs []Ino
+	var sum Summary
+	err := m.client.txn(func(tx kvTxn) error {
+		dirs, sum = dirs[:0], Summary{}
+		var files [][]byte
+		tx.scan(prefix, func(k, v []byte) bool {
+			if !bytes.HasPrefix(k, prefix) {
+				return false
 			}
-			for i := 0; i < nEntries; i += batchSize {
-				if i+batchSize > nEntries {
-					indexCh <- (*entries)[i:]
-				} else {
-					indexCh <- (*entries)[i : i+batchSize]
+			typ, inode := m.parseEntry(v)
+			if typ == TypeDirectory {
+				dirs = append(dirs, inode)
+			} else {
+				files = append(files, m.inodeKey(inode))
+			}
+			return true
+		})
+		var attr Attr
+		for i := 0; i < len(files); i += 4096 {
+			end := i + 4096
+			if end > len(files) {
+				end = len(files)
+			}
+			for _, buf := range tx.gets(files[i:end]...) {
+				attr = Attr{}
+				if buf != nil {
+					m.parseAttr(buf, &attr)
 				}
+				sum.add(&attr)
 			}
-			close(indexCh)
-			wg.Wait()
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	summary.Files += sum.Files
+	summary.Length += sum.Length
+	summary.Size += sum.Size
+	return dirs, 0
+}
+
+func (m *kvMeta) doFind(ctx Context, filter *FindFilter, cursor string, limit int, entries *[]*Entry) (string, error) {
+	// AiiiiiiiiD...      dentry
+	prefix := m.fmtKey("A")
+	begin := prefix
+	if cursor != "" {
+		var err error
+		if begin, err = hex.DecodeString(cursor); err != nil || !bytes.HasPrefix(begin, prefix) {
+			return "", syscall.EINVAL
+		}
+	}
+	var next []byte
+	var parents []Ino
+	err := m.client.txn(func(tx kvTxn) error {
+		*entries, parents, next = (*entries)[:0], parents[:0], nil
+		tx.scan(begin, func(k, v []byte) bool {
+			if !bytes.HasPrefix(k, prefix) {
+				return false
+			}
+			if len(*entries) >= limit {
+				next = append([]byte{}, k...)
+				return false
+			}
+			if len(k) > 10 && k[1+8] == 'D' && filter.matchName(string(k[10:])) {
+				typ, inode := m.parseEntry(v)
+				*entries = append(*entries, &Entry{Inode: inode, Name: append([]byte{}, k[10:]...), Attr: &Attr{Typ: typ}})
+				parents = append(parents, m.decodeInode(k[1:9]))
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if st := m.doFillAttrs(ctx, *entries); st != 0 {
+		return "", st
+	}
+	for i, e := range *entries {
+		e.Attr.Parent = parents[i]
+	}
+	if next == nil {
+		return "", nil
+	}
+	return hex.EncodeToString(next), nil
+}
+
+func (m *kvMeta) doFillAttrs(ctx Context, entries []*Entry) syscall.Errno {
+	var err error
+	fillAttr := func(es []*Entry) error {
+		var keys = make([][]byte, len(es))
+		for i, e := range es {
+			keys[i] = m.inodeKey(e.Inode)
+		}
+		var rs [][]byte
+		err := m.client.txn(func(tx kvTxn) error {
+			rs = tx.gets(keys...)
+			return nil
+		})
 		if err != nil {
-			return errno(err)
+			return err
+		}
+		for j, re := range rs {
+			if re != nil {
+				m.parseAttr(re, es[j].Attr)
+			}
 		}
+		return nil
+	}
+	batchSize := 4096
+	nEntries := len(entries)
+	if nEntries <= batchSize {
+		err = fillAttr(entries)
+	} else {
+		indexCh := make(chan []*Entry, 10)
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for es := range indexCh {
+					if e := fillAttr(es); e != nil {
+						err = e
+						break
+					}
+				}
+			}()
+		}
+		for i := 0; i < nEntries; i += batchSize {
+			if i+batchSize > nEntries {
+				indexCh <- entries[i:]
+			} else {
+				indexCh <- entries[i : i+batchSize]
+			}
+		}
+		close(indexCh)
+		wg.Wait()
+	}
+	if err != nil {
+		return errno(err)
 	}
 	return 0
 }
@@ -1510,21 +2249,60 @@ func (m *kvMeta) doReaddir(ctx Context, inode Ino, plus uint8, entries *[]*Entry
 func (m *kvMeta) doDeleteSustainedInode(sid uint64, inode Ino) error {
 	var attr Attr
 	var newSpace int64
-	err := m.txn(func(tx kvTxn) error {
+	var released, deleted bool
+	grace := m.sustainedGrace(sid)
+	err := m.txn(Background, func(tx kvTxn) error {
+		released, deleted = false, false
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
 			return nil
 		}
 		m.parseAttr(a, &attr)
-		tx.set(m.delfileKey(inode, attr.Length), m.packInt64(time.Now().Unix()))
-		tx.dels(m.inodeKey(inode))
+		tx.set(m.delfileKey(inode, attr.Length), m.packInt64(time.Now().Add(grace).Unix()))
 		tx.dels(m.sustainedKey(sid, inode))
 		newSpace = -align4K(attr.Length)
+		released = true
+		if grace == 0 {
+			// or the inode is removed with its data, see deleteDeferredInode
+			tx.dels(m.inodeKey(inode))
+			deleted = true
+		}
 		return nil
 	})
-	if err == nil {
-		m.updateStats(newSpace, -1)
-		go m.doDeleteFileData(inode, attr.Length)
+	if err == nil && released {
+		m.sustainedUsage.update(newSpace, -1)
+		if deleted {
+			m.updateStats(newSpace, -1)
+			go m.doDeleteFileData(inode, attr.Length)
+		} else {
+			logger.Infof("Defer deleting inode %d of session %d for %s", inode, sid, grace)
+		}
+	}
+	return err
+}
+
+// deleteDeferredInode removes the inode of a file held open by a dead session, which is kept
+// until its data is purged.
+func (m *kvMeta) deleteDeferredInode(inode Ino) error {
+	var attr Attr
+	var deleted bool
+	err := m.txn(Background, func(tx kvTxn) error {
+		deleted = false
+		a := tx.get(m.inodeKey(inode))
+		if a == nil {
+			return nil
+		}
+		m.parseAttr(a, &attr)
+		if attr.Nlink > 0 {
+			return fmt.Errorf("inode %d is linked again", inode)
+		}
+		tx.dels(m.inodeKey(inode))
+		tx.dels(tx.scanKeys(m.xattrKey(inode, ""))...)
+		deleted = true
+		return nil
+	})
+	if err == nil && deleted {
+		m.updateStats(-align4K(attr.Length), -1)
 	}
 	return err
 }
@@ -1546,7 +2324,7 @@ func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 	}
 	ss := readSliceBuf(val)
 	if ss == nil {
-		return syscall.EIO
+		return utils.Errno(utils.NewError(utils.ErrCorrupt, fmt.Errorf("corrupt slices of inode %d chunk %d", inode, indx)))
 	}
 	*chunks = buildSlice(ss)
 	m.of.CacheChunk(inode, indx, *chunks)
@@ -1558,6 +2336,11 @@ func (m *kvMeta) Read(ctx Context, inode Ino, indx uint32, chunks *[]Slice) sysc
 
 func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Slice) syscall.Errno {
 	defer timeit(time.Now())
+	unlock, st := m.writing.lock(ctx, inode)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(inode)
 	if f != nil {
 		f.Lock()
@@ -1565,15 +2348,16 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 	}
 	defer func() { m.of.InvalidateChunk(inode, indx) }()
 	var newSpace int64
+	var parent Ino
 	var needCompact bool
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(ctx, func(tx kvTxn) error {
 		var attr Attr
 		a := tx.get(m.inodeKey(inode))
 		if a == nil {
 			return syscall.ENOENT
 		}
 		m.parseAttr(a, &attr)
-		if attr.Typ != TypeFile {
+		if attr.Typ != TypeFile || attr.Flags&FlagImmutable != 0 {
 			return syscall.EPERM
 		}
 		newleng := uint64(indx)*ChunkSize + uint64(off) + uint64(slice.Len)
@@ -1584,6 +2368,10 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 		if m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = attr.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1599,6 +2387,7 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 			go m.compactChunk(inode, indx, false)
 		}
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -1606,13 +2395,19 @@ func (m *kvMeta) Write(ctx Context, inode Ino, indx uint32, off uint32, slice Sl
 func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, offOut uint64, size uint64, flags uint32, copied *uint64) syscall.Errno {
 	defer timeit(time.Now())
 	var newSpace int64
+	var parent Ino
+	unlock, st := m.writing.lock(ctx, fout)
+	if st != 0 {
+		return st
+	}
+	defer unlock()
 	f := m.of.find(fout)
 	if f != nil {
 		f.Lock()
 		defer f.Unlock()
 	}
 	defer func() { m.of.InvalidateChunk(fout, 0xFFFFFFFF) }()
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(ctx, func(tx kvTxn) error {
 		rs := tx.gets(m.inodeKey(fin), m.inodeKey(fout))
 		if rs[0] == nil || rs[1] == nil {
 			return syscall.ENOENT
@@ -1634,6 +2429,9 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if attr.Typ != TypeFile {
 			return syscall.EINVAL
 		}
+		if attr.Flags&FlagImmutable != 0 || attr.Flags&FlagAppend != 0 && offOut < attr.Length {
+			return syscall.EPERM
+		}
 
 		newleng := offOut + size
 		if newleng > attr.Length {
@@ -1643,6 +2441,10 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 		if m.checkQuota(newSpace, 0) {
 			return syscall.ENOSPC
 		}
+		parent = attr.Parent
+		if m.checkDirQuota(ctx, parent, newSpace, 0) {
+			return syscall.EDQUOT
+		}
 		now := time.Now()
 		attr.Mtime = now.Unix()
 		attr.Mtimensec = uint32(now.Nanosecond())
@@ -1707,6 +2509,7 @@ func (m *kvMeta) CopyFileRange(ctx Context, fin Ino, offIn uint64, fout Ino, off
 	})
 	if err == nil {
 		m.updateStats(newSpace, 0)
+		m.updateDirQuota(ctx, parent, newSpace, 0)
 	}
 	return errno(err)
 }
@@ -1764,10 +2567,72 @@ func (m *kvMeta) doCleanupSlices() {
 	}
 }
 
+func (m *kvMeta) doCountUnrefSlices(ctx Context, stats *GCStats) error {
+	klen := 1 + 8 + 4
+	_, err := m.scanValues(m.fmtKey("K"), func(k, v []byte) bool {
+		if len(k) != klen || len(v) != 8 {
+			return false
+		}
+		size := uint64(utils.FromBuffer(k[9:]).Get32())
+		if refs := parseCounter(v); refs == 0 {
+			stats.LeakedSlices++
+			stats.LeakedSpace += size
+		} else if refs < 0 {
+			stats.PendingSlices++
+			stats.PendingSliceSpace += size
+		}
+		return false
+	})
+	return err
+}
+
+func (m *kvMeta) doScanInodes(ctx Context, fn func(inode Ino, attr *Attr) bool) error {
+	// AiiiiiiiiI         inode attribute
+	prefix := m.fmtKey("A")
+	begin := prefix
+	for begin != nil {
+		var inodes []Ino
+		var attrs []*Attr
+		var next []byte
+		err := m.client.txn(func(tx kvTxn) error {
+			var n int
+			inodes, attrs, next = inodes[:0], attrs[:0], nil
+			tx.scan(begin, func(k, v []byte) bool {
+				if !bytes.HasPrefix(k, prefix) {
+					return false
+				}
+				if n >= 1000 {
+					next = append([]byte{}, k...)
+					return false
+				}
+				n++
+				if len(k) == 1+8+1 && k[1+8] == 'I' {
+					attr := &Attr{}
+					m.parseAttr(v, attr)
+					inodes = append(inodes, m.decodeInode(k[1:9]))
+					attrs = append(attrs, attr)
+				}
+				return true
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, inode := range inodes {
+			if !fn(inode, attrs[i]) {
+				return nil
+			}
+		}
+		begin = next
+	}
+	return nil
+}
+
 func (m *kvMeta) deleteChunk(inode Ino, indx uint32) error {
 	key := m.chunkKey(inode, indx)
 	var todel []*slice
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(Background, func(tx kvTxn) error {
 		buf := tx.get(key)
 		slices := readSliceBuf(buf)
 		tx.dels(key)
@@ -1789,7 +2654,7 @@ func (m *kvMeta) deleteChunk(inode Ino, indx uint32) error {
 }
 
 func (r *kvMeta) cleanupZeroRef(chunkid uint64, size uint32) {
-	_ = r.txn(func(tx kvTxn) error {
+	_ = r.txn(Background, func(tx kvTxn) error {
 		v := tx.incrBy(r.sliceKey(chunkid, size), 0)
 		if v != 0 {
 			return syscall.EINVAL
@@ -1800,6 +2665,10 @@ func (r *kvMeta) cleanupZeroRef(chunkid uint64, size uint32) {
 }
 
 func (m *kvMeta) doDeleteFileData(inode Ino, length uint64) {
+	if err := m.deleteDeferredInode(inode); err != nil {
+		logger.Warnf("delete inode %d: %s", inode, err)
+		return
+	}
 	keys, err := m.scanKeys(m.fmtKey("A", inode, "C"))
 	if err != nil {
 		logger.Warnf("delete chunks of inode %d: %s", inode, err)
@@ -1834,76 +2703,87 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 		}()
 	}
 
-	buf, err := m.get(m.chunkKey(inode, indx))
-	if err != nil {
-		return
-	}
+	for retry := 0; ; retry++ {
+		buf, err := m.get(m.chunkKey(inode, indx))
+		if err != nil {
+			return
+		}
 
-	ss := readSliceBuf(buf)
-	skipped := skipSome(ss)
-	ss = ss[skipped:]
-	pos, size, chunks := compactChunk(ss)
-	if len(ss) < 2 || size == 0 {
-		return
-	}
+		ss := readSliceBuf(buf)
+		skipped := skipSome(ss)
+		ss = ss[skipped:]
+		pos, size, chunks := compactChunk(ss)
+		if len(ss) < 2 || size == 0 {
+			return
+		}
 
-	var chunkid uint64
-	st := m.NewChunk(Background, &chunkid)
-	if st != 0 {
-		return
-	}
-	logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
-	err = m.newMsg(CompactChunk, chunks, chunkid)
-	if err != nil {
-		if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
-			logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+		var chunkid uint64
+		st := m.NewChunk(Background, &chunkid)
+		if st != 0 {
+			return
 		}
-		return
-	}
-	err = m.txn(func(tx kvTxn) error {
-		buf2 := tx.get(m.chunkKey(inode, indx))
-		if len(buf2) < len(buf) || !bytes.Equal(buf, buf2[:len(buf)]) {
-			logger.Infof("chunk %d:%d was changed %d -> %d", inode, indx, len(buf), len(buf2))
-			return syscall.EINVAL
+		logger.Debugf("compact %d:%d: skipped %d slices (%d bytes) %d slices (%d bytes)", inode, indx, skipped, pos, len(ss), size)
+		err = m.newMsg(CompactChunk, chunks, chunkid)
+		if err != nil {
+			if !strings.Contains(err.Error(), "not exist") && !strings.Contains(err.Error(), "not found") {
+				logger.Warnf("compact %d %d with %d slices: %s", inode, indx, len(ss), err)
+			}
+			return
 		}
+		err = m.txn(Background, func(tx kvTxn) error {
+			buf2 := tx.get(m.chunkKey(inode, indx))
+			if len(buf2) < len(buf) || !bytes.Equal(buf, buf2[:len(buf)]) {
+				logger.Infof("chunk %d:%d was changed %d -> %d", inode, indx, len(buf), len(buf2))
+				return syscall.EINVAL
+			}
 
-		buf2 = append(append(buf2[:skipped*sliceBytes], marshalSlice(pos, chunkid, size, 0, size)...), buf2[len(buf):]...)
-		tx.set(m.chunkKey(inode, indx), buf2)
-		// create the key to tracking it
-		tx.set(m.sliceKey(chunkid, size), make([]byte, 8))
-		for _, s := range ss {
-			tx.incrBy(m.sliceKey(s.chunkid, s.size), -1)
-		}
-		return nil
-	})
-	// there could be false-negative that the compaction is successful, double-check
-	if err != nil {
-		logger.Warnf("compact %d:%d failed: %s", inode, indx, err)
-		refs, e := m.get(m.sliceKey(chunkid, size))
-		if e == nil {
-			if len(refs) > 0 {
-				err = nil
-			} else {
-				logger.Infof("compacted chunk %d was not used", chunkid)
-				err = syscall.EINVAL
+			buf2 = append(append(buf2[:skipped*sliceBytes], marshalSlice(pos, chunkid, size, 0, size)...), buf2[len(buf):]...)
+			tx.set(m.chunkKey(inode, indx), buf2)
+			// create the key to tracking it
+			tx.set(m.sliceKey(chunkid, size), make([]byte, 8))
+			for _, s := range ss {
+				tx.incrBy(m.sliceKey(s.chunkid, s.size), -1)
+			}
+			return nil
+		})
+		// there could be false-negative that the compaction is successful, double-check
+		if err != nil {
+			logger.Warnf("compact %d:%d failed: %s", inode, indx, err)
+			refs, e := m.get(m.sliceKey(chunkid, size))
+			if e == nil {
+				if len(refs) > 0 {
+					err = nil
+				} else {
+					logger.Infof("compacted chunk %d was not used", chunkid)
+					err = syscall.EINVAL
+				}
 			}
 		}
-	}
 
-	if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINVAL {
-		logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, chunkid, size)
-		m.deleteSlice(chunkid, size)
-	} else if err == nil {
-		m.of.InvalidateChunk(inode, indx)
-		m.cleanupZeroRef(chunkid, size)
-		for _, s := range ss {
-			refs, err := m.getCounter(m.sliceKey(s.chunkid, s.size))
-			if err == nil && refs < 0 {
-				m.deleteSlice(s.chunkid, s.size)
+		if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINVAL {
+			logger.Infof("compaction for %d:%d is wasted, delete slice %d (%d bytes)", inode, indx, chunkid, size)
+			m.deleteSlice(chunkid, size)
+		} else if err == nil {
+			m.of.InvalidateChunk(inode, indx)
+			m.cleanupZeroRef(chunkid, size)
+			for _, s := range ss {
+				refs, err := m.getCounter(m.sliceKey(s.chunkid, s.size))
+				if err == nil && refs < 0 {
+					m.deleteSlice(s.chunkid, s.size)
+				}
 			}
+		} else {
+			logger.Warnf("compact %d %d: %s", inode, indx, err)
+		}
+		if !force || err != nil && err != syscall.EINVAL {
+			break
+		}
+		// compact the rest, or retry the one wasted by others (a background compaction or writes),
+		// so the chunk is compacted once a forced compaction returns, unless it keeps changing
+		if retry >= maxCompactRetries {
+			logger.Warnf("compact %d %d: chunk is still changing after %d retries", inode, indx, retry)
+			return
 		}
-	} else {
-		logger.Warnf("compact %d %d: %s", inode, indx, err)
 	}
 	go func() {
 		// wait for the current compaction to finish
@@ -1912,7 +2792,7 @@ func (m *kvMeta) compactChunk(inode Ino, indx uint32, force bool) {
 	}()
 }
 
-func (r *kvMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
+func (r *kvMeta) CompactAll(ctx Context, threads int, bar *utils.Bar) syscall.Errno {
 	// AiiiiiiiiCnnnn     file chunks
 	klen := 1 + 8 + 1 + 4
 	result, err := r.scanValues(r.fmtKey("A"), func(k, v []byte) bool {
@@ -1923,42 +2803,82 @@ func (r *kvMeta) CompactAll(ctx Context, bar *utils.Bar) syscall.Errno {
 		return errno(err)
 	}
 
-	bar.IncrTotal(int64(len(result)))
-	for k, value := range result {
+	cs := make([]chunkPos, 0, len(result))
+	for k := range result {
 		key := []byte(k[1:])
-		inode := r.decodeInode(key[:8])
-		indx := binary.BigEndian.Uint32(key[9:])
-		logger.Debugf("compact chunk %d:%d (%d slices)", inode, indx, len(value)/sliceBytes)
-		r.compactChunk(inode, indx, true)
-		bar.Increment()
+		cs = append(cs, chunkPos{r.decodeInode(key[:8]), binary.BigEndian.Uint32(key[9:])})
 	}
-	return 0
+	return r.compactChunks(cs, threads, bar)
 }
 
-func (m *kvMeta) ListSlices(ctx Context, slices map[Ino][]Slice, delete bool, showProgress func()) syscall.Errno {
+func (m *kvMeta) UsedSlices(ctx Context, chunkids []uint64) (map[uint64]bool, syscall.Errno) {
+	used := make(map[uint64]bool, len(chunkids))
+	err := m.client.txn(func(tx kvTxn) error {
+		for _, id := range chunkids {
+			used[id] = true
+			// only the slices referenced more than once or being deleted are kept
+			tx.scanValues(m.fmtKey("K", id), func(k, v []byte) bool {
+				if len(v) == 8 && parseCounter(v) < 0 {
+					delete(used, id)
+				}
+				return false
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	return used, 0
+}
+
+func (m *kvMeta) ListSlices(ctx Context, delete bool, fn func(inode Ino, s Slice) error) syscall.Errno {
 	if delete {
 		m.doCleanupSlices()
 	}
 	// AiiiiiiiiCnnnn     file chunks
 	klen := 1 + 8 + 1 + 4
-	result, err := m.scanValues(m.fmtKey("A"), func(k, v []byte) bool {
-		return len(k) == klen && k[1+8] == 'C'
-	})
-	if err != nil {
-		logger.Warnf("scan chunks: %s", err)
-		return errno(err)
-	}
-	for key, value := range result {
-		inode := m.decodeInode([]byte(key)[1:9])
-		ss := readSliceBuf(value)
-		for _, s := range ss {
-			if s.chunkid > 0 {
-				slices[inode] = append(slices[inode], Slice{Chunkid: s.chunkid, Size: s.size})
-				if showProgress != nil {
-					showProgress()
+	prefix := m.fmtKey("A")
+	begin := prefix
+	type chunkSlices struct {
+		inode Ino
+		value []byte
+	}
+	for begin != nil {
+		// scan in batches, so the callback is not called within a transaction
+		var batch []chunkSlices
+		var next []byte
+		err := m.client.txn(func(tx kvTxn) error {
+			batch, next = batch[:0], nil
+			tx.scan(begin, func(k, v []byte) bool {
+				if !bytes.HasPrefix(k, prefix) {
+					return false
+				}
+				if len(batch) >= 10000 {
+					next = append([]byte{}, k...)
+					return false
+				}
+				if len(k) == klen && k[1+8] == 'C' {
+					batch = append(batch, chunkSlices{m.decodeInode(k[1:9]), v})
+				}
+				return true
+			})
+			return nil
+		})
+		if err != nil {
+			logger.Warnf("scan chunks: %s", err)
+			return errno(err)
+		}
+		for _, c := range batch {
+			for _, s := range readSliceBuf(c.value) {
+				if s.chunkid > 0 {
+					if err = fn(c.inode, Slice{Chunkid: s.chunkid, Size: s.size}); err != nil {
+						return errno(err)
+					}
 				}
 			}
 		}
+		begin = next
 	}
 	return 0
 }
@@ -1993,14 +2913,9 @@ func (m *kvMeta) ListXattr(ctx Context, inode Ino, names *[]byte) syscall.Errno
 	return 0
 }
 
-func (m *kvMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
-	if name == "" {
-		return syscall.EINVAL
-	}
-	defer timeit(time.Now())
-	inode = m.checkRoot(inode)
+func (m *kvMeta) doSetXattr(ctx Context, inode Ino, name string, value []byte, flags uint32) syscall.Errno {
 	key := m.xattrKey(inode, name)
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(ctx, func(tx kvTxn) error {
 		switch flags {
 		case XattrCreate:
 			v := tx.get(key)
@@ -2019,12 +2934,7 @@ func (m *kvMeta) SetXattr(ctx Context, inode Ino, name string, value []byte, fla
 	return errno(err)
 }
 
-func (m *kvMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
-	if name == "" {
-		return syscall.EINVAL
-	}
-	defer timeit(time.Now())
-	inode = m.checkRoot(inode)
+func (m *kvMeta) doRemoveXattr(ctx Context, inode Ino, name string) syscall.Errno {
 	value, err := m.get(m.xattrKey(inode, name))
 	if err != nil {
 		return errno(err)
@@ -2035,6 +2945,190 @@ func (m *kvMeta) RemoveXattr(ctx Context, inode Ino, name string) syscall.Errno
 	return errno(m.deleteKeys(m.xattrKey(inode, name)))
 }
 
+func (m *kvMeta) doTag(inode Ino, key string, value []byte, add bool) error {
+	if add {
+		return m.txn(Background, func(tx kvTxn) error {
+			tx.set(m.tagKey(key, value, inode), []byte{})
+			return nil
+		})
+	}
+	return m.deleteKeys(m.tagKey(key, value, inode))
+}
+
+func (m *kvMeta) doFindTagged(key string, value []byte) ([]tagged, error) {
+	prefix := m.fmtKey("T", uint8(len(key)), key)
+	if value != nil {
+		prefix = m.fmtKey("T", uint8(len(key)), key, uint8(len(value)), string(value))
+	}
+	keys, err := m.scanKeys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ts := make([]tagged, 0, len(keys))
+	p := 2 + len(key)
+	for _, k := range keys {
+		if len(k) != p+1+int(k[p])+8 {
+			logger.Warnf("invalid tag key %q", k)
+			continue
+		}
+		ts = append(ts, tagged{m.decodeInode(k[len(k)-8:]), k[p+1 : len(k)-8]})
+	}
+	return ts, nil
+}
+
+func (m *kvMeta) doAddEvent(e *Event) error {
+	return m.txn(Background, func(tx kvTxn) error {
+		tx.set(m.eventKey(e.ID), e.marshal())
+		return nil
+	})
+}
+
+func (m *kvMeta) doReadEvents(ctx Context, after uint64, limit int) ([]*Event, error) {
+	var events []*Event
+	prefix := m.fmtKey("E")
+	err := m.client.txn(func(tx kvTxn) error {
+		events = events[:0]
+		tx.scan(m.eventKey(after+1), func(k, v []byte) bool {
+			if !bytes.HasPrefix(k, prefix) {
+				return false
+			}
+			e, err := parseEvent(v)
+			if err != nil {
+				logger.Warnf("key %q: %s", k, err)
+				return true
+			}
+			events = append(events, e)
+			return len(events) < limit
+		})
+		return nil
+	})
+	return events, err
+}
+
+func (m *kvMeta) doCleanupEvents(edge time.Time) (int, error) {
+	var total int
+	prefix := m.fmtKey("E")
+	for {
+		var keys [][]byte
+		err := m.client.txn(func(tx kvTxn) error {
+			keys = keys[:0]
+			tx.scan(prefix, func(k, v []byte) bool {
+				if !bytes.HasPrefix(k, prefix) {
+					return false
+				}
+				if e, err := parseEvent(v); err == nil && e.Time >= edge.UnixNano() {
+					return false
+				}
+				keys = append(keys, append([]byte{}, k...))
+				return len(keys) < eventBatch
+			})
+			return nil
+		})
+		if err == nil {
+			err = m.deleteKeys(keys...)
+		}
+		if err != nil {
+			return total, err
+		}
+		total += len(keys)
+		if len(keys) < eventBatch {
+			return total, nil
+		}
+	}
+}
+
+func (m *kvMeta) doNotify(msg string) error {
+	return nil
+}
+
+func (m *kvMeta) doWatch(cb func(msg string)) error {
+	return fmt.Errorf("notification is not supported by %s", m.Name())
+}
+
+func (m *kvMeta) parseQuota(buf []byte) *Quota {
+	if len(buf) != 32 {
+		logger.Errorf("invalid quota value: %v", buf)
+		return nil
+	}
+	rb := utils.ReadBuffer(buf)
+	return &Quota{
+		MaxSpace:   int64(rb.Get64()),
+		MaxInodes:  int64(rb.Get64()),
+		UsedSpace:  int64(rb.Get64()),
+		UsedInodes: int64(rb.Get64()),
+	}
+}
+
+func (m *kvMeta) packQuota(q *Quota) []byte {
+	wb := utils.NewBuffer(32)
+	wb.Put64(uint64(q.MaxSpace))
+	wb.Put64(uint64(q.MaxInodes))
+	wb.Put64(uint64(q.UsedSpace))
+	wb.Put64(uint64(q.UsedInodes))
+	return wb.Bytes()
+}
+
+func (m *kvMeta) doGetQuota(inode Ino) (*Quota, error) {
+	buf, err := m.get(m.dirQuotaKey(inode))
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return m.parseQuota(buf), nil
+}
+
+func (m *kvMeta) doSetQuota(inode Ino, quota *Quota) error {
+	return m.txn(Background, func(tx kvTxn) error {
+		tx.set(m.dirQuotaKey(inode), m.packQuota(quota))
+		return nil
+	})
+}
+
+func (m *kvMeta) doDelQuota(inode Ino) error {
+	return m.deleteKeys(m.dirQuotaKey(inode))
+}
+
+func (m *kvMeta) doLoadQuotas() (map[Ino]*Quota, error) {
+	vals, err := m.scanValues(m.fmtKey("QD"), nil)
+	if err != nil {
+		return nil, err
+	}
+	quotas := make(map[Ino]*Quota, len(vals))
+	for k, v := range vals {
+		if q := m.parseQuota(v); q != nil {
+			quotas[m.decodeInode([]byte(k[2:]))] = q
+		}
+	}
+	return quotas, nil
+}
+
+func (m *kvMeta) doFlushQuotas(quotas map[Ino]*Quota) error {
+	return m.txn(Background, func(tx kvTxn) error {
+		for inode, delta := range quotas {
+			key := m.dirQuotaKey(inode)
+			buf := tx.get(key)
+			if buf == nil {
+				continue // deleted
+			}
+			q := m.parseQuota(buf)
+			if q == nil {
+				continue
+			}
+			q.UsedSpace += delta.UsedSpace
+			q.UsedInodes += delta.UsedInodes
+			tx.set(key, m.packQuota(q))
+		}
+		return nil
+	})
+}
+
+func (m *kvMeta) doFlushSustained(space, inodes int64) error {
+	return m.txn(Background, func(tx kvTxn) error {
+		tx.incrBy(m.counterKey(sustainedSpace), space)
+		tx.incrBy(m.counterKey(sustainedInodes), inodes)
+		return nil
+	})
+}
+
 func (m *kvMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 	e := &DumpedEntry{}
 	f := func(tx kvTxn) error {
@@ -2084,7 +3178,7 @@ func (m *kvMeta) dumpEntry(inode Ino) (*DumpedEntry, error) {
 	if m.snap != nil {
 		return e, m.snap.txn(f)
 	} else {
-		return e, m.txn(f)
+		return e, m.txn(Background, f)
 	}
 }
 
@@ -2146,91 +3240,39 @@ func (m *kvMeta) dumpDir(inode Ino, tree *DumpedEntry, bw *bufio.Writer, depth i
 	return nil
 }
 
-func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
-	defer func() {
-		if p := recover(); p != nil {
-			if e, ok := p.(error); ok {
-				err = e
-			} else {
-				err = errors.Errorf("DumpMeta error: %v", p)
-			}
-		}
-	}()
+func (m *kvMeta) dumpHeader() (*DumpedMeta, error) {
 	vals, err := m.scanValues(m.fmtKey("D"), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	dels := make([]*DumpedDelFile, 0, len(vals))
 	for k, v := range vals {
 		b := utils.FromBuffer([]byte(k[1:])) // "D"
 		if b.Len() != 16 {
-			return fmt.Errorf("invalid delfileKey: %s", k)
+			return nil, fmt.Errorf("invalid delfileKey: %s", k)
 		}
 		inode := m.decodeInode(b.Get(8))
 		dels = append(dels, &DumpedDelFile{inode, b.Get64(), m.parseInt64(v)})
 	}
 
-	progress := utils.NewProgress(false, false)
-	var tree, trash *DumpedEntry
-	if root == 0 {
-		root = m.root
-	}
-	if root == 1 { // make snap
-		switch c := m.client.(type) {
-		case *memKV:
-			m.snap = c
-		default:
-			m.snap = &memKV{items: btree.New(2), temp: &kvItem{}}
-			bar := progress.AddCountBar("Snapshot keys", 0)
-			if err = m.txn(func(tx kvTxn) error {
-				used := parseCounter(tx.get(m.counterKey(usedSpace)))
-				inodeTotal := parseCounter(tx.get(m.counterKey(totalInodes)))
-				guessKeyTotal := int64(math.Ceil((float64(used/inodeTotal/(64*1024*1024)) + float64(3)) * float64(inodeTotal)))
-				bar.SetCurrent(0) // Reset
-				bar.SetTotal(guessKeyTotal)
-				threshold := 0.1
-				tx.scan(nil, func(key, value []byte) {
-					m.snap.set(string(key), value)
-					if bar.Current() > int64(math.Ceil(float64(guessKeyTotal)*(1-threshold))) {
-						guessKeyTotal += int64(math.Ceil(float64(guessKeyTotal) * threshold))
-						bar.SetTotal(guessKeyTotal)
-					}
-					bar.Increment()
-				})
-				return nil
-			}); err != nil {
-				return err
-			}
-			bar.Done()
-		}
-		if trash, err = m.dumpEntry(TrashInode); err != nil {
-			trash = nil
-		}
-	}
-	if tree, err = m.dumpEntry(root); err != nil {
-		return err
-	}
-	if tree == nil {
-		return errors.New("The entry of the root inode was not found")
-	}
-	tree.Name = "FSTree"
 	format, err := m.Load()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var rs [][]byte
-	err = m.txn(func(tx kvTxn) error {
+	err = m.txn(Background, func(tx kvTxn) error {
 		rs = tx.gets(m.counterKey(usedSpace),
 			m.counterKey(totalInodes),
 			m.counterKey("nextInode"),
 			m.counterKey("nextChunk"),
 			m.counterKey("nextSession"),
-			m.counterKey("nextTrash"))
+			m.counterKey("nextTrash"),
+			m.counterKey("generation"))
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cs := make([]int64, len(rs))
 	for i, r := range rs {
@@ -2239,22 +3281,15 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		}
 	}
 
-	if root == 1 {
-		err = m.snap.txn(func(tx kvTxn) error {
-			vals = tx.scanValues(m.fmtKey("SS"), nil)
-			return nil
-		})
-	} else {
-		vals, err = m.scanValues(m.fmtKey("SS"), nil)
-	}
+	vals, err = m.scanValues(m.fmtKey("SS"), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	ss := make(map[uint64][]Ino)
 	for k := range vals {
 		b := utils.FromBuffer([]byte(k[2:])) // "SS"
 		if b.Len() != 16 {
-			return fmt.Errorf("invalid sustainedKey: %s", k)
+			return nil, fmt.Errorf("invalid sustainedKey: %s", k)
 		}
 		sid := b.Get64()
 		inode := m.decodeInode(b.Get(8))
@@ -2265,7 +3300,7 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 		sessions = append(sessions, &DumpedSustained{k, v})
 	}
 
-	dm := DumpedMeta{
+	return &DumpedMeta{
 		Setting: format,
 		Counters: &DumpedCounters{
 			UsedSpace:   cs[0],
@@ -2274,9 +3309,71 @@ func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
 			NextChunk:   cs[3],
 			NextSession: cs[4],
 			NextTrash:   cs[5],
+			Generation:  cs[6],
 		},
 		Sustained: sessions,
 		DelFiles:  dels,
+	}, nil
+}
+
+func (m *kvMeta) DumpMeta(w io.Writer, root Ino) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			if e, ok := p.(error); ok {
+				err = e
+			} else {
+				err = errors.Errorf("DumpMeta error: %v", p)
+			}
+		}
+	}()
+	progress := utils.NewProgress(false, false)
+	var tree, trash *DumpedEntry
+	if root == 0 {
+		root = m.root
+	}
+	if root == 1 { // make snap
+		switch c := m.client.(type) {
+		case *memKV:
+			m.snap = c
+		default:
+			m.snap = &memKV{items: btree.New(2), temp: &kvItem{}}
+			bar := progress.AddCountBar("Snapshot keys", 0)
+			if err = m.txn(Background, func(tx kvTxn) error {
+				used := parseCounter(tx.get(m.counterKey(usedSpace)))
+				inodeTotal := parseCounter(tx.get(m.counterKey(totalInodes)))
+				guessKeyTotal := int64(math.Ceil((float64(used/inodeTotal/(64*1024*1024)) + float64(3)) * float64(inodeTotal)))
+				bar.SetCurrent(0) // Reset
+				bar.SetTotal(guessKeyTotal)
+				threshold := 0.1
+				tx.scan(nil, func(key, value []byte) bool {
+					m.snap.set(string(key), value)
+					if bar.Current() > int64(math.Ceil(float64(guessKeyTotal)*(1-threshold))) {
+						guessKeyTotal += int64(math.Ceil(float64(guessKeyTotal) * threshold))
+						bar.SetTotal(guessKeyTotal)
+					}
+					bar.Increment()
+					return true
+				})
+				return nil
+			}); err != nil {
+				return err
+			}
+			bar.Done()
+		}
+		if trash, err = m.dumpEntry(TrashInode); err != nil {
+			trash = nil
+		}
+	}
+	if tree, err = m.dumpEntry(root); err != nil {
+		return err
+	}
+	if tree == nil {
+		return errors.New("The entry of the root inode was not found")
+	}
+	tree.Name = "FSTree"
+	dm, err := m.dumpHeader()
+	if err != nil {
+		return err
 	}
 	bw, err := dm.writeJsonWithOutTree(w)
 	if err != nil {
@@ -2319,7 +3416,7 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]i
 	logger.Debugf("Loading entry inode %d name %s", inode, e.Name)
 	attr := loadAttr(e.Attr)
 	attr.Parent = e.Parent
-	return m.txn(func(tx kvTxn) error {
+	return m.txn(Background, func(tx kvTxn) error {
 		if attr.Typ == TypeFile {
 			attr.Length = e.Attr.Length
 			for _, c := range e.Chunks {
@@ -2332,8 +3429,8 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]i
 					m.Lock()
 					refs[string(m.sliceKey(s.Chunkid, s.Size))]++
 					m.Unlock()
-					if cs.NextChunk <= int64(s.Chunkid) {
-						cs.NextChunk = int64(s.Chunkid) + 1
+					if cs.NextChunk <= int64(idSeq(s.Chunkid)) {
+						cs.NextChunk = int64(idSeq(s.Chunkid)) + 1
 					}
 				}
 				tx.set(m.chunkKey(inode, c.Index), slices)
@@ -2347,13 +3444,20 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]i
 			attr.Length = uint64(len(e.Symlink))
 			tx.set(m.symKey(inode), []byte(e.Symlink))
 		}
+		if len(e.Parents) > 1 {
+			parents := make(map[Ino]int)
+			for _, p := range e.Parents {
+				parents[p]++
+			}
+			m.setParents(tx, inode, parents)
+		}
 		if inode > 1 && inode != TrashInode {
 			cs.UsedSpace += align4K(attr.Length)
 			cs.UsedInodes += 1
 		}
 		if inode < TrashInode {
-			if cs.NextInode <= int64(inode) {
-				cs.NextInode = int64(inode) + 1
+			if cs.NextInode <= int64(idSeq(uint64(inode))) {
+				cs.NextInode = int64(idSeq(uint64(inode))) + 1
 			}
 		} else {
 			if cs.NextTrash < int64(inode)-TrashInode {
@@ -2363,15 +3467,18 @@ func (m *kvMeta) loadEntry(e *DumpedEntry, cs *DumpedCounters, refs map[string]i
 
 		for _, x := range e.Xattrs {
 			tx.set(m.xattrKey(inode, x.Name), []byte(x.Value))
+			if strings.HasPrefix(x.Name, TagPrefix) {
+				tx.set(m.tagKey(x.Name[len(TagPrefix):], []byte(x.Value), inode), []byte{})
+			}
 		}
 		tx.set(m.inodeKey(inode), m.marshal(attr))
 		return nil
 	})
 }
 
-func (m *kvMeta) LoadMeta(r io.Reader) error {
+func (m *kvMeta) LoadMeta(r io.Reader, opts *LoadOptions) error {
 	var exist bool
-	err := m.txn(func(tx kvTxn) error {
+	err := m.txn(Background, func(tx kvTxn) error {
 		exist = tx.exist(m.fmtKey())
 		return nil
 	})
@@ -2382,81 +3489,25 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 		return fmt.Errorf("Database %s is not empty", m.Name())
 	}
 
-	dec := json.NewDecoder(r)
-	dm := &DumpedMeta{}
-	if err := dec.Decode(dm); err != nil {
-		return err
-	}
-	format, err := json.MarshalIndent(dm.Setting, "", "")
-	if err != nil {
-		return err
-	}
-
-	progress := utils.NewProgress(false, false)
-	bar := progress.AddCountBar("Collected entries", 1) // with root
-	showProgress := func(totalIncr, currentIncr int64) {
-		bar.IncrTotal(totalIncr)
-		bar.IncrInt64(currentIncr)
-	}
-	dm.FSTree.Attr.Inode = 1
-	entries := make(map[Ino]*DumpedEntry)
-	if err = collectEntry(dm.FSTree, entries, showProgress); err != nil {
-		return err
-	}
-	if dm.Trash != nil {
-		bar.IncrTotal(1)
-		if err = collectEntry(dm.Trash, entries, showProgress); err != nil {
-			return err
-		}
-	}
-	bar.Done()
-
 	counters := &DumpedCounters{
 		NextInode: 2,
 		NextChunk: 1,
 	}
 	refs := make(map[string]int64)
-	bar = progress.AddCountBar("Loaded entries", int64(len(entries)))
-	maxNum := 100
-	pool := make(chan struct{}, maxNum)
-	errCh := make(chan error, 100)
-	done := make(chan struct{}, 1)
-	var wg sync.WaitGroup
-	for _, entry := range entries {
-		select {
-		case err = <-errCh:
-			return err
-		default:
-		}
-		pool <- struct{}{}
-		wg.Add(1)
-		go func(entry *DumpedEntry) {
-			defer func() {
-				wg.Done()
-				bar.Increment()
-				<-pool
-			}()
-			if err = m.loadEntry(entry, counters, refs); err != nil {
-				errCh <- err
-			}
-		}(entry)
+	dm, err := loadEntries(r, opts, func(e *DumpedEntry) error { return m.loadEntry(e, counters, refs) })
+	if err != nil {
+		return err
 	}
-
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case err = <-errCh:
+	format, err := json.MarshalIndent(dm.Setting, "", "")
+	if err != nil {
 		return err
-	case <-done:
 	}
-	progress.Done()
+	// the inode numbers not in the dump could be reused by other files after loaded
+	counters.Generation = dm.Counters.Generation + 1
 	logger.Infof("Dumped counters: %+v", *dm.Counters)
 	logger.Infof("Loaded counters: %+v", *counters)
 
-	return m.txn(func(tx kvTxn) error {
+	return m.txn(Background, func(tx kvTxn) error {
 		tx.set(m.fmtKey("setting"), format)
 		tx.set(m.counterKey(usedSpace), packCounter(counters.UsedSpace))
 		tx.set(m.counterKey(totalInodes), packCounter(counters.UsedInodes))
@@ -2464,6 +3515,7 @@ func (m *kvMeta) LoadMeta(r io.Reader) error {
 		tx.set(m.counterKey("nextChunk"), packCounter(counters.NextChunk))
 		tx.set(m.counterKey("nextSession"), packCounter(counters.NextSession))
 		tx.set(m.counterKey("nextTrash"), packCounter(counters.NextTrash))
+		tx.set(m.counterKey("generation"), packCounter(counters.Generation))
 		for _, d := range dm.DelFiles {
 			tx.set(m.delfileKey(d.Inode, d.Length), m.packInt64(d.Expire))
 		}
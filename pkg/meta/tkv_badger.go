@@ -0,0 +1,217 @@
+//go:build !nobadger
+// +build !nobadger
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	Register("badger", newKVMeta)
+	drivers["badger"] = newBadgerClient
+}
+
+// badgerLogger forwards the logs of Badger, which are too verbose at info level.
+type badgerLogger struct{}
+
+func (badgerLogger) Errorf(f string, args ...interface{})   { logger.Errorf(f, args...) }
+func (badgerLogger) Warningf(f string, args ...interface{}) { logger.Warnf(f, args...) }
+func (badgerLogger) Infof(f string, args ...interface{})    { logger.Debugf(f, args...) }
+func (badgerLogger) Debugf(f string, args ...interface{})   { logger.Tracef(f, args...) }
+
+// newBadgerClient opens an embedded Badger database in the directory addr, which
+// can be used by only one process at the same time.
+func newBadgerClient(addr string) (tkvClient, error) {
+	db, err := badger.Open(badger.DefaultOptions(addr).WithLogger(badgerLogger{}))
+	if err != nil {
+		return nil, err
+	}
+	return &badgerClient{db}, nil
+}
+
+type badgerTxn struct {
+	t *badger.Txn
+}
+
+// badgerValue keeps empty values distinguishable from missing ones
+func badgerValue(item *badger.Item) []byte {
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		panic(err)
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
+
+func (tx *badgerTxn) get(key []byte) []byte {
+	item, err := tx.t.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		panic(err)
+	}
+	return badgerValue(item)
+}
+
+func (tx *badgerTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tx.get(key)
+	}
+	return values
+}
+
+// iterate walks through the keys in [begin, end) in order, end could be nil.
+func (tx *badgerTxn) iterate(begin, end []byte, keysOnly bool, handler func(k, v []byte) bool) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = !keysOnly
+	it := tx.t.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(begin); it.Valid(); it.Next() {
+		item := it.Item()
+		k := item.KeyCopy(nil)
+		if len(end) > 0 && bytes.Compare(k, end) >= 0 {
+			break
+		}
+		var v []byte
+		if !keysOnly {
+			v = badgerValue(item)
+		}
+		if !handler(k, v) {
+			break
+		}
+	}
+}
+
+func (tx *badgerTxn) scanRange(begin, end []byte) map[string][]byte {
+	ret := make(map[string][]byte)
+	tx.iterate(begin, end, false, func(k, v []byte) bool {
+		ret[string(k)] = v
+		return true
+	})
+	return ret
+}
+
+func (tx *badgerTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	tx.iterate(prefix, nil, false, handler)
+}
+
+func (tx *badgerTxn) scanKeys(prefix []byte) [][]byte {
+	var keys [][]byte
+	tx.iterate(prefix, nextKey(prefix), true, func(k, v []byte) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+func (tx *badgerTxn) scanValues(prefix []byte, filter func(k, v []byte) bool) map[string][]byte {
+	ret := make(map[string][]byte)
+	tx.iterate(prefix, nextKey(prefix), false, func(k, v []byte) bool {
+		if filter == nil || filter(k, v) {
+			ret[string(k)] = v
+		}
+		return true
+	})
+	return ret
+}
+
+func (tx *badgerTxn) exist(prefix []byte) bool {
+	var found bool
+	tx.iterate(prefix, nextKey(prefix), true, func(k, v []byte) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+func (tx *badgerTxn) set(key, value []byte) {
+	if err := tx.t.Set(key, value); err != nil {
+		panic(err)
+	}
+}
+
+func (tx *badgerTxn) append(key []byte, value []byte) []byte {
+	new := append(tx.get(key), value...)
+	tx.set(key, new)
+	return new
+}
+
+func (tx *badgerTxn) incrBy(key []byte, value int64) int64 {
+	var new int64
+	buf := tx.get(key)
+	if len(buf) > 0 {
+		new = parseCounter(buf)
+	}
+	if value != 0 {
+		new += value
+		tx.set(key, packCounter(new))
+	}
+	return new
+}
+
+func (tx *badgerTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		if err := tx.t.Delete(key); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type badgerClient struct {
+	db *badger.DB
+}
+
+func (c *badgerClient) name() string {
+	return "badger"
+}
+
+func (c *badgerClient) txn(f func(kvTxn) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(error)
+			if ok {
+				err = fe
+			} else {
+				err = errors.Errorf("badger client txn func error: %v", r)
+			}
+		}
+	}()
+	err = c.db.Update(func(t *badger.Txn) error {
+		return f(&badgerTxn{t})
+	})
+	if err == badger.ErrConflict {
+		err = errors.Wrap(err, "write conflict")
+	}
+	return err
+}
+
+func (c *badgerClient) reset(prefix []byte) error {
+	if len(prefix) == 0 {
+		return c.db.DropAll()
+	}
+	return c.db.DropPrefix(prefix)
+}
@@ -0,0 +1,303 @@
+//go:build !noetcd
+// +build !noetcd
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/clientv3"
+)
+
+const etcdScanBatch = 1024
+
+func init() {
+	Register("etcd", newKVMeta)
+	drivers["etcd"] = newEtcdClient
+}
+
+// newEtcdClient connects to etcd with addr like [user:password@]host1:2379[,host2:2379...]/prefix
+func newEtcdClient(addr string) (tkvClient, error) {
+	conf := clientv3.Config{DialTimeout: time.Second * 5}
+	if p := strings.LastIndex(addr, "@"); p > 0 {
+		auth := addr[:p]
+		addr = addr[p+1:]
+		if q := strings.Index(auth, ":"); q >= 0 {
+			conf.Username, conf.Password = auth[:q], auth[q+1:]
+		} else {
+			conf.Username = auth
+		}
+	}
+	var prefix string
+	if p := strings.Index(addr, "/"); p > 0 {
+		prefix = addr[p+1:]
+		addr = addr[:p]
+	}
+	conf.Endpoints = strings.Split(addr, ",")
+	client, err := clientv3.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	return withPrefix(&etcdClient{client}, append([]byte(prefix), 0xFD)), nil
+}
+
+// etcdTxn is an optimistic transaction: all the reads are served from a snapshot of the
+// first read, the writes are buffered and committed only if none of the keys or ranges
+// read have been changed since the snapshot.
+type etcdTxn struct {
+	ctx      context.Context
+	kv       clientv3.KV
+	rev      int64
+	cmps     []clientv3.Cmp
+	observed map[string]bool
+	buffer   map[string][]byte
+}
+
+func (tx *etcdTxn) read(key string, opts ...clientv3.OpOption) *clientv3.GetResponse {
+	if tx.rev > 0 {
+		opts = append(opts, clientv3.WithRev(tx.rev))
+	}
+	resp, err := tx.kv.Get(tx.ctx, key, opts...)
+	if err != nil {
+		panic(err)
+	}
+	if tx.rev == 0 {
+		tx.rev = resp.Header.Revision
+	}
+	return resp
+}
+
+func (tx *etcdTxn) get(key []byte) []byte {
+	k := string(key)
+	if v, ok := tx.buffer[k]; ok {
+		return v
+	}
+	resp := tx.read(k)
+	if !tx.observed[k] {
+		tx.observed[k] = true
+		tx.cmps = append(tx.cmps, clientv3.Compare(clientv3.ModRevision(k), "<", tx.rev+1))
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	return etcdValue(resp.Kvs[0].Value)
+}
+
+// etcdValue keeps empty values distinguishable from missing ones
+func etcdValue(v []byte) []byte {
+	if v == nil {
+		return []byte{}
+	}
+	return v
+}
+
+func (tx *etcdTxn) gets(keys ...[]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tx.get(key)
+	}
+	return values
+}
+
+// scanAll scans the keys in [begin, end) in order, end could be nil.
+func (tx *etcdTxn) scanAll(begin, end []byte, keysOnly bool, handler func(k, v []byte) bool) {
+	start := string(begin)
+	rangeEnd := clientv3.GetPrefixRangeEnd("") // "\x00", up to the last key
+	if len(end) > 0 {
+		rangeEnd = string(end)
+	}
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(rangeEnd), clientv3.WithLimit(etcdScanBatch)}
+		if keysOnly {
+			opts = append(opts, clientv3.WithKeysOnly())
+		}
+		resp := tx.read(start, opts...)
+		for _, kv := range resp.Kvs {
+			v := kv.Value
+			if !keysOnly {
+				v = etcdValue(v)
+			}
+			if !handler(kv.Key, v) {
+				tx.cmps = append(tx.cmps, clientv3.Compare(clientv3.ModRevision(string(begin)), "<", tx.rev+1).WithRange(string(append(kv.Key, 0))))
+				return
+			}
+		}
+		if !resp.More {
+			break
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+	tx.cmps = append(tx.cmps, clientv3.Compare(clientv3.ModRevision(string(begin)), "<", tx.rev+1).WithRange(rangeEnd))
+}
+
+// scanRange returns the keys in [begin, end) with the buffered writes applied.
+func (tx *etcdTxn) scanRange(begin, end []byte) map[string][]byte {
+	ret := make(map[string][]byte)
+	tx.scanAll(begin, end, false, func(k, v []byte) bool {
+		ret[string(k)] = v
+		return true
+	})
+	for k, v := range tx.buffer {
+		if k >= string(begin) && (len(end) == 0 || k < string(end)) {
+			if v == nil {
+				delete(ret, k)
+			} else {
+				ret[k] = v
+			}
+		}
+	}
+	return ret
+}
+
+func (tx *etcdTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	tx.scanAll(prefix, nil, false, handler)
+}
+
+func (tx *etcdTxn) scanKeys(prefix []byte) [][]byte {
+	res := tx.scanRange(prefix, nextKey(prefix))
+	keys := make([][]byte, 0, len(res))
+	for k := range res {
+		keys = append(keys, []byte(k))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+func (tx *etcdTxn) scanValues(prefix []byte, filter func(k, v []byte) bool) map[string][]byte {
+	res := tx.scanRange(prefix, nextKey(prefix))
+	for k, v := range res {
+		if filter != nil && !filter([]byte(k), v) {
+			delete(res, k)
+		}
+	}
+	return res
+}
+
+func (tx *etcdTxn) exist(prefix []byte) bool {
+	for k, v := range tx.buffer {
+		if v != nil && strings.HasPrefix(k, string(prefix)) {
+			return true
+		}
+	}
+	var found bool
+	tx.scanAll(prefix, nextKey(prefix), true, func(k, v []byte) bool {
+		if v, ok := tx.buffer[string(k)]; ok && v == nil {
+			return true // deleted
+		}
+		found = true
+		return false
+	})
+	return found
+}
+
+func (tx *etcdTxn) set(key, value []byte) {
+	tx.buffer[string(key)] = value
+}
+
+func (tx *etcdTxn) append(key []byte, value []byte) []byte {
+	new := append(tx.get(key), value...)
+	tx.set(key, new)
+	return new
+}
+
+func (tx *etcdTxn) incrBy(key []byte, value int64) int64 {
+	var new int64
+	buf := tx.get(key)
+	if len(buf) > 0 {
+		new = parseCounter(buf)
+	}
+	if value != 0 {
+		new += value
+		tx.set(key, packCounter(new))
+	}
+	return new
+}
+
+func (tx *etcdTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.buffer[string(key)] = nil
+	}
+}
+
+type etcdClient struct {
+	client *clientv3.Client
+}
+
+func (c *etcdClient) name() string {
+	return "etcd"
+}
+
+func (c *etcdClient) txn(f func(kvTxn) error) (err error) {
+	tx := &etcdTxn{
+		ctx:      context.Background(),
+		kv:       c.client.KV,
+		observed: make(map[string]bool),
+		buffer:   make(map[string][]byte),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fe, ok := r.(error)
+			if ok {
+				err = fe
+			} else {
+				err = errors.Errorf("etcd client txn func error: %v", r)
+			}
+		}
+	}()
+	if err = f(tx); err != nil {
+		return err
+	}
+	if len(tx.buffer) == 0 {
+		return nil
+	}
+	ops := make([]clientv3.Op, 0, len(tx.buffer))
+	for k, v := range tx.buffer {
+		if v == nil {
+			ops = append(ops, clientv3.OpDelete(k))
+		} else {
+			ops = append(ops, clientv3.OpPut(k, string(v)))
+		}
+	}
+	resp, err := c.client.Txn(tx.ctx).If(tx.cmps...).Then(ops...).Commit()
+	if err != nil {
+		if strings.Contains(err.Error(), "too many operations") {
+			return errors.Wrapf(err, "%d compares and %d operations (please increase --max-txn-ops of etcd)", len(tx.cmps), len(ops))
+		}
+		return err
+	}
+	if !resp.Succeeded {
+		return errors.New("write conflict: keys were changed by other transactions")
+	}
+	return nil
+}
+
+func (c *etcdClient) reset(prefix []byte) error {
+	var err error
+	if len(prefix) == 0 {
+		_, err = c.client.Delete(context.Background(), "\x00", clientv3.WithFromKey())
+	} else {
+		_, err = c.client.Delete(context.Background(), string(prefix), clientv3.WithPrefix())
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+//go:build fdb
+// +build fdb
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+)
+
+func init() {
+	Register("fdb", newKVMeta)
+	drivers["fdb"] = newFdbClient
+}
+
+// newFdbClient connects to FoundationDB with addr like /etc/foundationdb/fdb.cluster?prefix=jfs
+func newFdbClient(addr string) (tkvClient, error) {
+	err := fdb.APIVersion(630)
+	if err != nil {
+		return nil, fmt.Errorf("set API version: %s", err)
+	}
+	u, err := url.Parse("fdb://" + addr)
+	if err != nil {
+		return nil, err
+	}
+	db, err := fdb.OpenDatabase(u.Path)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %s", err)
+	}
+	prefix := u.Query().Get("prefix")
+	return withPrefix(&fdbClient{db}, append([]byte(prefix), 0xFD)), nil
+}
+
+type fdbTxn struct {
+	fdb.Transaction
+}
+
+func (tx *fdbTxn) get(key []byte) []byte {
+	return tx.Get(fdb.Key(key)).MustGet()
+}
+
+func (tx *fdbTxn) gets(keys ...[]byte) [][]byte {
+	fs := make([]fdb.FutureByteSlice, len(keys))
+	for i, key := range keys {
+		fs[i] = tx.Get(fdb.Key(key))
+	}
+	values := make([][]byte, len(keys))
+	for i, f := range fs {
+		values[i] = f.MustGet()
+	}
+	return values
+}
+
+func (tx *fdbTxn) scanRange(begin, end []byte) map[string][]byte {
+	it := tx.GetRange(fdb.KeyRange{Begin: fdb.Key(begin), End: fdb.Key(end)},
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).Iterator()
+	ret := make(map[string][]byte)
+	for it.Advance() {
+		kv := it.MustGet()
+		ret[string(kv.Key)] = kv.Value
+	}
+	return ret
+}
+
+func (tx *fdbTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	it := tx.GetRange(fdb.KeyRange{Begin: fdb.Key(prefix), End: fdb.Key{0xFF}},
+		fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+	for it.Advance() {
+		kv := it.MustGet()
+		if !handler(kv.Key, kv.Value) {
+			break
+		}
+	}
+}
+
+func (tx *fdbTxn) scanKeys(prefix []byte) [][]byte {
+	it := tx.GetRange(fdb.KeyRange{Begin: fdb.Key(prefix), End: fdb.Key(nextKey(prefix))},
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).Iterator()
+	var ret [][]byte
+	for it.Advance() {
+		ret = append(ret, it.MustGet().Key)
+	}
+	return ret
+}
+
+func (tx *fdbTxn) scanValues(prefix []byte, filter func(k, v []byte) bool) map[string][]byte {
+	it := tx.GetRange(fdb.KeyRange{Begin: fdb.Key(prefix), End: fdb.Key(nextKey(prefix))},
+		fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).Iterator()
+	ret := make(map[string][]byte)
+	for it.Advance() {
+		kv := it.MustGet()
+		if filter == nil || filter(kv.Key, kv.Value) {
+			ret[string(kv.Key)] = kv.Value
+		}
+	}
+	return ret
+}
+
+func (tx *fdbTxn) exist(prefix []byte) bool {
+	it := tx.GetRange(fdb.KeyRange{Begin: fdb.Key(prefix), End: fdb.Key(nextKey(prefix))},
+		fdb.RangeOptions{Limit: 1}).Iterator()
+	return it.Advance()
+}
+
+func (tx *fdbTxn) set(key, value []byte) {
+	tx.Set(fdb.Key(key), value)
+}
+
+func (tx *fdbTxn) append(key []byte, value []byte) []byte {
+	new := append(tx.get(key), value...)
+	tx.set(key, new)
+	return new
+}
+
+func (tx *fdbTxn) incrBy(key []byte, value int64) int64 {
+	var new int64
+	buf := tx.get(key)
+	if len(buf) > 0 {
+		new = parseCounter(buf)
+	}
+	if value != 0 {
+		new += value
+		tx.set(key, packCounter(new))
+	}
+	return new
+}
+
+func (tx *fdbTxn) dels(keys ...[]byte) {
+	for _, key := range keys {
+		tx.Clear(fdb.Key(key))
+	}
+}
+
+type fdbClient struct {
+	client fdb.Database
+}
+
+func (c *fdbClient) name() string {
+	return "fdb"
+}
+
+// txn runs f within a FoundationDB transaction, which is retried automatically on conflicts.
+func (c *fdbClient) txn(f func(kvTxn) error) error {
+	_, err := c.client.Transact(func(t fdb.Transaction) (interface{}, error) {
+		return nil, f(&fdbTxn{t})
+	})
+	return err
+}
+
+func (c *fdbClient) reset(prefix []byte) error {
+	_, err := c.client.Transact(func(t fdb.Transaction) (interface{}, error) {
+		end := fdb.Key{0xFF}
+		if len(prefix) > 0 {
+			end = fdb.Key(nextKey(prefix))
+		}
+		t.ClearRange(fdb.KeyRange{Begin: fdb.Key(prefix), End: end})
+		return nil, nil
+	})
+	return err
+}
@@ -1,6 +1,3 @@
-//go:build !fdb
-// +build !fdb
-
 /*
  * JuiceFS, Copyright 2021 Juicedata, Inc.
  *
@@ -23,7 +20,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/btree"
 )
@@ -35,8 +35,18 @@ func init() {
 
 const settingPath = "/tmp/juicefs.memkv.setting.json"
 
+// newMockClient creates an in-memory client. If addr is an absolute path (memkv:///path/to/snapshot),
+// all the keys are loaded from the snapshot file, and saved into it every second once changed.
 func newMockClient(addr string) (tkvClient, error) {
 	client := &memKV{items: btree.New(2), temp: &kvItem{}}
+	if strings.HasPrefix(addr, "/") {
+		client.snapshot = addr
+		if err := client.load(); err != nil {
+			return nil, err
+		}
+		go client.flush()
+		return client, nil
+	}
 	if d, err := ioutil.ReadFile(settingPath); err == nil {
 		var buffer map[string][]byte
 		if err = json.Unmarshal(d, &buffer); err == nil {
@@ -97,15 +107,14 @@ func (tx *memTxn) scanRange(begin_, end_ []byte) map[string][]byte {
 	return ret
 }
 
-func (tx *memTxn) scan(prefix []byte, handler func(key []byte, value []byte)) {
+func (tx *memTxn) scan(prefix []byte, handler func(key []byte, value []byte) bool) {
 	tx.store.Lock()
 	defer tx.store.Unlock()
 	begin := string(prefix)
 	tx.store.items.AscendGreaterOrEqual(&kvItem{key: begin}, func(i btree.Item) bool {
 		it := i.(*kvItem)
 		tx.observed[it.key] = it.ver
-		handler([]byte(it.key), it.value)
-		return true
+		return handler([]byte(it.key), it.value)
 	})
 }
 
@@ -192,8 +201,66 @@ func (it *kvItem) Less(o btree.Item) bool {
 
 type memKV struct {
 	sync.Mutex
-	items *btree.BTree
-	temp  *kvItem
+	items    *btree.BTree
+	temp     *kvItem
+	snapshot string
+	dirty    bool
+}
+
+func (c *memKV) load() error {
+	d, err := ioutil.ReadFile(c.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items map[string][]byte
+	if err = json.Unmarshal(d, &items); err != nil {
+		return fmt.Errorf("load snapshot %s: %s", c.snapshot, err)
+	}
+	for k, v := range items {
+		c.set(k, v) // not locked
+	}
+	return nil
+}
+
+// save writes all the keys into the snapshot file, which is replaced atomically.
+func (c *memKV) save() error {
+	c.Lock()
+	if !c.dirty {
+		c.Unlock()
+		return nil
+	}
+	items := make(map[string][]byte, c.items.Len())
+	c.items.Ascend(func(i btree.Item) bool {
+		it := i.(*kvItem)
+		items[it.key] = it.value
+		return true
+	})
+	c.dirty = false
+	c.Unlock()
+	d, err := json.Marshal(items)
+	if err == nil {
+		tmp := c.snapshot + ".tmp"
+		if err = ioutil.WriteFile(tmp, d, 0600); err == nil {
+			err = os.Rename(tmp, c.snapshot)
+		}
+	}
+	if err != nil {
+		c.Lock()
+		c.dirty = true
+		c.Unlock()
+	}
+	return err
+}
+
+func (c *memKV) flush() {
+	for range time.Tick(time.Second) {
+		if err := c.save(); err != nil {
+			logger.Warnf("save snapshot %s: %s", c.snapshot, err)
+		}
+	}
 }
 
 func (c *memKV) name() string {
@@ -237,6 +304,14 @@ func (c *memKV) txn(f func(kvTxn) error) error {
 	if len(tx.buffer) == 0 {
 		return nil
 	}
+	if _, ok := tx.buffer["setting"]; ok && c.snapshot != "" {
+		// save it before the process (e.g. format) exits
+		defer func() {
+			if err := c.save(); err != nil {
+				logger.Warnf("save snapshot %s: %s", c.snapshot, err)
+			}
+		}()
+	}
 	c.Lock()
 	defer c.Unlock()
 	for k, ver := range tx.observed {
@@ -247,7 +322,7 @@ func (c *memKV) txn(f func(kvTxn) error) error {
 			return fmt.Errorf("write conflict: %s %d > %d", k, it.ver, ver)
 		}
 	}
-	if _, ok := tx.buffer["setting"]; ok {
+	if _, ok := tx.buffer["setting"]; ok && c.snapshot == "" {
 		d, _ := json.Marshal(tx.buffer)
 		if err := ioutil.WriteFile(settingPath, d, 0644); err != nil {
 			return err
@@ -256,6 +331,7 @@ func (c *memKV) txn(f func(kvTxn) error) error {
 	for k, value := range tx.buffer {
 		c.set(k, value)
 	}
+	c.dirty = true
 	return nil
 }
 
@@ -266,6 +342,7 @@ func (c *memKV) reset(prefix []byte) error {
 	c.Lock()
 	c.items = btree.New(2)
 	c.temp = &kvItem{}
+	c.dirty = true
 	c.Unlock()
 	return nil
 }
@@ -0,0 +1,593 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+The protocol between JuiceFS and an out-of-tree metadata engine is gRPC over a unix socket
+or TCP, the service is defined in tkv_plugin.proto. The engine only needs to provide a
+transactional key-value store:
+
+  KV.Txn    stream TxnRequest -> stream TxnReply
+            GET     keys                           -> values, missing
+            SCAN    begin, end, limit, keys_only   -> ordered keys in [begin, end), at most limit, and values
+            SET     keys, values                   -> empty
+            DELETE  keys                           -> empty
+            COMMIT                                 -> empty
+  KV.Reset  prefix -> empty, delete all the keys with the prefix
+
+A transaction lives as long as the stream of KV.Txn, it's rolled back if the stream is closed
+before a COMMIT. Reads in a transaction should see the writes before them in the same
+transaction. A request or the commit fails by ending the stream with an error, which should
+contain "write conflict" if the transaction conflicts with others, then it will be retried
+by JuiceFS.
+*/
+
+const (
+	pluginScanBatch  = 1024
+	pluginMaxMessage = 256 << 20
+)
+
+func init() {
+	Register("plugin", newKVMeta)
+	drivers["plugin"] = newPluginClient
+}
+
+// PluginOp is the operation of a request in a transaction of the plugin protocol.
+type PluginOp int32
+
+const (
+	PluginGet PluginOp = iota
+	PluginScan
+	PluginSet
+	PluginDelete
+	PluginCommit
+)
+
+// PluginRequest is the TxnRequest in the plugin protocol.
+type PluginRequest struct {
+	Op       PluginOp
+	Keys     [][]byte
+	Values   [][]byte
+	Begin    []byte
+	End      []byte
+	Limit    uint32
+	KeysOnly bool
+}
+
+// PluginReply is the TxnReply in the plugin protocol.
+type PluginReply struct {
+	Keys    [][]byte
+	Values  [][]byte
+	Missing []bool
+}
+
+// PluginResetRequest is the ResetRequest in the plugin protocol.
+type PluginResetRequest struct {
+	Prefix []byte
+}
+
+// PluginResetReply is the ResetReply in the plugin protocol.
+type PluginResetReply struct{}
+
+// The messages are encoded by hand, so no generated code is needed.
+
+func (r *PluginRequest) Reset()         { *r = PluginRequest{} }
+func (r *PluginRequest) String() string { return fmt.Sprintf("%+v", *r) }
+func (r *PluginRequest) ProtoMessage()  {}
+
+func (r *PluginRequest) Marshal() ([]byte, error) {
+	var b []byte
+	if r.Op != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.Op))
+	}
+	b = appendRepeatedBytes(b, 2, r.Keys)
+	b = appendRepeatedBytes(b, 3, r.Values)
+	b = appendBytes(b, 4, r.Begin)
+	b = appendBytes(b, 5, r.End)
+	if r.Limit != 0 {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.Limit))
+	}
+	if r.KeysOnly {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	return b, nil
+}
+
+func (r *PluginRequest) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var v []byte
+		var x uint64
+		n := -1
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+			r.Op = PluginOp(x)
+		case num == 2 && typ == protowire.BytesType:
+			v, n = consumeBytes(b)
+			r.Keys = append(r.Keys, v)
+		case num == 3 && typ == protowire.BytesType:
+			v, n = consumeBytes(b)
+			r.Values = append(r.Values, v)
+		case num == 4 && typ == protowire.BytesType:
+			r.Begin, n = consumeBytes(b)
+		case num == 5 && typ == protowire.BytesType:
+			r.End, n = consumeBytes(b)
+		case num == 6 && typ == protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+			r.Limit = uint32(x)
+		case num == 7 && typ == protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+			r.KeysOnly = x != 0
+		}
+		return n
+	})
+}
+
+func (r *PluginReply) Reset()         { *r = PluginReply{} }
+func (r *PluginReply) String() string { return fmt.Sprintf("%+v", *r) }
+func (r *PluginReply) ProtoMessage()  {}
+
+func (r *PluginReply) Marshal() ([]byte, error) {
+	var b []byte
+	b = appendRepeatedBytes(b, 1, r.Keys)
+	b = appendRepeatedBytes(b, 2, r.Values)
+	if len(r.Missing) > 0 {
+		var packed []byte
+		for _, m := range r.Missing {
+			packed = protowire.AppendVarint(packed, protowire.EncodeBool(m))
+		}
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, packed)
+	}
+	return b, nil
+}
+
+func (r *PluginReply) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		var v []byte
+		n := -1
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n = consumeBytes(b)
+			r.Keys = append(r.Keys, v)
+		case num == 2 && typ == protowire.BytesType:
+			v, n = consumeBytes(b)
+			r.Values = append(r.Values, v)
+		case num == 3 && typ == protowire.VarintType: // unpacked
+			var x uint64
+			x, n = protowire.ConsumeVarint(b)
+			r.Missing = append(r.Missing, x != 0)
+		case num == 3 && typ == protowire.BytesType: // packed
+			v, n = protowire.ConsumeBytes(b)
+			for len(v) > 0 {
+				x, m := protowire.ConsumeVarint(v)
+				if m < 0 {
+					return m
+				}
+				r.Missing = append(r.Missing, x != 0)
+				v = v[m:]
+			}
+		}
+		return n
+	})
+}
+
+func (r *PluginResetRequest) Reset()         { *r = PluginResetRequest{} }
+func (r *PluginResetRequest) String() string { return fmt.Sprintf("%+v", *r) }
+func (r *PluginResetRequest) ProtoMessage()  {}
+
+func (r *PluginResetRequest) Marshal() ([]byte, error) {
+	return appendBytes(nil, 1, r.Prefix), nil
+}
+
+func (r *PluginResetRequest) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		n := -1
+		if num == 1 && typ == protowire.BytesType {
+			r.Prefix, n = consumeBytes(b)
+		}
+		return n
+	})
+}
+
+func (r *PluginResetReply) Reset()                   { *r = PluginResetReply{} }
+func (r *PluginResetReply) String() string           { return "{}" }
+func (r *PluginResetReply) ProtoMessage()            {}
+func (r *PluginResetReply) Marshal() ([]byte, error) { return nil, nil }
+
+func (r *PluginResetReply) Unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int { return -1 })
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendRepeatedBytes(b []byte, num protowire.Number, vs [][]byte) []byte {
+	for _, v := range vs {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	return b
+}
+
+// consumeBytes returns a copy of the bytes, which is not nil.
+func consumeBytes(b []byte) ([]byte, int) {
+	v, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return nil, n
+	}
+	return append([]byte{}, v...), n
+}
+
+// consumeFields parses the fields in b with field, which returns the length of the value,
+// or -1 to skip an unknown field.
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = field(num, typ, b); n == -1 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+type pluginServer interface {
+	Txn(stream grpc.ServerStream) error
+	Reset(ctx context.Context, req *PluginResetRequest) (*PluginResetReply, error)
+}
+
+var pluginService = grpc.ServiceDesc{
+	ServiceName: "juicefs.meta.KV",
+	HandlerType: (*pluginServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Reset",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(PluginResetRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			return srv.(pluginServer).Reset(ctx, req)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Txn",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(pluginServer).Txn(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+	Metadata: "tkv_plugin.proto",
+}
+
+// newPluginClient connects to a metadata engine process, the addr could be
+// the path of unix socket or host:port.
+func newPluginClient(addr string) (tkvClient, error) {
+	network := "unix"
+	if !strings.HasPrefix(addr, "/") && strings.Contains(addr, ":") {
+		network = "tcp"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(), grpc.FailOnNonTempDialError(true),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(pluginMaxMessage), grpc.MaxCallSendMsgSize(pluginMaxMessage)))
+	if err != nil {
+		return nil, err
+	}
+	return &pluginClient{conn}, nil
+}
+
+type pluginClient struct {
+	conn *grpc.ClientConn
+}
+
+func (c *pluginClient) name() string {
+	return "plugin"
+}
+
+func (c *pluginClient) txn(f func(kvTxn) error) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // roll back the transaction if it's not committed
+	stream, err := c.conn.NewStream(ctx, &pluginService.Streams[0], "/juicefs.meta.KV/Txn")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			fe, isErr := r.(error)
+			if isErr {
+				err = fe
+			} else {
+				err = errors.Errorf("plugin client txn func error: %v", r)
+			}
+		}
+	}()
+	tx := &pluginTxn{stream}
+	if err = f(tx); err != nil {
+		return err
+	}
+	_, err = tx.do(&PluginRequest{Op: PluginCommit})
+	return err
+}
+
+func (c *pluginClient) reset(prefix []byte) error {
+	return c.conn.Invoke(context.Background(), "/juicefs.meta.KV/Reset", &PluginResetRequest{prefix}, &PluginResetReply{})
+}
+
+type pluginTxn struct {
+	stream grpc.ClientStream
+}
+
+func (tx *pluginTxn) do(req *PluginRequest) (*PluginReply, error) {
+	// io.EOF means the stream is ended by the engine, the error is returned by RecvMsg
+	if err := tx.stream.SendMsg(req); err != nil && err != io.EOF {
+		return nil, err
+	}
+	reply := new(PluginReply)
+	if err := tx.stream.RecvMsg(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (tx *pluginTxn) call(req *PluginRequest) *PluginReply {
+	reply, err := tx.do(req)
+	if err != nil {
+		panic(err)
+	}
+	return reply
+}
+
+func (tx *pluginTxn) get(key []byte) []byte {
+	return tx.gets(key)[0]
+}
+
+func (tx *pluginTxn) gets(keys ...[]byte) [][]byte {
+	reply := tx.call(&PluginRequest{Op: PluginGet, Keys: keys})
+	if len(reply.Values) != len(keys) {
+		panic(fmt.Errorf("expect %d values, but got %d", len(keys), len(reply.Values)))
+	}
+	for i := range reply.Missing {
+		if reply.Missing[i] {
+			reply.Values[i] = nil
+		}
+	}
+	return reply.Values
+}
+
+// scanBatch returns the ordered keys and values in [begin, end).
+func (tx *pluginTxn) scanBatch(begin, end []byte, keysOnly bool) ([][]byte, [][]byte) {
+	reply := tx.call(&PluginRequest{Op: PluginScan, Begin: begin, End: end, Limit: pluginScanBatch, KeysOnly: keysOnly})
+	if !keysOnly && len(reply.Values) != len(reply.Keys) {
+		panic(fmt.Errorf("expect %d values, but got %d", len(reply.Keys), len(reply.Values)))
+	}
+	return reply.Keys, reply.Values
+}
+
+func (tx *pluginTxn) scanAll(begin, end []byte, keysOnly bool, handler func(k, v []byte) bool) {
+	for {
+		keys, values := tx.scanBatch(begin, end, keysOnly)
+		for i, k := range keys {
+			var v []byte
+			if !keysOnly {
+				v = values[i]
+			}
+			if !handler(k, v) {
+				return
+			}
+		}
+		if len(keys) < pluginScanBatch {
+			return
+		}
+		begin = append(keys[len(keys)-1], 0)
+	}
+}
+
+func (tx *pluginTxn) scanRange(begin, end []byte) map[string][]byte {
+	ret := make(map[string][]byte)
+	tx.scanAll(begin, end, false, func(k, v []byte) bool {
+		ret[string(k)] = v
+		return true
+	})
+	return ret
+}
+
+func (tx *pluginTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	tx.scanAll(prefix, nil, false, handler)
+}
+
+func (tx *pluginTxn) scanKeys(prefix []byte) [][]byte {
+	var keys [][]byte
+	tx.scanAll(prefix, nextKey(prefix), true, func(k, v []byte) bool {
+		keys = append(keys, k)
+		return true
+	})
+	return keys
+}
+
+func (tx *pluginTxn) scanValues(prefix []byte, filter func(k, v []byte) bool) map[string][]byte {
+	ret := make(map[string][]byte)
+	tx.scanAll(prefix, nextKey(prefix), false, func(k, v []byte) bool {
+		if filter == nil || filter(k, v) {
+			ret[string(k)] = v
+		}
+		return true
+	})
+	return ret
+}
+
+func (tx *pluginTxn) exist(prefix []byte) bool {
+	reply := tx.call(&PluginRequest{Op: PluginScan, Begin: prefix, End: nextKey(prefix), Limit: 1, KeysOnly: true})
+	return len(reply.Keys) > 0
+}
+
+func (tx *pluginTxn) set(key, value []byte) {
+	tx.call(&PluginRequest{Op: PluginSet, Keys: [][]byte{key}, Values: [][]byte{value}})
+}
+
+func (tx *pluginTxn) append(key []byte, value []byte) []byte {
+	new := append(tx.get(key), value...)
+	tx.set(key, new)
+	return new
+}
+
+func (tx *pluginTxn) incrBy(key []byte, value int64) int64 {
+	var new int64
+	buf := tx.get(key)
+	if len(buf) > 0 {
+		new = parseCounter(buf)
+	}
+	if value != 0 {
+		new += value
+		tx.set(key, packCounter(new))
+	}
+	return new
+}
+
+func (tx *pluginTxn) dels(keys ...[]byte) {
+	if len(keys) == 0 {
+		return
+	}
+	tx.call(&PluginRequest{Op: PluginDelete, Keys: keys})
+}
+
+// ServeKVPlugin serves the key-value store of a TKV metadata engine (e.g. memkv://, tikv://pd:2379/jfs)
+// with the plugin protocol, which can be used as a reference or a proxy of engines.
+func ServeKVPlugin(ln net.Listener, uri string) error {
+	p := strings.Index(uri, "://")
+	if p < 0 {
+		return fmt.Errorf("invalid uri: %s", uri)
+	}
+	client, err := newTkvClient(uri[:p], uri[p+3:])
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(pluginMaxMessage), grpc.MaxSendMsgSize(pluginMaxMessage))
+	server.RegisterService(&pluginService, &kvService{client})
+	return server.Serve(ln)
+}
+
+type kvService struct {
+	client tkvClient
+}
+
+func (s *kvService) Txn(stream grpc.ServerStream) error {
+	err := s.client.txn(func(tx kvTxn) error {
+		for {
+			req := new(PluginRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err // closed before committed, roll it back
+			}
+			if req.Op == PluginCommit {
+				return nil
+			}
+			reply, err := s.do(tx, req)
+			if err != nil {
+				return err
+			}
+			if err = stream.SendMsg(reply); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(&PluginReply{})
+}
+
+func (s *kvService) do(tx kvTxn, req *PluginRequest) (reply *PluginReply, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	reply = new(PluginReply)
+	switch req.Op {
+	case PluginGet:
+		reply.Values = tx.gets(req.Keys...)
+		reply.Missing = make([]bool, len(reply.Values))
+		for i, v := range reply.Values {
+			reply.Missing[i] = v == nil
+		}
+	case PluginScan:
+		tx.scan(req.Begin, func(k, v []byte) bool {
+			if len(req.End) > 0 && bytes.Compare(k, req.End) >= 0 || len(reply.Keys) >= int(req.Limit) {
+				return false
+			}
+			reply.Keys = append(reply.Keys, k)
+			if !req.KeysOnly {
+				reply.Values = append(reply.Values, v)
+			}
+			return true
+		})
+	case PluginSet:
+		if len(req.Keys) != len(req.Values) {
+			return nil, fmt.Errorf("got %d keys but %d values", len(req.Keys), len(req.Values))
+		}
+		for i, k := range req.Keys {
+			tx.set(k, req.Values[i])
+		}
+	case PluginDelete:
+		tx.dels(req.Keys...)
+	default:
+		return nil, fmt.Errorf("unknown operation %d", req.Op)
+	}
+	return reply, nil
+}
+
+func (s *kvService) Reset(ctx context.Context, req *PluginResetRequest) (*PluginResetReply, error) {
+	var prefix []byte
+	if len(req.Prefix) > 0 {
+		prefix = req.Prefix
+	}
+	return &PluginResetReply{}, s.client.reset(prefix)
+}
@@ -50,10 +50,10 @@ func (tx *prefixTxn) scanRange(begin_, end_ []byte) map[string][]byte {
 	}
 	return m
 }
-func (tx *prefixTxn) scan(prefix []byte, handler func(key, value []byte)) {
-	tx.kvTxn.scan(tx.realKey(prefix), func(key, value []byte) {
+func (tx *prefixTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
+	tx.kvTxn.scan(tx.realKey(prefix), func(key, value []byte) bool {
 		key = tx.origKey(key)
-		handler(key, value)
+		return handler(key, value)
 	})
 }
 func (tx *prefixTxn) scanKeys(prefix []byte) [][]byte {
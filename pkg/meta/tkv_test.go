@@ -18,8 +18,13 @@
 package meta
 
 import (
+	"bytes"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestMemKVClient(t *testing.T) {
@@ -31,6 +36,81 @@ func TestMemKVClient(t *testing.T) {
 	testMeta(t, m)
 }
 
+func TestPluginClient(t *testing.T) {
+	_ = os.Remove(settingPath)
+	sock := filepath.Join(t.TempDir(), "kv.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+	go ServeKVPlugin(ln, "memkv://")
+	m, err := newKVMeta("plugin", sock, &Config{MaxDeletes: 1})
+	if err != nil || m.Name() != "plugin" {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
+
+func TestPluginMessages(t *testing.T) {
+	// the bytes are encoded as tkv_plugin.proto
+	req := &PluginRequest{Op: PluginSet, Keys: [][]byte{[]byte("a")}, Values: [][]byte{{}}}
+	buf, _ := req.Marshal()
+	if expected := []byte{0x08, 0x02, 0x12, 0x01, 'a', 0x1a, 0x00}; !bytes.Equal(buf, expected) {
+		t.Fatalf("encoded request %x, expect %x", buf, expected)
+	}
+	var req2 PluginRequest
+	if err := req2.Unmarshal(buf); err != nil || !reflect.DeepEqual(req, &req2) {
+		t.Fatalf("decoded request %+v: %s", req2, err)
+	}
+	req = &PluginRequest{Op: PluginScan, Begin: []byte("b"), End: []byte("c"), Limit: 10, KeysOnly: true}
+	buf, _ = req.Marshal()
+	req2.Reset()
+	if err := req2.Unmarshal(buf); err != nil || !reflect.DeepEqual(req, &req2) {
+		t.Fatalf("decoded request %+v: %s", req2, err)
+	}
+
+	// an existing empty value is told from a missing one
+	reply := &PluginReply{Values: [][]byte{{}, {}, []byte("v")}, Missing: []bool{false, true, false}}
+	buf, _ = reply.Marshal()
+	var reply2 PluginReply
+	if err := reply2.Unmarshal(buf); err != nil || !reflect.DeepEqual(reply, &reply2) {
+		t.Fatalf("decoded reply %+v: %s", reply2, err)
+	}
+	// unpacked bools and unknown fields are accepted
+	reply2.Reset()
+	if err := reply2.Unmarshal([]byte{0x18, 0x01, 0x18, 0x00, 0x20, 0x05}); err != nil || !reflect.DeepEqual(reply2.Missing, []bool{true, false}) {
+		t.Fatalf("decoded missing %v: %s", reply2.Missing, err)
+	}
+	if err := reply2.Unmarshal([]byte{0x12, 0x05, 'a'}); err == nil {
+		t.Fatalf("truncated reply should fail")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	_ = os.Remove(settingPath)
+	m, err := newKVMeta("memkv", "jfs-heartbeat", &Config{Heartbeat: time.Millisecond * 100})
+	if err != nil {
+		t.Fatalf("create meta: %s", err)
+	}
+	if err = m.Init(Format{Name: "test"}, true); err != nil {
+		t.Fatalf("init: %s", err)
+	}
+	if err = m.NewSession(); err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer m.CloseSession()
+	km := m.(*kvMeta)
+	_ = km.setValue(km.sessionKey(km.sid), km.packInt64(time.Now().Add(-time.Minute*3).Unix()))
+	if ses, _ := m.ListSessions(&SessionFilter{Idle: time.Minute * 2}); len(ses) != 1 {
+		t.Fatalf("session should be idle: %+v", ses)
+	}
+	time.Sleep(time.Millisecond * 500)
+	if ses, _ := m.ListSessions(&SessionFilter{Idle: time.Minute * 2}); len(ses) != 0 {
+		t.Fatalf("heartbeat should be refreshed: %+v", ses)
+	}
+}
+
 func TestTiKVClient(t *testing.T) {
 	m, err := newKVMeta("tikv", "127.0.0.1:2379/jfs-unit-test", &Config{MaxDeletes: 1})
 	if err != nil || m.Name() != "tikv" {
@@ -39,6 +119,22 @@ func TestTiKVClient(t *testing.T) {
 	testMeta(t, m)
 }
 
+func TestBadgerClient(t *testing.T) {
+	m, err := newKVMeta("badger", t.TempDir(), &Config{MaxDeletes: 1})
+	if err != nil || m.Name() != "badger" {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
+
+func TestEtcdClient(t *testing.T) {
+	m, err := newKVMeta("etcd", "127.0.0.1:2379/jfs-unit-test", &Config{MaxDeletes: 1})
+	if err != nil || m.Name() != "etcd" {
+		t.Fatalf("create meta: %s", err)
+	}
+	testMeta(t, m)
+}
+
 func TestMemKV(t *testing.T) {
 	c, _ := newTkvClient("memkv", "")
 	c = withPrefix(c, []byte("jfs"))
@@ -65,3 +161,32 @@ func TestMemKV(t *testing.T) {
 		t.Fatalf("counter should be 0, but got %d", count)
 	}
 }
+
+func TestMemKVSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jfs.snapshot")
+	c, err := newMockClient(path)
+	if err != nil {
+		t.Fatalf("create memkv: %s", err)
+	}
+	_ = c.txn(func(tx kvTxn) error {
+		tx.set([]byte("k"), []byte("v"))
+		tx.set([]byte("empty"), []byte{})
+		return nil
+	})
+	if err = c.(*memKV).save(); err != nil {
+		t.Fatalf("save snapshot: %s", err)
+	}
+	c2, err := newMockClient(path)
+	if err != nil {
+		t.Fatalf("load snapshot: %s", err)
+	}
+	_ = c2.txn(func(tx kvTxn) error {
+		if v := tx.get([]byte("k")); string(v) != "v" {
+			t.Fatalf("expect v, but got %q", v)
+		}
+		if v := tx.get([]byte("empty")); v == nil || len(v) != 0 {
+			t.Fatalf("expect empty value, but got %v", v)
+		}
+		return nil
+	})
+}
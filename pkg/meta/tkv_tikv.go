@@ -118,14 +118,16 @@ func (tx *tikvTxn) scanRange(begin, end []byte) map[string][]byte {
 	return tx.scanRange0(begin, end, nil)
 }
 
-func (tx *tikvTxn) scan(prefix []byte, handler func(key, value []byte)) {
+func (tx *tikvTxn) scan(prefix []byte, handler func(key, value []byte) bool) {
 	it, err := tx.Iter(prefix, nil) //nolint:typecheck
 	if err != nil {
 		panic(err)
 	}
 	defer it.Close()
 	for it.Valid() {
-		handler(it.Key(), it.Value())
+		if !handler(it.Key(), it.Value()) {
+			break
+		}
 		if err = it.Next(); err != nil {
 			panic(err)
 		}
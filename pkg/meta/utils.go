@@ -17,8 +17,8 @@
 package meta
 
 import (
-	"bytes"
 	"fmt"
+	"path"
 	"runtime/debug"
 	"sort"
 	"strings"
@@ -30,12 +30,14 @@ import (
 )
 
 const (
-	usedSpace    = "usedSpace"
-	totalInodes  = "totalInodes"
-	delfiles     = "delfiles"
-	allSessions  = "sessions"
-	sessionInfos = "sessionInfos"
-	sliceRefs    = "sliceRef"
+	usedSpace       = "usedSpace"
+	totalInodes     = "totalInodes"
+	sustainedSpace  = "sustainedSpace"
+	sustainedInodes = "sustainedInodes"
+	delfiles        = "delfiles"
+	allSessions     = "sessions"
+	sessionInfos    = "sessionInfos"
+	sliceRefs       = "sliceRef"
 )
 
 const (
@@ -48,16 +50,41 @@ const (
 	fallocInsertRange   = 0x20
 )
 
+// holeChunk is the part of a hole (punched or zeroed by fallocate) in a chunk.
+type holeChunk struct {
+	indx  uint32
+	off   uint32
+	len   uint32
+	whole bool // no data is left in the chunk, so it can be released
+}
+
+// holeChunks splits the hole [off, off+size) of a file with length into chunks, the part beyond length is ignored.
+func holeChunks(off, size, length uint64) []holeChunk {
+	if off >= length {
+		return nil
+	}
+	if off+size > length {
+		size = length - off
+	}
+	var hs []holeChunk
+	for size > 0 {
+		coff := off % ChunkSize
+		l := size
+		if coff+size > ChunkSize {
+			l = ChunkSize - coff
+		}
+		hs = append(hs, holeChunk{uint32(off / ChunkSize), uint32(coff), uint32(l), coff == 0 && (l == ChunkSize || off+l >= length)})
+		off += l
+		size -= l
+	}
+	return hs
+}
+
 type msgCallbacks struct {
 	sync.Mutex
 	callbacks map[uint32]MsgCallback
 }
 
-type freeID struct {
-	next  uint64
-	maxid uint64
-}
-
 var logger = utils.GetLogger("juicefs")
 
 func errno(err error) syscall.Errno {
@@ -71,10 +98,14 @@ func errno(err error) syscall.Errno {
 		return syscall.ENOENT
 	}
 	if strings.HasPrefix(err.Error(), "OOM") {
-		return syscall.ENOSPC
+		return utils.Errno(utils.NewError(utils.ErrNoSpace, err))
 	}
-	logger.Errorf("error: %s\n%s", err, debug.Stack())
-	return syscall.EIO
+	if utils.ClassOf(err) == utils.ErrUnknown {
+		logger.Errorf("error: %s\n%s", err, debug.Stack())
+	} else {
+		logger.Warnf("error: %s", err)
+	}
+	return utils.Errno(err)
 }
 
 func accessMode(attr *Attr, uid uint32, gids []uint32) uint8 {
@@ -138,6 +169,32 @@ func loadLocks(d []byte) []plockRecord {
 	return ls
 }
 
+// checkFlags checks the change of attributes in SetAttr against the flags of inode: only root can change
+// the flags, and the other attributes of immutable or append-only inodes can't be changed.
+func checkFlags(ctx Context, flags uint8, set uint16, attr *Attr) syscall.Errno {
+	if flags&(FlagImmutable|FlagAppend) != 0 && set&^SetAttrFlag != 0 {
+		return syscall.EPERM
+	}
+	if set&SetAttrFlag != 0 && attr.Flags != flags && ctx.Uid() != 0 {
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// decodeLocks parses the packed records of POSIX locks for display.
+func decodeLocks(d []byte) []PlockRecord {
+	ls := loadLocks(d)
+	rs := make([]PlockRecord, 0, len(ls))
+	for _, l := range ls {
+		typ := "R"
+		if l.ltype == F_WRLCK {
+			typ = "W"
+		}
+		rs = append(rs, PlockRecord{l.start, l.end, typ, l.pid})
+	}
+	return rs
+}
+
 func dumpLocks(ls []plockRecord) []byte {
 	wb := utils.NewBuffer(uint32(len(ls)) * 24)
 	for _, l := range ls {
@@ -200,109 +257,93 @@ func updateLocks(ls []plockRecord, nl plockRecord) []plockRecord {
 	return ls
 }
 
-func emptyDir(r Meta, ctx Context, inode Ino, concurrent chan int) syscall.Errno {
-	if st := r.Access(ctx, inode, 3, nil); st != 0 {
-		return st
-	}
-	var entries []*Entry
-	if st := r.Readdir(ctx, inode, 0, &entries); st != 0 {
-		return st
-	}
-	var wg sync.WaitGroup
-	var status syscall.Errno
-	for _, e := range entries {
-		if e.Inode == inode || len(e.Name) == 2 && string(e.Name) == ".." {
+// Remove removes a file or a directory recursively.
+func Remove(r Meta, ctx Context, parent Ino, name string) syscall.Errno {
+	return r.Remove(ctx, parent, name, nil)
+}
+
+// TreeStats counts the entries handled by CreateTree.
+type TreeStats struct {
+	Dirs    uint64 // directories created
+	Files   uint64 // files created
+	Existed uint64 // entries existing already
+}
+
+// CreateTree creates the directories and empty files of paths under root, together with the missing
+// parents of them like MkdirAll. A path ending with "/" is a directory, others are files. The entries of
+// the same directory are created by MknodBatch, one level after another.
+func CreateTree(r Meta, ctx Context, root Ino, paths []string, dirMode, fileMode uint16, stats *TreeStats) error {
+	dirs := make(map[string]bool)
+	files := make(map[string]bool)
+	for _, p := range paths {
+		isDir := strings.HasSuffix(p, "/")
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if p == "" {
 			continue
 		}
-		if e.Attr.Typ == TypeDirectory {
-			select {
-			case concurrent <- 1:
-				wg.Add(1)
-				go func(child Ino, name string) {
-					defer wg.Done()
-					e := emptyEntry(r, ctx, inode, name, child, concurrent)
-					if e != 0 {
-						status = e
-					}
-					<-concurrent
-				}(e.Inode, string(e.Name))
-			default:
-				if st := emptyEntry(r, ctx, inode, string(e.Name), e.Inode, concurrent); st != 0 {
-					return st
-				}
-			}
+		if isDir {
+			dirs[p] = true
 		} else {
-			if st := r.Unlink(ctx, inode, string(e.Name)); st != 0 {
-				return st
-			}
+			files[p] = true
 		}
-	}
-	wg.Wait()
-	return status
-}
-
-func emptyEntry(r Meta, ctx Context, parent Ino, name string, inode Ino, concurrent chan int) syscall.Errno {
-	st := emptyDir(r, ctx, inode, concurrent)
-	if st == 0 {
-		st = r.Rmdir(ctx, parent, name)
-		if st == syscall.ENOTEMPTY {
-			st = emptyEntry(r, ctx, parent, name, inode, concurrent)
+		for d := path.Dir(p); d != "."; d = path.Dir(d) {
+			dirs[d] = true
 		}
 	}
-	return st
-}
-
-func Remove(r Meta, ctx Context, parent Ino, name string) syscall.Errno {
-	if st := r.Access(ctx, parent, 3, nil); st != 0 {
-		return st
-	}
-	var inode Ino
-	var attr Attr
-	if st := r.Lookup(ctx, parent, name, &inode, &attr); st != 0 {
-		return st
-	}
-	if attr.Typ != TypeDirectory {
-		return r.Unlink(ctx, parent, name)
+	var levels [][]string
+	for d := range dirs {
+		depth := strings.Count(d, "/")
+		for len(levels) <= depth {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], d)
 	}
-	concurrent := make(chan int, 50)
-	return emptyEntry(r, ctx, parent, name, inode, concurrent)
-}
 
-func GetSummary(r Meta, ctx Context, inode Ino, summary *Summary, recursive bool) syscall.Errno {
-	var attr Attr
-	if st := r.GetAttr(ctx, inode, &attr); st != 0 {
-		return st
-	}
-	if attr.Typ == TypeDirectory {
-		var entries []*Entry
-		if st := r.Readdir(ctx, inode, 1, &entries); st != 0 {
-			return st
+	inodes := map[string]Ino{".": root}
+	create := func(ps []string, _type uint8, mode uint16) error {
+		groups := make(map[string][]string)
+		for _, p := range ps {
+			groups[path.Dir(p)] = append(groups[path.Dir(p)], p)
 		}
-		for _, e := range entries {
-			if e.Inode == inode || len(e.Name) == 2 && bytes.Equal(e.Name, []byte("..")) {
-				continue
+		for dir, group := range groups {
+			sort.Strings(group)
+			names := make([]string, len(group))
+			for i, p := range group {
+				names[i] = path.Base(p)
+			}
+			ins := make([]Ino, len(names))
+			sts := make([]syscall.Errno, len(names))
+			if st := r.MknodBatch(ctx, inodes[dir], names, _type, mode, 0, ins, sts); st != 0 {
+				return fmt.Errorf("create entries in /%s: %s", strings.TrimPrefix(dir, "."), st)
 			}
-			if e.Attr.Typ == TypeDirectory {
-				if recursive {
-					if st := GetSummary(r, ctx, e.Inode, summary, recursive); st != 0 {
-						return st
+			for i, p := range group {
+				switch sts[i] {
+				case 0:
+					if _type == TypeDirectory {
+						stats.Dirs++
+					} else {
+						stats.Files++
 					}
-				} else {
-					summary.Dirs++
-					summary.Size += 4096
+				case syscall.EEXIST:
+					stats.Existed++
+				default:
+					return fmt.Errorf("create /%s: %s", p, sts[i])
+				}
+				if _type == TypeDirectory {
+					inodes[p] = ins[i]
 				}
-			} else {
-				summary.Files++
-				summary.Length += e.Attr.Length
-				summary.Size += uint64(align4K(e.Attr.Length))
 			}
 		}
-		summary.Dirs++
-		summary.Size += 4096
-	} else {
-		summary.Files++
-		summary.Length += attr.Length
-		summary.Size += uint64(align4K(attr.Length))
+		return nil
 	}
-	return 0
+	for _, level := range levels {
+		if err := create(level, TypeDirectory, dirMode); err != nil {
+			return err
+		}
+	}
+	var fs []string
+	for f := range files {
+		fs = append(fs, f)
+	}
+	return create(fs, TypeFile, fileMode)
 }
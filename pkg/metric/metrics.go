@@ -63,23 +63,104 @@ var (
 		Name: "used_inodes",
 		Help: "Total number of inodes.",
 	})
+	sustainedSpace = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sustained_space",
+		Help: "Space in bytes held by deleted files which are still open.",
+	})
+	trashSpace = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "trash_space",
+		Help: "Space in bytes held by files in the trash.",
+	})
+	pendingFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_deleted_files",
+		Help: "The number of removed files waiting to be deleted.",
+	})
+	pendingFileSpace = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_deleted_file_space",
+		Help: "Space in bytes held by removed files waiting to be deleted.",
+	})
+	pendingSlices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_deleted_slices",
+		Help: "The number of unreferenced slices waiting to be deleted.",
+	})
+	pendingSliceSpace = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "pending_deleted_slice_space",
+		Help: "Space in bytes held by unreferenced slices waiting to be deleted.",
+	})
+	leakedSlices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "leaked_slices",
+		Help: "The number of slices never referenced by any file, which may be leaked.",
+	})
+	leakedSpace = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "leaked_slice_space",
+		Help: "Space in bytes held by slices never referenced by any file.",
+	})
+	gcAlert = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gc_alert",
+		Help: "1 if the space held by pending deletions and leaked slices exceeds GCAlertSpace of the volume.",
+	})
 )
 
+// updateGCStats scans the pending deletions and leaked slices, and alerts if they hold too much space.
+func updateGCStats(m meta.Meta) {
+	var stats meta.GCStats
+	if st := m.GetGCStats(meta.Background, &stats); st != 0 {
+		logger.Warnf("get gc stats: %s", st)
+		return
+	}
+	pendingFiles.Set(float64(stats.PendingFiles))
+	pendingFileSpace.Set(float64(stats.PendingFileSpace))
+	pendingSlices.Set(float64(stats.PendingSlices))
+	pendingSliceSpace.Set(float64(stats.PendingSliceSpace))
+	leakedSlices.Set(float64(stats.LeakedSlices))
+	leakedSpace.Set(float64(stats.LeakedSpace))
+	format, err := m.Load()
+	if err != nil {
+		logger.Warnf("load setting: %s", err)
+		return
+	}
+	if format.GCAlertSpace > 0 && stats.Total() > format.GCAlertSpace {
+		gcAlert.Set(1)
+		logger.Warnf("Space held by pending deletions and leaked slices (%d bytes) exceeds the alert threshold (%d bytes): %+v",
+			stats.Total(), format.GCAlertSpace, stats)
+	} else {
+		gcAlert.Set(0)
+	}
+}
+
 func UpdateMetrics(m meta.Meta) {
 	prometheus.MustRegister(cpu)
 	prometheus.MustRegister(memory)
 	prometheus.MustRegister(uptime)
 	prometheus.MustRegister(usedSpace)
 	prometheus.MustRegister(usedInodes)
+	prometheus.MustRegister(sustainedSpace)
+	prometheus.MustRegister(trashSpace)
+	prometheus.MustRegister(pendingFiles)
+	prometheus.MustRegister(pendingFileSpace)
+	prometheus.MustRegister(pendingSlices)
+	prometheus.MustRegister(pendingSliceSpace)
+	prometheus.MustRegister(leakedSlices)
+	prometheus.MustRegister(leakedSpace)
+	prometheus.MustRegister(gcAlert)
 
 	ctx := meta.Background
-	for {
+	for i := 0; ; i++ {
 		var totalSpace, availSpace, iused, iavail uint64
 		err := m.StatFS(ctx, &totalSpace, &availSpace, &iused, &iavail)
 		if err == 0 {
 			usedSpace.Set(float64(totalSpace - availSpace))
 			usedInodes.Set(float64(iused))
 		}
+		var pending meta.PendingUsage
+		if st := m.GetPendingUsage(ctx, &pending); st == 0 {
+			sustainedSpace.Set(float64(pending.SustainedSpace))
+			trashSpace.Set(float64(pending.TrashSpace))
+		}
+		// scanning all the slices is even more expensive, do it every 30 minutes
+		if i%180 == 0 {
+			updateGCStats(m)
+		}
 		time.Sleep(time.Second * 10)
 	}
 }
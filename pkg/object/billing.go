@@ -0,0 +1,237 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Classes of requests, which are charged differently by most of the object stores.
+const (
+	classA    = "class-a" // PUT, LIST and multipart uploads
+	classB    = "class-b" // GET and HEAD
+	classFree = "free"    // DELETE and aborting uploads
+)
+
+var (
+	billingRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_billing_requests",
+		Help: "Requests to object store by billing class.",
+	}, []string{"backend", "class"})
+	billingBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "object_billing_bytes",
+		Help: "Bytes transferred from/to object store.",
+	}, []string{"backend", "direction"})
+	billingCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "object_billing_estimated_cost",
+		Help: "Estimated cost of requests and traffic to object store, based on the price table.",
+	}, []string{"backend", "item"})
+	billingOnce sync.Once
+)
+
+// Prices is the price table to estimate the cost of object store, in any currency.
+type Prices struct {
+	ClassA   float64 // per 1000 class A requests
+	ClassB   float64 // per 1000 class B requests
+	Download float64 // per GiB downloaded
+	Upload   float64 // per GiB uploaded
+}
+
+// ParsePrices parses a price table like "class-a=0.005,class-b=0.0004,download=0.09".
+func ParsePrices(s string) (*Prices, error) {
+	var p Prices
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid price: %s", item)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid price: %s", item)
+		}
+		switch strings.TrimSpace(kv[0]) {
+		case classA:
+			p.ClassA = v
+		case classB:
+			p.ClassB = v
+		case "download":
+			p.Download = v
+		case "upload":
+			p.Upload = v
+		default:
+			return nil, fmt.Errorf("unknown item of price: %s", kv[0])
+		}
+	}
+	return &p, nil
+}
+
+type withBilling struct {
+	ObjectStorage
+	prices   Prices
+	requests map[string]prometheus.Counter
+	costs    map[string]prometheus.Gauge
+	download prometheus.Counter
+	upload   prometheus.Counter
+}
+
+// WithBilling returns an object storage that counts the requests and traffic to the backend,
+// and estimates the cost of them with the prices (could be nil).
+func WithBilling(os ObjectStorage, backend string, prices *Prices) ObjectStorage {
+	billingOnce.Do(func() {
+		_ = prometheus.Register(billingRequests)
+		_ = prometheus.Register(billingBytes)
+		_ = prometheus.Register(billingCost)
+	})
+	b := &withBilling{
+		ObjectStorage: os,
+		requests:      make(map[string]prometheus.Counter),
+		costs:         make(map[string]prometheus.Gauge),
+		download:      billingBytes.WithLabelValues(backend, "download"),
+		upload:        billingBytes.WithLabelValues(backend, "upload"),
+	}
+	if prices != nil {
+		b.prices = *prices
+	}
+	for _, class := range []string{classA, classB, classFree} {
+		b.requests[class] = billingRequests.WithLabelValues(backend, class)
+	}
+	for _, item := range []string{classA, classB, "download", "upload"} {
+		b.costs[item] = billingCost.WithLabelValues(backend, item)
+	}
+	return b
+}
+
+func (b *withBilling) request(class string) {
+	b.requests[class].Inc()
+	switch class {
+	case classA:
+		b.costs[class].Add(b.prices.ClassA / 1000)
+	case classB:
+		b.costs[class].Add(b.prices.ClassB / 1000)
+	}
+}
+
+func (b *withBilling) downloaded(n int) {
+	b.download.Add(float64(n))
+	b.costs["download"].Add(float64(n) / (1 << 30) * b.prices.Download)
+}
+
+func (b *withBilling) uploaded(n int) {
+	b.upload.Add(float64(n))
+	b.costs["upload"].Add(float64(n) / (1 << 30) * b.prices.Upload)
+}
+
+func (b *withBilling) Create() error {
+	b.request(classA)
+	return b.ObjectStorage.Create()
+}
+
+type countedReader struct {
+	io.ReadCloser
+	count func(int)
+}
+
+func (r *countedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count(n)
+	return n, err
+}
+
+func (b *withBilling) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	b.request(classB)
+	r, err := b.ObjectStorage.Get(key, off, limit)
+	if err != nil {
+		return nil, err
+	}
+	return &countedReader{r, b.downloaded}, nil
+}
+
+func (b *withBilling) Put(key string, in io.Reader) error {
+	b.request(classA)
+	// keep it seekable, which is required by some backends
+	if s, ok := in.(io.Seeker); ok {
+		if cur, err := s.Seek(0, io.SeekCurrent); err == nil {
+			if end, err := s.Seek(0, io.SeekEnd); err == nil {
+				if _, err = s.Seek(cur, io.SeekStart); err != nil {
+					return err
+				}
+				b.uploaded(int(end - cur))
+				return b.ObjectStorage.Put(key, in)
+			}
+		}
+	}
+	return b.ObjectStorage.Put(key, &countedReader{ioutil.NopCloser(in), b.uploaded})
+}
+
+func (b *withBilling) Delete(key string) error {
+	b.request(classFree)
+	return b.ObjectStorage.Delete(key)
+}
+
+func (b *withBilling) Head(key string) (Object, error) {
+	b.request(classB)
+	return b.ObjectStorage.Head(key)
+}
+
+func (b *withBilling) List(prefix, marker string, limit int64) ([]Object, error) {
+	b.request(classA)
+	return b.ObjectStorage.List(prefix, marker, limit)
+}
+
+func (b *withBilling) ListAll(prefix, marker string) (<-chan Object, error) {
+	b.request(classA)
+	return b.ObjectStorage.ListAll(prefix, marker)
+}
+
+func (b *withBilling) CreateMultipartUpload(key string) (*MultipartUpload, error) {
+	b.request(classA)
+	return b.ObjectStorage.CreateMultipartUpload(key)
+}
+
+func (b *withBilling) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	b.request(classA)
+	b.uploaded(len(body))
+	return b.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func (b *withBilling) AbortUpload(key string, uploadID string) {
+	b.request(classFree)
+	b.ObjectStorage.AbortUpload(key, uploadID)
+}
+
+func (b *withBilling) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	b.request(classA)
+	return b.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
+
+func (b *withBilling) ListUploads(marker string) ([]*PendingPart, string, error) {
+	b.request(classA)
+	return b.ObjectStorage.ListUploads(marker)
+}
+
+var _ ObjectStorage = &withBilling{}
@@ -0,0 +1,73 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParsePrices(t *testing.T) {
+	p, err := ParsePrices("class-a=0.005, class-b=0.0004,download=0.09")
+	if err != nil {
+		t.Fatalf("parse prices: %s", err)
+	}
+	if *p != (Prices{ClassA: 0.005, ClassB: 0.0004, Download: 0.09}) {
+		t.Fatalf("unexpected prices: %+v", p)
+	}
+	for _, s := range []string{"class-a", "class-c=1", "upload=-1", "download=x"} {
+		if _, err = ParsePrices(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestBilling(t *testing.T) {
+	s, _ := newMem("billing", "", "")
+	b := WithBilling(s, "mem", &Prices{ClassA: 5, ClassB: 0.4, Download: 1 << 10, Upload: 1 << 20})
+	data := make([]byte, 1<<20)
+	if err := b.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d, err := get(b, "a", 0, -1); err != nil || len(d) != len(data) {
+		t.Fatalf("get: %s", err)
+	}
+	if _, err := b.Head("a"); err != nil {
+		t.Fatalf("head: %s", err)
+	}
+	if err := b.Delete("a"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+
+	expect := func(v float64, expected float64, name string) {
+		if math.Abs(v-expected) > 1e-9 {
+			t.Fatalf("%s: expect %f, but got %f", name, expected, v)
+		}
+	}
+	expect(testutil.ToFloat64(billingRequests.WithLabelValues("mem", classA)), 1, "class A requests")
+	expect(testutil.ToFloat64(billingRequests.WithLabelValues("mem", classB)), 2, "class B requests")
+	expect(testutil.ToFloat64(billingRequests.WithLabelValues("mem", classFree)), 1, "free requests")
+	expect(testutil.ToFloat64(billingBytes.WithLabelValues("mem", "upload")), 1<<20, "uploaded bytes")
+	expect(testutil.ToFloat64(billingBytes.WithLabelValues("mem", "download")), 1<<20, "downloaded bytes")
+	expect(testutil.ToFloat64(billingCost.WithLabelValues("mem", classA)), 0.005, "cost of class A")
+	expect(testutil.ToFloat64(billingCost.WithLabelValues("mem", classB)), 0.0008, "cost of class B")
+	expect(testutil.ToFloat64(billingCost.WithLabelValues("mem", "download")), 1, "cost of download")
+	expect(testutil.ToFloat64(billingCost.WithLabelValues("mem", "upload")), 1<<10, "cost of upload")
+}
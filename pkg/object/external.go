@@ -0,0 +1,281 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The protocol between JuiceFS and an external storage process, which is HTTP over a unix socket or TCP:
+
+  PUT    /bucket                            create the bucket
+  GET    /objects/KEY                       read an object, with optional header "Range: bytes=START-END"
+  PUT    /objects/KEY                       write an object
+  DELETE /objects/KEY                       delete an object (deleting a missing one should succeed)
+  HEAD   /objects/KEY                       stat an object, returns Content-Length and Last-Modified
+  GET    /list?prefix=P&marker=M&limit=N    list objects after the marker in order, as a JSON array of
+                                            {"key": string, "size": int, "mtime": unix nano, "isdir": bool}
+
+A missing object should be responded with 404, and other failures with 5xx and the error as body.
+The access key and secret key, if any, are sent as basic authentication.
+*/
+
+type external struct {
+	DefaultObjectStorage
+	endpoint  string
+	base      string
+	client    *http.Client
+	accessKey string
+	secretKey string
+}
+
+func (e *external) String() string {
+	return fmt.Sprintf("external://%s/", e.endpoint)
+}
+
+func (e *external) request(method, path string, query url.Values, body io.Reader, header map[string]string) (*http.Response, error) {
+	u := e.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if e.accessKey != "" {
+		req.SetBasicAuth(e.accessKey, e.secretKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func objectPath(key string) string {
+	return "/objects/" + url.PathEscape(key)
+}
+
+func (e *external) Create() error {
+	resp, err := e.request("PUT", "/bucket", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (e *external) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	var header map[string]string
+	if off > 0 || limit > 0 {
+		r := fmt.Sprintf("bytes=%d-", off)
+		if limit > 0 {
+			r += strconv.FormatInt(off+limit-1, 10)
+		}
+		header = map[string]string{"Range": r}
+	}
+	resp, err := e.request("GET", objectPath(key), nil, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (e *external) Put(key string, in io.Reader) error {
+	resp, err := e.request("PUT", objectPath(key), nil, in, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (e *external) Delete(key string) error {
+	resp, err := e.request("DELETE", objectPath(key), nil, nil, nil)
+	if err == os.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (e *external) Head(key string) (Object, error) {
+	resp, err := e.request("HEAD", objectPath(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &obj{key, resp.ContentLength, mtime, strings.HasSuffix(key, "/")}, nil
+}
+
+func (e *external) List(prefix, marker string, limit int64) ([]Object, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("marker", marker)
+	query.Set("limit", strconv.FormatInt(limit, 10))
+	resp, err := e.request("GET", "/list", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var items []map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		return nil, fmt.Errorf("decode listing: %s", err)
+	}
+	objs := make([]Object, 0, len(items))
+	for _, item := range items {
+		objs = append(objs, UnmarshalObject(item))
+	}
+	return objs, nil
+}
+
+// newExternal connects to an external storage process, the endpoint could be
+// unix:///path/to/socket or http://host:port.
+func newExternal(endpoint, accessKey, secretKey string) (ObjectStorage, error) {
+	e := &external{endpoint: endpoint, accessKey: accessKey, secretKey: secretKey}
+	transport := &http.Transport{
+		IdleConnTimeout:     time.Second * 300,
+		MaxIdleConnsPerHost: 500,
+		DisableCompression:  true,
+	}
+	if strings.HasPrefix(endpoint, "unix://") {
+		sock := strings.TrimPrefix(endpoint, "unix://")
+		e.endpoint = "unix:" + sock
+		e.base = "http://unix"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		}
+	} else {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %s: %s", endpoint, err)
+		}
+		e.endpoint = u.Host
+		e.base = strings.TrimSuffix(u.Scheme+"://"+u.Host+u.Path, "/")
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+	e.client = &http.Client{Transport: transport, Timeout: time.Hour}
+	return e, nil
+}
+
+// ExternalHandler serves an object storage with the protocol of external storage,
+// which can be used to build an external storage process.
+func ExternalHandler(store ObjectStorage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fail := func(err error) {
+			if os.IsNotExist(err) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+		}
+		switch {
+		case r.URL.Path == "/bucket" && r.Method == "PUT":
+			if err := store.Create(); err != nil {
+				fail(err)
+			}
+		case r.URL.Path == "/list" && r.Method == "GET":
+			q := r.URL.Query()
+			limit, _ := strconv.ParseInt(q.Get("limit"), 10, 64)
+			objs, err := store.List(q.Get("prefix"), q.Get("marker"), limit)
+			if err != nil {
+				fail(err)
+				return
+			}
+			items := make([]map[string]interface{}, 0, len(objs))
+			for _, o := range objs {
+				items = append(items, MarshalObject(o))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(items)
+		case strings.HasPrefix(r.URL.Path, "/objects/"):
+			key := strings.TrimPrefix(r.URL.Path, "/objects/")
+			switch r.Method {
+			case "GET":
+				var off, limit int64 = 0, -1
+				if rg := r.Header.Get("Range"); strings.HasPrefix(rg, "bytes=") {
+					ps := strings.SplitN(rg[6:], "-", 2)
+					off, _ = strconv.ParseInt(ps[0], 10, 64)
+					if len(ps) == 2 && ps[1] != "" {
+						end, _ := strconv.ParseInt(ps[1], 10, 64)
+						limit = end - off + 1
+					}
+				}
+				in, err := store.Get(key, off, limit)
+				if err != nil {
+					fail(err)
+					return
+				}
+				defer in.Close()
+				_, _ = io.Copy(w, in)
+			case "PUT":
+				if err := store.Put(key, r.Body); err != nil {
+					fail(err)
+				}
+			case "DELETE":
+				if err := store.Delete(key); err != nil {
+					fail(err)
+				}
+			case "HEAD":
+				o, err := store.Head(key)
+				if err != nil {
+					fail(err)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.FormatInt(o.Size(), 10))
+				w.Header().Set("Last-Modified", o.Mtime().UTC().Format(http.TimeFormat))
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func init() {
+	Register("external", newExternal)
+}
@@ -0,0 +1,82 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"io"
+
+	"github.com/juicedata/juicefs/pkg/utils"
+)
+
+type withFaults struct {
+	ObjectStorage
+	faults *utils.FaultInjector
+}
+
+// WithFaults returns an object storage that drops or delays the requests as configured in faults.
+func WithFaults(os ObjectStorage, faults *utils.FaultInjector) ObjectStorage {
+	return &withFaults{os, faults}
+}
+
+func (f *withFaults) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if err := f.faults.Inject(); err != nil {
+		return nil, err
+	}
+	return f.ObjectStorage.Get(key, off, limit)
+}
+
+func (f *withFaults) Put(key string, in io.Reader) error {
+	if err := f.faults.Inject(); err != nil {
+		return err
+	}
+	return f.ObjectStorage.Put(key, in)
+}
+
+func (f *withFaults) Delete(key string) error {
+	if err := f.faults.Inject(); err != nil {
+		return err
+	}
+	return f.ObjectStorage.Delete(key)
+}
+
+func (f *withFaults) Head(key string) (Object, error) {
+	if err := f.faults.Inject(); err != nil {
+		return nil, err
+	}
+	return f.ObjectStorage.Head(key)
+}
+
+func (f *withFaults) List(prefix, marker string, limit int64) ([]Object, error) {
+	if err := f.faults.Inject(); err != nil {
+		return nil, err
+	}
+	return f.ObjectStorage.List(prefix, marker, limit)
+}
+
+func (f *withFaults) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	if err := f.faults.Inject(); err != nil {
+		return nil, err
+	}
+	return f.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
+
+func (f *withFaults) CompleteUpload(key string, uploadID string, parts []*Part) error {
+	if err := f.faults.Inject(); err != nil {
+		return err
+	}
+	return f.ObjectStorage.CompleteUpload(key, uploadID, parts)
+}
@@ -338,6 +338,67 @@ func (d *filestore) ListAll(prefix, marker string) (<-chan Object, error) {
 	return listed, nil
 }
 
+func (d *filestore) Patch(key string) (Patch, error) {
+	p := d.path(key)
+	old, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	tmp := filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".tmp"+strconv.Itoa(rand.Int()))
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		_ = old.Close()
+		return nil, err
+	}
+	return &filePatch{p, tmp, old, f}, nil
+}
+
+type filePatch struct {
+	path, tmp string
+	old, f    *os.File
+}
+
+func (p *filePatch) Copy(off, newOff, size int64) error {
+	if _, err := p.old.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := p.f.Seek(newOff, io.SeekStart); err != nil {
+		return err
+	}
+	// copy_file_range(2) is used if possible, which only references the data in some file systems
+	n, err := p.f.ReadFrom(io.LimitReader(p.old, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (p *filePatch) WriteAt(data []byte, off int64) error {
+	_, err := p.f.WriteAt(data, off)
+	return err
+}
+
+func (p *filePatch) Commit(size int64) error {
+	_ = p.old.Close()
+	err := p.f.Truncate(size)
+	if e := p.f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(p.tmp, p.path)
+	}
+	if err != nil {
+		_ = os.Remove(p.tmp)
+	}
+	return err
+}
+
+func (p *filePatch) Abort() {
+	_ = p.old.Close()
+	_ = p.f.Close()
+	_ = os.Remove(p.tmp)
+}
+
 func (d *filestore) Chtimes(path string, mtime time.Time) error {
 	p := d.path(path)
 	return os.Chtimes(p, mtime, mtime)
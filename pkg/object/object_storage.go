@@ -35,6 +35,25 @@ var UserAgent = "JuiceFS"
 type MtimeChanger interface {
 	Chtimes(path string, mtime time.Time) error
 }
+
+// Patcher can build a new version of an existing object from ranges of the current one,
+// so the unchanged data is not written again.
+type Patcher interface {
+	Patch(key string) (Patch, error)
+}
+
+// Patch is a new version of an object being built in a temporary place, it replaces
+// the object only when committed.
+type Patch interface {
+	// Copy copies size bytes at off of the current object to newOff of the new version.
+	Copy(off, newOff, size int64) error
+	WriteAt(data []byte, off int64) error
+	// Commit truncates the new version to size and replaces the object with it.
+	Commit(size int64) error
+	// Abort discards the new version.
+	Abort()
+}
+
 type File interface {
 	Object
 	Owner() string
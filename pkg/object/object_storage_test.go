@@ -24,7 +24,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -237,6 +240,20 @@ func TestMem(t *testing.T) {
 	testStorage(t, m)
 }
 
+func TestExternal(t *testing.T) {
+	m, _ := newMem("", "", "")
+	sock := filepath.Join(t.TempDir(), "external.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen %s: %s", sock, err)
+	}
+	srv := &http.Server{Handler: ExternalHandler(m)}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+	s, _ := newExternal("unix://"+sock, "", "")
+	testStorage(t, s)
+}
+
 func TestDisk(t *testing.T) {
 	s, _ := newDisk("/tmp/abc/", "", "")
 	testStorage(t, s)
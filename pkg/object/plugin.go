@@ -0,0 +1,90 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+)
+
+// LoadPlugin loads an object storage from a Go plugin, which should export
+//
+//	var Name string // the name used as --storage
+//	func New(endpoint, accessKey, secretKey string) (object.ObjectStorage, error)
+//
+// The plugin must be built with the same version of Go and JuiceFS.
+func LoadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("Name")
+	if err != nil {
+		return err
+	}
+	name, ok := sym.(*string)
+	if !ok || *name == "" {
+		return fmt.Errorf("invalid Name in plugin %s: %T", path, sym)
+	}
+	if sym, err = p.Lookup("New"); err != nil {
+		return err
+	}
+	var creator Creator
+	switch f := sym.(type) {
+	case func(string, string, string) (ObjectStorage, error):
+		creator = f
+	case *Creator:
+		creator = *f
+	default:
+		return fmt.Errorf("invalid New in plugin %s: %T", path, sym)
+	}
+	if _, ok := storages[*name]; ok {
+		logger.Warnf("storage %s is overridden by plugin %s", *name, path)
+	}
+	Register(*name, creator)
+	logger.Infof("Loaded storage %s from plugin %s", *name, path)
+	return nil
+}
+
+// LoadPlugins loads all the plugins in the list of paths separated by os.PathListSeparator,
+// each of them could be a plugin or a directory of plugins (*.so).
+func LoadPlugins(paths string) error {
+	for _, p := range strings.Split(paths, string(os.PathListSeparator)) {
+		if p == "" {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		files := []string{p}
+		if fi.IsDir() {
+			if files, err = filepath.Glob(filepath.Join(p, "*.so")); err != nil {
+				return err
+			}
+		}
+		for _, f := range files {
+			if err = LoadPlugin(f); err != nil {
+				return fmt.Errorf("load plugin %s: %s", f, err)
+			}
+		}
+	}
+	return nil
+}
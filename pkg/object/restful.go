@@ -38,6 +38,11 @@ import (
 var resolver = dnscache.New(time.Minute)
 var httpClient *http.Client
 
+// CloseIdleConnections closes the idle connections to object storages, new ones are created on demand.
+func CloseIdleConnections() {
+	httpClient.CloseIdleConnections()
+}
+
 func init() {
 	rand.Seed(time.Now().Unix())
 	httpClient = &http.Client{
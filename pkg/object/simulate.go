@@ -0,0 +1,188 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/ratelimit"
+)
+
+// ErrSimulated is returned by the requests failed by a simulated object storage.
+var ErrSimulated = errors.New("simulated failure")
+
+// SimulatedPerf is the performance of a simulated object storage.
+type SimulatedPerf struct {
+	Latency   time.Duration // added to every request before it's served
+	Bandwidth int64         // bytes per second shared by all the requests, 0 means unlimited
+	ErrorRate float64       // probability for a request to fail
+}
+
+func (p SimulatedPerf) String() string {
+	bw := "unlimited"
+	if p.Bandwidth > 0 {
+		bw = fmt.Sprintf("%g Mbps", float64(p.Bandwidth)*8/1e6)
+	}
+	return fmt.Sprintf("latency %s, bandwidth %s, error rate %g", p.Latency, bw, p.ErrorRate)
+}
+
+// ParseSimulatedPerf parses the performance like "latency=50ms,bandwidth=1000,error-rate=0.001",
+// where bandwidth is in Mbps. The items not given are zero, which means no latency, unlimited
+// bandwidth and no error.
+func ParseSimulatedPerf(s string) (*SimulatedPerf, error) {
+	var p SimulatedPerf
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid item of performance: %s", item)
+		}
+		v := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "latency":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid latency: %s", v)
+			}
+			p.Latency = d
+		case "bandwidth":
+			bw, err := strconv.ParseFloat(v, 64)
+			if err != nil || bw < 0 {
+				return nil, fmt.Errorf("invalid bandwidth: %s", v)
+			}
+			p.Bandwidth = int64(bw * 1e6 / 8)
+		case "error-rate":
+			r, err := strconv.ParseFloat(v, 64)
+			if err != nil || r < 0 || r >= 1 {
+				return nil, fmt.Errorf("invalid error rate: %s", v)
+			}
+			p.ErrorRate = r
+		default:
+			return nil, fmt.Errorf("unknown item of performance: %s", kv[0])
+		}
+	}
+	return &p, nil
+}
+
+type simulated struct {
+	ObjectStorage
+	perf    SimulatedPerf
+	limiter *ratelimit.Bucket
+}
+
+// Simulate returns an object storage that serves the requests with the latency, bandwidth and
+// error rate in perf, to model how the volume would perform on another object storage.
+func Simulate(os ObjectStorage, perf SimulatedPerf) ObjectStorage {
+	s := &simulated{ObjectStorage: os, perf: perf}
+	if perf.Bandwidth > 0 {
+		// allow bursts of 100ms only, or the first second of a benchmark would be too fast
+		s.limiter = ratelimit.NewBucketWithRate(float64(perf.Bandwidth), perf.Bandwidth/10+1)
+	}
+	return s
+}
+
+func (s *simulated) String() string {
+	return fmt.Sprintf("simulated(%s)", s.ObjectStorage)
+}
+
+func (s *simulated) request() error {
+	time.Sleep(s.perf.Latency)
+	if s.perf.ErrorRate > 0 && rand.Float64() < s.perf.ErrorRate {
+		return ErrSimulated
+	}
+	return nil
+}
+
+// throttled reads no faster than the bandwidth.
+type throttled struct {
+	io.Reader
+	limiter *ratelimit.Bucket
+}
+
+func (t *throttled) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if n > 0 {
+		t.limiter.Wait(int64(n))
+	}
+	return n, err
+}
+
+type throttledCloser struct {
+	throttled
+	io.Closer
+}
+
+func (s *simulated) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	if err := s.request(); err != nil {
+		return nil, err
+	}
+	r, err := s.ObjectStorage.Get(key, off, limit)
+	if err != nil || s.limiter == nil {
+		return r, err
+	}
+	return &throttledCloser{throttled{r, s.limiter}, r}, nil
+}
+
+func (s *simulated) Put(key string, in io.Reader) error {
+	if err := s.request(); err != nil {
+		return err
+	}
+	if s.limiter != nil {
+		in = &throttled{in, s.limiter}
+	}
+	return s.ObjectStorage.Put(key, in)
+}
+
+func (s *simulated) Delete(key string) error {
+	if err := s.request(); err != nil {
+		return err
+	}
+	return s.ObjectStorage.Delete(key)
+}
+
+func (s *simulated) Head(key string) (Object, error) {
+	if err := s.request(); err != nil {
+		return nil, err
+	}
+	return s.ObjectStorage.Head(key)
+}
+
+func (s *simulated) List(prefix, marker string, limit int64) ([]Object, error) {
+	if err := s.request(); err != nil {
+		return nil, err
+	}
+	return s.ObjectStorage.List(prefix, marker, limit)
+}
+
+func (s *simulated) UploadPart(key string, uploadID string, num int, body []byte) (*Part, error) {
+	if err := s.request(); err != nil {
+		return nil, err
+	}
+	if s.limiter != nil {
+		s.limiter.Wait(int64(len(body)))
+	}
+	return s.ObjectStorage.UploadPart(key, uploadID, num, body)
+}
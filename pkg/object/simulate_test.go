@@ -0,0 +1,75 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseSimulatedPerf(t *testing.T) {
+	p, err := ParseSimulatedPerf("latency=50ms, bandwidth=800,error-rate=0.01")
+	if err != nil {
+		t.Fatalf("parse performance: %s", err)
+	}
+	if *p != (SimulatedPerf{Latency: 50 * time.Millisecond, Bandwidth: 100e6, ErrorRate: 0.01}) {
+		t.Fatalf("unexpected performance: %+v", p)
+	}
+	for _, s := range []string{"latency", "latency=1", "bandwidth=-1", "error-rate=1", "iops=100"} {
+		if _, err = ParseSimulatedPerf(s); err == nil {
+			t.Fatalf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	m, _ := newMem("simulate", "", "")
+	s := Simulate(m, SimulatedPerf{Latency: 20 * time.Millisecond, Bandwidth: 4 << 20})
+	data := make([]byte, 1<<20)
+	start := time.Now()
+	if err := s.Put("a", bytes.NewReader(data)); err != nil {
+		t.Fatalf("put: %s", err)
+	}
+	if d, err := get(s, "a", 0, -1); err != nil || len(d) != len(data) {
+		t.Fatalf("get: %s", err)
+	}
+	// 2 MiB should take about 0.5 second
+	if used := time.Since(start); used < 400*time.Millisecond {
+		t.Fatalf("bandwidth is not limited: %s", used)
+	}
+	start = time.Now()
+	if _, err := s.Head("a"); err != nil {
+		t.Fatalf("head: %s", err)
+	}
+	if used := time.Since(start); used < 20*time.Millisecond {
+		t.Fatalf("no latency: %s", used)
+	}
+
+	f := Simulate(m, SimulatedPerf{ErrorRate: 0.5})
+	var failed int
+	for i := 0; i < 100; i++ {
+		if _, err := f.Head("a"); err == ErrSimulated {
+			failed++
+		} else if err != nil {
+			t.Fatalf("head: %s", err)
+		}
+	}
+	if failed == 0 || failed == 100 {
+		t.Fatalf("unexpected failures: %d", failed)
+	}
+}
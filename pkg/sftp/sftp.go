@@ -0,0 +1,344 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sftp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+var logger = utils.GetLogger("juicefs")
+
+// User is an account of the SFTP server, which is jailed in Home of the volume.
+type User struct {
+	Name string
+	Home string
+	Keys []ssh.PublicKey
+}
+
+// LoadUsers reads users from a file, in which every line has the format of
+// "NAME HOME PUBLIC-KEY", where PUBLIC-KEY is in authorized_keys format.
+// A user can have multiple keys in separate lines.
+func LoadUsers(name string) (map[string]*User, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]*User)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expect NAME HOME PUBLIC-KEY", lineno)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[2:], " ")))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		home := path.Clean("/" + fields[1])
+		u := users[fields[0]]
+		if u == nil {
+			u = &User{Name: fields[0], Home: home}
+			users[u.Name] = u
+		} else if u.Home != home {
+			return nil, fmt.Errorf("line %d: conflicted home for user %s: %s != %s", lineno, u.Name, u.Home, home)
+		}
+		u.Keys = append(u.Keys, key)
+	}
+	return users, scanner.Err()
+}
+
+type Server struct {
+	fs     *fs.FileSystem
+	ctx    meta.Context
+	users  map[string]*User
+	config *ssh.ServerConfig
+}
+
+func NewServer(jfs *fs.FileSystem, users map[string]*User, hostKey ssh.Signer) *Server {
+	s := &Server{
+		fs:    jfs,
+		ctx:   meta.NewContext(uint32(os.Getpid()), uint32(os.Getuid()), []uint32{uint32(os.Getgid())}),
+		users: users,
+	}
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+	s.config.AddHostKey(hostKey)
+	return s
+}
+
+func (s *Server) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if u, ok := s.users[conn.User()]; ok {
+		for _, k := range u.Keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return &ssh.Permissions{Extensions: map[string]string{"home": u.Home}}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %s", conn.User())
+}
+
+// Serve accepts connections from l until it's closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(nConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		logger.Warnf("handshake with %s: %s", nConn.RemoteAddr(), err)
+		_ = nConn.Close()
+		return
+	}
+	defer conn.Close()
+	home := conn.Permissions.Extensions["home"]
+	logger.Infof("user %s logged in from %s", conn.User(), conn.RemoteAddr())
+	if fi, eno := s.fs.Stat(s.ctx, home); eno != 0 || !fi.IsDir() {
+		if eno = s.fs.Mkdir(s.ctx, home, 0755); eno != 0 {
+			logger.Errorf("create home %s for %s: %s", home, conn.User(), eno)
+			return
+		}
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			logger.Warnf("accept channel from %s: %s", conn.RemoteAddr(), err)
+			continue
+		}
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				// the payload of subsystem request is a string prefixed by its length
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+			}
+		}(requests)
+		h := &handler{fs: s.fs, ctx: s.ctx, root: home}
+		server := sftp.NewRequestServer(ch, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+		go func() {
+			if err := server.Serve(); err != nil && err != io.EOF {
+				logger.Warnf("sftp session of %s: %s", conn.User(), err)
+			}
+			_ = server.Close()
+		}()
+	}
+}
+
+func errno(eno syscall.Errno) error {
+	if eno == 0 {
+		return nil
+	}
+	return eno
+}
+
+// handler serves SFTP requests of a user within the root directory.
+type handler struct {
+	fs   *fs.FileSystem
+	ctx  meta.Context
+	root string
+}
+
+func (h *handler) path(p string) string {
+	return path.Join(h.root, p)
+}
+
+type fileReader struct {
+	ctx meta.Context
+	f   *fs.File
+}
+
+func (r *fileReader) ReadAt(b []byte, off int64) (int, error) {
+	return r.f.Pread(r.ctx, b, off)
+}
+
+func (r *fileReader) Close() error {
+	return errno(r.f.Close(r.ctx))
+}
+
+type fileWriter struct {
+	ctx meta.Context
+	f   *fs.File
+}
+
+func (w *fileWriter) WriteAt(b []byte, off int64) (int, error) {
+	n, eno := w.f.Pwrite(w.ctx, b, off)
+	return n, errno(eno)
+}
+
+func (w *fileWriter) Close() error {
+	return errno(w.f.Close(w.ctx))
+}
+
+func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, eno := h.fs.Open(h.ctx, h.path(r.Filepath), vfs.MODE_MASK_R)
+	if eno != 0 {
+		return nil, eno
+	}
+	return &fileReader{h.ctx, f}, nil
+}
+
+func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	p := h.path(r.Filepath)
+	flags := r.Pflags()
+	f, eno := h.fs.Open(h.ctx, p, vfs.MODE_MASK_W)
+	if eno == syscall.ENOENT && flags.Creat {
+		f, eno = h.fs.Create(h.ctx, p, 0644)
+	} else if eno == 0 && flags.Excl {
+		_ = f.Close(h.ctx)
+		return nil, syscall.EEXIST
+	} else if eno == 0 && flags.Trunc {
+		eno = h.fs.Truncate(h.ctx, p, 0)
+	}
+	if eno != 0 {
+		return nil, eno
+	}
+	return &fileWriter{h.ctx, f}, nil
+}
+
+func (h *handler) Filecmd(r *sftp.Request) error {
+	p := h.path(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(p, r)
+	case "Rename":
+		return errno(h.fs.Rename(h.ctx, p, h.path(r.Target), 0))
+	case "Rmdir", "Remove":
+		return errno(h.fs.Delete(h.ctx, p))
+	case "Mkdir":
+		return errno(h.fs.Mkdir(h.ctx, p, 0755))
+	case "Symlink":
+		return errno(h.fs.Symlink(h.ctx, p, h.path(r.Target)))
+	}
+	return syscall.ENOTSUP
+}
+
+func (h *handler) setstat(p string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if eno := h.fs.Truncate(h.ctx, p, attrs.Size); eno != 0 {
+			return eno
+		}
+	}
+	if !flags.Permissions && !flags.UidGid && !flags.Acmodtime {
+		return nil
+	}
+	f, eno := h.fs.Open(h.ctx, p, 0)
+	if eno != 0 {
+		return eno
+	}
+	defer f.Close(h.ctx)
+	if flags.Permissions {
+		if eno = f.Chmod(h.ctx, uint16(attrs.Mode&07777)); eno != 0 {
+			return eno
+		}
+	}
+	if flags.UidGid {
+		if eno = f.Chown(h.ctx, attrs.UID, attrs.GID); eno != 0 {
+			return eno
+		}
+	}
+	if flags.Acmodtime {
+		if eno = f.Utime(h.ctx, int64(attrs.Atime)*1000, int64(attrs.Mtime)*1000); eno != 0 {
+			return eno
+		}
+	}
+	return nil
+}
+
+type listerat []os.FileInfo
+
+func (l listerat) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
+
+func (l *linkInfo) Name() string { return l.target }
+
+func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	p := h.path(r.Filepath)
+	switch r.Method {
+	case "List":
+		f, eno := h.fs.Open(h.ctx, p, 0)
+		if eno != 0 {
+			return nil, eno
+		}
+		defer f.Close(h.ctx)
+		fis, eno := f.Readdir(h.ctx, 0)
+		if eno != 0 {
+			return nil, eno
+		}
+		return listerat(fis), nil
+	case "Stat":
+		fi, eno := h.fs.Stat(h.ctx, p)
+		if eno != 0 {
+			return nil, eno
+		}
+		return listerat{fi}, nil
+	case "Readlink":
+		target, eno := h.fs.Readlink(h.ctx, p)
+		if eno != 0 {
+			return nil, eno
+		}
+		t := string(target)
+		if h.root != "/" && strings.HasPrefix(t, h.root+"/") {
+			t = t[len(h.root):]
+		}
+		return listerat{&linkInfo{target: t}}, nil
+	}
+	return nil, syscall.ENOTSUP
+}
@@ -0,0 +1,149 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/juicedata/juicefs/pkg/chunk"
+	"github.com/juicedata/juicefs/pkg/fs"
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/object"
+	"github.com/juicedata/juicefs/pkg/vfs"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("signer: %s", err)
+	}
+	return signer
+}
+
+// nolint:errcheck
+func TestSFTP(t *testing.T) {
+	m := meta.NewClient("memkv://", &meta.Config{MaxDeletes: 1})
+	format := meta.Format{Name: "test", BlockSize: 4096, Capacity: 1 << 30}
+	_ = m.Init(format, true)
+	conf := vfs.Config{
+		Meta:   &meta.Config{},
+		Format: &format,
+		Chunk:  &chunk.Config{BlockSize: format.BlockSize << 10, MaxUpload: 1, BufferSize: 100 << 20},
+	}
+	objStore, _ := object.CreateStorage("mem", "", "", "")
+	jfs, err := fs.NewFileSystem(&conf, m, chunk.NewCachedStore(objStore, *conf.Chunk))
+	if err != nil {
+		t.Fatalf("new fs: %s", err)
+	}
+
+	userKey := newSigner(t)
+	users := fmt.Sprintf("# name home key\nalice /alice %s\n", ssh.MarshalAuthorizedKey(userKey.PublicKey()))
+	tmp, _ := ioutil.TempFile("", "users")
+	defer os.Remove(tmp.Name())
+	_, _ = tmp.WriteString(users)
+	tmp.Close()
+	us, err := LoadUsers(tmp.Name())
+	if err != nil || len(us) != 1 || us["alice"].Home != "/alice" {
+		t.Fatalf("load users: %+v %s", us, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer l.Close()
+	go NewServer(jfs, us, newSigner(t)).Serve(l)
+
+	dial := func(user string, key ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(key)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	if _, err = dial("alice", newSigner(t)); err == nil {
+		t.Fatalf("login with unknown key should fail")
+	}
+	conn, err := dial("alice", userKey)
+	if err != nil {
+		t.Fatalf("login: %s", err)
+	}
+	defer conn.Close()
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("sftp client: %s", err)
+	}
+	defer client.Close()
+
+	if err = client.Mkdir("/d"); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	f, err := client.Create("/d/f")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: %s", err)
+	}
+	f.Close()
+	if fi, err := client.Stat("/d/f"); err != nil || fi.Size() != 5 {
+		t.Fatalf("stat: %+v %s", fi, err)
+	}
+	if fis, err := client.ReadDir("/d"); err != nil || len(fis) != 1 || fis[0].Name() != "f" {
+		t.Fatalf("readdir: %+v %s", fis, err)
+	}
+	f, err = client.Open("/d/f")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if data, err := ioutil.ReadAll(f); err != nil || string(data) != "hello" {
+		t.Fatalf("read: %s %s", data, err)
+	}
+	f.Close()
+	if err = client.Rename("/d/f", "/d/g"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if err = client.Symlink("/d/g", "/d/l"); err != nil {
+		t.Fatalf("symlink: %s", err)
+	}
+	if target, err := client.ReadLink("/d/l"); err != nil || target != "g" {
+		t.Fatalf("readlink: %s %s", target, err)
+	}
+	// jailed in home
+	if fi, eno := jfs.Stat(meta.Background, "/alice/d/g"); eno != 0 || fi.Size() != 5 {
+		t.Fatalf("stat in volume: %+v %s", fi, eno)
+	}
+	if _, err = client.Stat("/../alice/d/g"); err == nil {
+		t.Fatalf("path should be relative to home")
+	}
+	if err = client.Remove("/d/l"); err != nil {
+		t.Fatalf("remove: %s", err)
+	}
+}
@@ -42,6 +42,8 @@ type Config struct {
 	Quiet       bool
 	CheckAll    bool
 	CheckNew    bool
+	Delta       bool
+	Listing     string
 }
 
 func NewConfigFromCli(c *cli.Context) *Config {
@@ -66,5 +68,7 @@ func NewConfigFromCli(c *cli.Context) *Config {
 		Quiet:       c.Bool("quiet"),
 		CheckAll:    c.Bool("check-all"),
 		CheckNew:    c.Bool("check-new"),
+		Delta:       c.Bool("delta"),
+		Listing:     c.String("use-listing"),
 	}
 }
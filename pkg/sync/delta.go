@@ -0,0 +1,250 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// rollsum is the weak checksum of rsync, which can be rolled by one byte.
+type rollsum struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rollsum) init(p []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(p))
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+}
+
+func (r *rollsum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rollsum) digest() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+type blockSum struct {
+	off    int64
+	strong [md5.Size]byte
+}
+
+// blockSums returns the checksums of the full blocks of the existing object in dst.
+func blockSums(dst object.ObjectStorage, key string) (map[uint32][]blockSum, error) {
+	in, err := dst.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	sums := make(map[uint32][]blockSum)
+	buf := make([]byte, deltaBlockSize)
+	var rs rollsum
+	for off := int64(0); ; off += deltaBlockSize {
+		if _, err = io.ReadFull(in, buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sums, nil
+		} else if err != nil {
+			return nil, err
+		}
+		rs.init(buf)
+		weak := rs.digest()
+		sums[weak] = append(sums[weak], blockSum{off, md5.Sum(buf)})
+	}
+}
+
+// deltaWriter builds the new version of an object, merging the adjacent ranges copied from the old one.
+type deltaWriter struct {
+	patch             object.Patch
+	off, newOff, size int64 // the pending range to copy
+	written           int64
+}
+
+func (d *deltaWriter) copy(off, newOff, size int64) error {
+	if d.size > 0 && d.off+d.size == off && d.newOff+d.size == newOff {
+		d.size += size
+		return nil
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.off, d.newOff, d.size = off, newOff, size
+	return nil
+}
+
+func (d *deltaWriter) write(data []byte, off int64) error {
+	if len(data) == 0 {
+		return nil
+	}
+	d.written += int64(len(data))
+	return d.patch.WriteAt(data, off)
+}
+
+func (d *deltaWriter) flush() error {
+	if d.size == 0 {
+		return nil
+	}
+	err := d.patch.Copy(d.off, d.newOff, d.size)
+	d.size = 0
+	return err
+}
+
+// match returns the offset of the block in the old object with the same data, the one following
+// the pending range is preferred.
+func (d *deltaWriter) match(sums map[uint32][]blockSum, weak uint32, block []byte) (int64, bool) {
+	cands := sums[weak]
+	if len(cands) == 0 {
+		return 0, false
+	}
+	strong := md5.Sum(block)
+	var found bool
+	var off int64
+	for _, c := range cands {
+		if c.strong == strong {
+			if d.size > 0 && c.off == d.off+d.size {
+				return c.off, true
+			}
+			if !found {
+				found, off = true, c.off
+			}
+		}
+	}
+	return off, found
+}
+
+// copyDelta updates an existing file in dst like rsync: the blocks of it are looked up in src by rolling
+// checksums, so they are found even if shifted, then the new version is built in a temporary file from
+// the matched blocks and the other data of src, and replaces the old one at last.
+func copyDelta(src, dst object.ObjectStorage, key string, size int64) (err error) {
+	if limiter != nil {
+		limiter.Wait(size)
+	}
+	concurrent <- 1
+	defer func() {
+		<-concurrent
+	}()
+	sums, err := blockSums(dst, key)
+	if err != nil {
+		return fmt.Errorf("dest checksum: %s", err)
+	}
+	in, err := src.Get(key, 0, -1)
+	if err != nil {
+		return fmt.Errorf("src get: %s", err)
+	}
+	defer in.Close()
+	patch, err := dst.(object.Patcher).Patch(key)
+	if err != nil {
+		return fmt.Errorf("dest patch: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			patch.Abort()
+		}
+	}()
+
+	d := &deltaWriter{patch: patch}
+	buf := make([]byte, 0, deltaBlockSize*4)
+	var base int64   // offset of buf in src
+	var pos, lit int // the window to match, and the data not matched before it
+	var rs rollsum
+	var rolled, eof bool
+	for {
+		if !eof && len(buf)-pos <= deltaBlockSize {
+			// keep the window and the next byte in buffer
+			if err = d.write(buf[lit:pos], base+int64(lit)); err != nil {
+				return fmt.Errorf("dest write: %s", err)
+			}
+			n := copy(buf, buf[pos:])
+			base += int64(pos)
+			pos, lit = 0, 0
+			m, e := io.ReadFull(in, buf[n:cap(buf)])
+			buf = buf[:n+m]
+			if e == io.EOF || e == io.ErrUnexpectedEOF {
+				eof = true
+			} else if e != nil {
+				return fmt.Errorf("src read: %s", e)
+			}
+		}
+		if len(buf)-pos < deltaBlockSize {
+			break
+		}
+		if !rolled {
+			rs.init(buf[pos : pos+deltaBlockSize])
+			rolled = true
+		}
+		if off, ok := d.match(sums, rs.digest(), buf[pos:pos+deltaBlockSize]); ok {
+			if err = d.write(buf[lit:pos], base+int64(lit)); err != nil {
+				return fmt.Errorf("dest write: %s", err)
+			}
+			if err = d.copy(off, base+int64(pos), deltaBlockSize); err != nil {
+				return fmt.Errorf("dest copy: %s", err)
+			}
+			pos += deltaBlockSize
+			lit = pos
+			rolled = false
+			continue
+		}
+		if pos+deltaBlockSize == len(buf) {
+			break // end of src
+		}
+		rs.roll(buf[pos], buf[pos+deltaBlockSize])
+		pos++
+	}
+	if err = d.write(buf[lit:], base+int64(lit)); err != nil {
+		return fmt.Errorf("dest write: %s", err)
+	}
+	if err = d.flush(); err != nil {
+		return fmt.Errorf("dest copy: %s", err)
+	}
+	if n := base + int64(len(buf)); n != size {
+		return fmt.Errorf("size of src is changed: %d != %d", n, size)
+	}
+	if err = patch.Commit(size); err != nil {
+		return fmt.Errorf("dest commit: %s", err)
+	}
+	copiedBytes.IncrInt64(d.written)
+	logger.Debugf("Written %d of %d bytes of %s", d.written, size, key)
+	return nil
+}
+
+// canUpdate returns true if the existing file in dst can be updated by copyDelta.
+func canUpdate(dst object.ObjectStorage, key string, size int64) bool {
+	if _, ok := dst.(object.Patcher); !ok || size == 0 {
+		return false
+	}
+	o, err := dst.Head(key)
+	return err == nil && !o.IsDir() && o.Size() > 0
+}
+
+func updateData(src, dst object.ObjectStorage, key string, size int64) error {
+	start := time.Now()
+	err := try(3, func() error { return copyDelta(src, dst, key, size) })
+	if err == nil {
+		logger.Debugf("Updated data of %s (%d bytes) in %s", key, size, time.Since(start))
+	} else {
+		logger.Errorf("Failed to update data of %s in %s: %s", key, time.Since(start), err)
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// Listing is a snapshot of all the objects in an object storage, saved as
+// JSON lines: a header followed by one line per object in the order of keys.
+type Listing struct {
+	Storage string    `json:"storage"`
+	Time    time.Time `json:"time"`
+	path    string
+}
+
+type listedObj struct {
+	K string `json:"key"`
+	S int64  `json:"size"`
+	M int64  `json:"mtime"`
+	D bool   `json:"dir,omitempty"`
+}
+
+func (o *listedObj) Key() string      { return o.K }
+func (o *listedObj) Size() int64      { return o.S }
+func (o *listedObj) Mtime() time.Time { return time.Unix(0, o.M) }
+func (o *listedObj) IsDir() bool      { return o.D }
+
+// SaveListing lists all the objects in store and writes them into w.
+func SaveListing(store object.ObjectStorage, w io.Writer) (int64, error) {
+	objs, err := ListAll(store, "", "")
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+	enc := json.NewEncoder(bw)
+	if err = enc.Encode(&Listing{Storage: store.String(), Time: time.Now()}); err != nil {
+		return 0, err
+	}
+	var count int64
+	for o := range objs {
+		if o == nil {
+			return count, fmt.Errorf("listing failed")
+		}
+		err = enc.Encode(&listedObj{o.Key(), o.Size(), o.Mtime().UnixNano(), o.IsDir()})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+// OpenListing reads the header of a listing saved by SaveListing.
+func OpenListing(path string) (*Listing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var l Listing
+	if err = json.NewDecoder(f).Decode(&l); err != nil {
+		return nil, fmt.Errorf("invalid listing %s: %s", path, err)
+	}
+	if l.Storage == "" {
+		return nil, fmt.Errorf("invalid listing %s: no storage", path)
+	}
+	l.path = path
+	return &l, nil
+}
+
+// Objects returns the objects with the given prefix within [start, end], with the
+// prefix removed from their keys. The same as ListAll, a nil is sent when it fails.
+func (l *Listing) Objects(prefix, start, end string) (<-chan object.Object, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReaderSize(f, 1<<20))
+	var h Listing
+	if err = dec.Decode(&h); err != nil {
+		f.Close()
+		return nil, err
+	}
+	out := make(chan object.Object, maxResults*10)
+	go func() {
+		defer f.Close()
+		defer close(out)
+		for {
+			var o listedObj
+			if err := dec.Decode(&o); err == io.EOF {
+				return
+			} else if err != nil {
+				logger.Errorf("read listing %s: %s", l.path, err)
+				out <- nil
+				return
+			}
+			if !strings.HasPrefix(o.K, prefix) {
+				if o.K > prefix {
+					return
+				}
+				continue
+			}
+			o.K = o.K[len(prefix):]
+			if o.K < start {
+				continue
+			}
+			if end != "" && o.K > end {
+				return
+			}
+			out <- &o
+		}
+	}()
+	return out, nil
+}
+
+func listFromFile(path string, src object.ObjectStorage, start, end string) (<-chan object.Object, error) {
+	l, err := OpenListing(path)
+	if err != nil {
+		return nil, err
+	}
+	if l.Storage != src.String() {
+		return nil, fmt.Errorf("listing %s was saved from %s, not %s", path, l.Storage, src)
+	}
+	logger.Infof("Use listing of %s saved at %s", l.Storage, l.Time.Format(time.RFC3339))
+	return l.Objects("", start, end)
+}
@@ -0,0 +1,87 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/object"
+)
+
+// nolint:errcheck
+func TestListing(t *testing.T) {
+	store, _ := object.CreateStorage("mem", "listing", "", "")
+	for _, key := range []string{"a", "chunks/0/0/1_0_4", "chunks/0/0/2_0_5", "chunks/1/1/1001_0_6", "z"} {
+		store.Put(key, bytes.NewReader([]byte(key)))
+	}
+	path := filepath.Join(t.TempDir(), "listing")
+	fp, _ := os.Create(path)
+	if n, err := SaveListing(store, fp); err != nil || n != 5 {
+		t.Fatalf("save listing: %d %s", n, err)
+	}
+	fp.Close()
+
+	l, err := OpenListing(path)
+	if err != nil {
+		t.Fatalf("open listing: %s", err)
+	}
+	if l.Storage != store.String() {
+		t.Fatalf("storage %s != %s", l.Storage, store)
+	}
+	objs, err := l.Objects("chunks/", "", "")
+	if err != nil {
+		t.Fatalf("objects: %s", err)
+	}
+	var keys []string
+	for o := range objs {
+		if o == nil {
+			t.Fatalf("listing failed")
+		}
+		keys = append(keys, o.Key())
+		if o.Key() == "0/0/1_0_4" && (o.Size() != 16 || o.Mtime().IsZero()) {
+			t.Fatalf("bad object %s: size %d mtime %s", o.Key(), o.Size(), o.Mtime())
+		}
+	}
+	if len(keys) != 3 || keys[0] != "0/0/1_0_4" || keys[2] != "1/1/1001_0_6" {
+		t.Fatalf("keys: %+v", keys)
+	}
+
+	objs, _ = l.Objects("", "b", "chunks/0/0/2_0_5")
+	keys = keys[:0]
+	for o := range objs {
+		keys = append(keys, o.Key())
+	}
+	if len(keys) != 2 || keys[0] != "chunks/0/0/1_0_4" || keys[1] != "chunks/0/0/2_0_5" {
+		t.Fatalf("keys: %+v", keys)
+	}
+
+	if _, err = listFromFile(path, store, "", ""); err != nil {
+		t.Fatalf("list from file: %s", err)
+	}
+	other, _ := object.CreateStorage("mem", "other", "", "")
+	if _, err = listFromFile(path, other, "", ""); err == nil {
+		t.Fatalf("listing saved from another storage should be refused")
+	}
+
+	os.WriteFile(path, []byte("not a listing"), 0644)
+	if _, err = OpenListing(path); err == nil {
+		t.Fatalf("open invalid listing should fail")
+	}
+}
@@ -37,6 +37,7 @@ const (
 	maxResults      = 1000
 	defaultPartSize = 5 << 20
 	bufferSize      = 32 << 10
+	deltaBlockSize  = 64 << 10
 	maxBlock        = defaultPartSize * 2
 	markDeleteSrc   = -1
 	markDeleteDst   = -2
@@ -512,7 +513,12 @@ func worker(tasks <-chan object.Object, src, dst object.ObjectStorage, config *C
 				logger.Infof("Will copy %s (%d bytes)", obj.Key(), obj.Size())
 				break
 			}
-			err := copyData(src, dst, key, obj.Size())
+			var err error
+			if config.Delta && canUpdate(dst, key, obj.Size()) {
+				err = updateData(src, dst, key, obj.Size())
+			} else {
+				err = copyData(src, dst, key, obj.Size())
+			}
 			if err == nil && (config.CheckAll || config.CheckNew) {
 				var equal bool
 				if equal, err = checkSum(src, dst, key, obj.Size()); err == nil && !equal {
@@ -576,7 +582,13 @@ func producer(tasks chan<- object.Object, src, dst object.ObjectStorage, config
 	}
 	logger.Debugf("maxResults: %d, defaultPartSize: %d, maxBlock: %d", maxResults, defaultPartSize, maxBlock)
 
-	srckeys, err := ListAll(src, start, end)
+	var srckeys <-chan object.Object
+	var err error
+	if config.Listing != "" {
+		srckeys, err = listFromFile(config.Listing, src, start, end)
+	} else {
+		srckeys, err = ListAll(src, start, end)
+	}
 	if err != nil {
 		logger.Fatal(err)
 	}
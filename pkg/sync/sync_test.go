@@ -17,9 +17,13 @@ package sync
 
 import (
 	"bytes"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/juicedata/juicefs/pkg/object"
 )
@@ -159,3 +163,78 @@ func TestSync(t *testing.T) {
 		t.Fatalf("sync: %s", err)
 	}
 }
+
+// nolint:errcheck
+func TestSyncDelta(t *testing.T) {
+	config := &Config{
+		Threads: 10,
+		Update:  true,
+		Delta:   true,
+		Quiet:   true,
+	}
+	os.RemoveAll("/tmp/delta_a/")
+	os.RemoveAll("/tmp/delta_b/")
+	a, _ := object.CreateStorage("file", "/tmp/delta_a/", "", "")
+	b, _ := object.CreateStorage("file", "/tmp/delta_b/", "", "")
+	data := make([]byte, deltaBlockSize*5+100)
+	rand.Read(data)
+	a.Put("f", bytes.NewReader(data))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if c := copiedBytes.Current(); c != int64(len(data)) {
+		t.Fatalf("should copy %d bytes, but got %d", len(data), c)
+	}
+
+	time.Sleep(time.Second)
+	data[deltaBlockSize*2+10] ^= 0xFF
+	data = append(data, []byte("tail")...)
+	a.Put("f", bytes.NewReader(data))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if c := copiedBytes.Current(); c != deltaBlockSize+104 {
+		t.Fatalf("should write %d bytes, but got %d", deltaBlockSize+104, c)
+	}
+	in, err := b.Get("f", 0, -1)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer in.Close()
+	if d, _ := ioutil.ReadAll(in); !bytes.Equal(d, data) {
+		t.Fatalf("data of f is not updated")
+	}
+
+	// insert some bytes, the blocks after them are found by rolling checksums
+	time.Sleep(time.Second)
+	data = append([]byte("head"), data...)
+	a.Put("f", bytes.NewReader(data))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if c := copiedBytes.Current(); c != 4+104 {
+		t.Fatalf("should write %d bytes, but got %d", 4+104, c)
+	}
+	in2, err := b.Get("f", 0, -1)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+	defer in2.Close()
+	if d, _ := ioutil.ReadAll(in2); !bytes.Equal(d, data) {
+		t.Fatalf("data of f is not updated")
+	}
+	if fs, _ := ioutil.ReadDir("/tmp/delta_b/"); len(fs) != 1 {
+		t.Fatalf("temporary files are left: %d files", len(fs))
+	}
+
+	// shrink
+	time.Sleep(time.Second)
+	data = data[:100]
+	a.Put("f", bytes.NewReader(data))
+	if err := Sync(a, b, config); err != nil {
+		t.Fatalf("sync: %s", err)
+	}
+	if o, err := b.Head("f"); err != nil || o.Size() != 100 {
+		t.Fatalf("f should be truncated: %+v %s", o, err)
+	}
+}
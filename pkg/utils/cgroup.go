@@ -0,0 +1,65 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// CgroupLimits returns the memory (in bytes) and CPU (in cores) limits of the container,
+// which are read from cgroup v2 or v1, 0 means unlimited.
+func CgroupLimits() (memory int64, cpus float64) {
+	return cgroupLimits(cgroupRoot)
+}
+
+func readCgroupFile(path string) string {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(d))
+}
+
+func cgroupLimits(root string) (memory int64, cpus float64) {
+	if v := readCgroupFile(filepath.Join(root, "memory.max")); v != "" { // v2
+		memory, _ = strconv.ParseInt(v, 10, 64) // "max" means unlimited
+		if fs := strings.Fields(readCgroupFile(filepath.Join(root, "cpu.max"))); len(fs) == 2 {
+			quota, _ := strconv.ParseFloat(fs[0], 64)
+			period, _ := strconv.ParseFloat(fs[1], 64)
+			if quota > 0 && period > 0 {
+				cpus = quota / period
+			}
+		}
+		return
+	}
+	// v1
+	memory, _ = strconv.ParseInt(readCgroupFile(filepath.Join(root, "memory", "memory.limit_in_bytes")), 10, 64)
+	if memory >= 1<<62 { // PAGE_COUNTER_MAX, unlimited
+		memory = 0
+	}
+	quota, _ := strconv.ParseFloat(readCgroupFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us")), 64)
+	period, _ := strconv.ParseFloat(readCgroupFile(filepath.Join(root, "cpu", "cpu.cfs_period_us")), 64)
+	if quota > 0 && period > 0 {
+		cpus = quota / period
+	}
+	return
+}
@@ -0,0 +1,62 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupLimits(t *testing.T) {
+	write := func(path, content string) {
+		_ = os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %s", path, err)
+		}
+	}
+
+	v2 := t.TempDir()
+	write(filepath.Join(v2, "memory.max"), "536870912\n")
+	write(filepath.Join(v2, "cpu.max"), "50000 100000\n")
+	mem, cpus := cgroupLimits(v2)
+	assertEqual(t, mem, int64(512<<20))
+	assertEqual(t, cpus, 0.5)
+	write(filepath.Join(v2, "memory.max"), "max\n")
+	write(filepath.Join(v2, "cpu.max"), "max 100000\n")
+	mem, cpus = cgroupLimits(v2)
+	assertEqual(t, mem, int64(0))
+	assertEqual(t, cpus, 0.0)
+
+	v1 := t.TempDir()
+	write(filepath.Join(v1, "memory", "memory.limit_in_bytes"), "9223372036854771712\n")
+	write(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), "-1\n")
+	write(filepath.Join(v1, "cpu", "cpu.cfs_period_us"), "100000\n")
+	mem, cpus = cgroupLimits(v1)
+	assertEqual(t, mem, int64(0))
+	assertEqual(t, cpus, 0.0)
+	write(filepath.Join(v1, "memory", "memory.limit_in_bytes"), "1073741824\n")
+	write(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), "200000\n")
+	mem, cpus = cgroupLimits(v1)
+	assertEqual(t, mem, int64(1<<30))
+	assertEqual(t, cpus, 2.0)
+
+	mem, cpus = cgroupLimits(filepath.Join(v1, "not-exist"))
+	assertEqual(t, mem, int64(0))
+	assertEqual(t, cpus, 0.0)
+}
@@ -0,0 +1,147 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrClass is the class of an error from meta engine or object storage.
+type ErrClass string
+
+const (
+	ErrUnknown    ErrClass = "unknown"
+	ErrNotFound   ErrClass = "notfound"
+	ErrPermission ErrClass = "permission"
+	ErrQuota      ErrClass = "quota"
+	ErrNoSpace    ErrClass = "nospace"
+	ErrNetwork    ErrClass = "network"
+	ErrTimeout    ErrClass = "timeout"
+	ErrCorrupt    ErrClass = "corrupt"
+)
+
+// errnoOfClass maps the error classes into the errno returned to applications.
+var errnoOfClass = map[ErrClass]syscall.Errno{
+	ErrUnknown:    syscall.EIO,
+	ErrNotFound:   syscall.ENOENT,
+	ErrPermission: syscall.EACCES,
+	ErrQuota:      syscall.EDQUOT,
+	ErrNoSpace:    syscall.ENOSPC,
+	ErrNetwork:    syscall.ENETUNREACH,
+	ErrTimeout:    syscall.ETIMEDOUT,
+	ErrCorrupt:    syscall.EBADMSG,
+}
+
+var classOfErrno = map[syscall.Errno]ErrClass{
+	syscall.ENOENT:       ErrNotFound,
+	syscall.EACCES:       ErrPermission,
+	syscall.EPERM:        ErrPermission,
+	syscall.EDQUOT:       ErrQuota,
+	syscall.ENOSPC:       ErrNoSpace,
+	syscall.ECONNREFUSED: ErrNetwork,
+	syscall.ECONNRESET:   ErrNetwork,
+	syscall.ECONNABORTED: ErrNetwork,
+	syscall.ENETUNREACH:  ErrNetwork,
+	syscall.EHOSTUNREACH: ErrNetwork,
+	syscall.EPIPE:        ErrNetwork,
+	syscall.ETIMEDOUT:    ErrTimeout,
+	syscall.EBADMSG:      ErrCorrupt,
+}
+
+// ErrorCounter counts the errors returned to applications by class.
+var ErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "io_errors",
+	Help: "errors returned to applications by class.",
+}, []string{"class"})
+
+// Error is an error with a known class.
+type Error struct {
+	Class ErrClass
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError returns err with the given class, or nil if err is nil.
+func NewError(class ErrClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{class, err}
+}
+
+// ClassOf returns the class of err: the one given by NewError, or guessed from the wrapped errors.
+func ClassOf(err error) ErrClass {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	var eno syscall.Errno
+	if errors.As(err, &eno) {
+		if c, ok := classOfErrno[eno]; ok {
+			return c
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		if ne.Timeout() {
+			return ErrTimeout
+		}
+		return ErrNetwork
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return ErrPermission
+	}
+	return ErrUnknown
+}
+
+// Errno returns the errno of err for applications, and counts it by class.
+// A bare syscall.Errno is returned as it is.
+func Errno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	class := ClassOf(err)
+	ErrorCounter.WithLabelValues(string(class)).Inc()
+	if eno, ok := err.(syscall.Errno); ok {
+		return eno
+	}
+	return errnoOfClass[class]
+}
+
+// IsRetryable returns whether the operation failed with eno could succeed by retrying.
+func IsRetryable(eno syscall.Errno) bool {
+	return eno == syscall.EIO || eno == errnoOfClass[ErrNetwork] || eno == errnoOfClass[ErrTimeout]
+}
@@ -0,0 +1,44 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrno(t *testing.T) {
+	assertEqual(t, Errno(nil), syscall.Errno(0))
+	assertEqual(t, Errno(syscall.ENOENT), syscall.ENOENT)
+	assertEqual(t, Errno(errors.New("unknown")), syscall.EIO)
+	assertEqual(t, Errno(NewError(ErrQuota, errors.New("quota exceeded"))), syscall.EDQUOT)
+	assertEqual(t, Errno(fmt.Errorf("get block: %w", NewError(ErrCorrupt, errors.New("short read")))), syscall.EBADMSG)
+	assertEqual(t, Errno(fmt.Errorf("get block: %w", context.DeadlineExceeded)), syscall.ETIMEDOUT)
+	assertEqual(t, Errno(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), syscall.ENETUNREACH)
+	assertEqual(t, Errno(fmt.Errorf("open: %w", os.ErrPermission)), syscall.EACCES)
+
+	assertEqual(t, ClassOf(fmt.Errorf("upload: %w", syscall.ENOSPC)), ErrNoSpace)
+	assertEqual(t, ClassOf(errors.New("unknown")), ErrUnknown)
+	assertEqual(t, IsRetryable(syscall.EIO), true)
+	assertEqual(t, IsRetryable(syscall.ETIMEDOUT), true)
+	assertEqual(t, IsRetryable(syscall.EDQUOT), false)
+}
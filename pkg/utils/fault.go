@@ -0,0 +1,85 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjectedFault is returned by the requests dropped by a FaultInjector.
+var ErrInjectedFault = NewError(ErrNetwork, errors.New("injected fault"))
+
+// Fault describes the faults injected into requests, the percentages are in [0, 100].
+type Fault struct {
+	Drop         float64       // percentage of requests to fail
+	DelayPercent float64       // percentage of requests to delay
+	Delay        time.Duration // latency added to the delayed requests
+}
+
+func (f Fault) String() string {
+	if f.Drop == 0 && f.DelayPercent == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("drop %g%%, delay %g%% by %s", f.Drop, f.DelayPercent, f.Delay)
+}
+
+// Validate checks whether the fault is valid.
+func (f Fault) Validate() error {
+	if f.Drop < 0 || f.Drop > 100 || f.DelayPercent < 0 || f.DelayPercent > 100 {
+		return fmt.Errorf("percentage should be in [0, 100]: %s", f)
+	}
+	if f.Delay < 0 {
+		return fmt.Errorf("negative delay: %s", f.Delay)
+	}
+	return nil
+}
+
+// FaultInjector drops or delays the requests it's called for, so the failure handling of
+// applications can be rehearsed. The zero value injects nothing.
+type FaultInjector struct {
+	fault atomic.Value
+}
+
+// Set replaces the current fault.
+func (f *FaultInjector) Set(fault Fault) {
+	f.fault.Store(fault)
+}
+
+// Get returns the current fault.
+func (f *FaultInjector) Get() Fault {
+	fault, _ := f.fault.Load().(Fault)
+	return fault
+}
+
+// Inject delays the request, or fails it with ErrInjectedFault, according to the current fault.
+func (f *FaultInjector) Inject() error {
+	if f == nil {
+		return nil
+	}
+	fault := f.Get()
+	if fault.DelayPercent > 0 && fault.Delay > 0 && rand.Float64()*100 < fault.DelayPercent {
+		time.Sleep(fault.Delay)
+	}
+	if fault.Drop > 0 && rand.Float64()*100 < fault.Drop {
+		return ErrInjectedFault
+	}
+	return nil
+}
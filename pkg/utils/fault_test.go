@@ -0,0 +1,57 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector(t *testing.T) {
+	var f FaultInjector
+	if err := f.Inject(); err != nil {
+		t.Fatalf("no fault is injected by default: %s", err)
+	}
+	var nilInjector *FaultInjector
+	if err := nilInjector.Inject(); err != nil {
+		t.Fatalf("nil injector: %s", err)
+	}
+
+	f.Set(Fault{Drop: 100})
+	if err := f.Inject(); err != ErrInjectedFault || Errno(err) != syscall.ENETUNREACH {
+		t.Fatalf("dropped request: %v", err)
+	}
+	f.Set(Fault{DelayPercent: 100, Delay: time.Millisecond * 20})
+	start := time.Now()
+	if err := f.Inject(); err != nil || time.Since(start) < time.Millisecond*20 {
+		t.Fatalf("delayed request: %v %s", err, time.Since(start))
+	}
+	if s := f.Get().String(); s != "drop 0%, delay 100% by 20ms" {
+		t.Fatalf("fault: %s", s)
+	}
+	f.Set(Fault{})
+	if s := f.Get().String(); s != "none" {
+		t.Fatalf("fault: %s", s)
+	}
+
+	for _, fault := range []Fault{{Drop: -1}, {DelayPercent: 101}, {Delay: -time.Second}} {
+		if fault.Validate() == nil {
+			t.Fatalf("fault %+v should be invalid", fault)
+		}
+	}
+}
@@ -27,7 +27,7 @@ import (
 var mu sync.Mutex
 var loggers = make(map[string]*logHandle)
 
-var syslogHook logrus.Hook
+var hooks []logrus.Hook // added to all the loggers
 
 type logHandle struct {
 	logrus.Logger
@@ -81,8 +81,8 @@ func (l *logHandle) Log(args ...interface{}) {
 func newLogger(name string) *logHandle {
 	l := &logHandle{Logger: *logrus.New(), name: name, tty: isatty.IsTerminal(os.Stderr.Fd())}
 	l.Formatter = l
-	if syslogHook != nil {
-		l.Hooks.Add(syslogHook)
+	for _, hook := range hooks {
+		l.Hooks.Add(hook)
 	}
 	return l
 }
@@ -100,6 +100,16 @@ func GetLogger(name string) *logHandle {
 	return logger
 }
 
+// AddLogHook adds a hook to send logs of all the loggers to external sinks.
+func AddLogHook(hook logrus.Hook) {
+	mu.Lock()
+	defer mu.Unlock()
+	hooks = append(hooks, hook)
+	for _, l := range loggers {
+		l.Hooks.Add(hook)
+	}
+}
+
 // SetLogLevel sets Level to all the loggers in the map
 func SetLogLevel(lvl logrus.Level) {
 	for _, logger := range loggers {
@@ -0,0 +1,100 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// JournaldHook sends logs to systemd-journald with its native protocol.
+type JournaldHook struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+func NewJournaldHook() (*JournaldHook, error) {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Name: journaldSocket, Net: "unixgram"}
+	if _, err = os.Stat(journaldSocket); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &JournaldHook{conn, addr}, nil
+}
+
+func (hook *JournaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// journald priorities are the same as syslog
+func journaldPriority(lvl logrus.Level) int {
+	switch lvl {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func appendJournalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if strings.ContainsRune(value, '\n') {
+		// binary safe format: KEY\n<little endian 64 bits size><value>\n
+		buf.WriteByte('\n')
+		_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func (hook *JournaldHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	// drop the timestamp, journald has its own
+	appendJournalField(&buf, "MESSAGE", strings.TrimSuffix(line[27:], "\n"))
+	appendJournalField(&buf, "PRIORITY", strconv.Itoa(journaldPriority(entry.Level)))
+	appendJournalField(&buf, "SYSLOG_IDENTIFIER", "juicefs")
+	appendJournalField(&buf, "SYSLOG_PID", strconv.Itoa(os.Getpid()))
+	_, err = hook.conn.WriteToUnix(buf.Bytes(), hook.addr)
+	return err
+}
@@ -0,0 +1,77 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package utils
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogRing is a hook which keeps the latest lines of logs in memory,
+// they can be served over HTTP as plain text.
+type LogRing struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{lines: make([]string, size)}
+}
+
+func (r *LogRing) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (r *LogRing) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+	r.Unlock()
+	return nil
+}
+
+// Lines returns the lines kept, the oldest one first.
+func (r *LogRing) Lines() []string {
+	r.Lock()
+	defer r.Unlock()
+	var lines []string
+	if r.full {
+		lines = append(lines, r.lines[r.next:]...)
+	}
+	return append(lines, r.lines[:r.next]...)
+}
+
+func (r *LogRing) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range r.Lines() {
+		if _, err := w.Write([]byte(line)); err != nil {
+			return
+		}
+	}
+}
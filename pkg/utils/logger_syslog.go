@@ -67,10 +67,6 @@ func InitLoggers(logToSyslog bool) {
 			// println("Unable to connect to local syslog daemon")
 			return
 		}
-		syslogHook = &SyslogHook{hook}
-
-		for _, l := range loggers {
-			l.Hooks.Add(syslogHook)
-		}
+		AddLogHook(&SyslogHook{hook})
 	}
 }
@@ -18,6 +18,7 @@ package utils
 
 import (
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -56,3 +57,24 @@ func TestLogger(t *testing.T) {
 		t.Fatalf("warn/error should be logged: %s", s)
 	}
 }
+
+func TestLogRing(t *testing.T) {
+	ring := NewLogRing(2)
+	AddLogHook(ring)
+	logger := GetLogger("ring")
+	logger.SetLevel(logrus.InfoLevel)
+	logger.Info("line 1")
+	logger.Debug("line 2") // filtered by level
+	logger.Warn("line 3")
+	logger.Error("line 4")
+
+	lines := ring.Lines()
+	if len(lines) != 2 || !strings.Contains(lines[0], "line 3") || !strings.Contains(lines[1], "line 4") {
+		t.Fatalf("unexpected lines: %q", lines)
+	}
+	w := httptest.NewRecorder()
+	ring.ServeHTTP(w, httptest.NewRequest("GET", "/debug/logs", nil))
+	if body := w.Body.String(); body != strings.Join(lines, "") {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
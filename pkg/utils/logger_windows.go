@@ -16,4 +16,50 @@
 
 package utils
 
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
 func InitLoggers(logToSyslog bool) {}
+
+// EventLogHook sends logs to Windows Event Log.
+type EventLogHook struct {
+	log *eventlog.Log
+}
+
+// NewEventLogHook opens the event log of source, which will be registered if it's not yet.
+func NewEventLogHook(source string) (*EventLogHook, error) {
+	err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "registry key already exists") {
+		return nil, err
+	}
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &EventLogHook{l}, nil
+}
+
+func (hook *EventLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (hook *EventLogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	// drop the timestamp
+	line = line[27:]
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return hook.log.Error(1, line)
+	case logrus.WarnLevel:
+		return hook.log.Warning(1, line)
+	default:
+		return hook.log.Info(1, line)
+	}
+}
@@ -40,12 +40,15 @@ type logReader struct {
 }
 
 var (
-	readerLock sync.Mutex
-	readers    map[uint64]*logReader
+	readerLock   sync.Mutex
+	readers      map[uint64]*logReader
+	blockReaders map[uint64]*logReader
+	lastBlock    string
 )
 
 func init() {
 	readers = make(map[uint64]*logReader)
+	blockReaders = make(map[uint64]*logReader)
 }
 
 func logit(ctx Context, format string, args ...interface{}) {
@@ -74,6 +77,32 @@ func logit(ctx Context, format string, args ...interface{}) {
 	}
 }
 
+// traceBlock sends the key of a block being read to the readers of block log,
+// repeated reads of the same block are only logged once.
+func traceBlock(key string) {
+	readerLock.Lock()
+	defer readerLock.Unlock()
+	if len(blockReaders) == 0 || key == lastBlock {
+		return
+	}
+	lastBlock = key
+	line := []byte(key + "\n")
+	for _, r := range blockReaders {
+		select {
+		case r.buffer <- line:
+		default:
+		}
+	}
+}
+
+func openBlockLog(fh uint64) uint64 {
+	readerLock.Lock()
+	defer readerLock.Unlock()
+	blockReaders[fh] = &logReader{buffer: make(chan []byte, 10240)}
+	lastBlock = ""
+	return fh
+}
+
 func openAccessLog(fh uint64) uint64 {
 	readerLock.Lock()
 	defer readerLock.Unlock()
@@ -85,11 +114,15 @@ func closeAccessLog(fh uint64) {
 	readerLock.Lock()
 	defer readerLock.Unlock()
 	delete(readers, fh)
+	delete(blockReaders, fh)
 }
 
 func readAccessLog(fh uint64, buf []byte) int {
 	readerLock.Lock()
 	r, ok := readers[fh]
+	if !ok {
+		r, ok = blockReaders[fh]
+	}
 	readerLock.Unlock()
 	if !ok {
 		return 0
@@ -71,3 +71,21 @@ func TestAccessLog(t *testing.T) {
 		t.Fatalf("expected line: %q", string(buf[:n]))
 	}
 }
+
+func TestBlockLog(t *testing.T) {
+	traceBlock("chunks/0/0/1_0_1024") // no readers
+	openBlockLog(3)
+	defer closeAccessLog(3)
+
+	ctx := NewLogContext(meta.NewContext(10, 1, []uint32{2}))
+	logit(ctx, "test") // should not go to block log
+	traceBlock("chunks/0/0/1_0_1024")
+	traceBlock("chunks/0/0/1_0_1024")
+	traceBlock("chunks/0/0/2_0_1024")
+
+	buf := make([]byte, 1024)
+	n := readAccessLog(3, buf)
+	if string(buf[:n]) != "chunks/0/0/1_0_1024\nchunks/0/0/2_0_1024\n" {
+		t.Fatalf("unexpected block log: %q", string(buf[:n]))
+	}
+}
@@ -18,9 +18,11 @@ package vfs
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/juicedata/juicefs/pkg/meta"
@@ -162,3 +164,30 @@ func rotate(objs []string, now time.Time) []string {
 	}
 	return toDel
 }
+
+// FindBackup returns the key of the latest metadata backup made at or before t.
+func FindBackup(blob object.ObjectStorage, t time.Time) (string, error) {
+	ch, err := osync.ListAll(object.WithPrefix(blob, "meta/"), "", "")
+	if err != nil {
+		return "", err
+	}
+	var found string
+	var last time.Time
+	for o := range ch {
+		name := o.Key()
+		if len(name) != 30 || !strings.HasPrefix(name, "dump-") { // len("dump-2006-01-02-150405.json.gz")
+			continue
+		}
+		ts, err := time.Parse("2006-01-02-150405", name[5:22])
+		if err != nil || ts.After(t) {
+			continue
+		}
+		if found == "" || ts.After(last) {
+			found, last = name, ts
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no metadata backup before %s", t.Format(time.RFC3339))
+	}
+	return "meta/" + found, nil
+}
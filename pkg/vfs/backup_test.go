@@ -17,6 +17,7 @@
 package vfs
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
@@ -82,3 +83,26 @@ func TestBackup(t *testing.T) {
 		t.Fatalf("there should be at least 1 backup file")
 	}
 }
+
+func TestFindBackup(t *testing.T) {
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	for _, k := range []string{"dump-2022-05-01-000000.json.gz", "dump-2022-05-01-010000.json.gz", "dump-2022-05-02-000000.json.gz", "dump-bad.json.gz"} {
+		if err := blob.Put("meta/"+k, bytes.NewReader(nil)); err != nil {
+			t.Fatalf("put %s: %s", k, err)
+		}
+	}
+	cases := map[string]string{
+		"2022-05-01T00:30:00Z": "meta/dump-2022-05-01-000000.json.gz",
+		"2022-05-01T01:00:00Z": "meta/dump-2022-05-01-010000.json.gz",
+		"2022-05-03T00:00:00Z": "meta/dump-2022-05-02-000000.json.gz",
+	}
+	for at, expect := range cases {
+		ts, _ := time.Parse(time.RFC3339, at)
+		if key, err := FindBackup(blob, ts); err != nil || key != expect {
+			t.Fatalf("find backup at %s: %s %v, expect %s", at, key, err, expect)
+		}
+	}
+	if _, err := FindBackup(blob, time.Date(2022, 4, 30, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Fatalf("should not find any backup before the first one")
+	}
+}
@@ -17,8 +17,10 @@
 package vfs
 
 import (
+	"bytes"
 	"fmt"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -73,6 +75,76 @@ func (v *VFS) fillCache(paths []string, concurrent int) {
 	logger.Infof("Warmup %d paths in %s", len(paths), time.Since(start))
 }
 
+func (v *VFS) fillBlocks(keys []string, concurrent int) {
+	logger.Infof("start to warmup %d blocks with %d workers", len(keys), concurrent)
+	start := time.Now()
+	todo := make(chan string, 10240)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			for key := range todo {
+				if err := v.Store.FillBlock(key); err != nil {
+					logger.Errorf("Failed to cache block %s: %s", key, err)
+				}
+			}
+			wg.Done()
+		}()
+	}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			todo <- key
+		}
+	}
+	close(todo)
+	wg.Wait()
+	logger.Infof("Warmup %d blocks in %s", len(keys), time.Since(start))
+}
+
+// listCache returns the UUID of the volume in the first line, followed by the keys of
+// cached blocks and the paths of their files, separated by tab.
+func (v *VFS) listCache() []byte {
+	blocks := v.Store.CachedBlocks()
+	keys := make([]string, 0, len(blocks))
+	for key := range blocks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString(v.Conf.Format.UUID + "\n")
+	for _, key := range keys {
+		buf.WriteString(key + "\t" + blocks[key] + "\n")
+	}
+	return buf.Bytes()
+}
+
+// loadBlocks builds cache for blocks from local files, the items are keys and paths separated by tab.
+func (v *VFS) loadBlocks(items []string, concurrent int) {
+	logger.Infof("start to load %d blocks into cache with %d workers", len(items), concurrent)
+	start := time.Now()
+	todo := make(chan []string, 10240)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			for kp := range todo {
+				if err := v.Store.LoadBlock(kp[0], kp[1]); err != nil {
+					logger.Errorf("Failed to load block %s from %s: %s", kp[0], kp[1], err)
+				}
+			}
+			wg.Done()
+		}()
+	}
+	for _, item := range items {
+		if kp := strings.SplitN(item, "\t", 2); len(kp) == 2 {
+			todo <- kp
+		}
+	}
+	close(todo)
+	wg.Wait()
+	logger.Infof("Load %d blocks in %s", len(items), time.Since(start))
+}
+
 func (v *VFS) resolve(p string, inode *Ino, attr *Attr) syscall.Errno {
 	p = strings.Trim(p, "/")
 	ctx := meta.Background
@@ -0,0 +1,151 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// freezer quiesces the modifications of a mount point, like FIFREEZE of local file systems: once it's
+// frozen, the new modifications wait until it's thawed, so a consistent snapshot of the data can be taken.
+type freezer struct {
+	sync.Mutex
+	frozen bool
+	active int           // modifications in progress
+	idle   chan struct{} // closed when active drops to zero while freezing
+	thawed chan struct{} // closed when it's thawed
+	timer  *time.Timer   // thaws it automatically
+}
+
+// enter waits until it's not frozen, and registers a modification, which should call leave once done.
+func (f *freezer) enter(ctx meta.Context) syscall.Errno {
+	for {
+		f.Lock()
+		if !f.frozen {
+			f.active++
+			f.Unlock()
+			return 0
+		}
+		thawed := f.thawed
+		f.Unlock()
+		select {
+		case <-thawed:
+		case <-time.After(time.Millisecond * 100):
+			if ctx.Canceled() {
+				return syscall.EINTR
+			}
+		}
+	}
+}
+
+func (f *freezer) leave() {
+	f.Lock()
+	f.active--
+	if f.active == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+	f.Unlock()
+}
+
+// freeze blocks new modifications and waits for the ones in progress up to wait. It will be thawed
+// automatically after timeout if it's positive.
+func (f *freezer) freeze(wait, timeout time.Duration) syscall.Errno {
+	f.Lock()
+	if f.frozen {
+		f.Unlock()
+		return syscall.EBUSY
+	}
+	f.frozen = true
+	f.thawed = make(chan struct{})
+	var idle chan struct{}
+	if f.active > 0 {
+		idle = make(chan struct{})
+		f.idle = idle
+	}
+	f.Unlock()
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-time.After(wait):
+			f.thaw()
+			return syscall.ETIMEDOUT
+		}
+	}
+	if timeout > 0 {
+		f.Lock()
+		f.timer = time.AfterFunc(timeout, func() {
+			if f.thaw() == 0 {
+				logger.Warnf("Thawed automatically after frozen for %s", timeout)
+			}
+		})
+		f.Unlock()
+	}
+	return 0
+}
+
+func (f *freezer) thaw() syscall.Errno {
+	f.Lock()
+	defer f.Unlock()
+	if !f.frozen {
+		return syscall.EINVAL
+	}
+	f.frozen = false
+	f.idle = nil
+	close(f.thawed)
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	return 0
+}
+
+// Freeze blocks the modifications of the mount point, flushes all the buffered data and uploads the
+// blocks staged by writeback, so the metadata and object storage are consistent until thawed.
+func (v *VFS) Freeze(ctx Context, wait, timeout time.Duration) syscall.Errno {
+	if st := v.freezer.freeze(wait, timeout); st != 0 {
+		return st
+	}
+	if st := v.writer.Sync(ctx); st != 0 {
+		_ = v.freezer.thaw()
+		return st
+	}
+	if v.times != nil {
+		v.times.flushAll()
+	}
+	// the blocks staged by writeback are referenced by the metadata already
+	if err := v.Store.FlushStaging(wait); err != nil {
+		logger.Warnf("Freeze: %s", err)
+		_ = v.freezer.thaw()
+		return syscall.ETIMEDOUT
+	}
+	logger.Infof("Frozen, modifications are blocked until thawed")
+	return 0
+}
+
+// Thaw unblocks the modifications blocked by Freeze.
+func (v *VFS) Thaw(ctx Context) syscall.Errno {
+	st := v.freezer.thaw()
+	if st == 0 {
+		logger.Infof("Thawed")
+	}
+	return st
+}
@@ -31,13 +31,17 @@ type handle struct {
 	fh    uint64
 
 	// for dir
-	children []*meta.Entry
+	children []*meta.Entry // a page of entries, starting from childOff
+	childOff int
+	cursor   string // to list the next page
+	listed   bool   // all the entries are listed
 
 	// for file
 	locks      uint8
 	flockOwner uint64 // kernel 3.1- does not pass lock_owner in release()
 	reader     FileReader
 	writer     FileWriter
+	append     bool // writes are appended at the end of file reserved in meta
 	ops        []Context
 
 	// rwlock
@@ -202,6 +206,7 @@ func (v *VFS) newFileHandle(inode Ino, length uint64, flags uint32) uint64 {
 	case syscall.O_RDWR:
 		h.reader = v.reader.Open(inode, length)
 		h.writer = v.writer.Open(inode, length)
+		h.append = v.Conf.OrderedAppend && flags&syscall.O_APPEND != 0
 	}
 	return h.fh
 }
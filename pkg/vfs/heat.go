@@ -0,0 +1,161 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// the maximum number of files to track, the new ones are ignored once it's reached
+const maxHeatFiles = 1 << 20
+
+type fileHeat struct {
+	count uint32 // number of opens
+	last  int64  // last access in seconds
+}
+
+// heatMap tracks approximate access counts and the last access time of files
+// opened by this client.
+type heatMap struct {
+	sync.Mutex
+	files map[Ino]*fileHeat
+}
+
+func newHeatMap() *heatMap {
+	return &heatMap{files: make(map[Ino]*fileHeat)}
+}
+
+func (h *heatMap) access(ino Ino) {
+	now := time.Now().Unix()
+	h.Lock()
+	defer h.Unlock()
+	f := h.files[ino]
+	if f == nil {
+		if len(h.files) >= maxHeatFiles {
+			return
+		}
+		f = &fileHeat{}
+		h.files[ino] = f
+	}
+	f.count++
+	f.last = now
+}
+
+func (h *heatMap) get(ino Ino) (fileHeat, bool) {
+	h.Lock()
+	defer h.Unlock()
+	if f, ok := h.files[ino]; ok {
+		return *f, true
+	}
+	return fileHeat{}, false
+}
+
+type heatTier struct {
+	name  string
+	files uint64
+	size  uint64
+}
+
+type hotFile struct {
+	path string
+	fileHeat
+}
+
+// heatReport walks the tree under inode and classifies the files into hot, warm and cold
+// by their last access, which is the later one of atime and the one tracked by this client.
+func (v *VFS) heatReport(ctx meta.Context, inode Ino, hot, warm time.Duration, top int) ([]byte, syscall.Errno) {
+	now := time.Now()
+	tiers := []*heatTier{{name: "hot"}, {name: "warm"}, {name: "cold"}}
+	var hottest []hotFile
+	classify := func(inode Ino, p string, attr *Attr) {
+		last := attr.Atime
+		if f, ok := v.heat.get(inode); ok {
+			if f.last > last {
+				last = f.last
+			}
+			hottest = append(hottest, hotFile{p, f})
+		}
+		t := tiers[2]
+		if age := now.Sub(time.Unix(last, 0)); age < hot {
+			t = tiers[0]
+		} else if age < warm {
+			t = tiers[1]
+		}
+		t.files++
+		t.size += attr.Length
+	}
+	var walk func(dir Ino, prefix string) syscall.Errno
+	walk = func(dir Ino, prefix string) syscall.Errno {
+		var entries []*meta.Entry
+		if st := v.Meta.Readdir(ctx, dir, meta.ReaddirFull, &entries); st != 0 {
+			return st
+		}
+		for _, e := range entries {
+			name := string(e.Name)
+			if name == "." || name == ".." || dir == rootID && name == meta.TrashName {
+				continue
+			}
+			p := path.Join(prefix, name)
+			if e.Attr.Typ == meta.TypeDirectory {
+				if st := walk(e.Inode, p); st != 0 {
+					return st
+				}
+				continue
+			}
+			if e.Attr.Typ == meta.TypeFile {
+				classify(e.Inode, p, e.Attr)
+			}
+		}
+		return 0
+	}
+	var attr Attr
+	if st := v.Meta.GetAttr(ctx, inode, &attr); st != 0 {
+		return nil, st
+	}
+	if attr.Typ == meta.TypeDirectory {
+		if st := walk(inode, ""); st != 0 {
+			return nil, st
+		}
+	} else if attr.Typ == meta.TypeFile {
+		classify(inode, ".", &attr)
+	}
+
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "%-6s %12s %16s\n", "TIER", "FILES", "SIZE")
+	for _, t := range tiers {
+		fmt.Fprintf(&w, "%-6s %12d %16d\n", t.name, t.files, t.size)
+	}
+	sort.Slice(hottest, func(i, j int) bool { return hottest[i].count > hottest[j].count })
+	if len(hottest) > top {
+		hottest = hottest[:top]
+	}
+	if len(hottest) > 0 {
+		fmt.Fprintf(&w, "\nhottest files (opens, last access, path):\n")
+		for _, f := range hottest {
+			fmt.Fprintf(&w, "%8d  %s  %s\n", f.count, time.Unix(f.last, 0).Format("2006-01-02 15:04:05"), f.path)
+		}
+	}
+	return w.Bytes(), 0
+}
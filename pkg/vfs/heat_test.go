@@ -0,0 +1,59 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestHeatReport(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	entry, _ := v.Mkdir(ctx, 1, "heat", 0777, 022)
+	fe, fh, _ := v.Create(ctx, entry.Inode, "hot", 0644, 0, uint32(os.O_WRONLY))
+	_ = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh)
+	v.Release(ctx, fe.Inode, fh)
+	for i := 0; i < 3; i++ {
+		_, fh, _ = v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+		v.Release(ctx, fe.Inode, fh)
+	}
+	ce, fh, _ := v.Create(ctx, entry.Inode, "cold", 0644, 0, uint32(os.O_WRONLY))
+	v.Release(ctx, ce.Inode, fh)
+	attr := &meta.Attr{Atime: time.Now().Add(-time.Hour * 24 * 30).Unix()}
+	if st := v.Meta.SetAttr(ctx, ce.Inode, meta.SetAttrAtime, 0, attr); st != 0 {
+		t.Fatalf("setattr cold: %s", st)
+	}
+
+	report, st := v.heatReport(ctx, entry.Inode, time.Hour, time.Hour*24, 10)
+	if st != 0 {
+		t.Fatalf("heat report: %s", st)
+	}
+	lines := strings.Split(string(report), "\n")
+	if len(lines) < 7 || strings.Fields(lines[1])[1] != "1" || strings.Fields(lines[1])[2] != "5" ||
+		strings.Fields(lines[3])[1] != "1" || !strings.HasSuffix(lines[6], " hot") || strings.Fields(lines[6])[0] != "3" {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+	if _, st = v.heatReport(ctx, 12345, time.Hour, time.Hour*24, 10); st != syscall.ENOENT {
+		t.Fatalf("heat report of missing inode: %s", st)
+	}
+}
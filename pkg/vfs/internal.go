@@ -37,9 +37,16 @@ const (
 	controlInode    = minInternalNode + 2
 	statsInode      = minInternalNode + 3
 	configInode     = minInternalNode + 4
+	blockInode      = minInternalNode + 5
 	trashInode      = meta.TrashInode
 )
 
+// targets of the faults to inject
+const (
+	FaultMeta   = 1 << 0
+	FaultObject = 1 << 1
+)
+
 type internalNode struct {
 	inode Ino
 	name  string
@@ -51,6 +58,7 @@ var internalNodes = []*internalNode{
 	{controlInode, ".control", &Attr{Mode: 0666}},
 	{statsInode, ".stats", &Attr{Mode: 0444}},
 	{configInode, ".config", &Attr{Mode: 0400}},
+	{blockInode, ".blocklog", &Attr{Mode: 0400}},
 	{trashInode, meta.TrashName, &Attr{Mode: 0555}},
 }
 
@@ -153,13 +161,51 @@ func collectMetrics() []byte {
 	return w.Bytes()
 }
 
+// visible checks whether the inode given by a control message is under the mounted subdir, so that the
+// inodes outside of it could not be reached by their numbers.
+func (v *VFS) visible(ctx Context, inode Ino) syscall.Errno {
+	if v.Conf.Meta.Subdir == "" || inode == 1 {
+		return 0
+	}
+	var root Ino
+	var attr Attr
+	if st := v.Meta.Lookup(ctx, 1, ".", &root, &attr); st != 0 {
+		return st
+	}
+	for inode != root {
+		if inode == 1 || inode == 0 { // reached the root of volume, or a hard link without parent
+			return syscall.ENOENT
+		}
+		if st := v.Meta.GetAttr(ctx, inode, &attr); st != 0 {
+			return st
+		}
+		inode = attr.Parent
+	}
+	return 0
+}
+
 func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte {
 	switch cmd {
 	case meta.Rmr:
 		inode := Ino(r.Get64())
 		name := string(r.Get(int(r.Get8())))
+		if st := v.visible(ctx, inode); st != 0 {
+			return []byte{uint8(st)}
+		}
 		r := meta.Remove(v.Meta, ctx, inode, name)
 		return []byte{uint8(r)}
+	case meta.Clone:
+		src := Ino(r.Get64())
+		parent := Ino(r.Get64())
+		name := string(r.Get(int(r.Get8())))
+		st := v.visible(ctx, src)
+		if st == 0 {
+			st = v.visible(ctx, parent)
+		}
+		if st == 0 {
+			st = v.Meta.Clone(ctx, src, parent, name)
+		}
+		return []byte{uint8(st)}
 	case meta.Info:
 		var summary meta.Summary
 		inode := Ino(r.Get64())
@@ -169,7 +215,10 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 		}
 
 		wb := utils.NewBuffer(4)
-		r := meta.GetSummary(v.Meta, ctx, inode, &summary, recursive != 0)
+		r := v.visible(ctx, inode)
+		if r == 0 {
+			r = v.Meta.GetSummary(ctx, inode, &summary, recursive != 0)
+		}
 		if r != 0 {
 			msg := r.Error()
 			wb.Put32(uint32(len(msg)))
@@ -177,6 +226,9 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 		}
 		var w = bytes.NewBuffer(nil)
 		fmt.Fprintf(w, " inode: %d\n", inode)
+		for _, p := range meta.GetPaths(v.Meta, ctx, inode) {
+			fmt.Fprintf(w, " path:\t%s\n", p)
+		}
 		fmt.Fprintf(w, " files:\t%d\n", summary.Files)
 		fmt.Fprintf(w, " dirs:\t%d\n", summary.Dirs)
 		fmt.Fprintf(w, " length:\t%d\n", summary.Length)
@@ -204,6 +256,103 @@ func (v *VFS) handleInternalMsg(ctx Context, cmd uint32, r *utils.Buffer) []byte
 			go v.fillCache(paths, int(concurrent))
 		}
 		return []byte{uint8(0)}
+	case meta.FillBlocks:
+		keys := strings.Split(string(r.Get(int(r.Get32()))), "\n")
+		concurrent := r.Get16()
+		background := r.Get8()
+		if background == 0 {
+			v.fillBlocks(keys, int(concurrent))
+		} else {
+			go v.fillBlocks(keys, int(concurrent))
+		}
+		return []byte{uint8(0)}
+	case meta.ListCache:
+		list := v.listCache()
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(list)))
+		return append(wb.Bytes(), list...)
+	case meta.LoadCache:
+		uuid := string(r.Get(int(r.Get32())))
+		items := strings.Split(string(r.Get(int(r.Get32()))), "\n")
+		concurrent := r.Get16()
+		if ctx.Uid() != 0 {
+			return []byte{uint8(syscall.EPERM & 0xff)}
+		}
+		if uuid != v.Conf.Format.UUID {
+			return []byte{uint8(syscall.EXDEV & 0xff)}
+		}
+		v.loadBlocks(items, int(concurrent))
+		return []byte{uint8(0)}
+	case meta.Heat:
+		inode := Ino(r.Get64())
+		hot := time.Duration(r.Get32()) * time.Second
+		warm := time.Duration(r.Get32()) * time.Second
+		top := int(r.Get16())
+		st := v.visible(ctx, inode)
+		var report []byte
+		if st == 0 {
+			report, st = v.heatReport(ctx, inode, hot, warm, top)
+		}
+		if st != 0 {
+			report = []byte(st.Error() + "\n")
+		}
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(report)))
+		return append(wb.Bytes(), report...)
+	case meta.Fault:
+		metaFaults, objectFaults := v.Conf.Meta.Faults, v.Conf.ObjectFaults
+		if metaFaults == nil || objectFaults == nil {
+			return []byte{uint8(syscall.ENOTSUP & 0xff)}
+		}
+		if target := r.Get8(); target != 0 {
+			if ctx.Uid() != 0 {
+				return []byte{uint8(syscall.EPERM & 0xff)}
+			}
+			fault := utils.Fault{
+				Drop:         float64(r.Get32()) / 100,
+				DelayPercent: float64(r.Get32()) / 100,
+				Delay:        time.Duration(r.Get32()) * time.Millisecond,
+			}
+			if target&FaultMeta != 0 {
+				metaFaults.Set(fault)
+			}
+			if target&FaultObject != 0 {
+				objectFaults.Set(fault)
+			}
+			logger.Warnf("Inject faults into requests to meta engine: %s, object storage: %s", metaFaults.Get(), objectFaults.Get())
+		}
+		report := fmt.Sprintf("meta engine: %s\nobject storage: %s\n", metaFaults.Get(), objectFaults.Get())
+		wb := utils.NewBuffer(4)
+		wb.Put32(uint32(len(report)))
+		return append(wb.Bytes(), report...)
+	case meta.Chattr:
+		inode := Ino(r.Get64())
+		add, remove := r.Get8(), r.Get8()
+		if st := v.visible(ctx, inode); st != 0 {
+			return []byte{uint8(st & 0xff)}
+		}
+		flags, st := v.ChangeFlags(ctx, inode, add, remove)
+		if st != 0 {
+			return []byte{uint8(st & 0xff)}
+		}
+		wb := utils.NewBuffer(4 + 1)
+		wb.Put32(1)
+		wb.Put8(flags)
+		return wb.Bytes()
+	case meta.Freeze:
+		freeze := r.Get8()
+		wait := time.Duration(r.Get32()) * time.Second
+		timeout := time.Duration(r.Get32()) * time.Second
+		if ctx.Uid() != 0 {
+			return []byte{uint8(syscall.EPERM & 0xff)}
+		}
+		var st syscall.Errno
+		if freeze != 0 {
+			st = v.Freeze(ctx, wait, timeout)
+		} else {
+			st = v.Thaw(ctx)
+		}
+		return []byte{uint8(st & 0xff)}
 	default:
 		logger.Warnf("unknown message type: %d", cmd)
 		return []byte{uint8(syscall.EINVAL & 0xff)}
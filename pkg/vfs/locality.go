@@ -0,0 +1,84 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"path"
+	"syscall"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+// CachedFile is the amount of data of a file cached by this client.
+type CachedFile struct {
+	Inode  Ino
+	Path   string
+	Length uint64
+	Cached uint64 // bytes of the file found in local cache
+}
+
+func (v *VFS) cachedBytes(inode Ino, length uint64) (uint64, syscall.Errno) {
+	var cached uint64
+	var slices []meta.Slice
+	for indx := uint64(0); indx*meta.ChunkSize < length; indx++ {
+		if st := v.Meta.Read(meta.Background, inode, uint32(indx), &slices); st != 0 {
+			return 0, st
+		}
+		for _, s := range slices {
+			if s.Chunkid > 0 {
+				cached += v.Store.CheckCache(s.Chunkid, s.Size, s.Off, s.Len)
+			}
+		}
+	}
+	return cached, 0
+}
+
+// CachedData reports how much data of the file at p (relative to the root of mount) is cached
+// by this client. For a directory, the regular files directly under it are reported.
+func (v *VFS) CachedData(p string) ([]CachedFile, syscall.Errno) {
+	var inode Ino
+	var attr = &Attr{}
+	if st := v.resolve(p, &inode, attr); st != 0 {
+		return nil, st
+	}
+	p = path.Join("/", p)
+	var files []CachedFile
+	switch attr.Typ {
+	case meta.TypeFile:
+		files = append(files, CachedFile{Inode: inode, Path: p, Length: attr.Length})
+	case meta.TypeDirectory:
+		var entries []*meta.Entry
+		if st := v.Meta.Readdir(meta.Background, inode, meta.ReaddirFull, &entries); st != 0 {
+			return nil, st
+		}
+		for _, e := range entries {
+			if e.Attr.Typ == meta.TypeFile {
+				files = append(files, CachedFile{Inode: e.Inode, Path: path.Join(p, string(e.Name)), Length: e.Attr.Length})
+			}
+		}
+	default:
+		return nil, syscall.EINVAL
+	}
+	for i := range files {
+		cached, st := v.cachedBytes(files[i].Inode, files[i].Length)
+		if st != 0 {
+			return nil, st
+		}
+		files[i].Cached = cached
+	}
+	return files, 0
+}
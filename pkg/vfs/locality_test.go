@@ -0,0 +1,60 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+func TestCachedData(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	entry, _ := v.Mkdir(ctx, 1, "local", 0777, 022)
+	fe, fh, _ := v.Create(ctx, entry.Inode, "file", 0644, 0, uint32(os.O_WRONLY))
+	data := make([]byte, 10<<10)
+	_ = v.Write(ctx, fe.Inode, data, 0, fh)
+	_ = v.Flush(ctx, fe.Inode, fh, 0)
+	v.Release(ctx, fe.Inode, fh)
+	v.fillCache([]string{"/local/file"}, 1)
+
+	files, st := v.CachedData("/local/file")
+	if st != 0 || len(files) != 1 {
+		t.Fatalf("cached data of file: %v %s", files, st)
+	}
+	if f := files[0]; f.Inode != fe.Inode || f.Path != "/local/file" || f.Length != 10<<10 || f.Cached != 10<<10 {
+		t.Fatalf("cached data of file: %+v", f)
+	}
+	if files, st = v.CachedData("local"); st != 0 || len(files) != 1 || files[0].Path != "/local/file" {
+		t.Fatalf("cached data of dir: %v %s", files, st)
+	}
+
+	var slices []meta.Slice
+	_ = v.Meta.Read(meta.Background, fe.Inode, 0, &slices)
+	for _, s := range slices {
+		_ = v.Store.Remove(s.Chunkid, int(s.Size))
+	}
+	if files, st = v.CachedData("/local/file"); st != 0 || files[0].Cached != 0 {
+		t.Fatalf("cached data of removed file: %v %s", files, st)
+	}
+	if _, st = v.CachedData("/local/none"); st != syscall.ENOENT {
+		t.Fatalf("cached data of missing file: %s", st)
+	}
+}
@@ -183,7 +183,7 @@ func (s *sliceReader) run() {
 		f.tried++
 		trycnt := f.tried
 		if trycnt >= f.r.maxRetries {
-			s.done(syscall.EIO, 0)
+			s.done(err, 0)
 		} else {
 			s.done(0, retry_time(trycnt))
 		}
@@ -202,9 +202,8 @@ func (s *sliceReader) run() {
 
 	p := s.page.Slice(0, int(need))
 	defer p.Release()
-	var n int
 	ctx := context.TODO()
-	n = f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
+	n, rerr := f.r.Read(ctx, p, chunks, (uint32(s.block.off))%meta.ChunkSize)
 
 	f.Lock()
 	if s.state != BUSY || f.shouldStop() {
@@ -219,6 +218,9 @@ func (s *sliceReader) run() {
 	} else {
 		s.currentPos = 0 // start again from beginning
 		err = syscall.EIO
+		if rerr != nil {
+			err = utils.Errno(rerr)
+		}
 		f.tried++
 		_ = f.r.m.InvalidateChunkCache(meta.Background, inode, indx)
 		if f.tried >= f.r.maxRetries {
@@ -806,7 +808,7 @@ func (r *dataReader) readSlice(ctx context.Context, s *meta.Slice, page *chunk.P
 	return nil
 }
 
-func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
+func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) (int, error) {
 	if len(chunks) > 16 {
 		return r.readManyChunks(ctx, page, chunks, offset)
 	}
@@ -842,12 +844,12 @@ func (r *dataReader) Read(ctx context.Context, page *chunk.Page, chunks []meta.S
 		waits--
 	}
 	if err != nil {
-		return 0
+		return 0, err
 	}
-	return read
+	return read, nil
 }
 
-func (r *dataReader) readManyChunks(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) int {
+func (r *dataReader) readManyChunks(ctx context.Context, page *chunk.Page, chunks []meta.Slice, offset uint32) (int, error) {
 	read := 0
 	var pos uint32
 	var err error
@@ -894,11 +896,11 @@ CHUNKS:
 		waits--
 	}
 	if err != nil {
-		return 0
+		return 0, err
 	}
 	for read < size {
 		buf[read] = 0
 		read++
 	}
-	return read
+	return read, nil
 }
@@ -0,0 +1,137 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	"github.com/juicedata/juicefs/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// max number of blocks verified in every round of scrub
+const scrubBlocks = 100
+
+var (
+	scrubbedBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "scrubbed_blocks",
+		Help: "The number of blocks verified by scrub.",
+	})
+	scrubBadBlocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "scrub_bad_blocks",
+		Help: "The number of missing or corrupted blocks found by scrub.",
+	}, []string{"class"})
+)
+
+type badBlock struct {
+	inode Ino
+	key   string
+	err   error
+}
+
+// blockScrubber walks through all the files in rounds, and resumes from where the last round stopped,
+// so every block referenced is verified once in a while.
+type blockScrubber struct {
+	v       *VFS
+	cursor  string        // cursor of Find to scan the next entries
+	last    bool          // the last batch of a pass is found
+	pending []*meta.Entry // files found but not verified yet
+	indx    uint32        // index of the next chunk in the first pending file
+}
+
+// Scrub verifies the blocks of a rotating subset of files against the object storage periodically,
+// and reports the missing or corrupted ones as metrics and logs, so silent data loss is detected
+// before it's read. The interval is randomized by up to 20%, so the clients don't scrub all at once.
+func (v *VFS) Scrub(interval time.Duration) {
+	s := &blockScrubber{v: v}
+	for {
+		time.Sleep(interval + time.Duration(rand.Int63n(int64(interval)/5+1)) - interval/10)
+		for _, b := range s.scrub(scrubBlocks) {
+			logger.Warnf("Scrub found bad block %s of inode %d: %s", b.key, b.inode, b.err)
+		}
+	}
+}
+
+// scrub verifies about n blocks from where it stopped last time, and returns the bad ones. The errors
+// caused by network or timeout are not reported, the blocks will be verified again in the next pass.
+func (s *blockScrubber) scrub(n int) []*badBlock {
+	ctx := meta.Background
+	var bad []*badBlock
+	var verified int
+	for verified < n {
+		if len(s.pending) == 0 {
+			if !s.next(ctx) {
+				break
+			}
+			continue
+		}
+		e := s.pending[0]
+		if uint64(s.indx)*meta.ChunkSize >= e.Attr.Length {
+			s.pending, s.indx = s.pending[1:], 0
+			continue
+		}
+		var slices []meta.Slice
+		if st := s.v.Meta.Read(ctx, e.Inode, s.indx, &slices); st != 0 {
+			logger.Debugf("scrub: read inode %d chunk %d: %s", e.Inode, s.indx, st)
+			s.pending, s.indx = s.pending[1:], 0 // it could be removed
+			continue
+		}
+		s.indx++
+		for _, sl := range slices {
+			if sl.Chunkid == 0 {
+				continue
+			}
+			blocks := int(sl.Size-1)/s.v.Conf.Chunk.BlockSize + 1
+			verified += blocks
+			scrubbedBlocks.Add(float64(blocks))
+			for key, err := range s.v.Store.VerifyBlocks(sl.Chunkid, sl.Size) {
+				class := utils.ClassOf(err)
+				if class == utils.ErrNetwork || class == utils.ErrTimeout {
+					logger.Debugf("scrub: verify block %s: %s", key, err)
+					continue
+				}
+				scrubBadBlocks.WithLabelValues(string(class)).Inc()
+				bad = append(bad, &badBlock{e.Inode, key, err})
+			}
+		}
+	}
+	return bad
+}
+
+// next finds the next batch of files, it returns false when a pass is finished, so the next round
+// starts over from the beginning.
+func (s *blockScrubber) next(ctx meta.Context) bool {
+	if s.last {
+		s.last = false
+		return false
+	}
+	var entries []*meta.Entry
+	if st := s.v.Meta.Find(ctx, &meta.FindFilter{}, &s.cursor, 1000, &entries); st != 0 {
+		logger.Warnf("scrub: find files: %s", st)
+		s.cursor = ""
+		return false
+	}
+	for _, e := range entries {
+		if e.Attr.Typ == meta.TypeFile && e.Attr.Length > 0 {
+			s.pending = append(s.pending, e)
+		}
+	}
+	s.last = s.cursor == ""
+	return true
+}
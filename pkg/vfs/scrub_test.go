@@ -0,0 +1,83 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+	osync "github.com/juicedata/juicefs/pkg/sync"
+)
+
+func TestScrub(t *testing.T) {
+	v, blob := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	data := bytes.Repeat([]byte("x"), 10<<10)
+	for i := 0; i < 3; i++ {
+		fe, fh, e := v.Create(ctx, 1, fmt.Sprintf("f%d", i), 0644, 0, syscall.O_RDWR)
+		if e != 0 {
+			t.Fatalf("create f%d: %s", i, e)
+		}
+		if e = v.Write(ctx, fe.Inode, data, 0, fh); e != 0 {
+			t.Fatalf("write f%d: %s", i, e)
+		}
+		if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+			t.Fatalf("flush f%d: %s", i, e)
+		}
+		v.Release(ctx, fe.Inode, fh)
+	}
+
+	s := &blockScrubber{v: v}
+	if bad := s.scrub(100); len(bad) != 0 {
+		t.Fatalf("scrub healthy files: %+v", bad)
+	}
+
+	ch, err := osync.ListAll(blob, "chunks/", "")
+	if err != nil {
+		t.Fatalf("list blocks: %s", err)
+	}
+	var keys []string
+	for o := range ch {
+		keys = append(keys, o.Key())
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expect 3 blocks, got %d", len(keys))
+	}
+	sort.Strings(keys)
+	if err = blob.Delete(keys[0]); err != nil {
+		t.Fatalf("delete %s: %s", keys[0], err)
+	}
+	if err = blob.Put(keys[2], bytes.NewReader([]byte("broken"))); err != nil {
+		t.Fatalf("put %s: %s", keys[2], err)
+	}
+
+	// one block in every round, the broken ones are found in one pass
+	var found []string
+	for i := 0; i < 4; i++ {
+		for _, b := range s.scrub(1) {
+			found = append(found, b.key)
+		}
+	}
+	sort.Strings(found)
+	if len(found) != 2 || found[0] != keys[0] || found[1] != keys[2] {
+		t.Fatalf("expect bad blocks %s and %s, got %v", keys[0], keys[2], found)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * JuiceFS, Copyright 2022 Juicedata, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package vfs
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/juicedata/juicefs/pkg/meta"
+)
+
+const timestampMask = meta.SetAttrAtime | meta.SetAttrMtime | meta.SetAttrAtimeNow | meta.SetAttrMtimeNow
+
+type pendingTime struct {
+	set  uint16
+	attr Attr
+}
+
+// timeBatch defers the updates of timestamps, coalesces them per inode
+// and writes them into the meta engine periodically.
+type timeBatch struct {
+	sync.Mutex
+	m       meta.Meta
+	pending map[Ino]*pendingTime
+}
+
+func newTimeBatch(m meta.Meta, interval time.Duration) *timeBatch {
+	b := &timeBatch{m: m, pending: make(map[Ino]*pendingTime)}
+	go func() {
+		for {
+			time.Sleep(interval)
+			b.flushAll()
+		}
+	}()
+	return b
+}
+
+// isTimestampOnly returns true if only atime/mtime are changed.
+func isTimestampOnly(set uint16) bool {
+	return set != 0 && set&^timestampMask == 0
+}
+
+func (b *timeBatch) add(ino Ino, set uint16, attr *Attr) {
+	now := time.Now()
+	if set&meta.SetAttrAtimeNow != 0 {
+		attr.Atime = now.Unix()
+		attr.Atimensec = uint32(now.Nanosecond())
+		set = set&^meta.SetAttrAtimeNow | meta.SetAttrAtime
+	}
+	if set&meta.SetAttrMtimeNow != 0 {
+		attr.Mtime = now.Unix()
+		attr.Mtimensec = uint32(now.Nanosecond())
+		set = set&^meta.SetAttrMtimeNow | meta.SetAttrMtime
+	}
+	b.Lock()
+	defer b.Unlock()
+	p := b.pending[ino]
+	if p == nil {
+		p = &pendingTime{}
+		b.pending[ino] = p
+	}
+	p.set |= set
+	if set&meta.SetAttrAtime != 0 {
+		p.attr.Atime = attr.Atime
+		p.attr.Atimensec = attr.Atimensec
+	}
+	if set&meta.SetAttrMtime != 0 {
+		p.attr.Mtime = attr.Mtime
+		p.attr.Mtimensec = attr.Mtimensec
+	}
+}
+
+// checkTimesPermission checks the permission to change the timestamps before they are deferred, because
+// they are written later by the client itself. Only the owner can set them to a specified time, and writers
+// can also set them to now.
+func (v *VFS) checkTimesPermission(ctx Context, ino Ino, set uint16, attr *Attr) syscall.Errno {
+	if attr.Flags&(meta.FlagImmutable|meta.FlagAppend) != 0 {
+		return syscall.EPERM
+	}
+	if ctx.Uid() == 0 || ctx.Uid() == attr.Uid {
+		return 0
+	}
+	if set&(meta.SetAttrAtime|meta.SetAttrMtime) != 0 {
+		return syscall.EPERM
+	}
+	return v.Meta.Access(ctx, ino, MODE_MASK_W, attr)
+}
+
+// update applies the pending timestamps of an inode to attr.
+func (b *timeBatch) update(ino Ino, attr *Attr) {
+	b.Lock()
+	defer b.Unlock()
+	p := b.pending[ino]
+	if p == nil {
+		return
+	}
+	if p.set&meta.SetAttrAtime != 0 {
+		attr.Atime = p.attr.Atime
+		attr.Atimensec = p.attr.Atimensec
+	}
+	if p.set&meta.SetAttrMtime != 0 {
+		attr.Mtime = p.attr.Mtime
+		attr.Mtimensec = p.attr.Mtimensec
+	}
+}
+
+func (b *timeBatch) flush(ctx meta.Context, ino Ino) syscall.Errno {
+	b.Lock()
+	p := b.pending[ino]
+	delete(b.pending, ino)
+	b.Unlock()
+	if p == nil {
+		return 0
+	}
+	return b.m.SetAttr(ctx, ino, p.set, 0, &p.attr)
+}
+
+// flushTimes writes the pending timestamps of an inode before it's modified, so they don't overwrite
+// the ones changed by the modification.
+func (v *VFS) flushTimes(ctx Context, ino Ino) syscall.Errno {
+	if v.times == nil {
+		return 0
+	}
+	return v.times.flush(ctx, ino)
+}
+
+func (b *timeBatch) flushAll() {
+	b.Lock()
+	pending := b.pending
+	b.pending = make(map[Ino]*pendingTime)
+	b.Unlock()
+	for ino, p := range pending {
+		if st := b.m.SetAttr(meta.Background, ino, p.set, 0, &p.attr); st != 0 && st != syscall.ENOENT {
+			logger.Warnf("update timestamps of inode %d: %s", ino, st)
+		}
+	}
+}
@@ -52,6 +52,12 @@ type Config struct {
 	FastResolve     bool   `json:",omitempty"`
 	AccessLog       string `json:",omitempty"`
 	HideInternal    bool
+	OrderedAppend   bool          `json:",omitempty"` // reserve the range in meta for writes to files opened with O_APPEND
+	OpTimeout       time.Duration `json:",omitempty"` // cancel the FUSE operations running longer than it, 0 means unlimited
+
+	TimestampGranularity time.Duration `json:",omitempty"`
+
+	ObjectFaults *utils.FaultInjector `json:"-"` // inject faults into requests to object storage, for testing
 }
 
 var (
@@ -87,6 +93,9 @@ func (v *VFS) Lookup(ctx Context, parent Ino, name string) (entry *meta.Entry, e
 	err = v.Meta.Lookup(ctx, parent, name, &inode, attr)
 	if err == 0 {
 		v.UpdateLength(inode, attr)
+		if v.times != nil {
+			v.times.update(inode, attr)
+		}
 		entry = &meta.Entry{Inode: inode, Attr: attr}
 	}
 	return
@@ -103,6 +112,9 @@ func (v *VFS) GetAttr(ctx Context, ino Ino, opened uint8) (entry *meta.Entry, er
 	err = v.Meta.GetAttr(ctx, ino, attr)
 	if err == 0 {
 		v.UpdateLength(ino, attr)
+		if v.times != nil {
+			v.times.update(ino, attr)
+		}
 		entry = &meta.Entry{Inode: ino, Attr: attr}
 	}
 	return
@@ -132,6 +144,10 @@ func (v *VFS) Mknod(ctx Context, parent Ino, name string, mode uint16, cumask ui
 	defer func() {
 		logit(ctx, "mknod (%d,%s,%s:0%04o,0x%08X): %s%s", parent, name, smode(mode), mode, rdev, strerr(err), (*Entry)(entry))
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if parent == rootID && IsSpecialName(name) {
 		err = syscall.EEXIST
 		return
@@ -157,6 +173,10 @@ func (v *VFS) Mknod(ctx Context, parent Ino, name string, mode uint16, cumask ui
 
 func (v *VFS) Unlink(ctx Context, parent Ino, name string) (err syscall.Errno) {
 	defer func() { logit(ctx, "unlink (%d,%s): %s", parent, name, strerr(err)) }()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if parent == rootID && IsSpecialName(name) {
 		err = syscall.EPERM
 		return
@@ -173,6 +193,10 @@ func (v *VFS) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask ui
 	defer func() {
 		logit(ctx, "mkdir (%d,%s,%s:0%04o): %s%s", parent, name, smode(mode), mode, strerr(err), (*Entry)(entry))
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if parent == rootID && IsSpecialName(name) {
 		err = syscall.EEXIST
 		return
@@ -193,6 +217,10 @@ func (v *VFS) Mkdir(ctx Context, parent Ino, name string, mode uint16, cumask ui
 
 func (v *VFS) Rmdir(ctx Context, parent Ino, name string) (err syscall.Errno) {
 	defer func() { logit(ctx, "rmdir (%d,%s): %s", parent, name, strerr(err)) }()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if len(name) > maxName {
 		err = syscall.ENAMETOOLONG
 		return
@@ -205,6 +233,10 @@ func (v *VFS) Symlink(ctx Context, path string, parent Ino, name string) (entry
 	defer func() {
 		logit(ctx, "symlink (%d,%s,%s): %s%s", parent, name, path, strerr(err), (*Entry)(entry))
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if parent == rootID && IsSpecialName(name) {
 		err = syscall.EEXIST
 		return
@@ -233,6 +265,10 @@ func (v *VFS) Rename(ctx Context, parent Ino, name string, newparent Ino, newnam
 	defer func() {
 		logit(ctx, "rename (%d,%s,%d,%s,%d): %s", parent, name, newparent, newname, flags, strerr(err))
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if parent == rootID && IsSpecialName(name) {
 		err = syscall.EPERM
 		return
@@ -254,6 +290,10 @@ func (v *VFS) Link(ctx Context, ino Ino, newparent Ino, newname string) (entry *
 	defer func() {
 		logit(ctx, "link (%d,%d,%s): %s%s", ino, newparent, newname, strerr(err), (*Entry)(entry))
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if IsSpecialNode(ino) {
 		err = syscall.EPERM
 		return
@@ -302,17 +342,19 @@ func (v *VFS) Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plu
 	h.Lock()
 	defer h.Unlock()
 
-	if h.children == nil || off == 0 {
-		var inodes []*meta.Entry
-		err = v.Meta.Readdir(ctx, ino, 1, &inodes)
-		if err == syscall.EACCES {
-			err = v.Meta.Readdir(ctx, ino, 0, &inodes)
-		}
-		if err != 0 {
+	if off == 0 || off < h.childOff {
+		h.children, h.childOff, h.cursor, h.listed = nil, 0, "", false
+	}
+	// only one page of entries is kept in handle, so it will not take too much memory for big directory
+	for off >= h.childOff+len(h.children) && !h.listed {
+		var page []*meta.Entry
+		if err = v.Meta.ReaddirAt(ctx, ino, 0, &h.cursor, readdirPage, &page); err != 0 {
 			return
 		}
-		h.children = inodes
-		if ino == rootID && !v.Conf.HideInternal {
+		h.childOff += len(h.children)
+		h.children = page
+		h.listed = h.cursor == ""
+		if h.listed && ino == rootID && !v.Conf.HideInternal {
 			// add internal nodes
 			for _, node := range internalNodes {
 				h.children = append(h.children, &meta.Entry{
@@ -323,12 +365,39 @@ func (v *VFS) Readdir(ctx Context, ino Ino, size uint32, off int, fh uint64, plu
 			}
 		}
 	}
-	if off < len(h.children) {
-		entries = h.children[off:]
+	if off-h.childOff < len(h.children) {
+		entries = h.children[off-h.childOff:]
+	}
+	if plus {
+		v.fillAttrs(ctx, ino, entries)
 	}
 	return
 }
 
+// the number of entries to list from meta at a time
+const readdirPage = 10000
+
+// the number of entries to fetch attributes ahead for readdirplus
+const readdirLookahead = 1024
+
+// fillAttrs fetches attributes for the next window of entries in one batch,
+// errors are ignored since the kernel will lookup the entries without attributes.
+func (v *VFS) fillAttrs(ctx Context, ino Ino, entries []*meta.Entry) {
+	if len(entries) > readdirLookahead {
+		entries = entries[:readdirLookahead]
+	}
+	var missing []*meta.Entry
+	for _, e := range entries {
+		if e.Attr.Full || len(e.Name) <= 2 && (string(e.Name) == "." || string(e.Name) == "..") {
+			continue
+		}
+		missing = append(missing, e)
+	}
+	if st := v.Meta.FillAttrs(ctx, missing); st != 0 {
+		logger.Debugf("fill attributes of entries in %d: %s", ino, st)
+	}
+}
+
 func (v *VFS) Releasedir(ctx Context, ino Ino, fh uint64) int {
 	h := v.findHandle(ino, fh)
 	if h == nil {
@@ -343,6 +412,10 @@ func (v *VFS) Create(ctx Context, parent Ino, name string, mode uint16, cumask u
 	defer func() {
 		logit(ctx, "create (%d,%s,%s:0%04o): %s%s [fh:%d]", parent, name, smode(mode), mode, strerr(err), (*Entry)(entry), fh)
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if parent == rootID && IsSpecialName(name) {
 		err = syscall.EEXIST
 		return
@@ -378,6 +451,8 @@ func (v *VFS) Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh ui
 		switch ino {
 		case logInode:
 			openAccessLog(fh)
+		case blockInode:
+			openBlockLog(fh)
 		case statsInode:
 			h.data = collectMetrics()
 		case configInode:
@@ -400,6 +475,7 @@ func (v *VFS) Open(ctx Context, ino Ino, flags uint32) (entry *meta.Entry, fh ui
 		v.UpdateLength(ino, attr)
 		fh = v.newFileHandle(ino, attr.Length, flags)
 		entry = &meta.Entry{Inode: ino, Attr: attr}
+		v.heat.access(ino)
 	}
 	return
 }
@@ -418,6 +494,9 @@ func (v *VFS) Truncate(ctx Context, ino Ino, size int64, opened uint8, attr *Att
 		err = syscall.EFBIG
 		return
 	}
+	if err = v.flushTimes(ctx, ino); err != 0 {
+		return
+	}
 	hs := v.findAllHandles(ino)
 	for _, h := range hs {
 		if !h.Wlock(ctx) {
@@ -441,7 +520,7 @@ func (v *VFS) ReleaseHandler(ino Ino, fh uint64) {
 
 func (v *VFS) Release(ctx Context, ino Ino, fh uint64) {
 	if IsSpecialNode(ino) {
-		if ino == logInode {
+		if ino == logInode || ino == blockInode {
 			closeAccessLog(fh)
 		}
 		v.releaseHandle(ino, fh)
@@ -449,30 +528,33 @@ func (v *VFS) Release(ctx Context, ino Ino, fh uint64) {
 	}
 	var err syscall.Errno
 	defer func() { logit(ctx, "release (%d): %s", ino, strerr(err)) }()
+	// a release can't fail: the handle, locks and the opened inode would be leaked if it's interrupted
+	// or timed out, so it waits until thawed and ignores the cancellation of ctx
+	bg := meta.Background
+	_ = v.freezer.enter(bg)
+	defer v.freezer.leave()
 	if fh > 0 {
 		f := v.findHandle(ino, fh)
 		if f != nil {
 			f.Lock()
 			// rwlock_wait_for_unlock:
 			for (f.writing | f.writers | f.readers) != 0 {
-				if f.cond.WaitWithTimeout(time.Second) && ctx.Canceled() {
-					f.Unlock()
-					logger.Warnf("write lock %d interrupted", f.inode)
-					err = syscall.EINTR
-					return
-				}
+				f.cond.WaitWithTimeout(time.Second)
 			}
 			locks := f.locks
 			owner := f.flockOwner
 			f.Unlock()
 			if f.writer != nil {
-				_ = f.writer.Flush(ctx)
+				_ = f.writer.Flush(bg)
 			}
 			if locks&1 != 0 {
-				_ = v.Meta.Flock(ctx, ino, owner, F_UNLCK, false)
+				_ = v.Meta.Flock(bg, ino, owner, F_UNLCK, false)
 			}
 		}
-		_ = v.Meta.Close(ctx, ino)
+		if v.times != nil {
+			_ = v.times.flush(bg, ino)
+		}
+		_ = v.Meta.Close(bg, ino)
 		go v.releaseFileHandle(ino, fh) // after writes it waits for data sync, so do it after everything
 	}
 }
@@ -480,7 +562,7 @@ func (v *VFS) Release(ctx Context, ino Ino, fh uint64) {
 func (v *VFS) Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n int, err syscall.Errno) {
 	size := uint32(len(buf))
 	if IsSpecialNode(ino) {
-		if ino == logInode {
+		if ino == logInode || ino == blockInode {
 			n = readAccessLog(fh, buf)
 		} else {
 			h := v.findHandle(ino, fh)
@@ -541,6 +623,9 @@ func (v *VFS) Read(ctx Context, ino Ino, buf []byte, off uint64, fh uint64) (n i
 	if err == syscall.ENOENT {
 		err = syscall.EBADF
 	}
+	if err == 0 {
+		_ = v.Meta.TouchAtime(ctx, ino)
+	}
 	h.removeOp(ctx)
 	return
 }
@@ -582,13 +667,33 @@ func (v *VFS) Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err sysca
 		err = syscall.EACCES
 		return
 	}
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 
+	if err = v.flushTimes(ctx, ino); err != 0 {
+		return
+	}
 	if !h.Wlock(ctx) {
 		err = syscall.EINTR
 		return
 	}
 	defer h.Wunlock()
 
+	if h.append {
+		// the kernel picks the offset from the length it knows, which could be stale if the file
+		// is appended by other clients, so the range is reserved at the end of file in meta instead
+		if err = v.Meta.Reserve(ctx, ino, size, &off); err != 0 {
+			h.removeOp(ctx)
+			return
+		}
+		if off+size >= maxFileSize {
+			h.removeOp(ctx)
+			err = syscall.EFBIG
+			return
+		}
+	}
 	err = h.writer.Write(ctx, off, buf)
 	if err == syscall.ENOENT || err == syscall.EPERM || err == syscall.EINVAL {
 		err = syscall.EBADF
@@ -604,6 +709,10 @@ func (v *VFS) Write(ctx Context, ino Ino, buf []byte, off, fh uint64) (err sysca
 
 func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh uint64) (err syscall.Errno) {
 	defer func() { logit(ctx, "fallocate (%d,%d,%d,%d): %s", ino, mode, off, length, strerr(err)) }()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if off < 0 || length <= 0 {
 		err = syscall.EINVAL
 		return
@@ -632,7 +741,45 @@ func (v *VFS) Fallocate(ctx Context, ino Ino, mode uint8, off, length int64, fh
 	defer h.Wunlock()
 	defer h.removeOp(ctx)
 
+	// the buffered data should not be written over the hole
+	err = v.writer.Flush(ctx, ino)
+	if err != 0 {
+		return
+	}
+	if err = v.flushTimes(ctx, ino); err != 0 {
+		return
+	}
 	err = v.Meta.Fallocate(ctx, ino, mode, uint64(off), uint64(length))
+	if err == 0 {
+		v.reader.Invalidate(ino, uint64(off), uint64(length))
+	}
+	return
+}
+
+// ChangeFlags adds and removes the flags (meta.FlagImmutable and meta.FlagAppend) of an inode, and returns the new flags.
+func (v *VFS) ChangeFlags(ctx Context, ino Ino, add, remove uint8) (flags uint8, err syscall.Errno) {
+	defer func() { logit(ctx, "chattr (%d,+%d,-%d): %d %s", ino, add, remove, flags, strerr(err)) }()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
+	if IsSpecialNode(ino) {
+		err = syscall.EPERM
+		return
+	}
+	if (add|remove)&^(meta.FlagImmutable|meta.FlagAppend) != 0 {
+		err = syscall.ENOTSUP
+		return
+	}
+	var attr Attr
+	if err = v.Meta.GetAttr(ctx, ino, &attr); err != 0 {
+		return
+	}
+	flags = attr.Flags&^remove | add
+	if flags != attr.Flags {
+		attr.Flags = flags
+		err = v.Meta.SetAttr(ctx, ino, meta.SetAttrFlag, 0, &attr)
+	}
 	return
 }
 
@@ -640,6 +787,10 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 	defer func() {
 		logit(ctx, "copy_file_range (%d,%d,%d,%d,%d,%d): %s", nodeIn, offIn, nodeOut, offOut, size, flags, strerr(err))
 	}()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if IsSpecialNode(nodeIn) {
 		err = syscall.ENOTSUP
 		return
@@ -698,6 +849,9 @@ func (v *VFS) CopyFileRange(ctx Context, nodeIn Ino, fhIn, offIn uint64, nodeOut
 	if err != 0 {
 		return
 	}
+	if err = v.flushTimes(ctx, nodeOut); err != 0 {
+		return
+	}
 	err = v.Meta.CopyFileRange(ctx, nodeIn, offIn, nodeOut, offOut, size, flags, &copied)
 	if err == 0 {
 		v.reader.Invalidate(nodeOut, offOut, size)
@@ -769,6 +923,9 @@ func (v *VFS) Fsync(ctx Context, ino Ino, datasync int, fh uint64) (err syscall.
 		return
 	}
 	err = v.doFsync(ctx, h)
+	if err == 0 && v.times != nil {
+		err = v.times.flush(ctx, ino)
+	}
 	return
 }
 
@@ -779,6 +936,10 @@ const (
 
 func (v *VFS) SetXattr(ctx Context, ino Ino, name string, value []byte, flags uint32) (err syscall.Errno) {
 	defer func() { logit(ctx, "setxattr (%d,%s,%d,%d): %s", ino, name, len(value), flags, strerr(err)) }()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if IsSpecialNode(ino) {
 		err = syscall.EPERM
 		return
@@ -856,6 +1017,10 @@ func (v *VFS) ListXattr(ctx Context, ino Ino, size int) (data []byte, err syscal
 
 func (v *VFS) RemoveXattr(ctx Context, ino Ino, name string) (err syscall.Errno) {
 	defer func() { logit(ctx, "removexattr (%d,%s): %s", ino, name, strerr(err)) }()
+	if err = v.freezer.enter(ctx); err != 0 {
+		return
+	}
+	defer v.freezer.leave()
 	if IsSpecialNode(ino) {
 		err = syscall.EPERM
 		return
@@ -891,6 +1056,9 @@ type VFS struct {
 	handles map[Ino][]*handle
 	hanleM  sync.Mutex
 	nextfh  uint64
+	times   *timeBatch
+	heat    *heatMap
+	freezer freezer
 
 	handlersGause  prometheus.GaugeFunc
 	usedBufferSize prometheus.GaugeFunc
@@ -909,6 +1077,19 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore) *VFS {
 		writer:  writer,
 		handles: make(map[Ino][]*handle),
 		nextfh:  1,
+		heat:    newHeatMap(),
+	}
+
+	store.SetTracer(traceBlock)
+	store.SetSliceChecker(func(ids []uint64) (map[uint64]bool, error) {
+		used, st := m.UsedSlices(meta.Background, ids)
+		if st != 0 {
+			return nil, st
+		}
+		return used, nil
+	})
+	if conf.TimestampGranularity > 0 {
+		v.times = newTimeBatch(m, conf.TimestampGranularity)
 	}
 
 	if conf.Meta.Subdir != "" { // don't show trash directory
@@ -947,9 +1128,22 @@ func NewVFS(conf *Config, m meta.Meta, store chunk.ChunkStore) *VFS {
 	return v
 }
 
+// Reader returns the reader of data, which can be shared with other interfaces to the same files.
+func (v *VFS) Reader() DataReader {
+	return v.reader
+}
+
+// Writer returns the writer of data, which can be shared with other interfaces to the same files.
+func (v *VFS) Writer() DataWriter {
+	return v.writer
+}
+
 func InitMetrics() {
 	prometheus.MustRegister(readSizeHistogram)
 	prometheus.MustRegister(writtenSizeHistogram)
 	prometheus.MustRegister(opsDurationsHistogram)
 	prometheus.MustRegister(compactSizeHistogram)
+	prometheus.MustRegister(utils.ErrorCounter)
+	prometheus.MustRegister(scrubbedBlocks)
+	prometheus.MustRegister(scrubBadBlocks)
 }
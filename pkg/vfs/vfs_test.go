@@ -19,6 +19,7 @@ package vfs
 import (
 	"fmt"
 	"log"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"syscall"
@@ -124,6 +125,17 @@ func TestVFSBasic(t *testing.T) {
 	if fe, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || fe.Attr.Nlink != 2 {
 		t.Fatalf("getattr d1/f2: %s %d", e, fe.Attr.Nlink)
 	}
+	dh, _ := v.Opendir(ctx, 1)
+	if entries, e := v.Readdir(ctx, 1, 1024, 0, dh, true); e != 0 {
+		t.Fatalf("readdirplus 1: %s", e)
+	} else {
+		for _, e := range entries {
+			if string(e.Name) == "f2" && (!e.Attr.Full || e.Attr.Mode != 0755) {
+				t.Fatalf("attr of f2 is not filled: %+v", e.Attr)
+			}
+		}
+	}
+	v.Releasedir(ctx, 1, dh)
 	if e := v.Unlink(ctx, de.Inode, "f1"); e != 0 {
 		t.Fatalf("unlink d1/f1: %s", e)
 	}
@@ -582,6 +594,98 @@ func TestVFSLocks(t *testing.T) {
 	}
 }
 
+func TestVFSFlags(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "chattr", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create chattr: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	var arg uint64 = FS_IMMUTABLE_FL
+	if e = v.Ioctl(ctx, fe.Inode, FS_IOC_SETFLAGS, &arg); e != 0 {
+		t.Fatalf("set immutable: %s", e)
+	}
+	arg = 0
+	if e = v.Ioctl(ctx, fe.Inode, FS_IOC_GETFLAGS, &arg); e != 0 || arg != FS_IMMUTABLE_FL {
+		t.Fatalf("get flags: %s, 0x%X", e, arg)
+	}
+	if _, _, e = v.Open(ctx, fe.Inode, syscall.O_WRONLY); e != syscall.EPERM {
+		t.Fatalf("open immutable file for write: %s", e)
+	}
+	if e = v.Unlink(ctx, 1, "chattr"); e != syscall.EPERM {
+		t.Fatalf("unlink immutable file: %s", e)
+	}
+	arg = FS_APPEND_FL | 0x80 // FS_NOATIME_FL is not supported
+	if e = v.Ioctl(ctx, fe.Inode, FS_IOC_SETFLAGS, &arg); e != syscall.ENOTSUP {
+		t.Fatalf("set unsupported flags: %s", e)
+	}
+	arg = FS_APPEND_FL
+	if e = v.Ioctl(ctx, fe.Inode, FS_IOC32_SETFLAGS, &arg); e != 0 {
+		t.Fatalf("set append-only: %s", e)
+	}
+	if _, _, e = v.Open(ctx, fe.Inode, syscall.O_WRONLY); e != syscall.EPERM {
+		t.Fatalf("open append-only file without O_APPEND: %s", e)
+	}
+	if _, fh, e = v.Open(ctx, fe.Inode, syscall.O_WRONLY|syscall.O_APPEND); e != 0 {
+		t.Fatalf("open append-only file with O_APPEND: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	if flags, e := v.ChangeFlags(ctx, fe.Inode, 0, meta.FlagAppend); e != 0 || flags != 0 {
+		t.Fatalf("clear flags: %s, %d", e, flags)
+	}
+	if e = v.Unlink(ctx, 1, "chattr"); e != 0 {
+		t.Fatalf("unlink chattr: %s", e)
+	}
+	if e = v.Ioctl(ctx, 1, 0x5401, &arg); e != syscall.ENOTTY {
+		t.Fatalf("unknown ioctl: %s", e)
+	}
+}
+
+func TestOrderedAppend(t *testing.T) {
+	v, blob := createTestVFS()
+	v.Conf.OrderedAppend = true
+	// another client of the same volume
+	v2 := NewVFS(v.Conf, v.Meta, chunk.NewCachedStore(blob, *v.Conf.Chunk))
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "log", 0644, 0, syscall.O_WRONLY|syscall.O_APPEND)
+	if e != 0 {
+		t.Fatalf("create log: %s", e)
+	}
+	_, fh2, e := v2.Open(ctx, fe.Inode, syscall.O_WRONLY|syscall.O_APPEND)
+	if e != 0 {
+		t.Fatalf("open log: %s", e)
+	}
+	// the offsets given by kernel are stale
+	if e = v.Write(ctx, fe.Inode, []byte("aaa"), 0, fh); e != 0 {
+		t.Fatalf("write log: %s", e)
+	}
+	if e = v2.Write(ctx, fe.Inode, []byte("bbb"), 0, fh2); e != 0 {
+		t.Fatalf("write log: %s", e)
+	}
+	if e = v.Write(ctx, fe.Inode, []byte("ccc"), 3, fh); e != 0 {
+		t.Fatalf("write log: %s", e)
+	}
+	if e = v.Flush(ctx, fe.Inode, fh, 0); e != 0 {
+		t.Fatalf("flush log: %s", e)
+	}
+	if e = v2.Flush(ctx, fe.Inode, fh2, 0); e != 0 {
+		t.Fatalf("flush log: %s", e)
+	}
+	v.Release(ctx, fe.Inode, fh)
+	v2.Release(ctx, fe.Inode, fh2)
+
+	_, fh, e = v.Open(ctx, fe.Inode, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("open log: %s", e)
+	}
+	defer v.Release(ctx, fe.Inode, fh)
+	buf := make([]byte, 20)
+	if n, e := v.Read(ctx, fe.Inode, buf, 0, fh); e != 0 || string(buf[:n]) != "aaabbbccc" {
+		t.Fatalf("read log: %s %q", e, buf[:n])
+	}
+}
+
 func TestInternalFile(t *testing.T) {
 	v, _ := createTestVFS()
 	ctx := NewLogContext(meta.Background)
@@ -597,8 +701,8 @@ func TestInternalFile(t *testing.T) {
 			internalFiles[string(e.Name)] = true
 		}
 	}
-	if len(internalFiles) != 4 {
-		t.Fatalf("there should be 4 internal files but got %d", len(internalFiles))
+	if len(internalFiles) != 5 {
+		t.Fatalf("there should be 5 internal files but got %d", len(internalFiles))
 	}
 	v.Releasedir(ctx, 1, fh)
 
@@ -776,3 +880,219 @@ func TestInternalFile(t *testing.T) {
 		t.Fatalf("result: %s", string(resp[:n]))
 	}
 }
+
+func TestTimestampBatch(t *testing.T) {
+	v, _ := createTestVFS()
+	v.times = newTimeBatch(v.Meta, time.Hour)
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "times", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create times: %s", e)
+	}
+	if fe2, e := v.SetAttr(ctx, fe.Inode, meta.SetAttrMtime, 0, 0, 0, 0, 0, 1234, 0, 5678, 0); e != 0 || fe2.Attr.Mtime != 1234 {
+		t.Fatalf("setattr mtime: %s", e)
+	}
+	if fe2, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || fe2.Attr.Mtime != 1234 || fe2.Attr.Mtimensec != 5678 {
+		t.Fatalf("getattr: %s %+v", e, fe2.Attr)
+	}
+	var attr meta.Attr
+	if e := v.Meta.GetAttr(ctx, fe.Inode, &attr); e != 0 || attr.Mtime == 1234 {
+		t.Fatalf("mtime should not be updated in meta: %s %d", e, attr.Mtime)
+	}
+	if e := v.Fsync(ctx, fe.Inode, 0, fh); e != 0 {
+		t.Fatalf("fsync: %s", e)
+	}
+	if e := v.Meta.GetAttr(ctx, fe.Inode, &attr); e != 0 || attr.Mtime != 1234 || attr.Mtimensec != 5678 {
+		t.Fatalf("mtime should be updated in meta: %s %d", e, attr.Mtime)
+	}
+
+	// pending timestamps are written before the file is modified
+	if _, e := v.SetAttr(ctx, fe.Inode, meta.SetAttrMtime, 0, 0, 0, 0, 0, 4321, 0, 0, 0); e != 0 {
+		t.Fatalf("setattr mtime: %s", e)
+	}
+	if e := v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write: %s", e)
+	}
+	if e := v.Meta.GetAttr(ctx, fe.Inode, &attr); e != 0 || attr.Mtime != 4321 {
+		t.Fatalf("mtime should be flushed before write: %s %d", e, attr.Mtime)
+	}
+	if _, e := v.SetAttr(ctx, fe.Inode, meta.SetAttrMtime, 0, 0, 0, 0, 0, 5678, 0, 0, 0); e != 0 {
+		t.Fatalf("setattr mtime: %s", e)
+	}
+	if _, e := v.SetAttr(ctx, fe.Inode, meta.SetAttrSize, 0, 0, 0, 0, 0, 0, 0, 0, 1); e != 0 {
+		t.Fatalf("truncate: %s", e)
+	}
+	if fe2, e := v.GetAttr(ctx, fe.Inode, 0); e != 0 || fe2.Attr.Mtime == 5678 {
+		t.Fatalf("mtime should be changed by truncate: %s %d", e, fe2.Attr.Mtime)
+	}
+	v.Release(ctx, fe.Inode, fh)
+
+	// the permission is checked before deferring the update
+	uctx := NewLogContext(meta.NewContext(1, 1000, []uint32{1000}))
+	if _, e := v.SetAttr(uctx, fe.Inode, meta.SetAttrMtime, 0, 0, 0, 0, 0, 1, 0, 0, 0); e != syscall.EPERM {
+		t.Fatalf("setattr mtime by others: %s", e)
+	}
+	if _, e := v.SetAttr(uctx, fe.Inode, meta.SetAttrMtimeNow, 0, 0, 0, 0, 0, 0, 0, 0, 0); e != syscall.EACCES {
+		t.Fatalf("setattr mtime to now by others: %s", e)
+	}
+}
+
+func TestSubdirControl(t *testing.T) {
+	addr := "sqlite3://" + filepath.Join(t.TempDir(), "jfs.db")
+	m := meta.NewClient(addr, &meta.Config{Retries: 10, Strict: true})
+	format := meta.Format{Name: "test", UUID: uuid.New().String(), Storage: "mem", BlockSize: 4096}
+	if err := m.Init(format, true); err != nil {
+		t.Fatalf("setting: %s", err)
+	}
+	ctx := meta.Background
+	var sub, other, inode Ino
+	var attr meta.Attr
+	if st := m.Mkdir(ctx, 1, "sub", 0755, 0, 0, &sub, &attr); st != 0 {
+		t.Fatalf("mkdir sub: %s", st)
+	}
+	if st := m.Mkdir(ctx, sub, "d", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir sub/d: %s", st)
+	}
+	if st := m.Mkdir(ctx, 1, "other", 0755, 0, 0, &other, &attr); st != 0 {
+		t.Fatalf("mkdir other: %s", st)
+	}
+	if st := m.Mkdir(ctx, other, "d", 0755, 0, 0, &inode, &attr); st != 0 {
+		t.Fatalf("mkdir other/d: %s", st)
+	}
+
+	metaConf := &meta.Config{Retries: 10, Strict: true, Subdir: "sub"}
+	m = meta.NewClient(addr, metaConf)
+	conf := &Config{
+		Meta:    metaConf,
+		Format:  &format,
+		Version: "Juicefs",
+		Chunk:   &chunk.Config{BlockSize: format.BlockSize * 1024, MaxUpload: 2, BufferSize: 30 << 20, CacheDir: "memory"},
+	}
+	blob, _ := object.CreateStorage("mem", "", "", "")
+	v := NewVFS(conf, m, chunk.NewCachedStore(blob, *conf.Chunk))
+	rmr := func(parent Ino, name string) syscall.Errno {
+		w := utils.NewBuffer(uint32(8 + 1 + len(name)))
+		w.Put64(uint64(parent))
+		w.Put8(uint8(len(name)))
+		w.Put([]byte(name))
+		return syscall.Errno(v.handleInternalMsg(NewLogContext(ctx), meta.Rmr, utils.ReadBuffer(w.Bytes()))[0])
+	}
+	if st := rmr(other, "d"); st != syscall.ENOENT {
+		t.Fatalf("rmr outside of subdir: %s", st)
+	}
+	if st := m.Lookup(ctx, 1, "..", &inode, &attr); st != 0 || inode != sub {
+		t.Fatalf("lookup ..: %s %d", st, inode)
+	}
+	if st := rmr(1, "d"); st != 0 {
+		t.Fatalf("rmr sub/d: %s", st)
+	}
+	if st := rmr(sub, "d"); st != syscall.ENOENT {
+		t.Fatalf("rmr sub/d again: %s", st)
+	}
+}
+
+// doneContext is a context interrupted by closing done.
+type doneContext struct {
+	meta.Context
+	done chan struct{}
+}
+
+func (c *doneContext) Canceled() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	v, _ := createTestVFS()
+	ctx := NewLogContext(meta.Background)
+	fe, fh, e := v.Create(ctx, 1, "frozen", 0644, 0, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("create frozen: %s", e)
+	}
+	defer v.Release(ctx, fe.Inode, fh)
+	if e = v.Write(ctx, fe.Inode, []byte("hello"), 0, fh); e != 0 {
+		t.Fatalf("write frozen: %s", e)
+	}
+	freeze := func(on uint8) syscall.Errno {
+		w := utils.NewBuffer(9)
+		w.Put8(on)
+		w.Put32(1)
+		w.Put32(0)
+		return syscall.Errno(v.handleInternalMsg(ctx, meta.Freeze, utils.ReadBuffer(w.Bytes()))[0])
+	}
+	if st := freeze(1); st != 0 {
+		t.Fatalf("freeze: %s", st)
+	}
+	if st := freeze(1); st != syscall.EBUSY {
+		t.Fatalf("freeze again: %s", st)
+	}
+	// the buffered data is flushed
+	var slices []meta.Slice
+	if st := v.Meta.Read(ctx, fe.Inode, 0, &slices); st != 0 || len(slices) != 1 || slices[0].Len != 5 {
+		t.Fatalf("read slices: %s %+v", st, slices)
+	}
+
+	done := make(chan syscall.Errno, 2)
+	go func() { done <- v.Write(ctx, fe.Inode, []byte("world"), 5, fh) }()
+	go func() {
+		_, e := v.Mkdir(ctx, 1, "frozen-dir", 0755, 0)
+		done <- e
+	}()
+	select {
+	case e = <-done:
+		t.Fatalf("modification should be blocked: %s", e)
+	case <-time.After(time.Millisecond * 100):
+	}
+	if st := freeze(0); st != 0 {
+		t.Fatalf("thaw: %s", st)
+	}
+	if st := freeze(0); st != syscall.EINVAL {
+		t.Fatalf("thaw again: %s", st)
+	}
+	for i := 0; i < 2; i++ {
+		if e = <-done; e != 0 {
+			t.Fatalf("modification after thawed: %s", e)
+		}
+	}
+
+	// thawed automatically
+	if st := v.Freeze(ctx, time.Second, time.Millisecond*50); st != 0 {
+		t.Fatalf("freeze: %s", st)
+	}
+	if e = v.Rmdir(ctx, 1, "frozen-dir"); e != 0 {
+		t.Fatalf("rmdir after thawed automatically: %s", e)
+	}
+	if st := v.Freeze(ctx, time.Second, 0); st != 0 {
+		t.Fatalf("freeze: %s", st)
+	}
+	interrupted := &doneContext{meta.Background, make(chan struct{})}
+	close(interrupted.done)
+	if e = v.Unlink(NewLogContext(interrupted), 1, "frozen"); e != syscall.EINTR {
+		t.Fatalf("canceled unlink: %s", e)
+	}
+	// an interrupted release waits until thawed, and releases the handle anyway
+	_, fh2, e := v.Open(ctx, fe.Inode, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("open frozen: %s", e)
+	}
+	released := make(chan struct{})
+	go func() {
+		v.Release(NewLogContext(interrupted), fe.Inode, fh2)
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Fatalf("release should wait until thawed")
+	case <-time.After(time.Millisecond * 200):
+	}
+	_ = v.Thaw(ctx)
+	<-released
+	time.Sleep(time.Millisecond * 100) // the handle is removed asynchronously
+	if v.findHandle(fe.Inode, fh2) != nil {
+		t.Fatalf("handle %d is not released", fh2)
+	}
+}
@@ -36,6 +36,7 @@ const F_UNLCK = syscall.F_UNLCK
 type Statfs struct {
 	Total  uint64
 	Avail  uint64
+	Free   uint64 // including the space held by sustained files and the trash
 	Files  uint64
 	Favail uint64
 }
@@ -46,6 +47,14 @@ func (v *VFS) StatFS(ctx Context, ino Ino) (st *Statfs, err syscall.Errno) {
 	st = new(Statfs)
 	st.Total = totalspace
 	st.Avail = availspace
+	st.Free = availspace
+	var pending meta.PendingUsage
+	if v.Meta.GetPendingUsage(ctx, &pending) == 0 {
+		st.Free += pending.SustainedSpace + pending.TrashSpace
+		if st.Free > totalspace {
+			st.Free = totalspace
+		}
+	}
 	st.Files = iused + iavail
 	st.Favail = iavail
 	logit(ctx, "statfs (%d): OK (%d,%d,%d,%d)", ino, totalspace-availspace, availspace, iused, iavail)
@@ -142,6 +151,12 @@ func (v *VFS) SetAttr(ctx Context, ino Ino, set int, opened uint8, mode, uid, gi
 	defer func() {
 		logit(ctx, "setattr (%d,0x%X,[%s]): %s%s", ino, set, str, strerr(err), (*Entry)(entry))
 	}()
+	if set&meta.SetAttrSize == 0 { // Truncate waits for it by itself
+		if err = v.freezer.enter(ctx); err != 0 {
+			return
+		}
+		defer v.freezer.leave()
+	}
 	if IsSpecialNode(ino) {
 		n := getInternalNode(ino)
 		entry = &meta.Entry{Inode: ino, Attr: n.attr}
@@ -149,6 +164,26 @@ func (v *VFS) SetAttr(ctx Context, ino Ino, set int, opened uint8, mode, uid, gi
 	}
 	err = syscall.EINVAL
 	var attr = &Attr{}
+	if v.times != nil {
+		if isTimestampOnly(uint16(set)) {
+			if err = v.Meta.GetAttr(ctx, ino, attr); err != 0 {
+				return
+			}
+			if err = v.checkTimesPermission(ctx, ino, uint16(set), attr); err != 0 {
+				return
+			}
+			v.UpdateLength(ino, attr)
+			v.times.add(ino, uint16(set), &Attr{Atime: atime, Atimensec: atimensec, Mtime: mtime, Mtimensec: mtimensec})
+			v.times.update(ino, attr)
+			entry = &meta.Entry{Inode: ino, Attr: attr}
+			return
+		}
+		// keep the order of updates
+		if err = v.times.flush(ctx, ino); err != 0 {
+			return
+		}
+		err = syscall.EINVAL
+	}
 	if set&meta.SetAttrSize != 0 {
 		err = v.Truncate(ctx, ino, int64(size), opened, attr)
 		if err != 0 {
@@ -282,3 +317,48 @@ func (v *VFS) Flock(ctx Context, ino Ino, fh uint64, owner uint64, typ uint32, b
 	}
 	return
 }
+
+// ioctl commands and flags of chattr(1) on Linux
+const (
+	FS_IOC_GETFLAGS   = 0x80086601
+	FS_IOC_SETFLAGS   = 0x40086602
+	FS_IOC32_GETFLAGS = 0x80046601
+	FS_IOC32_SETFLAGS = 0x40046602
+
+	FS_IMMUTABLE_FL = 0x00000010
+	FS_APPEND_FL    = 0x00000020
+)
+
+// Ioctl handles FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, so chattr +i/+a works on the inode.
+func (v *VFS) Ioctl(ctx Context, ino Ino, cmd uint32, arg *uint64) (err syscall.Errno) {
+	defer func() { logit(ctx, "ioctl (%d,0x%X,0x%X): %s", ino, cmd, *arg, strerr(err)) }()
+	switch cmd {
+	case FS_IOC_GETFLAGS, FS_IOC32_GETFLAGS:
+		var flags uint8
+		if flags, err = v.ChangeFlags(ctx, ino, 0, 0); err != 0 {
+			return
+		}
+		*arg = 0
+		if flags&meta.FlagImmutable != 0 {
+			*arg |= FS_IMMUTABLE_FL
+		}
+		if flags&meta.FlagAppend != 0 {
+			*arg |= FS_APPEND_FL
+		}
+	case FS_IOC_SETFLAGS, FS_IOC32_SETFLAGS:
+		if *arg&^(FS_IMMUTABLE_FL|FS_APPEND_FL) != 0 {
+			return syscall.ENOTSUP
+		}
+		var add, remove uint8 = 0, meta.FlagImmutable | meta.FlagAppend
+		if *arg&FS_IMMUTABLE_FL != 0 {
+			add |= meta.FlagImmutable
+		}
+		if *arg&FS_APPEND_FL != 0 {
+			add |= meta.FlagAppend
+		}
+		_, err = v.ChangeFlags(ctx, ino, add, remove&^add)
+	default:
+		err = syscall.ENOTTY
+	}
+	return
+}
@@ -43,6 +43,8 @@ type FileWriter interface {
 type DataWriter interface {
 	Open(inode Ino, fleng uint64) FileWriter
 	Flush(ctx meta.Context, inode Ino) syscall.Errno
+	// Sync flushes the buffered data of all the files.
+	Sync(ctx meta.Context) syscall.Errno
 	GetLength(inode Ino) uint64
 	Truncate(inode Ino, length uint64)
 }
@@ -71,7 +73,7 @@ func (s *sliceWriter) prepareID(ctx meta.Context, retry bool) {
 		f.Unlock()
 		st := f.w.m.NewChunk(ctx, &id)
 		f.Lock()
-		if st != 0 && st != syscall.EIO {
+		if st != 0 && !utils.IsRetryable(st) {
 			s.err = st
 			break
 		}
@@ -116,7 +118,7 @@ func (s *sliceWriter) flushData() {
 	if err := s.writer.Finish(int(s.length)); err != nil {
 		logger.Errorf("upload chunk %v (length: %v) fail: %s", s.id, s.length, err)
 		s.writer.Abort()
-		s.err = syscall.EIO
+		s.err = utils.Errno(err)
 	}
 	s.writer = nil
 }
@@ -204,10 +206,6 @@ func (c *chunkWriter) commitThread() {
 
 		f.Lock()
 		if err != 0 {
-			if err != syscall.ENOENT && err != syscall.ENOSPC {
-				logger.Warnf("write inode:%d error: %s", f.inode, err)
-				err = syscall.EIO
-			}
 			f.err = err
 			logger.Errorf("write inode:%d indx:%d  %s", f.inode, c.indx, err)
 		}
@@ -505,6 +503,24 @@ func (w *dataWriter) Flush(ctx meta.Context, inode Ino) syscall.Errno {
 	return 0
 }
 
+func (w *dataWriter) Sync(ctx meta.Context) syscall.Errno {
+	w.Lock()
+	files := make([]*fileWriter, 0, len(w.files))
+	for _, f := range w.files {
+		f.refs++
+		files = append(files, f)
+	}
+	w.Unlock()
+	var err syscall.Errno
+	for _, f := range files {
+		if e := f.Flush(ctx); e != 0 && err == 0 {
+			err = e
+		}
+		w.free(f)
+	}
+	return err
+}
+
 func (w *dataWriter) GetLength(inode Ino) uint64 {
 	f := w.find(inode)
 	if f != nil {
@@ -396,6 +396,7 @@ func jfs_init(cname, jsonConf, user, group, superuser, supergroup *C.char) uintp
 		chunkConf := chunk.Config{
 			BlockSize:      format.BlockSize * 1024,
 			Compress:       format.Compression,
+			CompressDict:   format.CompressDict,
 			CacheDir:       jConf.CacheDir,
 			CacheMode:      0644, // all user can read cache
 			CacheSize:      jConf.CacheSize,